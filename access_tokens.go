@@ -0,0 +1,173 @@
+package chat
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Access tokens are JWTs handed out on login for clients that can't keep
+// a session cookie, like scripts, apps and WebSockets opened from other
+// origins. They are signed with HS256 under a key derived from the secret
+// key for access tokens alone, and name the user, so nothing is kept for
+// them on the server. A banned user's tokens stop working right away. So
+// do a user's tokens once they log out everywhere or reset their
+// password, which bumps the generation the tokens carry; everyone else's
+// tokens work until they expire.
+
+// How long access tokens are valid, or 0 to not hand any out
+var accessTokenTTL = time.Hour
+
+var errInvalidAccessToken = errors.New("Invalid or expired access token")
+
+// accessTokenHeader is the JOSE header of every access token
+type accessTokenHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+}
+
+// accessTokenClaims is the payload of an access token
+type accessTokenClaims struct {
+	Subject   string `json:"sub"`  // User ID
+	Username  string `json:"name"` // For clients to show; the ID is what counts
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	// User's token generation when the token was issued
+	Generation int `json:"gen,omitempty"`
+}
+
+// LoggedIn is the response to logging in or registering. Clients that
+// don't keep the session cookie send the access token as a bearer token
+// instead, or with ?access_token= when connecting to /ws.
+type LoggedIn struct {
+	User
+	AccessToken          string     `json:"accessToken,omitempty"`
+	AccessTokenExpiresAt *time.Time `json:"accessTokenExpiresAt,omitempty"`
+}
+
+// LoggedInFrame confirms a client's {"auth": token}. Its messages are
+// posted under the account from then on.
+type LoggedInFrame struct {
+	LoggedIn string `json:"loggedIn"` // Username
+}
+
+// signAccessToken issues an access token for the user
+func signAccessToken(user User, now time.Time) (string, time.Time, error) {
+	expires := now.Add(accessTokenTTL)
+	header, err := json.Marshal(accessTokenHeader{Alg: "HS256", Typ: "JWT"})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	claims, err := json.Marshal(accessTokenClaims{
+		Subject:   strconv.Itoa(user.ID),
+		Username:  user.Username,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: expires.Unix(),
+
+		Generation: user.TokenGeneration,
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(accessTokenSignature(signed)), expires, nil
+}
+
+// accessTokenSignature is the HMAC of an access token's header and claims
+func accessTokenSignature(signed string) []byte {
+	mac := hmac.New(sha256.New, signingKey(signingKeyAccess))
+	mac.Write([]byte(signed))
+	return mac.Sum(nil)
+}
+
+// isAccessToken tells access tokens from API tokens, which are opaque
+func isAccessToken(token string) bool {
+	return !strings.HasPrefix(token, apiTokenPrefix) && strings.Count(token, ".") == 2
+}
+
+// verifyAccessToken checks the signature and expiry of an access token
+// and returns the user it was issued to, unless they have been banned or
+// its generation has been revoked
+func verifyAccessToken(ctx context.Context, token string) (User, error) {
+	encHeader, rest, _ := strings.Cut(token, ".")
+	encClaims, encSig, ok := strings.Cut(rest, ".")
+	if !ok {
+		return User{}, errInvalidAccessToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(encSig)
+	if err != nil || !hmac.Equal(sig, accessTokenSignature(encHeader+"."+encClaims)) {
+		return User{}, errInvalidAccessToken
+	}
+
+	// The signature holds, but only HS256 JWTs are ever issued
+	var header accessTokenHeader
+	if b, err := base64.RawURLEncoding.DecodeString(encHeader); err != nil || json.Unmarshal(b, &header) != nil || header.Alg != "HS256" || header.Typ != "JWT" {
+		return User{}, errInvalidAccessToken
+	}
+	var claims accessTokenClaims
+	if b, err := base64.RawURLEncoding.DecodeString(encClaims); err != nil || json.Unmarshal(b, &claims) != nil {
+		return User{}, errInvalidAccessToken
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return User{}, errInvalidAccessToken
+	}
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return User{}, errInvalidAccessToken
+	}
+	user, ok := findUserByID(ctx, userID)
+	if !ok || user.Banned || claims.Generation != user.TokenGeneration {
+		return User{}, errInvalidAccessToken
+	}
+	return user, nil
+}
+
+// writeLoggedIn answers a login or registration with the user and, when
+// they are handed out, an access token
+func writeLoggedIn(w http.ResponseWriter, status int, user User) {
+	res := LoggedIn{User: user}
+	if accessTokenTTL > 0 {
+		token, expires, err := signAccessToken(user, time.Now().UTC())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		res.AccessToken, res.AccessTokenExpiresAt = token, &expires
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(res)
+}
+
+// revokeAccessTokens bumps the user's token generation, so every access
+// token issued to them so far stops working
+func revokeAccessTokens(ctx context.Context, userID int) error {
+	_, err := store.UpdateUser(ctx, userID, func(u *User) error {
+		u.TokenGeneration++
+		return nil
+	})
+	return err
+}
+
+// logInClient hands a guest's connection over to the user whose access
+// token it sent
+func logInClient(ws *websocket.Conn, room Room, user User) {
+	hub.do(func() {
+		if c, ok := hub.clients[ws]; ok {
+			c.userID = user.ID
+			c.info.Username = user.Username
+			hub.clients[ws] = c
+		}
+	})
+	if cluster != nil && room.ID != 0 {
+		cluster.connectUser(user.ID, room.ID)
+	}
+}
@@ -0,0 +1,120 @@
+package chat
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useMemoryStore swaps in an empty memory store for the test
+func useMemoryStore(t *testing.T) *memoryStore {
+	t.Helper()
+	s, prev := newMemoryStore(), store
+	store = s
+	t.Cleanup(func() { store = prev })
+	return s
+}
+
+func TestVerifyAccessToken(t *testing.T) {
+	ctx := context.Background()
+	useMemoryStore(t)
+	prevKey := tokenSigningKey
+	tokenSigningKey = []byte("test signing key")
+	t.Cleanup(func() { tokenSigningKey = prevKey })
+
+	user, err := store.CreateUser(ctx, User{Username: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	banned, err := store.CreateUser(ctx, User{Username: "mallory", Banned: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	sign := func(u User, at time.Time) string {
+		token, _, err := signAccessToken(u, at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	valid := sign(user, now)
+	header, claims, _ := strings.Cut(valid, ".")
+	claims, _, _ = strings.Cut(claims, ".")
+	revoked := user
+	revoked.TokenGeneration--
+	unsigned := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`)) + "." + claims + "."
+	// The valid token's header and claims, signed under another key
+	signedWith := func(key []byte, header string) string {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(header + "." + claims))
+		return header + "." + claims + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	}
+	otherType := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"reset"}`))
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"valid", valid, true},
+		{"expired", sign(user, now.Add(-accessTokenTTL-time.Minute)), false},
+		{"tampered signature", valid[:len(valid)-2] + "AA", false},
+		{"tampered claims", header + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"2","exp":9999999999}`)) + valid[strings.LastIndex(valid, "."):], false},
+		{"unsigned", unsigned, false},
+		{"signed with the secret key itself", signedWith(tokenSigningKey, header), false},
+		{"signed with the account token key", signedWith(signingKey(signingKeyAccount), header), false},
+		{"not a JWT type", signedWith(signingKey(signingKeyAccess), otherType), false},
+		{"re-signed with the access token key", signedWith(signingKey(signingKeyAccess), header), true},
+		{"not a JWT", "not-a-token", false},
+		{"banned user", sign(banned, now), false},
+		{"unknown user", sign(User{ID: 99, Username: "ghost"}, now), false},
+		{"revoked generation", sign(revoked, now), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := verifyAccessToken(ctx, tt.token)
+			if tt.ok && (err != nil || got.ID != user.ID) {
+				t.Errorf("verifyAccessToken() = %+v, %v, want %s", got, err, user.Username)
+			}
+			if !tt.ok && err == nil {
+				t.Errorf("verifyAccessToken() accepted the token for %s", got.Username)
+			}
+		})
+	}
+}
+
+func TestRevokeAccessTokens(t *testing.T) {
+	ctx := context.Background()
+	useMemoryStore(t)
+	user, err := store.CreateUser(ctx, User{Username: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _, err := signAccessToken(user, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifyAccessToken(ctx, token); err != nil {
+		t.Fatalf("token rejected before revoking: %v", err)
+	}
+	if err := revokeAccessTokens(ctx, user.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifyAccessToken(ctx, token); err == nil {
+		t.Error("token still accepted after revoking")
+	}
+
+	// Tokens issued afterwards work again
+	user, _ = findUserByID(ctx, user.ID)
+	if token, _, err = signAccessToken(user, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifyAccessToken(ctx, token); err != nil {
+		t.Errorf("new token rejected: %v", err)
+	}
+}
@@ -0,0 +1,254 @@
+package chat
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Purposes of signed account tokens, so a token issued for one flow can't
+// be used in another
+const (
+	tokenPurposeReset  = "reset"
+	tokenPurposeVerify = "verify"
+
+	passwordResetTTL     = time.Hour
+	emailVerificationTTL = 48 * time.Hour
+)
+
+var (
+	// Key for signing account tokens, taken from the config at startup
+	tokenSigningKey []byte
+
+	// Whether new accounts must verify their email before logging in
+	requireEmailVerification bool
+
+	// Externally visible base URL, used for links in emails
+	publicURL string
+
+	errInvalidToken = errors.New("invalid or expired token")
+)
+
+// Kinds of tokens signed under tokenSigningKey, each with its own key
+const (
+	signingKeyAccount = "account token"
+	signingKeyAccess  = "access token"
+)
+
+// signingKey derives the key for one kind of token from tokenSigningKey,
+// so a token of one kind can never pass for another
+func signingKey(kind string) []byte {
+	mac := hmac.New(sha256.New, tokenSigningKey)
+	mac.Write([]byte(kind))
+	return mac.Sum(nil)
+}
+
+// tokenStamp fingerprints the user state a token is bound to. Reset tokens
+// are bound to the password hash, so they stop working once used; verify
+// tokens are bound to the email address they were sent to.
+func tokenStamp(purpose string, user User) string {
+	var sum [32]byte
+	switch purpose {
+	case tokenPurposeReset:
+		sum = sha256.Sum256(user.PasswordHash)
+	default:
+		sum = sha256.Sum256([]byte(strings.ToLower(user.Email)))
+	}
+	return hex.EncodeToString(sum[:8])
+}
+
+// signAccountToken creates a token for the user that expires after ttl.
+// The format is base64(purpose|userID|expiry|stamp) "." base64(HMAC).
+func signAccountToken(purpose string, user User, ttl time.Duration) string {
+	expires := time.Now().Add(ttl).Unix()
+	payload := fmt.Sprintf("%s|%d|%d|%s", purpose, user.ID, expires, tokenStamp(purpose, user))
+
+	mac := hmac.New(sha256.New, signingKey(signingKeyAccount))
+	mac.Write([]byte(payload))
+
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyAccountToken checks the signature, purpose, expiry and stamp of a
+// token and returns the user it was issued for
+func verifyAccountToken(ctx context.Context, purpose, token string) (User, error) {
+	encPayload, encSig, ok := strings.Cut(token, ".")
+	if !ok {
+		return User{}, errInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encPayload)
+	if err != nil {
+		return User{}, errInvalidToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(encSig)
+	if err != nil {
+		return User{}, errInvalidToken
+	}
+
+	mac := hmac.New(sha256.New, signingKey(signingKeyAccount))
+	mac.Write(payload)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return User{}, errInvalidToken
+	}
+
+	parts := strings.Split(string(payload), "|")
+	if len(parts) != 4 || parts[0] != purpose {
+		return User{}, errInvalidToken
+	}
+	userID, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return User{}, errInvalidToken
+	}
+	expires, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return User{}, errInvalidToken
+	}
+
+	user, ok := findUserByID(ctx, userID)
+	if !ok {
+		return User{}, errInvalidToken
+	}
+	if subtle.ConstantTimeCompare([]byte(parts[3]), []byte(tokenStamp(purpose, user))) != 1 {
+		return User{}, errInvalidToken
+	}
+	return user, nil
+}
+
+// sendVerificationEmail emails the user a link that verifies their address
+func sendVerificationEmail(user User) {
+	token := signAccountToken(tokenPurposeVerify, user, emailVerificationTTL)
+	link := publicURL + "/auth/verify-email?token=" + url.QueryEscape(token)
+
+	sendEmail(emailVerifyAddress, EmailData{User: user, Link: link, ExpiresIn: "48 hours"})
+}
+
+// EmailRequest is the request body for flows that start from an address
+type EmailRequest struct {
+	Email string `json:"email"`
+}
+
+// PasswordReset is the request body for completing a password reset
+type PasswordReset struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+///////////////////////////////////
+// Account Recovery API Handlers //
+///////////////////////////////////
+
+// Email a password reset link (POST /auth/password-reset)
+func requestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	var req EmailRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Always answer the same way so the endpoint can't be used to find
+	// out which addresses have accounts
+	if user, ok := findUserByEmail(r.Context(), req.Email); ok && user.PasswordHash != nil {
+		token := signAccountToken(tokenPurposeReset, user, passwordResetTTL)
+		link := publicURL + "/?resetToken=" + url.QueryEscape(token)
+
+		sendEmail(emailPasswordReset, EmailData{User: user, Link: link, ExpiresIn: "one hour"})
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// Set a new password with a reset token (POST /auth/password-reset/confirm)
+func confirmPasswordReset(w http.ResponseWriter, r *http.Request) {
+	var req PasswordReset
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(req.Password) < minPasswordLength {
+		http.Error(w, "Password must be at least 8 characters", http.StatusBadRequest)
+		return
+	}
+
+	user, err := verifyAccountToken(r.Context(), tokenPurposeReset, req.Token)
+	if err != nil {
+		http.Error(w, "Invalid or expired reset link", http.StatusBadRequest)
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Receiving the reset email proves ownership of the address too. A
+	// reset usually means the old password leaked, so every access token
+	// issued so far is revoked with it.
+	// Until the new hash is saved the token stays valid, so the user can
+	// try again
+	if _, ok := updateUser(r.Context(), user.ID, func(u *User) {
+		u.PasswordHash = hash
+		u.EmailVerified = true
+		u.TokenGeneration++
+	}); !ok {
+		http.Error(w, "Could not save the new password", http.StatusInternalServerError)
+		return
+	}
+
+	// And every session ends
+	if err := sessions.DeleteUser(user.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Verify an email address from the link in the verification email
+// (GET /auth/verify-email)
+func verifyEmail(w http.ResponseWriter, r *http.Request) {
+	user, err := verifyAccountToken(r.Context(), tokenPurposeVerify, r.URL.Query().Get("token"))
+	if err != nil {
+		http.Error(w, "Invalid or expired verification link", http.StatusBadRequest)
+		return
+	}
+
+	if _, ok := updateUser(r.Context(), user.ID, func(u *User) { u.EmailVerified = true }); !ok {
+		http.Error(w, "Could not verify the email address", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/?emailVerified=1", http.StatusFound)
+}
+
+// Send a new verification email (POST /auth/verify-email/resend)
+func resendVerificationEmail(w http.ResponseWriter, r *http.Request) {
+	var req EmailRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if user, ok := findUserByEmail(r.Context(), req.Email); ok && !user.EmailVerified {
+		sendVerificationEmail(user)
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
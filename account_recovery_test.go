@@ -0,0 +1,161 @@
+package chat
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyAccountToken(t *testing.T) {
+	ctx := context.Background()
+	useMemoryStore(t)
+	prevKey := tokenSigningKey
+	tokenSigningKey = []byte("test signing key")
+	t.Cleanup(func() { tokenSigningKey = prevKey })
+
+	user, err := store.CreateUser(ctx, User{Username: "alice", Email: "alice@example.com", PasswordHash: []byte("hash")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign := signAccountToken
+	reset := sign(tokenPurposeReset, user, time.Hour)
+	payload, sig, _ := strings.Cut(reset, ".")
+	rehashed, readdressed := user, user
+	rehashed.PasswordHash = []byte("old hash")
+	readdressed.Email = "old@example.com"
+	decoded, _ := base64.RawURLEncoding.DecodeString(payload)
+	mac := hmac.New(sha256.New, signingKey(signingKeyAccess))
+	mac.Write(decoded)
+	accessKeyMAC := mac.Sum(nil)
+	otherKey := func() string {
+		tokenSigningKey = []byte("another key")
+		defer func() { tokenSigningKey = []byte("test signing key") }()
+		return sign(tokenPurposeReset, user, time.Hour)
+	}()
+
+	tests := []struct {
+		name    string
+		purpose string
+		token   string
+		ok      bool
+	}{
+		{"reset", tokenPurposeReset, reset, true},
+		{"verify", tokenPurposeVerify, sign(tokenPurposeVerify, user, time.Hour), true},
+		{"email case", tokenPurposeVerify, sign(tokenPurposeVerify, User{ID: user.ID, Email: "Alice@Example.com"}, time.Hour), true},
+		{"other purpose", tokenPurposeVerify, reset, false},
+		{"expired", tokenPurposeReset, sign(tokenPurposeReset, user, -time.Minute), false},
+		{"password since changed", tokenPurposeReset, sign(tokenPurposeReset, rehashed, time.Hour), false},
+		{"email since changed", tokenPurposeVerify, sign(tokenPurposeVerify, readdressed, time.Hour), false},
+		{"unknown user", tokenPurposeReset, sign(tokenPurposeReset, User{ID: 99, PasswordHash: user.PasswordHash}, time.Hour), false},
+		{"other key", tokenPurposeReset, otherKey, false},
+		{"access token key", tokenPurposeReset, payload + "." + base64.RawURLEncoding.EncodeToString(accessKeyMAC), false},
+		{"tampered signature", tokenPurposeReset, payload + "." + sig[:len(sig)-2] + "AA", false},
+		{"no signature", tokenPurposeReset, payload, false},
+		{"not base64", tokenPurposeReset, "!!." + sig, false},
+		{"empty", tokenPurposeReset, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := verifyAccountToken(ctx, tt.purpose, tt.token)
+			if tt.ok && (err != nil || got.ID != user.ID) {
+				t.Errorf("verifyAccountToken() = %+v, %v, want %s", got, err, user.Username)
+			}
+			if !tt.ok && err == nil {
+				t.Errorf("verifyAccountToken() accepted the token for %s", got.Username)
+			}
+		})
+	}
+}
+
+// failingUserUpdates is a store that can't save changes to users
+type failingUserUpdates struct{ Store }
+
+func (failingUserUpdates) UpdateUser(ctx context.Context, id int, fn func(u *User) error) (User, error) {
+	return User{}, errors.New("disk full")
+}
+
+func TestConfirmPasswordReset(t *testing.T) {
+	ctx := context.Background()
+	mem := useMemoryStore(t)
+	prevKey, prevSessions := tokenSigningKey, sessions
+	tokenSigningKey = []byte("test signing key")
+	sessions = newMemorySessionStore()
+	t.Cleanup(func() { tokenSigningKey, sessions = prevKey, prevSessions })
+
+	user, err := store.CreateUser(ctx, User{Username: "alice", Email: "alice@example.com", PasswordHash: []byte("hash")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := signAccountToken(tokenPurposeReset, user, passwordResetTTL)
+	confirm := func(password string) int {
+		body := `{"token":"` + token + `","password":"` + password + `"}`
+		w := httptest.NewRecorder()
+		confirmPasswordReset(w, httptest.NewRequest("POST", "/auth/password-reset/confirm", strings.NewReader(body)))
+		return w.Code
+	}
+
+	if code := confirm("short"); code != http.StatusBadRequest {
+		t.Errorf("short password: status %d", code)
+	}
+	// A reset that can't be saved leaves the token for another try
+	store = failingUserUpdates{mem}
+	if code := confirm("a new password"); code != http.StatusInternalServerError {
+		t.Errorf("failed save: status %d", code)
+	}
+	store = mem
+	if code := confirm("a new password"); code != http.StatusNoContent {
+		t.Fatalf("reset: status %d", code)
+	}
+	got, _ := findUserByID(ctx, user.ID)
+	if !got.EmailVerified || got.TokenGeneration != user.TokenGeneration+1 {
+		t.Errorf("after reset: verified %v, token generation %d", got.EmailVerified, got.TokenGeneration)
+	}
+	// The new password hash retires the token
+	if code := confirm("another password"); code != http.StatusBadRequest {
+		t.Errorf("second reset: status %d", code)
+	}
+}
+
+func TestVerifyEmail(t *testing.T) {
+	ctx := context.Background()
+	mem := useMemoryStore(t)
+	prevKey := tokenSigningKey
+	tokenSigningKey = []byte("test signing key")
+	t.Cleanup(func() { tokenSigningKey, store = prevKey, mem })
+
+	user, err := store.CreateUser(ctx, User{Username: "alice", Email: "alice@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := signAccountToken(tokenPurposeVerify, user, emailVerificationTTL)
+
+	tests := []struct {
+		name   string
+		store  Store
+		want   int
+		marked bool
+	}{
+		{"failed save", failingUserUpdates{mem}, http.StatusInternalServerError, false},
+		{"verified", mem, http.StatusFound, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store = tt.store
+			w := httptest.NewRecorder()
+			verifyEmail(w, httptest.NewRequest("GET", "/auth/verify-email?token="+token, nil))
+			if w.Code != tt.want {
+				t.Errorf("status %d, want %d", w.Code, tt.want)
+			}
+			if got, _ := mem.GetUser(ctx, user.ID); got.EmailVerified != tt.marked {
+				t.Errorf("verified = %v", got.EmailVerified)
+			}
+		})
+	}
+}
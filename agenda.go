@@ -0,0 +1,127 @@
+package chat
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// How far back the agenda looks for mentions in rooms the user has
+	// no read marker in
+	agendaMentionsSince = 24 * time.Hour
+	// Latest messages of each room searched for mentions
+	agendaMessagesPerRoom = 500
+	agendaMaxMentions     = 50
+)
+
+// A mention, "@username" or the urgent "@@username"
+var mentionPattern = regexp.MustCompile(`@@?([^\s@,.:;!?]+)`)
+
+// Agenda is the logged-in user's day in the workspace
+type Agenda struct {
+	Date     string    `json:"date"`     // Today, in the requested time zone
+	DueToday []Task    `json:"dueToday"` // Open tasks assigned to the user due today
+	Overdue  []Task    `json:"overdue"`  // Open tasks assigned to the user due before today
+	Mentions []Message `json:"mentions"` // Unread messages mentioning the user, newest first
+	Pinned   []Pin     `json:"pinned"`   // Pinned messages of the workspace, newest pin first
+}
+
+// mentions reports whether a message mentions username
+func mentions(content, username string) bool {
+	for _, m := range mentionPattern.FindAllStringSubmatch(content, -1) {
+		if strings.EqualFold(m[1], username) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the logged-in user's agenda: their open tasks due today or overdue,
+// the messages mentioning them past their read marker in each room, and the
+// pinned announcements (GET /me/agenda). ?tz= picks the time zone of "today"
+// (default UTC).
+func getAgenda(w http.ResponseWriter, r *http.Request) {
+	user, _ := currentUser(r)
+
+	query := r.URL.Query()
+	loc := time.UTC
+	if tz := query.Get("tz"); tz != "" {
+		var err error
+		if loc, err = time.LoadLocation(tz); err != nil {
+			http.Error(w, "Unknown time zone "+tz, http.StatusBadRequest)
+			return
+		}
+	}
+	now := time.Now().In(loc)
+
+	ws := requestWorkspace(r)
+	tasks, err := store.ListTasks(r.Context(), ws.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+	tomorrow := today.AddDate(0, 0, 1)
+	agenda := Agenda{Date: today.Format(time.DateOnly), DueToday: []Task{}, Overdue: []Task{}, Mentions: []Message{}}
+	for _, task := range tasks {
+		if task.DueDate == nil || task.Status == "completed" || !strings.EqualFold(task.Assignee, user.Username) {
+			continue
+		}
+		switch {
+		case task.DueDate.Before(today):
+			agenda.Overdue = append(agenda.Overdue, task)
+		case task.DueDate.Before(tomorrow):
+			agenda.DueToday = append(agenda.DueToday, task)
+		}
+	}
+	byDueDate := func(a, b Task) int { return a.DueDate.Compare(*b.DueDate) }
+	slices.SortFunc(agenda.DueToday, byDueDate)
+	slices.SortFunc(agenda.Overdue, byDueDate)
+
+	rooms, err := store.ListRooms(r.Context(), ws.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	markers, err := store.ListReadMarkers(r.Context(), user.ID, ws.ID, time.Time{})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	read := readMarkersByRoom(markers)
+	since := now.Add(-agendaMentionsSince)
+	for _, room := range rooms {
+		msgs, err := chatService.History(r.Context(), room, 0, agendaMessagesPerRoom)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		marker, hasMarker := read[room.ID]
+		for _, m := range msgs {
+			unread := m.CreatedAt.After(since)
+			if hasMarker {
+				unread = m.ID > marker.MessageID
+			}
+			if unread && m.UserID != user.ID && mentions(m.Content, user.Username) {
+				m.Room = room.Name
+				agenda.Mentions = append(agenda.Mentions, m)
+			}
+		}
+	}
+	slices.SortFunc(agenda.Mentions, func(a, b Message) int { return b.CreatedAt.Compare(a.CreatedAt) })
+	if len(agenda.Mentions) > agendaMaxMentions {
+		agenda.Mentions = agenda.Mentions[:agendaMaxMentions]
+	}
+
+	if agenda.Pinned, err = store.ListPins(r.Context(), ws.ID, 0); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(agenda)
+}
@@ -0,0 +1,101 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestGetAgenda(t *testing.T) {
+	ctx := context.Background()
+	useMemoryStore(t)
+	prevQueue := messageQueue
+	messageQueue = newMessageWriter(store, MessageWriterConfig{})
+	t.Cleanup(func() {
+		messageQueue.Close()
+		messageQueue = prevQueue
+	})
+
+	ws, err := store.CreateWorkspace(ctx, Workspace{Slug: "acme", Name: "Acme"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	general, err := store.CreateRoom(ctx, Room{WorkspaceID: ws.ID, Name: "general"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	random, err := store.CreateRoom(ctx, Room{WorkspaceID: ws.ID, Name: "random"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := User{ID: 1, Username: "alice"}
+	now := time.Now().UTC()
+	// Messages 1-3 in general, 4-5 in random
+	if err := store.SaveMessages(ctx, []Message{
+		{RoomID: general.ID, UserID: 2, Username: "bob", Content: "@alice read", CreatedAt: now.Add(-time.Hour)},
+		{RoomID: general.ID, UserID: 2, Username: "bob", Content: "@alice unread", CreatedAt: now.Add(-time.Hour)},
+		{RoomID: general.ID, UserID: 2, Username: "bob", Content: "Release on Friday", CreatedAt: now.Add(-time.Hour)},
+		{RoomID: random.ID, UserID: 2, Username: "bob", Content: "@alice last week", CreatedAt: now.Add(-7 * 24 * time.Hour)},
+		{RoomID: random.ID, UserID: 2, Username: "bob", Content: "@alice today", CreatedAt: now.Add(-time.Minute)},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.SetReadMarker(ctx, ReadMarker{UserID: alice.ID, RoomID: general.ID, WorkspaceID: ws.ID, MessageID: 1, UpdatedAt: now}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		pin      string // Message ID pinned in general first
+		status   int
+		mentions []string
+		pinned   []string
+	}{
+		{"unread past the marker", "", 0, []string{"@alice today", "@alice unread"}, nil},
+		{"pinned", "3", 200, []string{"@alice today", "@alice unread"}, []string{"Release on Friday"}},
+		{"pinned from another room", "5", 404, []string{"@alice today", "@alice unread"}, []string{"Release on Friday"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.pin != "" {
+				r := httptest.NewRequest("PUT", "/rooms/general/pins/"+tt.pin, nil)
+				r = r.WithContext(context.WithValue(r.Context(), workspaceContextKey{}, ws))
+				r = r.WithContext(context.WithValue(r.Context(), userContextKey{}, alice))
+				r = mux.SetURLVars(r, map[string]string{"name": "general", "id": tt.pin})
+				w := httptest.NewRecorder()
+				pinMessage(w, r)
+				if w.Code != tt.status {
+					t.Fatalf("pin status %d, want %d: %s", w.Code, tt.status, w.Body)
+				}
+			}
+
+			r := httptest.NewRequest("GET", "/me/agenda", nil)
+			r = r.WithContext(context.WithValue(r.Context(), workspaceContextKey{}, ws))
+			r = r.WithContext(context.WithValue(r.Context(), userContextKey{}, alice))
+			w := httptest.NewRecorder()
+			getAgenda(w, r)
+			var agenda Agenda
+			if err := json.NewDecoder(w.Body).Decode(&agenda); err != nil {
+				t.Fatal(err)
+			}
+			var mentions, pinned []string
+			for _, m := range agenda.Mentions {
+				mentions = append(mentions, m.Content)
+			}
+			for _, p := range agenda.Pinned {
+				pinned = append(pinned, p.Message.Content)
+			}
+			if fmt.Sprint(mentions) != fmt.Sprint(tt.mentions) {
+				t.Errorf("mentions %q, want %q", mentions, tt.mentions)
+			}
+			if fmt.Sprint(pinned) != fmt.Sprint(tt.pinned) {
+				t.Errorf("pinned %q, want %q", pinned, tt.pinned)
+			}
+		})
+	}
+}
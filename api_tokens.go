@@ -0,0 +1,351 @@
+package chat
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Scopes that can be granted to an API token
+const (
+	scopeRead     = "read"      // Safe (GET) requests to the REST API, and reading chat
+	scopeTasks    = "tasks"     // Full access to the task API
+	scopeChatPost = "chat:post" // Posting chat messages over /ws
+	scopeAdmin    = "admin"     // The admin API; only admins can grant it
+)
+
+var allScopes = []string{scopeRead, scopeTasks, scopeChatPost, scopeAdmin}
+
+// Prefix of every API token, so leaked tokens are easy to recognise
+const apiTokenPrefix = "chat_"
+
+// APIToken is a personal access token for scripts and bots. Only a hash of
+// the secret is kept; the token itself is shown once when it's created.
+type APIToken struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"-"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	Hint       string     `json:"hint"` // Last characters of the token
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+	Hash       string     `json:"-"`
+	// Admin who minted the token to act as its owner for support; their
+	// requests are audited under both names
+	ImpersonatedBy string `json:"impersonatedBy,omitempty"`
+}
+
+// NewAPIToken is the request body for minting a token
+type NewAPIToken struct {
+	Name      string   `json:"name"`
+	Scopes    []string `json:"scopes"`
+	ExpiresIn string   `json:"expiresIn,omitempty"` // Go duration, e.g. "720h"; empty never expires
+}
+
+// CreatedAPIToken is returned once, when a token is minted
+type CreatedAPIToken struct {
+	APIToken
+	Token string `json:"token"`
+}
+
+// How often a token's last use is saved; requests in between don't write
+// to the store
+const apiTokenTouchInterval = time.Minute
+
+// Context key for the API token a request was authenticated with
+type apiTokenContextKey struct{}
+
+func (t APIToken) hasScope(scope string) bool {
+	return slices.Contains(t.Scopes, scope)
+}
+
+func (t APIToken) expired(now time.Time) bool {
+	return t.ExpiresAt != nil && now.After(*t.ExpiresAt)
+}
+
+// newAPITokenSecret generates the secret of a new token
+func newAPITokenSecret() (string, error) {
+	secret, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	return apiTokenPrefix + secret, nil
+}
+
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// findAPIToken returns the unexpired token matching the secret and marks it
+// as used
+func findAPIToken(ctx context.Context, secret string) (APIToken, bool) {
+	token, err := store.FindAPIToken(ctx, hashAPIToken(secret))
+	if err != nil {
+		if !errors.Is(err, errNotFound) {
+			log.Printf("Looking up API token: %v", err)
+		}
+		return APIToken{}, false
+	}
+	now := time.Now().UTC()
+	if token.expired(now) {
+		return APIToken{}, false
+	}
+	if token.LastUsedAt == nil || now.Sub(*token.LastUsedAt) >= apiTokenTouchInterval {
+		touched, err := store.UpdateAPIToken(ctx, token.ID, func(t *APIToken) error {
+			t.LastUsedAt = &now
+			return nil
+		})
+		if err != nil {
+			log.Printf("Recording use of API token %d: %v", token.ID, err)
+		} else {
+			token = touched
+		}
+	}
+	return token, true
+}
+
+// bearerToken extracts an API or access token from the Authorization
+// header. Browsers can't set headers on WebSocket handshakes, so /ws also
+// accepts an access_token query parameter.
+func bearerToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		scheme, token, ok := strings.Cut(auth, " ")
+		if ok && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+		return ""
+	}
+	if isChatPath(r.URL.Path) {
+		return r.URL.Query().Get("access_token")
+	}
+	return ""
+}
+
+// Middleware that authenticates requests carrying an API token and rejects
+// those outside the token's scopes. Access tokens from logging in act like
+// the session cookie. Requests without a token pass through unchanged.
+func apiTokenMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secret := bearerToken(r)
+		if secret == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if isAccessToken(secret) {
+			user, err := verifyAccessToken(r.Context(), secret)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userContextKey{}, user)))
+			return
+		}
+		if !featureEnabled(r, featureAPITokens) {
+			writeFeatureDisabled(w, "API token access")
+			return
+		}
+
+		token, ok := findAPIToken(r.Context(), secret)
+		if !ok {
+			http.Error(w, "Invalid or expired API token", http.StatusUnauthorized)
+			return
+		}
+		user, ok := findUserByID(r.Context(), token.UserID)
+		if !ok || user.Banned {
+			http.Error(w, "Invalid or expired API token", http.StatusUnauthorized)
+			return
+		}
+		ctx := context.WithValue(r.Context(), userContextKey{}, user)
+		ctx = context.WithValue(ctx, apiTokenContextKey{}, token)
+		r = r.WithContext(ctx)
+		if token.ImpersonatedBy != "" {
+			recordAudit(r, "impersonation.request", user.Username, r.Method+" "+r.URL.Path)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestAPIToken returns the API token the request was authenticated
+// with, if any
+func requestAPIToken(r *http.Request) (APIToken, bool) {
+	token, ok := r.Context().Value(apiTokenContextKey{}).(APIToken)
+	return token, ok
+}
+
+////////////////////////////
+// API Token API Handlers //
+////////////////////////////
+
+// List the current user's API tokens (GET /me/tokens)
+func listAPITokens(w http.ResponseWriter, r *http.Request) {
+	user, _ := currentUser(r)
+
+	list, err := store.ListAPITokens(r.Context(), user.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(list)
+}
+
+// Mint a new API token (POST /me/tokens)
+func createAPIToken(w http.ResponseWriter, r *http.Request) {
+	user, _ := currentUser(r)
+	if !featureEnabled(r, featureAPITokens) {
+		writeFeatureDisabled(w, "API token access")
+		return
+	}
+
+	var req NewAPIToken
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		http.Error(w, "Token name is required", http.StatusBadRequest)
+		return
+	}
+	if len(req.Scopes) == 0 {
+		http.Error(w, "At least one scope is required", http.StatusBadRequest)
+		return
+	}
+	for _, s := range req.Scopes {
+		if !slices.Contains(allScopes, s) {
+			http.Error(w, "Unknown scope: "+s+" (expected one of "+strings.Join(allScopes, ", ")+")", http.StatusBadRequest)
+			return
+		}
+	}
+	if slices.Contains(req.Scopes, scopeAdmin) && user.Role != roleAdmin {
+		http.Error(w, "Only admins can grant the admin scope", http.StatusForbidden)
+		return
+	}
+
+	now := time.Now().UTC()
+	var expiresAt *time.Time
+	if req.ExpiresIn != "" {
+		d, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || d <= 0 {
+			http.Error(w, "Invalid expiresIn duration", http.StatusBadRequest)
+			return
+		}
+		t := now.Add(d)
+		expiresAt = &t
+	}
+
+	secret, err := newAPITokenSecret()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	token, err := store.CreateAPIToken(r.Context(), APIToken{
+		UserID:    user.ID,
+		Name:      req.Name,
+		Scopes:    slices.Compact(slices.Sorted(slices.Values(req.Scopes))),
+		Hint:      secret[len(secret)-4:],
+		CreatedAt: now,
+		ExpiresAt: expiresAt,
+		Hash:      hashAPIToken(secret),
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(r, "api_token.create", user.Username, "token "+strconv.Itoa(token.ID)+" scopes="+strings.Join(token.Scopes, ","))
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(CreatedAPIToken{APIToken: token, Token: secret})
+}
+
+// Revoke an API token (DELETE /me/tokens/{id})
+func revokeAPIToken(w http.ResponseWriter, r *http.Request) {
+	user, _ := currentUser(r)
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid token ID", http.StatusBadRequest)
+		return
+	}
+
+	token, err := store.GetAPIToken(r.Context(), id)
+	if errors.Is(err, errNotFound) || err == nil && token.UserID != user.ID {
+		http.Error(w, "Token not found", http.StatusNotFound)
+		return
+	}
+	if err == nil {
+		err = store.DeleteAPIToken(r.Context(), id)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r, "api_token.revoke", user.Username, "token "+strconv.Itoa(id))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// List a user's API tokens (GET /admin/users/{id}/tokens)
+func listUserAPITokens(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	list, err := store.ListAPITokens(r.Context(), id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(list)
+}
+
+// Replace the secret of any API token, keeping its name, scopes and
+// expiry; the old secret stops working at once
+// (POST /admin/tokens/{id}/rotate)
+func rotateAPIToken(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid token ID", http.StatusBadRequest)
+		return
+	}
+
+	secret, err := newAPITokenSecret()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	token, err := store.UpdateAPIToken(r.Context(), id, func(t *APIToken) error {
+		t.Hash = hashAPIToken(secret)
+		t.Hint = secret[len(secret)-4:]
+		t.LastUsedAt = nil
+		return nil
+	})
+	if errors.Is(err, errNotFound) {
+		http.Error(w, "Token not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	owner, _ := findUserByID(r.Context(), token.UserID)
+	recordAudit(r, "api_token.rotate", owner.Username, "token "+strconv.Itoa(id))
+	json.NewEncoder(w).Encode(CreatedAPIToken{APIToken: token, Token: secret})
+}
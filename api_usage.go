@@ -0,0 +1,71 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"time"
+)
+
+// APIUsage is what counts against the caller's limits right now, so
+// integrators can tell why they got a 429 without asking an admin
+type APIUsage struct {
+	Window   int            `json:"window"`   // Seconds of the sliding rate limit window
+	Requests RateLimitUsage `json:"requests"` // API requests
+	Messages RateLimitUsage `json:"messages"` // Chat messages
+	// Requests answered 429 within the window
+	Throttled int          `json:"throttled"`
+	Storage   StorageUsage `json:"storage"`
+	// Token the request authenticated with; absent for session logins
+	Token *APIToken `json:"token,omitempty"`
+}
+
+// RateLimitUsage is one rate limit bucket
+type RateLimitUsage struct {
+	Used      int `json:"used"`
+	Limit     int `json:"limit,omitempty"`     // 0 when unlimited
+	Remaining int `json:"remaining,omitempty"` // Left in the window, when limited
+	// Seconds until the oldest counted event leaves the window
+	ResetsIn int `json:"resetsIn"`
+}
+
+// rateLimitUsage reads a bucket without counting against it
+func rateLimitUsage(ctx context.Context, key string, limit int) RateLimitUsage {
+	used, reset, err := rateLimiter.Count(ctx, key, currentRateLimits().Window)
+	if err != nil {
+		log.Printf("Reading the rate limit of %s failed: %v", key, err)
+	}
+	usage := RateLimitUsage{Used: used, Limit: limit, ResetsIn: int(math.Ceil(reset.Seconds()))}
+	if limit > 0 {
+		usage.Remaining = max(0, limit-used)
+	}
+	return usage
+}
+
+// Get the caller's rate limits, storage and token (GET /me/usage)
+func getMyUsage(w http.ResponseWriter, r *http.Request) {
+	user, _ := currentUser(r)
+	ctx := r.Context()
+	storage, err := userStorageUsage(ctx, user.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	limits := currentRateLimits()
+	apiKey := rateLimitKey(r, "api")
+	throttled := rateLimitUsage(ctx, "throttled:"+apiKey, 0)
+	usage := APIUsage{
+		Window:    int(limits.Window / time.Second),
+		Requests:  rateLimitUsage(ctx, apiKey, limits.Requests),
+		Messages:  rateLimitUsage(ctx, rateLimitKey(r, "chat"), limits.Messages),
+		Throttled: throttled.Used,
+		Storage:   storage,
+	}
+	if token, ok := requestAPIToken(r); ok {
+		usage.Token = &token
+	}
+	json.NewEncoder(w).Encode(usage)
+}
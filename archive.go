@@ -0,0 +1,303 @@
+package chat
+
+import (
+	"cmp"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ArchiveConfig moves old chat messages out of the store into gzipped
+// JSON Lines files, one directory per room, which history reads when it
+// runs out of stored messages. In a cluster, Dir must be shared by the
+// nodes, e.g. an NFS or S3 mount; only one node archives at a time.
+type ArchiveConfig struct {
+	Dir   string        // Directory of the archive; empty disables archiving
+	After time.Duration // Age at which messages are archived
+}
+
+const (
+	// How often the archiver looks for messages to move
+	archiveInterval = time.Hour
+	// Messages moved per archive file
+	archiveBatchSize = 1000
+)
+
+// archiveConfig is the archive of the running server
+var archiveConfig ArchiveConfig
+
+// archivedMessage is how a message is kept in the archive, with the
+// fields Message leaves out of its JSON
+type archivedMessage struct {
+	Message
+	RoomID      int `json:"roomId"`
+	WorkspaceID int `json:"workspaceId,omitempty"`
+	UserID      int `json:"userId,omitempty"`
+}
+
+func (m archivedMessage) message() Message {
+	msg := m.Message
+	msg.RoomID, msg.WorkspaceID, msg.UserID = m.RoomID, m.WorkspaceID, m.UserID
+	return msg
+}
+
+// archiveFile is a file of the archive, holding the messages of one room
+// with IDs from first to last
+type archiveFile struct {
+	path        string
+	first, last int
+}
+
+// runArchiver archives old messages every archiveInterval
+func runArchiver() {
+	for now := range time.Tick(archiveInterval) {
+		if archiveConfig.Dir == "" || archiveConfig.After <= 0 {
+			continue
+		}
+		// Nodes archiving side by side would write the same messages twice
+		if cluster != nil && !cluster.leader() {
+			continue
+		}
+		if err := archiveMessages(now.Add(-archiveConfig.After)); err != nil {
+			log.Printf("Archiving messages failed: %v", err)
+		}
+	}
+}
+
+// archiveMessages moves the messages posted before cutoff to the archive,
+// a batch at a time. Each batch is written out before it's deleted from
+// the store, so a failure leaves the messages where they were.
+func archiveMessages(cutoff time.Time) error {
+	total := 0
+	for {
+		ctx, cancel := storeContext()
+		// SQLite compares times as text, so they must all be in UTC
+		msgs, err := store.ListMessagesBefore(ctx, cutoff.UTC(), archiveBatchSize)
+		cancel()
+		if err != nil {
+			return err
+		}
+		if len(msgs) == 0 {
+			break
+		}
+
+		byRoom := make(map[int][]Message)
+		for _, msg := range msgs {
+			byRoom[msg.RoomID] = append(byRoom[msg.RoomID], msg)
+		}
+		for roomID, roomMsgs := range byRoom {
+			if err := writeArchiveFile(archiveConfig.Dir, roomID, roomMsgs); err != nil {
+				return fmt.Errorf("room %d: %w", roomID, err)
+			}
+		}
+
+		ids := make([]int, len(msgs))
+		for i, msg := range msgs {
+			ids[i] = msg.ID
+		}
+		ctx, cancel = storeContext()
+		err = store.DeleteMessageIDs(ctx, ids)
+		cancel()
+		if err != nil {
+			return err
+		}
+		total += len(msgs)
+		if len(msgs) < archiveBatchSize {
+			break
+		}
+	}
+	if total > 0 {
+		log.Printf("Archived %d messages posted before %s", total, cutoff.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// writeArchiveFile writes the messages of a room, oldest first, to a new
+// file of the archive. The file only appears once it's complete.
+func writeArchiveFile(dir string, roomID int, msgs []Message) error {
+	roomDir := filepath.Join(dir, strconv.Itoa(roomID))
+	if err := os.MkdirAll(roomDir, 0750); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%d-%d.jsonl.gz", msgs[0].ID, msgs[len(msgs)-1].ID)
+	return replaceArchiveFile(filepath.Join(roomDir, name), msgs)
+}
+
+// replaceArchiveFile writes messages, oldest first, to a file of the
+// archive, in place of the one there if any. Readers see either file
+// whole.
+func replaceArchiveFile(path string, msgs []Message) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	zw := gzip.NewWriter(tmp)
+	enc := json.NewEncoder(zw)
+	for _, msg := range msgs {
+		a := archivedMessage{Message: msg, RoomID: msg.RoomID, WorkspaceID: msg.WorkspaceID, UserID: msg.UserID}
+		if err := enc.Encode(a); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// archiveFiles lists the archive files of a room, newest first
+func archiveFiles(dir string, roomID int) ([]archiveFile, error) {
+	roomDir := filepath.Join(dir, strconv.Itoa(roomID))
+	entries, err := os.ReadDir(roomDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var files []archiveFile
+	for _, e := range entries {
+		ids, ok := strings.CutSuffix(e.Name(), ".jsonl.gz")
+		if !ok {
+			continue
+		}
+		first, last, ok := strings.Cut(ids, "-")
+		if !ok {
+			continue
+		}
+		f := archiveFile{path: filepath.Join(roomDir, e.Name())}
+		var err1, err2 error
+		f.first, err1 = strconv.Atoi(first)
+		f.last, err2 = strconv.Atoi(last)
+		if err1 == nil && err2 == nil {
+			files = append(files, f)
+		}
+	}
+	slices.SortFunc(files, func(a, b archiveFile) int { return cmp.Compare(b.first, a.first) })
+	return files, nil
+}
+
+// readArchiveFile returns the messages of an archive file, oldest first
+func readArchiveFile(path string) ([]Message, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	var msgs []Message
+	dec := json.NewDecoder(zr)
+	for dec.More() {
+		var a archivedMessage
+		if err := dec.Decode(&a); err != nil {
+			return nil, fmt.Errorf("%s: %w", filepath.Base(path), err)
+		}
+		msgs = append(msgs, a.message())
+	}
+	return msgs, nil
+}
+
+// archivedHistory returns up to limit archived messages of a room with an
+// ID below beforeID (or the latest ones when beforeID is 0), oldest first
+func archivedHistory(roomID, beforeID, limit int) ([]Message, error) {
+	if archiveConfig.Dir == "" || limit <= 0 {
+		return nil, nil
+	}
+	files, err := archiveFiles(archiveConfig.Dir, roomID)
+	if err != nil {
+		return nil, err
+	}
+	var list []Message
+	for _, f := range files {
+		if len(list) >= limit {
+			break
+		}
+		if beforeID != 0 && f.first >= beforeID {
+			continue
+		}
+		msgs, err := readArchiveFile(f.path)
+		if err != nil {
+			return nil, err
+		}
+		msgs = slices.DeleteFunc(msgs, func(m Message) bool { return beforeID != 0 && m.ID >= beforeID })
+		list = append(msgs, list...)
+	}
+	return list[max(0, len(list)-limit):], nil
+}
+
+// archivedUserMessages returns the archived messages a user posted in the
+// rooms from from until before until, ordered by ID
+func archivedUserMessages(rooms []Room, userID int, from, until time.Time) ([]Message, error) {
+	if archiveConfig.Dir == "" {
+		return nil, nil
+	}
+	var list []Message
+	for _, room := range rooms {
+		files, err := archiveFiles(archiveConfig.Dir, room.ID)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			msgs, err := readArchiveFile(f.path)
+			if err != nil {
+				return nil, err
+			}
+			for _, m := range msgs {
+				if m.UserID == userID && !m.CreatedAt.Before(from) && m.CreatedAt.Before(until) {
+					m.Room = room.Name
+					list = append(list, m)
+				}
+			}
+		}
+	}
+	slices.SortFunc(list, func(a, b Message) int { return cmp.Compare(a.ID, b.ID) })
+	return list, nil
+}
+
+// historyWithArchive tops up a page of stored history with archived
+// messages when the store ran out of older ones
+func historyWithArchive(ctx context.Context, room Room, beforeID, limit int) ([]Message, error) {
+	msgs, err := store.ListMessages(ctx, room.ID, beforeID, limit)
+	if err != nil || len(msgs) >= limit || archiveConfig.Dir == "" {
+		return msgs, err
+	}
+	if len(msgs) > 0 {
+		beforeID = msgs[0].ID
+	}
+	older, err := archivedHistory(room.ID, beforeID, limit-len(msgs))
+	if err != nil {
+		// The stored messages are still worth showing
+		log.Printf("Reading the archive of room %d failed: %v", room.ID, err)
+		return msgs, nil
+	}
+	for i := range older {
+		older[i].Room = room.Name
+	}
+	return append(older, msgs...), nil
+}
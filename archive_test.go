@@ -0,0 +1,128 @@
+package chat
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestArchive(t *testing.T) {
+	ctx := context.Background()
+	useMemoryStore(t)
+	prev := archiveConfig
+	archiveConfig = ArchiveConfig{Dir: t.TempDir(), After: 24 * time.Hour}
+	t.Cleanup(func() { archiveConfig = prev })
+
+	ws, err := store.CreateWorkspace(ctx, Workspace{Slug: "acme", Name: "Acme"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	general, err := store.CreateRoom(ctx, Room{WorkspaceID: ws.ID, Name: "general"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops, err := store.CreateRoom(ctx, Room{WorkspaceID: ws.ID, Name: "ops"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	old, cutoff := now.Add(-48*time.Hour), now.Add(-24*time.Hour)
+	post := func(room Room, userID int, at time.Time) Message {
+		return Message{Username: "user" + strconv.Itoa(userID), Content: "hi", Room: room.Name, CreatedAt: at, RoomID: room.ID, WorkspaceID: ws.ID, UserID: userID}
+	}
+	ids := func(msgs []Message) []int {
+		list := []int{}
+		for _, m := range msgs {
+			list = append(list, m.ID)
+		}
+		return list
+	}
+
+	// Two runs, the second finding messages the first left to come of age
+	if err := store.SaveMessages(ctx, []Message{post(general, 1, old), post(general, 2, old), post(ops, 1, old), post(general, 1, old)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := archiveMessages(cutoff); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveMessages(ctx, []Message{post(general, 2, old), post(general, 1, old), post(general, 1, now)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := archiveMessages(cutoff); err != nil {
+		t.Fatal(err)
+	}
+	if stored, err := store.ListMessages(ctx, general.ID, 0, 10); err != nil || !slices.Equal(ids(stored), []int{7}) {
+		t.Fatalf("stored %v, %v", ids(stored), err)
+	}
+	files, err := archiveFiles(archiveConfig.Dir, general.ID)
+	if err != nil || len(files) != 2 || files[0].first != 5 || files[0].last != 6 || files[1].first != 1 || files[1].last != 4 {
+		t.Fatalf("archive files %+v, %v", files, err)
+	}
+
+	// Half-written files and others are left out
+	roomDir := filepath.Join(archiveConfig.Dir, strconv.Itoa(general.ID))
+	for _, name := range []string{"8-9.jsonl.gz.123.tmp", "notes.txt"} {
+		if err := os.WriteFile(filepath.Join(roomDir, name), []byte("not an archive"), 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		beforeID int
+		limit    int
+		want     []int
+	}{
+		{"stored only", 0, 1, []int{7}},
+		{"across the store and files", 0, 4, []int{4, 5, 6, 7}},
+		{"everything", 0, 10, []int{1, 2, 4, 5, 6, 7}},
+		{"older page", 7, 2, []int{5, 6}},
+		{"within a file", 4, 10, []int{1, 2}},
+		{"before the archive", 1, 10, []int{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msgs, err := historyWithArchive(ctx, general, tt.beforeID, tt.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(ids(msgs), tt.want) {
+				t.Errorf("history %v, want %v", ids(msgs), tt.want)
+			}
+			// With the fields their JSON leaves out
+			for _, m := range msgs {
+				at := old
+				if m.ID == 7 {
+					at = now
+				}
+				if m.Room != "general" || m.RoomID != general.ID || m.WorkspaceID != ws.ID || m.UserID == 0 || !m.CreatedAt.Equal(at) {
+					t.Errorf("message %+v", m)
+				}
+			}
+		})
+	}
+
+	// Exports read a user's archived messages in every room
+	msgs, err := archivedUserMessages([]Room{general, ops}, 1, old, cutoff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(ids(msgs), []int{1, 3, 4, 6}) || msgs[1].Room != "ops" {
+		t.Errorf("user messages %+v", msgs)
+	}
+	if msgs, err := archivedUserMessages([]Room{general}, 1, old.Add(time.Second), cutoff); err != nil || len(msgs) != 0 {
+		t.Errorf("user messages after %v: %+v, %v", old, msgs, err)
+	}
+
+	// A damaged archive doesn't hide the stored messages
+	if err := os.WriteFile(filepath.Join(roomDir, "0-0.jsonl.gz"), []byte("not gzip"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if msgs, err := historyWithArchive(ctx, general, 0, 10); err != nil || !slices.Equal(ids(msgs), []int{7}) {
+		t.Errorf("history %v, %v", ids(msgs), err)
+	}
+}
@@ -0,0 +1,368 @@
+package chat
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// AttachmentConfig holds the settings of uploaded files. Files are kept
+// under Dir, one directory per attachment, and only move there once the
+// scanner passed them; rejected files go to Dir/.quarantine instead.
+type AttachmentConfig struct {
+	// Dir keeps attachments. Without it, attachments are only listed by name.
+	Dir string
+	// Scanner checks each file for malware: "clamav" or empty for none
+	Scanner string
+	// ClamAVAddr is the clamd daemon, host:port or the path of its socket
+	ClamAVAddr string
+	// Images are stripped of their metadata and scaled down to fit
+	Images ImageConfig
+	// Bytes of attachments each user may share and each workspace may
+	// hold; 0 is unlimited
+	UserQuota, WorkspaceQuota int64
+}
+
+// Directories under AttachmentConfig.Dir that attachment links can't
+// reach, since attachment IDs never contain a dot
+const (
+	attachmentsPendingDir    = ".pending"
+	attachmentsQuarantineDir = ".quarantine"
+)
+
+// Longest a clamd scan may take
+const clamAVTimeout = time.Minute
+
+var (
+	attachmentConfig AttachmentConfig
+	// Active scanner, or nil when uploads aren't scanned
+	attachmentScanner AttachmentScanner
+)
+
+// AttachmentScanner checks an uploaded file before it can be downloaded
+type AttachmentScanner interface {
+	// Scan returns the name of the threat found in the file, or "" when
+	// it's clean. An error means the file couldn't be checked.
+	Scan(ctx context.Context, r io.Reader) (threat string, err error)
+}
+
+// AttachmentRejected is returned for an upload the scanner flagged or
+// that isn't the image it claims to be
+type AttachmentRejected struct {
+	Name   string
+	Reason string
+}
+
+func (e *AttachmentRejected) Error() string {
+	return fmt.Sprintf("%s was rejected: %s", e.Name, e.Reason)
+}
+
+// attachmentUpload is a file being added to the attachments
+type attachmentUpload struct {
+	Name        string
+	ContentType string
+	// Content of the file, copied to disk as it's read rather than held
+	// in memory
+	Data     io.Reader
+	Uploader User
+	// Workspace the file is shared in, whose owners hear about rejected
+	// files
+	Workspace Workspace
+}
+
+func newAttachmentScanner(cfg AttachmentConfig) (AttachmentScanner, error) {
+	switch cfg.Scanner {
+	case "":
+		return nil, nil
+	case "clamav":
+		if cfg.ClamAVAddr == "" {
+			return nil, errors.New("the clamd address is required")
+		}
+		return clamAVScanner{addr: cfg.ClamAVAddr}, nil
+	default:
+		return nil, fmt.Errorf("unknown attachment scanner %q", cfg.Scanner)
+	}
+}
+
+// saveAttachment scans an upload, re-encodes it if it's an image and
+// keeps it, returning the link to it, or nothing when attachments aren't
+// kept. Flagged files are quarantined and reported, and come back as
+// *AttachmentRejected, as do broken images. Files over a storage quota
+// come back as *StorageQuotaExceeded.
+func saveAttachment(ctx context.Context, up attachmentUpload) (string, error) {
+	if attachmentConfig.Dir == "" {
+		return "", nil
+	}
+	id, err := randomToken(16)
+	if err != nil {
+		return "", err
+	}
+	pending := filepath.Join(attachmentConfig.Dir, attachmentsPendingDir, id)
+	if err := os.MkdirAll(pending, 0750); err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(pending)
+	file := filepath.Join(pending, up.Name)
+	size, err := writeAttachmentFile(file, up.Data)
+	if err != nil {
+		return "", err
+	}
+
+	if attachmentScanner != nil {
+		f, err := os.Open(file)
+		if err != nil {
+			return "", err
+		}
+		scanCtx, cancel := context.WithTimeout(ctx, clamAVTimeout)
+		threat, err := attachmentScanner.Scan(scanCtx, f)
+		cancel()
+		f.Close()
+		if err != nil {
+			return "", fmt.Errorf("scanning %s: %w", up.Name, err)
+		}
+		if threat != "" {
+			quarantineAttachment(ctx, id, pending, up, threat)
+			return "", &AttachmentRejected{Name: up.Name, Reason: threat}
+		}
+	}
+
+	// Images are recognized by their content as well, so one sent as
+	// application/octet-stream keeps no metadata either. They have to be
+	// decoded whole anyway, and MaxPixels bounds them.
+	sniffed, err := sniffContentType(file)
+	if err != nil {
+		return "", err
+	}
+	if reencodableImage(up.ContentType) || reencodableImage(sniffed) {
+		original, err := os.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		data, err := reencodeImage(original, sniffed)
+		if errors.Is(err, errInvalidImage) || errors.Is(err, errImageTooBig) {
+			return "", &AttachmentRejected{Name: up.Name, Reason: err.Error()}
+		}
+		if err != nil {
+			return "", fmt.Errorf("re-encoding %s: %w", up.Name, err)
+		}
+		if err := os.WriteFile(file, data, 0640); err != nil {
+			return "", err
+		}
+		size = int64(len(data))
+	}
+
+	// Checked last, as re-encoded images can come out smaller
+	if err := checkStorageQuota(ctx, up.Name, size, up.Uploader.ID, up.Workspace.ID); err != nil {
+		return "", err
+	}
+	if err := os.Rename(pending, filepath.Join(attachmentConfig.Dir, id)); err != nil {
+		return "", err
+	}
+	err = store.CreateStoredAttachment(ctx, StoredAttachment{
+		ID:          id,
+		Name:        up.Name,
+		Size:        size,
+		UserID:      up.Uploader.ID,
+		WorkspaceID: up.Workspace.ID,
+		CreatedAt:   time.Now().UTC(),
+	})
+	if err != nil {
+		// The file is kept either way; it just doesn't count
+		log.Printf("Recording attachment %s failed: %v", id, err)
+	}
+	return publicURL + "/attachments/" + id + "/" + url.PathEscape(up.Name), nil
+}
+
+// writeAttachmentFile copies an attachment's content to a new file and
+// returns its size
+func writeAttachmentFile(name string, r io.Reader) (int64, error) {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return n, err
+}
+
+// sniffContentType guesses the media type of a file from its first bytes
+func sniffContentType(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return "", err
+	}
+	return http.DetectContentType(head[:n]), nil
+}
+
+// quarantineAttachment keeps a flagged file out of reach for inspection,
+// records it in the audit log and tells the workspace's owners
+func quarantineAttachment(ctx context.Context, id, pending string, up attachmentUpload, threat string) {
+	quarantine := filepath.Join(attachmentConfig.Dir, attachmentsQuarantineDir)
+	err := os.MkdirAll(quarantine, 0750)
+	if err == nil {
+		err = os.Rename(pending, filepath.Join(quarantine, id))
+	}
+	if err != nil {
+		log.Printf("Quarantining attachment %s failed: %v", id, err)
+	}
+
+	details := fmt.Sprintf("%s by %s: %s", up.Name, up.Uploader.Username, threat)
+	recordAudit(nil, "attachment.quarantine", up.Workspace.Slug+"/"+id, details)
+	notifyModerators(ctx, up.Workspace, Notification{
+		Subject: "Attachment quarantined: " + up.Name,
+		Body: fmt.Sprintf("%s uploaded %s in the %s workspace. The scanner found %s, so it was quarantined as %s.",
+			up.Uploader.Username, up.Name, up.Workspace.Name, threat, id),
+	})
+}
+
+// notifyModerators emails the owners of a workspace and the deployment
+// admins
+func notifyModerators(ctx context.Context, ws Workspace, n Notification) {
+	users, err := store.ListUsers(ctx)
+	if err != nil {
+		log.Printf("Notifying the moderators of %s failed: %v", ws.Slug, err)
+		return
+	}
+	for _, user := range users {
+		if user.Email != "" && canManageWorkspace(ctx, ws, user) {
+			notifyAsync(emailNotifier, user, n)
+		}
+	}
+}
+
+// attachmentName makes an attachment's file name safe to store and link
+func attachmentName(name string) string {
+	name = path.Base(strings.ReplaceAll(name, `\`, "/"))
+	if name == "." || name == "/" || name == ".." {
+		return "attachment"
+	}
+	return name
+}
+
+// clamAVScanner streams files to a clamd daemon with its INSTREAM command
+type clamAVScanner struct {
+	addr string
+}
+
+// Largest chunk sent to clamd at once
+const clamAVChunkSize = 32 << 10
+
+func (s clamAVScanner) Scan(ctx context.Context, r io.Reader) (string, error) {
+	network := "tcp"
+	if strings.HasPrefix(s.addr, "/") {
+		network = "unix"
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, s.addr)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return "", err
+	}
+	buf := make([]byte, clamAVChunkSize)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if err := binary.Write(conn, binary.BigEndian, uint32(n)); err != nil {
+				return "", err
+			}
+			if _, err := conn.Write(buf[:n]); err != nil {
+				return "", err
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	// A zero-length chunk ends the stream
+	if err := binary.Write(conn, binary.BigEndian, uint32(0)); err != nil {
+		return "", err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	// "stream: OK", "stream: <threat> FOUND" or "<reason> ERROR"
+	reply = strings.TrimSpace(strings.TrimSuffix(reply, "\x00"))
+	switch {
+	case strings.HasSuffix(reply, " OK"):
+		return "", nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return strings.TrimSuffix(strings.TrimPrefix(reply, "stream: "), " FOUND"), nil
+	default:
+		return "", fmt.Errorf("clamd: %s", reply)
+	}
+}
+
+/////////////////////////////
+// Attachment API Handlers //
+/////////////////////////////
+
+// Download a file shared in a room (GET /attachments/{id}/{filename})
+func getAttachment(w http.ResponseWriter, r *http.Request) {
+	if attachmentConfig.Dir == "" {
+		http.Error(w, "Attachment not found", http.StatusNotFound)
+		return
+	}
+	vars := mux.Vars(r)
+	id, name := vars["id"], vars["filename"]
+	if strings.ContainsAny(id, `./\`) || attachmentName(name) != name {
+		http.Error(w, "Attachment not found", http.StatusNotFound)
+		return
+	}
+
+	f, err := os.Open(filepath.Join(attachmentConfig.Dir, id, name))
+	if err != nil {
+		http.Error(w, "Attachment not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Served as a download, so that HTML attachments can't run as the site
+	contentType := mime.TypeByExtension(filepath.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, name, info.ModTime(), f)
+}
@@ -0,0 +1,116 @@
+package chat
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// Most audit events returned at once
+	maxAuditPage = 1000
+	// How often audit events past the retention are removed
+	auditPruneInterval = time.Hour
+)
+
+// AuditEvent records a security-relevant action
+type AuditEvent struct {
+	ID      int       `json:"id"`
+	Time    time.Time `json:"time"`
+	Action  string    `json:"action"`
+	Actor   string    `json:"actor,omitempty"` // Username of the acting user, if any
+	IP      string    `json:"ip,omitempty"`
+	Target  string    `json:"target,omitempty"` // What the action applied to
+	Details string    `json:"details,omitempty"`
+
+	// User the actor was impersonating, who sees these events at
+	// /me/impersonations
+	OnBehalfOf string `json:"onBehalfOf,omitempty"`
+}
+
+// AuditFilter selects audit events
+type AuditFilter struct {
+	AfterID int  // Only events with a higher ID
+	Limit   int  // At most this many, or all when 0
+	Latest  bool // The newest events up to Limit rather than the oldest
+	// Only events of impersonating this user: those done on their
+	// behalf and the impersonation.start events naming them
+	Impersonated string
+}
+
+// How long audit events are kept, from the config; 0 keeps them forever
+var auditRetention time.Duration
+
+// recordAudit saves an event in the audit log and writes it to the server
+// log. The actor and IP are taken from the request when given.
+func recordAudit(r *http.Request, action, target, details string) {
+	event := AuditEvent{
+		Time:    time.Now().UTC(),
+		Action:  action,
+		Target:  target,
+		Details: details,
+	}
+	if r != nil {
+		event.IP = clientIP(r)
+		if user, ok := currentUser(r); ok {
+			event.Actor = user.Username
+			if token, ok := requestAPIToken(r); ok && token.ImpersonatedBy != "" {
+				event.Actor, event.OnBehalfOf = token.ImpersonatedBy, user.Username
+			}
+		}
+	}
+
+	saveAudit(event)
+}
+
+// saveAudit writes an event to the server log and saves it in the store
+func saveAudit(event AuditEvent) {
+	// The server log keeps the event even when the store can't
+	log.Printf("Audit: %s target=%q actor=%q ip=%s %s", event.Action, event.Target, event.Actor, event.IP, event.Details)
+	ctx, cancel := storeContext()
+	defer cancel()
+	if _, err := store.AppendAuditEvent(ctx, event); err != nil {
+		log.Printf("Saving audit event %s failed: %v", event.Action, err)
+	}
+}
+
+// runAuditPruning removes the audit events past the retention every
+// auditPruneInterval
+func runAuditPruning() {
+	for now := range time.Tick(auditPruneInterval) {
+		if auditRetention <= 0 {
+			continue
+		}
+		// Nodes pruning side by side would delete the same events
+		if cluster != nil && !cluster.leader() {
+			continue
+		}
+		ctx, cancel := storeContext()
+		n, err := store.DeleteAuditEventsBefore(ctx, now.Add(-auditRetention).UTC())
+		cancel()
+		if err != nil {
+			log.Printf("Pruning the audit log failed: %v", err)
+		} else if n > 0 {
+			log.Printf("Removed %d audit events older than %s", n, auditRetention)
+		}
+	}
+}
+
+// List audit events, newest last (GET /admin/audit?after=<id>&limit=<n>)
+func getAuditLog(w http.ResponseWriter, r *http.Request) {
+	after, _ := strconv.Atoi(r.URL.Query().Get("after"))
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 || limit > maxAuditPage {
+		limit = 100
+	}
+
+	// Pages forward from a cursor, otherwise shows the latest events
+	events, err := store.ListAuditEvents(r.Context(), AuditFilter{AfterID: after, Limit: limit, Latest: after <= 0})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(events)
+}
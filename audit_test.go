@@ -0,0 +1,64 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestGetAuditLog(t *testing.T) {
+	useMemoryStore(t)
+	for i := 1; i <= 5; i++ {
+		recordAudit(nil, "test.event", fmt.Sprint(i), "")
+	}
+
+	tests := []struct {
+		name  string
+		query string
+		want  []string // Targets
+	}{
+		{"latest", "?limit=2", []string{"4", "5"}},
+		{"after a cursor", "?after=1&limit=2", []string{"2", "3"}},
+		{"past the end", "?after=5", []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			getAuditLog(w, httptest.NewRequest("GET", "/admin/audit"+tt.query, nil))
+			var events []AuditEvent
+			if err := json.NewDecoder(w.Body).Decode(&events); err != nil {
+				t.Fatal(err)
+			}
+			targets := []string{}
+			for _, e := range events {
+				targets = append(targets, e.Target)
+			}
+			if fmt.Sprint(targets) != fmt.Sprint(tt.want) {
+				t.Errorf("got %v, want %v", targets, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeleteAuditEventsBefore(t *testing.T) {
+	ctx := context.Background()
+	useMemoryStore(t)
+	now := time.Now().UTC()
+	for _, age := range []time.Duration{48 * time.Hour, time.Hour} {
+		if _, err := store.AppendAuditEvent(ctx, AuditEvent{Time: now.Add(-age), Action: "test.event"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n, err := store.DeleteAuditEventsBefore(ctx, now.Add(-24*time.Hour))
+	if err != nil || n != 1 {
+		t.Fatalf("deleted %d: %v", n, err)
+	}
+	left, _ := store.ListAuditEvents(ctx, AuditFilter{})
+	if len(left) != 1 || left[0].ID != 2 {
+		t.Errorf("left %+v", left)
+	}
+}
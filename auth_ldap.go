@@ -0,0 +1,175 @@
+package chat
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// LDAPConfig holds the directory settings for the LDAP auth provider
+type LDAPConfig struct {
+	URL      string // ldap:// or ldaps:// URL of the directory server
+	StartTLS bool   // Upgrade ldap:// connections with StartTLS
+
+	// Service account used to search for users
+	BindDN       string
+	BindPassword string
+
+	// Users are searched below BaseDN with UserFilter, where %s is replaced
+	// by the escaped login name, e.g. "(sAMAccountName=%s)" for AD
+	BaseDN     string
+	UserFilter string
+
+	// Attributes holding the login name, email and group memberships
+	UsernameAttr string
+	EmailAttr    string
+	GroupAttr    string
+
+	// GroupRoles maps group DNs to chat roles. Users in none of the groups
+	// get DefaultRole; an empty DefaultRole denies them access
+	GroupRoles  map[string]string
+	DefaultRole string
+}
+
+// ldapAuthProvider authenticates against an LDAP or Active Directory server
+// by searching for the user with a service account and then binding as the
+// user with the supplied password
+type ldapAuthProvider struct {
+	cfg LDAPConfig
+}
+
+func newLDAPAuthProvider(cfg LDAPConfig) (*ldapAuthProvider, error) {
+	if cfg.URL == "" || cfg.BaseDN == "" {
+		return nil, errors.New("LDAP URL and base DN are required")
+	}
+	if !strings.Contains(cfg.UserFilter, "%s") {
+		return nil, errors.New("LDAP user filter must contain %s")
+	}
+
+	// Normalize DNs so group lookups don't depend on spacing or case
+	roles := make(map[string]string, len(cfg.GroupRoles))
+	for dn, role := range cfg.GroupRoles {
+		roles[normalizeDN(dn)] = role
+	}
+	cfg.GroupRoles = roles
+
+	return &ldapAuthProvider{cfg: cfg}, nil
+}
+
+func (p *ldapAuthProvider) Authenticate(ctx context.Context, username, password string) (User, error) {
+	// An empty password would be an unauthenticated bind, which many
+	// servers accept without checking anything
+	if username == "" || password == "" {
+		return User{}, errInvalidCredentials
+	}
+
+	conn, err := p.dial(ctx)
+	if err != nil {
+		return User{}, err
+	}
+	defer conn.Close()
+
+	if err := conn.Bind(p.cfg.BindDN, p.cfg.BindPassword); err != nil {
+		return User{}, fmt.Errorf("LDAP service bind: %w", err)
+	}
+
+	res, err := conn.Search(ldap.NewSearchRequest(
+		p.cfg.BaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		fmt.Sprintf(p.cfg.UserFilter, ldap.EscapeFilter(username)),
+		[]string{p.cfg.UsernameAttr, p.cfg.EmailAttr, p.cfg.GroupAttr},
+		nil,
+	))
+	if err != nil {
+		return User{}, fmt.Errorf("LDAP user search: %w", err)
+	}
+	if len(res.Entries) != 1 {
+		return User{}, errInvalidCredentials
+	}
+	entry := res.Entries[0]
+
+	// Binding as the user verifies the password
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return User{}, errInvalidCredentials
+		}
+		return User{}, fmt.Errorf("LDAP user bind: %w", err)
+	}
+
+	role := p.roleFor(entry.GetAttributeValues(p.cfg.GroupAttr))
+	if role == "" {
+		log.Printf("LDAP user %s is not in any group mapped to a role", entry.DN)
+		return User{}, errInvalidCredentials
+	}
+
+	name := entry.GetAttributeValue(p.cfg.UsernameAttr)
+	if name == "" {
+		name = username
+	}
+	return upsertExternalUser(ctx, name, entry.GetAttributeValue(p.cfg.EmailAttr), role)
+}
+
+// Accounts are managed in the directory
+func (p *ldapAuthProvider) AllowsRegistration() bool {
+	return false
+}
+
+// dial connects to the directory server, upgrading with StartTLS if
+// enabled. The connection gives up on operations when ctx's deadline
+// passes.
+func (p *ldapAuthProvider) dial(ctx context.Context) (*ldap.Conn, error) {
+	dialer := &net.Dialer{}
+	deadline, hasDeadline := ctx.Deadline()
+	if hasDeadline {
+		dialer.Deadline = deadline
+	}
+	conn, err := ldap.DialURL(p.cfg.URL, ldap.DialWithDialer(dialer))
+	if err != nil {
+		return nil, fmt.Errorf("LDAP connect: %w", err)
+	}
+	if hasDeadline {
+		conn.SetTimeout(time.Until(deadline))
+	}
+
+	if p.cfg.StartTLS {
+		host := strings.TrimPrefix(p.cfg.URL, "ldap://")
+		if i := strings.LastIndex(host, ":"); i >= 0 {
+			host = host[:i]
+		}
+		if err := conn.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("LDAP StartTLS: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+// roleFor picks the most privileged role granted by the user's groups
+func (p *ldapAuthProvider) roleFor(groups []string) string {
+	role := p.cfg.DefaultRole
+	for _, group := range groups {
+		switch p.cfg.GroupRoles[normalizeDN(group)] {
+		case roleAdmin:
+			return roleAdmin
+		case roleUser:
+			role = roleUser
+		}
+	}
+	return role
+}
+
+// normalizeDN lowercases a DN and strips spaces around its components
+func normalizeDN(dn string) string {
+	parts := strings.Split(dn, ",")
+	for i, part := range parts {
+		parts[i] = strings.ToLower(strings.TrimSpace(part))
+	}
+	return strings.Join(parts, ",")
+}
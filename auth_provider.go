@@ -0,0 +1,56 @@
+package chat
+
+import (
+	"context"
+	"errors"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// User roles
+const (
+	roleUser  = "user"
+	roleAdmin = "admin"
+)
+
+// AuthProvider verifies a username and password and returns the matching
+// local user, creating or updating it as needed
+type AuthProvider interface {
+	Authenticate(ctx context.Context, username, password string) (User, error)
+	// AllowsRegistration reports whether users can sign up locally
+	AllowsRegistration() bool
+}
+
+// Active authentication backend, selected in the config at startup
+var authProvider AuthProvider = localAuthProvider{}
+
+// newAuthProvider creates the authentication backend selected in the config
+func newAuthProvider(cfg Config) (AuthProvider, error) {
+	switch cfg.AuthProvider {
+	case "", "local":
+		return localAuthProvider{}, nil
+	case "ldap":
+		return newLDAPAuthProvider(cfg.LDAP)
+	default:
+		return nil, errors.New("unknown auth provider: " + cfg.AuthProvider)
+	}
+}
+
+// localAuthProvider checks passwords against the bcrypt hashes of
+// registered users
+type localAuthProvider struct{}
+
+func (localAuthProvider) Authenticate(ctx context.Context, username, password string) (User, error) {
+	user, ok := findUserByUsername(ctx, username)
+	if !ok {
+		return User{}, errInvalidCredentials
+	}
+	if bcrypt.CompareHashAndPassword(user.PasswordHash, []byte(password)) != nil {
+		return User{}, errInvalidCredentials
+	}
+	return user, nil
+}
+
+func (localAuthProvider) AllowsRegistration() bool {
+	return true
+}
@@ -0,0 +1,359 @@
+package chat
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+
+	"github.com/gorilla/mux"
+)
+
+// Access levels a route can require, lowest first. Managers are the
+// owners of the workspace the request is for, or of the one named in the
+// route's {slug}, and deployment admins.
+const (
+	accessPublic  = "public"
+	accessUser    = "user"
+	accessManager = "manager"
+	accessAdmin   = "admin"
+)
+
+// RoutePolicy says who may call a route
+type RoutePolicy struct {
+	Method  string   `json:"method"`  // "*" for any method
+	Pattern string   `json:"pattern"` // Route template, e.g. "/rooms/{name}/policy"
+	Access  string   `json:"access"`  // Least access level of the caller
+	Scopes  []string `json:"scopes"`  // API token scopes granting the route, any one; none keeps tokens out
+}
+
+// Scopes granting groups of routes to API tokens. The admin scope only
+// works for tokens of admins, who the admin access level still requires.
+var (
+	readScopes   = []string{scopeRead}
+	tasksScopes  = []string{scopeTasks}
+	chatScopes   = []string{scopeRead, scopeChatPost}
+	uploadScopes = []string{scopeChatPost}
+	adminScopes  = []string{scopeAdmin}
+	anyScopes    = allScopes
+
+	readTasksScopes = []string{scopeRead, scopeTasks}
+)
+
+// routePolicies authorizes every route. Handlers still check what depends
+// on the resource, such as who owns an upload.
+var routePolicies = []RoutePolicy{
+	// Accounts and sessions
+	{"POST", "/auth/register", accessPublic, nil},
+	{"POST", "/auth/login", accessPublic, nil},
+	{"POST", "/auth/logout", accessPublic, nil},
+	{"POST", "/auth/logout-all", accessUser, nil},
+	{"GET", "/auth/oauth", accessPublic, readScopes},
+	{"GET", "/auth/oauth/{provider}", accessPublic, nil},
+	{"GET", "/auth/oauth/{provider}/callback", accessPublic, nil},
+	{"POST", "/auth/2fa", accessPublic, nil},
+	{"POST", "/auth/2fa/sms", accessPublic, nil},
+	{"POST", "/auth/password-reset", accessPublic, nil},
+	{"POST", "/auth/password-reset/confirm", accessPublic, nil},
+	{"GET", "/auth/verify-email", accessPublic, nil},
+	{"POST", "/auth/verify-email/resend", accessPublic, nil},
+	{"GET", "/me", accessUser, readScopes},
+	{"POST", "/me/2fa/enroll", accessUser, nil},
+	{"POST", "/me/2fa/confirm", accessUser, nil},
+	{"POST", "/me/2fa/recovery-codes", accessUser, nil},
+	{"POST", "/me/2fa/disable", accessUser, nil},
+	{"GET", "/me/preferences", accessUser, readScopes},
+	{"PUT", "/me/preferences", accessUser, nil},
+	{"GET", "/me/agenda", accessUser, readScopes},
+	{"GET", "/me/usage", accessUser, readScopes},
+	{"GET", "/me/impersonations", accessUser, readScopes},
+	{"GET", "/me/read-markers", accessUser, readScopes},
+	{"GET", "/me/connections", accessUser, readScopes},
+	{"GET", "/me/messages/export", accessUser, readScopes},
+	{"GET", "/me/permissions", accessPublic, anyScopes},
+	{"PUT", "/me/phone", accessUser, nil},
+	{"DELETE", "/me/phone", accessUser, nil},
+	{"POST", "/me/phone/verify", accessUser, nil},
+	// Tokens never mint or revoke their own kind
+	{"GET", "/me/tokens", accessUser, nil},
+	{"POST", "/me/tokens", accessUser, nil},
+	{"DELETE", "/me/tokens/{id}", accessUser, nil},
+	{"GET", "/features", accessPublic, readScopes},
+	{"GET", "/branding", accessPublic, readScopes},
+
+	// Workspaces
+	{"GET", "/workspaces", accessUser, readScopes},
+	{"POST", "/workspaces", accessUser, nil},
+	{"GET", "/workspaces/{slug}", accessPublic, readScopes},
+	{"PUT", "/workspaces/{slug}/settings", accessManager, nil},
+	{"POST", "/workspaces/{slug}/join", accessUser, nil},
+	{"GET", "/workspaces/{slug}/members", accessUser, readScopes},
+	{"POST", "/workspaces/{slug}/members", accessManager, nil},
+	{"DELETE", "/workspaces/{slug}/members/{userID}", accessUser, nil},
+
+	// Administration
+	{"GET", "/admin/security-policy", accessAdmin, adminScopes},
+	{"PUT", "/admin/security-policy", accessAdmin, adminScopes},
+	{"GET", "/admin/audit", accessAdmin, adminScopes},
+	{"POST", "/admin/backup", accessAdmin, adminScopes},
+	{"GET", "/admin/migrations", accessAdmin, adminScopes},
+	{"POST", "/admin/migrations", accessAdmin, adminScopes},
+	{"GET", "/admin/stats", accessAdmin, adminScopes},
+	{"GET", "/admin/slo", accessAdmin, adminScopes},
+	{"GET", "/admin/cluster", accessAdmin, adminScopes},
+	{"GET", "/admin/users", accessAdmin, adminScopes},
+	{"GET", "/admin/storage", accessAdmin, adminScopes},
+	{"POST", "/admin/users/{id}/ban", accessAdmin, adminScopes},
+	{"POST", "/admin/users/{id}/unban", accessAdmin, adminScopes},
+	{"GET", "/admin/users/{id}/tokens", accessAdmin, adminScopes},
+	{"POST", "/admin/users/{id}/impersonate", accessAdmin, adminScopes},
+	{"POST", "/admin/users/{id}/anonymize", accessAdmin, adminScopes},
+	{"GET", "/admin/anonymizations/{id}", accessAdmin, adminScopes},
+	{"POST", "/admin/tokens/{id}/rotate", accessAdmin, adminScopes},
+	{"DELETE", "/admin/rooms/{name}/messages", accessAdmin, adminScopes},
+	{"GET", "/admin/scheduled-messages", accessAdmin, adminScopes},
+	{"POST", "/admin/scheduled-messages", accessAdmin, adminScopes},
+	{"DELETE", "/admin/scheduled-messages/{id}", accessAdmin, adminScopes},
+	{"GET", "/admin/maintenance", accessAdmin, adminScopes},
+	{"PUT", "/admin/maintenance", accessAdmin, adminScopes},
+	{"POST", "/admin/config/reload", accessAdmin, adminScopes},
+	{"GET", "/admin/logging", accessAdmin, adminScopes},
+	{"PUT", "/admin/logging", accessAdmin, adminScopes},
+	{"GET", "/admin/features", accessAdmin, adminScopes},
+	{"PUT", "/admin/features/{name}", accessAdmin, adminScopes},
+	{"PUT", "/admin/features/{name}/workspaces/{slug}", accessAdmin, adminScopes},
+	{"DELETE", "/admin/features/{name}/workspaces/{slug}", accessAdmin, adminScopes},
+
+	// Rooms and moderation
+	{"GET", "/presence", accessPublic, readScopes},
+	{"GET", "/sync", accessPublic, readScopes},
+	{"GET", "/rooms", accessPublic, readScopes},
+	{"GET", "/rooms/active", accessPublic, readScopes},
+	{"GET", "/messages", accessPublic, readScopes},
+	{"POST", "/rooms", accessUser, nil},
+	{"PUT", "/rooms/{name}/slow-mode", accessManager, nil},
+	{"PUT", "/rooms/{name}/policy", accessManager, nil},
+	{"GET", "/rooms/{name}/branding", accessPublic, readScopes},
+	{"PUT", "/rooms/{name}/branding", accessManager, nil},
+	{"GET", "/rooms/{name}/leaderboard", accessPublic, readScopes},
+	{"PUT", "/rooms/{name}/read", accessUser, chatScopes},
+	{"GET", "/rooms/{name}/pins", accessPublic, readScopes},
+	{"PUT", "/rooms/{name}/pins/{id}", accessManager, nil},
+	{"DELETE", "/rooms/{name}/pins/{id}", accessManager, nil},
+	{"GET", "/rooms/{name}/webhooks", accessManager, readScopes},
+	{"POST", "/rooms/{name}/webhooks", accessManager, nil},
+	{"DELETE", "/rooms/{name}/webhooks/{id}", accessManager, nil},
+	{"GET", "/moderation/held", accessManager, readScopes},
+	{"POST", "/moderation/held/{id}/approve", accessManager, nil},
+	{"POST", "/moderation/held/{id}/reject", accessManager, nil},
+
+	// Tasks and projects
+	{"POST", "/tasks", accessUser, tasksScopes},
+	{"GET", "/tasks", accessPublic, readTasksScopes},
+	{"GET", "/tasks/search", accessPublic, readTasksScopes},
+	{"GET", "/tasks/changes", accessPublic, readTasksScopes},
+	{"GET", "/tasks/{id}", accessPublic, readTasksScopes},
+	{"PUT", "/tasks/{id}", accessUser, tasksScopes},
+	{"DELETE", "/tasks/{id}", accessUser, tasksScopes},
+	{"POST", "/tasks/{id}/merge/{otherId}", accessUser, tasksScopes},
+	{"POST", "/tasks/{id}/clone", accessUser, tasksScopes},
+	{"POST", "/tasks/{id}/claim", accessUser, tasksScopes},
+	{"GET", "/tasks/{id}/history", accessPublic, readTasksScopes},
+	{"GET", "/tasks/{id}/history/{version}", accessPublic, readTasksScopes},
+	{"POST", "/tasks/{id}/undo", accessUser, tasksScopes},
+	{"GET", "/search", accessPublic, readScopes},
+	{"GET", "/projects", accessPublic, readScopes},
+	{"POST", "/projects", accessUser, nil},
+	{"GET", "/projects/{id}", accessPublic, readScopes},
+	{"GET", "/projects/{id}/stats", accessPublic, readScopes},
+	{"GET", "/projects/{id}/report", accessPublic, readScopes},
+	{"PUT", "/projects/{id}/wip-limits", accessManager, nil},
+	{"POST", "/import/{provider}", accessManager, nil},
+
+	// Automations and event subscriptions
+	{"GET", "/automations", accessManager, readScopes},
+	{"POST", "/automations", accessManager, nil},
+	{"GET", "/automations/{id}", accessManager, readScopes},
+	{"PUT", "/automations/{id}", accessManager, nil},
+	{"DELETE", "/automations/{id}", accessManager, nil},
+	{"GET", "/subscriptions", accessManager, readScopes},
+	{"POST", "/subscriptions", accessManager, nil},
+	{"DELETE", "/subscriptions/{id}", accessManager, nil},
+	{"GET", "/events", accessManager, readScopes},
+
+	// Files; uploads end up in chat messages
+	{"GET", "/attachments/{id}/{filename}", accessPublic, readScopes},
+	{"OPTIONS", "/uploads", accessPublic, uploadScopes},
+	{"POST", "/uploads", accessUser, uploadScopes},
+	{"HEAD", "/uploads/{id}", accessPublic, chatScopes},
+	{"GET", "/uploads/{id}", accessPublic, chatScopes},
+	{"PATCH", "/uploads/{id}", accessPublic, uploadScopes},
+	{"DELETE", "/uploads/{id}", accessPublic, uploadScopes},
+
+	// Operations
+	{"GET", "/readyz", accessPublic, readScopes},
+	{"GET", "/time", accessPublic, readScopes},
+	{"GET", "/metrics", accessPublic, readScopes},
+
+	// Reading the chat needs any scope that includes it; posting is
+	// checked per message
+	{"*", "/ws", accessPublic, chatScopes},
+	{"*", "/ws/{room}", accessPublic, chatScopes},
+	{"*", "/", accessPublic, readScopes},
+}
+
+// Policies by "METHOD pattern"
+var routePolicyIndex = make(map[string]RoutePolicy)
+
+func init() {
+	for _, p := range routePolicies {
+		routePolicyIndex[p.Method+" "+p.Pattern] = p
+	}
+}
+
+// routeKeys lists the ways a route's methods and template can be looked up
+func routeKeys(route *mux.Route) ([]string, error) {
+	pattern, err := route.GetPathTemplate()
+	if err != nil {
+		return nil, err
+	}
+	methods, err := route.GetMethods()
+	if err != nil || len(methods) == 0 {
+		return []string{"* " + pattern}, nil
+	}
+	keys := make([]string, len(methods))
+	for i, m := range methods {
+		keys[i] = m + " " + pattern
+	}
+	return keys, nil
+}
+
+// checkRoutePolicies makes sure every route of the router has a policy,
+// so a new route can't go out unprotected by mistake
+func checkRoutePolicies(router *mux.Router) error {
+	return router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		if route.GetHandler() == nil {
+			return nil // A subrouter
+		}
+		keys, err := routeKeys(route)
+		if err != nil {
+			return nil
+		}
+		for _, key := range keys {
+			if _, ok := routePolicyIndex[key]; !ok {
+				return fmt.Errorf("route %s has no access policy", key)
+			}
+		}
+		return nil
+	})
+}
+
+// requestPolicy finds the policy of the route a request matched
+func requestPolicy(r *http.Request) (RoutePolicy, bool) {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return RoutePolicy{}, false
+	}
+	pattern, err := route.GetPathTemplate()
+	if err != nil {
+		return RoutePolicy{}, false
+	}
+	if p, ok := routePolicyIndex[r.Method+" "+pattern]; ok {
+		return p, true
+	}
+	p, ok := routePolicyIndex["* "+pattern]
+	return p, ok
+}
+
+// authorize checks a request against a policy. It returns the status and
+// message to deny the request with, or 0 when it may go ahead.
+func authorize(r *http.Request, p RoutePolicy) (int, string) {
+	if token, ok := requestAPIToken(r); ok && !slices.ContainsFunc(p.Scopes, token.hasScope) {
+		return http.StatusForbidden, "API token doesn't have the scope for this request"
+	}
+	if p.Access == accessPublic {
+		return 0, ""
+	}
+
+	user, ok := currentUser(r)
+	if !ok {
+		return http.StatusUnauthorized, "Not logged in"
+	}
+	switch p.Access {
+	case accessManager:
+		ws := requestWorkspace(r)
+		if slug, ok := mux.Vars(r)["slug"]; ok {
+			if ws, ok = findWorkspaceBySlug(r.Context(), slug); !ok {
+				// The handler reports it missing
+				return 0, ""
+			}
+		}
+		if !canManageWorkspace(r.Context(), ws, user) {
+			return http.StatusForbidden, "Only moderators can do this"
+		}
+	case accessAdmin:
+		if user.Role != roleAdmin {
+			return http.StatusForbidden, "Admin access required"
+		}
+		if currentSecurityPolicy().RequireAdmin2FA && !user.TOTPEnabled {
+			return http.StatusForbidden, "Enable two-factor authentication to use admin features"
+		}
+	}
+	return 0, ""
+}
+
+// Middleware that lets requests through to routes the caller may use,
+// going by the route's policy
+func authorizeMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if mux.CurrentRoute(r) == nil {
+			// Not found or method not allowed; the router answers
+			next.ServeHTTP(w, r)
+			return
+		}
+		p, ok := requestPolicy(r)
+		if !ok {
+			log.Printf("No access policy for %s %s", r.Method, r.URL.Path)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if status, msg := authorize(r, p); status != 0 {
+			http.Error(w, msg, status)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Permission is whether the caller may use a route
+type Permission struct {
+	RoutePolicy
+	Allowed bool   `json:"allowed"`
+	Reason  string `json:"reason,omitempty"` // Why not
+}
+
+// PermissionReport is what the caller may do, going by the route policies
+type PermissionReport struct {
+	Username  string       `json:"username,omitempty"` // Empty for guests
+	Workspace string       `json:"workspace"`
+	Scopes    []string     `json:"scopes,omitempty"` // Of the API token the request was made with
+	Routes    []Permission `json:"routes"`
+}
+
+// Report which routes the caller may use with the session or API token
+// the request is made with, in the request's workspace (GET /me/permissions)
+func getMyPermissions(w http.ResponseWriter, r *http.Request) {
+	report := PermissionReport{Workspace: requestWorkspace(r).Slug, Routes: []Permission{}}
+	if user, ok := currentUser(r); ok {
+		report.Username = user.Username
+	}
+	if token, ok := requestAPIToken(r); ok {
+		report.Scopes = token.Scopes
+	}
+	for _, p := range routePolicies {
+		status, reason := authorize(r, p)
+		report.Routes = append(report.Routes, Permission{RoutePolicy: p, Allowed: status == 0, Reason: reason})
+	}
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,201 @@
+package chat
+
+import (
+	"context"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestAuthorizeMiddleware(t *testing.T) {
+	ctx := context.Background()
+	useMemoryStore(t)
+	prevPolicy := currentSecurityPolicy()
+	t.Cleanup(func() {
+		securityPolicyMu.Lock()
+		securityPolicy = prevPolicy
+		securityPolicyMu.Unlock()
+	})
+
+	ws, err := store.CreateWorkspace(ctx, Workspace{Slug: "acme", Name: "Acme"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	member := User{ID: 1, Username: "alice", Role: roleUser}
+	owner := User{ID: 2, Username: "bob", Role: roleUser}
+	admin := User{ID: 3, Username: "carol", Role: roleAdmin}
+	admin2FA := User{ID: 4, Username: "dave", Role: roleAdmin, TOTPEnabled: true}
+	for _, m := range []WorkspaceMember{
+		{WorkspaceID: ws.ID, UserID: member.ID, Role: workspaceRoleMember},
+		{WorkspaceID: ws.ID, UserID: owner.ID, Role: workspaceRoleOwner},
+	} {
+		if _, err := store.AddMember(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A router with a route of each access level, plus one without a policy
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	router := mux.NewRouter()
+	router.HandleFunc("/auth/oauth", ok).Methods("GET")
+	router.HandleFunc("/auth/logout-all", ok).Methods("POST")
+	router.HandleFunc("/workspaces/{slug}", ok).Methods("GET")
+	router.HandleFunc("/workspaces/{slug}/settings", ok).Methods("PUT")
+	router.HandleFunc("/admin/stats", ok).Methods("GET")
+	router.HandleFunc("/ws", ok)
+	router.HandleFunc("/unlisted", ok).Methods("GET")
+	router.Use(authorizeMiddleware)
+
+	tests := []struct {
+		name, method, path string
+		user               *User
+		token              *APIToken
+		require2FA         bool
+		want               int
+	}{
+		{"public", "GET", "/auth/oauth", nil, nil, false, http.StatusOK},
+		{"logged out", "POST", "/auth/logout-all", nil, nil, false, http.StatusUnauthorized},
+		{"logged in", "POST", "/auth/logout-all", &member, nil, false, http.StatusOK},
+		{"manager route as a member", "PUT", "/workspaces/acme/settings", &member, nil, false, http.StatusForbidden},
+		{"manager route as the owner", "PUT", "/workspaces/acme/settings", &owner, nil, false, http.StatusOK},
+		{"manager route as an admin", "PUT", "/workspaces/acme/settings", &admin, nil, false, http.StatusOK},
+		{"manager route of a missing workspace", "PUT", "/workspaces/nope/settings", &member, nil, false, http.StatusOK},
+		{"admin route as a user", "GET", "/admin/stats", &owner, nil, false, http.StatusForbidden},
+		{"admin route as an admin", "GET", "/admin/stats", &admin, nil, false, http.StatusOK},
+		{"admin route without 2FA", "GET", "/admin/stats", &admin, nil, true, http.StatusForbidden},
+		{"admin route with 2FA", "GET", "/admin/stats", &admin2FA, nil, true, http.StatusOK},
+		{"token with the scope", "GET", "/workspaces/acme", &member, &APIToken{Scopes: []string{scopeRead}}, false, http.StatusOK},
+		{"token without the scope", "GET", "/workspaces/acme", &member, &APIToken{Scopes: []string{scopeTasks}}, false, http.StatusForbidden},
+		{"token on a public route", "GET", "/auth/oauth", &member, &APIToken{Scopes: []string{scopeTasks}}, false, http.StatusForbidden},
+		{"token on a route tokens can't use", "POST", "/auth/logout-all", &member, &APIToken{Scopes: allScopes}, false, http.StatusForbidden},
+		{"admin scope of a user", "GET", "/admin/stats", &owner, &APIToken{Scopes: []string{scopeAdmin}}, false, http.StatusForbidden},
+		{"admin scope of an admin", "GET", "/admin/stats", &admin, &APIToken{Scopes: []string{scopeAdmin}}, false, http.StatusOK},
+		{"any method", "POST", "/ws", nil, nil, false, http.StatusOK},
+		{"no policy", "GET", "/unlisted", &admin, nil, false, http.StatusForbidden},
+		{"not found", "GET", "/missing", nil, nil, false, http.StatusNotFound},
+		{"method not allowed", "DELETE", "/admin/stats", nil, nil, false, http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			securityPolicyMu.Lock()
+			securityPolicy = SecurityPolicy{RequireAdmin2FA: tt.require2FA}
+			securityPolicyMu.Unlock()
+
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.user != nil {
+				r = r.WithContext(context.WithValue(r.Context(), userContextKey{}, *tt.user))
+			}
+			if tt.token != nil {
+				r = r.WithContext(context.WithValue(r.Context(), apiTokenContextKey{}, *tt.token))
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
+
+func TestCheckRoutePolicies(t *testing.T) {
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	tests := []struct {
+		name  string
+		route func(router *mux.Router)
+		ok    bool
+	}{
+		{"listed", func(router *mux.Router) { router.HandleFunc("/admin/stats", ok).Methods("GET") }, true},
+		{"listed for any method", func(router *mux.Router) { router.HandleFunc("/ws", ok) }, true},
+		{"subrouter", func(router *mux.Router) {
+			router.PathPrefix("/admin").Subrouter().HandleFunc("/stats", ok).Methods("GET")
+		}, true},
+		{"unlisted", func(router *mux.Router) { router.HandleFunc("/unlisted", ok) }, false},
+		{"unlisted method", func(router *mux.Router) { router.HandleFunc("/admin/stats", ok).Methods("GET", "DELETE") }, false},
+		{"listed for one method only", func(router *mux.Router) { router.HandleFunc("/admin/stats", ok) }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := mux.NewRouter()
+			tt.route(router)
+			if err := checkRoutePolicies(router); (err == nil) != tt.ok {
+				t.Errorf("checkRoutePolicies() = %v", err)
+			}
+		})
+	}
+}
+
+// The routes besides GET that visitors may call, and why
+var publicWrites = map[string]string{
+	"POST /auth/register":               "signing up",
+	"POST /auth/login":                  "logging in",
+	"POST /auth/logout":                 "ends the caller's own session",
+	"POST /auth/2fa":                    "finishes a login",
+	"POST /auth/2fa/sms":                "finishes a login",
+	"POST /auth/password-reset":         "for users who can't log in",
+	"POST /auth/password-reset/confirm": "for users who can't log in",
+	"POST /auth/verify-email/resend":    "for users who can't log in yet",
+	"OPTIONS /uploads":                  "changes nothing",
+	"HEAD /uploads/{id}":                "only the owner gets at an upload",
+	"PATCH /uploads/{id}":               "only the owner gets at an upload",
+	"DELETE /uploads/{id}":              "only the owner gets at an upload",
+	"* /ws":                             "workspaceAccessMiddleware lets guests in only with guest access",
+	"* /ws/{room}":                      "workspaceAccessMiddleware lets guests in only with guest access",
+	"* /":                               "serves the web UI",
+}
+
+func TestWriteRoutesNeedLogin(t *testing.T) {
+	for _, p := range routePolicies {
+		key := p.Method + " " + p.Pattern
+		if p.Access == accessPublic && p.Method != "GET" && publicWrites[key] == "" {
+			t.Errorf("%s can be called without logging in", key)
+		}
+	}
+}
+
+func TestGuestAccess(t *testing.T) {
+	useMemoryStore(t)
+	featuresMu.Lock()
+	prevFeatures := maps.Clone(features)
+	featuresMu.Unlock()
+	t.Cleanup(func() {
+		featuresMu.Lock()
+		features = prevFeatures
+		featuresMu.Unlock()
+	})
+	ws := Workspace{ID: 1, Slug: defaultWorkspaceSlug}
+	handler := workspaceAccessMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		name     string
+		flags    map[string]bool
+		path     string
+		loggedIn bool
+		want     int
+	}{
+		{"guest chat by default", nil, "/ws", false, http.StatusUnauthorized},
+		{"guest tasks by default", nil, "/tasks", false, http.StatusUnauthorized},
+		{"user chat by default", nil, "/ws", true, http.StatusOK},
+		{"guest chat allowed", map[string]bool{featureGuestAccess: true}, "/ws/general", false, http.StatusOK},
+		{"unscoped route", nil, "/features", false, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := setFeatureDefaults(tt.flags); err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest("GET", tt.path, nil)
+			r = r.WithContext(context.WithValue(r.Context(), workspaceContextKey{}, ws))
+			if tt.loggedIn {
+				r = r.WithContext(context.WithValue(r.Context(), userContextKey{}, User{ID: 1, Username: "alice"}))
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
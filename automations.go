@@ -0,0 +1,493 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Automation triggers
+const (
+	triggerStatusChanged = "status_changed"
+	triggerDueDatePassed = "due_date_passed"
+	triggerTagAdded      = "tag_added"
+)
+
+// Automation actions
+const (
+	actionReassign    = "reassign"
+	actionSetPriority = "set_priority"
+	actionPostToRoom  = "post_to_room"
+	actionCallWebhook = "call_webhook"
+)
+
+// How often tasks are checked for due dates that have passed
+const dueDateCheckInterval = time.Minute
+
+// Automation is a "when X then Y" rule for the tasks of a workspace.
+// Actions run in order; none of them changes a task's status or tags, so
+// automations can't trigger each other in a loop.
+//
+// Webhook actions get a POST of an AutomationDelivery, signed like room
+// webhook deliveries with the automation's secret.
+type Automation struct {
+	ID        int                `json:"id"`
+	Name      string             `json:"name"`
+	Enabled   bool               `json:"enabled"`
+	Trigger   AutomationTrigger  `json:"trigger"`
+	Actions   []AutomationAction `json:"actions"`
+	CreatedBy string             `json:"createdBy"`
+	CreatedAt time.Time          `json:"createdAt"`
+
+	WorkspaceID int    `json:"-"`
+	Secret      string `json:"-"`
+}
+
+// AutomationTrigger is the change to a task that runs an automation
+type AutomationTrigger struct {
+	Type   string `json:"type"`             // "status_changed", "due_date_passed" or "tag_added"
+	Status string `json:"status,omitempty"` // status_changed: only changes to this status, or any when empty
+	Tag    string `json:"tag,omitempty"`    // tag_added: the tag
+}
+
+// AutomationAction is one step of an automation
+type AutomationAction struct {
+	Type     string `json:"type"`               // "reassign", "set_priority", "post_to_room" or "call_webhook"
+	Assignee string `json:"assignee,omitempty"` // reassign
+	Priority string `json:"priority,omitempty"` // set_priority
+	Room     string `json:"room,omitempty"`     // post_to_room
+	// Message posted to the room, a Go template over the task, e.g.
+	// "{{.Title}} is overdue"
+	Message string `json:"message,omitempty"`
+	URL     string `json:"url,omitempty"` // call_webhook
+
+	RoomID   int `json:"-"` // post_to_room
+	template *template.Template
+}
+
+// AutomationRequest is the request body for adding or changing an
+// automation
+type AutomationRequest struct {
+	Name    string             `json:"name"`
+	Enabled *bool              `json:"enabled"` // Defaults to true
+	Trigger AutomationTrigger  `json:"trigger"`
+	Actions []AutomationAction `json:"actions"`
+}
+
+// CreatedAutomation is returned once, when an automation is added
+type CreatedAutomation struct {
+	Automation
+	Secret string `json:"secret"` // Signs the automation's webhook calls
+}
+
+// AutomationDelivery is the body of a call_webhook action
+type AutomationDelivery struct {
+	Automation int    `json:"automation"`
+	Trigger    string `json:"trigger"`
+	Task       Task   `json:"task"`
+}
+
+var (
+	// Every workspace's automations, loaded from the store. Events are
+	// handled on whichever node they happen, so each keeps them all.
+	automations   []Automation
+	automationsMu sync.Mutex
+
+	// Due dates already reported overdue, by task ID
+	overdueTasks   = make(map[int]time.Time)
+	overdueTasksMu sync.Mutex
+)
+
+// runAutomations runs the automations a task event triggers
+func runAutomations(e Event) {
+	var task Task
+	var statusChanged bool
+	var addedTags []string
+	switch data := e.Data.(type) {
+	case Task:
+		if e.Type == eventTaskCreated {
+			addedTags = data.Tags
+		}
+		task = data
+	case TaskUpdatedEvent:
+		task = data.Task
+		statusChanged = data.Status != data.PreviousStatus
+		for _, tag := range data.Tags {
+			if !slices.Contains(data.PreviousTags, tag) {
+				addedTags = append(addedTags, tag)
+			}
+		}
+	default:
+		return
+	}
+
+	automationsMu.Lock()
+	defer automationsMu.Unlock()
+
+	for _, a := range automations {
+		if !a.Enabled || a.WorkspaceID != e.WorkspaceID {
+			continue
+		}
+		t := a.Trigger
+		switch {
+		case t.Type == triggerStatusChanged && statusChanged && (t.Status == "" || t.Status == task.Status),
+			t.Type == triggerTagAdded && slices.Contains(addedTags, t.Tag),
+			t.Type == triggerDueDatePassed && e.Type == eventTaskOverdue:
+			go a.run(task)
+		}
+	}
+}
+
+// run takes the automation's actions on a task. A failed action is logged
+// and stops the rest.
+func (a Automation) run(task Task) {
+	ctx, cancel := storeContext()
+	defer cancel()
+	for _, action := range a.Actions {
+		var err error
+		switch action.Type {
+		case actionReassign, actionSetPriority:
+			task, err = a.updateTask(ctx, task.ID, action)
+		case actionPostToRoom:
+			var text strings.Builder
+			if err = action.template.Execute(&text, task); err != nil {
+				break
+			}
+			err = chatService.Announce(ctx, Room{ID: action.RoomID, WorkspaceID: a.WorkspaceID, Name: action.Room}, text.String())
+		case actionCallWebhook:
+			header := http.Header{"X-Chat-Automation-ID": {strconv.Itoa(a.ID)}}
+			hookCtx, cancelHook := withTimeout(context.Background(), timeouts.Webhook)
+			err = postSignedJSON(hookCtx, action.URL, a.Secret, header, AutomationDelivery{Automation: a.ID, Trigger: a.Trigger.Type, Task: task})
+			cancelHook()
+		}
+		if err != nil {
+			log.Printf("Automation %d: %s failed: %v", a.ID, action.Type, err)
+			return
+		}
+	}
+}
+
+// updateTask reassigns a task or changes its priority, returning the
+// updated task for the next actions
+func (a Automation) updateTask(ctx context.Context, id int, action AutomationAction) (Task, error) {
+	task, err := store.GetTask(ctx, a.WorkspaceID, id)
+	if err != nil {
+		return Task{}, err
+	}
+	if action.Type == actionReassign {
+		task.Assignee = action.Assignee
+	} else {
+		task.Priority = action.Priority
+	}
+	task, err = store.UpdateTask(ctx, task, systemUsername)
+	if err != nil {
+		return Task{}, err
+	}
+	indexTask(task)
+	publishEvent(a.WorkspaceID, eventTaskUpdated, strconv.Itoa(task.ID), TaskUpdatedEvent{
+		Task:           task,
+		PreviousStatus: task.Status,
+		PreviousTags:   task.Tags,
+		UpdatedBy:      systemUsername,
+	})
+	return task, nil
+}
+
+// runDueDateChecks reports tasks whose due date has passed every
+// dueDateCheckInterval
+func runDueDateChecks() {
+	for now := range time.Tick(dueDateCheckInterval) {
+		if err := checkDueDates(now); err != nil {
+			log.Printf("Due date check failed: %v", err)
+		}
+	}
+}
+
+// checkDueDates publishes a task_overdue event for each unfinished task
+// whose due date passed since it was last checked
+func checkDueDates(now time.Time) error {
+	ctx, cancel := storeContext()
+	defer cancel()
+	workspaces, err := store.ListWorkspaces(ctx)
+	if err != nil {
+		return err
+	}
+
+	overdueTasksMu.Lock()
+	defer overdueTasksMu.Unlock()
+
+	for _, ws := range workspaces {
+		tasks, err := store.ListTasks(ctx, ws.ID)
+		if err != nil {
+			return err
+		}
+		for _, task := range tasks {
+			if task.DueDate == nil || task.DueDate.After(now) || task.Status == "completed" {
+				continue
+			}
+			// Moving the due date makes the task due again
+			if reported, ok := overdueTasks[task.ID]; ok && reported.Equal(*task.DueDate) {
+				continue
+			}
+			overdueTasks[task.ID] = *task.DueDate
+			publishEvent(ws.ID, eventTaskOverdue, strconv.Itoa(task.ID), task)
+		}
+	}
+	return nil
+}
+
+// loadAutomations replaces the automations in memory with the stored ones
+func loadAutomations(ctx context.Context) error {
+	list, err := store.ListAutomations(ctx)
+	if err != nil {
+		return err
+	}
+	loaded := make([]Automation, 0, len(list))
+	for _, a := range list {
+		if err := compileAutomation(&a); err != nil {
+			log.Printf("Automation %d: %v", a.ID, err)
+			continue
+		}
+		loaded = append(loaded, a)
+	}
+
+	automationsMu.Lock()
+	defer automationsMu.Unlock()
+	automations = loaded
+	return nil
+}
+
+// compileAutomation parses the message templates of an automation's
+// post_to_room actions
+func compileAutomation(a *Automation) error {
+	for i, action := range a.Actions {
+		if action.Type != actionPostToRoom {
+			continue
+		}
+		tmpl, err := template.New("message").Option("missingkey=zero").Parse(action.Message)
+		if err != nil {
+			return fmt.Errorf("Action %d: invalid message template: %w", i+1, err)
+		}
+		a.Actions[i].template = tmpl
+	}
+	return nil
+}
+
+// checkAutomation validates a request and builds the automation from it
+func checkAutomation(ctx context.Context, ws Workspace, req AutomationRequest) (Automation, error) {
+	a := Automation{Name: strings.TrimSpace(req.Name), Enabled: req.Enabled == nil || *req.Enabled, Trigger: req.Trigger}
+	if a.Name == "" {
+		return a, errors.New("Automations need a name")
+	}
+
+	switch a.Trigger.Type {
+	case triggerStatusChanged:
+		a.Trigger = AutomationTrigger{Type: triggerStatusChanged, Status: a.Trigger.Status}
+	case triggerDueDatePassed:
+		a.Trigger = AutomationTrigger{Type: triggerDueDatePassed}
+	case triggerTagAdded:
+		tag := strings.ToLower(strings.TrimSpace(a.Trigger.Tag))
+		if tag == "" {
+			return a, errors.New("tag_added triggers need a tag")
+		}
+		a.Trigger = AutomationTrigger{Type: triggerTagAdded, Tag: tag}
+	default:
+		return a, errors.New(`Trigger type must be "status_changed", "due_date_passed" or "tag_added"`)
+	}
+
+	if len(req.Actions) == 0 {
+		return a, errors.New("Automations need at least one action")
+	}
+	for i, action := range req.Actions {
+		var checked AutomationAction
+		switch action.Type {
+		case actionReassign:
+			task := Task{Assignee: action.Assignee}
+			if action.Assignee == "" {
+				return a, fmt.Errorf("Action %d: reassign needs an assignee", i+1)
+			}
+			if err := checkTaskFields(ctx, ws, &task); err != nil {
+				return a, fmt.Errorf("Action %d: %w", i+1, err)
+			}
+			checked = AutomationAction{Type: actionReassign, Assignee: task.Assignee}
+		case actionSetPriority:
+			if !slices.Contains(taskPriorities, action.Priority) {
+				return a, fmt.Errorf("Action %d: priority must be one of %s", i+1, strings.Join(taskPriorities, ", "))
+			}
+			checked = AutomationAction{Type: actionSetPriority, Priority: action.Priority}
+		case actionPostToRoom:
+			room, err := store.FindRoom(ctx, ws.ID, action.Room)
+			if err != nil {
+				return a, fmt.Errorf("Action %d: room not found", i+1)
+			}
+			if action.Message == "" {
+				return a, fmt.Errorf("Action %d: post_to_room needs a message", i+1)
+			}
+			checked = AutomationAction{Type: actionPostToRoom, Room: room.Name, Message: action.Message, RoomID: room.ID}
+		case actionCallWebhook:
+			u, err := checkWebhookURL(ctx, action.URL)
+			if err != nil {
+				return a, fmt.Errorf("Action %d: %w", i+1, err)
+			}
+			checked = AutomationAction{Type: actionCallWebhook, URL: u.String()}
+		default:
+			return a, fmt.Errorf(`Action %d: type must be "reassign", "set_priority", "post_to_room" or "call_webhook"`, i+1)
+		}
+		a.Actions = append(a.Actions, checked)
+	}
+	return a, compileAutomation(&a)
+}
+
+// automationFromVars looks up the automation of the request's workspace
+// named in the route, answering with 404 when it doesn't exist
+func automationFromVars(w http.ResponseWriter, r *http.Request) (Automation, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid automation ID", http.StatusBadRequest)
+		return Automation{}, false
+	}
+	ws := requestWorkspace(r)
+
+	automationsMu.Lock()
+	defer automationsMu.Unlock()
+
+	i := slices.IndexFunc(automations, func(a Automation) bool { return a.ID == id && a.WorkspaceID == ws.ID })
+	if i < 0 {
+		http.Error(w, "Automation not found", http.StatusNotFound)
+		return Automation{}, false
+	}
+	return automations[i], true
+}
+
+/////////////////////////////
+// Automation API Handlers //
+/////////////////////////////
+
+// List the automations of the workspace; moderators only (GET /automations)
+func listAutomations(w http.ResponseWriter, r *http.Request) {
+	ws := requestWorkspace(r)
+
+	automationsMu.Lock()
+	defer automationsMu.Unlock()
+
+	list := []Automation{}
+	for _, a := range automations {
+		if a.WorkspaceID == ws.ID {
+			list = append(list, a)
+		}
+	}
+	json.NewEncoder(w).Encode(list)
+}
+
+// Get an automation by ID; moderators only (GET /automations/{id})
+func getAutomation(w http.ResponseWriter, r *http.Request) {
+
+	a, ok := automationFromVars(w, r)
+	if !ok {
+		return
+	}
+	json.NewEncoder(w).Encode(a)
+}
+
+// Add an automation to the workspace; moderators only (POST /automations)
+func createAutomation(w http.ResponseWriter, r *http.Request) {
+	user, _ := currentUser(r)
+	ws := requestWorkspace(r)
+
+	var req AutomationRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	a, err := checkAutomation(r.Context(), ws, req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	a.CreatedBy = user.Username
+	a.CreatedAt = time.Now().UTC()
+	a.WorkspaceID = ws.ID
+	if a.Secret, err = randomToken(32); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if a, err = store.CreateAutomation(r.Context(), a); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	registryChanged(registryAutomations)
+
+	recordAudit(r, "automation.create", ws.Slug, a.Name)
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(CreatedAutomation{Automation: a, Secret: a.Secret})
+}
+
+// Replace an automation's name, trigger and actions, or turn it on or off;
+// moderators only (PUT /automations/{id})
+func updateAutomation(w http.ResponseWriter, r *http.Request) {
+	ws := requestWorkspace(r)
+
+	var req AutomationRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	updated, err := checkAutomation(r.Context(), ws, req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	a, ok := automationFromVars(w, r)
+	if !ok {
+		return
+	}
+	a.Name, a.Enabled, a.Trigger, a.Actions = updated.Name, updated.Enabled, updated.Trigger, updated.Actions
+	if _, err := store.UpdateAutomation(r.Context(), a); errors.Is(err, errNotFound) {
+		http.Error(w, "Automation not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	registryChanged(registryAutomations)
+
+	recordAudit(r, "automation.update", ws.Slug, a.Name)
+	json.NewEncoder(w).Encode(a)
+}
+
+// Remove an automation; moderators only (DELETE /automations/{id})
+func deleteAutomation(w http.ResponseWriter, r *http.Request) {
+	ws := requestWorkspace(r)
+
+	a, ok := automationFromVars(w, r)
+	if !ok {
+		return
+	}
+	if err := store.DeleteAutomation(r.Context(), a.ID); errors.Is(err, errNotFound) {
+		http.Error(w, "Automation not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	registryChanged(registryAutomations)
+
+	recordAudit(r, "automation.delete", ws.Slug, a.Name)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,420 @@
+package chat
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Version of the backup archive layout, bumped on incompatible changes
+const backupFormat = 1
+
+// Files inside a backup archive
+const (
+	backupManifestFile = "manifest.json"
+	backupDataFile     = "data.gob"
+	// Directory of the copied files, one subdirectory per backupDir
+	backupFilesDir = "files/"
+)
+
+// BackupManifest describes a backup archive. It is stored as JSON next to
+// the data so archives can be inspected without restoring them.
+type BackupManifest struct {
+	Format    int            `json:"format"`
+	CreatedAt time.Time      `json:"createdAt"`
+	Counts    map[string]int `json:"counts"`
+	Files     []BackupFile   `json:"files"`
+}
+
+// BackupFile is a file copied into a backup archive
+type BackupFile struct {
+	Path string `json:"path"` // Under files/ in the archive
+	Size int64  `json:"size"`
+}
+
+// backupDir is a directory whose files go into backups, under
+// files/<name>/ in the archive
+type backupDir struct {
+	name string
+	dir  string // Empty when it isn't configured
+}
+
+// backupDirs returns the directories of attachments, which holds the
+// unfinished uploads too, and of the message archive
+func backupDirs(attachments, archive string) []backupDir {
+	return []backupDir{{"attachments", attachments}, {"archive", archive}}
+}
+
+// backupSource is where the content of a file in a backup comes from
+type backupSource struct {
+	BackupFile
+	path string
+	// Content read while listing, kept for files that change in place
+	data []byte
+}
+
+// listBackupFiles finds the files of the directories to back up. Files
+// still being written, scanned or that were quarantined stay out.
+// Unfinished uploads are copied as far as their state says they got, as
+// their data is appended to before the state is saved.
+func listBackupFiles(dirs []backupDir) ([]backupSource, error) {
+	var files []backupSource
+	for _, d := range dirs {
+		if d.dir == "" {
+			continue
+		}
+		err := filepath.WalkDir(d.dir, func(path string, e fs.DirEntry, err error) error {
+			if errors.Is(err, fs.ErrNotExist) && path == d.dir {
+				return fs.SkipDir
+			}
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(d.dir, path)
+			if err != nil {
+				return err
+			}
+			rel = filepath.ToSlash(rel)
+			if e.IsDir() {
+				if rel == attachmentsPendingDir || rel == attachmentsQuarantineDir {
+					return fs.SkipDir
+				}
+				return nil
+			}
+			if !e.Type().IsRegular() || strings.HasSuffix(rel, ".tmp") {
+				return nil
+			}
+
+			f := backupSource{BackupFile: BackupFile{Path: d.name + "/" + rel}, path: path}
+			dir, name := filepath.Split(rel)
+			id, isUpload := strings.CutSuffix(name, ".json")
+			switch {
+			case dir == uploadsDir+"/" && isUpload:
+				if f.data, err = os.ReadFile(path); err != nil {
+					return err
+				}
+				f.Size = int64(len(f.data))
+				var up storedUpload
+				if err := json.Unmarshal(f.data, &up); err != nil {
+					return fmt.Errorf("upload %s: %w", id, err)
+				}
+				files = append(files, f, backupSource{
+					BackupFile: BackupFile{Path: d.name + "/" + dir + id + ".part", Size: up.Offset},
+					path:       filepath.Join(filepath.Dir(path), id+".part"),
+				})
+				return nil
+			case dir == uploadsDir+"/" && strings.HasSuffix(name, ".part"):
+				// Listed with the upload's state
+				return nil
+			}
+			info, err := e.Info()
+			if err != nil {
+				return err
+			}
+			f.Size = info.Size()
+			files = append(files, f)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// writeBackup writes a snapshot and the files of dirs as a gzipped tar
+// archive. The data is gob encoded, which unlike the API's JSON keeps
+// password hashes, 2FA secrets and the internal IDs that tie records
+// together.
+func writeBackup(w io.Writer, snap *Snapshot, dirs []backupDir) error {
+	files, err := listBackupFiles(dirs)
+	if err != nil {
+		return err
+	}
+	listed := []BackupFile{}
+	for _, f := range files {
+		listed = append(listed, f.BackupFile)
+	}
+
+	manifest, err := json.MarshalIndent(BackupManifest{
+		Format:    backupFormat,
+		CreatedAt: time.Now().UTC(),
+		Counts: map[string]int{
+			"users":      len(snap.Users),
+			"identities": len(snap.Identities),
+			"workspaces": len(snap.Workspaces),
+			"members":    len(snap.Members),
+			"rooms":      len(snap.Rooms),
+			"projects":   len(snap.Projects),
+			"tasks":      len(snap.Tasks),
+			"messages":   len(snap.Messages),
+			"apiTokens":  len(snap.APITokens),
+
+			"roomWebhooks":       len(snap.RoomWebhooks),
+			"automations":        len(snap.Automations),
+			"eventSubscriptions": len(snap.EventSubscriptions),
+			"scheduledMessages":  len(snap.ScheduledMessages),
+			"storedAttachments":  len(snap.StoredAttachments),
+			"heldMessages":       len(snap.HeldMessages),
+			"pins":               len(snap.Pins),
+			"readMarkers":        len(snap.ReadMarkers),
+			"taskEvents":         len(snap.TaskEvents),
+			"taskSnapshots":      len(snap.TaskSnapshots),
+		},
+		Files: listed,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	var data bytes.Buffer
+	if err := gob.NewEncoder(&data).Encode(snap); err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for _, f := range []struct {
+		name string
+		body []byte
+	}{
+		{backupManifestFile, manifest},
+		{backupDataFile, data.Bytes()},
+	} {
+		err := tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0600, Size: int64(len(f.body)), ModTime: time.Now()})
+		if err != nil {
+			return err
+		}
+		if _, err := tw.Write(f.body); err != nil {
+			return err
+		}
+	}
+	for _, f := range files {
+		if err := writeBackupFile(tw, f); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// writeBackupFile copies a listed file into the archive. Files only grow
+// or get replaced whole, so the listed size is copied; a file removed
+// since it was listed, like an upload that expired, is an error.
+func writeBackupFile(tw *tar.Writer, f backupSource) error {
+	err := tw.WriteHeader(&tar.Header{Name: backupFilesDir + f.Path, Mode: 0600, Size: f.Size, ModTime: time.Now()})
+	if err != nil {
+		return err
+	}
+	if f.data != nil {
+		_, err := tw.Write(f.data)
+		return err
+	}
+	src, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	if _, err := io.CopyN(tw, src, f.Size); err != nil {
+		return fmt.Errorf("copying %s: %w", f.Path, err)
+	}
+	return nil
+}
+
+// readBackup reads the manifest and snapshot of an archive written by
+// writeBackup, leaving its files out
+func readBackup(r io.Reader) (*BackupManifest, *Snapshot, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer gz.Close()
+
+	var manifest *BackupManifest
+	var snap *Snapshot
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		switch hdr.Name {
+		case backupManifestFile:
+			manifest = &BackupManifest{}
+			if err := json.NewDecoder(tr).Decode(manifest); err != nil {
+				return nil, nil, fmt.Errorf("%s: %w", backupManifestFile, err)
+			}
+			if manifest.Format != backupFormat {
+				return nil, nil, fmt.Errorf("unsupported backup format %d", manifest.Format)
+			}
+		case backupDataFile:
+			snap = &Snapshot{}
+			if err := gob.NewDecoder(tr).Decode(snap); err != nil {
+				return nil, nil, fmt.Errorf("%s: %w", backupDataFile, err)
+			}
+		}
+	}
+
+	if manifest == nil || snap == nil {
+		return nil, nil, errors.New("not a chat backup archive")
+	}
+	return manifest, snap, nil
+}
+
+// extractBackupFiles copies the files of an archive written by
+// writeBackup into dirs. Files already there are left alone and fail the
+// restore, as are files missing from the manifest or of another size.
+func extractBackupFiles(r io.Reader, dirs []backupDir) (int, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, err
+	}
+	defer gz.Close()
+
+	var listed map[string]int64
+	extracted := 0
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return extracted, err
+		}
+
+		if hdr.Name == backupManifestFile {
+			var manifest BackupManifest
+			if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+				return extracted, fmt.Errorf("%s: %w", backupManifestFile, err)
+			}
+			listed = make(map[string]int64)
+			for _, f := range manifest.Files {
+				listed[f.Path] = f.Size
+			}
+			continue
+		}
+		name, ok := strings.CutPrefix(hdr.Name, backupFilesDir)
+		if !ok {
+			continue
+		}
+		if size, ok := listed[name]; !ok || size != hdr.Size {
+			return extracted, fmt.Errorf("%s is not in the manifest", hdr.Name)
+		}
+		delete(listed, name)
+		_, rel, _ := strings.Cut(name, "/")
+		dir, err := backupFileDir(dirs, name)
+		if err != nil {
+			return extracted, err
+		}
+
+		path := filepath.Join(dir, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+			return extracted, err
+		}
+		if _, err := writeAttachmentFile(path, tr); err != nil {
+			return extracted, fmt.Errorf("%s: %w", hdr.Name, err)
+		}
+		extracted++
+	}
+
+	if len(listed) > 0 {
+		return extracted, fmt.Errorf("%d files of the manifest are missing from the archive", len(listed))
+	}
+	return extracted, nil
+}
+
+// backupFileDir returns the directory a file of a backup goes to
+func backupFileDir(dirs []backupDir, name string) (string, error) {
+	dirName, rel, _ := strings.Cut(name, "/")
+	i := slices.IndexFunc(dirs, func(d backupDir) bool { return d.name == dirName })
+	if i < 0 || !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("unexpected file %s%s", backupFilesDir, name)
+	}
+	if dirs[i].dir == "" {
+		return "", fmt.Errorf("the backup has %s files but no directory is configured for them", dirName)
+	}
+	return dirs[i].dir, nil
+}
+
+// restoreFromFile loads a backup archive into the store at startup, and
+// its files into dirs once the store took the data
+func restoreFromFile(path string, dirs []backupDir) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	manifest, snap, err := readBackup(f)
+	if err != nil {
+		return err
+	}
+	// Checked first, so a backup is restored whole or not at all
+	for _, file := range manifest.Files {
+		if _, err := backupFileDir(dirs, file.Path); err != nil {
+			return err
+		}
+	}
+	if err := store.Restore(context.Background(), snap); err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	files, err := extractBackupFiles(f, dirs)
+	if err != nil {
+		return fmt.Errorf("restoring files: %w", err)
+	}
+
+	log.Printf("Restored %d users, %d tasks, %d messages and %d files from %s",
+		len(snap.Users), len(snap.Tasks), len(snap.Messages), files, path)
+	return nil
+}
+
+/////////////////////////
+// Backup API Handlers //
+/////////////////////////
+
+// Download a snapshot of all data (POST /admin/backup)
+func createBackup(w http.ResponseWriter, r *http.Request) {
+	// Include the messages still waiting in the write-behind queue
+	messageQueue.Flush()
+
+	snap, err := store.Snapshot(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(r, "backup.create", "", fmt.Sprintf("%d users, %d tasks, %d messages", len(snap.Users), len(snap.Tasks), len(snap.Messages)))
+
+	name := "chat-backup-" + time.Now().UTC().Format("20060102T150405Z") + ".tar.gz"
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	dirs := backupDirs(attachmentConfig.Dir, archiveConfig.Dir)
+	if err := writeBackup(w, snap, dirs); err != nil {
+		// Headers are gone by now; all we can do is cut the download short
+		log.Printf("Backup write error: %v", err)
+	}
+}
@@ -0,0 +1,154 @@
+package chat
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBackupRestore(t *testing.T) {
+	ctx := context.Background()
+	at := time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)
+	msg := Message{ID: 7, Username: "alice", Content: "hi", Room: "general", CreatedAt: at, RoomID: 1, WorkspaceID: 1, UserID: 1}
+	want := &Snapshot{
+		Users:      []User{{ID: 1, Username: "alice", PasswordHash: []byte("hash"), CreatedAt: at}},
+		Identities: []Identity{{Provider: "github", Subject: "42", UserID: 1}},
+		Workspaces: []Workspace{{ID: 1, Slug: "acme", Name: "Acme", CreatedAt: at}},
+		Members:    []WorkspaceMember{{WorkspaceID: 1, UserID: 1, Role: "owner", JoinedAt: at}},
+		Rooms:      []Room{{ID: 1, WorkspaceID: 1, Name: "general", CreatedAt: at}},
+		Tasks:      []Task{{ID: 3, WorkspaceID: 1, Title: "Ship it", Status: "pending", CreatedAt: at}},
+		Messages:   []Message{msg},
+		TaskEvents: []TaskEvent{{ID: 1, WorkspaceID: 1, TaskID: 3, Version: 1, Type: "created", By: "alice", At: at}},
+
+		StoredAttachments: []StoredAttachment{{ID: "a1", Name: "notes.txt", Size: 5, UserID: 1, WorkspaceID: 1, CreatedAt: at}},
+		Pins:              []Pin{{Room: "general", Message: msg, PinnedBy: "alice", PinnedAt: at, RoomID: 1, WorkspaceID: 1}},
+		ReadMarkers:       []ReadMarker{{Room: "general", MessageID: 7, UpdatedAt: at, UserID: 1, RoomID: 1, WorkspaceID: 1}},
+	}
+	source := newMemoryStore()
+	if err := source.Restore(ctx, want); err != nil {
+		t.Fatal(err)
+	}
+
+	writeFile := func(t *testing.T, path, data string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	attachments, archive := t.TempDir(), t.TempDir()
+	writeFile(t, filepath.Join(attachments, "a1", "notes.txt"), "notes")
+	writeFile(t, filepath.Join(attachments, attachmentsPendingDir, "b2", "scan.txt"), "scanning")
+	writeFile(t, filepath.Join(attachments, attachmentsQuarantineDir, "c3", "virus.exe"), "flagged")
+	up, _ := json.Marshal(storedUpload{Upload: Upload{ID: "u1", Name: "big.bin", Length: 10, Offset: 4}, UserID: 1, WorkspaceID: 1})
+	writeFile(t, filepath.Join(attachments, uploadsDir, "u1.json"), string(up))
+	// Appended to before the state caught up
+	writeFile(t, filepath.Join(attachments, uploadsDir, "u1.part"), "012345")
+	writeFile(t, filepath.Join(archive, "1", "1-6.jsonl.gz"), "archived")
+	writeFile(t, filepath.Join(archive, "1", "8-9.jsonl.gz.123.tmp"), "half")
+
+	snap, err := source.Snapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "backup.tar.gz")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeBackup(f, snap, backupDirs(attachments, archive)); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	manifest := readBackupManifest(t, path)
+	wantFiles := []BackupFile{
+		{"attachments/.uploads/u1.json", int64(len(up))},
+		{"attachments/.uploads/u1.part", 4},
+		{"attachments/a1/notes.txt", 5},
+		{"archive/1/1-6.jsonl.gz", 8},
+	}
+	if !reflect.DeepEqual(manifest.Files, wantFiles) {
+		t.Errorf("files %+v, want %+v", manifest.Files, wantFiles)
+	}
+	if manifest.Counts["pins"] != 1 || manifest.Counts["readMarkers"] != 1 || manifest.Counts["storedAttachments"] != 1 {
+		t.Errorf("counts %v", manifest.Counts)
+	}
+
+	// Into an empty instance
+	useMemoryStore(t)
+	restoredAttachments, restoredArchive := t.TempDir(), t.TempDir()
+	dirs := backupDirs(restoredAttachments, restoredArchive)
+	if err := restoreFromFile(path, dirs); err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.Snapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("restored %+v, want %+v", got, want)
+	}
+	for name, data := range map[string]string{
+		filepath.Join(restoredAttachments, "a1", "notes.txt"):     "notes",
+		filepath.Join(restoredAttachments, uploadsDir, "u1.part"): "0123",
+		filepath.Join(restoredArchive, "1", "1-6.jsonl.gz"):       "archived",
+	} {
+		if b, err := os.ReadFile(name); err != nil || string(b) != data {
+			t.Errorf("%s: %q, %v, want %q", name, b, err, data)
+		}
+	}
+	for _, name := range []string{attachmentsPendingDir, attachmentsQuarantineDir} {
+		if _, err := os.Stat(filepath.Join(restoredAttachments, name)); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s was restored: %v", name, err)
+		}
+	}
+
+	// An instance with data keeps it, and its files
+	if err := restoreFromFile(path, backupDirs(t.TempDir(), t.TempDir())); !errors.Is(err, errStoreNotEmpty) {
+		t.Errorf("restoring over data: %v", err)
+	}
+
+	// Files need somewhere to go, or nothing is restored
+	mem := useMemoryStore(t)
+	if err := restoreFromFile(path, backupDirs("", restoredArchive)); err == nil {
+		t.Error("restored attachments without an attachments directory")
+	}
+	if len(mem.users) != 0 {
+		t.Errorf("restored %d users without the attachments", len(mem.users))
+	}
+}
+
+// readBackupManifest reads the manifest of a backup archive
+func readBackupManifest(t *testing.T, path string) BackupManifest {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	if hdr, err := tr.Next(); err != nil || hdr.Name != backupManifestFile {
+		t.Fatalf("first file %v, %v", hdr, err)
+	}
+	var manifest BackupManifest
+	if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+		t.Fatal(err)
+	}
+	return manifest
+}
@@ -0,0 +1,103 @@
+package chat
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// Longest welcome banner, in characters
+const maxWelcomeBanner = 500
+
+// RoomBranding overrides the workspace's branding in one room; empty
+// fields keep the workspace's
+type RoomBranding struct {
+	LogoURL       string `json:"logoUrl,omitempty"`
+	Color         string `json:"color,omitempty"`
+	WelcomeBanner string `json:"welcomeBanner,omitempty"`
+}
+
+// Branding is what the web app shows: the server's branding, overridden by
+// the workspace's and then the room's
+type Branding struct {
+	Name          string `json:"name"`
+	LogoURL       string `json:"logoUrl,omitempty"`
+	Color         string `json:"color"`
+	SupportEmail  string `json:"supportEmail,omitempty"`
+	WelcomeBanner string `json:"welcomeBanner,omitempty"`
+}
+
+// effectiveBranding merges the branding that applies in a room
+func effectiveBranding(ws Workspace, room *Room) Branding {
+	brand := brandingFor(ws)
+	b := Branding{
+		Name:          brand.Name,
+		LogoURL:       brand.LogoURL,
+		Color:         brand.Color,
+		SupportEmail:  brand.SupportEmail,
+		WelcomeBanner: brand.WelcomeBanner,
+	}
+	if room == nil {
+		return b
+	}
+	if room.Branding.LogoURL != "" {
+		b.LogoURL = room.Branding.LogoURL
+	}
+	if room.Branding.Color != "" {
+		b.Color = room.Branding.Color
+	}
+	if room.Branding.WelcomeBanner != "" {
+		b.WelcomeBanner = room.Branding.WelcomeBanner
+	}
+	return b
+}
+
+///////////////////////////
+// Branding API Handlers //
+///////////////////////////
+
+// Get the workspace's branding, which the web app reads before anyone logs
+// in (GET /branding)
+func getBranding(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(effectiveBranding(requestWorkspace(r), nil))
+}
+
+// Get the branding in a room (GET /rooms/{name}/branding)
+func getRoomBranding(w http.ResponseWriter, r *http.Request) {
+	room, ok := roomFromVars(w, r)
+	if !ok {
+		return
+	}
+	json.NewEncoder(w).Encode(effectiveBranding(requestWorkspace(r), &room))
+}
+
+// Replace a room's own branding (PUT /rooms/{name}/branding)
+func setRoomBranding(w http.ResponseWriter, r *http.Request) {
+	ws := requestWorkspace(r)
+
+	var branding RoomBranding
+	if err := json.NewDecoder(r.Body).Decode(&branding); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	branding.WelcomeBanner = strings.TrimSpace(branding.WelcomeBanner)
+	err := validBranding(WorkspaceBranding{LogoURL: branding.LogoURL, Color: branding.Color, WelcomeBanner: branding.WelcomeBanner})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	room, ok := roomFromVars(w, r)
+	if !ok {
+		return
+	}
+	room, err = store.SetRoomBranding(r.Context(), room.ID, branding)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	noteRoomUpdate(room)
+
+	recordAudit(r, "room.branding", ws.Slug+"/"+room.Name, "")
+	json.NewEncoder(w).Encode(room)
+}
@@ -0,0 +1,63 @@
+package chat
+
+import (
+	"slices"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// BatchFrame carries messages of a busy room that came in within one
+// batch interval, oldest first, to clients that take batches. A message
+// with nothing before it in the interval goes out on its own right away.
+type BatchFrame struct {
+	Batch []Message `json:"batch"`
+}
+
+// clientBatch holds the messages for a client until the next flush. Only
+// the hub's loop touches it.
+type clientBatch struct {
+	pending  []Message
+	lastSent time.Time
+}
+
+// How often broadcast batches are flushed, or 0 to send every message
+// on its own
+var broadcastBatchInterval = 20 * time.Millisecond
+
+// newClientBatch returns the batch for a new client, or nil when it
+// doesn't take batches
+func newClientBatch(caps []string) *clientBatch {
+	if broadcastBatchInterval <= 0 || !slices.Contains(caps, capBatches) {
+		return nil
+	}
+	return &clientBatch{}
+}
+
+// sendNow reports whether a message can be written right away because
+// nothing was sent to the client within the interval, and otherwise
+// keeps it for the next flush
+func (b *clientBatch) sendNow(msg Message, now time.Time) bool {
+	if len(b.pending) == 0 && now.Sub(b.lastSent) >= broadcastBatchInterval {
+		b.lastSent = now
+		return true
+	}
+	b.pending = append(b.pending, msg)
+	return false
+}
+
+// flushBatch writes a client's pending messages in one frame. The hub
+// flushes every client once per batch interval.
+func (h *Hub) flushBatch(ws *websocket.Conn, c chatClient, now time.Time) error {
+	if c.batch == nil || len(c.batch.pending) == 0 {
+		return nil
+	}
+	var frame any = BatchFrame{Batch: c.batch.pending}
+	if len(c.batch.pending) == 1 {
+		frame = c.batch.pending[0]
+	}
+	// The pump owns the messages from here on, so the next batch starts
+	// a slice of its own
+	c.batch.pending, c.batch.lastSent = nil, now
+	return h.write(ws, frame)
+}
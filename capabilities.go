@@ -0,0 +1,111 @@
+package chat
+
+import (
+	"bytes"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Capabilities a client can advertise when it connects, with one
+// ?capability= per capability. Names the server doesn't know, such as
+// features newer clients support, are ignored, so clients can advertise
+// them ahead of the server.
+const (
+	capAttachments = "attachments" // Attachments as a list on messages, not links in the content
+	capNotices     = "notices"     // Maintenance and reconnect notice frames
+	capServerTime  = "server-time" // The server's time on every frame
+	capCompression = "compression" // Compressed frames, if permessage-deflate was negotiated
+	capBatches     = "batches"     // Messages sent close together in one BatchFrame
+	capHistory     = "history"     // A room's latest messages in one HistoryFrame on connect
+)
+
+var knownCapabilities = []string{capAttachments, capNotices, capServerTime, capCompression, capBatches, capHistory}
+
+// Capabilities of clients that don't advertise any: the frames the server
+// sent before clients could choose
+var legacyCapabilities = []string{capAttachments, capNotices, capServerTime}
+
+// CapabilitiesFrame is the first frame sent to a client that advertised
+// capabilities: the ones the server will use with it
+type CapabilitiesFrame struct {
+	Capabilities []string `json:"capabilities"`
+}
+
+// clientCapabilities returns the capabilities a client advertised that the
+// server supports, and whether it advertised any at all
+func clientCapabilities(r *http.Request) ([]string, bool) {
+	advertised, ok := r.URL.Query()["capability"]
+	if !ok {
+		return legacyCapabilities, false
+	}
+	caps := []string{}
+	for _, c := range advertised {
+		c = strings.ToLower(strings.TrimSpace(c))
+		if slices.Contains(knownCapabilities, c) && !slices.Contains(caps, c) {
+			caps = append(caps, c)
+		}
+	}
+	return caps, true
+}
+
+// tailorFrame adapts a frame to a client's capabilities. It returns false
+// for frames the client doesn't take at all.
+func tailorFrame(caps []string, v any) (any, bool) {
+	switch frame := v.(type) {
+	case MaintenanceNotice, ReconnectNotice:
+		return v, slices.Contains(caps, capNotices)
+	case Message:
+		if len(frame.Attachments) == 0 || slices.Contains(caps, capAttachments) {
+			return v, true
+		}
+		// Clients that only show text get the files as links
+		for _, a := range frame.Attachments {
+			if a.URL != "" && !strings.Contains(frame.Content, a.URL) {
+				frame.Content = strings.TrimSpace(frame.Content + "\n" + a.URL)
+			}
+		}
+		frame.Attachments = nil
+		return frame, true
+	case BackfillFrame:
+		msgs := make([]Message, len(frame.Backfill.Messages))
+		for i, msg := range frame.Backfill.Messages {
+			tailored, _ := tailorFrame(caps, msg)
+			msgs[i] = tailored.(Message)
+		}
+		frame.Backfill.Messages = msgs
+		return frame, true
+	case BatchFrame:
+		msgs := make([]Message, len(frame.Batch))
+		for i, msg := range frame.Batch {
+			tailored, _ := tailorFrame(caps, msg)
+			msgs[i] = tailored.(Message)
+		}
+		frame.Batch = msgs
+		return frame, true
+	case HistoryFrame:
+		msgs := make([]Message, len(frame.History))
+		for i, msg := range frame.History {
+			tailored, _ := tailorFrame(caps, msg)
+			msgs[i] = tailored.(Message)
+		}
+		frame.History = msgs
+		return frame, true
+	}
+	return v, true
+}
+
+// encodeFrame tailors a frame to a client's capabilities and encodes it
+// into buf, stamped with the server's time if the client takes it. It
+// returns false for frames the client doesn't take.
+func encodeFrame(buf *bytes.Buffer, caps []string, v any, now time.Time) (bool, error) {
+	v, ok := tailorFrame(caps, v)
+	if !ok {
+		return false, nil
+	}
+	if slices.Contains(caps, capServerTime) {
+		return true, stampFrame(buf, v, now)
+	}
+	return true, encodeJSON(buf, v)
+}
@@ -0,0 +1,42 @@
+package chat
+
+import (
+	"context"
+	"time"
+)
+
+// ChatService holds the chat operations shared by every frontend. Messages
+// from users go through their connection's message pipeline instead, which
+// keeps per-connection state such as rate limits.
+type ChatService interface {
+	// Announce posts a message from the system user to a room
+	Announce(ctx context.Context, room Room, content string) error
+	// History returns up to limit messages of a room with an ID below
+	// beforeID (or the latest ones when beforeID is 0), oldest first,
+	// reading the archive once the store runs out
+	History(ctx context.Context, room Room, beforeID, limit int) ([]Message, error)
+}
+
+var chatService ChatService = broadcastChatService{}
+
+// broadcastChatService is the ChatService that saves messages through the
+// write-behind queue and sends them to the room's clients
+type broadcastChatService struct{}
+
+func (broadcastChatService) Announce(ctx context.Context, room Room, content string) error {
+	msg := Message{
+		Username:    systemUsername,
+		Content:     content,
+		Room:        room.Name,
+		RoomID:      room.ID,
+		WorkspaceID: room.WorkspaceID,
+		CreatedAt:   time.Now().UTC(),
+	}
+	messageQueue.Enqueue(msg)
+	queueBroadcast(msg)
+	return nil
+}
+
+func (broadcastChatService) History(ctx context.Context, room Room, beforeID, limit int) ([]Message, error) {
+	return historyWithArchive(ctx, room, beforeID, limit)
+}
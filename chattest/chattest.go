@@ -0,0 +1,352 @@
+// Package chattest runs the whole chat server in-process for integration
+// tests. The server keeps its data in memory and listens on a random
+// loopback port; the helpers register users, create rooms, post tasks and
+// connect WebSocket clients whose frames a test can assert on.
+//
+//	func TestChat(t *testing.T) {
+//		srv := chattest.New(t)
+//		alice := srv.Register("alice")
+//		bob := srv.Guest("bob")
+//
+//		a, b := alice.Dial("general"), bob.Dial("general")
+//		a.Send("hi bob")
+//		b.ExpectMessage("alice", "hi bob")
+//	}
+//
+// The server keeps its state in package variables, so a process can only
+// run one at a time. A test can start a single server, and tests using
+// chattest must not call t.Parallel.
+package chattest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	chat "github.com/param85584/go-chat-app"
+)
+
+// Password of every user created with Register
+const Password = "chattest-password"
+
+// Timeout bounds every wait for a frame
+var Timeout = 5 * time.Second
+
+// Held by the running server
+var serverMu sync.Mutex
+
+// Server is a running chat server
+type Server struct {
+	// URL is the base URL of the server, e.g. "http://127.0.0.1:43127"
+	URL string
+
+	t     testing.TB
+	srv   *httptest.Server
+	mu    sync.Mutex
+	conns []*Conn
+}
+
+// New starts a server and stops it when the test ends. The configuration
+// starts from the defaults of chat.LoadConfig, with in-memory storage and
+// sessions, guest access on for Guest clients and outgoing email
+// disabled; configure may change it further.
+func New(t testing.TB, configure ...func(*chat.Config)) *Server {
+	t.Helper()
+	if !serverMu.TryLock() {
+		t.Fatal("chattest: another server is running; only one can run at a time")
+	}
+
+	srv := httptest.NewUnstartedServer(nil)
+	s := &Server{URL: "http://" + srv.Listener.Addr().String(), t: t, srv: srv}
+
+	cfg := chat.LoadConfig()
+	cfg.Addr = srv.Listener.Addr().String()
+	cfg.Store = "memory"
+	cfg.SessionStore = "memory"
+	cfg.RestoreFrom = ""
+	cfg.Seed = false
+	cfg.AuthProvider = "local"
+	cfg.SMTP = chat.SMTPConfig{}
+	cfg.RequireEmailVerification = false
+	cfg.PublicURL = s.URL
+	cfg.SecretKey = "chattest"
+	cfg.Features = append(cfg.Features, "guest_access=true")
+	for _, fn := range configure {
+		fn(&cfg)
+	}
+
+	handler, err := chat.NewServer(cfg)
+	if err != nil {
+		srv.Close()
+		serverMu.Unlock()
+		t.Fatalf("chattest: starting server: %v", err)
+	}
+	srv.Config.Handler = handler
+	srv.Start()
+	t.Cleanup(s.close)
+	return s
+}
+
+// close hangs up every client, stops the server and releases it for the
+// next test
+func (s *Server) close() {
+	defer serverMu.Unlock()
+
+	s.mu.Lock()
+	for _, c := range s.conns {
+		c.ws.Close()
+	}
+	s.mu.Unlock()
+	s.srv.Close()
+	if err := chat.Close(); err != nil {
+		s.t.Errorf("chattest: closing server: %v", err)
+	}
+}
+
+// Guest returns a client without an account, posting chat messages as
+// username
+func (s *Server) Guest(username string) *Client {
+	jar, _ := cookiejar.New(nil)
+	return &Client{Username: username, HTTP: &http.Client{Jar: jar}, s: s}
+}
+
+// Register creates an account with the given username and Password and
+// returns a client logged in to it
+func (s *Server) Register(username string) *Client {
+	s.t.Helper()
+	c := s.Guest(username)
+	creds := map[string]string{"username": username, "password": Password}
+	if code := c.Do(http.MethodPost, "/auth/register", creds, nil); code != http.StatusCreated {
+		s.t.Fatalf("chattest: registering %s: status %d", username, code)
+	}
+	return c
+}
+
+////////////
+// Client //
+////////////
+
+// Client makes requests to the server as one user or guest. Logged-in
+// clients keep their session cookie in HTTP's cookie jar.
+type Client struct {
+	Username string
+	HTTP     *http.Client
+	// Token, when set, is sent as a bearer token instead of the cookie
+	Token string
+
+	s *Server
+}
+
+// Do sends a JSON request and decodes a successful JSON response into out.
+// It returns the status code; error responses are not decoded.
+func (c *Client) Do(method, path string, in, out any) int {
+	c.s.t.Helper()
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			c.s.t.Fatalf("chattest: encoding %s %s: %v", method, path, err)
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, c.s.URL+path, body)
+	if err != nil {
+		c.s.t.Fatalf("chattest: %s %s: %v", method, path, err)
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	res, err := c.HTTP.Do(req)
+	if err != nil {
+		c.s.t.Fatalf("chattest: %s %s: %v", method, path, err)
+	}
+	defer res.Body.Close()
+
+	if out != nil && res.StatusCode < 300 && res.StatusCode != http.StatusNoContent {
+		if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+			c.s.t.Fatalf("chattest: decoding %s %s: %v", method, path, err)
+		}
+	}
+	return res.StatusCode
+}
+
+// CreateTask posts a task to the default workspace and returns it with
+// its ID
+func (c *Client) CreateTask(task chat.Task) chat.Task {
+	c.s.t.Helper()
+	var created chat.Task
+	if code := c.Do(http.MethodPost, "/tasks", task, &created); code != http.StatusCreated {
+		c.s.t.Fatalf("chattest: creating task %q: status %d", task.Title, code)
+	}
+	return created
+}
+
+// CreateRoom creates a chat room in the default workspace. Only logged-in
+// clients can create rooms.
+func (c *Client) CreateRoom(name string) chat.Room {
+	c.s.t.Helper()
+	var room chat.Room
+	if code := c.Do(http.MethodPost, "/rooms", chat.Room{Name: name}, &room); code != http.StatusCreated {
+		c.s.t.Fatalf("chattest: creating room #%s: status %d", name, code)
+	}
+	return room
+}
+
+// Dial connects to a chat room of the default workspace. The connection
+// is closed when the test ends.
+func (c *Client) Dial(room string) *Conn {
+	c.s.t.Helper()
+	u, _ := url.Parse(c.s.URL + "/ws")
+	u.RawQuery = url.Values{"room": {room}}.Encode()
+
+	// The dialer doesn't use the cookie jar, so pass the session on
+	header := http.Header{}
+	if c.Token != "" {
+		header.Set("Authorization", "Bearer "+c.Token)
+	}
+	for _, cookie := range c.HTTP.Jar.Cookies(u) {
+		header.Add("Cookie", cookie.String())
+	}
+	u.Scheme = "ws"
+
+	dialer := websocket.Dialer{HandshakeTimeout: Timeout}
+	ws, res, err := dialer.Dial(u.String(), header)
+	if err != nil {
+		status := 0
+		if res != nil {
+			status = res.StatusCode
+		}
+		c.s.t.Fatalf("chattest: connecting %s to #%s: %v (status %d)", c.Username, room, err, status)
+	}
+
+	conn := &Conn{Client: c, ws: ws}
+	c.s.mu.Lock()
+	c.s.conns = append(c.s.conns, conn)
+	c.s.mu.Unlock()
+	return conn
+}
+
+//////////
+// Conn //
+//////////
+
+// Frame is a frame sent by the server: a chat message, or an error for a
+// message of ours it rejected. An error carries the rejected message's
+// clientMsgId in the embedded Message, as a chat message does.
+type Frame struct {
+	chat.Message
+	Type         string `json:"type,omitempty"` // "error" for errors
+	Code         string `json:"code,omitempty"`
+	ErrorMessage string `json:"message,omitempty"`
+	RetryAfter   int    `json:"retryAfter,omitempty"` // Seconds to wait before trying again
+	Error        string `json:"error,omitempty"`      // Same as ErrorMessage
+}
+
+// Conn is a WebSocket connection to a chat room
+type Conn struct {
+	Client *Client
+	ws     *websocket.Conn
+}
+
+// Send posts a chat message. Guests post under their client's Username;
+// the server ignores it for logged-in users.
+func (c *Conn) Send(content string) {
+	c.Client.s.t.Helper()
+	c.SendMessage(chat.Message{Content: content})
+}
+
+// SendMessage posts a chat message with more than content, such as
+// attachments. An empty Username is filled in with the client's.
+func (c *Conn) SendMessage(msg chat.Message) {
+	t := c.Client.s.t
+	t.Helper()
+	if msg.Username == "" {
+		msg.Username = c.Client.Username
+	}
+	c.ws.SetWriteDeadline(time.Now().Add(Timeout))
+	if err := c.ws.WriteJSON(msg); err != nil {
+		t.Fatalf("chattest: sending as %s: %v", c.Client.Username, err)
+	}
+}
+
+// ReadFrame waits for the next frame
+func (c *Conn) ReadFrame() Frame {
+	t := c.Client.s.t
+	t.Helper()
+	f, err := c.read(Timeout)
+	if err != nil {
+		t.Fatalf("chattest: %s reading a frame: %v", c.Client.Username, err)
+	}
+	return f
+}
+
+// ExpectMessage waits for the next frame and fails the test unless it is
+// a chat message with the given author and content
+func (c *Conn) ExpectMessage(username, content string) chat.Message {
+	t := c.Client.s.t
+	t.Helper()
+	f := c.ReadFrame()
+	if f.Error != "" {
+		t.Fatalf("chattest: %s expected %s: %q, got error %q", c.Client.Username, username, content, f.Error)
+	}
+	if f.Username != username || f.Content != content {
+		t.Fatalf("chattest: %s expected %s: %q, got %s: %q", c.Client.Username, username, content, f.Username, f.Content)
+	}
+	return f.Message
+}
+
+// ExpectError waits for the next frame and fails the test unless it
+// rejects one of our messages. It returns the reason.
+func (c *Conn) ExpectError() string {
+	t := c.Client.s.t
+	t.Helper()
+	f := c.ReadFrame()
+	if f.Error == "" {
+		t.Fatalf("chattest: %s expected an error, got %s: %q", c.Client.Username, f.Username, f.Content)
+	}
+	return f.Error
+}
+
+// ExpectNothing fails the test if a frame arrives within d. A connection
+// can't be read from after a timeout, so this must be the last read on c.
+func (c *Conn) ExpectNothing(d time.Duration) {
+	t := c.Client.s.t
+	t.Helper()
+	f, err := c.read(d)
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return
+	}
+	if err != nil {
+		t.Fatalf("chattest: %s reading a frame: %v", c.Client.Username, err)
+	}
+	t.Fatalf("chattest: %s expected nothing, got %+v", c.Client.Username, f)
+}
+
+// Close hangs up
+func (c *Conn) Close() {
+	c.ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	c.ws.Close()
+}
+
+func (c *Conn) read(timeout time.Duration) (Frame, error) {
+	var f Frame
+	c.ws.SetReadDeadline(time.Now().Add(timeout))
+	err := c.ws.ReadJSON(&f)
+	return f, err
+}
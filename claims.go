@@ -0,0 +1,99 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultClaimTTL = 15 * time.Minute
+	maxClaimTTL     = 24 * time.Hour
+	// How often expired claims are released
+	claimReleaseInterval = 30 * time.Second
+)
+
+var errTaskClaimed = errors.New("task is claimed by someone else")
+
+// ClaimRequest is the optional request body for claiming a task
+type ClaimRequest struct {
+	// TTL is how many seconds the claim lasts, 15 minutes by default.
+	// Claiming the task again before then renews it.
+	TTL int `json:"ttl"`
+}
+
+// claimable reports whether username may claim a task at now: it must be
+// open and unassigned, already theirs, or held by a claim that expired
+func claimable(task Task, username string, now time.Time) bool {
+	if task.Status == "completed" {
+		return false
+	}
+	return task.Assignee == "" || strings.EqualFold(task.Assignee, username) ||
+		task.ClaimExpiresAt != nil && task.ClaimExpiresAt.Before(now)
+}
+
+// runClaimReleases returns tasks whose claim expired to the backlog every
+// claimReleaseInterval
+func runClaimReleases() {
+	for now := range time.Tick(claimReleaseInterval) {
+		releaseExpiredClaims(now)
+	}
+}
+
+// releaseExpiredClaims unassigns the tasks whose claim expired before now
+func releaseExpiredClaims(now time.Time) {
+	ctx, cancel := storeContext()
+	defer cancel()
+	// SQLite compares times as text, so they must all be in UTC
+	released, err := store.ReleaseExpiredClaims(ctx, now.UTC())
+	if err != nil {
+		log.Printf("Releasing expired claims failed: %v", err)
+		return
+	}
+	for _, task := range released {
+		publishEvent(task.WorkspaceID, eventTaskUpdated, strconv.Itoa(task.ID), TaskUpdatedEvent{
+			Task:           task,
+			PreviousStatus: task.Status,
+			PreviousTags:   task.Tags,
+			UpdatedBy:      systemUsername,
+		})
+	}
+}
+
+// Claim a task from the shared backlog for the logged-in user
+// (POST /tasks/{id}/claim). Only one user can hold a task; the claim is
+// released automatically when it expires unless it is renewed.
+func claimTask(w http.ResponseWriter, r *http.Request) {
+	user, _ := currentUser(r)
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid task ID", http.StatusBadRequest)
+		return
+	}
+
+	var req ClaimRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	ttl := defaultClaimTTL
+	if req.TTL != 0 {
+		ttl = time.Duration(req.TTL) * time.Second
+	}
+
+	task, err := taskService.Claim(r.Context(), requestWorkspace(r), id, user.Username, ttl)
+	if err != nil {
+		writeTaskError(w, err)
+		return
+	}
+
+	writeTask(w, r, http.StatusOK, task)
+}
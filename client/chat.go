@@ -0,0 +1,572 @@
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// RejectedError is reported to OnError handlers when the server drops a
+// message the client sent, e.g. because of a rate limit
+type RejectedError struct {
+	Reason string
+	Code   string // e.g. "rate.connection" or "policy.links"
+	// How long the server asked to wait before sending again, for rate
+	// limits and slow mode
+	RetryAfter time.Duration
+
+	// ClientMsgID of the dropped message, as PostMessage returned it
+	ClientMsgID string
+}
+
+func (e *RejectedError) Error() string {
+	return "message rejected: " + e.Reason
+}
+
+// GapError is reported to OnError handlers when the client missed
+// messages that the server no longer has at hand. The room's history
+// has them.
+type GapError struct {
+	From, To int64 // Sequence numbers of the missed messages
+}
+
+func (e *GapError) Error() string {
+	return fmt.Sprintf("missed messages %d to %d", e.From, e.To)
+}
+
+// chatConn is the WebSocket side of a Client. It keeps one connection to
+// the chat room open, redialing with backoff when it drops, and holds on
+// to messages sent in between until it is connected again.
+type chatConn struct {
+	client *Client
+
+	mu        sync.Mutex // Guards the fields below and writes to conn
+	conn      *websocket.Conn
+	pending   []Message
+	onMessage []func(Message)
+	onError   []func(error)
+	running   bool
+	closed    bool
+	cancel    context.CancelFunc
+	done      chan struct{}
+
+	// Time of the last message received, to resume from after a
+	// reconnect, and the wait the server asked for before reconnecting
+	lastSeen   time.Time
+	retryAfter time.Duration
+
+	// Sequence number of the last message on this connection, to spot
+	// the ones missed in between
+	lastSeq int64
+
+	// Highest stored message ID seen, which resumes skip past, and the
+	// client message IDs of the latest messages, oldest first, so a
+	// message replayed or resent after a reconnect isn't handed out twice
+	lastID    int
+	seenIDs   map[string]bool
+	seenOrder []string
+
+	// The connection left its room with Leave, and stays out of every
+	// room after reconnecting until Join
+	left bool
+}
+
+// Client message IDs remembered to spot repeated messages
+const maxSeenClientMsgIDs = 1000
+
+// frame is anything the server sends over the WebSocket: a chat message,
+// an error for a message of ours it dropped, or a notice that the server
+// is shutting down. Every frame carries the server's time of sending.
+type frame struct {
+	Message
+	Error     string `json:"error"`
+	Code      string `json:"code"`
+	Reconnect *struct {
+		RetryAfter int `json:"retryAfter"` // Seconds
+	} `json:"reconnect"`
+	Backfill *struct {
+		From     int64     `json:"from"`
+		To       int64     `json:"to"`
+		Messages []Message `json:"messages"`
+		Complete bool      `json:"complete"`
+	} `json:"backfill"`
+	ServerTime time.Time `json:"serverTime"`
+
+	// Messages sent together, and the capabilities the server agreed to
+	Batch        []Message `json:"batch"`
+	Capabilities []string  `json:"capabilities"`
+	// The room's latest messages, on connecting or joining it
+	History []Message `json:"history"`
+
+	// Error frames are typed "error", and say how long to wait for rate
+	// limits
+	Type       string `json:"type"`
+	RetryAfter int    `json:"retryAfter"` // Seconds
+
+	// Confirm a Join or Leave
+	Joined string `json:"joined"`
+	Left   string `json:"left"`
+}
+
+// Capabilities the client advertises when it connects
+var capabilities = []string{"attachments", "notices", "server-time", "batches", "history"}
+
+// OnMessage registers a callback for every message posted in the room,
+// including the client's own. Callbacks run on the connection's read
+// loop, so a slow callback delays the ones after it.
+func (c *Client) OnMessage(fn func(Message)) {
+	c.chat.mu.Lock()
+	defer c.chat.mu.Unlock()
+	c.chat.onMessage = append(c.chat.onMessage, fn)
+}
+
+// OnError registers a callback for dropped connections, failed
+// reconnection attempts and messages the server rejected (*RejectedError)
+func (c *Client) OnError(fn func(error)) {
+	c.chat.mu.Lock()
+	defer c.chat.mu.Unlock()
+	c.chat.onError = append(c.chat.onError, fn)
+}
+
+// Connect joins the chat room. It returns once the first connection is
+// established; after that the client reconnects on its own until ctx is
+// cancelled or Close is called.
+func (c *Client) Connect(ctx context.Context) error {
+	cc := &c.chat
+
+	cc.mu.Lock()
+	if cc.closed {
+		cc.mu.Unlock()
+		return ErrClosed
+	}
+	if cc.running {
+		cc.mu.Unlock()
+		return errors.New("client is already connected")
+	}
+	cc.running = true
+	cc.mu.Unlock()
+
+	conn, err := c.dial(ctx, time.Time{}, 0)
+	if err != nil {
+		cc.mu.Lock()
+		cc.running = false
+		cc.mu.Unlock()
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	cc.mu.Lock()
+	cc.cancel = cancel
+	cc.done = make(chan struct{})
+	cc.mu.Unlock()
+
+	cc.attach(conn)
+	go cc.run(ctx, conn)
+	return nil
+}
+
+// SendMessage posts a message to the room. While the client is
+// reconnecting the message is kept and sent once the connection is back.
+func (c *Client) SendMessage(content string) error {
+	_, err := c.PostMessage(content)
+	return err
+}
+
+// PostMessage posts a message like SendMessage and returns the client
+// message ID it was sent with. The message comes back to OnMessage with
+// that ClientMsgID once the server has broadcast it, or to OnError as a
+// *RejectedError with it when the server dropped it, so a message shown
+// before it was sent can be swapped for the server's copy.
+func (c *Client) PostMessage(content string) (string, error) {
+	cc := &c.chat
+	msg := Message{Username: c.username, Content: content, ClientMsgID: newClientMsgID()}
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	if cc.closed {
+		return "", ErrClosed
+	}
+	if cc.conn == nil || cc.conn.WriteJSON(msg) != nil {
+		// The read loop notices the broken connection and reconnects
+		cc.queue(msg)
+	}
+	return msg.ClientMsgID, nil
+}
+
+// Join moves the connection to another room of the workspace. Messages
+// of the room it was in stop arriving, and the client reconnects to the
+// new room from then on. Before Connect, it only picks the room.
+func (c *Client) Join(room string) error {
+	cc := &c.chat
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	if cc.closed {
+		return ErrClosed
+	}
+	c.room, cc.left = room, false
+	if cc.conn != nil {
+		// The new room is picked up when reconnecting if this fails
+		cc.conn.WriteJSON(map[string]string{"join": room})
+	}
+	return nil
+}
+
+// Leave takes the connection out of its room without joining another, so
+// no messages arrive until Join. Messages posted meanwhile are rejected.
+func (c *Client) Leave() error {
+	cc := &c.chat
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	if cc.closed {
+		return ErrClosed
+	}
+	cc.left = true
+	if cc.conn != nil {
+		cc.conn.WriteJSON(map[string]bool{"leave": true})
+	}
+	return nil
+}
+
+// currentRoom is the room the client joined last, or "" for the default
+// one
+func (c *Client) currentRoom() string {
+	c.chat.mu.Lock()
+	defer c.chat.mu.Unlock()
+	return c.room
+}
+
+// newClientMsgID returns a random ID for a message to post
+func newClientMsgID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Close disconnects from the chat room. Messages still waiting for a
+// connection are dropped.
+func (c *Client) Close() error {
+	cc := &c.chat
+
+	cc.mu.Lock()
+	if cc.closed {
+		cc.mu.Unlock()
+		return nil
+	}
+	cc.closed = true
+	cancel, done, conn := cc.cancel, cc.done, cc.conn
+	if conn != nil {
+		conn.WriteMessage(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	}
+	cc.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+	if conn != nil {
+		conn.Close()
+	}
+	if done != nil {
+		<-done
+	}
+	return nil
+}
+
+// dial opens a WebSocket to the room. A non-zero since asks the server
+// to replay the messages posted after it, leaving out those up to the
+// stored message lastID.
+func (c *Client) dial(ctx context.Context, since time.Time, lastID int) (*websocket.Conn, error) {
+	u := *c.baseURL
+	if u.Scheme == "https" {
+		u.Scheme = "wss"
+	} else {
+		u.Scheme = "ws"
+	}
+	u.Path += "/ws"
+	query := url.Values{}
+	if room := c.currentRoom(); room != "" {
+		query.Set("room", room)
+	}
+	if !since.IsZero() {
+		query.Set("since", since.Format(time.RFC3339Nano))
+	}
+	if lastID != 0 {
+		query.Set("lastId", strconv.Itoa(lastID))
+	}
+	query["capability"] = capabilities
+	u.RawQuery = query.Encode()
+
+	header := http.Header{}
+	if c.token != "" {
+		header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	dialer := *websocket.DefaultDialer
+	if t, ok := c.http.Transport.(*http.Transport); ok {
+		dialer.Proxy = t.Proxy
+		dialer.TLSClientConfig = t.TLSClientConfig
+	}
+	conn, res, err := dialer.DialContext(ctx, u.String(), header)
+	if err != nil && res != nil {
+		return nil, newAPIError(res)
+	}
+	return conn, err
+}
+
+// run reads from the connection and reconnects whenever it drops
+func (cc *chatConn) run(ctx context.Context, conn *websocket.Conn) {
+	defer close(cc.done)
+
+	for {
+		err := cc.read(conn)
+		cc.detach(conn)
+		if ctx.Err() != nil || cc.isClosed() {
+			return
+		}
+		cc.reportError(err)
+
+		// The server closes with a policy violation when we may not post;
+		// reconnecting wouldn't change that
+		if websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+			return
+		}
+
+		conn = cc.reconnect(ctx)
+		if conn == nil {
+			return
+		}
+		cc.attach(conn)
+	}
+}
+
+// read dispatches incoming frames until the connection fails
+func (cc *chatConn) read(conn *websocket.Conn) error {
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+
+		var f frame
+		if err := json.Unmarshal(data, &f); err != nil {
+			cc.reportError(err)
+			continue
+		}
+		if !f.ServerTime.IsZero() {
+			cc.client.observeServerTime(f.ServerTime, time.Now())
+		}
+		if f.Type == "error" || f.Error != "" {
+			cc.reportError(&RejectedError{
+				Reason:      f.Error,
+				Code:        f.Code,
+				RetryAfter:  time.Duration(f.RetryAfter) * time.Second,
+				ClientMsgID: f.ClientMsgID,
+			})
+			continue
+		}
+		if f.Reconnect != nil {
+			cc.mu.Lock()
+			cc.retryAfter = time.Duration(f.Reconnect.RetryAfter) * time.Second
+			cc.mu.Unlock()
+			continue
+		}
+		if f.Backfill != nil {
+			cc.dispatch(f.Backfill.Messages...)
+			if !f.Backfill.Complete {
+				cc.reportError(&GapError{From: f.Backfill.From, To: f.Backfill.To})
+			}
+			continue
+		}
+		if f.Capabilities != nil {
+			continue
+		}
+		if f.Joined != "" || f.Left != "" {
+			// The new room numbers its messages from the start
+			cc.mu.Lock()
+			cc.lastSeq = 0
+			cc.mu.Unlock()
+			continue
+		}
+		if f.History != nil {
+			cc.dispatch(f.History...)
+			continue
+		}
+		if f.Batch != nil {
+			for _, msg := range f.Batch {
+				cc.checkSeq(conn, msg.Seq)
+				cc.dispatch(msg)
+			}
+			continue
+		}
+
+		cc.checkSeq(conn, f.Seq)
+		cc.dispatch(f.Message)
+	}
+}
+
+// checkSeq follows the sequence numbers of the room's messages and asks
+// for the ones missed in between
+func (cc *chatConn) checkSeq(conn *websocket.Conn, seq int64) {
+	if seq == 0 {
+		return
+	}
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	// A lower number means the server started the sequence over
+	if cc.lastSeq != 0 && seq > cc.lastSeq+1 {
+		// Ask for the missed messages; they arrive after this one
+		conn.WriteJSON(map[string]any{"backfill": map[string]int64{"from": cc.lastSeq + 1, "to": seq - 1}})
+	}
+	cc.lastSeq = seq
+}
+
+// dispatch hands messages to the OnMessage callbacks, once each
+func (cc *chatConn) dispatch(msgs ...Message) {
+	for _, msg := range msgs {
+		cc.mu.Lock()
+		if cc.seen(msg) {
+			cc.mu.Unlock()
+			continue
+		}
+		if msg.CreatedAt.After(cc.lastSeen) {
+			cc.lastSeen = msg.CreatedAt
+		}
+		handlers := cc.onMessage
+		cc.mu.Unlock()
+		for _, fn := range handlers {
+			fn(msg)
+		}
+	}
+}
+
+// seen reports whether a message was handed out before, and remembers it
+// otherwise. Live messages have no stored ID yet, so those are told
+// apart by their client message ID. The caller holds cc.mu.
+func (cc *chatConn) seen(msg Message) bool {
+	if msg.ID != 0 {
+		if msg.ID <= cc.lastID {
+			return true
+		}
+		cc.lastID = msg.ID
+	}
+	if msg.ClientMsgID == "" {
+		return false
+	}
+	if cc.seenIDs[msg.ClientMsgID] {
+		return true
+	}
+	if cc.seenIDs == nil {
+		cc.seenIDs = make(map[string]bool)
+	}
+	cc.seenIDs[msg.ClientMsgID] = true
+	cc.seenOrder = append(cc.seenOrder, msg.ClientMsgID)
+	if len(cc.seenOrder) > maxSeenClientMsgIDs {
+		delete(cc.seenIDs, cc.seenOrder[0])
+		cc.seenOrder = cc.seenOrder[1:]
+	}
+	return false
+}
+
+// reconnect dials until it succeeds, backing off exponentially, and
+// resumes from the last message received. It first waits as long as a
+// server that shut down asked. It returns nil when ctx is cancelled
+// first.
+func (cc *chatConn) reconnect(ctx context.Context) *websocket.Conn {
+	c := cc.client
+	cc.mu.Lock()
+	backoff := max(c.minBackoff, cc.retryAfter)
+	cc.retryAfter = 0
+	since, lastID := cc.lastSeen, cc.lastID
+	cc.mu.Unlock()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+
+		conn, err := c.dial(ctx, since, lastID)
+		if err == nil {
+			return conn
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		cc.reportError(err)
+		backoff = min(backoff*2, c.maxBackoff)
+		// A server throttling reconnects says how long to wait
+		var apiErr *APIError
+		if errors.As(err, &apiErr) {
+			backoff = max(backoff, apiErr.RetryAfter)
+		}
+	}
+}
+
+// attach makes conn the active connection and sends the messages that
+// were queued while disconnected
+func (cc *chatConn) attach(conn *websocket.Conn) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	cc.conn = conn
+	cc.lastSeq = 0
+	if cc.left {
+		conn.WriteJSON(map[string]bool{"leave": true})
+	}
+	pending := cc.pending
+	cc.pending = nil
+	for i, msg := range pending {
+		if err := conn.WriteJSON(msg); err != nil {
+			cc.pending = append(cc.pending, pending[i:]...)
+			return
+		}
+	}
+}
+
+// detach forgets a connection that has failed
+func (cc *chatConn) detach(conn *websocket.Conn) {
+	conn.Close()
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if cc.conn == conn {
+		cc.conn = nil
+	}
+}
+
+// queue keeps a message until the client is connected again, dropping
+// the oldest ones beyond the limit. The caller holds cc.mu.
+func (cc *chatConn) queue(msg Message) {
+	cc.pending = append(cc.pending, msg)
+	if max := cc.client.maxPending; len(cc.pending) > max {
+		cc.pending = cc.pending[len(cc.pending)-max:]
+	}
+}
+
+func (cc *chatConn) isClosed() bool {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.closed
+}
+
+func (cc *chatConn) reportError(err error) {
+	cc.mu.Lock()
+	handlers := cc.onError
+	cc.mu.Unlock()
+	for _, fn := range handlers {
+		fn(err)
+	}
+}
@@ -0,0 +1,444 @@
+// Package client is a Go client for the chat server. It speaks the
+// WebSocket chat protocol, reconnecting on its own when the connection
+// drops, and wraps the task REST API in typed methods.
+//
+//	c, err := client.New("https://chat.example.com", token, client.WithRoom("ops"))
+//	c.OnMessage(func(m client.Message) { fmt.Println(m.Username+":", m.Content) })
+//	err = c.Connect(ctx)
+//	err = c.SendMessage("deploy finished")
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message is a chat message
+type Message struct {
+	ID        int       `json:"id,omitempty"`
+	Username  string    `json:"username"`
+	Content   string    `json:"content"`
+	Room      string    `json:"room,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+
+	Attachments []Attachment `json:"attachments,omitempty"`
+	// Number of the message in the room's broadcasts; zero for messages
+	// replayed from history
+	Seq int64 `json:"seq,omitempty"`
+	// ID the sender picked for the message, which comes back on the
+	// broadcast; see PostMessage
+	ClientMsgID string `json:"clientMsgId,omitempty"`
+}
+
+// Attachment is a file shared in a message
+type Attachment struct {
+	Name        string `json:"name"`
+	URL         string `json:"url,omitempty"`
+	ContentType string `json:"contentType"`
+}
+
+// Task is a task in the workspace the client is connected to
+type Task struct {
+	ID          int        `json:"id"`
+	Title       string     `json:"title"`
+	Description string     `json:"description"`
+	Status      string     `json:"status"`             // "pending" or "completed"
+	Assignee    string     `json:"assignee,omitempty"` // Username
+	Priority    string     `json:"priority,omitempty"` // "low", "normal", "high" or "urgent"
+	Tags        []string   `json:"tags,omitempty"`
+	DueDate     *time.Time `json:"dueDate,omitempty"`
+	ProjectID   int        `json:"projectId,omitempty"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	CompletedAt *time.Time `json:"completedAt,omitempty"`
+	// ClaimExpiresAt is when a claim on the task runs out
+	ClaimExpiresAt *time.Time `json:"claimExpiresAt,omitempty"`
+}
+
+// TaskChanges is a page of the tasks changed since a cursor
+type TaskChanges struct {
+	Cursor  string       `json:"cursor"` // Pass to TaskChanges next time
+	Changes []TaskChange `json:"changes"`
+	HasMore bool         `json:"hasMore"` // Ask again right away
+	// Changes is a page of every task in the workspace. Together with the
+	// pages up to the one without HasMore they replace the caller's copy;
+	// deleted tasks aren't listed then.
+	Full bool `json:"full"`
+}
+
+// TaskChange is a task as it is now, or a tombstone for a deleted one
+type TaskChange struct {
+	ID         int   `json:"id"`
+	Deleted    bool  `json:"deleted,omitempty"`
+	MergedInto int   `json:"mergedInto,omitempty"`
+	Task       *Task `json:"task,omitempty"` // Nil for deleted tasks
+}
+
+// Room is a chat room in the workspace the client is connected to
+type Room struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"createdAt"`
+	SlowMode  int       `json:"slowMode"` // Seconds each user waits between messages, 0 when off
+	Policy    struct {
+		MaxLength int  `json:"maxLength"` // Longest message in characters, 0 for the server limit
+		NoLinks   bool `json:"noLinks"`
+	} `json:"policy"`
+}
+
+// ActiveRoom is a room with clients connected to it
+type ActiveRoom struct {
+	Name    string `json:"name"`
+	Members int    `json:"members"`
+}
+
+// APIError is returned for requests the server answers with an error status
+type APIError struct {
+	StatusCode int
+	Message    string
+	RetryAfter time.Duration // How long the server asked to wait, for 429 and 503
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("chat server: %d %s", e.StatusCode, e.Message)
+}
+
+// newAPIError reads an error response
+func newAPIError(res *http.Response) *APIError {
+	msg, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+	e := &APIError{StatusCode: res.StatusCode, Message: strings.TrimSpace(string(msg))}
+	if seconds, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil {
+		e.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	return e
+}
+
+// ErrClosed is returned when using a client after Close
+var ErrClosed = errors.New("client is closed")
+
+// Client talks to one chat server, and to one workspace and room on it.
+// It is safe for concurrent use.
+type Client struct {
+	baseURL  *url.URL
+	token    string
+	http     *http.Client
+	room     string // Guarded by chat.mu, as Join changes it
+	username string
+
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	maxPending int
+
+	chat chatConn
+
+	// How far the server's clock is ahead of ours, measured with
+	// SyncClock or, until then, estimated from chat frames
+	clockMu     sync.Mutex
+	clockOffset time.Duration
+	clockSynced bool
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithHTTPClient sets the HTTP client used for REST calls and the
+// WebSocket handshake
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.http = hc }
+}
+
+// WithRoom picks the chat room to join instead of the default one
+func WithRoom(room string) Option {
+	return func(c *Client) { c.room = room }
+}
+
+// WithUsername sets the name to post under when the client has no token.
+// Clients with a token always post under their account name.
+func WithUsername(name string) Option {
+	return func(c *Client) { c.username = name }
+}
+
+// WithReconnectBackoff sets the shortest and longest wait between
+// reconnection attempts
+func WithReconnectBackoff(min, max time.Duration) Option {
+	return func(c *Client) { c.minBackoff, c.maxBackoff = min, max }
+}
+
+// WithMaxPending sets how many messages sent while disconnected are kept
+// to be delivered after reconnecting
+func WithMaxPending(n int) Option {
+	return func(c *Client) { c.maxPending = n }
+}
+
+// New creates a client for the server at baseURL, e.g.
+// "https://chat.example.com" or "https://chat.example.com/w/acme" for a
+// workspace. The token is a personal API token or an access token from
+// logging in; it may be empty for servers that allow guests.
+func New(baseURL, token string, opts ...Option) (*Client, error) {
+	u, err := url.Parse(strings.TrimSuffix(baseURL, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported URL scheme %q", u.Scheme)
+	}
+
+	c := &Client{
+		baseURL:    u,
+		token:      token,
+		http:       http.DefaultClient,
+		minBackoff: time.Second,
+		maxBackoff: 30 * time.Second,
+		maxPending: 100,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.chat.client = c
+	return c, nil
+}
+
+// Login logs in with a username and password and returns a client that
+// uses the access token the server hands out. Access tokens expire, after
+// an hour by default; log in again then. Accounts with two-factor
+// authentication need a personal API token instead.
+func Login(ctx context.Context, baseURL, username, password string, opts ...Option) (*Client, error) {
+	c, err := New(baseURL, "", opts...)
+	if err != nil {
+		return nil, err
+	}
+	var res struct {
+		AccessToken       string `json:"accessToken"`
+		TwoFactorRequired bool   `json:"twoFactorRequired"`
+	}
+	creds := map[string]string{"username": username, "password": password}
+	if err := c.do(ctx, http.MethodPost, "/auth/login", creds, &res); err != nil {
+		return nil, err
+	}
+	if res.TwoFactorRequired {
+		return nil, errors.New("the account uses two-factor authentication; use an API token")
+	}
+	if res.AccessToken == "" {
+		return nil, errors.New("the server hands out no access tokens; use an API token")
+	}
+	c.token = res.AccessToken
+	return c, nil
+}
+
+// endpoint returns the URL of a server path
+func (c *Client) endpoint(path string) string {
+	return c.baseURL.String() + path
+}
+
+// do sends a REST request and decodes the JSON response into out
+func (c *Client) do(ctx context.Context, method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.endpoint(path), body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		return newAPIError(res)
+	}
+	if out == nil || res.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+///////////
+// Rooms //
+///////////
+
+// ListRooms returns the chat rooms of the workspace
+func (c *Client) ListRooms(ctx context.Context) ([]Room, error) {
+	var rooms []Room
+	err := c.do(ctx, http.MethodGet, "/rooms", nil, &rooms)
+	return rooms, err
+}
+
+// ActiveRooms returns the rooms people are connected to, busiest first
+func (c *Client) ActiveRooms(ctx context.Context) ([]ActiveRoom, error) {
+	var rooms []ActiveRoom
+	err := c.do(ctx, http.MethodGet, "/rooms/active", nil, &rooms)
+	return rooms, err
+}
+
+// History returns up to limit messages of the client's room posted before
+// the message beforeID, oldest first, or the latest ones when beforeID is
+// 0. Passing the ID of the first message gets the page before it.
+func (c *Client) History(ctx context.Context, beforeID, limit int) ([]Message, error) {
+	q := url.Values{}
+	if room := c.currentRoom(); room != "" {
+		q.Set("room", room)
+	}
+	if beforeID != 0 {
+		q.Set("before", strconv.Itoa(beforeID))
+	}
+	if limit != 0 {
+		q.Set("limit", strconv.Itoa(limit))
+	}
+	var msgs []Message
+	err := c.do(ctx, http.MethodGet, "/messages?"+q.Encode(), nil, &msgs)
+	return msgs, err
+}
+
+///////////
+// Tasks //
+///////////
+
+// ListTasks returns every task in the workspace
+func (c *Client) ListTasks(ctx context.Context) ([]Task, error) {
+	var tasks []Task
+	err := c.do(ctx, http.MethodGet, "/tasks", nil, &tasks)
+	return tasks, err
+}
+
+// GetTask returns a single task
+func (c *Client) GetTask(ctx context.Context, id int) (Task, error) {
+	var task Task
+	err := c.do(ctx, http.MethodGet, "/tasks/"+strconv.Itoa(id), nil, &task)
+	return task, err
+}
+
+// CreateTask creates a task and returns it with its ID
+func (c *Client) CreateTask(ctx context.Context, task Task) (Task, error) {
+	var created Task
+	err := c.do(ctx, http.MethodPost, "/tasks", task, &created)
+	return created, err
+}
+
+// UpdateTask replaces the task with the same ID
+func (c *Client) UpdateTask(ctx context.Context, task Task) (Task, error) {
+	var updated Task
+	err := c.do(ctx, http.MethodPut, "/tasks/"+strconv.Itoa(task.ID), task, &updated)
+	return updated, err
+}
+
+// DeleteTask deletes a task
+func (c *Client) DeleteTask(ctx context.Context, id int) error {
+	return c.do(ctx, http.MethodDelete, "/tasks/"+strconv.Itoa(id), nil, nil)
+}
+
+// CloneTask creates a pending, unassigned copy of a task, with its tags
+// when tags is true
+func (c *Client) CloneTask(ctx context.Context, id int, tags bool) (Task, error) {
+	var clone Task
+	err := c.do(ctx, http.MethodPost, "/tasks/"+strconv.Itoa(id)+"/clone", map[string]bool{"tags": tags}, &clone)
+	return clone, err
+}
+
+// ClaimTask claims an open task for the logged-in user for ttl, or the
+// server's default when ttl is 0. It fails with a 409 *APIError when
+// someone else holds the task.
+func (c *Client) ClaimTask(ctx context.Context, id int, ttl time.Duration) (Task, error) {
+	var claimed Task
+	err := c.do(ctx, http.MethodPost, "/tasks/"+strconv.Itoa(id)+"/claim", map[string]int{"ttl": int(ttl.Seconds())}, &claimed)
+	return claimed, err
+}
+
+// MergeTasks merges the task otherID into the task id and returns the
+// result. Getting otherID afterwards returns the merged task.
+func (c *Client) MergeTasks(ctx context.Context, id, otherID int) (Task, error) {
+	var merged Task
+	err := c.do(ctx, http.MethodPost, "/tasks/"+strconv.Itoa(id)+"/merge/"+strconv.Itoa(otherID), nil, &merged)
+	return merged, err
+}
+
+// UndoTask reverts the latest change to a task, if it was recent enough,
+// and returns the task. With a room, a confirmation is posted to it.
+func (c *Client) UndoTask(ctx context.Context, id int, room string) (Task, error) {
+	var task Task
+	err := c.do(ctx, http.MethodPost, "/tasks/"+strconv.Itoa(id)+"/undo", map[string]string{"room": room}, &task)
+	return task, err
+}
+
+// TaskChanges returns the tasks changed since cursor, which is empty the
+// first time. Keep calling it with the returned cursor while HasMore is
+// true.
+func (c *Client) TaskChanges(ctx context.Context, cursor string) (TaskChanges, error) {
+	var changes TaskChanges
+	err := c.do(ctx, http.MethodGet, "/tasks/changes?since="+url.QueryEscape(cursor), nil, &changes)
+	return changes, err
+}
+
+/////////////////
+// Server Time //
+/////////////////
+
+// SyncClock measures how far the server's clock is off from ours with a
+// round trip to /time, and returns the offset to add to local times
+func (c *Client) SyncClock(ctx context.Context) (time.Duration, error) {
+	var res struct {
+		Time       time.Time `json:"time"`
+		ReceivedAt time.Time `json:"receivedAt"`
+	}
+	sent := time.Now()
+	path := "/time?t=" + strconv.FormatInt(sent.UnixMilli(), 10)
+	if err := c.do(ctx, http.MethodGet, path, nil, &res); err != nil {
+		return 0, err
+	}
+	received := time.Now()
+
+	// Assume the request and the response took equally long
+	offset := (res.ReceivedAt.Sub(sent) + res.Time.Sub(received)) / 2
+	c.clockMu.Lock()
+	c.clockOffset, c.clockSynced = offset, true
+	c.clockMu.Unlock()
+	return offset, nil
+}
+
+// ClockOffset is how far the server's clock is ahead of ours, negative
+// when it is behind
+func (c *Client) ClockOffset() time.Duration {
+	c.clockMu.Lock()
+	defer c.clockMu.Unlock()
+	return c.clockOffset
+}
+
+// ServerNow is the current time by the server's clock
+func (c *Client) ServerNow() time.Time {
+	return time.Now().Add(c.ClockOffset())
+}
+
+// observeServerTime estimates the clock offset from the server time on a
+// frame received at local time received, until SyncClock measures it. The
+// frame was sent before it arrived, so each estimate is low by its delay
+// and the highest one is the closest.
+func (c *Client) observeServerTime(server, received time.Time) {
+	c.clockMu.Lock()
+	defer c.clockMu.Unlock()
+	if estimate := server.Sub(received); !c.clockSynced && (c.clockOffset == 0 || estimate > c.clockOffset) {
+		c.clockOffset = estimate
+	}
+}
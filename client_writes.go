@@ -0,0 +1,203 @@
+package chat
+
+import (
+	"errors"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Every client has its frames written by a goroutine of its own, from a
+// queue broadcasts only add to. A client that stops reading fills its
+// queue and is dropped, instead of holding up the room for the write
+// deadline.
+//
+// The clients belong to the hub, whose loop never waits on a connection:
+// frames are only ever queued, and a full queue drops the client. A client
+// that connects or joins a room has its live frames held back while what
+// came before them, the room's history or a replay, is loaded from the
+// store off the loop, and that is queued ahead of them.
+
+var errSlowClient = errors.New("client fell behind on its frames")
+
+// clientClose is queued behind a client's frames to close the connection
+// once they are written
+type clientClose struct {
+	code   int
+	reason string
+}
+
+// writePump writes the frames queued for a client until the queue is
+// closed or a write fails. Broadcasts are timed to the end of their write.
+// It closes done when it stops.
+func writePump(ws *websocket.Conn, caps []string, send <-chan any, done chan<- struct{}) {
+	defer close(done)
+	// Frames left when it stops are never written, but their broadcasts
+	// are done with this client. The queue is closed once the client is
+	// removed.
+	defer func() {
+		for v := range send {
+			frameDone(v)
+		}
+	}()
+	for v := range send {
+		if c, ok := v.(clientClose); ok {
+			closeConn(ws, c.code, c.reason)
+			return
+		}
+		err := writeFrame(ws, caps, v)
+		frameDone(v)
+		if err != nil {
+			log.Printf("WebSocket write error: %v", err)
+			delivery.recordDropped()
+			// The read loop sees the connection closed and removes it
+			ws.Close()
+			return
+		}
+	}
+}
+
+// writeFrame writes a frame, tailored to the client's capabilities,
+// within the broadcast timeout. Only the client's pump writes frames.
+func writeFrame(ws *websocket.Conn, caps []string, v any) error {
+	now := time.Now()
+	buf := getFrameBuffer()
+	defer putFrameBuffer(buf)
+	ok, err := encodeFrame(buf, caps, v, now)
+	if err != nil || !ok {
+		return err
+	}
+	if timeouts.Broadcast > 0 {
+		ws.SetWriteDeadline(now.Add(timeouts.Broadcast))
+	}
+	err = ws.WriteMessage(websocket.TextMessage, buf.Bytes())
+	ws.SetWriteDeadline(time.Time{})
+	return err
+}
+
+// drop stops broadcasting to a client and lets its pump finish what is
+// queued. The frames held back for it or waiting for a batch are never
+// written.
+func (h *Hub) drop(ws *websocket.Conn) {
+	if c, ok := h.clients[ws]; ok {
+		delete(h.clients, ws)
+		close(c.send)
+		if c.held != nil {
+			for _, v := range *c.held {
+				frameDone(v)
+			}
+		}
+		if c.batch != nil {
+			for _, msg := range c.batch.pending {
+				msg.broadcast.done()
+			}
+			c.batch.pending = nil
+		}
+	}
+}
+
+// hangUp closes a client's connection with the code and reason once the
+// frames queued for it are written, and stops broadcasting to it. It
+// returns a channel closed when the pump is done, or nil when the client
+// was already gone.
+func (h *Hub) hangUp(ws *websocket.Conn, code int, reason string) <-chan struct{} {
+	c, ok := h.clients[ws]
+	if !ok {
+		return nil
+	}
+	select {
+	case c.send <- clientClose{code, reason}:
+	default:
+		// A client this far behind doesn't get to read the rest
+		closeConn(ws, code, reason)
+	}
+	h.drop(ws)
+	return c.done
+}
+
+// queueSize is how many frames a client's queue holds: the configured
+// size, plus room for a replay when it resumes and for the history of the
+// rooms it joins when that comes as separate messages
+func queueSize(caps []string, resuming bool) int {
+	n := max(hubConfig.ClientQueue, 1)
+	if resuming {
+		n += maxResumeMessages
+	}
+	if !slices.Contains(caps, capHistory) {
+		n += max(historyOnConnect, 0)
+	}
+	return n
+}
+
+// releaseClient queues msgs for a client ahead of the frames held back
+// for it, leaving out the messages it is getting among those, and has
+// what follows go out as it comes. A room's history goes in one frame to
+// clients that take it. A client whose queue can't take them all is
+// dropped, as on a broadcast.
+func releaseClient(ws *websocket.Conn, msgs []Message, history bool) error {
+	var err error
+	hub.do(func() { err = hub.release(ws, msgs, history) })
+	return err
+}
+
+// release is releaseClient on the hub's loop
+func (h *Hub) release(ws *websocket.Conn, msgs []Message, history bool) error {
+	c, ok := h.clients[ws]
+	if !ok || c.held == nil {
+		return nil
+	}
+	held := *c.held
+	c.held = nil
+	h.clients[ws] = c
+
+	msgs = slices.DeleteFunc(slices.Clone(msgs), func(m Message) bool { return heldBack(held, m) })
+	var err error
+	if history && slices.Contains(c.caps, capHistory) {
+		if len(msgs) > 0 {
+			err = h.write(ws, HistoryFrame{History: msgs})
+		}
+	} else {
+		for _, msg := range msgs {
+			if err = h.write(ws, msg); err != nil {
+				break
+			}
+		}
+	}
+	for _, v := range held {
+		if err != nil {
+			// The client was dropped, so the rest never go out
+			frameDone(v)
+			continue
+		}
+		err = h.write(ws, v)
+	}
+	return err
+}
+
+// heldBack tells whether a message loaded from the store is among the
+// frames held back for a client. Broadcasts go out before the store
+// assigns an ID, so messages are told apart by who posted what when.
+func heldBack(held []any, msg Message) bool {
+	for _, v := range held {
+		switch v := v.(type) {
+		case Message:
+			if sameMessage(v, msg) {
+				return true
+			}
+		case BatchFrame:
+			if slices.ContainsFunc(v.Batch, func(m Message) bool { return sameMessage(m, msg) }) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sameMessage tells whether two copies are of the same message, to the
+// microsecond some databases keep times at
+func sameMessage(a, b Message) bool {
+	return a.Username == b.Username && a.Content == b.Content &&
+		a.CreatedAt.Round(time.Microsecond).Equal(b.CreatedAt.Round(time.Microsecond))
+}
@@ -0,0 +1,133 @@
+package chat
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestReleaseClient(t *testing.T) {
+	useHub(t)
+	prev := hubConfig
+	hubConfig.ClientQueue = 10
+	t.Cleanup(func() { hubConfig = prev })
+
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	older := Message{ID: 1, Username: "alice", Content: "before", CreatedAt: at}
+	// The store keeps times to the microsecond, the broadcast doesn't
+	stored := Message{ID: 2, Username: "bob", Content: "during", CreatedAt: at.Add(time.Second)}
+	live := stored
+	live.ID, live.Seq, live.CreatedAt = 0, 7, stored.CreatedAt.Add(300*time.Nanosecond)
+	later := Message{Username: "alice", Content: "after", CreatedAt: at.Add(2 * time.Second), Seq: 8}
+
+	tests := []struct {
+		name    string
+		caps    []string
+		history bool
+		want    []any
+	}{
+		{"replay", nil, false, []any{older, live, later}},
+		{"history as messages", nil, true, []any{older, live, later}},
+		{"history frame", []string{capHistory}, true, []any{HistoryFrame{History: []Message{older}}, live, later}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ws := &websocket.Conn{}
+			send := make(chan any, 10)
+			hub.registerClient(ws, chatClient{caps: tt.caps, send: send, held: new([]any)})
+			// Broadcast while the client is being sent what came before
+			hub.do(func() {
+				hub.write(ws, live)
+				hub.write(ws, later)
+			})
+			t.Cleanup(func() { hub.unregisterClient(ws) })
+
+			if n := len(send); n != 0 {
+				t.Fatalf("%d frames went out while held back", n)
+			}
+			if err := releaseClient(ws, []Message{older, stored}, tt.history); err != nil {
+				t.Fatal(err)
+			}
+			var got []any
+			for len(send) > 0 {
+				got = append(got, <-send)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("queued %d frames %v, want %v", len(got), got, tt.want)
+			}
+			for i := range got {
+				if !sameFrame(got[i], tt.want[i]) {
+					t.Errorf("frame %d = %+v, want %+v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+// sameFrame compares the message frames TestReleaseClient queues
+func sameFrame(a, b any) bool {
+	switch a := a.(type) {
+	case Message:
+		b, ok := b.(Message)
+		return ok && a.ID == b.ID && a.Seq == b.Seq && sameMessage(a, b)
+	case HistoryFrame:
+		b, ok := b.(HistoryFrame)
+		if !ok || len(a.History) != len(b.History) {
+			return false
+		}
+		for i := range a.History {
+			if !sameFrame(a.History[i], b.History[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// A broadcast is timed until the last client in the room has written the
+// message or is gone, not until it is queued
+func TestBroadcastTiming(t *testing.T) {
+	useHub(t)
+	prev := hubConfig
+	hubConfig.ClientQueue = 10
+	t.Cleanup(func() { hubConfig = prev })
+
+	writing, loading, elsewhere := &websocket.Conn{}, &websocket.Conn{}, &websocket.Conn{}
+	send := make(chan any, 10)
+	hub.registerClient(writing, chatClient{roomID: 1, send: send})
+	// Held back while its history loads
+	hub.registerClient(loading, chatClient{roomID: 1, send: make(chan any, 10), held: new([]any)})
+	hub.registerClient(elsewhere, chatClient{roomID: 2, send: make(chan any, 10)})
+
+	counted := func() uint64 {
+		delivery.mu.Lock()
+		defer delivery.mu.Unlock()
+		return delivery.count
+	}
+	before := counted()
+	deliverToClients(Message{RoomID: 1, Content: "hi", CreatedAt: time.Now()})
+	if n := counted() - before; n != 0 {
+		t.Fatalf("%d broadcasts recorded on queueing", n)
+	}
+	frameDone(<-send)
+	if n := counted() - before; n != 0 {
+		t.Fatalf("%d broadcasts recorded before the last client", n)
+	}
+	// The held back copy is never written once the client leaves
+	hub.unregisterClient(loading)
+	// Unregistering only hands the client over, so wait for the hub
+	hub.do(func() {})
+	if n := counted() - before; n != 1 {
+		t.Errorf("%d broadcasts recorded after the last client", n)
+	}
+}
+
+// useHub gives a test a running hub of its own
+func useHub(t *testing.T) {
+	prev := hub
+	hub = newHub()
+	go hub.run()
+	t.Cleanup(func() { hub = prev })
+}
@@ -0,0 +1,359 @@
+package chat
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ClusterConfig runs several instances as one deployment. Chat messages
+// cross between nodes over Redis pub/sub, and each room is owned by one
+// node, picked by consistent hashing, which fans its messages out.
+type ClusterConfig struct {
+	NodeID string   // This instance, the hostname by default
+	Nodes  []string // IDs of the nodes known up front
+	// Discovery adds the nodes that announce themselves in Redis to
+	// Nodes, and drops them once they stop. Clustering is off unless
+	// Nodes is set or Discovery is on.
+	Discovery bool
+	RedisURL  string
+}
+
+const (
+	// Points each node gets on the hash ring; more spread rooms more evenly
+	ringReplicas = 100
+	// Timeout of the Redis round trips made when joining and leaving rooms
+	clusterRedisTimeout = 2 * time.Second
+)
+
+// hashRing assigns rooms to nodes by consistent hashing, so a change in
+// membership only moves the rooms of the nodes that came or went
+type hashRing struct {
+	points []uint32 // Sorted
+	nodes  []string // Node at each point
+}
+
+func ringHash(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+func newHashRing(nodes []string) *hashRing {
+	type point struct {
+		hash uint32
+		node string
+	}
+	var points []point
+	for _, node := range nodes {
+		for i := range ringReplicas {
+			points = append(points, point{ringHash(node + "#" + strconv.Itoa(i)), node})
+		}
+	}
+	slices.SortFunc(points, func(a, b point) int {
+		return cmp.Or(cmp.Compare(a.hash, b.hash), strings.Compare(a.node, b.node))
+	})
+	ring := &hashRing{}
+	for _, p := range points {
+		ring.points = append(ring.points, p.hash)
+		ring.nodes = append(ring.nodes, p.node)
+	}
+	return ring
+}
+
+// owner returns the node that owns a room, or "" for an empty ring
+func (h *hashRing) owner(roomID int) string {
+	if len(h.points) == 0 {
+		return ""
+	}
+	hash := ringHash("room:" + strconv.Itoa(roomID))
+	i, _ := slices.BinarySearch(h.points, hash)
+	if i == len(h.points) {
+		i = 0
+	}
+	return h.nodes[i]
+}
+
+// clusterEnvelope carries a chat message between nodes, with the fields
+// Message leaves out of its JSON
+type clusterEnvelope struct {
+	From        string  `json:"from"`           // Node that sent the envelope
+	Kind        string  `json:"kind,omitempty"` // Empty for chat messages
+	Hops        int     `json:"hops"`           // Times the message was forwarded to an owner
+	Message     Message `json:"message"`
+	RoomID      int     `json:"roomId"`
+	WorkspaceID int     `json:"workspaceId"`
+	UserID      int     `json:"userId"`
+	Origin      string  `json:"origin"`
+	Reason      string  `json:"reason,omitempty"`   // Close reason of a disconnect
+	Registry    string  `json:"registry,omitempty"` // Registry to reload
+
+	Maintenance *MaintenanceState `json:"maintenance,omitempty"` // New maintenance mode
+	Features    *FeatureOverrides `json:"features,omitempty"`    // New feature overrides
+	LogLevels   LogLevels         `json:"logLevels,omitempty"`   // Log level changes
+}
+
+func newClusterEnvelope(from string, hops int, msg Message) clusterEnvelope {
+	return clusterEnvelope{
+		From:        from,
+		Hops:        hops,
+		Message:     msg,
+		RoomID:      msg.RoomID,
+		WorkspaceID: msg.WorkspaceID,
+		UserID:      msg.UserID,
+		Origin:      msg.Origin,
+	}
+}
+
+func (env clusterEnvelope) message() Message {
+	msg := env.Message
+	msg.RoomID = env.RoomID
+	msg.WorkspaceID = env.WorkspaceID
+	msg.UserID = env.UserID
+	msg.Origin = env.Origin
+	return msg
+}
+
+// clusterNode is this instance's part of the cluster. A message posted on
+// any node goes to its room's owner, which delivers it to its own clients,
+// runs the webhooks, bridges and events once, and publishes it on the
+// room's channel for the other nodes with clients in the room.
+type clusterNode struct {
+	id        string
+	static    []string // Nodes from the configuration
+	discovery bool
+	client    *redis.Client
+	pubsub    *redis.PubSub
+	done      chan struct{} // Closed when the node closes
+
+	mu    sync.Mutex
+	ring  *hashRing
+	nodes []string
+
+	// Local clients in each room, to subscribe to the rooms with any,
+	// and of each logged-in user, for presence. Held across the Redis
+	// calls so they happen in order.
+	roomsMu sync.Mutex
+	rooms   map[int]int
+	users   map[int]int
+	present map[roomPresence]int
+}
+
+var (
+	cluster *clusterNode
+	// Messages forwarded to this node as the owner of their room, which
+	// handleMessages fans out
+	clusterInbox = make(chan Message)
+)
+
+func newClusterNode(cfg ClusterConfig) (*clusterNode, error) {
+	if len(cfg.Nodes) == 0 && !cfg.Discovery {
+		return nil, nil
+	}
+	if cfg.NodeID == "" {
+		return nil, fmt.Errorf("a node ID is required")
+	}
+	opts, err := redis.ParseURL(cfg.RedisURL)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(opts)
+	ctx, cancel := context.WithTimeout(context.Background(), clusterRedisTimeout)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	c := &clusterNode{
+		id:        cfg.NodeID,
+		static:    cfg.Nodes,
+		discovery: cfg.Discovery,
+		client:    client,
+		done:      make(chan struct{}),
+		rooms:     make(map[int]int),
+		users:     make(map[int]int),
+		present:   make(map[roomPresence]int),
+	}
+	c.pubsub = client.Subscribe(ctx, c.nodeChannel(c.id))
+	if _, err := c.pubsub.Receive(ctx); err != nil {
+		client.Close()
+		return nil, err
+	}
+	c.setNodes(cfg.Nodes)
+	go c.receive()
+	go c.heartbeat()
+	return c, nil
+}
+
+// defaultNodeID is the hostname, which tells the instances of most
+// deployments apart
+func defaultNodeID() string {
+	host, _ := os.Hostname()
+	return host
+}
+
+func (c *clusterNode) nodeChannel(id string) string {
+	return "chat:cluster:node:" + id
+}
+
+func (c *clusterNode) roomChannel(roomID int) string {
+	return "chat:cluster:room:" + strconv.Itoa(roomID)
+}
+
+// setNodes changes the cluster's membership. Rooms whose owner changes
+// are fanned out by their new owner from the next message on.
+func (c *clusterNode) setNodes(nodes []string) {
+	nodes = slices.Clone(nodes)
+	if !slices.Contains(nodes, c.id) {
+		nodes = append(nodes, c.id)
+	}
+	slices.Sort(nodes)
+	nodes = slices.Compact(nodes)
+
+	c.roomsMu.Lock()
+	defer c.roomsMu.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if slices.Equal(nodes, c.nodes) {
+		return
+	}
+	ring := newHashRing(nodes)
+	moved := 0
+	if c.ring != nil {
+		for roomID := range c.rooms {
+			if c.ring.owner(roomID) != ring.owner(roomID) {
+				moved++
+			}
+		}
+	}
+	c.ring, c.nodes = ring, nodes
+	log.Printf("Cluster: %d nodes %v, %d local rooms changed owner", len(nodes), nodes, moved)
+}
+
+// owner returns the node that owns a room
+func (c *clusterNode) owner(roomID int) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ring.owner(roomID)
+}
+
+// forward hands a message posted here to the owner of its room
+func (c *clusterNode) forward(owner string, msg Message, hops int) {
+	c.publish(c.nodeChannel(owner), newClusterEnvelope(c.id, hops+1, msg))
+}
+
+// fanOut sends a message this node owns to the other nodes with clients
+// in its room
+func (c *clusterNode) fanOut(msg Message) {
+	c.publish(c.roomChannel(msg.RoomID), newClusterEnvelope(c.id, 0, msg))
+}
+
+func (c *clusterNode) publish(channel string, env clusterEnvelope) {
+	data, err := json.Marshal(env)
+	if err != nil {
+		log.Printf("Cluster: encoding message: %v", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), clusterRedisTimeout)
+	defer cancel()
+	if err := c.client.Publish(ctx, channel, data).Err(); err != nil {
+		log.Printf("Cluster: publishing to %s: %v", channel, err)
+	}
+}
+
+// join subscribes to a room's channel when its first local client joins
+func (c *clusterNode) join(roomID int) {
+	c.roomsMu.Lock()
+	defer c.roomsMu.Unlock()
+	c.rooms[roomID]++
+	if c.rooms[roomID] > 1 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), clusterRedisTimeout)
+	defer cancel()
+	if err := c.pubsub.Subscribe(ctx, c.roomChannel(roomID)); err != nil {
+		log.Printf("Cluster: subscribing to room %d: %v", roomID, err)
+	}
+}
+
+// leave unsubscribes from a room's channel when its last local client
+// leaves
+func (c *clusterNode) leave(roomID int) {
+	c.roomsMu.Lock()
+	defer c.roomsMu.Unlock()
+	c.rooms[roomID]--
+	if c.rooms[roomID] > 0 {
+		return
+	}
+	delete(c.rooms, roomID)
+	if c.closed() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), clusterRedisTimeout)
+	defer cancel()
+	if err := c.pubsub.Unsubscribe(ctx, c.roomChannel(roomID)); err != nil {
+		log.Printf("Cluster: unsubscribing from room %d: %v", roomID, err)
+	}
+}
+
+// receive handles the messages other nodes send until the node closes
+func (c *clusterNode) receive() {
+	nodeChannel := c.nodeChannel(c.id)
+	for m := range c.pubsub.Channel() {
+		var env clusterEnvelope
+		if err := json.Unmarshal([]byte(m.Payload), &env); err != nil {
+			log.Printf("Cluster: bad message on %s: %v", m.Channel, err)
+			continue
+		}
+		if env.From == c.id {
+			continue
+		}
+		if env.Kind != "" {
+			c.handleControl(env)
+			continue
+		}
+		msg := env.message()
+		if m.Channel != nodeChannel {
+			// The owner already ran everything else
+			deliverToClients(msg)
+			continue
+		}
+		// The sender's view of the ring may be out of date; pass the
+		// message on once more at most rather than bouncing it around
+		if owner := c.owner(msg.RoomID); owner != c.id && env.Hops < 2 {
+			c.forward(owner, msg, env.Hops)
+			continue
+		}
+		clusterInbox <- msg
+	}
+}
+
+// closed reports whether the node closed, after which clients that are
+// still disconnecting leave Redis alone
+func (c *clusterNode) closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *clusterNode) Close() {
+	close(c.done)
+	c.leaveCluster()
+	c.pubsub.Close()
+	c.client.Close()
+}
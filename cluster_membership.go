@@ -0,0 +1,434 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// How often a node announces itself and its connected users
+	clusterHeartbeatInterval = 5 * time.Second
+	// How long a node that stopped announcing itself stays a member
+	clusterNodeTTL = 3 * clusterHeartbeatInterval
+
+	clusterNodesKey = "chat:cluster:nodes" // Sorted set of node IDs by last heartbeat
+)
+
+// Kinds of clusterEnvelope besides chat messages
+const (
+	envelopeDisconnect  = "disconnect"  // Close a user's connections
+	envelopeLeave       = "leave"       // The sender is shutting down
+	envelopeReload      = "reload"      // A registry changed in the store
+	envelopeMaintenance = "maintenance" // Maintenance mode was switched
+	envelopeFeatures    = "features"    // An admin changed feature flags
+	envelopeConfig      = "config"      // An admin reloaded the config
+	envelopeLogLevels   = "log-levels"  // An admin changed log levels
+)
+
+// ClusterMember is a node as the cluster sees it
+type ClusterMember struct {
+	ID            string    `json:"id"`
+	LastHeartbeat time.Time `json:"lastHeartbeat"`
+	Users         int       `json:"users"` // Logged-in users connected to it
+	Self          bool      `json:"self,omitempty"`
+}
+
+// ClusterStatus is the admin overview of the cluster
+type ClusterStatus struct {
+	Node    string          `json:"node"`
+	Nodes   []string        `json:"nodes"`   // Nodes rooms are spread across
+	Members []ClusterMember `json:"members"` // Nodes with a recent heartbeat
+}
+
+// clusterPresenceKey is the set of users connected to a node, and
+// clusterRoomPresenceKey the set of "<room ID>:<user ID>" pairs of the
+// rooms they are in
+func clusterPresenceKey(node string) string {
+	return "chat:cluster:presence:" + node
+}
+
+func clusterRoomPresenceKey(node string) string {
+	return "chat:cluster:presence:" + node + ":rooms"
+}
+
+// roomPresence is a logged-in user in a room
+type roomPresence struct {
+	roomID int
+	userID int
+}
+
+func (p roomPresence) String() string {
+	return strconv.Itoa(p.roomID) + ":" + strconv.Itoa(p.userID)
+}
+
+func parseRoomPresence(s string) (roomPresence, bool) {
+	room, user, ok := strings.Cut(s, ":")
+	if !ok {
+		return roomPresence{}, false
+	}
+	roomID, err1 := strconv.Atoi(room)
+	userID, err2 := strconv.Atoi(user)
+	return roomPresence{roomID, userID}, err1 == nil && err2 == nil
+}
+
+// heartbeat announces the node and its users every clusterHeartbeatInterval
+// and, with discovery on, picks up the nodes that joined or left, until
+// the node closes
+func (c *clusterNode) heartbeat() {
+	ticker := time.NewTicker(clusterHeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		if err := c.announce(); err != nil {
+			log.Printf("Cluster: heartbeat failed: %v", err)
+		} else if c.discovery {
+			if members, err := c.members(); err != nil {
+				log.Printf("Cluster: listing members failed: %v", err)
+			} else {
+				nodes := slices.Clone(c.static)
+				for _, m := range members {
+					nodes = append(nodes, m.ID)
+				}
+				c.setNodes(nodes)
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// announce records the node's heartbeat and the users connected to it
+func (c *clusterNode) announce() error {
+	c.roomsMu.Lock()
+	users := make([]any, 0, len(c.users))
+	for id := range c.users {
+		users = append(users, id)
+	}
+	present := make([]any, 0, len(c.present))
+	for p := range c.present {
+		present = append(present, p.String())
+	}
+	c.roomsMu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), clusterRedisTimeout)
+	defer cancel()
+	now := time.Now()
+	key, roomsKey := clusterPresenceKey(c.id), clusterRoomPresenceKey(c.id)
+	_, err := c.client.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.ZAdd(ctx, clusterNodesKey, redis.Z{Score: float64(now.UnixMilli()), Member: c.id})
+		p.ZRemRangeByScore(ctx, clusterNodesKey, "-inf", strconv.FormatInt(now.Add(-clusterNodeTTL).UnixMilli(), 10))
+		p.Del(ctx, key, roomsKey)
+		if len(users) > 0 {
+			p.SAdd(ctx, key, users...)
+			p.Expire(ctx, key, clusterNodeTTL)
+			p.SAdd(ctx, roomsKey, present...)
+			p.Expire(ctx, roomsKey, clusterNodeTTL)
+		}
+		return nil
+	})
+	return err
+}
+
+// members returns the nodes with a recent heartbeat
+func (c *clusterNode) members() ([]ClusterMember, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), clusterRedisTimeout)
+	defer cancel()
+	since := time.Now().Add(-clusterNodeTTL).UnixMilli()
+	zs, err := c.client.ZRangeByScoreWithScores(ctx, clusterNodesKey, &redis.ZRangeBy{
+		Min: strconv.FormatInt(since, 10),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	members := make([]ClusterMember, 0, len(zs))
+	for _, z := range zs {
+		id := z.Member.(string)
+		users, err := c.client.SCard(ctx, clusterPresenceKey(id)).Result()
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, ClusterMember{
+			ID:            id,
+			LastHeartbeat: time.UnixMilli(int64(z.Score)).UTC(),
+			Users:         int(users),
+			Self:          id == c.id,
+		})
+	}
+	slices.SortFunc(members, func(a, b ClusterMember) int { return strings.Compare(a.ID, b.ID) })
+	return members, nil
+}
+
+// userNodes returns the nodes a user is connected to
+func (c *clusterNode) userNodes(ctx context.Context, userID int) ([]string, error) {
+	members, err := c.members()
+	if err != nil {
+		return nil, err
+	}
+	var nodes []string
+	for _, m := range members {
+		ok, err := c.client.SIsMember(ctx, clusterPresenceKey(m.ID), userID).Result()
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			nodes = append(nodes, m.ID)
+		}
+	}
+	return nodes, nil
+}
+
+// connectUser records that one more of a user's connections is on this
+// node, in a room
+func (c *clusterNode) connectUser(userID, roomID int) {
+	p := roomPresence{roomID, userID}
+	c.roomsMu.Lock()
+	defer c.roomsMu.Unlock()
+	c.users[userID]++
+	c.present[p]++
+	if c.present[p] > 1 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), clusterRedisTimeout)
+	defer cancel()
+	key, roomsKey := clusterPresenceKey(c.id), clusterRoomPresenceKey(c.id)
+	_, err := c.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SAdd(ctx, key, userID)
+		pipe.Expire(ctx, key, clusterNodeTTL)
+		pipe.SAdd(ctx, roomsKey, p.String())
+		pipe.Expire(ctx, roomsKey, clusterNodeTTL)
+		return nil
+	})
+	if err != nil {
+		log.Printf("Cluster: recording user %d: %v", userID, err)
+	}
+}
+
+// disconnectUser records that one of a user's connections on this node
+// closed
+func (c *clusterNode) disconnectUser(userID, roomID int) {
+	p := roomPresence{roomID, userID}
+	c.roomsMu.Lock()
+	defer c.roomsMu.Unlock()
+	c.users[userID]--
+	c.present[p]--
+	lastInRoom, last := c.present[p] <= 0, c.users[userID] <= 0
+	if lastInRoom {
+		delete(c.present, p)
+	}
+	if last {
+		delete(c.users, userID)
+	}
+	if !lastInRoom || c.closed() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), clusterRedisTimeout)
+	defer cancel()
+	_, err := c.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SRem(ctx, clusterRoomPresenceKey(c.id), p.String())
+		if last {
+			pipe.SRem(ctx, clusterPresenceKey(c.id), userID)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Cluster: forgetting user %d: %v", userID, err)
+	}
+}
+
+// remotePresence returns the users in rooms on the other nodes
+func (c *clusterNode) remotePresence(ctx context.Context) ([]roomPresence, error) {
+	members, err := c.members()
+	if err != nil {
+		return nil, err
+	}
+	var present []roomPresence
+	for _, m := range members {
+		if m.Self {
+			continue
+		}
+		pairs, err := c.client.SMembers(ctx, clusterRoomPresenceKey(m.ID)).Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, pair := range pairs {
+			if p, ok := parseRoomPresence(pair); ok {
+				present = append(present, p)
+			}
+		}
+	}
+	return present, nil
+}
+
+// closeUserConnections closes a user's connections on the other nodes
+// they are connected to
+func (c *clusterNode) closeUserConnections(ctx context.Context, userID int, reason string) error {
+	nodes, err := c.userNodes(ctx, userID)
+	if err != nil {
+		return err
+	}
+	for _, node := range nodes {
+		if node != c.id {
+			c.publish(c.nodeChannel(node), clusterEnvelope{From: c.id, Kind: envelopeDisconnect, UserID: userID, Reason: reason})
+		}
+	}
+	return nil
+}
+
+// handleControl carries out an envelope that isn't a chat message
+func (c *clusterNode) handleControl(env clusterEnvelope) {
+	switch env.Kind {
+	case envelopeDisconnect:
+		closeClients(func(cc chatClient) bool { return cc.userID == env.UserID }, websocket.ClosePolicyViolation, env.Reason)
+	case envelopeLeave:
+		// Take over the sender's rooms now rather than at the next
+		// heartbeat, so the clients it sent here aren't routed back
+		if c.discovery {
+			c.mu.Lock()
+			nodes := slices.DeleteFunc(slices.Clone(c.nodes), func(n string) bool { return n == env.From })
+			c.mu.Unlock()
+			c.setNodes(append(nodes, c.static...))
+		}
+	case envelopeReload:
+		reloadRegistry(env.Registry)
+	case envelopeMaintenance:
+		if env.Maintenance != nil {
+			setMaintenance(*env.Maintenance)
+		}
+	case envelopeFeatures:
+		if env.Features != nil {
+			setFeatureOverrides(*env.Features)
+		}
+	case envelopeLogLevels:
+		setLogLevels(env.LogLevels)
+	case envelopeConfig:
+		if _, err := reloadSettings(); err != nil {
+			log.Printf("Cluster: config reload asked by %s failed: %v", env.From, err)
+		}
+	default:
+		log.Printf("Cluster: unknown message kind %q from %s", env.Kind, env.From)
+	}
+}
+
+// leaveCluster removes the node from the members right away and tells
+// them, so the others rebalance without waiting for its heartbeat to run
+// out
+func (c *clusterNode) leaveCluster() {
+	ctx, cancel := context.WithTimeout(context.Background(), clusterRedisTimeout)
+	defer cancel()
+	_, err := c.client.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.ZRem(ctx, clusterNodesKey, c.id)
+		p.Del(ctx, clusterPresenceKey(c.id), clusterRoomPresenceKey(c.id))
+		return nil
+	})
+	if err != nil {
+		log.Printf("Cluster: leaving failed: %v", err)
+	}
+
+	c.broadcast(clusterEnvelope{From: c.id, Kind: envelopeLeave})
+}
+
+// leader reports whether this node is the first of the cluster's nodes,
+// which runs the jobs only one node should
+func (c *clusterNode) leader() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.nodes) > 0 && c.nodes[0] == c.id
+}
+
+// Ping checks that the backplane is reachable
+func (c *clusterNode) Ping(ctx context.Context) error {
+	return c.client.Ping(ctx).Err()
+}
+
+// broadcast sends an envelope to every other node
+func (c *clusterNode) broadcast(env clusterEnvelope) {
+	c.mu.Lock()
+	nodes := c.nodes
+	c.mu.Unlock()
+	for _, node := range nodes {
+		if node != c.id {
+			c.publish(c.nodeChannel(node), env)
+		}
+	}
+}
+
+// Registries every node keeps a copy of in memory, so messages and events
+// don't go to the store. A node that changes one in the store reloads it
+// and has the others reload it too.
+const (
+	registryRoomWebhooks       = "room_webhooks"
+	registryAutomations        = "automations"
+	registryEventSubscriptions = "event_subscriptions"
+	registryScheduledMessages  = "scheduled_messages"
+)
+
+var registryLoaders = map[string]func(context.Context) error{
+	registryRoomWebhooks:       loadRoomWebhooks,
+	registryAutomations:        loadAutomations,
+	registryEventSubscriptions: loadEventSubscriptions,
+	registryScheduledMessages:  loadScheduledMessages,
+}
+
+// loadRegistries loads every registry from the store at startup
+func loadRegistries(ctx context.Context) error {
+	for name, load := range registryLoaders {
+		if err := load(ctx); err != nil {
+			return fmt.Errorf("loading %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// reloadRegistry loads a registry from the store again. Failures are
+// logged; the node keeps its copy until the next change.
+func reloadRegistry(name string) {
+	load, ok := registryLoaders[name]
+	if !ok {
+		log.Printf("Cluster: unknown registry %q", name)
+		return
+	}
+	ctx, cancel := storeContext()
+	defer cancel()
+	if err := load(ctx); err != nil {
+		log.Printf("Reloading %s: %v", name, err)
+	}
+}
+
+// registryChanged reloads a registry after a change in the store, here
+// and on the other nodes
+func registryChanged(name string) {
+	reloadRegistry(name)
+	if cluster != nil {
+		cluster.broadcast(clusterEnvelope{From: cluster.id, Kind: envelopeReload, Registry: name})
+	}
+}
+
+// Get the cluster's nodes and members (GET /admin/cluster)
+func getClusterStatus(w http.ResponseWriter, r *http.Request) {
+	if cluster == nil {
+		http.Error(w, "Clustering is not enabled", http.StatusNotFound)
+		return
+	}
+	members, err := cluster.members()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	cluster.mu.Lock()
+	status := ClusterStatus{Node: cluster.id, Nodes: cluster.nodes, Members: members}
+	cluster.mu.Unlock()
+	json.NewEncoder(w).Encode(status)
+}
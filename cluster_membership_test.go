@@ -0,0 +1,122 @@
+package chat
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// eventually waits for cond, which the nodes' goroutines bring about
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+// clusterNodes returns the nodes a node spreads rooms across
+func clusterNodes(c *clusterNode) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.nodes)
+}
+
+func TestClusterMembership(t *testing.T) {
+	ctx := context.Background()
+	mr := useRedis(t)
+	useHub(t)
+
+	a := startClusterNode(t, mr, ClusterConfig{NodeID: "a", Discovery: true})
+	eventually(t, "a to announce itself", func() bool {
+		nodes, _ := mr.ZMembers(clusterNodesKey)
+		return slices.Contains(nodes, "a")
+	})
+	// Nodes that joined are discovered on the next heartbeat
+	b := startClusterNode(t, mr, ClusterConfig{NodeID: "b", Discovery: true})
+	eventually(t, "b to discover a", func() bool { return slices.Equal(clusterNodes(b), []string{"a", "b"}) })
+	if b.leader() {
+		t.Error("b leads the cluster after a")
+	}
+	// Nodes that stopped announcing themselves aren't members
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	stale := float64(time.Now().Add(-2 * clusterNodeTTL).UnixMilli())
+	if err := client.ZAdd(ctx, clusterNodesKey, redis.Z{Score: stale, Member: "c"}).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	b.connectUser(7, 3)
+	b.connectUser(7, 4)
+	b.connectUser(7, 4)
+	a.connectUser(8, 3)
+	members, err := a.members()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 2 || members[0].ID != "a" || !members[0].Self || members[0].Users != 1 ||
+		members[1].ID != "b" || members[1].Self || members[1].Users != 1 {
+		t.Errorf("members %+v", members)
+	}
+	for userID, want := range map[int][]string{7: {"b"}, 8: {"a"}, 9: nil} {
+		if nodes, err := a.userNodes(ctx, userID); err != nil || !slices.Equal(nodes, want) {
+			t.Errorf("user %d is on %v, %v, want %v", userID, nodes, err, want)
+		}
+	}
+
+	// The roster of the other nodes follows their connections, and
+	// survives their heartbeats
+	remote := func(want ...roomPresence) {
+		t.Helper()
+		present, err := a.remotePresence(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		slices.SortFunc(present, func(p, q roomPresence) int { return p.roomID - q.roomID })
+		if !slices.Equal(present, want) {
+			t.Errorf("remote presence %v, want %v", present, want)
+		}
+	}
+	remote(roomPresence{3, 7}, roomPresence{4, 7})
+	if err := b.announce(); err != nil {
+		t.Fatal(err)
+	}
+	remote(roomPresence{3, 7}, roomPresence{4, 7})
+	b.disconnectUser(7, 4)
+	remote(roomPresence{3, 7}, roomPresence{4, 7})
+	b.disconnectUser(7, 4)
+	remote(roomPresence{3, 7})
+
+	// Closing a user's connections reaches only the nodes they are on
+	toB := subscribeRedis(t, mr, b.nodeChannel("b"))
+	if err := a.closeUserConnections(ctx, 8, "gone"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.closeUserConnections(ctx, 7, "banned"); err != nil {
+		t.Fatal(err)
+	}
+	if env := receiveOne(t, toB); env.From != "a" || env.Kind != envelopeDisconnect || env.UserID != 7 || env.Reason != "banned" {
+		t.Errorf("sent %+v", env)
+	}
+
+	// A node that leaves hands over its rooms right away
+	a.setNodes([]string{"b"})
+	if !a.leader() {
+		t.Error("a doesn't lead the cluster")
+	}
+	a.leaveCluster()
+	eventually(t, "b to drop a", func() bool { return slices.Equal(clusterNodes(b), []string{"b"}) })
+	if !b.leader() {
+		t.Error("b doesn't lead the cluster after a left")
+	}
+	if members, err := b.members(); err != nil || len(members) != 1 || members[0].ID != "b" {
+		t.Errorf("members %+v, %v", members, err)
+	}
+	if nodes, err := b.userNodes(ctx, 8); err != nil || len(nodes) != 0 {
+		t.Errorf("user 8 is still on %v, %v", nodes, err)
+	}
+}
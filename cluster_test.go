@@ -0,0 +1,196 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// useRedis starts an in-memory Redis for the test
+func useRedis(t *testing.T) *miniredis.Miniredis {
+	t.Helper()
+	return miniredis.RunT(t)
+}
+
+// startClusterNode starts a node on the test's Redis, which leaves the cluster
+// when the test ends
+func startClusterNode(t *testing.T, mr *miniredis.Miniredis, cfg ClusterConfig) *clusterNode {
+	t.Helper()
+	cfg.RedisURL = "redis://" + mr.Addr()
+	c, err := newClusterNode(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	return c
+}
+
+// subscribeRedis listens on a channel as another node would
+func subscribeRedis(t *testing.T, mr *miniredis.Miniredis, channel string) <-chan clusterEnvelope {
+	t.Helper()
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	sub := client.Subscribe(context.Background(), channel)
+	if _, err := sub.Receive(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	envs := make(chan clusterEnvelope, 10)
+	go func() {
+		for m := range sub.Channel() {
+			var env clusterEnvelope
+			json.Unmarshal([]byte(m.Payload), &env)
+			envs <- env
+		}
+	}()
+	return envs
+}
+
+// publishRedis sends an envelope on a channel as another node would
+func publishRedis(t *testing.T, mr *miniredis.Miniredis, channel string, env clusterEnvelope) {
+	t.Helper()
+	data, _ := json.Marshal(env)
+	mr.Publish(channel, string(data))
+}
+
+// waitSubscribers waits until a channel has n subscribers, as subscribing
+// doesn't wait for Redis to confirm it
+func waitSubscribers(t *testing.T, mr *miniredis.Miniredis, channel string, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); mr.PubSubNumSub(channel)[channel] != n; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s has %d subscribers, want %d", channel, mr.PubSubNumSub(channel)[channel], n)
+		}
+	}
+}
+
+// receiveOne waits for the next value on a channel
+func receiveOne[T any](t *testing.T, ch <-chan T) T {
+	t.Helper()
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing received")
+		var zero T
+		return zero
+	}
+}
+
+func TestHashRing(t *testing.T) {
+	if owner := newHashRing(nil).owner(1); owner != "" {
+		t.Errorf("empty ring has owner %q", owner)
+	}
+
+	ring := newHashRing([]string{"a", "b", "c"})
+	reversed := newHashRing([]string{"c", "b", "a"})
+	grown := newHashRing([]string{"a", "b", "c", "d"})
+	owned := make(map[string]int)
+	for roomID := range 3000 {
+		owner := ring.owner(roomID)
+		owned[owner]++
+		// Every node agrees whatever order it lists the others in
+		if other := reversed.owner(roomID); other != owner {
+			t.Fatalf("room %d is owned by %s and %s", roomID, owner, other)
+		}
+		// A new node only takes rooms; the others keep theirs
+		if moved := grown.owner(roomID); moved != owner && moved != "d" {
+			t.Errorf("room %d moved from %s to %s", roomID, owner, moved)
+		}
+	}
+	for _, node := range []string{"a", "b", "c"} {
+		if owned[node] < 600 {
+			t.Errorf("rooms per node %v", owned)
+			break
+		}
+	}
+}
+
+func TestClusterRouting(t *testing.T) {
+	mr := useRedis(t)
+	prevHub := hub
+	hub = newHub() // Not running, so deliveries can be read here
+	t.Cleanup(func() { hub = prevHub })
+
+	a := startClusterNode(t, mr, ClusterConfig{NodeID: "a", Nodes: []string{"a", "b"}})
+	var mine, theirs int
+	for roomID := 1; mine == 0 || theirs == 0; roomID++ {
+		if a.owner(roomID) == "a" {
+			mine = roomID
+		} else {
+			theirs = roomID
+		}
+	}
+	toB := subscribeRedis(t, mr, a.nodeChannel("b"))
+	toA := a.nodeChannel("a")
+
+	// Messages posted here go to their room's owner with what their JSON
+	// leaves out
+	msg := Message{ID: 1, Content: "hi", RoomID: theirs, WorkspaceID: 2, UserID: 3, Origin: originDiscord}
+	a.forward("b", msg, 0)
+	if env := receiveOne(t, toB); env.From != "a" || env.Hops != 1 || env.message().Content != "hi" ||
+		env.RoomID != theirs || env.WorkspaceID != 2 || env.UserID != 3 || env.Origin != originDiscord {
+		t.Errorf("forwarded %+v", env)
+	}
+
+	tests := []struct {
+		name string
+		env  clusterEnvelope
+		kept bool // Fanned out here rather than passed on
+	}{
+		{"owned here", newClusterEnvelope("b", 1, Message{Content: "1", RoomID: mine}), true},
+		{"owned by b", newClusterEnvelope("b", 1, Message{Content: "2", RoomID: theirs}), false},
+		{"forwarded twice", newClusterEnvelope("b", 2, Message{Content: "3", RoomID: theirs}), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			publishRedis(t, mr, toA, tt.env)
+			if !tt.kept {
+				if env := receiveOne(t, toB); env.From != "a" || env.Hops != tt.env.Hops+1 || env.Message.Content != tt.env.Message.Content {
+					t.Errorf("passed on %+v", env)
+				}
+				return
+			}
+			if msg := receiveOne(t, clusterInbox); msg.Content != tt.env.Message.Content || msg.RoomID != tt.env.RoomID {
+				t.Errorf("kept %+v", msg)
+			}
+		})
+	}
+
+	// The node's own envelopes are ignored; those after them still arrive
+	publishRedis(t, mr, toA, newClusterEnvelope("a", 1, Message{Content: "echo", RoomID: mine}))
+	publishRedis(t, mr, toA, newClusterEnvelope("b", 1, Message{Content: "after", RoomID: mine}))
+	if msg := receiveOne(t, clusterInbox); msg.Content != "after" {
+		t.Errorf("received %+v", msg)
+	}
+
+	// Owners fan out on the room's channel to the nodes with clients in it
+	room := a.roomChannel(theirs)
+	fanned := subscribeRedis(t, mr, room)
+	a.fanOut(Message{Content: "to all", RoomID: theirs})
+	if env := receiveOne(t, fanned); env.From != "a" || env.Hops != 0 || env.Message.Content != "to all" {
+		t.Errorf("fanned out %+v", env)
+	}
+
+	// Which this node listens to while it has clients in the room
+	a.join(theirs)
+	a.join(theirs)
+	waitSubscribers(t, mr, room, 2)
+	publishRedis(t, mr, room, newClusterEnvelope("b", 0, Message{Content: "fanned", RoomID: theirs, UserID: 3}))
+	if msg := receiveOne(t, hub.broadcast); msg.Content != "fanned" || msg.UserID != 3 {
+		t.Errorf("delivered %+v", msg)
+	}
+	a.leave(theirs)
+	waitSubscribers(t, mr, room, 2)
+	a.leave(theirs)
+	waitSubscribers(t, mr, room, 1)
+	a.roomsMu.Lock()
+	rooms := len(a.rooms)
+	a.roomsMu.Unlock()
+	if rooms != 0 {
+		t.Errorf("still in %d rooms", rooms)
+	}
+}
@@ -0,0 +1,226 @@
+// Command chat-cli is a terminal chat client. Type to chat; lines starting
+// with a slash are commands (see /help).
+//
+//	chat-cli -url https://chat.example.com -token chat_... -room ops
+//
+// The token can also be set in CHAT_TOKEN. Without one the server must
+// allow guests, and messages are posted under -nick.
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/param85584/go-chat-app/client"
+)
+
+// Messages kept for /history
+const maxScrollback = 1000
+
+const helpText = `Commands:
+  /join <room>     switch to another room
+  /rooms           list the rooms of the workspace
+  /nick <name>     change the name you post under (guests only)
+  /history [n]     show the last n messages of this session (default 20)
+  /tasks           list the tasks of the workspace
+  /undo <task>     undo the latest change to a task
+  /help            show this help
+  /quit            leave`
+
+// session is the state of the running client
+type session struct {
+	url   string
+	token string
+	room  string
+	nick  string
+
+	out io.Writer
+	mu  sync.Mutex // Guards out, chat and scrollback
+	// Messages seen so far, oldest first
+	scrollback []client.Message
+	chat       *client.Client
+}
+
+func main() {
+	name := "guest"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+
+	url := flag.String("url", "http://localhost:8080", "server URL, with /w/{slug} for a workspace")
+	token := flag.String("token", os.Getenv("CHAT_TOKEN"), "personal API token (default $CHAT_TOKEN)")
+	room := flag.String("room", "general", "room to join")
+	nick := flag.String("nick", name, "name to post under without a token")
+	flag.Parse()
+
+	s := &session{url: *url, token: *token, room: *room, nick: *nick, out: os.Stdout}
+	if err := s.join(*room); err != nil {
+		fmt.Fprintln(os.Stderr, "chat-cli:", err)
+		os.Exit(1)
+	}
+	defer s.chat.Close()
+
+	s.printf("Joined #%s. Type /help for commands.", s.room)
+	in := bufio.NewScanner(os.Stdin)
+	for in.Scan() {
+		line := strings.TrimSpace(in.Text())
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "/") {
+			s.chat.SendMessage(line)
+			continue
+		}
+		if quit := s.command(line); quit {
+			return
+		}
+	}
+}
+
+// command runs a slash command and reports whether to quit
+func (s *session) command(line string) bool {
+	cmd, arg, _ := strings.Cut(line, " ")
+	arg = strings.TrimSpace(arg)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	switch cmd {
+	case "/quit", "/exit":
+		return true
+	case "/help":
+		s.printf("%s", helpText)
+	case "/join":
+		if arg == "" {
+			s.printf("Usage: /join <room>")
+			break
+		}
+		if err := s.join(arg); err != nil {
+			s.printf("Can't join #%s: %v", arg, err)
+			break
+		}
+		s.printf("Joined #%s", arg)
+	case "/nick":
+		if arg == "" {
+			s.printf("Usage: /nick <name>")
+			break
+		}
+		if s.token != "" {
+			s.printf("You're posting with a token, so your account name is used")
+			break
+		}
+		s.nick = arg
+		if err := s.join(s.room); err != nil {
+			s.printf("Reconnect failed: %v", err)
+			break
+		}
+		s.printf("You're now %s", arg)
+	case "/rooms":
+		rooms, err := s.chat.ListRooms(ctx)
+		if err != nil {
+			s.printf("Can't list rooms: %v", err)
+			break
+		}
+		for _, r := range rooms {
+			s.printf("  #%s", r.Name)
+		}
+	case "/history":
+		n := 20
+		if arg != "" {
+			var err error
+			if n, err = strconv.Atoi(arg); err != nil || n <= 0 {
+				s.printf("Usage: /history [n]")
+				break
+			}
+		}
+		s.mu.Lock()
+		history := s.scrollback[max(0, len(s.scrollback)-n):]
+		s.mu.Unlock()
+		for _, m := range history {
+			s.printMessage(m)
+		}
+	case "/tasks":
+		tasks, err := s.chat.ListTasks(ctx)
+		if err != nil {
+			s.printf("Can't list tasks: %v", err)
+			break
+		}
+		for _, t := range tasks {
+			s.printf("  %3d [%s] %s", t.ID, t.Status, t.Title)
+		}
+	case "/undo":
+		id, err := strconv.Atoi(arg)
+		if err != nil {
+			s.printf("Usage: /undo <task>")
+			break
+		}
+		// The server confirms in the room
+		if _, err := s.chat.UndoTask(ctx, id, s.room); err != nil {
+			s.printf("Can't undo: %v", err)
+		}
+	default:
+		s.printf("Unknown command %s, try /help", cmd)
+	}
+	return false
+}
+
+// join connects to a room, replacing the current connection once the new
+// one is up
+func (s *session) join(room string) error {
+	c, err := client.New(s.url, s.token, client.WithRoom(room), client.WithUsername(s.nick))
+	if err != nil {
+		return err
+	}
+	c.OnMessage(func(m client.Message) {
+		s.mu.Lock()
+		s.scrollback = append(s.scrollback, m)
+		if len(s.scrollback) > maxScrollback {
+			s.scrollback = s.scrollback[len(s.scrollback)-maxScrollback:]
+		}
+		s.mu.Unlock()
+		s.printMessage(m)
+	})
+	c.OnError(func(err error) {
+		var rejected *client.RejectedError
+		if errors.As(err, &rejected) {
+			s.printf("! %s", rejected.Reason)
+			return
+		}
+		s.printf("! connection: %v", err)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := c.Connect(ctx); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	old := s.chat
+	s.chat = c
+	s.room = room
+	s.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+func (s *session) printMessage(m client.Message) {
+	s.printf("%s %s: %s", m.CreatedAt.Local().Format("15:04"), m.Username, m.Content)
+}
+
+func (s *session) printf(format string, args ...any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fmt.Fprintf(s.out, format+"\n", args...)
+}
@@ -0,0 +1,19 @@
+// Command chat-server runs the chat server. It is configured through
+// CHAT_* environment variables and serves the web UI from ./public. Data
+// is kept in ./chat.db unless CHAT_STORE and CHAT_DATABASE_URL say
+// otherwise.
+//
+//	CHAT_ADDR=:8080 CHAT_DATABASE_URL=/var/lib/chat/chat.db chat-server
+package main
+
+import (
+	"log"
+
+	chat "github.com/param85584/go-chat-app"
+)
+
+func main() {
+	if err := chat.Run(chat.LoadConfig()); err != nil {
+		log.Fatal(err)
+	}
+}
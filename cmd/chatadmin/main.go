@@ -0,0 +1,368 @@
+// Command chatadmin runs common operations against the admin API of a
+// chat server. It authenticates with an API token that has the admin
+// scope, minted by an admin under /me/tokens.
+//
+//	chatadmin -url https://chat.example.com -token chat_... users
+//
+// The token can also be set in CHAT_ADMIN_TOKEN. Run chatadmin -h for the
+// list of commands.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const usage = `Usage: chatadmin [flags] <command> [args]
+
+Commands:
+  users                     list users
+  ban <user>                ban a user (by name or ID) and end their sessions
+  unban <user>              lift a ban
+  wipe-room <room>          delete every message of a room
+  tokens <user>             list a user's API tokens
+  rotate-token <id>         replace the secret of an API token
+  migrate [-status]         apply pending database migrations (the server
+                            also applies them when it starts)
+  backup [-o file]          download a backup archive
+  audit [-n N] [-f]         show the audit log, -f to keep following it
+
+Flags:
+`
+
+// admin is a client for the admin API
+type admin struct {
+	baseURL string
+	token   string
+	http    *http.Client
+}
+
+// User, APIToken and AuditEvent mirror the server's JSON
+type User struct {
+	ID        int       `json:"id"`
+	Username  string    `json:"username"`
+	Email     string    `json:"email"`
+	Role      string    `json:"role"`
+	Banned    bool      `json:"banned"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type APIToken struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	Hint       string     `json:"hint"`
+	ExpiresAt  *time.Time `json:"expiresAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+	Token      string     `json:"token"` // Only set when rotated
+}
+
+type AuditEvent struct {
+	ID      int       `json:"id"`
+	Time    time.Time `json:"time"`
+	Action  string    `json:"action"`
+	Actor   string    `json:"actor"`
+	IP      string    `json:"ip"`
+	Target  string    `json:"target"`
+	Details string    `json:"details"`
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	baseURL := flag.String("url", "http://localhost:8080", "server URL")
+	token := flag.String("token", os.Getenv("CHAT_ADMIN_TOKEN"), "API token with the admin scope (default $CHAT_ADMIN_TOKEN)")
+	workspace := flag.String("workspace", "", "workspace slug for room commands")
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *token == "" {
+		fatal(errors.New("an API token is required (-token or CHAT_ADMIN_TOKEN)"))
+	}
+
+	a := &admin{baseURL: strings.TrimSuffix(*baseURL, "/"), token: *token, http: http.DefaultClient}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	cmd, args := flag.Arg(0), flag.Args()[1:]
+	var err error
+	switch cmd {
+	case "users":
+		err = a.users(ctx)
+	case "ban", "unban":
+		if len(args) != 1 {
+			err = errors.New("usage: chatadmin " + cmd + " <user>")
+			break
+		}
+		err = a.setBanned(ctx, args[0], cmd == "ban")
+	case "wipe-room":
+		if len(args) != 1 {
+			err = errors.New("usage: chatadmin wipe-room <room>")
+			break
+		}
+		err = a.wipeRoom(ctx, *workspace, args[0])
+	case "tokens":
+		if len(args) != 1 {
+			err = errors.New("usage: chatadmin tokens <user>")
+			break
+		}
+		err = a.tokens(ctx, args[0])
+	case "rotate-token":
+		if len(args) != 1 {
+			err = errors.New("usage: chatadmin rotate-token <id>")
+			break
+		}
+		err = a.rotateToken(ctx, args[0])
+	case "migrate":
+		fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+		status := fs.Bool("status", false, "only show the schema version")
+		fs.Parse(args)
+		err = a.migrate(ctx, *status)
+	case "backup":
+		fs := flag.NewFlagSet("backup", flag.ExitOnError)
+		out := fs.String("o", "", "output file (default chat-backup-<time>.tar.gz)")
+		fs.Parse(args)
+		err = a.backup(ctx, *out)
+	case "audit":
+		fs := flag.NewFlagSet("audit", flag.ExitOnError)
+		n := fs.Int("n", 20, "number of recent events to show")
+		follow := fs.Bool("f", false, "keep polling for new events")
+		fs.Parse(args)
+		err = a.audit(ctx, *n, *follow)
+	default:
+		err = fmt.Errorf("unknown command %q, see chatadmin -h", cmd)
+	}
+	if err != nil && ctx.Err() == nil {
+		fatal(err)
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "chatadmin:", err)
+	os.Exit(1)
+}
+
+//////////////
+// Commands //
+//////////////
+
+func (a *admin) users(ctx context.Context) error {
+	var users []User
+	if err := a.do(ctx, http.MethodGet, "/admin/users", &users); err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tUSERNAME\tEMAIL\tROLE\tSTATUS\tCREATED")
+	for _, u := range users {
+		status := "active"
+		if u.Banned {
+			status = "banned"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\n", u.ID, u.Username, u.Email, u.Role, status, u.CreatedAt.Local().Format(time.DateTime))
+	}
+	return tw.Flush()
+}
+
+func (a *admin) setBanned(ctx context.Context, name string, banned bool) error {
+	user, err := a.findUser(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	action, done := "unban", "Unbanned"
+	if banned {
+		action, done = "ban", "Banned"
+	}
+	if err := a.do(ctx, http.MethodPost, "/admin/users/"+strconv.Itoa(user.ID)+"/"+action, nil); err != nil {
+		return err
+	}
+	fmt.Println(done, user.Username)
+	return nil
+}
+
+func (a *admin) wipeRoom(ctx context.Context, workspace, room string) error {
+	path := "/admin/rooms/" + url.PathEscape(room) + "/messages"
+	if workspace != "" {
+		path = "/w/" + url.PathEscape(workspace) + path
+	}
+
+	var res struct {
+		Deleted int `json:"deleted"`
+	}
+	if err := a.do(ctx, http.MethodDelete, path, &res); err != nil {
+		return err
+	}
+	fmt.Printf("Deleted %d messages from #%s\n", res.Deleted, room)
+	return nil
+}
+
+func (a *admin) tokens(ctx context.Context, name string) error {
+	user, err := a.findUser(ctx, name)
+	if err != nil {
+		return err
+	}
+	var tokens []APIToken
+	if err := a.do(ctx, http.MethodGet, "/admin/users/"+strconv.Itoa(user.ID)+"/tokens", &tokens); err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tSCOPES\tHINT\tLAST USED\tEXPIRES")
+	for _, t := range tokens {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t...%s\t%s\t%s\n", t.ID, t.Name, strings.Join(t.Scopes, ","), t.Hint, formatTime(t.LastUsedAt), formatTime(t.ExpiresAt))
+	}
+	return tw.Flush()
+}
+
+func (a *admin) rotateToken(ctx context.Context, id string) error {
+	if _, err := strconv.Atoi(id); err != nil {
+		return fmt.Errorf("invalid token ID %q", id)
+	}
+	var token APIToken
+	if err := a.do(ctx, http.MethodPost, "/admin/tokens/"+id+"/rotate", &token); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Rotated token %d (%s); the old secret no longer works. New secret:\n", token.ID, token.Name)
+	fmt.Println(token.Token)
+	return nil
+}
+
+func (a *admin) migrate(ctx context.Context, statusOnly bool) error {
+	var status struct {
+		Current int `json:"current"`
+		Latest  int `json:"latest"`
+	}
+	method := http.MethodPost
+	if statusOnly {
+		method = http.MethodGet
+	}
+	if err := a.do(ctx, method, "/admin/migrations", &status); err != nil {
+		return err
+	}
+	fmt.Printf("Schema version %d of %d\n", status.Current, status.Latest)
+	return nil
+}
+
+func (a *admin) backup(ctx context.Context, out string) error {
+	if out == "" {
+		out = "chat-backup-" + time.Now().UTC().Format("20060102T150405Z") + ".tar.gz"
+	}
+	f, err := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = a.do(ctx, http.MethodPost, "/admin/backup", f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(out)
+		return err
+	}
+	fmt.Println("Wrote", out)
+	return nil
+}
+
+func (a *admin) audit(ctx context.Context, n int, follow bool) error {
+	var events []AuditEvent
+	if err := a.do(ctx, http.MethodGet, "/admin/audit?limit="+strconv.Itoa(n), &events); err != nil {
+		return err
+	}
+
+	last := 0
+	for {
+		for _, e := range events {
+			fmt.Printf("%s  %-24s actor=%s ip=%s target=%s %s\n",
+				e.Time.Local().Format(time.DateTime), e.Action, e.Actor, e.IP, e.Target, e.Details)
+			last = e.ID
+		}
+		if !follow {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(2 * time.Second):
+		}
+		events = nil
+		if err := a.do(ctx, http.MethodGet, "/admin/audit?after="+strconv.Itoa(last), &events); err != nil {
+			return err
+		}
+	}
+}
+
+/////////////
+// Helpers //
+/////////////
+
+// findUser looks a user up by ID or username
+func (a *admin) findUser(ctx context.Context, name string) (User, error) {
+	var users []User
+	if err := a.do(ctx, http.MethodGet, "/admin/users", &users); err != nil {
+		return User{}, err
+	}
+	id, _ := strconv.Atoi(name)
+	for _, u := range users {
+		if u.ID == id || strings.EqualFold(u.Username, name) {
+			return u, nil
+		}
+	}
+	return User{}, fmt.Errorf("no user %q", name)
+}
+
+// do calls the admin API. JSON responses are decoded into out, unless out
+// is an io.Writer, which receives the raw body.
+func (a *admin) do(ctx context.Context, method, path string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, method, a.baseURL+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+a.token)
+
+	res, err := a.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+		return fmt.Errorf("%s %s: %s", method, path, strings.TrimSpace(string(msg)))
+	}
+	switch out := out.(type) {
+	case nil:
+		return nil
+	case io.Writer:
+		_, err = io.Copy(out, res.Body)
+		return err
+	default:
+		return json.NewDecoder(res.Body).Decode(out)
+	}
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Local().Format(time.DateTime)
+}
@@ -0,0 +1,274 @@
+// Command loadgen load-tests a running chat server. It opens many
+// WebSocket clients spread across rooms, has each of them post at a fixed
+// rate, and reports how long broadcasts take to reach the other clients.
+//
+//	loadgen -url http://localhost:8080 -clients 200 -rooms general,ops -rate 0.5 -duration 1m
+//
+// With -mode tasks it load-tests the task API instead: it creates -tasks
+// tasks, has -readers clients list and fetch them while -writers clients
+// update them, reports the request throughput and deletes the tasks.
+//
+//	loadgen -mode tasks -token $CHAT_TOKEN -tasks 1000 -readers 32 -writers 4 -duration 30s
+//
+// Rooms other than the default one must exist. Every client posts under
+// its own name as a guest, which needs guest access turned on
+// (CHAT_FEATURES=guest_access); with -token they all share the token's
+// account instead, which must have the chat:post scope. The server's per-connection rate
+// limit (CHAT_MESSAGE_RATE_INTERVAL, CHAT_MESSAGE_RATE_BURST) rejects
+// clients posting faster than it allows; those show up as rejected.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// stats is shared by every simulated client
+type stats struct {
+	connected    atomic.Int64
+	connectErrs  atomic.Int64
+	sent         atomic.Int64
+	received     atomic.Int64 // Our own messages seen by any client
+	expected     atomic.Int64 // Deliveries we should see: sent × connected clients in the room
+	rejected     atomic.Int64
+	writeErrs    atomic.Int64
+	disconnected atomic.Int64
+
+	mu        sync.Mutex
+	latencies []time.Duration
+}
+
+func (s *stats) observe(d time.Duration) {
+	s.mu.Lock()
+	s.latencies = append(s.latencies, d)
+	s.mu.Unlock()
+}
+
+// frame is a chat message or an error for a rejected one
+type frame struct {
+	Username string `json:"username"`
+	Content  string `json:"content"`
+	Error    string `json:"error"`
+}
+
+func main() {
+	baseURL := flag.String("url", "http://localhost:8080", "server URL, with /w/{slug} for a workspace")
+	token := flag.String("token", os.Getenv("CHAT_TOKEN"), "API token for every client (default $CHAT_TOKEN)")
+	clients := flag.Int("clients", 50, "number of simulated clients")
+	rooms := flag.String("rooms", "general", "comma-separated rooms to spread the clients over")
+	rate := flag.Float64("rate", 1, "messages per second each client posts")
+	duration := flag.Duration("duration", 30*time.Second, "how long to send messages")
+	ramp := flag.Duration("ramp", 5*time.Second, "time over which clients connect")
+	mode := flag.String("mode", "chat", `what to load-test: "chat" or "tasks"`)
+	tasks := flag.Int("tasks", 500, "tasks to create (tasks mode)")
+	readers := flag.Int("readers", 16, "clients reading tasks (tasks mode)")
+	writers := flag.Int("writers", 2, "clients updating tasks (tasks mode)")
+	flag.Parse()
+
+	if *mode == "tasks" {
+		if *tasks <= 0 || *readers < 0 || *writers < 0 {
+			fmt.Fprintln(os.Stderr, "loadgen: -tasks must be positive and -readers and -writers not negative")
+			os.Exit(2)
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		if err := runTaskLoad(ctx, *baseURL, *token, *tasks, *readers, *writers, *duration); err != nil {
+			fmt.Fprintln(os.Stderr, "loadgen:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if *mode != "chat" {
+		fmt.Fprintln(os.Stderr, `loadgen: -mode must be "chat" or "tasks"`)
+		os.Exit(2)
+	}
+
+	wsURL, err := url.Parse(strings.TrimSuffix(*baseURL, "/") + "/ws")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "loadgen:", err)
+		os.Exit(2)
+	}
+	wsURL.Scheme = strings.Replace(wsURL.Scheme, "http", "ws", 1)
+	roomNames := strings.Split(*rooms, ",")
+	if *clients <= 0 || *rate <= 0 {
+		fmt.Fprintln(os.Stderr, "loadgen: -clients and -rate must be positive")
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	// A run ID tells our messages apart from other traffic in the rooms
+	runID := strconv.FormatInt(time.Now().UnixNano(), 36)
+	st := &stats{}
+	// Connected clients per room
+	perRoom := make(map[string]*atomic.Int64)
+	for _, name := range roomNames {
+		perRoom[name] = &atomic.Int64{}
+	}
+
+	fmt.Printf("Connecting %d clients to %d rooms over %s\n", *clients, len(roomNames), *ramp)
+	sendCtx, stopSending := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < *clients; i++ {
+		room := roomNames[i%len(roomNames)]
+		delay := time.Duration(int64(*ramp) * int64(i) / int64(*clients))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case <-time.After(delay):
+			case <-sendCtx.Done():
+				return
+			}
+			runClient(sendCtx, st, wsURL, *token, room, i, runID, *rate, perRoom[room], start.Add(*ramp))
+		}()
+	}
+
+	// Send for the ramp-up plus the duration, reporting along the way
+	ticker := time.NewTicker(5 * time.Second)
+	deadline := time.After(*ramp + *duration)
+loop:
+	for {
+		select {
+		case <-ticker.C:
+			fmt.Printf("%5.0fs  connected=%d sent=%d received=%d rejected=%d\n",
+				time.Since(start).Seconds(), st.connected.Load(), st.sent.Load(), st.received.Load(), st.rejected.Load())
+		case <-deadline:
+			break loop
+		case <-ctx.Done():
+			break loop
+		}
+	}
+	ticker.Stop()
+	stopSending()
+	wg.Wait()
+
+	report(st, time.Since(start))
+}
+
+// runClient connects one simulated client and, once every client has had
+// time to connect, posts until ctx is done. It keeps reading for a moment
+// afterwards so in-flight broadcasts count.
+func runClient(ctx context.Context, st *stats, wsURL *url.URL, token, room string, id int, runID string, rate float64, roomSize *atomic.Int64, sendAt time.Time) {
+	u := *wsURL
+	u.RawQuery = url.Values{"room": {room}}.Encode()
+	header := http.Header{}
+	if token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, u.String(), header)
+	if err != nil {
+		st.connectErrs.Add(1)
+		return
+	}
+	defer conn.Close()
+	st.connected.Add(1)
+	roomSize.Add(1)
+
+	prefix := "loadgen " + runID + " "
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		for {
+			var f frame
+			if err := conn.ReadJSON(&f); err != nil {
+				if ctx.Err() == nil {
+					st.disconnected.Add(1)
+				}
+				return
+			}
+			if f.Error != "" {
+				st.rejected.Add(1)
+				continue
+			}
+			// Content is "loadgen <run> <client> <seq> <sent unix nanos>"
+			if !strings.HasPrefix(f.Content, prefix) {
+				continue
+			}
+			fields := strings.Fields(f.Content)
+			sent, err := strconv.ParseInt(fields[len(fields)-1], 10, 64)
+			if err != nil {
+				continue
+			}
+			st.received.Add(1)
+			st.observe(time.Since(time.Unix(0, sent)))
+		}
+	}()
+
+	// Deliveries are only counted as expected once the whole room is there
+	select {
+	case <-time.After(time.Until(sendAt)):
+	case <-ctx.Done():
+	}
+
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+	defer ticker.Stop()
+	name := "loadgen-" + strconv.Itoa(id)
+	for seq := 0; ; seq++ {
+		select {
+		case <-ctx.Done():
+			// Give the last broadcasts time to arrive, then hang up
+			time.Sleep(2 * time.Second)
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			conn.Close()
+			<-readDone
+			return
+		case <-ticker.C:
+		}
+
+		content := prefix + strconv.Itoa(id) + " " + strconv.Itoa(seq) + " " + strconv.FormatInt(time.Now().UnixNano(), 10)
+		msg, _ := json.Marshal(frame{Username: name, Content: content})
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if err := conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+			st.writeErrs.Add(1)
+			return
+		}
+		st.sent.Add(1)
+		st.expected.Add(roomSize.Load())
+	}
+}
+
+func report(st *stats, elapsed time.Duration) {
+	sent, received, expected := st.sent.Load(), st.received.Load(), st.expected.Load()
+
+	fmt.Printf("\nRan for %s\n", elapsed.Round(time.Second))
+	fmt.Printf("Clients:    %d connected, %d failed to connect, %d dropped\n",
+		st.connected.Load(), st.connectErrs.Load(), st.disconnected.Load())
+	fmt.Printf("Messages:   %d sent (%.1f/s), %d rejected, %d write errors\n",
+		sent, float64(sent)/elapsed.Seconds(), st.rejected.Load(), st.writeErrs.Load())
+	if expected > 0 {
+		fmt.Printf("Deliveries: %d of %d expected (%.2f%%)\n", received, expected, 100*float64(received)/float64(expected))
+	}
+
+	st.mu.Lock()
+	lat := slices.Clone(st.latencies)
+	st.mu.Unlock()
+	if len(lat) == 0 {
+		fmt.Println("Latency:    no messages delivered")
+		return
+	}
+	slices.Sort(lat)
+	pct := func(p float64) time.Duration {
+		return lat[min(len(lat)-1, int(p*float64(len(lat))))]
+	}
+	fmt.Printf("Latency:    p50=%s p90=%s p99=%s max=%s\n",
+		pct(0.50).Round(time.Microsecond), pct(0.90).Round(time.Microsecond),
+		pct(0.99).Round(time.Microsecond), lat[len(lat)-1].Round(time.Microsecond))
+}
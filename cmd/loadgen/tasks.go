@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// taskStats is shared by every task API worker
+type taskStats struct {
+	reads  atomic.Int64
+	writes atomic.Int64
+	errs   atomic.Int64
+
+	mu            sync.Mutex
+	readLatencies []time.Duration
+}
+
+// runTaskLoad creates tasks, then has readers list and fetch them while
+// writers update them, and reports the request throughput. Comparing
+// runs with and without writers shows how much writes hold up reads.
+func runTaskLoad(ctx context.Context, baseURL, token string, tasks, readers, writers int, duration time.Duration) error {
+	client := &http.Client{Timeout: 30 * time.Second}
+	do := func(method, path string, body any) (*http.Response, error) {
+		var buf bytes.Buffer
+		if body != nil {
+			json.NewEncoder(&buf).Encode(body)
+		}
+		req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(baseURL, "/")+path, &buf)
+		if err != nil {
+			return nil, err
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		return client.Do(req)
+	}
+
+	fmt.Printf("Creating %d tasks\n", tasks)
+	ids := make([]int, 0, tasks)
+	for i := range tasks {
+		res, err := do("POST", "/tasks", map[string]string{"title": fmt.Sprintf("loadgen task %d", i)})
+		if err != nil {
+			return err
+		}
+		var task struct {
+			ID int `json:"id"`
+		}
+		err = json.NewDecoder(res.Body).Decode(&task)
+		res.Body.Close()
+		if res.StatusCode != http.StatusCreated || err != nil {
+			return fmt.Errorf("creating a task: status %d", res.StatusCode)
+		}
+		ids = append(ids, task.ID)
+	}
+	defer func() {
+		fmt.Printf("Deleting %d tasks\n", len(ids))
+		for _, id := range ids {
+			if res, err := do("DELETE", "/tasks/"+strconv.Itoa(id), nil); err == nil {
+				res.Body.Close()
+			}
+		}
+	}()
+
+	fmt.Printf("Running %d readers and %d writers for %s\n", readers, writers, duration)
+	st := &taskStats{}
+	runCtx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+	request := func(method, path string, body any) bool {
+		res, err := do(method, path, body)
+		if err != nil {
+			if runCtx.Err() == nil {
+				st.errs.Add(1)
+			}
+			return false
+		}
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			st.errs.Add(1)
+			return false
+		}
+		return true
+	}
+
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := range readers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var latencies []time.Duration
+			for n := 0; runCtx.Err() == nil; n++ {
+				// Alternate between listing and fetching single tasks
+				path := "/tasks"
+				if (n+i)%2 == 1 {
+					path += "/" + strconv.Itoa(ids[rand.IntN(len(ids))])
+				}
+				began := time.Now()
+				if request("GET", path, nil) {
+					st.reads.Add(1)
+					latencies = append(latencies, time.Since(began))
+				}
+			}
+			st.mu.Lock()
+			st.readLatencies = append(st.readLatencies, latencies...)
+			st.mu.Unlock()
+		}()
+	}
+	statuses := []string{"pending", "in_progress", "completed"}
+	for range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for runCtx.Err() == nil {
+				id := ids[rand.IntN(len(ids))]
+				status := statuses[rand.IntN(len(statuses))]
+				if request("PUT", "/tasks/"+strconv.Itoa(id), map[string]string{"status": status}) {
+					st.writes.Add(1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	fmt.Printf("\nRan for %s\n", elapsed.Round(time.Second))
+	fmt.Printf("Reads:   %d (%.0f/s)\n", st.reads.Load(), float64(st.reads.Load())/elapsed.Seconds())
+	fmt.Printf("Writes:  %d (%.0f/s)\n", st.writes.Load(), float64(st.writes.Load())/elapsed.Seconds())
+	fmt.Printf("Errors:  %d\n", st.errs.Load())
+	lat := st.readLatencies
+	if len(lat) == 0 {
+		return nil
+	}
+	slices.Sort(lat)
+	pct := func(p float64) time.Duration {
+		return lat[min(len(lat)-1, int(p*float64(len(lat))))]
+	}
+	fmt.Printf("Latency: p50=%s p90=%s p99=%s max=%s\n",
+		pct(0.50).Round(time.Microsecond), pct(0.90).Round(time.Microsecond),
+		pct(0.99).Round(time.Microsecond), lat[len(lat)-1].Round(time.Microsecond))
+	return nil
+}
@@ -0,0 +1,722 @@
+package chat
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config holds the server settings. Every field can be set through a
+// CHAT_* environment variable; unset variables fall back to the defaults
+// in LoadConfig.
+type Config struct {
+	// ConfigFile is a file of CHAT_*=value lines read for the variables
+	// that aren't set in the environment (CHAT_CONFIG_FILE). Rate limits,
+	// the message pipeline, allowed origins and feature flags are read
+	// from it again on SIGHUP or POST /admin/config/reload
+	ConfigFile string
+
+	// Addr is the TCP address the HTTP server listens on (CHAT_ADDR)
+	Addr string
+
+	// TLSCertFile and TLSKeyFile enable HTTPS (and with it HTTP/2) when
+	// both are set (CHAT_TLS_CERT, CHAT_TLS_KEY)
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// H2C enables HTTP/2 over plaintext connections with prior knowledge.
+	// Only turn this on behind a trusted proxy that speaks h2c (CHAT_H2C)
+	H2C bool
+
+	// UnixSocket, when set, makes the server listen on this Unix socket
+	// path instead of Addr (CHAT_UNIX_SOCKET). The socket file is created
+	// with UnixSocketMode permissions (CHAT_UNIX_SOCKET_MODE, octal)
+	UnixSocket     string
+	UnixSocketMode fs.FileMode
+
+	// TrustedProxies lists the IPs and CIDR ranges of reverse proxies whose
+	// X-Forwarded-For and X-Real-IP headers are believed (CHAT_TRUSTED_PROXIES,
+	// comma-separated)
+	TrustedProxies []string
+
+	// AllowedOrigins lists the origins, such as https://chat.example.com,
+	// whose pages may open WebSocket connections besides the server's own
+	// (CHAT_ALLOWED_ORIGINS, comma-separated; "*" or empty allows any)
+	AllowedOrigins []string
+
+	// SessionStore selects where sessions are kept: "memory" or "redis"
+	// (CHAT_SESSION_STORE). RedisURL is a redis:// URL (CHAT_REDIS_URL)
+	SessionStore string
+	RedisURL     string
+
+	// SessionTTL is how long a session lasts without activity (CHAT_SESSION_TTL)
+	SessionTTL time.Duration
+
+	// SecureCookies marks session cookies Secure so browsers only send them
+	// over HTTPS. Defaults to on when TLS is enabled (CHAT_SECURE_COOKIES)
+	SecureCookies bool
+
+	// Store selects where data is kept: "sqlite" (default), "postgres" or
+	// "memory", which loses everything on restart and suits tests
+	// (CHAT_STORE). DatabaseURL is the SQLite file path, chat.db in the
+	// working directory by default, or the Postgres connection string
+	// (CHAT_DATABASE_URL)
+	Store       string
+	DatabaseURL string
+
+	// RestoreFrom loads a backup archive from POST /admin/backup on startup
+	// (CHAT_RESTORE_FROM). The store must be empty; when it already has
+	// data the archive is skipped, so the variable can stay set
+	RestoreFrom string
+
+	// Seed fills an empty store with demo users, rooms, messages and tasks
+	// on startup (CHAT_SEED)
+	Seed bool
+
+	// MaxConnections caps the WebSocket clients served at once; further
+	// clients are told to try again later. 0 means no limit
+	// (CHAT_MAX_CONNECTIONS)
+	MaxConnections int
+
+	// MaxConnectionLifetime has clients reconnect, resuming where they
+	// left off, once their connection is this old, so connections move
+	// over to renewed certificates and rebalanced nodes. Each connection
+	// gets up to ConnectionLifetimeJitter less so the reconnects spread
+	// out. 0 keeps connections open (CHAT_MAX_CONNECTION_LIFETIME,
+	// CHAT_CONNECTION_LIFETIME_JITTER, a tenth of the lifetime by default)
+	MaxConnectionLifetime    time.Duration
+	ConnectionLifetimeJitter time.Duration
+
+	// BroadcastBatchInterval is how often messages for clients that take
+	// batches are flushed. Messages that come faster than this are sent
+	// together in one frame. 0 sends every message on its own
+	// (CHAT_BROADCAST_BATCH_INTERVAL)
+	BroadcastBatchInterval time.Duration
+
+	// Hub sizes the broadcast queue (CHAT_BROADCAST_BUFFER), each
+	// connection's write buffer (CHAT_CLIENT_SEND_BUFFER, in bytes) and the
+	// frames a client may fall behind by before it is dropped
+	// (CHAT_CLIENT_QUEUE), and caps the frames clients may send
+	// (CHAT_MAX_FRAME_SIZE, in bytes; derived from CHAT_MAX_MESSAGE_LENGTH
+	// when 0). The write deadline is CHAT_BROADCAST_TIMEOUT. /metrics shows
+	// how they hold up
+	Hub HubConfig
+
+	// HistoryOnConnect is how many of a room's latest messages clients get
+	// when they connect or join it. 0 sends none (CHAT_HISTORY_ON_CONNECT)
+	HistoryOnConnect int
+
+	// MessageWriter batches chat message inserts
+	// (CHAT_MESSAGE_FLUSH_INTERVAL, CHAT_MESSAGE_BATCH_SIZE)
+	MessageWriter MessageWriterConfig
+
+	// Timeouts bound API requests, store calls made outside of them, webhook
+	// deliveries and broadcasts to each chat client (CHAT_REQUEST_TIMEOUT,
+	// CHAT_STORE_TIMEOUT, CHAT_WEBHOOK_TIMEOUT, CHAT_BROADCAST_TIMEOUT)
+	Timeouts TimeoutConfig
+
+	// AllowPrivateWebhooks lets webhooks, automations and event
+	// subscriptions post to loopback, link-local and private addresses,
+	// for servers that only deliver to internal services
+	// (CHAT_WEBHOOK_ALLOW_PRIVATE)
+	AllowPrivateWebhooks bool
+
+	// MessagePipeline limits what clients may post (CHAT_MAX_MESSAGE_LENGTH,
+	// CHAT_MESSAGE_RATE_INTERVAL, CHAT_MESSAGE_RATE_BURST, CHAT_BLOCKED_WORDS)
+	// and holds the first messages of new accounts for moderators to
+	// approve (CHAT_HOLD_NEW_POSTERS: how many, CHAT_NEW_ACCOUNT_AGE)
+	MessagePipeline MessagePipelineConfig
+
+	// RateLimit limits each user, or IP for guests, across connections and
+	// nodes, over a sliding window (CHAT_RATE_LIMIT_STORE: "memory" or
+	// "redis", CHAT_RATE_LIMIT_WINDOW, CHAT_RATE_LIMIT_MESSAGES,
+	// CHAT_RATE_LIMIT_REQUESTS, CHAT_RATE_LIMIT_CONNECTS; the limits are off
+	// when 0). Clients that keep reconnecting past the connect limit wait
+	// longer each time (CHAT_CONNECT_BACKOFF, CHAT_CONNECT_MAX_BACKOFF)
+	RateLimit RateLimitConfig
+
+	// PublicURL is the externally visible base URL of the server, used to
+	// build OAuth redirect URLs (CHAT_PUBLIC_URL)
+	PublicURL string
+
+	// OAuth login providers. A provider is enabled when its client ID is set
+	// (CHAT_OAUTH_GOOGLE_CLIENT_ID, CHAT_OAUTH_GOOGLE_CLIENT_SECRET,
+	// CHAT_OAUTH_GOOGLE_REDIRECT_URL, and the same for CHAT_OAUTH_GITHUB_*)
+	GoogleOAuth OAuthClientConfig
+	GitHubOAuth OAuthClientConfig
+
+	// AuthProvider selects how passwords are checked: "local" or "ldap"
+	// (CHAT_AUTH_PROVIDER). LDAP holds the directory settings (CHAT_LDAP_*)
+	AuthProvider string
+	LDAP         LDAPConfig
+
+	// AdminUsers lists usernames that become admins when their account is
+	// created (CHAT_ADMIN_USERS, comma-separated)
+	AdminUsers []string
+
+	// RequireAdmin2FA is the initial value of the security policy that
+	// requires admins to use two-factor authentication (CHAT_REQUIRE_ADMIN_2FA)
+	RequireAdmin2FA bool
+
+	// TOTPIssuer is the name shown in authenticator apps (CHAT_TOTP_ISSUER)
+	TOTPIssuer string
+
+	// SecretKey signs password reset and email verification links, and
+	// access tokens (CHAT_SECRET_KEY). A random key is generated when
+	// unset, which invalidates outstanding links and tokens on restart
+	SecretKey string
+
+	// AccessTokenTTL is how long the JWT access tokens handed out on login
+	// are valid, for clients that don't keep the session cookie. 0 hands
+	// out none (CHAT_ACCESS_TOKEN_TTL)
+	AccessTokenTTL time.Duration
+
+	// SMTP is the outgoing mail server (CHAT_SMTP_ADDR, CHAT_SMTP_USERNAME,
+	// CHAT_SMTP_PASSWORD, CHAT_SMTP_FROM). Without an address, emails are
+	// only written to the log
+	SMTP SMTPConfig
+
+	// SMS texts urgent mentions and login codes (CHAT_SMS_PROVIDER: "twilio"
+	// or empty to only log, CHAT_SMS_API_URL, CHAT_SMS_ACCOUNT_SID,
+	// CHAT_SMS_AUTH_TOKEN, CHAT_SMS_FROM, CHAT_SMS_MAX_PER_HOUR)
+	SMS SMSConfig
+
+	// RequireEmailVerification keeps new accounts from logging in until
+	// they open the link in the verification email. Defaults to on when
+	// SMTP is configured (CHAT_REQUIRE_EMAIL_VERIFICATION)
+	RequireEmailVerification bool
+
+	// Lockout is the brute-force protection for logins
+	// (CHAT_LOGIN_MAX_FAILURES, CHAT_LOGIN_MAX_IP_FAILURES,
+	// CHAT_LOGIN_LOCKOUT, CHAT_LOGIN_MAX_LOCKOUT, CHAT_LOGIN_FAILURE_WINDOW)
+	Lockout LockoutConfig
+
+	// WorkspaceDomain enables workspace subdomains: with "chat.example.com",
+	// acme.chat.example.com serves the "acme" workspace. Workspaces are
+	// always reachable under /w/{slug}/ as well (CHAT_WORKSPACE_DOMAIN)
+	WorkspaceDomain string
+
+	// Features sets the deployment-wide feature flags as a list of
+	// name=true|false, e.g. "guest_access=true,registration=false".
+	// Admins can change them at runtime under /admin/features (CHAT_FEATURES)
+	Features []string
+
+	// EventLog keeps every domain event in the store for integrations to
+	// replay from GET /events, for Retention (CHAT_EVENT_LOG: on by
+	// default, CHAT_EVENT_LOG_RETENTION, e.g. "168h"; 0 keeps them forever)
+	EventLog EventLogConfig
+
+	// AuditRetention is how long the audit log keeps events
+	// (CHAT_AUDIT_RETENTION, e.g. "2160h"; 0 keeps them forever)
+	AuditRetention time.Duration
+
+	// TaskUndoWindow is how long after a change to a task it can still be
+	// undone with POST /tasks/{id}/undo (CHAT_TASK_UNDO_WINDOW)
+	TaskUndoWindow time.Duration
+
+	// Kafka publishes domain events (message_created, task_created,
+	// task_completed, user_joined) when brokers are set
+	// (CHAT_KAFKA_BROKERS, comma-separated, CHAT_KAFKA_TOPIC_PREFIX,
+	// CHAT_KAFKA_SCHEMA: "json" or "cloudevents")
+	Kafka KafkaConfig
+
+	// MQTT connects the MQTT bridge to a broker when its URL is set
+	// (CHAT_MQTT_BROKER, CHAT_MQTT_CLIENT_ID, CHAT_MQTT_USERNAME,
+	// CHAT_MQTT_PASSWORD, CHAT_MQTT_TOPIC_PREFIX)
+	MQTT MQTTConfig
+
+	// XMPP connects the XMPP gateway to a server as an external component
+	// when its address is set (CHAT_XMPP_COMPONENT_ADDR, CHAT_XMPP_DOMAIN,
+	// CHAT_XMPP_SECRET)
+	XMPP XMPPConfig
+
+	// Discord mirrors Discord channels with rooms when a bot token is set
+	// (CHAT_DISCORD_BOT_TOKEN, CHAT_DISCORD_CHANNELS: comma-separated
+	// "<channel ID>=[<workspace>/]<room>" pairs)
+	Discord DiscordConfig
+
+	// InboundEmail posts mail sent to room addresses when a listen address
+	// is set (CHAT_INBOUND_SMTP_ADDR, CHAT_INBOUND_EMAIL_DOMAIN,
+	// CHAT_INBOUND_EMAIL_MAX_BYTES)
+	InboundEmail InboundEmailConfig
+
+	// Attachments keeps the files shared in rooms when a directory is set,
+	// scanning each one first when a scanner is (CHAT_ATTACHMENTS_DIR,
+	// CHAT_ATTACHMENT_SCANNER: "clamav" or empty, CHAT_CLAMAV_ADDR).
+	// Images are re-encoded without metadata and scaled down to fit
+	// (CHAT_IMAGE_MAX_WIDTH, CHAT_IMAGE_MAX_HEIGHT, CHAT_IMAGE_MAX_PIXELS).
+	// Quotas cap the bytes each user shares and each workspace holds
+	// (CHAT_USER_STORAGE_QUOTA, CHAT_WORKSPACE_STORAGE_QUOTA; 0 is unlimited)
+	Attachments AttachmentConfig
+
+	// Uploads are files sent in resumable chunks over the tus protocol at
+	// /uploads, kept as attachments once complete, so they need
+	// CHAT_ATTACHMENTS_DIR (CHAT_UPLOAD_MAX_SIZE, CHAT_UPLOAD_MAX_PENDING:
+	// bytes of unfinished uploads per user, CHAT_UPLOAD_EXPIRY)
+	Uploads UploadConfig
+
+	// Archive moves messages older than After to gzipped JSON Lines files
+	// under Dir, which room history falls back to (CHAT_ARCHIVE_DIR,
+	// CHAT_ARCHIVE_AFTER, e.g. "2160h" for 90 days; off unless both are set)
+	Archive ArchiveConfig
+
+	// Email fills the emails sent to users from templates, with the files
+	// in a directory replacing the built-in ones of the same name
+	// (CHAT_EMAIL_TEMPLATES_DIR), and brands them unless a workspace sets
+	// its own branding (CHAT_BRAND_NAME, CHAT_BRAND_LOGO_URL,
+	// CHAT_BRAND_COLOR, CHAT_SUPPORT_EMAIL)
+	Email EmailConfig
+
+	// Logging writes the log to stdout as text or JSON lines
+	// (CHAT_LOG_FORMAT), and also to a file rotated at MaxSize bytes whose
+	// rotated copies are removed after MaxAge (CHAT_LOG_FILE,
+	// CHAT_LOG_MAX_SIZE, CHAT_LOG_MAX_AGE) and to syslog (CHAT_LOG_SYSLOG,
+	// e.g. "udp://localhost:514" or "unixgram:///dev/log"). CHAT_LOG_LEVELS
+	// sets the lowest level logged per subsystem, e.g.
+	// "default=info,cluster=error"; admins change them under /admin/logging
+	Logging LoggingConfig
+
+	// SLO is the objective for broadcast latency, from a message coming in
+	// to its write to the last client: the share of broadcasts
+	// (CHAT_SLO_TARGET) that should be done within a latency
+	// (CHAT_SLO_LATENCY), over a window (CHAT_SLO_WINDOW). GET /admin/slo
+	// reports on it and GET /metrics exports it for Prometheus
+	SLO SLOConfig
+
+	// Cluster runs this instance as one node of several sharing a Redis
+	// server at RedisURL when the node IDs are set or discovery is on
+	// (CHAT_CLUSTER_NODES, comma-separated, CHAT_CLUSTER_DISCOVERY,
+	// CHAT_NODE_ID: this node, the hostname by default)
+	Cluster ClusterConfig
+}
+
+// OAuthClientConfig holds the OAuth client registered with a provider.
+// RedirectURL defaults to PublicURL + /auth/oauth/{provider}/callback
+type OAuthClientConfig struct {
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+}
+
+// Values read from the config file, for the variables the environment
+// doesn't set
+var (
+	configFileValues map[string]string
+	configFileMu     sync.Mutex
+)
+
+// LoadConfig reads the configuration from the environment and the config
+// file
+func LoadConfig() Config {
+	if err := loadConfigFile(os.Getenv("CHAT_CONFIG_FILE")); err != nil {
+		log.Printf("Not reading the config file: %v", err)
+	}
+	return configFromEnv()
+}
+
+// loadConfigFile reads the config file at path, or forgets the values read
+// before when path is empty. Lines are CHAT_*=value pairs; blank lines and
+// lines starting with # are skipped, and values may be quoted.
+func loadConfigFile(path string) error {
+	values := make(map[string]string)
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for n := 1; scanner.Scan(); n++ {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			key, value, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+			if !ok {
+				return fmt.Errorf("%s:%d: expected KEY=value", path, n)
+			}
+			value = strings.TrimSpace(value)
+			if unquoted, err := strconv.Unquote(value); err == nil {
+				value = unquoted
+			} else if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+				value = value[1 : len(value)-1]
+			}
+			values[strings.TrimSpace(key)] = value
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+
+	configFileMu.Lock()
+	configFileValues = values
+	configFileMu.Unlock()
+	return nil
+}
+
+// lookupEnv looks a variable up in the environment, then in the config file
+func lookupEnv(key string) (string, bool) {
+	if v, ok := os.LookupEnv(key); ok {
+		return v, true
+	}
+	configFileMu.Lock()
+	defer configFileMu.Unlock()
+	v, ok := configFileValues[key]
+	return v, ok
+}
+
+// getEnv is like os.Getenv, but falls back to the config file
+func getEnv(key string) string {
+	v, _ := lookupEnv(key)
+	return v
+}
+
+// configFromEnv builds the configuration from the environment and the
+// config file loaded last
+func configFromEnv() Config {
+	cfg := Config{
+		ConfigFile: os.Getenv("CHAT_CONFIG_FILE"),
+
+		Addr:        envString("CHAT_ADDR", ":8080"),
+		TLSCertFile: envString("CHAT_TLS_CERT", ""),
+		TLSKeyFile:  envString("CHAT_TLS_KEY", ""),
+		H2C:         envBool("CHAT_H2C", false),
+
+		UnixSocket:     envString("CHAT_UNIX_SOCKET", ""),
+		UnixSocketMode: envFileMode("CHAT_UNIX_SOCKET_MODE", 0660),
+
+		TrustedProxies: envList("CHAT_TRUSTED_PROXIES"),
+		AllowedOrigins: envList("CHAT_ALLOWED_ORIGINS"),
+
+		SessionStore: envString("CHAT_SESSION_STORE", "memory"),
+		RedisURL:     envString("CHAT_REDIS_URL", "redis://localhost:6379/0"),
+		SessionTTL:   envDuration("CHAT_SESSION_TTL", 7*24*time.Hour),
+
+		Store:       envString("CHAT_STORE", "sqlite"),
+		DatabaseURL: envString("CHAT_DATABASE_URL", ""),
+		RestoreFrom: envString("CHAT_RESTORE_FROM", ""),
+		Seed:        envBool("CHAT_SEED", false),
+
+		MaxConnections:         envInt("CHAT_MAX_CONNECTIONS", 0),
+		BroadcastBatchInterval: envDuration("CHAT_BROADCAST_BATCH_INTERVAL", 20*time.Millisecond),
+		Hub: HubConfig{
+			BroadcastBuffer:  envInt("CHAT_BROADCAST_BUFFER", 256),
+			ClientSendBuffer: envInt("CHAT_CLIENT_SEND_BUFFER", 4096),
+			ClientQueue:      envInt("CHAT_CLIENT_QUEUE", 256),
+			MaxFrameSize:     int64(envInt("CHAT_MAX_FRAME_SIZE", 0)),
+		},
+		HistoryOnConnect: envInt("CHAT_HISTORY_ON_CONNECT", 50),
+		MessageWriter: MessageWriterConfig{
+			FlushInterval: envDuration("CHAT_MESSAGE_FLUSH_INTERVAL", 500*time.Millisecond),
+			BatchSize:     envInt("CHAT_MESSAGE_BATCH_SIZE", 100),
+		},
+		Timeouts: TimeoutConfig{
+			Request:   envDuration("CHAT_REQUEST_TIMEOUT", 30*time.Second),
+			Store:     envDuration("CHAT_STORE_TIMEOUT", 10*time.Second),
+			Webhook:   envDuration("CHAT_WEBHOOK_TIMEOUT", 10*time.Second),
+			Broadcast: envDuration("CHAT_BROADCAST_TIMEOUT", 5*time.Second),
+		},
+		AllowPrivateWebhooks: envBool("CHAT_WEBHOOK_ALLOW_PRIVATE", false),
+		MessagePipeline: MessagePipelineConfig{
+			MaxLength:    envInt("CHAT_MAX_MESSAGE_LENGTH", 4000),
+			RateInterval: envDuration("CHAT_MESSAGE_RATE_INTERVAL", 200*time.Millisecond),
+			RateBurst:    envInt("CHAT_MESSAGE_RATE_BURST", 10),
+			BlockedWords: envList("CHAT_BLOCKED_WORDS"),
+
+			HoldNewPosters: envInt("CHAT_HOLD_NEW_POSTERS", 0),
+			NewAccountAge:  envDuration("CHAT_NEW_ACCOUNT_AGE", 24*time.Hour),
+		},
+		RateLimit: RateLimitConfig{
+			Store:    envString("CHAT_RATE_LIMIT_STORE", "memory"),
+			Window:   envDuration("CHAT_RATE_LIMIT_WINDOW", time.Minute),
+			Messages: envInt("CHAT_RATE_LIMIT_MESSAGES", 0),
+			Requests: envInt("CHAT_RATE_LIMIT_REQUESTS", 0),
+			Connects: envInt("CHAT_RATE_LIMIT_CONNECTS", 0),
+
+			ConnectBackoff:    envDuration("CHAT_CONNECT_BACKOFF", 5*time.Second),
+			MaxConnectBackoff: envDuration("CHAT_CONNECT_MAX_BACKOFF", 5*time.Minute),
+		},
+
+		PublicURL:   envString("CHAT_PUBLIC_URL", "http://localhost:8080"),
+		GoogleOAuth: envOAuthClient("CHAT_OAUTH_GOOGLE"),
+		GitHubOAuth: envOAuthClient("CHAT_OAUTH_GITHUB"),
+
+		AuthProvider: envString("CHAT_AUTH_PROVIDER", "local"),
+		LDAP: LDAPConfig{
+			URL:          envString("CHAT_LDAP_URL", ""),
+			StartTLS:     envBool("CHAT_LDAP_STARTTLS", false),
+			BindDN:       envString("CHAT_LDAP_BIND_DN", ""),
+			BindPassword: envString("CHAT_LDAP_BIND_PASSWORD", ""),
+			BaseDN:       envString("CHAT_LDAP_BASE_DN", ""),
+			UserFilter:   envString("CHAT_LDAP_USER_FILTER", "(uid=%s)"),
+			UsernameAttr: envString("CHAT_LDAP_USERNAME_ATTR", "uid"),
+			EmailAttr:    envString("CHAT_LDAP_EMAIL_ATTR", "mail"),
+			GroupAttr:    envString("CHAT_LDAP_GROUP_ATTR", "memberOf"),
+			GroupRoles:   envGroupRoles("CHAT_LDAP_GROUP_ROLES"),
+			DefaultRole:  envString("CHAT_LDAP_DEFAULT_ROLE", "user"),
+		},
+
+		AdminUsers:      envList("CHAT_ADMIN_USERS"),
+		RequireAdmin2FA: envBool("CHAT_REQUIRE_ADMIN_2FA", false),
+		TOTPIssuer:      envString("CHAT_TOTP_ISSUER", "Go Chat"),
+
+		SecretKey:      envString("CHAT_SECRET_KEY", ""),
+		AccessTokenTTL: envDuration("CHAT_ACCESS_TOKEN_TTL", time.Hour),
+		SMTP: SMTPConfig{
+			Addr:     envString("CHAT_SMTP_ADDR", ""),
+			Username: envString("CHAT_SMTP_USERNAME", ""),
+			Password: envString("CHAT_SMTP_PASSWORD", ""),
+			From:     envString("CHAT_SMTP_FROM", "chat@localhost"),
+		},
+		SMS: SMSConfig{
+			Provider:   envString("CHAT_SMS_PROVIDER", ""),
+			APIURL:     envString("CHAT_SMS_API_URL", "https://api.twilio.com"),
+			AccountSID: envString("CHAT_SMS_ACCOUNT_SID", ""),
+			AuthToken:  envString("CHAT_SMS_AUTH_TOKEN", ""),
+			From:       envString("CHAT_SMS_FROM", ""),
+			MaxPerHour: envInt("CHAT_SMS_MAX_PER_HOUR", 5),
+		},
+
+		Lockout: LockoutConfig{
+			MaxAccountFailures: envInt("CHAT_LOGIN_MAX_FAILURES", 5),
+			MaxIPFailures:      envInt("CHAT_LOGIN_MAX_IP_FAILURES", 20),
+			BaseLockout:        envDuration("CHAT_LOGIN_LOCKOUT", time.Minute),
+			MaxLockout:         envDuration("CHAT_LOGIN_MAX_LOCKOUT", time.Hour),
+			FailureWindow:      envDuration("CHAT_LOGIN_FAILURE_WINDOW", 15*time.Minute),
+		},
+
+		WorkspaceDomain: envString("CHAT_WORKSPACE_DOMAIN", ""),
+
+		Features: envList("CHAT_FEATURES"),
+
+		EventLog: EventLogConfig{
+			Enabled:   envBool("CHAT_EVENT_LOG", true),
+			Retention: envDuration("CHAT_EVENT_LOG_RETENTION", 7*24*time.Hour),
+		},
+		AuditRetention: envDuration("CHAT_AUDIT_RETENTION", 365*24*time.Hour),
+		TaskUndoWindow: envDuration("CHAT_TASK_UNDO_WINDOW", 5*time.Minute),
+
+		Kafka: KafkaConfig{
+			Brokers:     envList("CHAT_KAFKA_BROKERS"),
+			TopicPrefix: envString("CHAT_KAFKA_TOPIC_PREFIX", "chat."),
+			Schema:      envString("CHAT_KAFKA_SCHEMA", eventSchemaJSON),
+		},
+		MQTT: MQTTConfig{
+			BrokerURL:   envString("CHAT_MQTT_BROKER", ""),
+			ClientID:    envString("CHAT_MQTT_CLIENT_ID", "chat-server"),
+			Username:    envString("CHAT_MQTT_USERNAME", ""),
+			Password:    envString("CHAT_MQTT_PASSWORD", ""),
+			TopicPrefix: envString("CHAT_MQTT_TOPIC_PREFIX", "chat"),
+		},
+		XMPP: XMPPConfig{
+			ComponentAddr: envString("CHAT_XMPP_COMPONENT_ADDR", ""),
+			Domain:        envString("CHAT_XMPP_DOMAIN", ""),
+			Secret:        envString("CHAT_XMPP_SECRET", ""),
+		},
+		Discord: DiscordConfig{
+			BotToken: envString("CHAT_DISCORD_BOT_TOKEN", ""),
+			Channels: envList("CHAT_DISCORD_CHANNELS"),
+		},
+		InboundEmail: InboundEmailConfig{
+			Addr:     envString("CHAT_INBOUND_SMTP_ADDR", ""),
+			Domain:   envString("CHAT_INBOUND_EMAIL_DOMAIN", ""),
+			MaxBytes: int64(envInt("CHAT_INBOUND_EMAIL_MAX_BYTES", 10<<20)),
+		},
+		Attachments: AttachmentConfig{
+			Dir:        envString("CHAT_ATTACHMENTS_DIR", ""),
+			Scanner:    envString("CHAT_ATTACHMENT_SCANNER", ""),
+			ClamAVAddr: envString("CHAT_CLAMAV_ADDR", "localhost:3310"),
+			Images: ImageConfig{
+				MaxWidth:  envInt("CHAT_IMAGE_MAX_WIDTH", 4096),
+				MaxHeight: envInt("CHAT_IMAGE_MAX_HEIGHT", 4096),
+				MaxPixels: envInt("CHAT_IMAGE_MAX_PIXELS", 50_000_000),
+			},
+			UserQuota:      int64(envInt("CHAT_USER_STORAGE_QUOTA", 0)),
+			WorkspaceQuota: int64(envInt("CHAT_WORKSPACE_STORAGE_QUOTA", 0)),
+		},
+		Uploads: UploadConfig{
+			MaxSize:    int64(envInt("CHAT_UPLOAD_MAX_SIZE", 100<<20)),
+			MaxPending: int64(envInt("CHAT_UPLOAD_MAX_PENDING", 1<<30)),
+			Expiry:     envDuration("CHAT_UPLOAD_EXPIRY", 24*time.Hour),
+		},
+		Archive: ArchiveConfig{
+			Dir:   envString("CHAT_ARCHIVE_DIR", ""),
+			After: envDuration("CHAT_ARCHIVE_AFTER", 0),
+		},
+		Email: EmailConfig{
+			TemplatesDir: envString("CHAT_EMAIL_TEMPLATES_DIR", ""),
+			Branding: WorkspaceBranding{
+				Name:         envString("CHAT_BRAND_NAME", "Go Chat"),
+				LogoURL:      envString("CHAT_BRAND_LOGO_URL", ""),
+				Color:        envString("CHAT_BRAND_COLOR", "#4f46e5"),
+				SupportEmail: envString("CHAT_SUPPORT_EMAIL", ""),
+			},
+		},
+		Logging: LoggingConfig{
+			Format:  envString("CHAT_LOG_FORMAT", "text"),
+			File:    envString("CHAT_LOG_FILE", ""),
+			MaxSize: int64(envInt("CHAT_LOG_MAX_SIZE", 100<<20)),
+			MaxAge:  envDuration("CHAT_LOG_MAX_AGE", 7*24*time.Hour),
+			Syslog:  envString("CHAT_LOG_SYSLOG", ""),
+			Levels:  envPairs("CHAT_LOG_LEVELS"),
+		},
+		SLO: SLOConfig{
+			Latency: envDuration("CHAT_SLO_LATENCY", 250*time.Millisecond),
+			Target:  envFloat("CHAT_SLO_TARGET", 0.99),
+			Window:  envDuration("CHAT_SLO_WINDOW", time.Hour),
+		},
+		Cluster: ClusterConfig{
+			NodeID:    envString("CHAT_NODE_ID", defaultNodeID()),
+			Nodes:     envList("CHAT_CLUSTER_NODES"),
+			Discovery: envBool("CHAT_CLUSTER_DISCOVERY", false),
+		},
+	}
+	cfg.Cluster.RedisURL = cfg.RedisURL
+	cfg.MaxConnectionLifetime = envDuration("CHAT_MAX_CONNECTION_LIFETIME", 0)
+	cfg.ConnectionLifetimeJitter = envDuration("CHAT_CONNECTION_LIFETIME_JITTER", cfg.MaxConnectionLifetime/10)
+	cfg.SecureCookies = envBool("CHAT_SECURE_COOKIES", cfg.TLSEnabled())
+	cfg.RequireEmailVerification = envBool("CHAT_REQUIRE_EMAIL_VERIFICATION", cfg.SMTP.Addr != "")
+	return cfg
+}
+
+// TLSEnabled reports whether a certificate and key have been configured
+func (c Config) TLSEnabled() bool {
+	return c.TLSCertFile != "" && c.TLSKeyFile != ""
+}
+
+// envOAuthClient reads the <prefix>_CLIENT_ID, <prefix>_CLIENT_SECRET and
+// <prefix>_REDIRECT_URL variables
+func envOAuthClient(prefix string) OAuthClientConfig {
+	return OAuthClientConfig{
+		ClientID:     envString(prefix+"_CLIENT_ID", ""),
+		ClientSecret: envString(prefix+"_CLIENT_SECRET", ""),
+		RedirectURL:  envString(prefix+"_REDIRECT_URL", ""),
+	}
+}
+
+// envString returns the value of the environment variable or def if unset
+func envString(key, def string) string {
+	if v, ok := lookupEnv(key); ok {
+		return strings.TrimSpace(v)
+	}
+	return def
+}
+
+// envBool parses a boolean environment variable, falling back to def
+func envBool(key string, def bool) bool {
+	v, ok := lookupEnv(key)
+	if !ok || v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Printf("Invalid value for %s: %q, using default %v", key, v, def)
+		return def
+	}
+	return b
+}
+
+// envGroupRoles parses a group-to-role mapping written as
+// "<group DN>:<role>" pairs separated by semicolons
+func envGroupRoles(key string) map[string]string {
+	roles := make(map[string]string)
+	for _, item := range strings.Split(getEnv(key), ";") {
+		i := strings.LastIndex(item, ":")
+		if i <= 0 {
+			if strings.TrimSpace(item) != "" {
+				log.Printf("Invalid entry in %s: %q", key, item)
+			}
+			continue
+		}
+		roles[strings.TrimSpace(item[:i])] = strings.TrimSpace(item[i+1:])
+	}
+	return roles
+}
+
+// envPairs parses a comma-separated list of name=value pairs
+func envPairs(key string) map[string]string {
+	pairs := make(map[string]string)
+	for _, item := range envList(key) {
+		name, value, ok := strings.Cut(item, "=")
+		if !ok {
+			log.Printf("Invalid entry in %s: %q", key, item)
+			continue
+		}
+		pairs[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	return pairs
+}
+
+// envInt parses an integer environment variable, falling back to def
+func envInt(key string, def int) int {
+	v, ok := lookupEnv(key)
+	if !ok || v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Printf("Invalid value for %s: %q, using default %d", key, v, def)
+		return def
+	}
+	return n
+}
+
+// envFloat parses a number environment variable, falling back to def
+func envFloat(key string, def float64) float64 {
+	v, ok := lookupEnv(key)
+	if !ok || v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		log.Printf("Invalid value for %s: %q, using default %g", key, v, def)
+		return def
+	}
+	return f
+}
+
+// envDuration parses a duration such as "30m" or "24h", falling back to def
+func envDuration(key string, def time.Duration) time.Duration {
+	v, ok := lookupEnv(key)
+	if !ok || v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Printf("Invalid value for %s: %q, using default %v", key, v, def)
+		return def
+	}
+	return d
+}
+
+// envList splits a comma-separated environment variable, dropping empty items
+func envList(key string) []string {
+	var list []string
+	for _, item := range strings.Split(getEnv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// envFileMode parses an octal permission mode such as "0660", falling back to def
+func envFileMode(key string, def fs.FileMode) fs.FileMode {
+	v, ok := lookupEnv(key)
+	if !ok || v == "" {
+		return def
+	}
+	m, err := strconv.ParseUint(v, 8, 32)
+	if err != nil {
+		log.Printf("Invalid value for %s: %q, using default %#o", key, v, def)
+		return def
+	}
+	return fs.FileMode(m)
+}
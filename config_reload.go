@@ -0,0 +1,127 @@
+package chat
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// reloadableSettings are the settings a config reload applies. The rest
+// only change on restart.
+type reloadableSettings struct {
+	RateLimit       RateLimitConfig
+	MessagePipeline MessagePipelineConfig
+	AllowedOrigins  []string
+	Features        []string
+}
+
+// ConfigReload reports what a config reload changed
+type ConfigReload struct {
+	ReloadedAt time.Time `json:"reloadedAt"`
+	Changed    []string  `json:"changed"` // Names of the settings that changed
+}
+
+var (
+	// Settings applied at startup or by the last reload
+	liveSettings reloadableSettings
+	reloadMu     sync.Mutex
+)
+
+func settingsFrom(cfg Config) reloadableSettings {
+	return reloadableSettings{
+		RateLimit:       cfg.RateLimit,
+		MessagePipeline: cfg.MessagePipeline,
+		AllowedOrigins:  cfg.AllowedOrigins,
+		Features:        cfg.Features,
+	}
+}
+
+// applySettings puts settings into effect. Connected clients stay
+// connected; they pick up the new limits with their next message, except
+// for the per-connection message rate, which is fixed when they connect.
+func applySettings(settings reloadableSettings) {
+	rateLimitConfigMu.Lock()
+	rateLimitConfig = settings.RateLimit
+	rateLimitConfigMu.Unlock()
+
+	messagePipelineConfigMu.Lock()
+	messagePipelineConfig = settings.MessagePipeline
+	messagePipelineConfigMu.Unlock()
+
+	allowedOriginsMu.Lock()
+	allowedOrigins = settings.AllowedOrigins
+	allowedOriginsMu.Unlock()
+}
+
+// reloadSettings reads the config file and environment again and applies the
+// settings that can change at runtime. Feature flags are only reset when
+// CHAT_FEATURES itself changed, so toggles made by admins since startup
+// survive unrelated reloads.
+func reloadSettings() (ConfigReload, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	// The environment can't change after startup, only the file
+	if err := loadConfigFile(os.Getenv("CHAT_CONFIG_FILE")); err != nil {
+		return ConfigReload{}, err
+	}
+	cfg := configFromEnv()
+	next := settingsFrom(cfg)
+	// The rate limit store is connected at startup
+	next.RateLimit.Store = liveSettings.RateLimit.Store
+
+	flags, err := parseFeatureList(next.Features)
+	if err != nil {
+		return ConfigReload{}, err
+	}
+	for name := range flags {
+		if _, ok := knownFeatures[name]; !ok {
+			return ConfigReload{}, fmt.Errorf("unknown feature flag %q", name)
+		}
+	}
+
+	reload := ConfigReload{ReloadedAt: time.Now().UTC(), Changed: []string{}}
+	changed := func(name string, before, after any) {
+		if !reflect.DeepEqual(before, after) {
+			reload.Changed = append(reload.Changed, name)
+		}
+	}
+	changed("rateLimit", liveSettings.RateLimit, next.RateLimit)
+	changed("messagePipeline", liveSettings.MessagePipeline, next.MessagePipeline)
+	changed("allowedOrigins", liveSettings.AllowedOrigins, next.AllowedOrigins)
+	changed("features", liveSettings.Features, next.Features)
+
+	applySettings(next)
+	if !reflect.DeepEqual(liveSettings.Features, next.Features) {
+		setFeatureDefaults(flags)
+	}
+	liveSettings = next
+
+	if len(reload.Changed) == 0 {
+		log.Println("Config reloaded, nothing changed")
+	} else {
+		log.Printf("Config reloaded, changed: %s", strings.Join(reload.Changed, ", "))
+	}
+	return reload, nil
+}
+
+// Reload the config on this node and the others
+// (POST /admin/config/reload)
+func reloadConfig(w http.ResponseWriter, r *http.Request) {
+	reload, err := reloadSettings()
+	if err != nil {
+		http.Error(w, "Config reload failed: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if cluster != nil {
+		cluster.broadcast(clusterEnvelope{From: cluster.id, Kind: envelopeConfig})
+	}
+	recordAudit(r, "config.reload", "", strings.Join(reload.Changed, ","))
+	json.NewEncoder(w).Encode(reload)
+}
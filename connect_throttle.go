@@ -0,0 +1,83 @@
+package chat
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// connectStrike tracks a user or IP that went past the connect limit
+type connectStrike struct {
+	strikes      int
+	lastStrike   time.Time
+	blockedUntil time.Time
+}
+
+var (
+	// Users and IPs reconnecting in a loop, keyed like rate limits
+	connectStrikes   = make(map[string]*connectStrike)
+	connectStrikesMu sync.Mutex
+)
+
+// throttleConnect counts a WebSocket connect against the user, or the IP
+// for guests, and returns how long they must wait when they connect too
+// often, as crashing clients and attacks do. Each time they go past the
+// limit again the wait doubles, up to MaxConnectBackoff; strikes are
+// forgotten once that long passes without one.
+func throttleConnect(r *http.Request) time.Duration {
+	limits := currentRateLimits()
+	if limits.Connects <= 0 {
+		return 0
+	}
+	key := rateLimitKey(r, "connect")
+	now := time.Now()
+
+	connectStrikesMu.Lock()
+	if s, ok := connectStrikes[key]; ok && s.blockedUntil.After(now) {
+		connectStrikesMu.Unlock()
+		return s.blockedUntil.Sub(now)
+	}
+	connectStrikesMu.Unlock()
+
+	ok, retry := allowRate(r.Context(), key, limits.Connects)
+	if ok {
+		return 0
+	}
+
+	connectStrikesMu.Lock()
+	s, found := connectStrikes[key]
+	if !found || now.Sub(s.lastStrike) > limits.MaxConnectBackoff {
+		s = &connectStrike{}
+		connectStrikes[key] = s
+	}
+	s.strikes++
+	s.lastStrike = now
+	backoff := float64(limits.ConnectBackoff) * math.Pow(2, float64(s.strikes-1))
+	wait := max(time.Duration(math.Min(backoff, float64(limits.MaxConnectBackoff))), retry)
+	s.blockedUntil = now.Add(wait)
+	strikes := s.strikes
+	pruneConnectStrikes(now, limits.MaxConnectBackoff)
+	connectStrikesMu.Unlock()
+
+	recordAudit(r, "connect.throttle", key, fmt.Sprintf("%s after %d strikes", wait.Round(time.Second), strikes))
+	return wait
+}
+
+// pruneConnectStrikes forgets users and IPs that are neither blocked nor
+// recently struck. The caller must hold connectStrikesMu.
+func pruneConnectStrikes(now time.Time, quiet time.Duration) {
+	for key, s := range connectStrikes {
+		if now.After(s.blockedUntil) && now.Sub(s.lastStrike) > quiet {
+			delete(connectStrikes, key)
+		}
+	}
+}
+
+// writeConnectThrottled responds with 429 and a Retry-After header
+func writeConnectThrottled(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(max(1, int(math.Ceil(wait.Seconds())))))
+	http.Error(w, "Reconnecting too often, try again later", http.StatusTooManyRequests)
+}
@@ -0,0 +1,108 @@
+package chat
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Limits on the tags a client can give its connection with ?tag=
+const (
+	maxConnectionTags   = 5
+	maxConnectionTagLen = 32
+)
+
+// ConnectionInfo describes a connected WebSocket client, for "active
+// sessions" views
+type ConnectionInfo struct {
+	ID           int       `json:"id"`
+	Username     string    `json:"username,omitempty"` // Empty for guests
+	Workspace    string    `json:"workspace"`          // Slug
+	Room         string    `json:"room"`
+	UserAgent    string    `json:"userAgent,omitempty"`
+	Tags         []string  `json:"tags,omitempty"` // Labels the client chose, e.g. "desktop"
+	ConnectedAt  time.Time `json:"connectedAt"`
+	LastActivity time.Time `json:"lastActivity"` // Last message sent, or the connect time
+}
+
+// ConnectionStats is the admin overview of the connected clients
+type ConnectionStats struct {
+	Connections    int              `json:"connections"`
+	MaxConnections int              `json:"maxConnections,omitempty"` // 0 when unlimited
+	Users          int              `json:"users"`                    // Distinct logged-in users
+	Guests         int              `json:"guests"`
+	Clients        []ConnectionInfo `json:"clients"` // Oldest connection first
+}
+
+// connectionTags validates the ?tag= parameters a client connects with
+func connectionTags(r *http.Request) ([]string, error) {
+	var tags []string
+	for _, tag := range r.URL.Query()["tag"] {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || slices.Contains(tags, tag) {
+			continue
+		}
+		if len(tag) > maxConnectionTagLen {
+			return nil, fmt.Errorf("Tags can be at most %d characters", maxConnectionTagLen)
+		}
+		tags = append(tags, tag)
+	}
+	if len(tags) > maxConnectionTags {
+		return nil, fmt.Errorf("Connections can have at most %d tags", maxConnectionTags)
+	}
+	return tags, nil
+}
+
+// touchClient records that a client just sent a message
+func touchClient(ws *websocket.Conn, now time.Time) {
+	hub.do(func() {
+		if c, ok := hub.clients[ws]; ok {
+			c.info.LastActivity = now
+			hub.clients[ws] = c
+		}
+	})
+}
+
+// connections returns the clients that match selects, oldest first
+func connections(match func(chatClient) bool) []ConnectionInfo {
+	infos := []ConnectionInfo{}
+	hub.do(func() {
+		for _, c := range hub.clients {
+			if match(c) {
+				infos = append(infos, c.info)
+			}
+		}
+	})
+	slices.SortFunc(infos, func(a, b ConnectionInfo) int { return a.ID - b.ID })
+	return infos
+}
+
+// List the logged-in user's WebSocket connections (GET /me/connections)
+func getMyConnections(w http.ResponseWriter, r *http.Request) {
+	user, _ := currentUser(r)
+	json.NewEncoder(w).Encode(connections(func(c chatClient) bool { return c.userID == user.ID }))
+}
+
+// Get the connected clients (GET /admin/stats)
+func getConnectionStats(w http.ResponseWriter, r *http.Request) {
+	stats := ConnectionStats{
+		Clients:        connections(func(chatClient) bool { return true }),
+		MaxConnections: maxConnections,
+	}
+	users := make(map[string]bool)
+	for _, c := range stats.Clients {
+		if c.Username == "" {
+			stats.Guests++
+		} else {
+			users[c.Username] = true
+		}
+	}
+	stats.Connections = len(stats.Clients)
+	stats.Users = len(users)
+	json.NewEncoder(w).Encode(stats)
+}
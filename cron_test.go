@@ -0,0 +1,35 @@
+package chat
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	// A Friday
+	from := time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name, expr string
+		want       time.Time // Zero when it never fires
+	}{
+		{"daily", "@daily", time.Date(2026, 10, 17, 0, 0, 0, 0, time.UTC)},
+		{"day of week", "0 9 * * 1", time.Date(2026, 10, 19, 9, 0, 0, 0, time.UTC)},
+		{"day of month", "0 9 13 * *", time.Date(2026, 11, 13, 9, 0, 0, 0, time.UTC)},
+		{"either day", "0 9 1 * 1", time.Date(2026, 10, 19, 9, 0, 0, 0, time.UTC)},
+		{"stepped day of month and day of week", "0 9 */2 * 1", time.Date(2026, 10, 19, 9, 0, 0, 0, time.UTC)},
+		{"day of month and stepped day of week", "0 9 1 * */2", time.Date(2026, 11, 1, 9, 0, 0, 0, time.UTC)},
+		{"Sunday as 7", "0 9 * * 7", time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC)},
+		{"never", "0 0 30 2 *", time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := parseCron(tt.expr, time.UTC)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := s.next(from); !got.Equal(tt.want) {
+				t.Errorf("next(%q) = %v, want %v", tt.expr, got, tt.want)
+			}
+		})
+	}
+}
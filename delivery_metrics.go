@@ -0,0 +1,267 @@
+package chat
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SLOConfig is the objective for broadcast latency: the time from a
+// message coming in to its write to the last of this node's clients in
+// the room
+type SLOConfig struct {
+	Latency time.Duration // Broadcasts should be done within this
+	Target  float64       // Share of broadcasts that should be, e.g. 0.99
+	Window  time.Duration // Period the SLO report looks back on
+}
+
+// Most recent broadcasts kept for the SLO report
+const maxDeliverySamples = 100000
+
+// Upper bounds of the latency histogram buckets, in seconds
+var latencyBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+// deliverySample is one broadcast as this node delivered it
+type deliverySample struct {
+	at       time.Time
+	latency  time.Duration // From ingest to the write to the last client
+	lockWait time.Duration // Spent waiting for the hub to take it
+}
+
+// deliveryMetrics measures broadcasts: totals since startup for
+// Prometheus, and the broadcasts in the SLO window for the report
+type deliveryMetrics struct {
+	mu sync.Mutex
+
+	buckets     []uint64 // Broadcasts per latency bucket, not cumulative
+	count       uint64
+	latencySum  float64 // Seconds
+	lockWaitSum float64 // Seconds
+	writes      uint64  // Frames queued for clients
+	dropped     uint64  // Clients dropped because they fell behind or a write failed
+
+	samples []deliverySample // Oldest first
+}
+
+var (
+	delivery  = &deliveryMetrics{buckets: make([]uint64, len(latencyBuckets))}
+	sloConfig SLOConfig
+)
+
+// broadcastTiming follows a broadcast from the queueing of a message for
+// the clients in its room until the last of them has written it or is
+// gone, when the broadcast is recorded. The queued copies of the message
+// carry it to the clients' pumps.
+type broadcastTiming struct {
+	ingested   time.Time
+	handedOver time.Time     // To the hub
+	lockWait   time.Duration // Until the hub took it
+	writes     int
+	dropped    int
+	// Copies not yet written, plus one for the broadcast while it queues
+	// them
+	pending atomic.Int64
+}
+
+// newBroadcastTiming starts timing a broadcast of a message that came in
+// at ingested, as it is handed to the hub
+func newBroadcastTiming(ingested time.Time) *broadcastTiming {
+	t := &broadcastTiming{ingested: ingested, handedOver: time.Now()}
+	t.pending.Store(1)
+	return t
+}
+
+// queued counts a copy of the message queued for a client
+func (t *broadcastTiming) queued() {
+	t.pending.Add(1)
+}
+
+// done counts a copy as written, or as never going to be, and records the
+// broadcast after the last one
+func (t *broadcastTiming) done() {
+	if t != nil && t.pending.Add(-1) == 0 {
+		delivery.record(t.ingested, t.lockWait, t.writes, t.dropped)
+	}
+}
+
+// frameDone marks the broadcasts of the messages in a frame done with a
+// client
+func frameDone(v any) {
+	switch frame := v.(type) {
+	case Message:
+		frame.broadcast.done()
+	case BatchFrame:
+		for _, msg := range frame.Batch {
+			msg.broadcast.done()
+		}
+	}
+}
+
+// record adds a broadcast of a message that came in at ingested, done
+// now. In a cluster, messages from other nodes are timed by their clock.
+func (m *deliveryMetrics) record(ingested time.Time, lockWait time.Duration, writes, dropped int) {
+	now := time.Now()
+	latency := max(now.Sub(ingested), 0)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	seconds := latency.Seconds()
+	if i, _ := slices.BinarySearch(latencyBuckets, seconds); i < len(latencyBuckets) {
+		m.buckets[i]++
+	}
+	m.count++
+	m.latencySum += seconds
+	m.lockWaitSum += lockWait.Seconds()
+	m.writes += uint64(writes)
+	m.dropped += uint64(dropped)
+
+	m.samples = append(m.samples, deliverySample{now, latency, lockWait})
+	cutoff := now.Add(-sloConfig.Window)
+	old, _ := slices.BinarySearchFunc(m.samples, cutoff, func(s deliverySample, t time.Time) int { return s.at.Compare(t) })
+	old = max(old, len(m.samples)-maxDeliverySamples)
+	if old > 0 {
+		m.samples = slices.Delete(m.samples, 0, old)
+	}
+}
+
+// recordDropped counts a client dropped because a write to it failed
+func (m *deliveryMetrics) recordDropped() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dropped++
+}
+
+// SLOReport is how broadcasts did over the SLO window
+type SLOReport struct {
+	Since      time.Time `json:"since"`
+	Broadcasts int       `json:"broadcasts"`
+	// Broadcasts done within the objective, and their share
+	WithinObjective int     `json:"withinObjective"`
+	Ratio           float64 `json:"ratio"` // 1 when there were none
+	ObjectiveMs     float64 `json:"objectiveMs"`
+	Target          float64 `json:"target"`
+	Met             bool    `json:"met"`
+	// Latency percentiles in milliseconds
+	P50Ms float64 `json:"p50Ms"`
+	P90Ms float64 `json:"p90Ms"`
+	P99Ms float64 `json:"p99Ms"`
+	MaxMs float64 `json:"maxMs"`
+	// 99th percentile of the wait for the hub to take a broadcast, which
+	// grows with how busy its loop is
+	LockWaitP99Ms float64 `json:"lockWaitP99Ms"`
+}
+
+// report summarizes the broadcasts in the SLO window
+func (m *deliveryMetrics) report() SLOReport {
+	now := time.Now()
+	cutoff := now.Add(-sloConfig.Window)
+	var latencies, waits []time.Duration
+	m.mu.Lock()
+	for _, s := range m.samples {
+		if s.at.After(cutoff) {
+			latencies = append(latencies, s.latency)
+			waits = append(waits, s.lockWait)
+		}
+	}
+	m.mu.Unlock()
+	slices.Sort(latencies)
+	slices.Sort(waits)
+
+	r := SLOReport{
+		Since:       cutoff.UTC(),
+		Broadcasts:  len(latencies),
+		Ratio:       1,
+		ObjectiveMs: milliseconds(sloConfig.Latency),
+		Target:      sloConfig.Target,
+	}
+	if len(latencies) > 0 {
+		r.WithinObjective, _ = slices.BinarySearch(latencies, sloConfig.Latency+1)
+		r.Ratio = float64(r.WithinObjective) / float64(len(latencies))
+		r.P50Ms = milliseconds(percentile(latencies, 0.5))
+		r.P90Ms = milliseconds(percentile(latencies, 0.9))
+		r.P99Ms = milliseconds(percentile(latencies, 0.99))
+		r.MaxMs = milliseconds(latencies[len(latencies)-1])
+		r.LockWaitP99Ms = milliseconds(percentile(waits, 0.99))
+	}
+	r.Met = r.Ratio >= r.Target
+	return r
+}
+
+// percentile picks the p-th percentile of sorted durations
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	return sorted[min(int(p*float64(len(sorted))), len(sorted)-1)]
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// Report the broadcast latency against the SLO (GET /admin/slo)
+func getSLOReport(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(delivery.report())
+}
+
+// Export the delivery metrics in the Prometheus text format (GET /metrics)
+func getMetrics(w http.ResponseWriter, r *http.Request) {
+	report := delivery.report()
+	var connected int
+	hub.do(func() { connected = len(hub.clients) })
+
+	m := delivery
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintln(w, "# HELP chat_broadcast_latency_seconds Time from a message coming in to its write to the last client in the room.")
+	fmt.Fprintln(w, "# TYPE chat_broadcast_latency_seconds histogram")
+	var cumulative uint64
+	for i, le := range latencyBuckets {
+		cumulative += m.buckets[i]
+		fmt.Fprintf(w, "chat_broadcast_latency_seconds_bucket{le=\"%s\"} %d\n", strconv.FormatFloat(le, 'g', -1, 64), cumulative)
+	}
+	fmt.Fprintf(w, "chat_broadcast_latency_seconds_bucket{le=\"+Inf\"} %d\n", m.count)
+	fmt.Fprintf(w, "chat_broadcast_latency_seconds_sum %g\n", m.latencySum)
+	fmt.Fprintf(w, "chat_broadcast_latency_seconds_count %d\n", m.count)
+
+	fmt.Fprintln(w, "# HELP chat_broadcast_latency_window_seconds Broadcast latency percentiles over the SLO window.")
+	fmt.Fprintln(w, "# TYPE chat_broadcast_latency_window_seconds summary")
+	for _, q := range []struct {
+		quantile string
+		ms       float64
+	}{{"0.5", report.P50Ms}, {"0.9", report.P90Ms}, {"0.99", report.P99Ms}} {
+		fmt.Fprintf(w, "chat_broadcast_latency_window_seconds{quantile=\"%s\"} %g\n", q.quantile, q.ms/1000)
+	}
+
+	fmt.Fprintln(w, "# HELP chat_broadcast_lock_wait_seconds_total Time broadcasts spent waiting for the hub to take them.")
+	fmt.Fprintln(w, "# TYPE chat_broadcast_lock_wait_seconds_total counter")
+	fmt.Fprintf(w, "chat_broadcast_lock_wait_seconds_total %g\n", m.lockWaitSum)
+	fmt.Fprintln(w, "# HELP chat_client_writes_total Frames queued for chat clients by broadcasts.")
+	fmt.Fprintln(w, "# TYPE chat_client_writes_total counter")
+	fmt.Fprintf(w, "chat_client_writes_total %d\n", m.writes)
+	fmt.Fprintln(w, "# HELP chat_slow_clients_dropped_total Chat clients dropped because their queue filled up (CHAT_CLIENT_QUEUE) or a write failed, e.g. took longer than CHAT_BROADCAST_TIMEOUT.")
+	fmt.Fprintln(w, "# TYPE chat_slow_clients_dropped_total counter")
+	fmt.Fprintf(w, "chat_slow_clients_dropped_total %d\n", m.dropped)
+	fmt.Fprintln(w, "# HELP chat_broadcast_queue_length Messages waiting for the broadcast loop. Near the capacity, raise CHAT_BROADCAST_BUFFER.")
+	fmt.Fprintln(w, "# TYPE chat_broadcast_queue_length gauge")
+	fmt.Fprintf(w, "chat_broadcast_queue_length %d\n", len(broadcast))
+	fmt.Fprintln(w, "# HELP chat_broadcast_queue_capacity Messages the broadcast queue holds before senders wait (CHAT_BROADCAST_BUFFER).")
+	fmt.Fprintln(w, "# TYPE chat_broadcast_queue_capacity gauge")
+	fmt.Fprintf(w, "chat_broadcast_queue_capacity %d\n", cap(broadcast))
+	fmt.Fprintln(w, "# HELP chat_broadcast_queue_waits_total Messages whose sender waited because the broadcast queue was full.")
+	fmt.Fprintln(w, "# TYPE chat_broadcast_queue_waits_total counter")
+	fmt.Fprintf(w, "chat_broadcast_queue_waits_total %d\n", broadcastQueueWaits.Load())
+	fmt.Fprintln(w, "# HELP chat_oversized_frames_total Connections closed for sending a frame over the maximum frame size (CHAT_MAX_FRAME_SIZE).")
+	fmt.Fprintln(w, "# TYPE chat_oversized_frames_total counter")
+	fmt.Fprintf(w, "chat_oversized_frames_total %d\n", oversizedFrames.Load())
+	fmt.Fprintln(w, "# HELP chat_broadcast_slo_ratio Share of broadcasts in the SLO window done within the objective.")
+	fmt.Fprintln(w, "# TYPE chat_broadcast_slo_ratio gauge")
+	fmt.Fprintf(w, "chat_broadcast_slo_ratio %g\n", report.Ratio)
+	fmt.Fprintln(w, "# HELP chat_connections Chat clients connected to this node.")
+	fmt.Fprintln(w, "# TYPE chat_connections gauge")
+	fmt.Fprintf(w, "chat_connections %d\n", connected)
+}
@@ -0,0 +1,257 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Origin of messages that came in from Discord
+const originDiscord = "discord"
+
+// Name of the webhook the bridge posts through in each channel
+const discordWebhookName = "Chat bridge"
+
+// Chat messages waiting to be posted to Discord. When Discord can't keep
+// up, further messages are dropped.
+const discordQueueSize = 1024
+
+// Escapes the characters Discord formats text with
+var discordMarkdown = strings.NewReplacer(`\`, `\\`, "*", `\*`, "_", `\_`, "~", `\~`, "`", "\\`", "|", `\|`)
+
+// DiscordConfig holds the settings of the Discord bridge. The bot needs the
+// Message Content intent, and the Manage Webhooks permission to post under
+// the names of chat users; without it, messages are posted by the bot
+// with the author's name in front.
+type DiscordConfig struct {
+	BotToken string // Empty disables the bridge
+	// Channels pairs Discord channel IDs with rooms as
+	// "<channel ID>=<room>" or "<channel ID>=<workspace>/<room>"
+	Channels []string
+}
+
+// Discord bridge connected at startup, or nil when it is disabled
+var discordBridge *discordAdapter
+
+// discordChannel is a Discord channel mirrored with a room
+type discordChannel struct {
+	id      string
+	room    Room
+	ws      Workspace
+	webhook *discordgo.Webhook // nil when the bot can't manage webhooks
+}
+
+// discordAdapter mirrors Discord channels and rooms in both directions
+type discordAdapter struct {
+	session *discordgo.Session
+
+	byChannel map[string]*discordChannel
+	byRoom    map[int]*discordChannel
+	out       chan Message
+
+	mu        sync.Mutex
+	pipelines map[string]MessageHandler // By Discord user ID, so rate limits apply per user
+}
+
+// newDiscordBridge connects the bot and pairs up the configured channels
+// and rooms, creating missing rooms
+func newDiscordBridge(cfg DiscordConfig) (*discordAdapter, error) {
+	if cfg.BotToken == "" {
+		return nil, nil
+	}
+	session, err := discordgo.New("Bot " + cfg.BotToken)
+	if err != nil {
+		return nil, err
+	}
+	session.Identify.Intents = discordgo.IntentsGuildMessages | discordgo.IntentsMessageContent
+	// Handle messages one at a time, in the order they were sent
+	session.SyncEvents = true
+
+	b := &discordAdapter{
+		session:   session,
+		byChannel: make(map[string]*discordChannel),
+		byRoom:    make(map[int]*discordChannel),
+		out:       make(chan Message, discordQueueSize),
+		pipelines: make(map[string]MessageHandler),
+	}
+	for _, pair := range cfg.Channels {
+		ch, err := b.pair(pair)
+		if err != nil {
+			return nil, fmt.Errorf("channel %q: %w", pair, err)
+		}
+		b.byChannel[ch.id] = ch
+		b.byRoom[ch.room.ID] = ch
+	}
+
+	session.AddHandler(b.handleMessage)
+	if err := session.Open(); err != nil {
+		return nil, err
+	}
+	for _, ch := range b.byChannel {
+		ch.webhook = b.findWebhook(ch.id)
+	}
+	go b.post()
+	log.Printf("Discord bridge mirroring %d channels", len(b.byChannel))
+	return b, nil
+}
+
+// pair parses a "<channel ID>=[<workspace>/]<room>" pair
+func (b *discordAdapter) pair(pair string) (*discordChannel, error) {
+	channelID, target, ok := strings.Cut(pair, "=")
+	if !ok || channelID == "" {
+		return nil, errors.New("expected <channel ID>=<room>")
+	}
+	slug, name, ok := strings.Cut(target, "/")
+	if !ok {
+		slug, name = defaultWorkspaceSlug, target
+	}
+	if !roomNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("invalid room name %q", name)
+	}
+
+	ctx, cancel := storeContext()
+	defer cancel()
+	ws, ok := findWorkspaceBySlug(ctx, slug)
+	if !ok {
+		return nil, fmt.Errorf("workspace %q not found", slug)
+	}
+	room, err := store.FindRoom(ctx, ws.ID, name)
+	if errors.Is(err, errNotFound) {
+		room, err = store.CreateRoom(ctx, Room{WorkspaceID: ws.ID, Name: name, CreatedAt: time.Now().UTC()})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &discordChannel{id: channelID, room: room, ws: ws}, nil
+}
+
+// findWebhook returns the bridge's webhook in a channel, creating it if
+// needed, or nil when the bot isn't allowed to
+func (b *discordAdapter) findWebhook(channelID string) *discordgo.Webhook {
+	hooks, err := b.session.ChannelWebhooks(channelID)
+	if err == nil {
+		for _, hook := range hooks {
+			if hook.Name == discordWebhookName && hook.Token != "" {
+				return hook
+			}
+		}
+		var hook *discordgo.Webhook
+		if hook, err = b.session.WebhookCreate(channelID, discordWebhookName, ""); err == nil {
+			return hook
+		}
+	}
+	log.Printf("Discord: no webhook in channel %s, posting as the bot: %v", channelID, err)
+	return nil
+}
+
+// handleMessage posts messages from mirrored channels to their rooms
+func (b *discordAdapter) handleMessage(s *discordgo.Session, m *discordgo.MessageCreate) {
+	ch, ok := b.byChannel[m.ChannelID]
+	if !ok || m.Author == nil || m.Author.ID == s.State.User.ID {
+		return
+	}
+	if ch.webhook != nil && m.WebhookID == ch.webhook.ID {
+		// Our own post of a chat message
+		return
+	}
+
+	// Attachments are also linked in the content, for clients that only
+	// show text
+	content := m.ContentWithMentionsReplaced()
+	var attachments []Attachment
+	for _, a := range m.Attachments {
+		content = strings.TrimSpace(content + "\n" + a.URL)
+		contentType := a.ContentType
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		attachments = append(attachments, Attachment{Name: a.Filename, URL: a.URL, ContentType: contentType})
+	}
+
+	b.mu.Lock()
+	pipeline, ok := b.pipelines[m.Author.ID]
+	if !ok {
+		pipeline = newMessagePipeline()
+		b.pipelines[m.Author.ID] = pipeline
+	}
+	b.mu.Unlock()
+
+	err := pipeline(&MessageContext{
+		Request: bridgeRequest(ch.ws, "discord:"+m.Author.ID),
+		Room:    ch.room,
+		Message: Message{
+			Username:    discordAuthorName(m.Message) + " (Discord)",
+			Content:     content,
+			Attachments: attachments,
+			Room:        ch.room.Name,
+			RoomID:      ch.room.ID,
+			CreatedAt:   time.Now().UTC(),
+			Origin:      originDiscord,
+		},
+	})
+	var rejection *MessageRejection
+	if errors.As(err, &rejection) {
+		s.ChannelMessageSendReply(m.ChannelID, "Not posted to #"+ch.room.Name+": "+rejection.Reason, m.Reference())
+	} else if err != nil {
+		log.Printf("Message pipeline error from Discord user %s: %v", m.Author.ID, err)
+	}
+}
+
+// discordAuthorName is the name the author goes by in the server
+func discordAuthorName(m *discordgo.Message) string {
+	if m.Member != nil && m.Member.Nick != "" {
+		return m.Member.Nick
+	}
+	if m.Author.GlobalName != "" {
+		return m.Author.GlobalName
+	}
+	return m.Author.Username
+}
+
+// deliver queues a broadcast chat message for the room's channel
+func (b *discordAdapter) deliver(msg Message) {
+	if _, ok := b.byRoom[msg.RoomID]; !ok || msg.Origin == originDiscord {
+		return
+	}
+	select {
+	case b.out <- msg:
+	default:
+		log.Printf("Discord: queue is full, dropping a message in #%s", msg.Room)
+	}
+}
+
+// post mirrors queued messages one at a time, keeping them in order
+func (b *discordAdapter) post() {
+	// Chat users can't ping anyone on Discord
+	noMentions := &discordgo.MessageAllowedMentions{Parse: []discordgo.AllowedMentionType{}}
+
+	for msg := range b.out {
+		ch := b.byRoom[msg.RoomID]
+		var err error
+		if ch.webhook != nil {
+			_, err = b.session.WebhookExecute(ch.webhook.ID, ch.webhook.Token, false, &discordgo.WebhookParams{
+				Content:         msg.Content,
+				Username:        msg.Username,
+				AllowedMentions: noMentions,
+			})
+		} else {
+			_, err = b.session.ChannelMessageSendComplex(ch.id, &discordgo.MessageSend{
+				Content:         fmt.Sprintf("**%s**: %s", discordMarkdown.Replace(msg.Username), msg.Content),
+				AllowedMentions: noMentions,
+			})
+		}
+		if err != nil {
+			log.Printf("Discord: posting to channel %s failed: %v", ch.id, err)
+		}
+	}
+}
+
+// Close disconnects the bot
+func (b *discordAdapter) Close() {
+	b.session.Close()
+}
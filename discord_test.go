@@ -0,0 +1,198 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// discordRequest is a call the bridge made to the Discord API
+type discordRequest struct {
+	method string
+	path   string // After the API version, e.g. /channels/1/messages
+	body   map[string]any
+}
+
+// fakeDiscordAPI records the bridge's API calls and answers them all
+// with an empty object
+type fakeDiscordAPI chan discordRequest
+
+func (api fakeDiscordAPI) RoundTrip(r *http.Request) (*http.Response, error) {
+	req := discordRequest{method: r.Method, path: strings.TrimPrefix(r.URL.Path, "/api/v"+discordgo.APIVersion)}
+	if r.Body != nil {
+		json.NewDecoder(r.Body).Decode(&req.body)
+	}
+	api <- req
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       io.NopCloser(strings.NewReader("{}")),
+		Request:    r,
+	}, nil
+}
+
+// next returns the bridge's next API call
+func (api fakeDiscordAPI) next(t *testing.T) discordRequest {
+	t.Helper()
+	select {
+	case req := <-api:
+		return req
+	case <-time.After(5 * time.Second):
+		t.Fatal("no Discord API call")
+		return discordRequest{}
+	}
+}
+
+func TestDiscordPair(t *testing.T) {
+	ctx := context.Background()
+	useMemoryStore(t)
+	if err := ensureDefaultWorkspace(ctx); err != nil {
+		t.Fatal(err)
+	}
+	acme, err := store.CreateWorkspace(ctx, Workspace{Slug: "acme", Name: "Acme"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		pair string
+		ws   int // Workspace of the room, 0 when the pair is refused
+		room string
+	}{
+		{"123=general", 1, "general"},
+		{"456=acme/ops", acme.ID, "ops"},
+		{"=general", 0, ""},
+		{"123", 0, ""},
+		{"123=no spaces", 0, ""},
+		{"123=other/ops", 0, ""},
+	}
+	b := &discordAdapter{}
+	for _, tt := range tests {
+		t.Run(tt.pair, func(t *testing.T) {
+			ch, err := b.pair(tt.pair)
+			if tt.ws == 0 {
+				if err == nil {
+					t.Errorf("paired with %+v", ch.room)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Missing rooms are created
+			room, err := store.FindRoom(ctx, tt.ws, tt.room)
+			if err != nil || ch.room.ID != room.ID || ch.ws.ID != tt.ws {
+				t.Errorf("paired with %+v in %+v, stored %+v, %v", ch.room, ch.ws, room, err)
+			}
+		})
+	}
+}
+
+func TestDiscordBridge(t *testing.T) {
+	ctx := context.Background()
+	useMemoryStore(t)
+	posted := capturePosts(t)
+	if err := ensureDefaultWorkspace(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.CreateWorkspace(ctx, Workspace{Slug: "acme", Name: "Acme"}); err != nil {
+		t.Fatal(err)
+	}
+
+	session, err := discordgo.New("Bot token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := make(fakeDiscordAPI, 10)
+	session.Client = &http.Client{Transport: api}
+	session.State.User = &discordgo.User{ID: "bot"}
+	b := &discordAdapter{
+		session:   session,
+		byChannel: make(map[string]*discordChannel),
+		byRoom:    make(map[int]*discordChannel),
+		out:       make(chan Message, discordQueueSize),
+		pipelines: make(map[string]MessageHandler),
+	}
+	for _, pair := range []string{"c1=general", "c2=acme/ops"} {
+		ch, err := b.pair(pair)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.byChannel[ch.id] = ch
+		b.byRoom[ch.room.ID] = ch
+	}
+	// The bot may only manage webhooks in c1
+	b.byChannel["c1"].webhook = &discordgo.Webhook{ID: "w1", Token: "secret"}
+	general, ops := b.byChannel["c1"].room, b.byChannel["c2"].room
+
+	ann := &discordgo.User{ID: "u1", Username: "ann", GlobalName: "Ann"}
+	receive := func(m discordgo.Message) {
+		b.handleMessage(session, &discordgo.MessageCreate{Message: &m})
+	}
+	receive(discordgo.Message{
+		ChannelID:   "c1",
+		Content:     "see the log",
+		Author:      ann,
+		Member:      &discordgo.Member{Nick: "annie"},
+		Attachments: []*discordgo.MessageAttachment{{Filename: "app.log", URL: "https://cdn.example.com/app.log"}},
+	})
+	// The bot's own messages, its webhook posts and other channels
+	receive(discordgo.Message{ChannelID: "c1", Content: "echo", Author: &discordgo.User{ID: "bot"}})
+	receive(discordgo.Message{ChannelID: "c1", Content: "echo", Author: &discordgo.User{ID: "w1"}, WebhookID: "w1"})
+	receive(discordgo.Message{ChannelID: "c9", Content: "elsewhere", Author: ann})
+	receive(discordgo.Message{ChannelID: "c2", Content: "no nickname here", Author: ann})
+
+	msgs := posted()
+	if len(msgs) != 2 {
+		t.Fatalf("posted %+v", msgs)
+	}
+	if m := msgs[0]; m.Username != "annie (Discord)" || m.Content != "see the log\nhttps://cdn.example.com/app.log" ||
+		m.RoomID != general.ID || m.Origin != originDiscord || len(m.Attachments) != 1 || m.Attachments[0].ContentType != "application/octet-stream" {
+		t.Errorf("posted %+v", m)
+	}
+	if m := msgs[1]; m.Username != "Ann (Discord)" || m.RoomID != ops.ID {
+		t.Errorf("posted %+v", m)
+	}
+
+	// Rejected messages are answered in the channel
+	receive(discordgo.Message{ID: "m9", ChannelID: "c1", Content: " ", Author: ann})
+	if req := api.next(t); req.path != "/channels/c1/messages" || !strings.HasPrefix(fmt.Sprint(req.body["content"]), "Not posted to #general: ") {
+		t.Errorf("reply %+v", req)
+	}
+
+	// Chat messages go out through the webhook under the sender's name,
+	// or from the bot with the name in front
+	done := make(chan struct{})
+	go func() {
+		b.post()
+		close(done)
+	}()
+	b.deliver(Message{Username: "bob_1", Content: "hello @everyone", RoomID: general.ID})
+	b.deliver(Message{Username: "bob_1", Content: "hi", RoomID: ops.ID})
+	b.deliver(Message{Username: "ann", Content: "from Discord", RoomID: general.ID, Origin: originDiscord})
+	b.deliver(Message{Username: "bob_1", Content: "not bridged", RoomID: general.ID + ops.ID})
+	close(b.out)
+	<-done
+
+	req := api.next(t)
+	mentions, _ := req.body["allowed_mentions"].(map[string]any)
+	if parse, ok := mentions["parse"].([]any); !ok || len(parse) != 0 {
+		t.Errorf("allowed mentions %v", mentions)
+	}
+	if req.path != "/webhooks/w1/secret" || req.body["username"] != "bob_1" || req.body["content"] != "hello @everyone" {
+		t.Errorf("webhook post %+v", req)
+	}
+	if req := api.next(t); req.path != "/channels/c2/messages" || req.body["content"] != `**bob\_1**: hi` {
+		t.Errorf("bot post %+v", req)
+	}
+	if len(api) != 0 {
+		t.Errorf("%d more posts", len(api))
+	}
+}
@@ -0,0 +1,366 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// InboundEmailConfig holds the settings of the email gateway. It accepts
+// mail for Domain, where each room has an address: #general of the
+// default workspace is general@Domain, and #ops of the acme workspace is
+// acme.ops@Domain. Mail is posted as the user whose verified address it
+// comes from, so the listener belongs behind an MX that checks SPF and
+// DKIM rather than on the open internet.
+type InboundEmailConfig struct {
+	Addr     string // host:port to accept SMTP on; empty disables the gateway
+	Domain   string // Domain of the room addresses, e.g. rooms.example.com
+	MaxBytes int64  // Largest email accepted, attachments included
+}
+
+// Email gateway listening at startup, or nil when it is disabled
+var emailGateway *emailAdapter
+
+// emailAdapter posts inbound email to rooms
+type emailAdapter struct {
+	cfg    InboundEmailConfig
+	server *smtp.Server
+
+	mu        sync.Mutex
+	pipelines map[int]MessageHandler // By user ID, so rate limits apply per user
+}
+
+// inboundEmail is the part of an email that's posted to a room
+type inboundEmail struct {
+	Subject     string
+	Body        string
+	Attachments []emailAttachment
+}
+
+// emailAttachment is a file attached to an inbound email
+type emailAttachment struct {
+	Name        string
+	ContentType string
+	Data        []byte
+}
+
+// newEmailGateway starts accepting mail for the room addresses
+func newEmailGateway(cfg InboundEmailConfig) (*emailAdapter, error) {
+	if cfg.Addr == "" {
+		return nil, nil
+	}
+	if cfg.Domain == "" {
+		return nil, errors.New("a domain for the room addresses is required")
+	}
+	g := &emailAdapter{cfg: cfg, pipelines: make(map[int]MessageHandler)}
+	g.server = smtp.NewServer(smtp.BackendFunc(func(c *smtp.Conn) (smtp.Session, error) {
+		return &emailSession{gateway: g, remote: c.Conn().RemoteAddr().String()}, nil
+	}))
+	g.server.Domain = cfg.Domain
+	g.server.MaxMessageBytes = cfg.MaxBytes
+	g.server.MaxRecipients = 10
+	g.server.ReadTimeout = time.Minute
+	g.server.WriteTimeout = time.Minute
+
+	l, err := net.Listen("tcp", cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		if err := g.server.Serve(l); err != nil && !errors.Is(err, smtp.ErrServerClosed) {
+			log.Printf("Email gateway error: %v", err)
+		}
+	}()
+	log.Printf("Email gateway accepting mail for @%s on %s", cfg.Domain, l.Addr())
+	return g, nil
+}
+
+// roomFromAddress finds the room an address belongs to
+func (g *emailAdapter) roomFromAddress(addr string) (Workspace, Room, error) {
+	local, domain, ok := strings.Cut(addr, "@")
+	if !ok || !strings.EqualFold(domain, g.cfg.Domain) {
+		return Workspace{}, Room{}, errNotFound
+	}
+
+	slug, name, ok := strings.Cut(local, ".")
+	if !ok {
+		slug, name = defaultWorkspaceSlug, local
+	}
+	ctx, cancel := storeContext()
+	defer cancel()
+	ws, ok := findWorkspaceBySlug(ctx, strings.ToLower(slug))
+	if !ok {
+		return Workspace{}, Room{}, errNotFound
+	}
+	room, err := findOrCreateRoom(bridgeRequest(ws, "email"), ws, name)
+	return ws, room, err
+}
+
+// content is the chat message an email from sender to a room of ws is
+// posted as, with links to its attachments
+func (g *emailAdapter) content(email inboundEmail, sender User, ws Workspace) (string, []Attachment, error) {
+	content := strings.TrimSpace(email.Subject + "\n\n" + email.Body)
+	var attachments []Attachment
+	for _, a := range email.Attachments {
+		ctx, cancel := storeContext()
+		link, err := saveAttachment(ctx, attachmentUpload{
+			Name:        a.Name,
+			ContentType: a.ContentType,
+			Data:        bytes.NewReader(a.Data),
+			Uploader:    sender,
+			Workspace:   ws,
+		})
+		cancel()
+		if err != nil {
+			return "", nil, err
+		}
+		if link == "" {
+			content = strings.TrimSpace(content + "\n[attachment: " + a.Name + "]")
+		} else {
+			content = strings.TrimSpace(content + "\n" + link)
+		}
+		attachments = append(attachments, Attachment{Name: a.Name, URL: link, ContentType: a.ContentType})
+	}
+	return content, attachments, nil
+}
+
+// post sends an email through the message pipeline of its sender
+func (g *emailAdapter) post(user User, ws Workspace, room Room, content string, attachments []Attachment) error {
+	g.mu.Lock()
+	pipeline, ok := g.pipelines[user.ID]
+	if !ok {
+		pipeline = newMessagePipeline()
+		g.pipelines[user.ID] = pipeline
+	}
+	g.mu.Unlock()
+
+	r := bridgeRequest(ws, "email:"+user.Email)
+	r = r.WithContext(context.WithValue(r.Context(), userContextKey{}, user))
+	return pipeline(&MessageContext{
+		Request:  r,
+		User:     user,
+		LoggedIn: true,
+		Room:     room,
+		Message: Message{
+			Username:    user.Username,
+			Content:     content,
+			Attachments: slices.Clone(attachments),
+			Room:        room.Name,
+			RoomID:      room.ID,
+			UserID:      user.ID,
+			CreatedAt:   time.Now().UTC(),
+		},
+	})
+}
+
+// Close stops accepting mail
+func (g *emailAdapter) Close() {
+	g.server.Close()
+}
+
+// emailSession is one SMTP conversation
+type emailSession struct {
+	gateway *emailAdapter
+	remote  string
+
+	sender User
+	rooms  []emailRecipient
+}
+
+// emailRecipient is a room an email is addressed to
+type emailRecipient struct {
+	ws   Workspace
+	room Room
+}
+
+// smtpRejection answers the sending server with a permanent failure,
+// which bounces the email back to its sender with reason
+func smtpRejection(reason string) *smtp.SMTPError {
+	return &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: reason}
+}
+
+func (s *emailSession) Mail(from string, opts *smtp.MailOptions) error {
+	ctx, cancel := storeContext()
+	defer cancel()
+	user, ok := findUserByEmail(ctx, from)
+	if !ok || !user.EmailVerified || user.Banned {
+		return smtpRejection("Only the verified addresses of chat users can post to rooms")
+	}
+	s.sender = user
+	return nil
+}
+
+func (s *emailSession) Rcpt(to string, opts *smtp.RcptOptions) error {
+	ws, room, err := s.gateway.roomFromAddress(to)
+	if errors.Is(err, errNotFound) {
+		return &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "No such room"}
+	}
+	if err != nil {
+		return err
+	}
+	ctx, cancel := storeContext()
+	defer cancel()
+	if !isWorkspaceMember(ctx, ws, s.sender.ID) {
+		return smtpRejection("Not a member of this workspace")
+	}
+	s.rooms = append(s.rooms, emailRecipient{ws: ws, room: room})
+	return nil
+}
+
+func (s *emailSession) Data(r io.Reader) error {
+	email, err := parseInboundEmail(r)
+	if err != nil {
+		return &smtp.SMTPError{Code: 554, EnhancedCode: smtp.EnhancedCode{5, 6, 0}, Message: err.Error()}
+	}
+	if len(s.rooms) == 0 {
+		return nil
+	}
+	// The first room's workspace hears about rejected attachments
+	content, attachments, err := s.gateway.content(email, s.sender, s.rooms[0].ws)
+	var rejected *AttachmentRejected
+	if errors.As(err, &rejected) {
+		return smtpRejection("Attachment " + rejected.Error())
+	}
+	var overQuota *StorageQuotaExceeded
+	if errors.As(err, &overQuota) {
+		return smtpRejection("Attachment " + overQuota.Error())
+	}
+	if err != nil {
+		return err
+	}
+	for _, rcpt := range s.rooms {
+		err := s.gateway.post(s.sender, rcpt.ws, rcpt.room, content, attachments)
+		var rejection *MessageRejection
+		if errors.As(err, &rejection) && rejection.Code == rejectHeld {
+			// Posted once a moderator approves it, so it doesn't bounce
+			continue
+		}
+		if errors.As(err, &rejection) {
+			return smtpRejection("Not posted to #" + rcpt.room.Name + ": " + rejection.Reason)
+		}
+		if err != nil {
+			log.Printf("Message pipeline error from email by %s: %v", s.remote, err)
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *emailSession) Reset() {
+	s.sender = User{}
+	s.rooms = nil
+}
+
+func (s *emailSession) Logout() error {
+	return nil
+}
+
+// parseInboundEmail reads the subject, plain text body and attachments of
+// an email
+func parseInboundEmail(r io.Reader) (inboundEmail, error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return inboundEmail{}, err
+	}
+
+	var email inboundEmail
+	dec := new(mime.WordDecoder)
+	if email.Subject, err = dec.DecodeHeader(msg.Header.Get("Subject")); err != nil {
+		email.Subject = msg.Header.Get("Subject")
+	}
+	err = email.readPart(msg.Header.Get("Content-Type"), msg.Header.Get("Content-Transfer-Encoding"), "", msg.Body)
+	if err != nil {
+		return inboundEmail{}, err
+	}
+	email.Body = trimEmailBody(email.Body)
+	if email.Subject == "" && email.Body == "" && len(email.Attachments) == 0 {
+		return inboundEmail{}, errors.New("the email is empty")
+	}
+	return email, nil
+}
+
+// readPart walks a MIME part, keeping the first plain text body and the
+// attachments
+func (e *inboundEmail) readPart(contentType, encoding, disposition string, body io.Reader) error {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType, params = "text/plain", nil
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			p, err := mr.NextRawPart()
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			err = e.readPart(p.Header.Get("Content-Type"), p.Header.Get("Content-Transfer-Encoding"), p.Header.Get("Content-Disposition"), p)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return fmt.Errorf("unreadable %s part: %w", mediaType, err)
+	}
+
+	_, dispParams, _ := mime.ParseMediaType(disposition)
+	name := dispParams["filename"]
+	if name == "" {
+		name = params["name"]
+	}
+	if name == "" && mediaType == "text/plain" && !strings.HasPrefix(disposition, "attachment") {
+		if e.Body == "" {
+			e.Body = string(data)
+		}
+		return nil
+	}
+	if name == "" {
+		// Alternative HTML bodies and inline parts without a name
+		return nil
+	}
+	e.Attachments = append(e.Attachments, emailAttachment{Name: attachmentName(name), ContentType: mediaType, Data: data})
+	return nil
+}
+
+// trimEmailBody drops the signature and the quoted message of a reply
+func trimEmailBody(body string) string {
+	var lines []string
+	for _, line := range strings.Split(strings.ReplaceAll(body, "\r\n", "\n"), "\n") {
+		// The signature separator is "-- ", though quoted-printable
+		// decoding drops its trailing space
+		if strings.TrimRight(line, " ") == "--" {
+			break
+		}
+		if !strings.HasPrefix(line, ">") {
+			lines = append(lines, line)
+		}
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
@@ -0,0 +1,187 @@
+package chat
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// Default email templates. Each email has a <name>.txt template and
+// optionally a <name>.html one, both defining a "subject" template; the
+// HTML ones fill the "content" block of layout.html.
+//
+//go:embed templates/email
+var defaultEmailTemplates embed.FS
+
+// EmailConfig selects the email templates and the server's branding
+type EmailConfig struct {
+	// Directory whose templates replace the defaults of the same name
+	TemplatesDir string
+	// Branding used unless a workspace sets its own
+	Branding WorkspaceBranding
+}
+
+// EmailData is what email templates can use
+type EmailData struct {
+	User      User
+	Workspace Workspace // Empty for emails about the account
+	Brand     WorkspaceBranding
+	Link      string // Where the email sends the user
+	ExpiresIn string // How long Link works, when it expires
+	Inviter   string // Who added the user, for invitations
+}
+
+// emailTemplate is one email, parsed
+type emailTemplate struct {
+	text *template.Template
+	html *htmltemplate.Template // Nil for plain text only emails
+}
+
+// Names of the emails the server sends
+const (
+	emailVerifyAddress       = "verify_email"
+	emailPasswordReset       = "password_reset"
+	emailWorkspaceInvitation = "workspace_invitation"
+)
+
+var emailNames = []string{emailVerifyAddress, emailPasswordReset, emailWorkspaceInvitation}
+
+var (
+	emailTemplates = make(map[string]emailTemplate)
+	emailConfig    EmailConfig
+
+	brandColorPattern = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+)
+
+// setupEmailTemplates parses the email templates, preferring the files in
+// the override directory, so a broken override stops the server at
+// startup rather than when the email is due
+func setupEmailTemplates(cfg EmailConfig) error {
+	defaults, err := fs.Sub(defaultEmailTemplates, "templates/email")
+	if err != nil {
+		return err
+	}
+	files := defaults
+	if cfg.TemplatesDir != "" {
+		files = overlayFS{os.DirFS(cfg.TemplatesDir), defaults}
+	}
+
+	templates := make(map[string]emailTemplate)
+	for _, name := range emailNames {
+		text, err := template.ParseFS(files, name+".txt")
+		if err != nil {
+			return fmt.Errorf("email template %s: %w", name, err)
+		}
+		t := emailTemplate{text: text}
+		if _, err := fs.Stat(files, name+".html"); err == nil {
+			t.html, err = htmltemplate.ParseFS(files, "layout.html", name+".html")
+			if err != nil {
+				return fmt.Errorf("email template %s: %w", name, err)
+			}
+		}
+		templates[name] = t
+	}
+
+	emailTemplates = templates
+	emailConfig = cfg
+	return nil
+}
+
+// overlayFS reads files from the first file system that has them
+type overlayFS []fs.FS
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	var err error
+	for _, fsys := range o {
+		var f fs.File
+		if f, err = fsys.Open(name); err == nil {
+			return f, nil
+		}
+	}
+	return nil, err
+}
+
+// brandingFor is a workspace's branding on top of the server's
+func brandingFor(ws Workspace) WorkspaceBranding {
+	brand, custom := emailConfig.Branding, ws.Settings.Branding
+	if custom.Name != "" {
+		brand.Name = custom.Name
+	}
+	if custom.LogoURL != "" {
+		brand.LogoURL = custom.LogoURL
+	}
+	if custom.Color != "" {
+		brand.Color = custom.Color
+	}
+	if custom.SupportEmail != "" {
+		brand.SupportEmail = custom.SupportEmail
+	}
+	if custom.WelcomeBanner != "" {
+		brand.WelcomeBanner = custom.WelcomeBanner
+	}
+	return brand
+}
+
+// renderEmail fills in an email's templates
+func renderEmail(name string, data EmailData) (Notification, error) {
+	t, ok := emailTemplates[name]
+	if !ok {
+		return Notification{}, fmt.Errorf("no email template %s", name)
+	}
+	data.Brand = brandingFor(data.Workspace)
+
+	var subject, body, html bytes.Buffer
+	if err := t.text.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return Notification{}, err
+	}
+	if err := t.text.Execute(&body, data); err != nil {
+		return Notification{}, err
+	}
+	n := Notification{
+		Subject: strings.TrimSpace(subject.String()),
+		Body:    body.String(),
+		ReplyTo: data.Brand.SupportEmail,
+	}
+	if t.html != nil {
+		if err := t.html.ExecuteTemplate(&html, "layout.html", data); err != nil {
+			return Notification{}, err
+		}
+		n.HTML = html.String()
+	}
+	return n, nil
+}
+
+// sendEmail renders an email and sends it to data.User in the background
+func sendEmail(name string, data EmailData) {
+	n, err := renderEmail(name, data)
+	if err != nil {
+		log.Printf("Rendering the %s email failed: %v", name, err)
+		return
+	}
+	notifyAsync(emailNotifier, data.User, n)
+}
+
+// validBranding checks the branding a workspace owner sets
+func validBranding(b WorkspaceBranding) error {
+	if b.Color != "" && !brandColorPattern.MatchString(b.Color) {
+		return errors.New("branding color must look like #4f46e5")
+	}
+	if b.LogoURL != "" && !strings.HasPrefix(b.LogoURL, "https://") {
+		return errors.New("branding logo URL must start with https://")
+	}
+	if b.SupportEmail != "" && !strings.Contains(b.SupportEmail, "@") {
+		return errors.New("branding support email is not an email address")
+	}
+	if len([]rune(b.WelcomeBanner)) > maxWelcomeBanner {
+		return fmt.Errorf("welcome banner can't be longer than %d characters", maxWelcomeBanner)
+	}
+	return nil
+}
@@ -0,0 +1,266 @@
+package chat
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EventLogConfig keeps every domain event in the store so integrations
+// that were down can replay what they missed from GET /events
+type EventLogConfig struct {
+	Enabled   bool
+	Retention time.Duration // How long events are kept; 0 keeps them forever
+}
+
+const (
+	// Events listed per page of GET /events, by default and at most
+	eventLogDefaultLimit = 100
+	eventLogMaxLimit     = 1000
+	// Events written per batch, and the longest one waits to be written
+	eventLogBatchSize     = 100
+	eventLogFlushInterval = time.Second
+	// How often events past the retention are removed
+	eventLogPruneInterval = time.Hour
+)
+
+// LoggedEvent is an event as the event log keeps it. IDs only grow, so
+// integrations resume after the last one they saw.
+type LoggedEvent struct {
+	ID          int64           `json:"id"`
+	EventID     string          `json:"eventId"` // Event.ID, shared with the event bridge and subscriptions
+	Type        string          `json:"type"`
+	Time        time.Time       `json:"time"`
+	WorkspaceID int             `json:"-"`
+	Data        json.RawMessage `json:"data"`
+}
+
+// EventLogPage is a page of GET /events
+type EventLogPage struct {
+	Events []LoggedEvent `json:"events"`
+	// ID to pass as ?after= next time: the last event's, or after's when
+	// there were none
+	Next int64 `json:"next"`
+	// More events are waiting; ask again right away with Next
+	HasMore bool `json:"hasMore"`
+	// Events after the given ID were already removed past the retention,
+	// so some were missed
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// eventLogWriter appends events to the store in the background, in
+// batches, so publishing an event never waits on the database
+type eventLogWriter struct {
+	repo  EventLogRepository
+	queue chan LoggedEvent
+	flush chan chan struct{}
+	done  chan struct{}
+
+	// Guards queue against sends after Close
+	mu     sync.RWMutex
+	closed bool
+}
+
+var (
+	eventLogConfig EventLogConfig
+	// Active event log writer, or nil when the log is off
+	eventLog *eventLogWriter
+)
+
+// setupEventLog starts writing events to the store if the log is enabled
+func setupEventLog(repo EventLogRepository, cfg EventLogConfig) {
+	eventLogConfig = cfg
+	if !cfg.Enabled {
+		eventLog = nil
+		return
+	}
+	eventLog = &eventLogWriter{
+		repo:  repo,
+		queue: make(chan LoggedEvent, eventBusSize),
+		flush: make(chan chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go eventLog.run()
+}
+
+// logEvent queues an event for the log. Unlike the bus, it waits rather
+// than drop events when the store falls behind, so replays are complete.
+func logEvent(e Event) {
+	w := eventLog
+	if w == nil {
+		return
+	}
+	data, err := json.Marshal(e.Data)
+	if err != nil {
+		log.Printf("Event %s not logged: %v", e.Type, err)
+		return
+	}
+
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.closed {
+		log.Printf("Event log closed, dropping a %s event", e.Type)
+		return
+	}
+	w.queue <- LoggedEvent{EventID: e.ID, Type: e.Type, Time: e.Time, WorkspaceID: e.WorkspaceID, Data: data}
+}
+
+// Flush writes everything queued so far and returns once it is saved
+func (w *eventLogWriter) Flush() {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.closed {
+		return
+	}
+	written := make(chan struct{})
+	w.flush <- written
+	<-written
+}
+
+// Close stops accepting events and waits until everything queued has been
+// written
+func (w *eventLogWriter) Close() {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	w.mu.Unlock()
+	<-w.done
+}
+
+func (w *eventLogWriter) run() {
+	defer close(w.done)
+	ticker := time.NewTicker(eventLogFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]LoggedEvent, 0, eventLogBatchSize)
+	for {
+		select {
+		case e, ok := <-w.queue:
+			if !ok {
+				w.write(batch)
+				return
+			}
+			batch = append(batch, e)
+			if len(batch) >= eventLogBatchSize {
+				w.write(batch)
+				batch = batch[:0]
+			}
+		case written := <-w.flush:
+			for len(w.queue) > 0 {
+				batch = append(batch, <-w.queue)
+			}
+			w.write(batch)
+			batch = batch[:0]
+			close(written)
+		case <-ticker.C:
+			w.write(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+func (w *eventLogWriter) write(batch []LoggedEvent) {
+	if len(batch) == 0 {
+		return
+	}
+	ctx, cancel := storeContext()
+	defer cancel()
+	if err := w.repo.AppendEvents(ctx, batch); err != nil {
+		log.Printf("Failed to log %d events: %v", len(batch), err)
+	}
+}
+
+// runEventLogPruning removes the events past the retention every
+// eventLogPruneInterval
+func runEventLogPruning() {
+	for now := range time.Tick(eventLogPruneInterval) {
+		if eventLog == nil || eventLogConfig.Retention <= 0 {
+			continue
+		}
+		// Nodes pruning side by side would delete the same events
+		if cluster != nil && !cluster.leader() {
+			continue
+		}
+		ctx, cancel := storeContext()
+		n, err := store.DeleteEventsBefore(ctx, now.Add(-eventLogConfig.Retention).UTC())
+		cancel()
+		if err != nil {
+			log.Printf("Pruning the event log failed: %v", err)
+		} else if n > 0 {
+			log.Printf("Removed %d events older than %s from the event log", n, eventLogConfig.Retention)
+		}
+	}
+}
+
+// Replay the workspace's events after an ID, oldest first; moderators only
+// (GET /events?after=). ?types= takes a comma-separated list of event
+// types to return, and ?limit= caps the events per page (default 100, at
+// most 1000).
+func getEvents(w http.ResponseWriter, r *http.Request) {
+	if eventLog == nil {
+		http.Error(w, "The event log is off", http.StatusNotFound)
+		return
+	}
+	query := r.URL.Query()
+	var after int64
+	if a := query.Get("after"); a != "" {
+		n, err := strconv.ParseInt(a, 10, 64)
+		if err != nil || n < 0 {
+			http.Error(w, "after must be an event ID", http.StatusBadRequest)
+			return
+		}
+		after = n
+	}
+	limit := eventLogDefaultLimit
+	if l := query.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 {
+			http.Error(w, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, eventLogMaxLimit)
+	}
+	var types []string
+	if t := query.Get("types"); t != "" {
+		for _, typ := range strings.Split(t, ",") {
+			typ = strings.TrimSpace(typ)
+			if !slices.Contains(eventTypes, typ) {
+				http.Error(w, "Unknown event type: "+typ, http.StatusBadRequest)
+				return
+			}
+			types = append(types, typ)
+		}
+	}
+
+	// Events published on this node so far are in the store once this
+	// returns; other nodes write theirs within a second
+	eventLog.Flush()
+	ctx := r.Context()
+	// One more than asked tells whether there are more
+	events, err := store.ListEvents(ctx, requestWorkspace(r).ID, after, types, limit+1)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	oldest, err := store.OldestEventID(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	page := EventLogPage{Events: events, Next: after, Truncated: after > 0 && oldest > after+1}
+	if len(events) > limit {
+		page.Events, page.HasMore = events[:limit], true
+	}
+	if n := len(page.Events); n > 0 {
+		page.Next = page.Events[n-1].ID
+	}
+	json.NewEncoder(w).Encode(page)
+}
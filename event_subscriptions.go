@@ -0,0 +1,361 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Actions an event subscription can take
+const (
+	actionWebhook = "webhook"
+	actionEmail   = "email"
+	actionChat    = "chat"
+)
+
+// EventSubscription runs an action for the events of a workspace that
+// match its filters, e.g. announcing completed tasks in #ops. Messages
+// posted by the system never match, so a chat action can't set off
+// another.
+//
+// Webhook actions get a POST of a SubscriptionDelivery, signed like room
+// webhook deliveries with the subscription's secret.
+type EventSubscription struct {
+	ID int `json:"id"`
+	// EventTypes the subscription matches; empty matches every type
+	EventTypes []string `json:"eventTypes"`
+	// Filters are fields of the event data that must have the given
+	// value, compared as text ignoring case, e.g. {"status": "completed"}
+	Filters   map[string]string `json:"filters,omitempty"`
+	Action    EventAction       `json:"action"`
+	CreatedBy string            `json:"createdBy"`
+	CreatedAt time.Time         `json:"createdAt"`
+
+	WorkspaceID int    `json:"-"`
+	UserID      int    `json:"-"` // Creator, who receives email actions
+	RoomID      int    `json:"-"` // Room of chat actions
+	Secret      string `json:"-"`
+
+	template *template.Template
+}
+
+// EventAction is what a subscription does with a matching event
+type EventAction struct {
+	Type string `json:"type"`           // "webhook", "email" or "chat"
+	URL  string `json:"url,omitempty"`  // Webhook actions
+	Room string `json:"room,omitempty"` // Chat actions
+	// Template is the text of email and chat actions, a Go template over
+	// the event, e.g. "{{.Data.title}} is done". It defaults to the event
+	// type and data.
+	Template string `json:"template,omitempty"`
+}
+
+// NewEventSubscription is the request body for adding a subscription
+type NewEventSubscription struct {
+	EventTypes []string          `json:"eventTypes"`
+	Filters    map[string]string `json:"filters"`
+	Action     EventAction       `json:"action"`
+}
+
+// CreatedEventSubscription is returned once, when a subscription is added
+type CreatedEventSubscription struct {
+	EventSubscription
+	Secret string `json:"secret,omitempty"` // Webhook actions only
+}
+
+// SubscriptionDelivery is the body of a webhook action, and what action
+// templates are executed on
+type SubscriptionDelivery struct {
+	ID   string         `json:"id"`
+	Type string         `json:"type"`
+	Time time.Time      `json:"time"`
+	Data map[string]any `json:"data"`
+}
+
+const defaultActionTemplate = "{{.Type}}: {{json .Data}}"
+
+var (
+	// Every workspace's subscriptions, loaded from the store
+	eventSubscriptions   []EventSubscription
+	eventSubscriptionsMu sync.Mutex
+
+	actionTemplateFuncs = template.FuncMap{
+		"json": func(v any) string {
+			b, _ := json.Marshal(v)
+			return string(b)
+		},
+	}
+)
+
+// loadEventSubscriptions replaces the subscriptions in memory with the
+// stored ones
+func loadEventSubscriptions(ctx context.Context) error {
+	list, err := store.ListEventSubscriptions(ctx)
+	if err != nil {
+		return err
+	}
+	loaded := make([]EventSubscription, 0, len(list))
+	for _, sub := range list {
+		if err := compileEventSubscription(&sub); err != nil {
+			log.Printf("Subscription %d: %v", sub.ID, err)
+			continue
+		}
+		loaded = append(loaded, sub)
+	}
+
+	eventSubscriptionsMu.Lock()
+	defer eventSubscriptionsMu.Unlock()
+	eventSubscriptions = loaded
+	return nil
+}
+
+// compileEventSubscription parses the template of a subscription's action
+func compileEventSubscription(sub *EventSubscription) error {
+	text := sub.Action.Template
+	if text == "" {
+		text = defaultActionTemplate
+	}
+	tmpl, err := template.New("action").Funcs(actionTemplateFuncs).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return fmt.Errorf("Invalid template: %w", err)
+	}
+	sub.template = tmpl
+	return nil
+}
+
+// runEventSubscriptions runs the actions of the subscriptions an event
+// matches
+func runEventSubscriptions(e Event) {
+	if msg, ok := e.Data.(Message); ok && msg.Username == systemUsername {
+		return
+	}
+
+	eventSubscriptionsMu.Lock()
+	var matched []EventSubscription
+	for _, sub := range eventSubscriptions {
+		if sub.WorkspaceID == e.WorkspaceID && (len(sub.EventTypes) == 0 || slices.Contains(sub.EventTypes, e.Type)) {
+			matched = append(matched, sub)
+		}
+	}
+	eventSubscriptionsMu.Unlock()
+	if len(matched) == 0 {
+		return
+	}
+
+	// Filters and templates see the data as its JSON fields
+	delivery := SubscriptionDelivery{ID: e.ID, Type: e.Type, Time: e.Time}
+	b, err := json.Marshal(e.Data)
+	if err == nil {
+		err = json.Unmarshal(b, &delivery.Data)
+	}
+	if err != nil {
+		log.Printf("Event %s: %v", e.ID, err)
+		return
+	}
+
+	for _, sub := range matched {
+		if sub.matches(delivery.Data) {
+			go sub.run(delivery)
+		}
+	}
+}
+
+// matches reports whether the event data passes every filter
+func (sub EventSubscription) matches(data map[string]any) bool {
+	for field, want := range sub.Filters {
+		v, ok := data[field]
+		if !ok || !strings.EqualFold(fmt.Sprint(v), want) {
+			return false
+		}
+	}
+	return true
+}
+
+// run takes the subscription's action. Failures are logged and dropped.
+func (sub EventSubscription) run(d SubscriptionDelivery) {
+	if sub.Action.Type == actionWebhook {
+		sub.deliverWebhook(d)
+		return
+	}
+
+	var text strings.Builder
+	if err := sub.template.Execute(&text, d); err != nil {
+		log.Printf("Subscription %d: %v", sub.ID, err)
+		return
+	}
+	switch sub.Action.Type {
+	case actionEmail:
+		ctx, cancel := storeContext()
+		defer cancel()
+		user, ok := findUserByID(ctx, sub.UserID)
+		if !ok {
+			return
+		}
+		notifyAsync(emailNotifier, user, Notification{Subject: "Chat event: " + d.Type, Body: text.String()})
+	case actionChat:
+		room := Room{ID: sub.RoomID, WorkspaceID: sub.WorkspaceID, Name: sub.Action.Room}
+		if err := chatService.Announce(context.Background(), room, text.String()); err != nil {
+			log.Printf("Subscription %d: %v", sub.ID, err)
+		}
+	}
+}
+
+// deliverWebhook posts an event to the subscription's URL
+func (sub EventSubscription) deliverWebhook(d SubscriptionDelivery) {
+	header := http.Header{
+		"X-Chat-Subscription-ID": {strconv.Itoa(sub.ID)},
+		"X-Chat-Event":           {d.Type},
+	}
+	ctx, cancel := withTimeout(context.Background(), timeouts.Webhook)
+	defer cancel()
+	if err := postSignedJSON(ctx, sub.Action.URL, sub.Secret, header, d); err != nil {
+		log.Printf("Subscription %d delivery failed: %v", sub.ID, err)
+	}
+}
+
+/////////////////////////////////////
+// Event Subscription API Handlers //
+/////////////////////////////////////
+
+// List the event subscriptions of the workspace; moderators only
+// (GET /subscriptions)
+func listEventSubscriptions(w http.ResponseWriter, r *http.Request) {
+	ws := requestWorkspace(r)
+
+	eventSubscriptionsMu.Lock()
+	defer eventSubscriptionsMu.Unlock()
+
+	list := []EventSubscription{}
+	for _, sub := range eventSubscriptions {
+		if sub.WorkspaceID == ws.ID {
+			list = append(list, sub)
+		}
+	}
+	json.NewEncoder(w).Encode(list)
+}
+
+// Subscribe an action to the workspace's events; moderators only
+// (POST /subscriptions)
+func createEventSubscription(w http.ResponseWriter, r *http.Request) {
+	user, _ := currentUser(r)
+	ws := requestWorkspace(r)
+
+	var req NewEventSubscription
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, typ := range req.EventTypes {
+		if !slices.Contains(eventTypes, typ) {
+			http.Error(w, fmt.Sprintf("Unknown event type %q, expected one of %s", typ, strings.Join(eventTypes, ", ")), http.StatusBadRequest)
+			return
+		}
+	}
+
+	sub := EventSubscription{
+		EventTypes:  req.EventTypes,
+		Filters:     req.Filters,
+		Action:      req.Action,
+		CreatedBy:   user.Username,
+		CreatedAt:   time.Now().UTC(),
+		WorkspaceID: ws.ID,
+		UserID:      user.ID,
+	}
+	if sub.EventTypes == nil {
+		sub.EventTypes = []string{}
+	}
+
+	switch req.Action.Type {
+	case actionWebhook:
+		u, err := checkWebhookURL(r.Context(), req.Action.URL)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sub.Action = EventAction{Type: actionWebhook, URL: u.String()}
+		if sub.Secret, err = randomToken(32); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	case actionEmail:
+		if user.Email == "" {
+			http.Error(w, "Add an email address to your account first", http.StatusBadRequest)
+			return
+		}
+		sub.Action = EventAction{Type: actionEmail, Template: req.Action.Template}
+	case actionChat:
+		room, err := store.FindRoom(r.Context(), ws.ID, req.Action.Room)
+		if err != nil {
+			http.Error(w, "Room not found", http.StatusBadRequest)
+			return
+		}
+		sub.Action = EventAction{Type: actionChat, Room: room.Name, Template: req.Action.Template}
+		sub.RoomID = room.ID
+	default:
+		http.Error(w, `Action type must be "webhook", "email" or "chat"`, http.StatusBadRequest)
+		return
+	}
+
+	if err := compileEventSubscription(&sub); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if sub, err = store.CreateEventSubscription(r.Context(), sub); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	registryChanged(registryEventSubscriptions)
+
+	recordAudit(r, "subscription.create", ws.Slug, fmt.Sprintf("%s for %v", sub.Action.Type, sub.EventTypes))
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(CreatedEventSubscription{EventSubscription: sub, Secret: sub.Secret})
+}
+
+// Remove an event subscription; moderators only (DELETE /subscriptions/{id})
+func deleteEventSubscription(w http.ResponseWriter, r *http.Request) {
+	ws := requestWorkspace(r)
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid subscription ID", http.StatusBadRequest)
+		return
+	}
+
+	eventSubscriptionsMu.Lock()
+	i := slices.IndexFunc(eventSubscriptions, func(sub EventSubscription) bool {
+		return sub.ID == id && sub.WorkspaceID == ws.ID
+	})
+	var sub EventSubscription
+	if i >= 0 {
+		sub = eventSubscriptions[i]
+	}
+	eventSubscriptionsMu.Unlock()
+
+	if i < 0 {
+		http.Error(w, "Subscription not found", http.StatusNotFound)
+		return
+	}
+	if err := store.DeleteEventSubscription(r.Context(), id); errors.Is(err, errNotFound) {
+		http.Error(w, "Subscription not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	registryChanged(registryEventSubscriptions)
+	recordAudit(r, "subscription.delete", ws.Slug, fmt.Sprintf("%s for %v", sub.Action.Type, sub.EventTypes))
+	w.WriteHeader(http.StatusNoContent)
+}
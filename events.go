@@ -0,0 +1,163 @@
+package chat
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Types of the domain events published on the event bus
+const (
+	eventMessageCreated = "message_created"
+	eventRoomCreated    = "room_created"
+	eventTaskCreated    = "task_created"
+	eventTaskUpdated    = "task_updated"
+	eventTaskCompleted  = "task_completed"
+	eventTaskDeleted    = "task_deleted"
+	eventTaskMerged     = "task_merged"
+	eventTaskOverdue    = "task_overdue"
+	eventUserJoined     = "user_joined"
+)
+
+var eventTypes = []string{
+	eventMessageCreated, eventRoomCreated, eventTaskCreated, eventTaskUpdated,
+	eventTaskCompleted, eventTaskDeleted, eventTaskMerged, eventTaskOverdue, eventUserJoined,
+}
+
+// Events waiting for the bus's handlers. When they can't keep up, further
+// events are dropped.
+const eventBusSize = 4096
+
+// Event is something that happened in the application, published for
+// automations inside the chat and systems outside it to consume
+type Event struct {
+	ID          string
+	Type        string
+	Time        time.Time
+	Key         string // Events with the same key stay in order, e.g. a room's messages
+	WorkspaceID int
+	Data        any
+}
+
+// UserJoinedEvent is the data of a user_joined event: someone connected
+// to a chat room
+type UserJoinedEvent struct {
+	Username string `json:"username,omitempty"` // Empty for guests
+	Room     string `json:"room"`
+}
+
+// TaskUpdatedEvent is the data of a task_updated event
+type TaskUpdatedEvent struct {
+	Task
+	PreviousStatus string   `json:"previousStatus"`
+	PreviousTags   []string `json:"previousTags,omitempty"`
+	UpdatedBy      string   `json:"updatedBy,omitempty"` // Empty when not logged in
+}
+
+// TaskCompletedEvent is the data of a task_completed event
+type TaskCompletedEvent struct {
+	Task
+	CompletedBy string `json:"completedBy,omitempty"` // Empty when not logged in
+}
+
+// TaskDeletedEvent is the data of a task_deleted event
+type TaskDeletedEvent struct {
+	ID int `json:"id"`
+}
+
+// TaskMergedEvent is the data of a task_merged event: another task was
+// merged into Task
+type TaskMergedEvent struct {
+	Task
+	MergedID int    `json:"mergedId"`
+	MergedBy string `json:"mergedBy,omitempty"` // Empty when not logged in
+}
+
+// EventPublisher sends events to an external system. Publish must not
+// block on the network.
+type EventPublisher interface {
+	Publish(e Event) error
+	Close() error
+}
+
+var (
+	// Event bridge selected in the config at startup, or nil when events
+	// aren't published
+	eventPublisher EventPublisher
+
+	// The event bus, which hands every event to the handlers in turn
+	eventBus        = make(chan Event, eventBusSize)
+	eventHandlers   []func(Event)
+	eventHandlersMu sync.Mutex
+)
+
+// newEventPublisher creates the event bridge configured in cfg
+func newEventPublisher(cfg Config) (EventPublisher, error) {
+	if len(cfg.Kafka.Brokers) == 0 {
+		return nil, nil
+	}
+	switch cfg.Kafka.Schema {
+	case eventSchemaJSON, eventSchemaCloudEvents:
+	default:
+		return nil, fmt.Errorf("unknown event schema %q", cfg.Kafka.Schema)
+	}
+	return newKafkaPublisher(cfg.Kafka, publicURL), nil
+}
+
+// setupEventBus registers the built-in event handlers
+func setupEventBus() {
+	eventHandlersMu.Lock()
+	eventHandlers = nil
+	eventHandlersMu.Unlock()
+
+	subscribeEvents(runEventSubscriptions)
+	subscribeEvents(runAutomations)
+}
+
+// subscribeEvents adds a handler for every event published on the bus.
+// Handlers run one at a time on the bus, so they must not block.
+func subscribeEvents(handler func(Event)) {
+	eventHandlersMu.Lock()
+	defer eventHandlersMu.Unlock()
+	eventHandlers = append(eventHandlers, handler)
+}
+
+// publishEvent puts an event that happened in a workspace on the bus, and
+// hands it to the event bridge if there is one
+func publishEvent(workspaceID int, typ, key string, data any) {
+	id, err := randomToken(16)
+	if err != nil {
+		log.Printf("Event %s not published: %v", typ, err)
+		return
+	}
+	e := Event{ID: id, Type: typ, Time: time.Now().UTC(), Key: key, WorkspaceID: workspaceID, Data: data}
+	// The sync journal and the event log must not miss events when the
+	// bus is full
+	recordSyncChange(e)
+	logEvent(e)
+
+	select {
+	case eventBus <- e:
+	default:
+		log.Printf("Event bus is full, dropping a %s event", typ)
+	}
+	if eventPublisher == nil {
+		return
+	}
+	if err := eventPublisher.Publish(e); err != nil {
+		log.Printf("Event %s not published: %v", typ, err)
+	}
+}
+
+// runEventBus hands published events to the handlers
+func runEventBus() {
+	for e := range eventBus {
+		eventHandlersMu.Lock()
+		handlers := eventHandlers
+		eventHandlersMu.Unlock()
+		for _, handle := range handlers {
+			handle(e)
+		}
+	}
+}
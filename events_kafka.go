@@ -0,0 +1,153 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Encodings of published events
+const (
+	// {"id", "type", "time", "data"}
+	eventSchemaJSON = "json"
+	// CloudEvents 1.0 in structured JSON mode, with types like
+	// "chat.message_created"
+	eventSchemaCloudEvents = "cloudevents"
+)
+
+// KafkaConfig holds the Kafka event bridge settings. Events of each type
+// go to the topic TopicPrefix + type, e.g. "chat.message_created".
+type KafkaConfig struct {
+	Brokers     []string // host:port of the bootstrap brokers; none disables the bridge
+	TopicPrefix string
+	Schema      string // "json" or "cloudevents"
+}
+
+// Events waiting to be written to Kafka. When the brokers can't keep up,
+// further events are dropped.
+const kafkaQueueSize = 4096
+
+var (
+	errEventQueueFull = errors.New("event queue is full")
+	errEventsClosed   = errors.New("event bridge is closed")
+)
+
+// kafkaPublisher writes events to Kafka in the background
+type kafkaPublisher struct {
+	writer *kafka.Writer
+	prefix string
+	schema string
+	source string // CloudEvents source, the server's public URL
+
+	mu     sync.Mutex // Guards closed and sending on queue
+	closed bool
+	queue  chan kafka.Message
+	done   chan struct{} // Closed once the queue is written out
+}
+
+func newKafkaPublisher(cfg KafkaConfig, source string) *kafkaPublisher {
+	writer := &kafka.Writer{
+		Addr:                   kafka.TCP(cfg.Brokers...),
+		Balancer:               &kafka.Hash{},
+		BatchTimeout:           100 * time.Millisecond,
+		AllowAutoTopicCreation: true,
+	}
+	p := &kafkaPublisher{
+		writer: writer,
+		prefix: cfg.TopicPrefix,
+		schema: cfg.Schema,
+		source: source,
+		queue:  make(chan kafka.Message, kafkaQueueSize),
+		done:   make(chan struct{}),
+	}
+	go p.run()
+	log.Printf("Publishing events to Kafka at %v", cfg.Brokers)
+	return p
+}
+
+// Publish queues an event, so slow brokers never hold up the request or
+// broadcast that caused it
+func (p *kafkaPublisher) Publish(e Event) error {
+	value, err := json.Marshal(p.encode(e))
+	if err != nil {
+		return err
+	}
+	msg := kafka.Message{
+		Topic: p.prefix + e.Type,
+		Key:   []byte(e.Key),
+		Value: value,
+		Time:  e.Time,
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return errEventsClosed
+	}
+	select {
+	case p.queue <- msg:
+		return nil
+	default:
+		return errEventQueueFull
+	}
+}
+
+// run writes queued events until the queue is closed
+func (p *kafkaPublisher) run() {
+	defer close(p.done)
+	for msg := range p.queue {
+		// Take whatever else is waiting along in the same write
+		batch := []kafka.Message{msg}
+	more:
+		for len(batch) < kafkaQueueSize {
+			select {
+			case msg, ok := <-p.queue:
+				if !ok {
+					break more
+				}
+				batch = append(batch, msg)
+			default:
+				break more
+			}
+		}
+		if err := p.writer.WriteMessages(context.Background(), batch...); err != nil {
+			log.Printf("Kafka: %d events lost: %v", len(batch), err)
+		}
+	}
+}
+
+// encode shapes an event according to the schema
+func (p *kafkaPublisher) encode(e Event) any {
+	if p.schema == eventSchemaCloudEvents {
+		return struct {
+			SpecVersion     string    `json:"specversion"`
+			ID              string    `json:"id"`
+			Source          string    `json:"source"`
+			Type            string    `json:"type"`
+			Time            time.Time `json:"time"`
+			DataContentType string    `json:"datacontenttype"`
+			Data            any       `json:"data"`
+		}{"1.0", e.ID, p.source, "chat." + e.Type, e.Time, "application/json", e.Data}
+	}
+	return struct {
+		ID   string    `json:"id"`
+		Type string    `json:"type"`
+		Time time.Time `json:"time"`
+		Data any       `json:"data"`
+	}{e.ID, e.Type, e.Time, e.Data}
+}
+
+// Close writes out the events still queued
+func (p *kafkaPublisher) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	close(p.queue)
+	p.mu.Unlock()
+
+	<-p.done
+	return p.writer.Close()
+}
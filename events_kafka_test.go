@@ -0,0 +1,82 @@
+package chat
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func TestKafkaPublish(t *testing.T) {
+	at := time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)
+	e := Event{ID: "e1", Type: eventTaskDeleted, Time: at, Key: "acme/7", WorkspaceID: 1, Data: TaskDeletedEvent{ID: 7}}
+
+	tests := []struct {
+		schema string
+		want   string
+	}{
+		{eventSchemaJSON, `{"id":"e1","type":"task_deleted","time":"2026-03-01T09:00:00Z","data":{"id":7}}`},
+		{eventSchemaCloudEvents, `{"specversion":"1.0","id":"e1","source":"https://chat.example.com","type":"chat.task_deleted",` +
+			`"time":"2026-03-01T09:00:00Z","datacontenttype":"application/json","data":{"id":7}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.schema, func(t *testing.T) {
+			// Not running, so the queue can be read here
+			p := &kafkaPublisher{prefix: "chat.", schema: tt.schema, source: "https://chat.example.com", queue: make(chan kafka.Message, 1)}
+			if err := p.Publish(e); err != nil {
+				t.Fatal(err)
+			}
+			msg := <-p.queue
+			if msg.Topic != "chat.task_deleted" || string(msg.Key) != "acme/7" || !msg.Time.Equal(at) {
+				t.Errorf("message %s %s %v", msg.Topic, msg.Key, msg.Time)
+			}
+			if string(msg.Value) != tt.want {
+				t.Errorf("value %s, want %s", msg.Value, tt.want)
+			}
+		})
+	}
+}
+
+func TestKafkaBackpressure(t *testing.T) {
+	p := &kafkaPublisher{schema: eventSchemaJSON, queue: make(chan kafka.Message, 1)}
+	e := Event{ID: "e1", Type: eventMessageCreated, Data: Message{Content: "hi"}}
+
+	// A slow broker costs events rather than holding up the sender
+	if err := p.Publish(e); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Publish(e); !errors.Is(err, errEventQueueFull) {
+		t.Errorf("publishing to a full queue: %v", err)
+	}
+
+	// Events published while shutting down are refused, not sent on the
+	// closed queue
+	p.mu.Lock()
+	p.closed = true
+	close(p.queue)
+	p.mu.Unlock()
+	if err := p.Publish(e); !errors.Is(err, errEventsClosed) {
+		t.Errorf("publishing after close: %v", err)
+	}
+}
+
+func TestNewEventPublisher(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     KafkaConfig
+		enabled bool
+		err     bool
+	}{
+		{"no brokers", KafkaConfig{Schema: eventSchemaJSON}, false, false},
+		{"unknown schema", KafkaConfig{Brokers: []string{"localhost:9092"}, Schema: "avro"}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := newEventPublisher(Config{Kafka: tt.cfg})
+			if (p != nil) != tt.enabled || (err != nil) != tt.err {
+				t.Errorf("publisher %v, error %v", p, err)
+			}
+		})
+	}
+}
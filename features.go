@@ -0,0 +1,338 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// Feature flags that handlers consult at runtime
+const (
+	featureGuestAccess       = "guest_access"
+	featureRegistration      = "registration"
+	featureAPITokens         = "api_tokens"
+	featureWorkspaceCreation = "workspace_creation"
+
+	featureGamification             = "gamification"
+	featureAchievementAnnouncements = "achievement_announcements"
+)
+
+// featureInfo describes a known flag and its value when nothing is configured
+type featureInfo struct {
+	Description string
+	Default     bool
+}
+
+var knownFeatures = map[string]featureInfo{
+	featureGuestAccess:       {"Visitors who aren't logged in can read rooms and tasks and chat under a name of their own", false},
+	featureRegistration:      {"New users can sign up with a password", true},
+	featureAPITokens:         {"Users can mint and use personal API tokens", true},
+	featureWorkspaceCreation: {"Users can create workspaces", true},
+
+	featureGamification:             {"Track message streaks and task completions, and rank users on room leaderboards", false},
+	featureAchievementAnnouncements: {"Announce achievements users unlock in the room (needs gamification)", false},
+}
+
+// FeatureFlag is the state of one flag as shown to admins
+type FeatureFlag struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Enabled     bool            `json:"enabled"`              // Deployment-wide value
+	Workspaces  map[string]bool `json:"workspaces,omitempty"` // Overrides by workspace slug
+}
+
+// FeatureToggle is the request body for changing a flag
+type FeatureToggle struct {
+	Enabled bool `json:"enabled"`
+}
+
+// FeatureOverrides are the flag values admins set at runtime. They are
+// saved in the store and win over the config, so they outlive restarts
+// and config reloads and reach every node.
+type FeatureOverrides struct {
+	Features   map[string]bool         `json:"features,omitempty"`   // Deployment-wide
+	Workspaces map[int]map[string]bool `json:"workspaces,omitempty"` // By workspace ID
+}
+
+// Key of the feature overrides in the store
+const featureOverridesKey = "features"
+
+var (
+	// Deployment-wide flag values, seeded from the config at startup
+	features = make(map[string]bool)
+	// Deployment-wide values set by admins, which win over the config
+	featureOverrides = make(map[string]bool)
+	// Per-workspace overrides, keyed by workspace ID and flag name
+	workspaceFeatures = make(map[int]map[string]bool)
+	featuresMu        sync.Mutex
+)
+
+// setFeatureDefaults seeds the deployment-wide flags from the config,
+// falling back to each flag's default
+func setFeatureDefaults(configured map[string]bool) error {
+	featuresMu.Lock()
+	defer featuresMu.Unlock()
+
+	for name, info := range knownFeatures {
+		features[name] = info.Default
+	}
+	for name, enabled := range configured {
+		if _, ok := knownFeatures[name]; !ok {
+			return fmt.Errorf("unknown feature flag %q", name)
+		}
+		features[name] = enabled
+	}
+	return nil
+}
+
+// featureEnabled reports whether a flag is on for the request's workspace.
+// A workspace override wins over the deployment-wide value.
+func featureEnabled(r *http.Request, name string) bool {
+	ws := requestWorkspace(r)
+
+	featuresMu.Lock()
+	defer featuresMu.Unlock()
+
+	if enabled, ok := workspaceFeatures[ws.ID][name]; ok {
+		return enabled
+	}
+	return deploymentFeatureLocked(name)
+}
+
+// deploymentFeatureLocked returns the deployment-wide value of a flag.
+// featuresMu must be held.
+func deploymentFeatureLocked(name string) bool {
+	if enabled, ok := featureOverrides[name]; ok {
+		return enabled
+	}
+	return features[name]
+}
+
+// loadFeatureOverrides applies the overrides saved in the store. It runs at
+// startup, before requests come in.
+func loadFeatureOverrides(ctx context.Context) error {
+	saved, err := store.GetServerState(ctx, featureOverridesKey)
+	if errors.Is(err, errNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var overrides FeatureOverrides
+	if err := json.Unmarshal([]byte(saved), &overrides); err != nil {
+		return fmt.Errorf("saved feature overrides: %w", err)
+	}
+	setFeatureOverrides(overrides)
+	return nil
+}
+
+// setFeatureOverrides replaces the overrides on this node
+func setFeatureOverrides(overrides FeatureOverrides) {
+	featuresMu.Lock()
+	defer featuresMu.Unlock()
+
+	featureOverrides = make(map[string]bool)
+	maps.Copy(featureOverrides, overrides.Features)
+	workspaceFeatures = make(map[int]map[string]bool)
+	for wsID, flags := range overrides.Workspaces {
+		workspaceFeatures[wsID] = maps.Clone(flags)
+	}
+}
+
+// changeFeatureOverrides applies fn to the overrides saved in the store,
+// saves them and has every node use them
+func changeFeatureOverrides(ctx context.Context, fn func(o *FeatureOverrides)) error {
+	var overrides FeatureOverrides
+	saved, err := store.GetServerState(ctx, featureOverridesKey)
+	if err == nil {
+		err = json.Unmarshal([]byte(saved), &overrides)
+	}
+	if err != nil && !errors.Is(err, errNotFound) {
+		return err
+	}
+	if overrides.Features == nil {
+		overrides.Features = make(map[string]bool)
+	}
+	if overrides.Workspaces == nil {
+		overrides.Workspaces = make(map[int]map[string]bool)
+	}
+	fn(&overrides)
+
+	b, err := json.Marshal(overrides)
+	if err != nil {
+		return err
+	}
+	if err := store.SetServerState(ctx, featureOverridesKey, string(b)); err != nil {
+		return err
+	}
+	setFeatureOverrides(overrides)
+	if cluster != nil {
+		cluster.broadcast(clusterEnvelope{From: cluster.id, Kind: envelopeFeatures, Features: &overrides})
+	}
+	return nil
+}
+
+// writeFeatureDisabled responds with 403 for a switched-off capability
+func writeFeatureDisabled(w http.ResponseWriter, what string) {
+	http.Error(w, what+" is disabled", http.StatusForbidden)
+}
+
+///////////////////////////////
+// Feature Flag API Handlers //
+///////////////////////////////
+
+// List the effective flags for the current workspace (GET /features)
+func getFeatures(w http.ResponseWriter, r *http.Request) {
+	flags := make(map[string]bool)
+	for name := range knownFeatures {
+		flags[name] = featureEnabled(r, name)
+	}
+	json.NewEncoder(w).Encode(flags)
+}
+
+// List every flag with its overrides (GET /admin/features)
+func getFeatureFlags(w http.ResponseWriter, r *http.Request) {
+	all, err := store.ListWorkspaces(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	slugs := make(map[int]string)
+	for _, ws := range all {
+		slugs[ws.ID] = ws.Slug
+	}
+
+	featuresMu.Lock()
+	defer featuresMu.Unlock()
+
+	list := []FeatureFlag{}
+	for name, info := range knownFeatures {
+		flag := FeatureFlag{Name: name, Description: info.Description, Enabled: deploymentFeatureLocked(name)}
+		for wsID, overrides := range workspaceFeatures {
+			if enabled, ok := overrides[name]; ok {
+				if flag.Workspaces == nil {
+					flag.Workspaces = make(map[string]bool)
+				}
+				flag.Workspaces[slugs[wsID]] = enabled
+			}
+		}
+		list = append(list, flag)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	json.NewEncoder(w).Encode(list)
+}
+
+// Turn a flag on or off for the deployment (PUT /admin/features/{name})
+func setFeatureFlag(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if _, ok := knownFeatures[name]; !ok {
+		http.Error(w, "Unknown feature flag", http.StatusNotFound)
+		return
+	}
+
+	var req FeatureToggle
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = changeFeatureOverrides(r.Context(), func(o *FeatureOverrides) {
+		o.Features[name] = req.Enabled
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(r, "feature.set", name, "enabled="+strconv.FormatBool(req.Enabled))
+	json.NewEncoder(w).Encode(req)
+}
+
+// Override a flag for one workspace
+// (PUT /admin/features/{name}/workspaces/{slug})
+func setWorkspaceFeatureFlag(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if _, ok := knownFeatures[name]; !ok {
+		http.Error(w, "Unknown feature flag", http.StatusNotFound)
+		return
+	}
+	ws, ok := workspaceFromVars(w, r)
+	if !ok {
+		return
+	}
+
+	var req FeatureToggle
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = changeFeatureOverrides(r.Context(), func(o *FeatureOverrides) {
+		if o.Workspaces[ws.ID] == nil {
+			o.Workspaces[ws.ID] = make(map[string]bool)
+		}
+		o.Workspaces[ws.ID][name] = req.Enabled
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(r, "feature.set", name, "workspace="+ws.Slug+" enabled="+strconv.FormatBool(req.Enabled))
+	json.NewEncoder(w).Encode(req)
+}
+
+// Remove a workspace's override so it follows the deployment again
+// (DELETE /admin/features/{name}/workspaces/{slug})
+func clearWorkspaceFeatureFlag(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	ws, ok := workspaceFromVars(w, r)
+	if !ok {
+		return
+	}
+
+	err := changeFeatureOverrides(r.Context(), func(o *FeatureOverrides) {
+		delete(o.Workspaces[ws.ID], name)
+		if len(o.Workspaces[ws.ID]) == 0 {
+			delete(o.Workspaces, ws.ID)
+		}
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(r, "feature.clear", name, "workspace="+ws.Slug)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parseFeatureList parses "name=true,other=false" as used by CHAT_FEATURES.
+// A bare name means enabled.
+func parseFeatureList(items []string) (map[string]bool, error) {
+	flags := make(map[string]bool)
+	for _, item := range items {
+		name, value, hasValue := strings.Cut(item, "=")
+		enabled := true
+		if hasValue {
+			var err error
+			enabled, err = strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("feature flag %s: %w", name, err)
+			}
+		}
+		flags[strings.TrimSpace(name)] = enabled
+	}
+	return flags, nil
+}
@@ -0,0 +1,74 @@
+package chat
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestFeatureOverrides(t *testing.T) {
+	ctx := context.Background()
+	useMemoryStore(t)
+	t.Cleanup(resetState)
+
+	acme, err := store.CreateWorkspace(ctx, Workspace{Slug: "acme", Name: "Acme"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := store.CreateWorkspace(ctx, Workspace{Slug: "other", Name: "Other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	enabled := func(ws Workspace, name string) bool {
+		r := httptest.NewRequest("GET", "/features", nil)
+		return featureEnabled(r.WithContext(context.WithValue(r.Context(), workspaceContextKey{}, ws)), name)
+	}
+	call := func(handler http.HandlerFunc, method string, vars map[string]string, body string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handler(w, mux.SetURLVars(httptest.NewRequest(method, "/admin/features", strings.NewReader(body)), vars))
+		if w.Code >= 300 {
+			t.Fatalf("status %d: %s", w.Code, w.Body)
+		}
+	}
+
+	resetState()
+	setFeatureDefaults(nil)
+	call(setFeatureFlag, "PUT", map[string]string{"name": featureRegistration}, `{"enabled":false}`)
+	call(setWorkspaceFeatureFlag, "PUT", map[string]string{"name": featureGamification, "slug": "acme"}, `{"enabled":true}`)
+	call(setWorkspaceFeatureFlag, "PUT", map[string]string{"name": featureAPITokens, "slug": "acme"}, `{"enabled":false}`)
+	call(clearWorkspaceFeatureFlag, "DELETE", map[string]string{"name": featureAPITokens, "slug": "acme"}, "")
+
+	// A restart, with the flags switched in the config
+	resetState()
+	if err := loadFeatureOverrides(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := setFeatureDefaults(map[string]bool{featureRegistration: true, featureAPITokens: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		ws   Workspace
+		flag string
+		want bool
+	}{
+		{"deployment override", other, featureRegistration, false},
+		{"deployment override in a workspace", acme, featureRegistration, false},
+		{"workspace override", acme, featureGamification, true},
+		{"workspace override elsewhere", other, featureGamification, false},
+		{"cleared override", acme, featureAPITokens, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := enabled(tt.ws, tt.flag); got != tt.want {
+				t.Errorf("%s = %v, want %v", tt.flag, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package chat
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+)
+
+// Broadcasts encode every message once per client, so at high message
+// rates most of the garbage the broadcast path makes is frame buffers.
+// They are taken from a pool and handed back once the frame is written.
+var frameBuffers = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+
+// Buffers that grew past this aren't kept, so one large frame doesn't
+// keep its memory around
+const maxPooledFrameBuffer = 64 << 10
+
+// getFrameBuffer returns an empty buffer from the pool
+func getFrameBuffer() *bytes.Buffer {
+	buf := frameBuffers.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+// putFrameBuffer hands a buffer back to the pool once nothing refers to
+// its contents
+func putFrameBuffer(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooledFrameBuffer {
+		frameBuffers.Put(buf)
+	}
+}
+
+// encodeJSON appends the JSON encoding of v to buf, like json.Marshal
+// but without allocating a result
+func encodeJSON(buf *bytes.Buffer, v any) error {
+	if err := json.NewEncoder(buf).Encode(v); err != nil {
+		return err
+	}
+	// The encoder ends every value with a newline
+	buf.Truncate(buf.Len() - 1)
+	return nil
+}
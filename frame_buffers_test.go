@@ -0,0 +1,102 @@
+package chat
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+// marshalFrame encodes a frame the way the broadcast path did before
+// frame buffers were pooled: a fresh slice from json.Marshal, copied
+// again to put the server's time in front
+func marshalFrame(caps []string, v any, now time.Time) ([]byte, error) {
+	v, _ = tailorFrame(caps, v)
+	b, err := json.Marshal(v)
+	if err != nil || len(b) < 2 || b[0] != '{' {
+		return b, err
+	}
+	stamp := `"serverTime":"` + now.UTC().Format(time.RFC3339Nano) + `"`
+	if bytes.Equal(b, []byte("{}")) {
+		return []byte("{" + stamp + "}"), nil
+	}
+	return append([]byte("{"+stamp+","), b[1:]...), nil
+}
+
+// benchMessage is a typical chat message with an attachment
+var benchMessage = Message{
+	Username:    "alice",
+	Content:     strings.Repeat("Hello everyone, the deploy is done. ", 4),
+	Room:        "general",
+	CreatedAt:   time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC),
+	Attachments: []Attachment{{Name: "report.pdf", URL: "/uploads/abc123", ContentType: "application/pdf"}},
+	Seq:         42,
+	ClientMsgID: "3f2a9c1e7b6d4e0f",
+}
+
+func TestStampFrame(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	for _, v := range []any{benchMessage, struct{}{}, []int{1, 2}, MessageError{Error: "Slow down"}} {
+		want, err := marshalFrame(legacyCapabilities, v, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if _, err := encodeFrame(&buf, legacyCapabilities, v, now); err != nil {
+			t.Fatal(err)
+		}
+		if got := buf.String(); got != string(want) {
+			t.Errorf("encodeFrame(%T) = %s, want %s", v, got, want)
+		}
+	}
+}
+
+// BenchmarkEncodeFrameParallel encodes a message for many clients at
+// once, as a broadcast to a busy room does
+func BenchmarkEncodeFrameParallel(b *testing.B) {
+	now := time.Now()
+	b.Run("Marshal", func(b *testing.B) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				if _, err := marshalFrame(legacyCapabilities, benchMessage, now); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	})
+	b.Run("Pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				buf := getFrameBuffer()
+				_, err := encodeFrame(buf, legacyCapabilities, benchMessage, now)
+				putFrameBuffer(buf)
+				if err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	})
+}
+
+// BenchmarkEncodeBatchFrame encodes a batch of a bursty room's messages
+func BenchmarkEncodeBatchFrame(b *testing.B) {
+	now := time.Now()
+	batch := BatchFrame{Batch: make([]Message, 20)}
+	for i := range batch.Batch {
+		batch.Batch[i] = benchMessage
+	}
+	b.ReportAllocs()
+	for b.Loop() {
+		buf := getFrameBuffer()
+		_, err := encodeFrame(buf, legacyCapabilities, batch, now)
+		putFrameBuffer(buf)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// achievement is a milestone a user reaches once
+type achievement struct {
+	name      string
+	announce  string // Posted to the room, after the username
+	reachedAt func(a *UserActivity) bool
+}
+
+var achievements = []achievement{
+	{"chatty", "sent 100 messages", func(a *UserActivity) bool { return a.Messages >= 100 }},
+	{"talkative", "sent 1000 messages", func(a *UserActivity) bool { return a.Messages >= 1000 }},
+	{"regular", "chatted 7 days in a row", func(a *UserActivity) bool { return a.Streak >= 7 }},
+	{"devoted", "chatted 30 days in a row", func(a *UserActivity) bool { return a.Streak >= 30 }},
+	{"productive", "completed 10 tasks", func(a *UserActivity) bool { return a.TasksCompleted >= 10 }},
+}
+
+// UserActivity is what a user has done while gamification was on, kept in
+// the store so it outlives restarts and adds up across nodes
+type UserActivity struct {
+	UserID         int
+	Username       string
+	Messages       int
+	RoomMessages   map[int]int // By room ID
+	TasksCompleted int
+	Streak         int    // Consecutive days with a message, ending on LastDay
+	BestStreak     int    // Longest streak so far
+	LastDay        string // Last day with a message, as YYYY-MM-DD in UTC
+	Achievements   []string
+}
+
+// LeaderboardEntry is a user's standing in a room
+type LeaderboardEntry struct {
+	Username       string   `json:"username"`
+	Messages       int      `json:"messages"` // In this room
+	TasksCompleted int      `json:"tasksCompleted"`
+	Streak         int      `json:"streak"` // Days in a row with a message, up to today
+	BestStreak     int      `json:"bestStreak"`
+	Achievements   []string `json:"achievements"`
+}
+
+// newAchievements records and returns the achievements a user has just
+// reached
+func newAchievements(a *UserActivity) []achievement {
+	var reached []achievement
+	for _, ach := range achievements {
+		if ach.reachedAt(a) && !slices.Contains(a.Achievements, ach.name) {
+			a.Achievements = append(a.Achievements, ach.name)
+			reached = append(reached, ach)
+		}
+	}
+	return reached
+}
+
+// currentStreak is the streak as of today: it lapses once a day passes
+// without a message
+func (a *UserActivity) currentStreak(now time.Time) int {
+	today := now.UTC().Format(time.DateOnly)
+	yesterday := now.UTC().AddDate(0, 0, -1).Format(time.DateOnly)
+	if a.LastDay == today || a.LastDay == yesterday {
+		return a.Streak
+	}
+	return 0
+}
+
+// recordMessageActivity counts a message towards the author's stats and
+// streak, and returns achievements it unlocked
+func recordMessageActivity(ctx context.Context, user User, roomID int, now time.Time) ([]achievement, error) {
+	var reached []achievement
+	_, err := store.UpdateActivity(ctx, user.ID, func(a *UserActivity) {
+		a.Username = user.Username
+		a.Messages++
+		a.RoomMessages[roomID]++
+
+		today := now.UTC().Format(time.DateOnly)
+		if a.LastDay != today {
+			a.Streak = a.currentStreak(now) + 1
+			a.LastDay = today
+			a.BestStreak = max(a.BestStreak, a.Streak)
+		}
+		reached = newAchievements(a)
+	})
+	return reached, err
+}
+
+// recordTaskCompleted credits a user with completing a task
+func recordTaskCompleted(ctx context.Context, user User) error {
+	_, err := store.UpdateActivity(ctx, user.ID, func(a *UserActivity) {
+		a.Username = user.Username
+		a.TasksCompleted++
+		newAchievements(a)
+	})
+	return err
+}
+
+// trackActivity updates the author's stats once a message has gone out,
+// and announces the achievements it unlocks when announcements are on
+func trackActivity(next MessageHandler) MessageHandler {
+	return func(mc *MessageContext) error {
+		if !mc.LoggedIn || !featureEnabled(mc.Request, featureGamification) {
+			return next(mc)
+		}
+
+		ctx, cancel := storeContext()
+		reached, err := recordMessageActivity(ctx, mc.User, mc.Room.ID, mc.Message.CreatedAt)
+		cancel()
+		if err != nil {
+			// The message is out already; only the stats miss it
+			log.Printf("Recording activity of %s: %v", mc.User.Username, err)
+		}
+		if featureEnabled(mc.Request, featureAchievementAnnouncements) {
+			for _, ach := range reached {
+				queueBroadcast(Message{
+					Username:  systemUsername,
+					Content:   fmt.Sprintf("%s %s!", mc.User.Username, ach.announce),
+					Room:      mc.Room.Name,
+					RoomID:    mc.Room.ID,
+					CreatedAt: time.Now().UTC(),
+				})
+			}
+		}
+		return next(mc)
+	}
+}
+
+//////////////////////////////
+// Leaderboard API Handlers //
+//////////////////////////////
+
+// Rank the room's most active users (GET /rooms/{name}/leaderboard?limit=<n>)
+func getLeaderboard(w http.ResponseWriter, r *http.Request) {
+	if !featureEnabled(r, featureGamification) {
+		writeFeatureDisabled(w, "Gamification")
+		return
+	}
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 || limit > 100 {
+		limit = 10
+	}
+
+	room, ok := roomFromVars(w, r)
+	if !ok {
+		return
+	}
+
+	list, err := store.ListRoomActivity(r.Context(), room.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	entries := []LeaderboardEntry{}
+	for _, a := range list {
+		entries = append(entries, LeaderboardEntry{
+			Username:       a.Username,
+			Messages:       a.RoomMessages[room.ID],
+			TasksCompleted: a.TasksCompleted,
+			Streak:         a.currentStreak(now),
+			BestStreak:     a.BestStreak,
+			Achievements:   append([]string{}, a.Achievements...),
+		})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Messages != entries[j].Messages {
+			return entries[i].Messages > entries[j].Messages
+		}
+		if entries[i].Streak != entries[j].Streak {
+			return entries[i].Streak > entries[j].Streak
+		}
+		return entries[i].Username < entries[j].Username
+	})
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	json.NewEncoder(w).Encode(entries)
+}
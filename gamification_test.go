@@ -0,0 +1,114 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestRecordMessageActivity(t *testing.T) {
+	ctx := context.Background()
+	useMemoryStore(t)
+	alice := User{ID: 1, Username: "alice"}
+	day := time.Date(2026, 10, 10, 12, 0, 0, 0, time.UTC)
+
+	// Each message counts on top of the ones before it
+	tests := []struct {
+		name    string
+		at      time.Time
+		streak  int
+		reached []string
+	}{
+		{"first message", day, 1, nil},
+		{"same day", day.Add(time.Hour), 1, nil},
+		{"next day", day.AddDate(0, 0, 1), 2, nil},
+		{"third day", day.AddDate(0, 0, 2), 3, nil},
+		{"fourth day", day.AddDate(0, 0, 3), 4, nil},
+		{"fifth day", day.AddDate(0, 0, 4), 5, nil},
+		{"sixth day", day.AddDate(0, 0, 5), 6, nil},
+		{"a week in a row", day.AddDate(0, 0, 6), 7, []string{"regular"}},
+		{"after a gap", day.AddDate(0, 0, 9), 1, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reached, err := recordMessageActivity(ctx, alice, 1, tt.at)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, ach := range reached {
+				names = append(names, ach.name)
+			}
+			if fmt.Sprint(names) != fmt.Sprint(tt.reached) {
+				t.Errorf("reached %v, want %v", names, tt.reached)
+			}
+			a, _ := store.UpdateActivity(ctx, alice.ID, func(*UserActivity) {})
+			if a.Streak != tt.streak {
+				t.Errorf("streak %d, want %d", a.Streak, tt.streak)
+			}
+		})
+	}
+}
+
+func TestGetLeaderboard(t *testing.T) {
+	ctx := context.Background()
+	useMemoryStore(t)
+	t.Cleanup(resetState)
+	if err := setFeatureDefaults(map[string]bool{featureGamification: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	ws, err := store.CreateWorkspace(ctx, Workspace{Slug: "acme", Name: "Acme"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	general, err := store.CreateRoom(ctx, Room{WorkspaceID: ws.ID, Name: "general"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for _, post := range []struct {
+		user User
+		room int
+	}{
+		{User{ID: 1, Username: "alice"}, general.ID},
+		{User{ID: 2, Username: "bob"}, general.ID},
+		{User{ID: 2, Username: "bob"}, general.ID},
+		{User{ID: 3, Username: "carol"}, general.ID + 1},
+	} {
+		if _, err := recordMessageActivity(ctx, post.user, post.room, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := recordTaskCompleted(ctx, User{ID: 1, Username: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "/rooms/general/leaderboard", nil)
+	r = r.WithContext(context.WithValue(r.Context(), workspaceContextKey{}, ws))
+	w := httptest.NewRecorder()
+	getLeaderboard(w, mux.SetURLVars(r, map[string]string{"name": "general"}))
+	var entries []LeaderboardEntry
+	if err := json.NewDecoder(w.Body).Decode(&entries); err != nil {
+		t.Fatalf("%v: %s", err, w.Body)
+	}
+
+	want := []LeaderboardEntry{
+		{Username: "bob", Messages: 2, Streak: 1, BestStreak: 1},
+		{Username: "alice", Messages: 1, TasksCompleted: 1, Streak: 1, BestStreak: 1},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("got %+v, want %+v", entries, want)
+	}
+	for i, e := range entries {
+		e.Achievements = nil
+		if fmt.Sprint(e) != fmt.Sprint(want[i]) {
+			t.Errorf("entry %d is %+v, want %+v", i, e, want[i])
+		}
+	}
+}
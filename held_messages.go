@@ -0,0 +1,158 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// HeldMessage is a chat message waiting for a moderator to approve it
+// before anyone else sees it
+type HeldMessage struct {
+	ID          int       `json:"id"`
+	WorkspaceID int       `json:"-"`
+	Message     Message   `json:"message"`
+	Reason      string    `json:"reason"` // Why it was held
+	HeldAt      time.Time `json:"heldAt"`
+}
+
+// Code of messages held for review, which senders hear about like a
+// rejection even though the message may still be posted
+const rejectHeld = "message.held"
+
+// holdReason says why a message must wait for a moderator, or returns ""
+// when it can be posted right away
+func holdReason(mc *MessageContext) (string, error) {
+	policy := latestRoom(mc.Room).Policy
+	if policy.ReviewLinks && linkPattern.MatchString(mc.Message.Content) {
+		return "contains a link", nil
+	}
+	if newPoster, err := isNewPoster(mc); newPoster || err != nil {
+		return "is one of the first from a new account", err
+	}
+	return "", nil
+}
+
+// isNewPoster reports whether the sender's account is new and hasn't
+// posted enough messages yet to skip review. Guests have no account to
+// age, so they are left to the other limits.
+func isNewPoster(mc *MessageContext) (bool, error) {
+	cfg := currentPipelineConfig()
+	if cfg.HoldNewPosters <= 0 || !mc.LoggedIn || time.Since(mc.User.CreatedAt) >= cfg.NewAccountAge {
+		return false, nil
+	}
+	// Held messages only count once they are approved and stored
+	posted, err := store.CountUserMessages(mc.Request.Context(), mc.User.ID)
+	return posted < cfg.HoldNewPosters, err
+}
+
+// holdForReview keeps messages that need a moderator's approval out of
+// the room. Moderators' own messages are never held.
+func holdForReview(next MessageHandler) MessageHandler {
+	return func(mc *MessageContext) error {
+		reason, err := holdReason(mc)
+		if err != nil {
+			return err
+		}
+		if reason == "" {
+			return next(mc)
+		}
+		ctx := mc.Request.Context()
+		if mc.LoggedIn && canManageWorkspace(ctx, requestWorkspace(mc.Request), mc.User) {
+			return next(mc)
+		}
+
+		msg := mc.Message
+		msg.WorkspaceID = mc.Room.WorkspaceID
+		_, err = store.CreateHeldMessage(ctx, HeldMessage{
+			WorkspaceID: mc.Room.WorkspaceID,
+			Message:     msg,
+			Reason:      reason,
+			HeldAt:      time.Now().UTC(),
+		})
+		if err != nil {
+			return err
+		}
+		return rejectMessage(rejectHeld, "Your message %s, so it will appear in #%s once a moderator approves it",
+			reason, mc.Room.Name)
+	}
+}
+
+// releaseHeldMessage posts an approved message the way the pipeline would
+// have: saved, then broadcast
+func releaseHeldMessage(msg Message) {
+	msg.ID = 0
+	msg.CreatedAt = time.Now().UTC()
+	messageQueue.Enqueue(msg)
+	queueBroadcast(msg)
+}
+
+///////////////////////////////
+// Held Message API Handlers //
+///////////////////////////////
+
+// List the messages waiting for approval, oldest first
+// (GET /moderation/held)
+func listHeldMessages(w http.ResponseWriter, r *http.Request) {
+	list, err := store.ListHeldMessages(r.Context(), requestWorkspace(r).ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if list == nil {
+		list = []HeldMessage{}
+	}
+	json.NewEncoder(w).Encode(list)
+}
+
+// Post a held message (POST /moderation/held/{id}/approve)
+func approveHeldMessage(w http.ResponseWriter, r *http.Request) {
+	decideHeldMessage(w, r, true)
+}
+
+// Drop a held message (POST /moderation/held/{id}/reject)
+func rejectHeldMessage(w http.ResponseWriter, r *http.Request) {
+	decideHeldMessage(w, r, false)
+}
+
+func decideHeldMessage(w http.ResponseWriter, r *http.Request, approve bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+		return
+	}
+	ws := requestWorkspace(r)
+	// Taken out of the queue first, so two moderators can't both decide
+	held, err := store.TakeHeldMessage(r.Context(), ws.ID, id)
+	if errors.Is(err, errNotFound) {
+		http.Error(w, "Held message not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	action := "message.reject"
+	if approve {
+		action = "message.approve"
+		releaseHeldMessage(held.Message)
+	}
+	details := fmt.Sprintf("%s (%s): %s", held.Message.Username, held.Reason, truncate(held.Message.Content, 200))
+	recordAudit(r, action, ws.Slug+"/"+held.Message.Room, details)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// truncate shortens s to at most n characters
+func truncate(s string, n int) string {
+	if r := []rune(s); len(r) > n {
+		return strings.TrimSpace(string(r[:n])) + "…"
+	}
+	return s
+}
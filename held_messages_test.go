@@ -0,0 +1,109 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHoldForReview(t *testing.T) {
+	ctx := context.Background()
+	useMemoryStore(t)
+	prevConfig := currentPipelineConfig()
+	t.Cleanup(func() {
+		messagePipelineConfigMu.Lock()
+		messagePipelineConfig = prevConfig
+		messagePipelineConfigMu.Unlock()
+	})
+
+	ws, err := store.CreateWorkspace(ctx, Workspace{Slug: "acme", Name: "Acme"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	room := Room{ID: 1, WorkspaceID: ws.ID, Name: "general"}
+	linksRoom := Room{ID: 2, WorkspaceID: ws.ID, Name: "links", Policy: RoomPolicy{ReviewLinks: true}}
+
+	now := time.Now().UTC()
+	newcomer := User{ID: 1, Username: "alice", CreatedAt: now.Add(-time.Hour)}
+	regular := User{ID: 2, Username: "bob", CreatedAt: now.Add(-30 * 24 * time.Hour)}
+	talker := User{ID: 3, Username: "carol", CreatedAt: now.Add(-time.Hour)}
+	owner := User{ID: 4, Username: "dave", CreatedAt: now.Add(-time.Hour)}
+	admin := User{ID: 5, Username: "erin", Role: roleAdmin, CreatedAt: now.Add(-time.Hour)}
+	if _, err := store.AddMember(ctx, WorkspaceMember{WorkspaceID: ws.ID, UserID: owner.ID, Role: workspaceRoleOwner}); err != nil {
+		t.Fatal(err)
+	}
+	// Enough stored messages for carol to be past the hold
+	if err := store.SaveMessages(ctx, []Message{
+		{UserID: talker.ID, Username: talker.Username, RoomID: room.ID, Content: "one"},
+		{UserID: talker.ID, Username: talker.Username, RoomID: room.ID, Content: "two"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		hold     int // HoldNewPosters
+		user     User
+		loggedIn bool
+		room     Room
+		content  string
+		reason   string // Why it's held, or "" when it's posted
+	}{
+		{"new account", 2, newcomer, true, room, "hello", "is one of the first from a new account"},
+		{"holding off", 0, newcomer, true, room, "hello", ""},
+		{"old account", 2, regular, true, room, "hello", ""},
+		{"enough messages", 2, talker, true, room, "hello", ""},
+		{"not enough messages", 3, talker, true, room, "hello", "is one of the first from a new account"},
+		{"guest", 2, User{Username: "guest-1"}, false, room, "hello", ""},
+		{"workspace owner", 2, owner, true, room, "hello", ""},
+		{"admin", 2, admin, true, room, "hello", ""},
+		{"link", 0, regular, true, linksRoom, "see https://example.com", "contains a link"},
+		{"link in another room", 0, regular, true, room, "see https://example.com", ""},
+		{"link from an owner", 0, owner, true, linksRoom, "see https://example.com", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			messagePipelineConfigMu.Lock()
+			messagePipelineConfig = MessagePipelineConfig{HoldNewPosters: tt.hold, NewAccountAge: 24 * time.Hour}
+			messagePipelineConfigMu.Unlock()
+
+			r := httptest.NewRequest("GET", "/ws", nil)
+			r = r.WithContext(context.WithValue(r.Context(), workspaceContextKey{}, ws))
+			mc := &MessageContext{
+				Request:  r,
+				User:     tt.user,
+				LoggedIn: tt.loggedIn,
+				Room:     tt.room,
+				Message:  Message{Username: tt.user.Username, Content: tt.content, Room: tt.room.Name, RoomID: tt.room.ID},
+			}
+			posted := false
+			err := holdForReview(func(mc *MessageContext) error {
+				posted = true
+				return nil
+			})(mc)
+
+			held, _ := store.ListHeldMessages(ctx, ws.ID)
+			if tt.reason == "" {
+				if err != nil || !posted || len(held) != 0 {
+					t.Errorf("held (%v): %+v", err, held)
+				}
+				return
+			}
+			var rejection *MessageRejection
+			if !errors.As(err, &rejection) || rejection.Code != rejectHeld {
+				t.Errorf("error %v, want a %s rejection", err, rejectHeld)
+			}
+			if posted {
+				t.Error("posted while held")
+			}
+			if len(held) != 1 || held[0].Reason != tt.reason || held[0].Message.Content != tt.content {
+				t.Fatalf("held %+v, want it held because it %s", held, tt.reason)
+			}
+			if _, err := store.TakeHeldMessage(ctx, ws.ID, held[0].ID); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
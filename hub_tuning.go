@@ -0,0 +1,65 @@
+package chat
+
+import (
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+)
+
+// HubConfig tunes how messages get from senders to WebSocket clients. How
+// long a write to one client may take is Timeouts.Broadcast.
+type HubConfig struct {
+	// Messages queued for the broadcast loop. A burst larger than this has
+	// senders wait, which shows in chat_broadcast_queue_waits_total
+	BroadcastBuffer int
+	// Bytes buffered for each connection's writes. Frames larger than
+	// this go out in more than one write
+	ClientSendBuffer int
+	// Frames queued for each client's writes. A client that falls this
+	// far behind is dropped, counted in chat_slow_clients_dropped_total
+	ClientQueue int
+	// Largest frame a client may send, in bytes. Larger frames close the
+	// connection, counted in chat_oversized_frames_total. 0 derives it
+	// from the maximum message length
+	MaxFrameSize int64
+}
+
+var (
+	hubConfig HubConfig
+
+	// Sends that found the broadcast queue full and had to wait
+	broadcastQueueWaits atomic.Uint64
+	// Connections closed because a frame was over the read limit
+	oversizedFrames atomic.Uint64
+)
+
+// setupHub sizes the broadcast queue and connection buffers. It has to run
+// before the broadcast loop starts.
+func setupHub(cfg HubConfig) {
+	hubConfig = cfg
+	broadcast = make(chan Message, max(cfg.BroadcastBuffer, 0))
+	upgrader.WriteBufferSize = max(cfg.ClientSendBuffer, 0)
+}
+
+// queueBroadcast hands a message to the broadcast loop, waiting when the
+// queue is full
+func queueBroadcast(msg Message) {
+	select {
+	case broadcast <- msg:
+	default:
+		broadcastQueueWaits.Add(1)
+		broadcast <- msg
+	}
+}
+
+// setReadLimit caps the frames a new connection may send. Frames that
+// can't hold an allowed message are cut off with a "message too big"
+// close; shorter ones are left to the pipeline. A JSON-escaped character
+// takes up to 12 bytes.
+func setReadLimit(ws *websocket.Conn) {
+	if hubConfig.MaxFrameSize > 0 {
+		ws.SetReadLimit(hubConfig.MaxFrameSize)
+	} else if max := currentPipelineConfig().MaxLength; max > 0 {
+		ws.SetReadLimit(int64(max)*12 + 1024)
+	}
+}
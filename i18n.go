@@ -0,0 +1,142 @@
+package chat
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Locale of the messages as written in the code
+const defaultLocale = "en"
+
+// supportedLocales are the locales with a catalog, besides English
+func supportedLocales() []string {
+	locales := []string{defaultLocale}
+	for locale := range catalogs {
+		locales = append(locales, locale)
+	}
+	sort.Strings(locales[1:])
+	return locales
+}
+
+// requestLocale picks the language of the messages for a request: the
+// logged-in user's preference, then the best match in Accept-Language
+func requestLocale(r *http.Request) string {
+	if user, ok := currentUser(r); ok && user.Preferences.Locale != "" {
+		return user.Preferences.Locale
+	}
+	return acceptedLocale(r.Header.Get("Accept-Language"))
+}
+
+// acceptedLocale returns the supported locale the Accept-Language header
+// weighs highest, matching on the language only, so "de-AT" picks "de"
+func acceptedLocale(header string) string {
+	type weighted struct {
+		lang string
+		q    float64
+	}
+	var langs []weighted
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		lang, _, _ := strings.Cut(strings.ToLower(tag), "-")
+		if lang != "" && q > 0 {
+			langs = append(langs, weighted{lang, q})
+		}
+	}
+	sort.SliceStable(langs, func(i, j int) bool { return langs[i].q > langs[j].q })
+
+	for _, l := range langs {
+		if _, ok := catalogs[l.lang]; ok || l.lang == defaultLocale {
+			return l.lang
+		}
+	}
+	return defaultLocale
+}
+
+// validLocale normalizes a locale preference, or reports it unsupported
+func validLocale(locale string) (string, bool) {
+	locale = strings.ToLower(strings.TrimSpace(locale))
+	return locale, locale == "" || slices.Contains(supportedLocales(), locale)
+}
+
+// translate looks a message up in a locale's catalog. Messages are keyed
+// by their English text, format verbs included, so anything missing from
+// a catalog stays English.
+func translate(locale, msg string) string {
+	if t, ok := catalogs[locale][msg]; ok {
+		return t
+	}
+	return msg
+}
+
+// translatef formats a message in a locale. String arguments are
+// translated too, for messages built from other messages.
+func translatef(locale, format string, args ...any) string {
+	translated := make([]any, len(args))
+	for i, arg := range args {
+		if s, ok := arg.(string); ok {
+			arg = translate(locale, s)
+		}
+		translated[i] = arg
+	}
+	return fmt.Sprintf(translate(locale, format), translated...)
+}
+
+// localizeMiddleware translates the plain text error messages handlers
+// write with http.Error. JSON bodies are left alone; clients should match
+// on status codes and error codes, not on the text.
+func localizeMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isChatPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		locale := requestLocale(r)
+		if locale == defaultLocale {
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(&localizedWriter{ResponseWriter: w, locale: locale}, r)
+	})
+}
+
+// localizedWriter translates the body of error responses
+type localizedWriter struct {
+	http.ResponseWriter
+	locale    string
+	translate bool
+}
+
+func (w *localizedWriter) WriteHeader(status int) {
+	if status >= 400 && strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		w.translate = true
+		w.Header().Set("Content-Language", w.locale)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *localizedWriter) Write(p []byte) (int, error) {
+	if !w.translate {
+		return w.ResponseWriter.Write(p)
+	}
+	// http.Error writes the whole message at once
+	msg := strings.TrimSuffix(string(p), "\n")
+	if _, err := w.ResponseWriter.Write([]byte(translate(w.locale, msg) + "\n")); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *localizedWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,175 @@
+package chat
+
+// catalogs translate server messages by locale, keyed by the English text.
+// Translations use the format verbs of the English text, with explicit
+// argument indexes such as %[2]s where the word order differs.
+var catalogs = map[string]map[string]string{
+	"de": {
+		// API errors
+		"Not logged in":                                      "Nicht angemeldet",
+		"Login failed":                                       "Anmeldung fehlgeschlagen",
+		"Login expired, please log in again":                 "Anmeldung abgelaufen, bitte erneut anmelden",
+		"This account is banned":                             "Dieses Konto ist gesperrt",
+		"Username already taken":                             "Der Benutzername ist bereits vergeben",
+		"Verify your email address before logging in":        "Bestätige deine E-Mail-Adresse, bevor du dich anmeldest",
+		"Invalid two-factor code":                            "Ungültiger Zwei-Faktor-Code",
+		"Invalid or expired API token":                       "Ungültiges oder abgelaufenes API-Token",
+		"Invalid or expired access token":                    "Ungültiges oder abgelaufenes Zugriffstoken",
+		"Send the access token in the first frame":           "Sende das Zugriffstoken im ersten Frame",
+		"Too many requests":                                  "Zu viele Anfragen",
+		"Reconnecting too often, try again later":            "Die Verbindung wird zu oft neu aufgebaut, versuche es später erneut",
+		"User not found":                                     "Benutzer nicht gefunden",
+		"Room not found":                                     "Raum nicht gefunden",
+		"Join a room first":                                  "Tritt zuerst einem Raum bei",
+		"Workspace not found":                                "Workspace nicht gefunden",
+		"Not a member of this workspace":                     "Kein Mitglied dieses Workspace",
+		"Task not found":                                     "Aufgabe nicht gefunden",
+		"Invalid task ID":                                    "Ungültige Aufgaben-ID",
+		"Invalid user ID":                                    "Ungültige Benutzer-ID",
+		"Attachment not found":                               "Anhang nicht gefunden",
+		"Upload not found":                                   "Upload nicht gefunden",
+		"Uploads are not enabled":                            "Uploads sind nicht aktiviert",
+		"Only moderators can do this":                        "Das dürfen nur Moderatoren",
+		"The server is in maintenance mode; try again later": "Der Server wird gewartet; versuche es später erneut",
+
+		// Chat frames
+		"Username is required":                                                   "Ein Benutzername ist erforderlich",
+		"Username %q is reserved":                                                "Der Benutzername %q ist reserviert",
+		"Message is empty":                                                       "Die Nachricht ist leer",
+		"Message is longer than %d characters":                                   "Die Nachricht ist länger als %d Zeichen",
+		"Messages can have at most %d attachments":                               "Nachrichten können höchstens %d Anhänge haben",
+		"Client message IDs can have at most %d characters":                      "Client-Nachrichten-IDs dürfen höchstens %d Zeichen lang sein",
+		"Message contains a blocked word":                                        "Die Nachricht enthält ein gesperrtes Wort",
+		"You're sending messages too fast":                                       "Du sendest Nachrichten zu schnell",
+		"Slow mode is on, wait %s before posting again":                          "Der langsame Modus ist aktiv, warte %s, bevor du erneut schreibst",
+		"Messages in #%s are limited to %d characters":                           "Nachrichten in #%s sind auf %d Zeichen begrenzt",
+		"Links aren't allowed in #%s":                                            "Links sind in #%s nicht erlaubt",
+		"Links to %s aren't allowed in #%s":                                      "Links zu %s sind in #%s nicht erlaubt",
+		"Only links to %s are allowed in #%s":                                    "In #%[2]s sind nur Links zu %[1]s erlaubt",
+		"Attachments aren't allowed in #%s":                                      "Anhänge sind in #%s nicht erlaubt",
+		"%s files aren't allowed in #%s":                                         "%s-Dateien sind in #%s nicht erlaubt",
+		"Your message %s, so it will appear in #%s once a moderator approves it": "Deine Nachricht %s und erscheint in #%s, sobald ein Moderator sie freigibt",
+		"Username %q belongs to a registered user; log in to use it":             "Der Benutzername %q gehört einem registrierten Benutzer; melde dich an, um ihn zu verwenden",
+		"contains a link":                                                        "enthält einen Link",
+		"is one of the first from a new account":                                 "gehört zu den ersten eines neuen Kontos",
+		"The server is in maintenance mode: %s":                                  "Der Server wird gewartet: %s",
+		"API token can't post messages":                                          "Das API-Token darf keine Nachrichten senden",
+		"Account is banned":                                                      "Das Konto ist gesperrt",
+		"Server is shutting down":                                                "Der Server wird heruntergefahren",
+		"Server is at capacity, try again later":                                 "Der Server ist ausgelastet, versuche es später erneut",
+		"Connection reached its lifetime, reconnect":                             "Die Verbindung hat ihre Höchstdauer erreicht, bitte neu verbinden",
+		"Invalid message":                                                        "Ungültige Nachricht",
+	},
+	"es": {
+		// API errors
+		"Not logged in":                                      "No has iniciado sesión",
+		"Login failed":                                       "No se pudo iniciar sesión",
+		"Login expired, please log in again":                 "La sesión ha caducado, vuelve a iniciar sesión",
+		"This account is banned":                             "Esta cuenta está bloqueada",
+		"Username already taken":                             "El nombre de usuario ya está en uso",
+		"Verify your email address before logging in":        "Verifica tu correo electrónico antes de iniciar sesión",
+		"Invalid two-factor code":                            "Código de dos factores no válido",
+		"Invalid or expired API token":                       "Token de API no válido o caducado",
+		"Invalid or expired access token":                    "Token de acceso no válido o caducado",
+		"Send the access token in the first frame":           "Envía el token de acceso en el primer frame",
+		"Too many requests":                                  "Demasiadas solicitudes",
+		"Reconnecting too often, try again later":            "Te reconectas demasiado a menudo, inténtalo más tarde",
+		"User not found":                                     "Usuario no encontrado",
+		"Room not found":                                     "Sala no encontrada",
+		"Join a room first":                                  "Únete primero a una sala",
+		"Workspace not found":                                "Espacio de trabajo no encontrado",
+		"Not a member of this workspace":                     "No eres miembro de este espacio de trabajo",
+		"Task not found":                                     "Tarea no encontrada",
+		"Invalid task ID":                                    "ID de tarea no válido",
+		"Invalid user ID":                                    "ID de usuario no válido",
+		"Attachment not found":                               "Archivo adjunto no encontrado",
+		"Upload not found":                                   "Subida no encontrada",
+		"Uploads are not enabled":                            "Las subidas no están habilitadas",
+		"Only moderators can do this":                        "Solo los moderadores pueden hacer esto",
+		"The server is in maintenance mode; try again later": "El servidor está en mantenimiento; inténtalo más tarde",
+
+		// Chat frames
+		"Username is required":                                                   "El nombre de usuario es obligatorio",
+		"Username %q is reserved":                                                "El nombre de usuario %q está reservado",
+		"Message is empty":                                                       "El mensaje está vacío",
+		"Message is longer than %d characters":                                   "El mensaje supera los %d caracteres",
+		"Messages can have at most %d attachments":                               "Los mensajes pueden tener como máximo %d archivos adjuntos",
+		"Client message IDs can have at most %d characters":                      "Los ID de mensaje del cliente pueden tener como máximo %d caracteres",
+		"Message contains a blocked word":                                        "El mensaje contiene una palabra bloqueada",
+		"You're sending messages too fast":                                       "Estás enviando mensajes demasiado rápido",
+		"Slow mode is on, wait %s before posting again":                          "El modo lento está activado, espera %s antes de volver a escribir",
+		"Messages in #%s are limited to %d characters":                           "Los mensajes en #%s están limitados a %d caracteres",
+		"Links aren't allowed in #%s":                                            "No se permiten enlaces en #%s",
+		"Links to %s aren't allowed in #%s":                                      "No se permiten enlaces a %s en #%s",
+		"Only links to %s are allowed in #%s":                                    "Solo se permiten enlaces a %s en #%s",
+		"Attachments aren't allowed in #%s":                                      "No se permiten archivos adjuntos en #%s",
+		"%s files aren't allowed in #%s":                                         "No se permiten archivos %s en #%s",
+		"Your message %s, so it will appear in #%s once a moderator approves it": "Tu mensaje %s, así que aparecerá en #%s cuando un moderador lo apruebe",
+		"Username %q belongs to a registered user; log in to use it":             "El nombre de usuario %q pertenece a un usuario registrado; inicia sesión para usarlo",
+		"contains a link":                                                        "contiene un enlace",
+		"is one of the first from a new account":                                 "es uno de los primeros de una cuenta nueva",
+		"The server is in maintenance mode: %s":                                  "El servidor está en mantenimiento: %s",
+		"API token can't post messages":                                          "El token de API no puede enviar mensajes",
+		"Account is banned":                                                      "La cuenta está bloqueada",
+		"Server is shutting down":                                                "El servidor se está apagando",
+		"Server is at capacity, try again later":                                 "El servidor está al límite, inténtalo más tarde",
+		"Connection reached its lifetime, reconnect":                             "La conexión alcanzó su duración máxima, vuelve a conectarte",
+		"Invalid message":                                                        "Mensaje no válido",
+	},
+	"fr": {
+		// API errors
+		"Not logged in":                                      "Non connecté",
+		"Login failed":                                       "Échec de la connexion",
+		"Login expired, please log in again":                 "La session a expiré, veuillez vous reconnecter",
+		"This account is banned":                             "Ce compte est banni",
+		"Username already taken":                             "Ce nom d'utilisateur est déjà pris",
+		"Verify your email address before logging in":        "Vérifiez votre adresse e-mail avant de vous connecter",
+		"Invalid two-factor code":                            "Code à deux facteurs invalide",
+		"Invalid or expired API token":                       "Jeton d'API invalide ou expiré",
+		"Invalid or expired access token":                    "Jeton d'accès invalide ou expiré",
+		"Send the access token in the first frame":           "Envoyez le jeton d'accès dans la première trame",
+		"Too many requests":                                  "Trop de requêtes",
+		"Reconnecting too often, try again later":            "Reconnexions trop fréquentes, réessayez plus tard",
+		"User not found":                                     "Utilisateur introuvable",
+		"Room not found":                                     "Salon introuvable",
+		"Join a room first":                                  "Rejoignez d'abord un salon",
+		"Workspace not found":                                "Espace de travail introuvable",
+		"Not a member of this workspace":                     "Vous n'êtes pas membre de cet espace de travail",
+		"Task not found":                                     "Tâche introuvable",
+		"Invalid task ID":                                    "Identifiant de tâche invalide",
+		"Invalid user ID":                                    "Identifiant d'utilisateur invalide",
+		"Attachment not found":                               "Pièce jointe introuvable",
+		"Upload not found":                                   "Téléversement introuvable",
+		"Uploads are not enabled":                            "Les téléversements ne sont pas activés",
+		"Only moderators can do this":                        "Seuls les modérateurs peuvent faire cela",
+		"The server is in maintenance mode; try again later": "Le serveur est en maintenance ; réessayez plus tard",
+
+		// Chat frames
+		"Username is required":                                                   "Le nom d'utilisateur est obligatoire",
+		"Username %q is reserved":                                                "Le nom d'utilisateur %q est réservé",
+		"Message is empty":                                                       "Le message est vide",
+		"Message is longer than %d characters":                                   "Le message dépasse %d caractères",
+		"Messages can have at most %d attachments":                               "Les messages peuvent avoir au plus %d pièces jointes",
+		"Client message IDs can have at most %d characters":                      "Les identifiants de message client peuvent avoir au plus %d caractères",
+		"Message contains a blocked word":                                        "Le message contient un mot interdit",
+		"You're sending messages too fast":                                       "Vous envoyez des messages trop vite",
+		"Slow mode is on, wait %s before posting again":                          "Le mode lent est activé, attendez %s avant de publier à nouveau",
+		"Messages in #%s are limited to %d characters":                           "Les messages dans #%s sont limités à %d caractères",
+		"Links aren't allowed in #%s":                                            "Les liens ne sont pas autorisés dans #%s",
+		"Links to %s aren't allowed in #%s":                                      "Les liens vers %s ne sont pas autorisés dans #%s",
+		"Only links to %s are allowed in #%s":                                    "Seuls les liens vers %s sont autorisés dans #%s",
+		"Attachments aren't allowed in #%s":                                      "Les pièces jointes ne sont pas autorisées dans #%s",
+		"%s files aren't allowed in #%s":                                         "Les fichiers %s ne sont pas autorisés dans #%s",
+		"Your message %s, so it will appear in #%s once a moderator approves it": "Votre message %s ; il apparaîtra dans #%s une fois approuvé par un modérateur",
+		"Username %q belongs to a registered user; log in to use it":             "Le nom d'utilisateur %q appartient à un utilisateur inscrit ; connectez-vous pour l'utiliser",
+		"contains a link":                                                        "contient un lien",
+		"is one of the first from a new account":                                 "fait partie des premiers d'un nouveau compte",
+		"The server is in maintenance mode: %s":                                  "Le serveur est en maintenance : %s",
+		"API token can't post messages":                                          "Le jeton d'API ne peut pas publier de messages",
+		"Account is banned":                                                      "Le compte est banni",
+		"Server is shutting down":                                                "Le serveur s'arrête",
+		"Server is at capacity, try again later":                                 "Le serveur est saturé, réessayez plus tard",
+		"Connection reached its lifetime, reconnect":                             "La connexion a atteint sa durée maximale, reconnectez-vous",
+		"Invalid message":                                                        "Message invalide",
+	},
+}
@@ -0,0 +1,136 @@
+package chat
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+)
+
+// ImageConfig bounds the images shared in rooms. Images are decoded and
+// encoded again, which drops their metadata (GPS position, camera, EXIF
+// thumbnail) and anything a malformed file hides after the pixels.
+type ImageConfig struct {
+	// Larger images are scaled down to fit, keeping their aspect ratio;
+	// 0 leaves that side unbounded
+	MaxWidth, MaxHeight int
+	// Images with more pixels than this are rejected before they are
+	// decoded, so a small file can't claim gigabytes of memory
+	MaxPixels int
+}
+
+// Quality of re-encoded JPEG images
+const imageJPEGQuality = 90
+
+var (
+	errInvalidImage = errors.New("not a valid image")
+	errImageTooBig  = errors.New("image is too large")
+)
+
+// reencodableImage reports whether images of a media type are re-encoded.
+// Other formats, such as WebP, can't be decoded and are kept as they are.
+func reencodableImage(contentType string) bool {
+	switch contentType {
+	case "image/jpeg", "image/png", "image/gif":
+		return true
+	}
+	return false
+}
+
+// reencodeImage decodes an image and encodes it again in the same format
+// without its metadata, scaled down to the configured size. Animated GIFs
+// keep their frames and are only checked, not scaled.
+func reencodeImage(data []byte, contentType string) ([]byte, error) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || "image/"+format != contentType {
+		return nil, errInvalidImage
+	}
+	if limit := attachmentConfig.Images.MaxPixels; limit > 0 && cfg.Width*cfg.Height > limit {
+		return nil, errImageTooBig
+	}
+
+	var buf bytes.Buffer
+	if format == "gif" {
+		anim, err := gif.DecodeAll(bytes.NewReader(data))
+		if err != nil {
+			return nil, errInvalidImage
+		}
+		if len(anim.Image) == 1 {
+			anim.Image[0] = toPaletted(fitImage(anim.Image[0]), anim.Image[0].Palette)
+			anim.Config.Width, anim.Config.Height = anim.Image[0].Bounds().Dx(), anim.Image[0].Bounds().Dy()
+		}
+		err = gif.EncodeAll(&buf, anim)
+		return buf.Bytes(), err
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, errInvalidImage
+	}
+	img = fitImage(img)
+	switch format {
+	case "jpeg":
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: imageJPEGQuality})
+	case "png":
+		err = png.Encode(&buf, img)
+	}
+	return buf.Bytes(), err
+}
+
+// fitImage scales an image down to the configured size
+func fitImage(img image.Image) image.Image {
+	cfg := attachmentConfig.Images
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	scale := 1.0
+	if cfg.MaxWidth > 0 && w > cfg.MaxWidth {
+		scale = min(scale, float64(cfg.MaxWidth)/float64(w))
+	}
+	if cfg.MaxHeight > 0 && h > cfg.MaxHeight {
+		scale = min(scale, float64(cfg.MaxHeight)/float64(h))
+	}
+	if scale == 1 {
+		return img
+	}
+	return scaleDown(img, max(1, int(float64(w)*scale)), max(1, int(float64(h)*scale)))
+}
+
+// scaleDown resizes an image to w×h by averaging the source pixels each
+// destination pixel covers
+func scaleDown(src image.Image, w, h int) *image.RGBA64 {
+	b := src.Bounds()
+	dst := image.NewRGBA64(image.Rect(0, 0, w, h))
+	for y := range h {
+		y0 := b.Min.Y + y*b.Dy()/h
+		y1 := max(y0+1, b.Min.Y+(y+1)*b.Dy()/h)
+		for x := range w {
+			x0 := b.Min.X + x*b.Dx()/w
+			x1 := max(x0+1, b.Min.X+(x+1)*b.Dx()/w)
+
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, bl, a = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			dst.SetRGBA64(x, y, color.RGBA64{R: uint16(r / n), G: uint16(g / n), B: uint16(bl / n), A: uint16(a / n)})
+		}
+	}
+	return dst
+}
+
+// toPaletted converts a scaled GIF frame back to its palette
+func toPaletted(img image.Image, p color.Palette) *image.Paletted {
+	if pm, ok := img.(*image.Paletted); ok {
+		return pm
+	}
+	dst := image.NewPaletted(img.Bounds(), p)
+	draw.Draw(dst, dst.Bounds(), img, img.Bounds().Min, draw.Src)
+	return dst
+}
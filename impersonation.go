@@ -0,0 +1,144 @@
+package chat
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// How long impersonation tokens last unless the admin asks for less, and
+// the most they may ask for
+const (
+	defaultImpersonationTTL = time.Hour
+	maxImpersonationTTL     = 8 * time.Hour
+)
+
+// ImpersonationRequest is the request body for impersonating a user
+type ImpersonationRequest struct {
+	Reason    string   `json:"reason"`              // Shown to the user, e.g. the support ticket
+	Scopes    []string `json:"scopes"`              // Any scope but admin; defaults to read
+	ExpiresIn string   `json:"expiresIn,omitempty"` // Go duration, at most 8h
+}
+
+// Mint a token acting as a user, for support. The user sees it among
+// their tokens and can revoke it, and everything done with it is audited
+// (POST /admin/users/{id}/impersonate)
+func impersonateUser(w http.ResponseWriter, r *http.Request) {
+	admin, _ := currentUser(r)
+	if _, ok := requestAPIToken(r); ok {
+		http.Error(w, "Impersonation needs a session login, not an API token", http.StatusForbidden)
+		return
+	}
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	user, ok := findUserByID(r.Context(), id)
+	if !ok {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if user.ID == admin.ID {
+		http.Error(w, "You can't impersonate yourself", http.StatusConflict)
+		return
+	}
+
+	var req ImpersonationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.Reason == "" {
+		http.Error(w, "A reason is required", http.StatusBadRequest)
+		return
+	}
+	if len(req.Scopes) == 0 {
+		req.Scopes = []string{scopeRead}
+	}
+	for _, s := range req.Scopes {
+		if s == scopeAdmin {
+			http.Error(w, "Impersonation tokens can't have the admin scope", http.StatusBadRequest)
+			return
+		}
+		if !slices.Contains(allScopes, s) {
+			http.Error(w, "Unknown scope: "+s+" (expected one of "+strings.Join(allScopes, ", ")+")", http.StatusBadRequest)
+			return
+		}
+	}
+	ttl := defaultImpersonationTTL
+	if req.ExpiresIn != "" {
+		ttl, err = time.ParseDuration(req.ExpiresIn)
+		if err != nil || ttl <= 0 || ttl > maxImpersonationTTL {
+			http.Error(w, "expiresIn must be a duration of at most "+maxImpersonationTTL.String(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	secret, err := newAPITokenSecret()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	now := time.Now().UTC()
+	expiresAt := now.Add(ttl)
+	token, err := store.CreateAPIToken(r.Context(), APIToken{
+		UserID:         user.ID,
+		Name:           "Support access by " + admin.Username + ": " + req.Reason,
+		Scopes:         slices.Compact(slices.Sorted(slices.Values(req.Scopes))),
+		Hint:           secret[len(secret)-4:],
+		CreatedAt:      now,
+		ExpiresAt:      &expiresAt,
+		Hash:           hashAPIToken(secret),
+		ImpersonatedBy: admin.Username,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(r, "impersonation.start", user.Username,
+		"token "+strconv.Itoa(token.ID)+" scopes="+strings.Join(token.Scopes, ",")+" reason="+strconv.Quote(req.Reason))
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(CreatedAPIToken{APIToken: token, Token: secret})
+}
+
+// List what admins did while impersonating the current user, newest last
+// (GET /me/impersonations)
+func getMyImpersonations(w http.ResponseWriter, r *http.Request) {
+	user, _ := currentUser(r)
+
+	events, err := store.ListAuditEvents(r.Context(), AuditFilter{Impersonated: user.Username})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(events)
+}
+
+// auditImpersonatedMessages audits every message posted with an
+// impersonation token, so the user sees what was said in their name
+func auditImpersonatedMessages(next MessageHandler) MessageHandler {
+	return func(mc *MessageContext) error {
+		if mc.Token == nil || mc.Token.ImpersonatedBy == "" {
+			return next(mc)
+		}
+		ws := requestWorkspace(mc.Request)
+		saveAudit(AuditEvent{
+			Time:       time.Now().UTC(),
+			Action:     "impersonation.message",
+			Actor:      mc.Token.ImpersonatedBy,
+			IP:         clientIP(mc.Request),
+			Target:     ws.Slug + "/" + mc.Room.Name,
+			Details:    strconv.Quote(mc.Message.Content),
+			OnBehalfOf: mc.User.Username,
+		})
+		return next(mc)
+	}
+}
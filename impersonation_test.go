@@ -0,0 +1,56 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGetMyImpersonations(t *testing.T) {
+	useMemoryStore(t)
+	alice := User{ID: 1, Username: "alice"}
+	token := &APIToken{ID: 7, UserID: alice.ID, ImpersonatedBy: "root"}
+	room := Room{ID: 1, Name: "general"}
+	post := func(token *APIToken, content string) {
+		mc := &MessageContext{
+			Request:  httptest.NewRequest("GET", "/ws", nil),
+			User:     alice,
+			LoggedIn: true,
+			Token:    token,
+			Room:     room,
+			Message:  Message{Username: alice.Username, Content: content},
+		}
+		if err := auditImpersonatedMessages(func(*MessageContext) error { return nil })(mc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	recordAudit(nil, "impersonation.start", "alice", "token 7")
+	recordAudit(nil, "impersonation.start", "bob", "token 8")
+	post(token, "posted by support")
+	post(nil, "posted by alice")
+	post(&APIToken{ID: 9, UserID: alice.ID}, "posted by alice's script")
+
+	r := httptest.NewRequest("GET", "/me/impersonations", nil)
+	r = r.WithContext(context.WithValue(r.Context(), userContextKey{}, alice))
+	w := httptest.NewRecorder()
+	getMyImpersonations(w, r)
+	var events []AuditEvent
+	if err := json.NewDecoder(w.Body).Decode(&events); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"impersonation.start", "impersonation.message"}
+	if len(events) != len(want) {
+		t.Fatalf("got %+v, want %v", events, want)
+	}
+	for i, e := range events {
+		if e.Action != want[i] {
+			t.Errorf("event %d is %s, want %s", i, e.Action, want[i])
+		}
+	}
+	if msg := events[1]; msg.Actor != "root" || msg.OnBehalfOf != "alice" || msg.Details != `"posted by support"` {
+		t.Errorf("message event %+v", msg)
+	}
+}
@@ -0,0 +1,387 @@
+package chat
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Largest export that can be imported
+const maxImportBytes = 20 << 20
+
+// ImportReport describes what an import created, or would create on a dry
+// run, and how the export was mapped onto projects, statuses and tasks
+type ImportReport struct {
+	Provider string          `json:"provider"`
+	DryRun   bool            `json:"dryRun"`
+	Projects []ImportProject `json:"projects"`
+	// Statuses maps the export's statuses or lists to task statuses
+	Statuses map[string]string `json:"statuses"`
+	// Priorities maps the export's priorities to task priorities
+	Priorities map[string]string `json:"priorities,omitempty"`
+	Tasks      []Task            `json:"tasks"`
+	// Warnings lists what couldn't be imported as is, e.g. unknown
+	// assignees, which are left unassigned
+	Warnings []string `json:"warnings"`
+}
+
+// ImportProject is a project an import fills with tasks
+type ImportProject struct {
+	ID       int    `json:"id,omitempty"` // Zero on a dry run for new projects
+	Name     string `json:"name"`
+	Existing bool   `json:"existing"` // A project with this name already existed
+	Tasks    int    `json:"tasks"`
+}
+
+// importedTask is a task read from an export, before it is stored
+type importedTask struct {
+	Task
+	Project string // Name of its project
+}
+
+// importStatus maps a Jira status or Trello list name to a task status.
+// Names meaning done become "completed" and those meaning not started
+// become "pending"; others are kept as snake_case, e.g. "in_progress".
+func importStatus(name string) string {
+	status := strings.Join(strings.Fields(strings.ToLower(name)), "_")
+	switch status {
+	case "done", "closed", "resolved", "complete", "completed", "finished":
+		return "completed"
+	case "", "to_do", "todo", "open", "backlog", "new", "pending":
+		return "pending"
+	}
+	return status
+}
+
+// importPriority maps a Jira priority to a task priority
+func importPriority(name string) string {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "blocker", "critical", "highest", "urgent":
+		return "urgent"
+	case "high", "major":
+		return "high"
+	case "medium", "normal":
+		return "normal"
+	case "low", "lowest", "minor", "trivial":
+		return "low"
+	}
+	return ""
+}
+
+// Date formats found in Jira CSV exports, which depend on the site's
+// settings
+var jiraDateLayouts = []string{
+	"02/Jan/06 3:04 PM",
+	"02/Jan/06",
+	"2006-01-02 15:04",
+	"2006-01-02",
+	time.RFC3339,
+}
+
+// parseJiraDate parses a date of a Jira CSV export as UTC
+func parseJiraDate(s string) (time.Time, bool) {
+	for _, layout := range jiraDateLayouts {
+		if t, err := time.Parse(layout, strings.TrimSpace(s)); err == nil {
+			return t.UTC(), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// readJiraCSV reads the issues of a Jira CSV export. Each issue's "Project
+// name" becomes its project.
+func readJiraCSV(r io.Reader, report *ImportReport) ([]importedTask, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid Jira CSV: %w", err)
+	}
+	// Jira repeats columns holding several values, like labels
+	columns := make(map[string][]int)
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		columns[name] = append(columns[name], i)
+	}
+	if len(columns["summary"]) == 0 {
+		return nil, errors.New("Invalid Jira CSV: no Summary column")
+	}
+	value := func(record []string, column string) string {
+		for _, i := range columns[column] {
+			if i < len(record) && strings.TrimSpace(record[i]) != "" {
+				return strings.TrimSpace(record[i])
+			}
+		}
+		return ""
+	}
+
+	var tasks []importedTask
+	for line := 2; ; line++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid Jira CSV: %w", err)
+		}
+		key := value(record, "issue key")
+		if key == "" {
+			key = fmt.Sprintf("line %d", line)
+		}
+		title := value(record, "summary")
+		if title == "" {
+			report.Warnings = append(report.Warnings, fmt.Sprintf("Skipped %s: it has no summary", key))
+			continue
+		}
+
+		task := importedTask{Project: value(record, "project name")}
+		if task.Project == "" {
+			task.Project = "Jira import"
+		}
+		task.Title = title
+		task.Description = value(record, "description")
+		task.Assignee = value(record, "assignee")
+		if status := value(record, "status"); status != "" {
+			task.Status = importStatus(status)
+			report.Statuses[status] = task.Status
+		}
+		if priority := value(record, "priority"); priority != "" {
+			task.Priority = importPriority(priority)
+			report.Priorities[priority] = task.Priority
+		}
+		for _, i := range columns["labels"] {
+			if i < len(record) && record[i] != "" {
+				task.Tags = append(task.Tags, record[i])
+			}
+		}
+		for column, date := range map[string]**time.Time{"due date": &task.DueDate, "resolved": &task.CompletedAt} {
+			if s := value(record, column); s != "" {
+				if t, ok := parseJiraDate(s); ok {
+					*date = &t
+				} else {
+					report.Warnings = append(report.Warnings, fmt.Sprintf("Ignored the %s of %s: unknown date format %q", column, key, s))
+				}
+			}
+		}
+		if created, ok := parseJiraDate(value(record, "created")); ok {
+			task.CreatedAt = created
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks, nil
+}
+
+// trelloBoard is the part of a Trello board's JSON export that is imported
+type trelloBoard struct {
+	Name  string `json:"name"`
+	Lists []struct {
+		ID     string `json:"id"`
+		Name   string `json:"name"`
+		Closed bool   `json:"closed"`
+	} `json:"lists"`
+	Cards []struct {
+		ID          string     `json:"id"`
+		Name        string     `json:"name"`
+		Desc        string     `json:"desc"`
+		IDList      string     `json:"idList"`
+		Closed      bool       `json:"closed"`
+		Due         *time.Time `json:"due"`
+		DueComplete bool       `json:"dueComplete"`
+		IDMembers   []string   `json:"idMembers"`
+		Labels      []struct {
+			Name  string `json:"name"`
+			Color string `json:"color"`
+		} `json:"labels"`
+	} `json:"cards"`
+	Members []struct {
+		ID       string `json:"id"`
+		Username string `json:"username"`
+	} `json:"members"`
+}
+
+// readTrelloJSON reads the cards of a Trello board's JSON export. The
+// board becomes a project and its lists become statuses; archived lists
+// and cards are skipped.
+func readTrelloJSON(r io.Reader, report *ImportReport) ([]importedTask, error) {
+	var board trelloBoard
+	if err := json.NewDecoder(r).Decode(&board); err != nil {
+		return nil, fmt.Errorf("Invalid Trello JSON: %w", err)
+	}
+	if board.Name == "" {
+		board.Name = "Trello import"
+	}
+	lists := make(map[string]string)
+	for _, list := range board.Lists {
+		if !list.Closed {
+			lists[list.ID] = list.Name
+			report.Statuses[list.Name] = importStatus(list.Name)
+		}
+	}
+	members := make(map[string]string)
+	for _, m := range board.Members {
+		members[m.ID] = m.Username
+	}
+
+	var tasks []importedTask
+	for _, card := range board.Cards {
+		list, ok := lists[card.IDList]
+		if card.Closed || !ok {
+			report.Warnings = append(report.Warnings, fmt.Sprintf("Skipped archived card %q", card.Name))
+			continue
+		}
+		if strings.TrimSpace(card.Name) == "" {
+			report.Warnings = append(report.Warnings, fmt.Sprintf("Skipped card %s: it has no name", card.ID))
+			continue
+		}
+
+		task := importedTask{Project: board.Name}
+		task.Title = card.Name
+		task.Description = card.Desc
+		task.Status = importStatus(list)
+		if card.DueComplete {
+			task.Status = "completed"
+		}
+		task.DueDate = card.Due
+		if len(card.IDMembers) > 0 {
+			task.Assignee = members[card.IDMembers[0]]
+		}
+		for _, label := range card.Labels {
+			if label.Name != "" {
+				task.Tags = append(task.Tags, label.Name)
+			} else if label.Color != "" {
+				task.Tags = append(task.Tags, label.Color)
+			}
+		}
+		// Trello IDs start with the card's creation time
+		if len(card.ID) >= 8 {
+			if secs, err := strconv.ParseInt(card.ID[:8], 16, 64); err == nil {
+				task.CreatedAt = time.Unix(secs, 0).UTC()
+			}
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks, nil
+}
+
+////////////////////////
+// Import API Handler //
+////////////////////////
+
+// Import tasks from another tracker; moderators only
+// (POST /import/{provider}). The body is a Jira CSV export ("jira") or a
+// Trello board's JSON export ("trello"). Boards and Jira projects become
+// projects, reusing those with the same name, lists and Jira statuses
+// become task statuses and cards and issues become tasks. With
+// ?dryRun=true nothing is stored and the report previews the import. WIP
+// limits aren't enforced on imported tasks.
+func importTasks(w http.ResponseWriter, r *http.Request) {
+	user, _ := currentUser(r)
+	ws := requestWorkspace(r)
+
+	provider := mux.Vars(r)["provider"]
+	report := ImportReport{
+		Provider:   provider,
+		DryRun:     r.URL.Query().Get("dryRun") == "true",
+		Projects:   []ImportProject{},
+		Statuses:   make(map[string]string),
+		Priorities: make(map[string]string),
+		Tasks:      []Task{},
+		Warnings:   []string{},
+	}
+	body := http.MaxBytesReader(w, r.Body, maxImportBytes)
+	var imported []importedTask
+	var err error
+	switch provider {
+	case "jira":
+		imported, err = readJiraCSV(body, &report)
+	case "trello":
+		imported, err = readTrelloJSON(body, &report)
+	default:
+		http.Error(w, `Unknown provider, expected "jira" or "trello"`, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	existing, err := store.ListProjects(r.Context(), ws.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Index of each imported project in the report by lowercase name
+	projects := make(map[string]int)
+	now := time.Now().UTC()
+	for _, t := range imported {
+		name := strings.ToLower(t.Project)
+		if _, ok := projects[name]; !ok {
+			project := ImportProject{Name: t.Project}
+			if i := slices.IndexFunc(existing, func(p Project) bool { return strings.EqualFold(p.Name, t.Project) }); i >= 0 {
+				project = ImportProject{ID: existing[i].ID, Name: existing[i].Name, Existing: true}
+			} else if !report.DryRun {
+				created, err := store.CreateProject(r.Context(), Project{Name: t.Project, CreatedAt: now, WorkspaceID: ws.ID})
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				project.ID = created.ID
+			}
+			projects[name] = len(report.Projects)
+			report.Projects = append(report.Projects, project)
+		}
+		project := &report.Projects[projects[name]]
+		project.Tasks++
+
+		task := t.Task
+		if task.Status == "" {
+			task.Status = "pending"
+		}
+		if task.Assignee != "" {
+			if u, ok := findUserByUsername(r.Context(), task.Assignee); !ok || !isWorkspaceMember(r.Context(), ws, u.ID) {
+				report.Warnings = append(report.Warnings, fmt.Sprintf("Left %q unassigned: no member of this workspace is called %s", task.Title, task.Assignee))
+				task.Assignee = ""
+			}
+		}
+		// The project is checked above, and may not exist yet on a dry run
+		task.ProjectID = 0
+		if err := checkTaskFields(r.Context(), ws, &task); err != nil {
+			report.Warnings = append(report.Warnings, fmt.Sprintf("Skipped %q: %v", task.Title, err))
+			project.Tasks--
+			continue
+		}
+		task.ProjectID = project.ID
+		task.WorkspaceID = ws.ID
+		if task.CreatedAt.IsZero() {
+			task.CreatedAt = now
+		}
+		stampCompletion(&task, now)
+
+		if !report.DryRun {
+			// Imports bring over the board as it is, past any WIP limits
+			task, err = taskService.Create(r.Context(), ws, task, TaskWriteOptions{By: user.Username, OverrideWIPLimit: true})
+			if err != nil {
+				writeTaskError(w, err)
+				return
+			}
+		}
+		report.Tasks = append(report.Tasks, task)
+	}
+
+	if report.DryRun {
+		json.NewEncoder(w).Encode(report)
+		return
+	}
+	recordAudit(r, "tasks.import", provider, fmt.Sprintf("%d tasks in %d projects", len(report.Tasks), len(report.Projects)))
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(report)
+}
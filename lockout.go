@@ -0,0 +1,127 @@
+package chat
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LockoutConfig controls brute-force protection for logins
+type LockoutConfig struct {
+	MaxAccountFailures int           // Failures per account before it locks
+	MaxIPFailures      int           // Failures per client IP before it locks
+	BaseLockout        time.Duration // First lockout, doubled for every further failure
+	MaxLockout         time.Duration // Upper bound for a single lockout
+	FailureWindow      time.Duration // Quiet period after which failures are forgotten
+}
+
+// loginFailure tracks failed attempts for one account or IP
+type loginFailure struct {
+	Failures    int
+	LastFailure time.Time
+	LockedUntil time.Time
+}
+
+var (
+	lockoutConfig LockoutConfig
+
+	// Failed login attempts keyed by "account:<name>" or "ip:<addr>"
+	loginFailures   = make(map[string]*loginFailure)
+	loginFailuresMu sync.Mutex
+)
+
+func accountLockKey(username string) string {
+	return "account:" + strings.ToLower(username)
+}
+
+func ipLockKey(ip string) string {
+	return "ip:" + ip
+}
+
+// checkLoginAllowed returns how long the caller must wait before trying
+// again, or zero if neither the account nor the client IP is locked
+func checkLoginAllowed(r *http.Request, username string) time.Duration {
+	loginFailuresMu.Lock()
+	defer loginFailuresMu.Unlock()
+
+	now := time.Now()
+	var wait time.Duration
+	for _, key := range []string{accountLockKey(username), ipLockKey(clientIP(r))} {
+		if f, ok := loginFailures[key]; ok && f.LockedUntil.After(now) {
+			if d := f.LockedUntil.Sub(now); d > wait {
+				wait = d
+			}
+		}
+	}
+	return wait
+}
+
+// recordLoginFailure counts a failed attempt for the account and the
+// client IP, locking either once it passes its threshold. Every failure
+// past the threshold doubles the lockout.
+func recordLoginFailure(r *http.Request, username string) {
+	ip := clientIP(r)
+	keys := []struct {
+		key   string
+		limit int
+	}{
+		{accountLockKey(username), lockoutConfig.MaxAccountFailures},
+		{ipLockKey(ip), lockoutConfig.MaxIPFailures},
+	}
+
+	now := time.Now()
+	var locked []string
+
+	loginFailuresMu.Lock()
+	for _, k := range keys {
+		f, ok := loginFailures[k.key]
+		if !ok || now.Sub(f.LastFailure) > lockoutConfig.FailureWindow {
+			f = &loginFailure{}
+			loginFailures[k.key] = f
+		}
+		f.Failures++
+		f.LastFailure = now
+
+		if k.limit > 0 && f.Failures >= k.limit {
+			lockout := float64(lockoutConfig.BaseLockout) * math.Pow(2, float64(f.Failures-k.limit))
+			d := time.Duration(math.Min(lockout, float64(lockoutConfig.MaxLockout)))
+			f.LockedUntil = now.Add(d)
+			locked = append(locked, fmt.Sprintf("%s for %s after %d failures", k.key, d.Round(time.Second), f.Failures))
+		}
+	}
+	pruneLoginFailures(now)
+	loginFailuresMu.Unlock()
+
+	for _, l := range locked {
+		recordAudit(r, "login.lockout", username, l)
+	}
+}
+
+// recordLoginSuccess clears the failure count of the account
+func recordLoginSuccess(username string) {
+	loginFailuresMu.Lock()
+	defer loginFailuresMu.Unlock()
+
+	delete(loginFailures, accountLockKey(username))
+}
+
+// pruneLoginFailures forgets records that are neither locked nor recent.
+// The caller must hold loginFailuresMu.
+func pruneLoginFailures(now time.Time) {
+	for key, f := range loginFailures {
+		if now.After(f.LockedUntil) && now.Sub(f.LastFailure) > lockoutConfig.FailureWindow {
+			delete(loginFailures, key)
+		}
+	}
+}
+
+// writeLockedOut responds with 429 and a Retry-After header
+func writeLockedOut(w http.ResponseWriter, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, fmt.Sprintf("Too many failed login attempts, try again in %d seconds", seconds), http.StatusTooManyRequests)
+}
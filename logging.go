@@ -0,0 +1,361 @@
+package chat
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LoggingConfig selects where the server log goes and how much of it
+type LoggingConfig struct {
+	Format  string        // "text" or "json", written to stdout
+	File    string        // Also write to this file, rotating it; empty disables
+	MaxSize int64         // Bytes at which the file is rotated
+	MaxAge  time.Duration // Age at which rotated files are removed
+	Syslog  string        // Also send to syslog at udp://, tcp:// or unixgram:// address
+	// Levels by subsystem, plus "default" for the rest, e.g.
+	// "default=info,cluster=error"
+	Levels map[string]string
+}
+
+// Log levels, least severe first
+const (
+	levelDebug = "debug"
+	levelInfo  = "info"
+	levelWarn  = "warn"
+	levelError = "error"
+	levelOff   = "off"
+)
+
+var logLevelOrder = []string{levelDebug, levelInfo, levelWarn, levelError, levelOff}
+
+// Subsystem of log lines without a "Subsystem: " prefix
+const defaultSubsystem = "default"
+
+// LogLevels is the request and response body of the log level API
+type LogLevels map[string]string
+
+var (
+	// Lowest level logged per subsystem
+	logLevels   = LogLevels{defaultSubsystem: levelInfo}
+	logLevelsMu sync.Mutex
+
+	// The sinks the standard logger writes to once Run set them up
+	logOutput *logRouter
+)
+
+// logRouter receives everything written through the standard logger and
+// hands each line on to the sinks its subsystem's level lets through.
+// Lines are "Subsystem: message" by convention, as in "Cluster: node b
+// left"; they are info, or error when they say something failed.
+type logRouter struct {
+	mu     sync.Mutex
+	format string
+	stdout io.Writer
+	file   *rotatingFile
+	syslog net.Conn
+}
+
+// setupLogging sends the standard logger to the configured sinks
+func setupLogging(cfg LoggingConfig) error {
+	levels := LogLevels{defaultSubsystem: levelInfo}
+	for subsystem, level := range cfg.Levels {
+		if !slices.Contains(logLevelOrder, level) {
+			return fmt.Errorf("unknown log level %q for %s (expected one of %s)",
+				level, subsystem, strings.Join(logLevelOrder, ", "))
+		}
+		levels[strings.ToLower(subsystem)] = level
+	}
+
+	router := &logRouter{format: cfg.Format, stdout: os.Stdout}
+	switch cfg.Format {
+	case "", "text", "json":
+	default:
+		return fmt.Errorf("unknown log format %q", cfg.Format)
+	}
+	if cfg.File != "" {
+		f, err := openRotatingFile(cfg.File, cfg.MaxSize, cfg.MaxAge)
+		if err != nil {
+			return err
+		}
+		router.file = f
+	}
+	if cfg.Syslog != "" {
+		conn, err := dialSyslog(cfg.Syslog)
+		if err != nil {
+			router.Close()
+			return fmt.Errorf("syslog: %w", err)
+		}
+		router.syslog = conn
+	}
+
+	logLevelsMu.Lock()
+	logLevels = levels
+	logLevelsMu.Unlock()
+
+	if logOutput != nil {
+		logOutput.Close()
+	}
+	logOutput = router
+	log.SetFlags(0)
+	log.SetOutput(router)
+	return nil
+}
+
+// closeLogging sends the standard logger back to stderr
+func closeLogging() {
+	if logOutput == nil {
+		return
+	}
+	log.SetFlags(log.LstdFlags)
+	log.SetOutput(os.Stderr)
+	logOutput.Close()
+	logOutput = nil
+}
+
+// logSubsystem splits a line into its subsystem and message
+func logSubsystem(line string) (string, string) {
+	prefix, rest, ok := strings.Cut(line, ": ")
+	if !ok || prefix == "" || strings.ContainsAny(prefix, " \t") || len(prefix) > 20 {
+		return defaultSubsystem, line
+	}
+	return strings.ToLower(prefix), rest
+}
+
+// lineLevel guesses the level of a line logged without one
+func lineLevel(msg string) string {
+	lower := strings.ToLower(msg)
+	if strings.Contains(lower, "failed") || strings.Contains(lower, "error") {
+		return levelError
+	}
+	return levelInfo
+}
+
+// logEnabled reports whether a subsystem logs lines of the given level
+func logEnabled(subsystem, level string) bool {
+	logLevelsMu.Lock()
+	min, ok := logLevels[subsystem]
+	if !ok {
+		min = logLevels[defaultSubsystem]
+	}
+	logLevelsMu.Unlock()
+	return slices.Index(logLevelOrder, level) >= slices.Index(logLevelOrder, min)
+}
+
+// Write takes one line from the standard logger
+func (l *logRouter) Write(p []byte) (int, error) {
+	line := strings.TrimSuffix(string(p), "\n")
+	subsystem, msg := logSubsystem(line)
+	level := lineLevel(msg)
+	if !logEnabled(subsystem, level) {
+		return len(p), nil
+	}
+
+	now := time.Now()
+	var out []byte
+	if l.format == "json" {
+		out, _ = json.Marshal(struct {
+			Time      time.Time `json:"time"`
+			Level     string    `json:"level"`
+			Subsystem string    `json:"subsystem"`
+			Message   string    `json:"msg"`
+		}{now.UTC(), level, subsystem, msg})
+		out = append(out, '\n')
+	} else {
+		out = append([]byte(now.Format("2006/01/02 15:04:05 ")), p...)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.stdout.Write(out)
+	if l.file != nil {
+		if err := l.file.Write(out); err != nil {
+			fmt.Fprintf(os.Stderr, "Writing the log file failed: %v\n", err)
+		}
+	}
+	if l.syslog != nil {
+		l.syslog.Write(syslogLine(now, level, subsystem, line))
+	}
+	return len(p), nil
+}
+
+func (l *logRouter) Close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file != nil {
+		l.file.Close()
+	}
+	if l.syslog != nil {
+		l.syslog.Close()
+	}
+}
+
+// rotatingFile is a log file that is renamed aside once it reaches
+// maxSize, with rotated files removed once they are older than maxAge
+type rotatingFile struct {
+	path    string
+	maxSize int64
+	maxAge  time.Duration
+	f       *os.File
+	size    int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxAge time.Duration) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, maxAge: maxAge}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(r.path), 0750); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size = f, info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) error {
+	if r.maxSize > 0 && r.size+int64(len(p)) > r.maxSize && r.size > 0 {
+		if err := r.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return err
+}
+
+// rotate renames the file to <path>.<time> and starts a new one
+func (r *rotatingFile) rotate() error {
+	r.f.Close()
+	rotated := r.path + "." + time.Now().UTC().Format("20060102T150405.000")
+	if err := os.Rename(r.path, rotated); err != nil {
+		// Keep appending to the file rather than losing the log
+		r.open()
+		return err
+	}
+	if r.maxAge > 0 {
+		old, _ := filepath.Glob(r.path + ".*")
+		for _, name := range old {
+			if info, err := os.Stat(name); err == nil && time.Since(info.ModTime()) > r.maxAge {
+				os.Remove(name)
+			}
+		}
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) Close() error {
+	return r.f.Close()
+}
+
+// dialSyslog connects to a syslog server or socket given as a URL
+func dialSyslog(addr string) (net.Conn, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "udp", "tcp":
+		return net.Dial(u.Scheme, u.Host)
+	case "unixgram", "unix":
+		return net.Dial(u.Scheme, u.Path)
+	default:
+		return nil, fmt.Errorf("unknown syslog scheme %q (expected udp, tcp or unixgram)", u.Scheme)
+	}
+}
+
+// Syslog severities of the log levels (RFC 5424)
+var syslogSeverity = map[string]int{levelDebug: 7, levelInfo: 6, levelWarn: 4, levelError: 3}
+
+// syslogLine formats a line as an RFC 5424 message from the daemon facility
+func syslogLine(t time.Time, level, subsystem, msg string) []byte {
+	var b bytes.Buffer
+	host, _ := os.Hostname()
+	fmt.Fprintf(&b, "<%d>1 %s %s chat-server %d %s - %s\n",
+		3*8+syslogSeverity[level], t.UTC().Format(time.RFC3339Nano), host, os.Getpid(), subsystem, msg)
+	return b.Bytes()
+}
+
+//////////////////////////////////
+// Log Level Admin API Handlers //
+//////////////////////////////////
+
+// Get the log level of each subsystem (GET /admin/logging)
+func getLogLevels(w http.ResponseWriter, r *http.Request) {
+	logLevelsMu.Lock()
+	defer logLevelsMu.Unlock()
+	json.NewEncoder(w).Encode(logLevels)
+}
+
+// Change the log levels of the subsystems named in the body, leaving the
+// others alone; an empty level removes a subsystem's override
+// (PUT /admin/logging)
+func updateLogLevels(w http.ResponseWriter, r *http.Request) {
+	var req LogLevels
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for subsystem, level := range req {
+		if level == "" && subsystem == defaultSubsystem {
+			http.Error(w, "The default level can't be removed", http.StatusBadRequest)
+			return
+		}
+		if level != "" && !slices.Contains(logLevelOrder, level) {
+			http.Error(w, "Unknown log level: "+level+" (expected one of "+strings.Join(logLevelOrder, ", ")+")",
+				http.StatusBadRequest)
+			return
+		}
+	}
+
+	levels := setLogLevels(req)
+	if cluster != nil {
+		cluster.broadcast(clusterEnvelope{From: cluster.id, Kind: envelopeLogLevels, LogLevels: req})
+	}
+	for subsystem, level := range req {
+		recordAudit(r, "logging.level", subsystem, level)
+	}
+	json.NewEncoder(w).Encode(levels)
+}
+
+// setLogLevels applies level changes and returns the resulting levels
+func setLogLevels(changes LogLevels) LogLevels {
+	logLevelsMu.Lock()
+	defer logLevelsMu.Unlock()
+	for subsystem, level := range changes {
+		subsystem = strings.ToLower(subsystem)
+		if level == "" {
+			delete(logLevels, subsystem)
+		} else {
+			logLevels[subsystem] = level
+		}
+	}
+	levels := make(LogLevels, len(logLevels))
+	for subsystem, level := range logLevels {
+		levels[subsystem] = level
+	}
+	return levels
+}
@@ -1,270 +1,1402 @@
-package main
-
-import (
-	"encoding/json"
-	"log"
-	"net/http"
-	"strconv"
-	"sync"
-
-	"github.com/gorilla/mux"
-	"github.com/gorilla/websocket"
-)
-
-// Task represents a task with an ID, Title, Description, and Status
-type Task struct {
-	ID          int    `json:"id"`
-	Title       string `json:"title"`
-	Description string `json:"description"`
-	Status      string `json:"status"` // "pending" or "completed"
-}
-
-// Message represents a chat message
-type Message struct {
-	Username string `json:"username"`
-	Content  string `json:"content"`
-}
-
-var (
-	// Task management variables
-	tasks   []Task
-	nextID  int = 1
-	tasksMu sync.Mutex
-
-	// Chat application variables
-	clients   = make(map[*websocket.Conn]bool) // Connected clients
-	broadcast = make(chan Message)             // Broadcast channel
-	upgrader  = websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool {
-			// Allow connections from any origin
-			return true
-		},
-	}
-)
-
-func main() {
-	// Create a new Gorilla Mux router
-	router := mux.NewRouter()
-	router.Use(jsonMiddleware)
-
-	// Task management routes
-	router.HandleFunc("/tasks", createTask).Methods("POST")
-	router.HandleFunc("/tasks", getTasks).Methods("GET")
-	router.HandleFunc("/tasks/{id}", getTask).Methods("GET")
-	router.HandleFunc("/tasks/{id}", updateTask).Methods("PUT")
-	router.HandleFunc("/tasks/{id}", deleteTask).Methods("DELETE")
-
-	// WebSocket route for chat
-	router.HandleFunc("/ws", handleConnections)
-
-	// Serve static files from the "public" directory
-	router.PathPrefix("/").Handler(http.FileServer(http.Dir("./public/")))
-
-	// Start listening for incoming chat messages
-	go handleMessages()
-
-	// Start the server
-	log.Println("Server started on :8080")
-	err := http.ListenAndServe(":8080", router)
-	if err != nil {
-		log.Fatal("Server error: ", err)
-	}
-}
-
-// Middleware to set the Content-Type header to application/json
-func jsonMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Set Content-Type header
-		w.Header().Set("Content-Type", "application/json")
-		next.ServeHTTP(w, r)
-	})
-}
-
-//////////////////////
-// Task API Handlers //
-//////////////////////
-
-// Create a new task (POST /tasks)
-func createTask(w http.ResponseWriter, r *http.Request) {
-	var task Task
-	// Decode the request body into a Task struct
-	err := json.NewDecoder(r.Body).Decode(&task)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-
-	tasksMu.Lock()
-	defer tasksMu.Unlock()
-
-	// Assign an ID to the new task
-	task.ID = nextID
-	nextID++
-
-	// Set default status if not provided
-	if task.Status == "" {
-		task.Status = "pending"
-	}
-
-	// Add the new task to the slice
-	tasks = append(tasks, task)
-
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(task)
-}
-
-// Get all tasks (GET /tasks)
-func getTasks(w http.ResponseWriter, r *http.Request) {
-	tasksMu.Lock()
-	defer tasksMu.Unlock()
-
-	json.NewEncoder(w).Encode(tasks)
-}
-
-// Get a task by ID (GET /tasks/{id})
-func getTask(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	idStr := vars["id"]
-
-	// Convert ID from string to integer
-	id, err := strconv.Atoi(idStr)
-	if err != nil {
-		http.Error(w, "Invalid task ID", http.StatusBadRequest)
-		return
-	}
-
-	tasksMu.Lock()
-	defer tasksMu.Unlock()
-
-	// Search for the task by ID
-	for _, task := range tasks {
-		if task.ID == id {
-			json.NewEncoder(w).Encode(task)
-			return
-		}
-	}
-
-	// If task not found
-	http.Error(w, "Task not found", http.StatusNotFound)
-}
-
-// Update an existing task (PUT /tasks/{id})
-func updateTask(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	idStr := vars["id"]
-
-	// Convert ID from string to integer
-	id, err := strconv.Atoi(idStr)
-	if err != nil {
-		http.Error(w, "Invalid task ID", http.StatusBadRequest)
-		return
-	}
-
-	var updatedTask Task
-	// Decode the request body into a Task struct
-	err = json.NewDecoder(r.Body).Decode(&updatedTask)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-
-	tasksMu.Lock()
-	defer tasksMu.Unlock()
-
-	// Search for the task by ID and update it
-	for i, task := range tasks {
-		if task.ID == id {
-			if updatedTask.Title != "" {
-				tasks[i].Title = updatedTask.Title
-			}
-			if updatedTask.Description != "" {
-				tasks[i].Description = updatedTask.Description
-			}
-			if updatedTask.Status != "" {
-				tasks[i].Status = updatedTask.Status
-			}
-
-			json.NewEncoder(w).Encode(tasks[i])
-			return
-		}
-	}
-
-	// If task not found
-	http.Error(w, "Task not found", http.StatusNotFound)
-}
-
-// Delete a task by ID (DELETE /tasks/{id})
-func deleteTask(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	idStr := vars["id"]
-
-	// Convert ID from string to integer
-	id, err := strconv.Atoi(idStr)
-	if err != nil {
-		http.Error(w, "Invalid task ID", http.StatusBadRequest)
-		return
-	}
-
-	tasksMu.Lock()
-	defer tasksMu.Unlock()
-
-	// Search for the task by ID and delete it
-	for i, task := range tasks {
-		if task.ID == id {
-			tasks = append(tasks[:i], tasks[i+1:]...)
-			w.WriteHeader(http.StatusNoContent)
-			return
-		}
-	}
-
-	// If task not found
-	http.Error(w, "Task not found", http.StatusNotFound)
-}
-
-/////////////////////////////
-// WebSocket Chat Handlers //
-/////////////////////////////
-
-// Handle WebSocket connections
-func handleConnections(w http.ResponseWriter, r *http.Request) {
-	// Upgrade initial GET request to a WebSocket
-	ws, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Printf("WebSocket upgrade error: %v", err)
-		return
-	}
-	defer ws.Close()
-
-	// Register new client
-	clients[ws] = true
-
-	for {
-		var msg Message
-		// Read new message as JSON and map it to a Message object
-		err := ws.ReadJSON(&msg)
-		if err != nil {
-			log.Printf("WebSocket read error: %v", err)
-			delete(clients, ws)
-			break
-		}
-		// Send the newly received message to the broadcast channel
-		broadcast <- msg
-	}
-}
-
-// Broadcast messages to all connected clients
-func handleMessages() {
-	for {
-		// Grab the next message from the broadcast channel
-		msg := <-broadcast
-		// Send it out to every client connected
-		for client := range clients {
-			err := client.WriteJSON(msg)
-			if err != nil {
-				log.Printf("WebSocket write error: %v", err)
-				client.Close()
-				delete(clients, client)
-			}
-		}
-	}
-}
+package chat
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// Guards the background goroutines, which outlive a server and are shared
+// by the next one
+var startBackground sync.Once
+
+// NewServer sets the application up from cfg and returns its HTTP handler.
+// It opens the store and the session store, applies the settings and starts
+// the goroutines that broadcast and persist chat messages.
+//
+// The application keeps its state in package variables, so a process can
+// only run one server at a time. Call Close before setting up another.
+func NewServer(cfg Config) (http.Handler, error) {
+	resetState()
+	err := setTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("config error: %w", err)
+	}
+
+	store, err = newStore(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("store error: %w", err)
+	}
+	if _, ok := store.(*memoryStore); ok {
+		log.Print("Keeping data in memory; tasks, messages and accounts are lost when the server stops. Unset CHAT_STORE or set it to sqlite or postgres to keep them")
+	}
+	err = ensureDefaultWorkspace(context.Background())
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("store error: %w", err)
+	}
+	if cfg.RestoreFrom != "" {
+		err = restoreFromFile(cfg.RestoreFrom, backupDirs(cfg.Attachments.Dir, cfg.Archive.Dir))
+		if errors.Is(err, errStoreNotEmpty) {
+			log.Printf("Not restoring %s: the store already has data", cfg.RestoreFrom)
+		} else if err != nil {
+			store.Close()
+			return nil, fmt.Errorf("restore error: %w", err)
+		}
+	}
+	if cfg.Seed {
+		if err := seedDemoData(context.Background()); err != nil {
+			store.Close()
+			return nil, fmt.Errorf("seed error: %w", err)
+		}
+	}
+	if err := loadRegistries(context.Background()); err != nil {
+		store.Close()
+		return nil, fmt.Errorf("store error: %w", err)
+	}
+	if err := loadMaintenance(context.Background()); err != nil {
+		store.Close()
+		return nil, fmt.Errorf("store error: %w", err)
+	}
+	if err := loadFeatureOverrides(context.Background()); err != nil {
+		store.Close()
+		return nil, fmt.Errorf("store error: %w", err)
+	}
+	if err := loadAnonymizations(context.Background()); err != nil {
+		store.Close()
+		return nil, fmt.Errorf("store error: %w", err)
+	}
+	taskIndex, err = newTaskIndex(context.Background())
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("task index error: %w", err)
+	}
+
+	sessions, err = newSessionStore(cfg)
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("session store error: %w", err)
+	}
+	sessionTTL = cfg.SessionTTL
+	secureCookies = cfg.SecureCookies
+	setupOAuthProviders(cfg)
+
+	authProvider, err = newAuthProvider(cfg)
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("auth provider error: %w", err)
+	}
+	bootstrapAdmins = cfg.AdminUsers
+	securityPolicy = SecurityPolicy{RequireAdmin2FA: cfg.RequireAdmin2FA}
+	totpIssuer = cfg.TOTPIssuer
+
+	smsProvider, err = newSMSProvider(cfg.SMS)
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("SMS provider error: %w", err)
+	}
+	smsMaxPerHour = cfg.SMS.MaxPerHour
+
+	tokenSigningKey = []byte(cfg.SecretKey)
+	if len(tokenSigningKey) == 0 {
+		log.Println("CHAT_SECRET_KEY is not set, using a random key; emailed links and access tokens stop working on restart")
+		tokenSigningKey = make([]byte, 32)
+		if _, err := rand.Read(tokenSigningKey); err != nil {
+			store.Close()
+			return nil, fmt.Errorf("secret key error: %w", err)
+		}
+	}
+	accessTokenTTL = cfg.AccessTokenTTL
+	emailNotifier = newEmailNotifier(cfg.SMTP)
+	if err := setupEmailTemplates(cfg.Email); err != nil {
+		store.Close()
+		return nil, fmt.Errorf("email template error: %w", err)
+	}
+	requireEmailVerification = cfg.RequireEmailVerification
+	publicURL = strings.TrimSuffix(cfg.PublicURL, "/")
+	lockoutConfig = cfg.Lockout
+	maxConnections = cfg.MaxConnections
+	maxConnectionLifetime = cfg.MaxConnectionLifetime
+	connectionLifetimeJitter = cfg.ConnectionLifetimeJitter
+	broadcastBatchInterval = cfg.BroadcastBatchInterval
+	historyOnConnect = cfg.HistoryOnConnect
+	timeouts = cfg.Timeouts
+	allowPrivateWebhooks = cfg.AllowPrivateWebhooks
+	workspaceDomain = strings.ToLower(cfg.WorkspaceDomain)
+	archiveConfig = cfg.Archive
+	sloConfig = cfg.SLO
+	auditRetention = cfg.AuditRetention
+
+	flags, err := parseFeatureList(cfg.Features)
+	if err == nil {
+		err = setFeatureDefaults(flags)
+	}
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("feature flag error: %w", err)
+	}
+	eventPublisher, err = newEventPublisher(cfg)
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("event bridge error: %w", err)
+	}
+	mqttBridge, err = newMQTTBridge(cfg.MQTT)
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("MQTT bridge error: %w", err)
+	}
+	xmppGateway, err = newXMPPGateway(cfg.XMPP)
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("XMPP gateway error: %w", err)
+	}
+	discordBridge, err = newDiscordBridge(cfg.Discord)
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("Discord bridge error: %w", err)
+	}
+	if cfg.Attachments.Dir != "" {
+		if err := os.MkdirAll(cfg.Attachments.Dir, 0750); err != nil {
+			store.Close()
+			return nil, fmt.Errorf("attachments error: %w", err)
+		}
+	}
+	attachmentConfig = cfg.Attachments
+	uploadConfig = cfg.Uploads
+	attachmentScanner, err = newAttachmentScanner(cfg.Attachments)
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("attachment scanner error: %w", err)
+	}
+	emailGateway, err = newEmailGateway(cfg.InboundEmail)
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("email gateway error: %w", err)
+	}
+	cluster, err = newClusterNode(cfg.Cluster)
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("cluster error: %w", err)
+	}
+	rateLimiter, err = newRateLimiter(cfg)
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("rate limiter error: %w", err)
+	}
+	liveSettings = settingsFrom(cfg)
+	applySettings(liveSettings)
+
+	// Create a new Gorilla Mux router
+	router := mux.NewRouter()
+	router.Use(jsonMiddleware)
+	router.Use(requestTimeoutMiddleware)
+	router.Use(sessionMiddleware)
+	router.Use(apiTokenMiddleware)
+	router.Use(localizeMiddleware)
+	router.Use(authorizeMiddleware)
+	router.Use(rateLimitMiddleware)
+	router.Use(maintenanceMiddleware)
+	router.Use(workspaceAccessMiddleware)
+
+	// Account and session routes
+	router.HandleFunc("/auth/register", register).Methods("POST")
+	router.HandleFunc("/auth/login", login).Methods("POST")
+	router.HandleFunc("/auth/logout", logout).Methods("POST")
+	router.HandleFunc("/auth/logout-all", logoutEverywhere).Methods("POST")
+	router.HandleFunc("/auth/oauth", listOAuthProviders).Methods("GET")
+	router.HandleFunc("/auth/oauth/{provider}", startOAuthLogin).Methods("GET")
+	router.HandleFunc("/auth/oauth/{provider}/callback", finishOAuthLogin).Methods("GET")
+	router.HandleFunc("/auth/2fa", completeTwoFactorLogin).Methods("POST")
+	router.HandleFunc("/auth/2fa/sms", sendLoginCode).Methods("POST")
+	router.HandleFunc("/auth/password-reset", requestPasswordReset).Methods("POST")
+	router.HandleFunc("/auth/password-reset/confirm", confirmPasswordReset).Methods("POST")
+	router.HandleFunc("/auth/verify-email", verifyEmail).Methods("GET")
+	router.HandleFunc("/auth/verify-email/resend", resendVerificationEmail).Methods("POST")
+	router.HandleFunc("/me", getMe).Methods("GET")
+	router.HandleFunc("/me/2fa/enroll", enrollTwoFactor).Methods("POST")
+	router.HandleFunc("/me/2fa/confirm", confirmTwoFactor).Methods("POST")
+	router.HandleFunc("/me/2fa/recovery-codes", regenerateRecoveryCodes).Methods("POST")
+	router.HandleFunc("/me/2fa/disable", disableTwoFactor).Methods("POST")
+	router.HandleFunc("/me/preferences", getPreferences).Methods("GET")
+	router.HandleFunc("/me/preferences", updatePreferences).Methods("PUT")
+	router.HandleFunc("/me/agenda", getAgenda).Methods("GET")
+	router.HandleFunc("/me/usage", getMyUsage).Methods("GET")
+	router.HandleFunc("/me/impersonations", getMyImpersonations).Methods("GET")
+	router.HandleFunc("/me/read-markers", getReadMarkers).Methods("GET")
+	router.HandleFunc("/me/connections", getMyConnections).Methods("GET")
+	router.HandleFunc("/me/messages/export", exportMyMessages).Methods("GET")
+	router.HandleFunc("/me/permissions", getMyPermissions).Methods("GET")
+	router.HandleFunc("/me/phone", setPhoneNumber).Methods("PUT")
+	router.HandleFunc("/me/phone", removePhoneNumber).Methods("DELETE")
+	router.HandleFunc("/me/phone/verify", verifyPhoneNumber).Methods("POST")
+	router.HandleFunc("/me/tokens", listAPITokens).Methods("GET")
+	router.HandleFunc("/me/tokens", createAPIToken).Methods("POST")
+	router.HandleFunc("/me/tokens/{id}", revokeAPIToken).Methods("DELETE")
+	router.HandleFunc("/features", getFeatures).Methods("GET")
+	router.HandleFunc("/branding", getBranding).Methods("GET")
+
+	// Workspace routes
+	router.HandleFunc("/workspaces", listWorkspaces).Methods("GET")
+	router.HandleFunc("/workspaces", createWorkspace).Methods("POST")
+	router.HandleFunc("/workspaces/{slug}", getWorkspace).Methods("GET")
+	router.HandleFunc("/workspaces/{slug}/settings", updateWorkspaceSettings).Methods("PUT")
+	router.HandleFunc("/workspaces/{slug}/join", joinWorkspace).Methods("POST")
+	router.HandleFunc("/workspaces/{slug}/members", listWorkspaceMembers).Methods("GET")
+	router.HandleFunc("/workspaces/{slug}/members", addWorkspaceMemberHandler).Methods("POST")
+	router.HandleFunc("/workspaces/{slug}/members/{userID}", removeWorkspaceMember).Methods("DELETE")
+
+	// Admin routes
+	admin := router.PathPrefix("/admin").Subrouter()
+	admin.HandleFunc("/security-policy", getSecurityPolicy).Methods("GET")
+	admin.HandleFunc("/security-policy", updateSecurityPolicy).Methods("PUT")
+	admin.HandleFunc("/audit", getAuditLog).Methods("GET")
+	admin.HandleFunc("/backup", createBackup).Methods("POST")
+	admin.HandleFunc("/migrations", getMigrations).Methods("GET")
+	admin.HandleFunc("/migrations", runMigrations).Methods("POST")
+	admin.HandleFunc("/stats", getConnectionStats).Methods("GET")
+	admin.HandleFunc("/slo", getSLOReport).Methods("GET")
+	admin.HandleFunc("/cluster", getClusterStatus).Methods("GET")
+	admin.HandleFunc("/users", listUsers).Methods("GET")
+	admin.HandleFunc("/storage", getStorageUsage).Methods("GET")
+	admin.HandleFunc("/users/{id}/ban", banUser).Methods("POST")
+	admin.HandleFunc("/users/{id}/unban", unbanUser).Methods("POST")
+	admin.HandleFunc("/users/{id}/tokens", listUserAPITokens).Methods("GET")
+	admin.HandleFunc("/users/{id}/impersonate", impersonateUser).Methods("POST")
+	admin.HandleFunc("/users/{id}/anonymize", anonymizeUser).Methods("POST")
+	admin.HandleFunc("/anonymizations/{id}", getAnonymization).Methods("GET")
+	admin.HandleFunc("/tokens/{id}/rotate", rotateAPIToken).Methods("POST")
+	admin.HandleFunc("/rooms/{name}/messages", wipeRoom).Methods("DELETE")
+	admin.HandleFunc("/scheduled-messages", listScheduledMessages).Methods("GET")
+	admin.HandleFunc("/scheduled-messages", createScheduledMessage).Methods("POST")
+	admin.HandleFunc("/scheduled-messages/{id}", deleteScheduledMessage).Methods("DELETE")
+	admin.HandleFunc("/maintenance", getMaintenance).Methods("GET")
+	admin.HandleFunc("/maintenance", updateMaintenance).Methods("PUT")
+	admin.HandleFunc("/config/reload", reloadConfig).Methods("POST")
+	admin.HandleFunc("/logging", getLogLevels).Methods("GET")
+	admin.HandleFunc("/logging", updateLogLevels).Methods("PUT")
+	admin.HandleFunc("/features", getFeatureFlags).Methods("GET")
+	admin.HandleFunc("/features/{name}", setFeatureFlag).Methods("PUT")
+	admin.HandleFunc("/features/{name}/workspaces/{slug}", setWorkspaceFeatureFlag).Methods("PUT")
+	admin.HandleFunc("/features/{name}/workspaces/{slug}", clearWorkspaceFeatureFlag).Methods("DELETE")
+
+	// Room routes
+	router.HandleFunc("/presence", getPresence).Methods("GET")
+	router.HandleFunc("/sync", getSync).Methods("GET")
+	router.HandleFunc("/rooms", getRooms).Methods("GET")
+	router.HandleFunc("/rooms/active", getActiveRooms).Methods("GET")
+	router.HandleFunc("/messages", getMessages).Methods("GET")
+	router.HandleFunc("/rooms", createRoom).Methods("POST")
+	router.HandleFunc("/rooms/{name}/slow-mode", setRoomSlowMode).Methods("PUT")
+	router.HandleFunc("/rooms/{name}/policy", setRoomPolicy).Methods("PUT")
+	router.HandleFunc("/rooms/{name}/branding", getRoomBranding).Methods("GET")
+	router.HandleFunc("/rooms/{name}/branding", setRoomBranding).Methods("PUT")
+	router.HandleFunc("/rooms/{name}/leaderboard", getLeaderboard).Methods("GET")
+	router.HandleFunc("/rooms/{name}/read", setReadMarker).Methods("PUT")
+	router.HandleFunc("/rooms/{name}/pins", getPins).Methods("GET")
+	router.HandleFunc("/rooms/{name}/pins/{id}", pinMessage).Methods("PUT")
+	router.HandleFunc("/rooms/{name}/pins/{id}", unpinMessage).Methods("DELETE")
+	router.HandleFunc("/rooms/{name}/webhooks", listRoomWebhooks).Methods("GET")
+	router.HandleFunc("/rooms/{name}/webhooks", createRoomWebhook).Methods("POST")
+	router.HandleFunc("/rooms/{name}/webhooks/{id}", deleteRoomWebhook).Methods("DELETE")
+
+	// Moderation routes
+	router.HandleFunc("/moderation/held", listHeldMessages).Methods("GET")
+	router.HandleFunc("/moderation/held/{id}/approve", approveHeldMessage).Methods("POST")
+	router.HandleFunc("/moderation/held/{id}/reject", rejectHeldMessage).Methods("POST")
+
+	// Task management routes
+	router.HandleFunc("/tasks", createTask).Methods("POST")
+	router.HandleFunc("/tasks", getTasks).Methods("GET")
+	router.HandleFunc("/tasks/search", searchTasks).Methods("GET")
+	router.HandleFunc("/tasks/changes", getTaskChanges).Methods("GET")
+	router.HandleFunc("/tasks/{id}", getTask).Methods("GET")
+	router.HandleFunc("/tasks/{id}", updateTask).Methods("PUT")
+	router.HandleFunc("/tasks/{id}", deleteTask).Methods("DELETE")
+	router.HandleFunc("/tasks/{id}/merge/{otherId}", mergeTasks).Methods("POST")
+	router.HandleFunc("/tasks/{id}/clone", cloneTask).Methods("POST")
+	router.HandleFunc("/tasks/{id}/claim", claimTask).Methods("POST")
+	router.HandleFunc("/tasks/{id}/history", getTaskHistory).Methods("GET")
+	router.HandleFunc("/tasks/{id}/history/{version}", getTaskVersion).Methods("GET")
+	router.HandleFunc("/tasks/{id}/undo", undoTask).Methods("POST")
+	router.HandleFunc("/search", search).Methods("GET")
+	router.HandleFunc("/projects", getProjects).Methods("GET")
+	router.HandleFunc("/projects", createProject).Methods("POST")
+	router.HandleFunc("/projects/{id}", getProject).Methods("GET")
+	router.HandleFunc("/projects/{id}/stats", getProjectStats).Methods("GET")
+	router.HandleFunc("/projects/{id}/report", getProjectReport).Methods("GET")
+	router.HandleFunc("/projects/{id}/wip-limits", setProjectWIPLimits).Methods("PUT")
+	router.HandleFunc("/import/{provider}", importTasks).Methods("POST")
+
+	// Automation routes
+	router.HandleFunc("/automations", listAutomations).Methods("GET")
+	router.HandleFunc("/automations", createAutomation).Methods("POST")
+	router.HandleFunc("/automations/{id}", getAutomation).Methods("GET")
+	router.HandleFunc("/automations/{id}", updateAutomation).Methods("PUT")
+	router.HandleFunc("/automations/{id}", deleteAutomation).Methods("DELETE")
+
+	// Event subscription routes
+	router.HandleFunc("/subscriptions", listEventSubscriptions).Methods("GET")
+	router.HandleFunc("/subscriptions", createEventSubscription).Methods("POST")
+	router.HandleFunc("/subscriptions/{id}", deleteEventSubscription).Methods("DELETE")
+	router.HandleFunc("/events", getEvents).Methods("GET")
+
+	router.HandleFunc("/attachments/{id}/{filename}", getAttachment).Methods("GET")
+
+	// Resumable upload routes (tus)
+	router.HandleFunc("/uploads", describeUploads).Methods("OPTIONS")
+	router.HandleFunc("/uploads", createUpload).Methods("POST")
+	router.HandleFunc("/uploads/{id}", headUpload).Methods("HEAD")
+	router.HandleFunc("/uploads/{id}", getUpload).Methods("GET")
+	router.HandleFunc("/uploads/{id}", patchUpload).Methods("PATCH")
+	router.HandleFunc("/uploads/{id}", deleteUpload).Methods("DELETE")
+
+	router.HandleFunc("/readyz", getReadiness).Methods("GET")
+	router.HandleFunc("/time", getServerTime).Methods("GET")
+	router.HandleFunc("/metrics", getMetrics).Methods("GET")
+
+	// WebSocket route for chat
+	router.HandleFunc("/ws", handleConnections)
+	router.HandleFunc("/ws/{room}", handleConnections)
+
+	// Serve static files from the "public" directory
+	router.PathPrefix("/").Handler(http.FileServer(http.Dir("./public/")))
+	if err := checkRoutePolicies(router); err != nil {
+		return nil, fmt.Errorf("authorization error: %w", err)
+	}
+
+	// Start the hub, listening for incoming chat messages, posting
+	// scheduled ones, sending webhook batches, handing out events, checking
+	// due dates, releasing expired task claims, archiving old messages and
+	// pruning the event log and audit log
+	startBackground.Do(func() {
+		setupHub(cfg.Hub)
+		go hub.run()
+		go handleMessages()
+		go runScheduledMessages()
+		go runWebhookBatches()
+		go runEventBus()
+		go runDueDateChecks()
+		go runClaimReleases()
+		go runArchiver()
+		go runUploadExpiry()
+		go runEventLogPruning()
+		go runAuditPruning()
+	})
+
+	// Persist chat messages in the background
+	messageQueue = newMessageWriter(store, cfg.MessageWriter)
+	setupMessagePipeline(cfg.MessagePipeline)
+	setupEventBus()
+	setupEventLog(store, cfg.EventLog)
+	taskUndoWindow = cfg.TaskUndoWindow
+	// Anonymizations use both queues, so they pick up where they were
+	// once the queues run
+	resumeAnonymizations()
+
+	return workspaceHandler(router), nil
+}
+
+// Close sends the chat clients off to reconnect, writes out queued chat
+// messages and events, and closes the store
+func Close() error {
+	migrateClients()
+	if mqttBridge != nil {
+		mqttBridge.Close()
+	}
+	if xmppGateway != nil {
+		xmppGateway.Close()
+	}
+	if discordBridge != nil {
+		discordBridge.Close()
+	}
+	if emailGateway != nil {
+		emailGateway.Close()
+	}
+	if cluster != nil {
+		cluster.Close()
+	}
+	if closer, ok := rateLimiter.(io.Closer); ok {
+		closer.Close()
+	}
+	messageQueue.Close()
+	if eventLog != nil {
+		eventLog.Close()
+	}
+	if taskIndex != nil {
+		taskIndex.Close()
+	}
+	if eventPublisher != nil {
+		if err := eventPublisher.Close(); err != nil {
+			log.Printf("Event bridge close error: %v", err)
+		}
+	}
+	return store.Close()
+}
+
+// Run serves the application until one of its listeners fails, or until
+// SIGINT or SIGTERM shut it down gracefully. It checks the configuration
+// and connections first, and fails with a report of every problem found
+// rather than at the first request that runs into one.
+func Run(cfg Config) error {
+	if err := setupLogging(cfg.Logging); err != nil {
+		return fmt.Errorf("logging error: %w", err)
+	}
+	defer closeLogging()
+
+	// Listening first finds a taken port before anything else starts
+	listeners, listenErr := openListeners(cfg)
+	config := runChecks(configChecks(cfg, listeners, listenErr))
+	if !config.Ready {
+		logSelfCheck(config)
+		closeListeners(listeners)
+		return errSelfCheckFailed
+	}
+	startupReportMu.Lock()
+	startupReport = config
+	startupReportMu.Unlock()
+
+	handler, err := NewServer(cfg)
+	if err != nil {
+		closeListeners(listeners)
+		return err
+	}
+	report := runChecks(connectionChecks())
+	report.Checks = append(config.Checks, report.Checks...)
+	logSelfCheck(report)
+	if !report.Ready {
+		closeListeners(listeners)
+		Close()
+		return errSelfCheckFailed
+	}
+
+	// Start the server
+	srv := newHTTPServer(cfg, handler)
+	err = runServer(cfg, srv, listeners)
+	if err != nil {
+		err = fmt.Errorf("server error: %w", err)
+	}
+
+	// Write out queued messages before exiting
+	if cerr := Close(); cerr != nil {
+		log.Printf("Store close error: %v", cerr)
+	}
+	return err
+}
+
+// resetState clears the registries a previous server in the same process
+// left behind
+func resetState() {
+	featuresMu.Lock()
+	features = make(map[string]bool)
+	featureOverrides = make(map[string]bool)
+	workspaceFeatures = make(map[int]map[string]bool)
+	featuresMu.Unlock()
+
+	loginFailuresMu.Lock()
+	loginFailures = make(map[string]*loginFailure)
+	loginFailuresMu.Unlock()
+
+	connectStrikesMu.Lock()
+	connectStrikes = make(map[string]*connectStrike)
+	connectStrikesMu.Unlock()
+
+	oauthProviders = make(map[string]*oauthProvider)
+
+	scheduledMessagesMu.Lock()
+	scheduledMessages = nil
+	scheduledMessagesMu.Unlock()
+
+	roomWebhooksMu.Lock()
+	for _, hook := range roomWebhooks {
+		stopWebhookDeliveries(hook.ID)
+	}
+	roomWebhooks = nil
+	roomWebhooksMu.Unlock()
+
+	eventSubscriptionsMu.Lock()
+	eventSubscriptions = nil
+	eventSubscriptionsMu.Unlock()
+
+	automationsMu.Lock()
+	automations = nil
+	automationsMu.Unlock()
+
+	overdueTasksMu.Lock()
+	overdueTasks = make(map[int]time.Time)
+	overdueTasksMu.Unlock()
+
+	updatedRoomsMu.Lock()
+	updatedRooms = make(map[int]Room)
+	updatedRoomsMu.Unlock()
+
+	slowModeMu.Lock()
+	lastPosts = make(map[slowModePoster]time.Time)
+	slowModeMu.Unlock()
+
+	smsSentMu.Lock()
+	smsSent = make(map[int][]time.Time)
+	smsSentMu.Unlock()
+
+	phoneVerificationsMu.Lock()
+	phoneVerifications = make(map[int]smsCode)
+	phoneVerificationsMu.Unlock()
+}
+
+// Middleware to set the Content-Type header to application/json
+func jsonMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Set Content-Type header
+		w.Header().Set("Content-Type", "application/json")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Task represents a task with an ID, Title, Description, and Status
+type Task struct {
+	ID          int        `json:"id"`
+	Title       string     `json:"title"`
+	Description string     `json:"description"`
+	Status      string     `json:"status"`             // "pending" or "completed"
+	Assignee    string     `json:"assignee,omitempty"` // Username
+	Priority    string     `json:"priority,omitempty"` // "low", "normal", "high" or "urgent"
+	Tags        []string   `json:"tags,omitempty"`
+	DueDate     *time.Time `json:"dueDate,omitempty"`
+	// MergedInto is the ID of the task this one was merged into. Merged
+	// tasks are kept as tombstones that redirect to it, and aren't listed.
+	MergedInto  int        `json:"mergedInto,omitempty"`
+	ProjectID   int        `json:"projectId,omitempty"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	CompletedAt *time.Time `json:"completedAt,omitempty"`
+	// ClaimExpiresAt is when the assignee's claim on the task runs out and
+	// the task goes back to the shared backlog. Tasks assigned otherwise
+	// have none.
+	ClaimExpiresAt *time.Time `json:"claimExpiresAt,omitempty"`
+	WorkspaceID    int        `json:"-"`
+}
+
+// CloneOptions is the optional request body for cloning a task
+type CloneOptions struct {
+	Title string `json:"title"` // Defaults to the original's title
+	Tags  bool   `json:"tags"`  // Copy the original's tags
+}
+
+// Task priorities, lowest first
+var taskPriorities = []string{"low", "normal", "high", "urgent"}
+
+// checkTaskFields validates a task's project, assignee and priority, and
+// tidies up its tags
+func checkTaskFields(ctx context.Context, ws Workspace, task *Task) error {
+	if task.Priority != "" && !slices.Contains(taskPriorities, task.Priority) {
+		return fmt.Errorf("Priority must be one of %s", strings.Join(taskPriorities, ", "))
+	}
+	if task.ProjectID != 0 {
+		if _, err := store.GetProject(ctx, ws.ID, task.ProjectID); err != nil {
+			return fmt.Errorf("No project with ID %d in this workspace", task.ProjectID)
+		}
+	}
+	if task.Assignee != "" {
+		user, ok := findUserByUsername(ctx, task.Assignee)
+		if !ok || !isWorkspaceMember(ctx, ws, user.ID) {
+			return fmt.Errorf("No member of this workspace is called %s", task.Assignee)
+		}
+		task.Assignee = user.Username
+	}
+
+	tags := []string{}
+	for _, tag := range task.Tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if strings.Contains(tag, ",") {
+			return errors.New("Tags can't contain commas")
+		}
+		if tag != "" && !slices.Contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) > 20 {
+		return errors.New("Tasks can have at most 20 tags")
+	}
+	task.Tags = nil
+	if len(tags) > 0 {
+		task.Tags = tags
+	}
+	return nil
+}
+
+// stampCompletion records when a task was completed, or forgets it when
+// the task is reopened
+func stampCompletion(task *Task, now time.Time) {
+	switch {
+	case task.Status != "completed":
+		task.CompletedAt = nil
+	case task.CompletedAt == nil:
+		task.CompletedAt = &now
+	}
+}
+
+//////////////////////
+// Task API Handlers //
+//////////////////////
+
+// Create a new task (POST /tasks)
+func createTask(w http.ResponseWriter, r *http.Request) {
+	var task Task
+	// Decode the request body into a Task struct
+	err := json.NewDecoder(r.Body).Decode(&task)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Timestamps are the server's to set
+	task.CreatedAt = time.Time{}
+	task.CompletedAt = nil
+	task, err = overrideWIPLimit(r, func(opts TaskWriteOptions) (Task, error) {
+		return taskService.Create(r.Context(), requestWorkspace(r), task, opts)
+	})
+	if err != nil {
+		writeTaskError(w, err)
+		return
+	}
+
+	writeTask(w, r, http.StatusCreated, task)
+}
+
+// Get all tasks (GET /tasks)
+func getTasks(w http.ResponseWriter, r *http.Request) {
+	tasks, err := taskService.List(r.Context(), requestWorkspace(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeTasks(w, r, tasks)
+}
+
+// Get a task by ID (GET /tasks/{id})
+func getTask(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	idStr := vars["id"]
+
+	// Convert ID from string to integer
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "Invalid task ID", http.StatusBadRequest)
+		return
+	}
+
+	task, err := taskService.Get(r.Context(), requestWorkspace(r), id)
+	if err != nil {
+		writeTaskError(w, err)
+		return
+	}
+
+	// Links to a merged task lead to the task it was merged into
+	if task.MergedInto != 0 {
+		http.Redirect(w, r, fmt.Sprintf("/tasks/%d", task.MergedInto), http.StatusMovedPermanently)
+		return
+	}
+
+	writeTask(w, r, http.StatusOK, task)
+}
+
+// Update an existing task (PUT /tasks/{id})
+func updateTask(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	idStr := vars["id"]
+
+	// Convert ID from string to integer
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "Invalid task ID", http.StatusBadRequest)
+		return
+	}
+
+	var updatedTask Task
+	// Decode the request body into a Task struct
+	err = json.NewDecoder(r.Body).Decode(&updatedTask)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var previous Task
+	task, err := overrideWIPLimit(r, func(opts TaskWriteOptions) (task Task, err error) {
+		previous, task, err = taskService.Update(r.Context(), requestWorkspace(r), id, updatedTask, opts)
+		return task, err
+	})
+	if err != nil {
+		writeTaskError(w, err)
+		return
+	}
+
+	// Whoever marks a task completed gets the credit
+	if previous.Status != "completed" && task.Status == "completed" {
+		if user, loggedIn := currentUser(r); loggedIn && featureEnabled(r, featureGamification) {
+			if err := recordTaskCompleted(r.Context(), user); err != nil {
+				log.Printf("Recording activity of %s: %v", user.Username, err)
+			}
+		}
+	}
+
+	writeTask(w, r, http.StatusOK, task)
+}
+
+// Delete a task by ID (DELETE /tasks/{id})
+func deleteTask(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	idStr := vars["id"]
+
+	// Convert ID from string to integer
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "Invalid task ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := taskService.Delete(r.Context(), requestWorkspace(r), id); err != nil {
+		writeTaskError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Create a copy of a task (POST /tasks/{id}/clone). The copy keeps the
+// description, priority, due date and project, and optionally the tags,
+// but starts out pending and unassigned.
+func cloneTask(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid task ID", http.StatusBadRequest)
+		return
+	}
+
+	var clone CloneOptions
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&clone); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	task, err := overrideWIPLimit(r, func(opts TaskWriteOptions) (Task, error) {
+		return taskService.Clone(r.Context(), requestWorkspace(r), id, clone, opts)
+	})
+	if err != nil {
+		writeTaskError(w, err)
+		return
+	}
+
+	writeTask(w, r, http.StatusCreated, task)
+}
+
+// Merge another task into a task (POST /tasks/{id}/merge/{otherId}). The
+// task keeps its title and status, gains the other's description and
+// tags, and takes the higher priority and earlier due date. Its history
+// takes in the other's. The other task becomes a tombstone redirecting to
+// it.
+func mergeTasks(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid task ID", http.StatusBadRequest)
+		return
+	}
+	otherID, err := strconv.Atoi(vars["otherId"])
+	if err != nil {
+		http.Error(w, "Invalid task ID", http.StatusBadRequest)
+		return
+	}
+
+	user, _ := currentUser(r)
+	task, err := taskService.Merge(r.Context(), requestWorkspace(r), id, otherID, TaskWriteOptions{By: user.Username})
+	if err != nil {
+		writeTaskError(w, err)
+		return
+	}
+
+	writeTask(w, r, http.StatusOK, task)
+}
+
+// Message represents a chat message
+type Message struct {
+	ID        int       `json:"id,omitempty"`
+	Username  string    `json:"username"`
+	Content   string    `json:"content"`
+	Room      string    `json:"room,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	// Files shared with the message. Bridges also link them in Content
+	// for clients that only show text.
+	Attachments []Attachment `json:"attachments,omitempty"`
+	// Number of the message in its room's broadcasts, for spotting gaps.
+	// Messages loaded from history have none.
+	Seq int64 `json:"seq,omitempty"`
+
+	// ID the sender gave the message to match the broadcast, which carries
+	// it back with Seq, to the copy it showed before sending
+	ClientMsgID string `json:"clientMsgId,omitempty"`
+
+	RoomID      int    `json:"-"` // Room the message is broadcast in
+	WorkspaceID int    `json:"-"` // Workspace of the room, for the event bus
+	UserID      int    `json:"-"` // Author, or 0 for anonymous messages
+	Origin      string `json:"-"` // Bridge the message came in through, so it isn't mirrored back
+
+	// Timing of the broadcast, on the copies queued for this node's
+	// clients
+	broadcast *broadcastTiming
+}
+
+// Attachment is a file shared in a chat message
+type Attachment struct {
+	Name        string `json:"name"`
+	URL         string `json:"url,omitempty"` // Empty when the file wasn't kept
+	ContentType string `json:"contentType"`   // Media type, e.g. "image/png"
+}
+
+// chatClient is a connected WebSocket client
+type chatClient struct {
+	roomID int // Room the client listens to
+	userID int // Logged-in user, or 0 for guests
+	info   ConnectionInfo
+	caps   []string // Capabilities negotiated on connect
+	// Messages waiting to go out together, for clients that take batches
+	batch *clientBatch
+
+	send chan any        // Frames for the client's pump to write
+	done <-chan struct{} // Closed when the pump stops
+	// Frames held back while the client is sent what came before them,
+	// or nil
+	held *[]any
+}
+
+var (
+	// Chat application variables
+	hub       = newHub()           // Clients connected to this node
+	broadcast = make(chan Message) // Broadcast channel, sized by setupHub
+	upgrader  = websocket.Upgrader{CheckOrigin: originAllowed, EnableCompression: true}
+
+	// Origins besides the server's own that may open connections, or
+	// none to allow any
+	allowedOrigins   []string
+	allowedOriginsMu sync.Mutex
+
+	// Most WebSocket clients served at once, or 0 for no limit
+	maxConnections int
+)
+
+// Reasons sent along with WebSocket close codes
+const (
+	closeReasonBanned   = "Account is banned"
+	closeReasonShutdown = "Server is shutting down"
+	closeReasonCapacity = "Server is at capacity, try again later"
+	closeReasonRotated  = "Connection reached its lifetime, reconnect"
+	closeReasonInvalid  = "Invalid message"
+)
+
+// originAllowed lets a WebSocket handshake through when it comes from the
+// server's own pages, an allowed origin, or a client that isn't a browser
+// and so sends no Origin
+func originAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+
+	allowedOriginsMu.Lock()
+	defer allowedOriginsMu.Unlock()
+	if len(allowedOrigins) == 0 {
+		return true
+	}
+	for _, allowed := range allowedOrigins {
+		if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+/////////////////////////////
+// WebSocket Chat Handlers //
+/////////////////////////////
+
+// isChatPath reports whether a request is for the chat WebSocket, at /ws
+// or /ws/{room}
+func isChatPath(path string) bool {
+	return path == "/ws" || strings.HasPrefix(path, "/ws/")
+}
+
+// Handle WebSocket connections
+func handleConnections(w http.ResponseWriter, r *http.Request) {
+	// The WebSocket handshake is only defined for HTTP/1.1; HTTP/2 clients
+	// must open a separate HTTP/1.1 connection for /ws
+	if r.ProtoMajor != 1 {
+		http.Error(w, "WebSocket requires HTTP/1.1", http.StatusHTTPVersionNotSupported)
+		return
+	}
+
+	// Clients pick a room with /ws/{room} or ?room=, defaulting to the
+	// general room, and can switch rooms once connected
+	roomName := mux.Vars(r)["room"]
+	if roomName == "" {
+		roomName = r.URL.Query().Get("room")
+	}
+	if roomName == "" {
+		roomName = defaultRoomName
+	}
+	room, err := findOrCreateRoom(r, requestWorkspace(r), roomName)
+	if errors.Is(err, errNotFound) {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tags, err := connectionTags(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Clients reconnecting after a shutdown resume with ?since=
+	since, resuming, err := resumeSince(r)
+	if err != nil {
+		http.Error(w, "Invalid since", http.StatusBadRequest)
+		return
+	}
+	lastID, err := resumeLastID(r)
+	if err != nil {
+		http.Error(w, "Invalid lastId", http.StatusBadRequest)
+		return
+	}
+	if wait := throttleConnect(r); wait > 0 {
+		writeConnectThrottled(w, wait)
+		return
+	}
+	caps, negotiated := clientCapabilities(r)
+
+	// Upgrade initial GET request to a WebSocket
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("WebSocket upgrade error from %s: %v", clientIP(r), err)
+		return
+	}
+	defer ws.Close()
+	ws.EnableWriteCompression(slices.Contains(caps, capCompression))
+
+	setReadLimit(ws)
+
+	// Logged-in users always post under their account name
+	user, loggedIn := currentUser(r)
+	locale := requestLocale(r)
+
+	// Register new client in its room, unless the server is full
+	now := time.Now().UTC()
+	send, done := make(chan any, queueSize(caps, resuming)), make(chan struct{})
+	if negotiated {
+		send <- CapabilitiesFrame{Capabilities: caps}
+	}
+	registered := hub.registerClient(ws, chatClient{roomID: room.ID, userID: user.ID, info: ConnectionInfo{
+		Username:     user.Username,
+		Workspace:    requestWorkspace(r).Slug,
+		Room:         room.Name,
+		UserAgent:    r.UserAgent(),
+		Tags:         tags,
+		ConnectedAt:  now,
+		LastActivity: now,
+	}, caps: caps, batch: newClientBatch(caps), send: send, done: done,
+		// What is broadcast from here on waits until the client has what
+		// came before
+		held: new([]any)})
+	if !registered {
+		closeConn(ws, websocket.CloseTryAgainLater, translate(locale, closeReasonCapacity))
+		return
+	}
+	go writePump(ws, caps, send, done)
+	defer hub.unregisterClient(ws)
+	if lifetime := connectionLifetime(); lifetime > 0 {
+		timer := time.AfterFunc(lifetime, func() { rotateConnection(ws, translate(locale, closeReasonRotated)) })
+		defer timer.Stop()
+	}
+	joinCluster(room, user, loggedIn)
+	// Leave whichever room the client is in by then
+	defer func() { leaveCluster(room, user, loggedIn) }()
+	if resuming {
+		if err := resumeClient(r.Context(), ws, room, since, lastID); err != nil {
+			log.Printf("Resuming %s for %s failed: %v", room.Name, clientIP(r), err)
+		}
+	} else {
+		// New clients see what was said before they came in
+		sendHistory(r.Context(), ws, room)
+	}
+	sendMaintenanceNotice(ws)
+	publishEvent(room.WorkspaceID, eventUserJoined, room.Name, UserJoinedEvent{Username: user.Username, Room: room.Name})
+	var token *APIToken
+	if t, ok := requestAPIToken(r); ok {
+		token = &t
+	}
+
+	// Every message goes through the pipeline, which saves and broadcasts it
+	pipeline := newMessagePipeline()
+
+	// One frame is read into over and over rather than allocating one per
+	// message. It is cleared first so no field carries over, and what
+	// goes on from it is copied out.
+	var in clientFrame
+	for first := true; ; first = false {
+		in = clientFrame{}
+		// Read new message as JSON and map it to a Message object
+		err := ws.ReadJSON(&in)
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+			closeConn(ws, websocket.CloseInvalidFramePayloadData, closeReasonInvalid)
+			break
+		}
+		if errors.Is(err, websocket.ErrReadLimit) {
+			oversizedFrames.Add(1)
+		}
+		if err != nil {
+			log.Printf("WebSocket read error from %s: %v", clientIP(r), err)
+			break
+		}
+		if in.Backfill != nil {
+			writeToClient(ws, backfill(room.ID, *in.Backfill))
+			continue
+		}
+		if in.Auth != "" {
+			if !first || loggedIn {
+				writeToClient(ws, errorFrame(rejectAccessToken, translate(locale, "Send the access token in the first frame")))
+				continue
+			}
+			authed, err := verifyAccessToken(r.Context(), in.Auth)
+			if err != nil {
+				writeToClient(ws, errorFrame(rejectAccessToken, translate(locale, "Invalid or expired access token")))
+				continue
+			}
+			// Guests may be let into a workspace's anonymous chat, but
+			// the account they log in as has to belong to it
+			if !isWorkspaceMember(r.Context(), requestWorkspace(r), authed.ID) {
+				writeToClient(ws, errorFrame(rejectAccessToken, translate(locale, "Not a member of this workspace")))
+				continue
+			}
+			user, loggedIn = authed, true
+			logInClient(ws, room, user)
+			writeToClient(ws, LoggedInFrame{LoggedIn: user.Username})
+			continue
+		}
+		if in.Join != "" {
+			next, err := findOrCreateRoom(r, requestWorkspace(r), in.Join)
+			if errors.Is(err, errNotFound) {
+				writeToClient(ws, errorFrame(rejectRoomNotFound, translate(locale, "Room not found")))
+				continue
+			}
+			if err != nil {
+				log.Printf("Joining %s for %s failed: %v", in.Join, clientIP(r), err)
+				continue
+			}
+			moveClient(ws, room, next, user, loggedIn)
+			room = next
+			sendHistory(r.Context(), ws, room)
+			publishEvent(room.WorkspaceID, eventUserJoined, room.Name, UserJoinedEvent{Username: user.Username, Room: room.Name})
+			continue
+		}
+		if in.Leave {
+			if room.ID != 0 {
+				moveClient(ws, room, Room{}, user, loggedIn)
+				room = Room{}
+			}
+			continue
+		}
+		msg := in.Message
+		if room.ID == 0 {
+			frame := errorFrame(rejectNoRoom, translate(locale, "Join a room first"))
+			frame.ClientMsgID = msg.ClientMsgID
+			writeToClient(ws, frame)
+			continue
+		}
+		msg.Seq = 0 // Numbered when it is broadcast
+		if loggedIn {
+			msg.Username = user.Username
+			msg.UserID = user.ID
+		}
+		msg.Room = room.Name
+		msg.RoomID = room.ID
+		msg.CreatedAt = time.Now().UTC()
+		touchClient(ws, msg.CreatedAt)
+
+		// A message the client queued while reconnecting may have gone
+		// out before the connection dropped; it gets that copy back
+		// instead of posting it twice
+		if msg.ClientMsgID != "" {
+			if sent, ok := deliveredCopy(msg); ok {
+				writeToClient(ws, sent)
+				continue
+			}
+		}
+
+		err = pipeline(&MessageContext{
+			Request:  r,
+			User:     user,
+			LoggedIn: loggedIn,
+			Token:    token,
+			Room:     room,
+			Message:  msg,
+		})
+		var rejection *MessageRejection
+		if errors.As(err, &rejection) && rejection.Close {
+			closeConn(ws, websocket.ClosePolicyViolation, rejection.localized(locale))
+			break
+		}
+		if rejection != nil {
+			// Only the sender hears about a dropped message
+			writeToClient(ws, rejectionFrame(rejection, locale, msg.ClientMsgID))
+		} else if err != nil {
+			log.Printf("Message pipeline error from %s: %v", clientIP(r), err)
+		}
+	}
+}
+
+// Broadcast messages to all connected clients. In a cluster, messages
+// for rooms another node owns are handed to it instead.
+func handleMessages() {
+	for {
+		// Grab the next message from the broadcast channel
+		var msg Message
+		select {
+		case msg = <-broadcast:
+			if cluster != nil {
+				if owner := cluster.owner(msg.RoomID); owner != cluster.id {
+					cluster.forward(owner, msg, 0)
+					continue
+				}
+			}
+		case msg = <-clusterInbox:
+		}
+		sequenceMessage(&msg)
+		// Send it out to every client connected to the same room, here
+		// and on the other nodes
+		deliverToClients(msg)
+		if cluster != nil {
+			cluster.fanOut(msg)
+		}
+		// And to the room's webhooks, bridges and the event bridge
+		queueWebhookDeliveries(msg)
+		if mqttBridge != nil {
+			mqttBridge.publishMessage(msg)
+		}
+		if xmppGateway != nil {
+			xmppGateway.deliver(msg)
+		}
+		if discordBridge != nil {
+			discordBridge.deliver(msg)
+		}
+		publishEvent(msg.WorkspaceID, eventMessageCreated, msg.Room, msg)
+	}
+}
+
+// deliverToClients hands a message to the hub for this node's clients in
+// its room
+func deliverToClients(msg Message) {
+	recordFrame(msg)
+	msg.broadcast = newBroadcastTiming(msg.CreatedAt)
+	hub.broadcast <- msg
+}
+
+// writeToClient queues a frame for one client
+func writeToClient(ws *websocket.Conn, v any) error {
+	var err error
+	hub.do(func() { err = hub.write(ws, v) })
+	return err
+}
+
+// closeConn sends a close frame with the code and reason, then hangs up
+func closeConn(ws *websocket.Conn, code int, reason string) {
+	msg := websocket.FormatCloseMessage(code, reason)
+	ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	ws.Close()
+}
+
+// closeClients disconnects every client that match selects
+func closeClients(match func(chatClient) bool, code int, reason string) {
+	hub.do(func() {
+		for ws, c := range hub.clients {
+			if match(c) {
+				hub.hangUp(ws, code, reason)
+			}
+		}
+	})
+}
+
+/////////
+// Hub //
+/////////
+
+// Hub keeps the clients connected to this node. Its run loop is the only
+// goroutine that touches them: connections register and unregister
+// through it, it delivers the broadcasts, and whatever else reads or
+// changes a client runs on it through do. It only ever queues frames for
+// the clients' pumps, so it never waits on a connection.
+type Hub struct {
+	clients map[*websocket.Conn]chatClient
+
+	register   chan hubRegistration
+	unregister chan *websocket.Conn
+	broadcast  chan Message // Messages for the clients in their room
+	calls      chan func()
+
+	lastConnectionID int
+}
+
+// hubRegistration is a new connection joining the hub
+type hubRegistration struct {
+	ws       *websocket.Conn
+	client   chatClient
+	accepted chan<- bool // Whether it joined, as it doesn't when the node is full
+}
+
+// newHub returns a hub without clients. Its loop has to be started.
+func newHub() *Hub {
+	return &Hub{
+		clients:    make(map[*websocket.Conn]chatClient),
+		register:   make(chan hubRegistration),
+		unregister: make(chan *websocket.Conn),
+		broadcast:  make(chan Message),
+		calls:      make(chan func()),
+	}
+}
+
+// run serves the hub's channels, and flushes the clients' broadcast
+// batches once per batch interval
+func (h *Hub) run() {
+	var flush <-chan time.Time
+	if broadcastBatchInterval > 0 {
+		flush = time.Tick(broadcastBatchInterval)
+	}
+	for {
+		select {
+		case reg := <-h.register:
+			reg.accepted <- h.add(reg.ws, reg.client)
+		case ws := <-h.unregister:
+			h.drop(ws)
+		case msg := <-h.broadcast:
+			h.deliver(msg)
+		case fn := <-h.calls:
+			fn()
+		case now := <-flush:
+			for ws, c := range h.clients {
+				// Clients that fell behind are dropped by the write
+				h.flushBatch(ws, c, now)
+			}
+		}
+	}
+}
+
+// do runs fn on the hub's loop, where it may use the clients, and waits
+// for it. Functions running on the loop must not call it.
+func (h *Hub) do(fn func()) {
+	done := make(chan struct{})
+	h.calls <- func() {
+		defer close(done)
+		fn()
+	}
+	<-done
+}
+
+// registerClient adds a client to the hub, or reports false when the node
+// is at its connection limit
+func (h *Hub) registerClient(ws *websocket.Conn, c chatClient) bool {
+	accepted := make(chan bool, 1)
+	h.register <- hubRegistration{ws, c, accepted}
+	return <-accepted
+}
+
+// unregisterClient stops broadcasting to a client
+func (h *Hub) unregisterClient(ws *websocket.Conn) {
+	h.unregister <- ws
+}
+
+// add numbers a new client's connection and adds it, unless the node is
+// full
+func (h *Hub) add(ws *websocket.Conn, c chatClient) bool {
+	if maxConnections > 0 && len(h.clients) >= maxConnections {
+		return false
+	}
+	h.lastConnectionID++
+	c.info.ID = h.lastConnectionID
+	h.clients[ws] = c
+	return true
+}
+
+// deliver queues a message for the clients in its room
+func (h *Hub) deliver(msg Message) {
+	timing := msg.broadcast
+	timing.lockWait = time.Since(timing.handedOver)
+	now := time.Now()
+	for ws, c := range h.clients {
+		if c.roomID != msg.RoomID {
+			continue
+		}
+		timing.writes++
+		timing.queued()
+		if c.batch != nil && !c.batch.sendNow(msg, now) {
+			continue
+		}
+		if errors.Is(h.write(ws, msg), errSlowClient) {
+			timing.dropped++
+		}
+	}
+	// Recorded once the last client has written the message
+	timing.done()
+}
+
+// write queues a frame for a client's pump, or holds it back while the
+// client is sent what came before. A client whose queue is full is
+// dropped instead of holding up the hub.
+func (h *Hub) write(ws *websocket.Conn, v any) error {
+	c, ok := h.clients[ws]
+	if !ok {
+		return nil
+	}
+	if c.held != nil {
+		// Held back frames count against the queue too
+		if len(*c.held) < max(hubConfig.ClientQueue, 1) {
+			*c.held = append(*c.held, v)
+			return nil
+		}
+		frameDone(v)
+		return h.dropSlow(ws, c)
+	}
+	select {
+	case c.send <- v:
+		return nil
+	default:
+		frameDone(v)
+		return h.dropSlow(ws, c)
+	}
+}
+
+// dropSlow hangs up on a client whose queue is full
+func (h *Hub) dropSlow(ws *websocket.Conn, c chatClient) error {
+	log.Printf("WebSocket client %d fell behind, dropping it", c.info.ID)
+	ws.Close()
+	h.drop(ws)
+	return errSlowClient
+}
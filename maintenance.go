@@ -0,0 +1,192 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// MaintenanceState is the soft maintenance mode, which keeps the server
+// up but read-only, e.g. during a migration. Admins and logins still get
+// through, so it can be turned off again. It's kept in the store, so it
+// outlasts restarts and nodes that join meanwhile start in it.
+type MaintenanceState struct {
+	Enabled bool       `json:"enabled"`
+	Message string     `json:"message,omitempty"` // Banner shown to chat clients
+	Since   *time.Time `json:"since,omitempty"`
+}
+
+// MaintenanceNotice is the frame chat clients get when maintenance starts
+// or ends, and when they connect while it lasts
+type MaintenanceNotice struct {
+	Maintenance MaintenanceState `json:"maintenance"`
+}
+
+// Code of messages rejected during maintenance
+const rejectMaintenance = "server.maintenance"
+
+// Name of the pipeline step rejecting messages during maintenance
+const stepMaintenance = "maintenance"
+
+// Key of the maintenance state in the store
+const maintenanceStateKey = "maintenance"
+
+// Requests that still get through during maintenance besides the admin
+// API: logging in, with its second factor, and logging out
+var maintenanceExemptPaths = []string{
+	"/auth/login",
+	"/auth/2fa",
+	"/auth/2fa/sms",
+	"/auth/logout",
+}
+
+var (
+	maintenance   MaintenanceState
+	maintenanceMu sync.Mutex
+)
+
+func currentMaintenance() MaintenanceState {
+	maintenanceMu.Lock()
+	defer maintenanceMu.Unlock()
+	return maintenance
+}
+
+// loadMaintenance resumes the maintenance mode saved in the store, if any.
+// It runs at startup, before clients connect.
+func loadMaintenance(ctx context.Context) error {
+	saved, err := store.GetServerState(ctx, maintenanceStateKey)
+	if errors.Is(err, errNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state MaintenanceState
+	if err := json.Unmarshal([]byte(saved), &state); err != nil {
+		return fmt.Errorf("saved maintenance state: %w", err)
+	}
+	maintenanceMu.Lock()
+	maintenance = state
+	maintenanceMu.Unlock()
+	if state.Enabled {
+		log.Printf("Maintenance mode is on since %s", state.Since.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// setMaintenance switches maintenance mode on this node and tells its
+// chat clients
+func setMaintenance(state MaintenanceState) {
+	maintenanceMu.Lock()
+	maintenance = state
+	maintenanceMu.Unlock()
+
+	hub.do(func() {
+		for ws := range hub.clients {
+			hub.write(ws, MaintenanceNotice{Maintenance: state})
+		}
+	})
+}
+
+// maintenanceReason is what senders and API callers are told during
+// maintenance
+func maintenanceReason(state MaintenanceState) string {
+	if state.Message != "" {
+		return "The server is in maintenance mode: " + state.Message
+	}
+	return "The server is in maintenance mode; try again later"
+}
+
+// maintenanceMiddleware answers 503 Service Unavailable to requests that
+// would change anything during maintenance, except for the admin API and
+// logging in and out. Registering, password resets and the like wait.
+func maintenanceMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state := currentMaintenance()
+		readOnly := r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions
+		exempt := strings.HasPrefix(r.URL.Path, "/admin/") || slices.Contains(maintenanceExemptPaths, r.URL.Path)
+		if state.Enabled && !readOnly && !exempt {
+			w.Header().Set("Retry-After", "60")
+			http.Error(w, maintenanceReason(state), http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rejectDuringMaintenance rejects chat messages during maintenance
+func rejectDuringMaintenance(next MessageHandler) MessageHandler {
+	return func(mc *MessageContext) error {
+		state := currentMaintenance()
+		if state.Enabled && state.Message != "" {
+			return rejectMessage(rejectMaintenance, "The server is in maintenance mode: %s", state.Message)
+		}
+		if state.Enabled {
+			return rejectMessage(rejectMaintenance, "The server is in maintenance mode; try again later")
+		}
+		return next(mc)
+	}
+}
+
+// sendMaintenanceNotice tells a client that just connected about ongoing
+// maintenance
+func sendMaintenanceNotice(ws *websocket.Conn) {
+	if state := currentMaintenance(); state.Enabled {
+		writeToClient(ws, MaintenanceNotice{Maintenance: state})
+	}
+}
+
+////////////////////////////////////
+// Maintenance Admin API Handlers //
+////////////////////////////////////
+
+// Get the maintenance mode (GET /admin/maintenance)
+func getMaintenance(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(currentMaintenance())
+}
+
+// Turn maintenance mode on or off on every node (PUT /admin/maintenance)
+func updateMaintenance(w http.ResponseWriter, r *http.Request) {
+	var state MaintenanceState
+	if err := json.NewDecoder(r.Body).Decode(&state); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	state.Message = strings.TrimSpace(state.Message)
+	state.Since = nil
+	if state.Enabled {
+		now := time.Now().UTC()
+		state.Since = &now
+	} else {
+		state.Message = ""
+	}
+
+	saved, err := json.Marshal(state)
+	if err == nil {
+		err = store.SetServerState(r.Context(), maintenanceStateKey, string(saved))
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	setMaintenance(state)
+	if cluster != nil {
+		cluster.broadcast(clusterEnvelope{From: cluster.id, Kind: envelopeMaintenance, Maintenance: &state})
+	}
+
+	action := "maintenance.end"
+	if state.Enabled {
+		action = "maintenance.start"
+	}
+	recordAudit(r, action, "", state.Message)
+	json.NewEncoder(w).Encode(state)
+}
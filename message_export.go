@@ -0,0 +1,162 @@
+package chat
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Messages loaded from the store at a time while exporting
+const exportPageSize = 500
+
+// exportTime parses a ?from= or ?to= bound: a date, which to includes, or
+// an RFC 3339 time. The zero time leaves the bound open.
+func exportTime(s string, end bool) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if day, err := time.Parse(time.DateOnly, s); err == nil {
+		if end {
+			day = day.AddDate(0, 0, 1)
+		}
+		return day, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, errors.New("expected a date like 2024-03-01 or a time like 2024-03-01T12:00:00Z")
+	}
+	return t.UTC(), nil
+}
+
+// csvCell keeps a spreadsheet from reading a cell as a formula, by putting
+// a quote in front of text that starts like one
+func csvCell(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// Export the messages the caller posted in the workspace's rooms, oldest
+// first, for keeping a personal copy (GET /me/messages/export). ?format=
+// is json (default) or csv; ?from= and ?to= limit the dates. Archived
+// messages come first, as they are the oldest.
+func exportMyMessages(w http.ResponseWriter, r *http.Request) {
+	user, _ := currentUser(r)
+	q := r.URL.Query()
+	format := q.Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "csv" {
+		http.Error(w, "format must be json or csv", http.StatusBadRequest)
+		return
+	}
+	from, err := exportTime(q.Get("from"), false)
+	if err != nil {
+		http.Error(w, "Invalid from: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	until, err := exportTime(q.Get("to"), true)
+	if err != nil {
+		http.Error(w, "Invalid to: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if until.IsZero() {
+		until = time.Now().UTC()
+	}
+
+	// The user's archived messages are read up front. Messages still in
+	// the write-behind queue are written out, so the export has them.
+	ws := requestWorkspace(r)
+	rooms, err := store.ListRooms(r.Context(), ws.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	archived, err := archivedUserMessages(rooms, user.ID, from, until)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	messageQueue.Flush()
+
+	// Stored messages are written as they are loaded, so once the first
+	// page is out an error can only cut the export short
+	page, err := store.ListUserMessages(r.Context(), ws.ID, user.ID, from, until, 0, exportPageSize)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	name := "messages-" + user.Username + "-" + time.Now().UTC().Format(time.DateOnly) + "." + format
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+
+	var write func(Message) error
+	var finish func() error
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"id", "room", "createdAt", "content", "attachments"})
+		write = func(m Message) error {
+			urls := make([]string, 0, len(m.Attachments))
+			for _, a := range m.Attachments {
+				urls = append(urls, a.URL)
+			}
+			return cw.Write([]string{strconv.Itoa(m.ID), csvCell(m.Room), m.CreatedAt.UTC().Format(time.RFC3339Nano),
+				csvCell(m.Content), csvCell(strings.Join(urls, " "))})
+		}
+		finish = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+	} else {
+		enc := json.NewEncoder(w)
+		n := 0
+		write = func(m Message) error {
+			sep := ","
+			if n == 0 {
+				sep = "["
+			}
+			n++
+			if _, err := io.WriteString(w, sep); err != nil {
+				return err
+			}
+			return enc.Encode(m)
+		}
+		finish = func() error {
+			if n == 0 {
+				io.WriteString(w, "[")
+			}
+			_, err := io.WriteString(w, "]\n")
+			return err
+		}
+	}
+
+	for _, m := range archived {
+		if err := write(m); err != nil {
+			return
+		}
+	}
+	for len(page) > 0 {
+		for _, m := range page {
+			if err := write(m); err != nil {
+				return
+			}
+		}
+		if len(page) < exportPageSize {
+			break
+		}
+		page, err = store.ListUserMessages(r.Context(), ws.ID, user.ID, from, until, page[len(page)-1].ID, exportPageSize)
+		if err != nil {
+			log.Printf("Exporting the messages of %s failed: %v", user.Username, err)
+			return
+		}
+	}
+	finish()
+}
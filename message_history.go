@@ -0,0 +1,97 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/websocket"
+)
+
+// Pages of GET /messages hold this many messages unless asked for fewer
+const (
+	historyPageSize    = 50
+	historyMaxPageSize = 200
+)
+
+// Messages sent to a client when it connects or joins a room, or 0 for
+// none
+var historyOnConnect = 50
+
+// HistoryFrame carries the latest messages of a room, oldest first, to a
+// client that just connected or joined it. Clients without the history
+// capability get them as separate messages.
+type HistoryFrame struct {
+	History []Message `json:"history"`
+}
+
+// sendHistory sends a client the latest messages of the room it connected
+// to or joined, then what was held back for it since. The write-behind
+// queue is written out first, so the messages posted just before are in
+// the store.
+func sendHistory(ctx context.Context, ws *websocket.Conn, room Room) {
+	var msgs []Message
+	if historyOnConnect > 0 && room.ID != 0 {
+		if messageQueue != nil {
+			messageQueue.Flush()
+		}
+		var err error
+		msgs, err = chatService.History(ctx, room, 0, historyOnConnect)
+		if err != nil {
+			log.Printf("Loading the history of %s failed: %v", room.Name, err)
+		}
+	}
+	releaseClient(ws, msgs, true)
+}
+
+// Get a page of a room's messages, oldest first, for scrolling back through
+// its history (GET /messages?room=&before=&limit=). Passing the ID of the
+// first message as before gets the page before it; an empty page means
+// there are no older messages.
+func getMessages(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	name := q.Get("room")
+	if name == "" {
+		name = defaultRoomName
+	}
+	before := 0
+	if s := q.Get("before"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			http.Error(w, "before must be a message ID", http.StatusBadRequest)
+			return
+		}
+		before = n
+	}
+	limit := historyPageSize
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			http.Error(w, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, historyMaxPageSize)
+	}
+
+	room, err := store.FindRoom(r.Context(), requestWorkspace(r).ID, name)
+	if errors.Is(err, errNotFound) {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	msgs, err := chatService.History(r.Context(), room, before, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if msgs == nil {
+		msgs = []Message{}
+	}
+	json.NewEncoder(w).Encode(msgs)
+}
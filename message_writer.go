@@ -0,0 +1,139 @@
+package chat
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// MessageWriterConfig tunes the write-behind queue for chat messages
+type MessageWriterConfig struct {
+	FlushInterval time.Duration // Longest a message waits before it's written
+	BatchSize     int           // Messages written per batch; a full batch is written at once
+}
+
+// messageWriter persists chat messages in the background so the read loop
+// of a connection never waits on the database. Messages are collected and
+// written in batches, either when a batch fills up or when the flush
+// interval passes.
+type messageWriter struct {
+	repo  MessageRepository
+	cfg   MessageWriterConfig
+	queue chan Message
+	flush chan chan struct{} // Requests to write the pending batch now
+	done  chan struct{}
+
+	// Guards queue against sends after Close
+	mu     sync.RWMutex
+	closed bool
+}
+
+// Active message writer, started at startup
+var messageQueue *messageWriter
+
+func newMessageWriter(repo MessageRepository, cfg MessageWriterConfig) *messageWriter {
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 1
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = time.Second
+	}
+
+	w := &messageWriter{
+		repo:  repo,
+		cfg:   cfg,
+		queue: make(chan Message, cfg.BatchSize),
+		flush: make(chan chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// Enqueue schedules a message to be saved. It only blocks when the
+// database falls so far behind that the queue is full.
+func (w *messageWriter) Enqueue(msg Message) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	if w.closed {
+		log.Printf("Message writer closed, dropping message from %s", msg.Username)
+		return
+	}
+	w.queue <- msg
+}
+
+// Flush writes everything queued so far and returns once it is saved
+func (w *messageWriter) Flush() {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	if w.closed {
+		return
+	}
+	written := make(chan struct{})
+	w.flush <- written
+	<-written
+}
+
+// Close stops accepting messages and waits until everything queued has
+// been written
+func (w *messageWriter) Close() {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	w.mu.Unlock()
+
+	<-w.done
+}
+
+func (w *messageWriter) run() {
+	defer close(w.done)
+
+	ticker := time.NewTicker(w.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]Message, 0, w.cfg.BatchSize)
+	for {
+		select {
+		case msg, ok := <-w.queue:
+			if !ok {
+				w.write(batch)
+				return
+			}
+			batch = append(batch, msg)
+			if len(batch) >= w.cfg.BatchSize {
+				w.write(batch)
+				batch = batch[:0]
+			}
+		case written := <-w.flush:
+			// Take whatever is still buffered in the queue too
+			for len(w.queue) > 0 {
+				batch = append(batch, <-w.queue)
+			}
+			w.write(batch)
+			batch = batch[:0]
+			close(written)
+		case <-ticker.C:
+			w.write(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+// write saves a batch, logging the messages that couldn't be saved
+func (w *messageWriter) write(batch []Message) {
+	if len(batch) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := w.repo.SaveMessages(ctx, batch); err != nil {
+		log.Printf("Failed to save %d chat messages: %v", len(batch), err)
+	}
+}
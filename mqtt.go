@@ -0,0 +1,282 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// MQTTConfig holds the settings of the MQTT bridge, which lets devices
+// chat and create tasks through an MQTT broker instead of WebSockets.
+// Under TopicPrefix, the bridge uses these topics:
+//
+//	{workspace}/rooms/{room}/messages  every message posted in the room
+//	{workspace}/rooms/{room}/post      devices publish an MQTTPost to chat
+//	{workspace}/rooms/{room}/errors    why a post was rejected
+//	{workspace}/tasks/create           devices publish an MQTTTask
+//	{workspace}/tasks/errors           why a task wasn't created
+//
+// Devices authenticate with an API token in each payload: posting needs
+// the chat:post scope and creating tasks the tasks scope.
+type MQTTConfig struct {
+	BrokerURL   string // e.g. tcp://localhost:1883; empty disables the bridge
+	ClientID    string
+	Username    string
+	Password    string
+	TopicPrefix string
+}
+
+// MQTTPost is the payload devices publish to post a chat message
+type MQTTPost struct {
+	Token   string `json:"token"`
+	Content string `json:"content"`
+}
+
+// MQTTTask is the payload devices publish to create a task
+type MQTTTask struct {
+	Token       string `json:"token"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Status      string `json:"status"`
+}
+
+// MQTT bridge connected at startup, or nil when it is disabled
+var mqttBridge *mqttAdapter
+
+// mqttAdapter maps chat rooms and the task API to MQTT topics
+type mqttAdapter struct {
+	client mqtt.Client
+	prefix string
+
+	mu         sync.Mutex
+	pipelines  map[int]MessageHandler // By user ID, so rate limits apply per user
+	roomTopics map[int]string         // Message topic by room ID
+}
+
+// newMQTTBridge connects to the broker and subscribes to the topics
+// devices publish to
+func newMQTTBridge(cfg MQTTConfig) (*mqttAdapter, error) {
+	if cfg.BrokerURL == "" {
+		return nil, nil
+	}
+	b := &mqttAdapter{
+		prefix:     strings.TrimSuffix(cfg.TopicPrefix, "/"),
+		pipelines:  make(map[int]MessageHandler),
+		roomTopics: make(map[int]string),
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(cfg.BrokerURL).
+		SetClientID(cfg.ClientID).
+		SetUsername(cfg.Username).
+		SetPassword(cfg.Password).
+		SetAutoReconnect(true).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			log.Printf("MQTT connection lost: %v", err)
+		}).
+		// Subscriptions don't survive a reconnect to a clean session
+		SetOnConnectHandler(b.subscribe)
+
+	b.client = mqtt.NewClient(opts)
+	token := b.client.Connect()
+	if !token.WaitTimeout(10 * time.Second) {
+		return nil, fmt.Errorf("connecting to %s timed out", cfg.BrokerURL)
+	}
+	if err := token.Error(); err != nil {
+		return nil, err
+	}
+	log.Printf("MQTT bridge connected to %s", cfg.BrokerURL)
+	return b, nil
+}
+
+func (b *mqttAdapter) subscribe(client mqtt.Client) {
+	filters := map[string]byte{
+		b.prefix + "/+/rooms/+/post": 1,
+		b.prefix + "/+/tasks/create": 1,
+	}
+	token := client.SubscribeMultiple(filters, b.handle)
+	if token.WaitTimeout(10*time.Second) && token.Error() != nil {
+		log.Printf("MQTT subscribe error: %v", token.Error())
+	}
+}
+
+// handle dispatches a message published by a device
+func (b *mqttAdapter) handle(_ mqtt.Client, m mqtt.Message) {
+	parts := strings.Split(strings.TrimPrefix(m.Topic(), b.prefix+"/"), "/")
+	switch {
+	case len(parts) == 4 && parts[1] == "rooms" && parts[3] == "post":
+		if err := b.post(parts[0], parts[2], m.Payload()); err != nil {
+			b.publish(fmt.Sprintf("%s/%s/rooms/%s/errors", b.prefix, parts[0], parts[2]), errorFrame("", err.Error()))
+		}
+	case len(parts) == 3 && parts[1] == "tasks" && parts[2] == "create":
+		if err := b.createTask(parts[0], m.Payload()); err != nil {
+			b.publish(fmt.Sprintf("%s/%s/tasks/errors", b.prefix, parts[0]), errorFrame("", err.Error()))
+		}
+	}
+}
+
+// authenticate resolves the workspace and the API token a device sent,
+// returning a request carrying them as the HTTP middleware would
+func (b *mqttAdapter) authenticate(slug, secret string) (*http.Request, User, APIToken, error) {
+	ctx, cancel := storeContext()
+	defer cancel()
+	ws, ok := findWorkspaceBySlug(ctx, slug)
+	if !ok {
+		return nil, User{}, APIToken{}, errors.New("Workspace not found")
+	}
+	r := bridgeRequest(ws, "mqtt")
+	if !featureEnabled(r, featureAPITokens) {
+		return nil, User{}, APIToken{}, errors.New("API token access is disabled")
+	}
+
+	token, ok := findAPIToken(ctx, secret)
+	if !ok {
+		return nil, User{}, APIToken{}, errors.New("Invalid or expired API token")
+	}
+	user, ok := findUserByID(ctx, token.UserID)
+	if !ok || user.Banned {
+		return nil, User{}, APIToken{}, errors.New("Invalid or expired API token")
+	}
+	if !isWorkspaceMember(ctx, ws, user.ID) {
+		return nil, User{}, APIToken{}, errors.New("Not a member of this workspace")
+	}
+
+	ctx = context.WithValue(r.Context(), userContextKey{}, user)
+	ctx = context.WithValue(ctx, apiTokenContextKey{}, token)
+	return r.WithContext(ctx), user, token, nil
+}
+
+// post sends a device's chat message through the message pipeline
+func (b *mqttAdapter) post(slug, roomName string, payload []byte) error {
+	var req MQTTPost
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return err
+	}
+	r, user, token, err := b.authenticate(slug, req.Token)
+	if err != nil {
+		return err
+	}
+	room, err := findOrCreateRoom(r, requestWorkspace(r), roomName)
+	if errors.Is(err, errNotFound) {
+		return errors.New("Room not found")
+	}
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	pipeline, ok := b.pipelines[user.ID]
+	if !ok {
+		pipeline = newMessagePipeline()
+		b.pipelines[user.ID] = pipeline
+	}
+	b.mu.Unlock()
+
+	err = pipeline(&MessageContext{
+		Request:  r,
+		User:     user,
+		LoggedIn: true,
+		Token:    &token,
+		Room:     room,
+		Message: Message{
+			Username:  user.Username,
+			Content:   req.Content,
+			Room:      room.Name,
+			RoomID:    room.ID,
+			UserID:    user.ID,
+			CreatedAt: time.Now().UTC(),
+		},
+	})
+	var rejection *MessageRejection
+	if errors.As(err, &rejection) {
+		return errors.New(rejection.Reason)
+	}
+	return err
+}
+
+// createTask creates a task from a device's payload
+func (b *mqttAdapter) createTask(slug string, payload []byte) error {
+	var req MQTTTask
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return err
+	}
+	r, user, token, err := b.authenticate(slug, req.Token)
+	if err != nil {
+		return err
+	}
+	if !token.hasScope(scopeTasks) {
+		return errors.New("API token doesn't have the tasks scope")
+	}
+	if strings.TrimSpace(req.Title) == "" {
+		return errors.New("Title is required")
+	}
+	_, err = taskService.Create(r.Context(), requestWorkspace(r), Task{
+		Title:       req.Title,
+		Description: req.Description,
+		Status:      req.Status,
+	}, TaskWriteOptions{By: user.Username})
+	return err
+}
+
+// publishMessage forwards a broadcast message to its room's topic
+func (b *mqttAdapter) publishMessage(msg Message) {
+	topic, err := b.roomTopic(msg.RoomID)
+	if err != nil {
+		log.Printf("MQTT: no topic for room %d: %v", msg.RoomID, err)
+		return
+	}
+	b.publish(topic, msg)
+}
+
+// roomTopic returns the messages topic of a room. Rooms are looked up
+// once; they are never renamed or moved.
+func (b *mqttAdapter) roomTopic(roomID int) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if topic, ok := b.roomTopics[roomID]; ok {
+		return topic, nil
+	}
+
+	ctx, cancel := storeContext()
+	defer cancel()
+	workspaces, err := store.ListWorkspaces(ctx)
+	if err != nil {
+		return "", err
+	}
+	for _, ws := range workspaces {
+		rooms, err := store.ListRooms(ctx, ws.ID)
+		if err != nil {
+			return "", err
+		}
+		for _, room := range rooms {
+			b.roomTopics[room.ID] = fmt.Sprintf("%s/%s/rooms/%s/messages", b.prefix, ws.Slug, room.Name)
+		}
+	}
+	if topic, ok := b.roomTopics[roomID]; ok {
+		return topic, nil
+	}
+	return "", errNotFound
+}
+
+// publish sends v as JSON without waiting for the broker
+func (b *mqttAdapter) publish(topic string, v any) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("MQTT: %v", err)
+		return
+	}
+	b.client.Publish(topic, 1, false, payload)
+}
+
+// Close disconnects from the broker, giving in-flight messages a moment
+func (b *mqttAdapter) Close() {
+	b.client.Disconnect(250)
+}
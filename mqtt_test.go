@@ -0,0 +1,155 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// fakeMQTTClient records what the bridge publishes instead of talking to
+// a broker
+type fakeMQTTClient struct {
+	mqtt.Client
+
+	mu        sync.Mutex
+	published map[string][]string // Payloads by topic
+}
+
+func (c *fakeMQTTClient) Publish(topic string, qos byte, retained bool, payload any) mqtt.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.published[topic] = append(c.published[topic], string(payload.([]byte)))
+	return &mqtt.DummyToken{}
+}
+
+// take returns and forgets what was published to a topic
+func (c *fakeMQTTClient) take(topic string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	payloads := c.published[topic]
+	delete(c.published, topic)
+	return payloads
+}
+
+// fakeMQTTMessage is a message a device published
+type fakeMQTTMessage struct {
+	mqtt.Message
+	topic   string
+	payload []byte
+}
+
+func (m fakeMQTTMessage) Topic() string   { return m.topic }
+func (m fakeMQTTMessage) Payload() []byte { return m.payload }
+
+// useTaskIndex gives the test an empty task index, which task writes
+// through taskService update
+func useTaskIndex(t *testing.T) {
+	t.Helper()
+	index, err := newTaskIndex(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := taskIndex
+	taskIndex = index
+	t.Cleanup(func() {
+		taskIndex = prev
+		index.Close()
+	})
+}
+
+func TestMQTTBridge(t *testing.T) {
+	ctx := context.Background()
+	useMemoryStore(t)
+	useTaskIndex(t)
+	t.Cleanup(resetState)
+	setFeatureDefaults(nil)
+	posted := capturePosts(t)
+
+	ws, err := store.CreateWorkspace(ctx, Workspace{Slug: "acme", Name: "Acme"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	room, err := store.CreateRoom(ctx, Room{WorkspaceID: ws.ID, Name: "ops"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err := store.CreateUser(ctx, User{Username: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := store.CreateUser(ctx, User{Username: "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.AddMember(ctx, WorkspaceMember{WorkspaceID: ws.ID, UserID: alice.ID, Role: "member"}); err != nil {
+		t.Fatal(err)
+	}
+	for secret, token := range map[string]APIToken{
+		"post":     {UserID: alice.ID, Scopes: []string{scopeChatPost}},
+		"tasks":    {UserID: alice.ID, Scopes: []string{scopeTasks}},
+		"outsider": {UserID: bob.ID, Scopes: []string{scopeChatPost, scopeTasks}},
+	} {
+		token.Hash = hashAPIToken(secret)
+		if _, err := store.CreateAPIToken(ctx, token); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	client := &fakeMQTTClient{published: make(map[string][]string)}
+	b := &mqttAdapter{client: client, prefix: "chat", pipelines: make(map[int]MessageHandler), roomTopics: make(map[int]string)}
+	publish := func(topic string, payload any) {
+		data, _ := json.Marshal(payload)
+		b.handle(nil, fakeMQTTMessage{topic: topic, payload: data})
+	}
+
+	tests := []struct {
+		name    string
+		topic   string
+		payload any
+		err     string // Published on the errors topic, "" when accepted
+	}{
+		{"post", "chat/acme/rooms/ops/post", MQTTPost{Token: "post", Content: "disk is full"}, ""},
+		{"post without the scope", "chat/acme/rooms/ops/post", MQTTPost{Token: "tasks", Content: "hi"}, "API token can't post messages"},
+		{"post with a bad token", "chat/acme/rooms/ops/post", MQTTPost{Token: "nope", Content: "hi"}, "Invalid or expired API token"},
+		{"post from outside the workspace", "chat/acme/rooms/ops/post", MQTTPost{Token: "outsider", Content: "hi"}, "Not a member of this workspace"},
+		{"post to a missing room", "chat/acme/rooms/lobby/post", MQTTPost{Token: "post", Content: "hi"}, "Room not found"},
+		{"post to a missing workspace", "chat/other/rooms/ops/post", MQTTPost{Token: "post", Content: "hi"}, "Workspace not found"},
+		{"task", "chat/acme/tasks/create", MQTTTask{Token: "tasks", Title: "Replace disk"}, ""},
+		{"task without the scope", "chat/acme/tasks/create", MQTTTask{Token: "post", Title: "Replace disk"}, "API token doesn't have the tasks scope"},
+		{"task without a title", "chat/acme/tasks/create", MQTTTask{Token: "tasks", Title: " "}, "Title is required"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			publish(tt.topic, tt.payload)
+			errorsTopic := strings.TrimSuffix(strings.TrimSuffix(tt.topic, "/post"), "/create") + "/errors"
+			got := client.take(errorsTopic)
+			switch {
+			case tt.err == "" && len(got) > 0:
+				t.Errorf("rejected: %v", got)
+			case tt.err != "" && (len(got) != 1 || !strings.Contains(got[0], tt.err)):
+				t.Errorf("errors %v, want %q", got, tt.err)
+			}
+		})
+	}
+
+	msgs := posted()
+	if len(msgs) != 1 || msgs[0].Content != "disk is full" || msgs[0].Username != "alice" || msgs[0].RoomID != room.ID {
+		t.Errorf("posted %+v", msgs)
+	}
+	tasks, err := store.ListTasks(ctx, ws.ID)
+	if err != nil || len(tasks) != 1 || tasks[0].Title != "Replace disk" || tasks[0].Status != "pending" {
+		t.Errorf("tasks %+v, %v", tasks, err)
+	}
+
+	// Messages broadcast in a room go out on its topic
+	b.publishMessage(Message{ID: 1, Username: "bob", Content: "on it", Room: "ops", RoomID: room.ID})
+	got := client.take("chat/acme/rooms/ops/messages")
+	var msg Message
+	if len(got) != 1 || json.Unmarshal([]byte(got[0]), &msg) != nil || msg.Content != "on it" {
+		t.Errorf("published %v", got)
+	}
+}
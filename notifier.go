@@ -0,0 +1,127 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Notification is a message delivered to a user outside the chat
+type Notification struct {
+	Subject string
+	Body    string
+	HTML    string // Alternative to Body for email clients that show HTML
+	ReplyTo string // Address replies to emails go to, when not the sender
+}
+
+// Notifier delivers notifications to users over one channel
+type Notifier interface {
+	Notify(user User, n Notification) error
+}
+
+// Active email channel, selected in the config at startup
+var emailNotifier Notifier = logNotifier{}
+
+var errNoEmailAddress = errors.New("user has no email address")
+
+// newEmailNotifier returns an SMTP notifier when a server is configured,
+// and otherwise one that only logs, which is handy in development
+func newEmailNotifier(cfg SMTPConfig) Notifier {
+	if cfg.Addr == "" {
+		log.Println("SMTP is not configured, emails will only be logged")
+		return logNotifier{}
+	}
+	return &smtpNotifier{cfg: cfg}
+}
+
+// notifyAsync sends a notification in the background so handlers don't
+// wait on the mail server
+func notifyAsync(n Notifier, user User, notification Notification) {
+	go func() {
+		if err := n.Notify(user, notification); err != nil {
+			log.Printf("Notification to user %d failed: %v", user.ID, err)
+		}
+	}()
+}
+
+// SMTPConfig holds the outgoing mail server settings
+type SMTPConfig struct {
+	Addr     string // host:port of the mail server
+	Username string // Optional, enables PLAIN auth
+	Password string
+	From     string // Sender address
+}
+
+// smtpNotifier sends notifications as plain-text email. The connection is
+// upgraded with STARTTLS whenever the server offers it.
+type smtpNotifier struct {
+	cfg SMTPConfig
+}
+
+func (s *smtpNotifier) Notify(user User, n Notification) error {
+	if user.Email == "" {
+		return errNoEmailAddress
+	}
+
+	var auth smtp.Auth
+	if s.cfg.Username != "" {
+		host, _, err := net.SplitHostPort(s.cfg.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", s.cfg.Username, s.cfg.Password, host)
+	}
+
+	return smtp.SendMail(s.cfg.Addr, auth, s.cfg.From, []string{user.Email}, buildEmail(s.cfg.From, user.Email, n))
+}
+
+// buildEmail formats a minimal RFC 5322 message
+func buildEmail(from, to string, n Notification) []byte {
+	// Header values must not contain line breaks
+	clean := strings.NewReplacer("\r", "", "\n", "")
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", clean.Replace(from))
+	fmt.Fprintf(&b, "To: %s\r\n", clean.Replace(to))
+	fmt.Fprintf(&b, "Subject: %s\r\n", clean.Replace(n.Subject))
+	if n.ReplyTo != "" {
+		fmt.Fprintf(&b, "Reply-To: %s\r\n", clean.Replace(n.ReplyTo))
+	}
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	if n.HTML == "" {
+		b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+		b.WriteString("\r\n")
+		b.WriteString(strings.ReplaceAll(n.Body, "\n", "\r\n"))
+		return []byte(b.String())
+	}
+
+	// Both versions, the last one being the one clients prefer
+	boundary := fmt.Sprintf("chat-%x", time.Now().UnixNano())
+	fmt.Fprintf(&b, "Content-Type: multipart/alternative; boundary=%q\r\n", boundary)
+	b.WriteString("\r\n")
+	for _, part := range []struct{ contentType, body string }{
+		{"text/plain", n.Body},
+		{"text/html", n.HTML},
+	} {
+		fmt.Fprintf(&b, "--%s\r\n", boundary)
+		fmt.Fprintf(&b, "Content-Type: %s; charset=utf-8\r\n", part.contentType)
+		b.WriteString("\r\n")
+		b.WriteString(strings.ReplaceAll(part.body, "\n", "\r\n"))
+		b.WriteString("\r\n")
+	}
+	fmt.Fprintf(&b, "--%s--\r\n", boundary)
+	return []byte(b.String())
+}
+
+// logNotifier writes notifications to the server log instead of sending them
+type logNotifier struct{}
+
+func (logNotifier) Notify(user User, n Notification) error {
+	log.Printf("Notification for %s <%s>: %s\n%s", user.Username, user.Email, n.Subject, n.Body)
+	return nil
+}
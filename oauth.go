@@ -0,0 +1,320 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/endpoints"
+)
+
+// Cookies holding the in-flight OAuth state and PKCE verifier
+const (
+	oauthStateCookie    = "chat_oauth_state"
+	oauthVerifierCookie = "chat_oauth_verifier"
+	oauthCookieMaxAge   = 10 * 60
+)
+
+// oauthIdentity is the account information returned by a provider
+type oauthIdentity struct {
+	Subject string // Stable account ID at the provider
+	Login   string // Preferred username, used for new local accounts
+	Email   string // Only set when verified by the provider
+}
+
+// oauthProvider is a configured external login provider
+type oauthProvider struct {
+	config *oauth2.Config
+	// fetchIdentity loads the account details with an authorized client
+	fetchIdentity func(ctx context.Context, client *http.Client) (oauthIdentity, error)
+}
+
+// Enabled login providers by name ("google", "github")
+var oauthProviders = make(map[string]*oauthProvider)
+
+// setupOAuthProviders enables every provider with a client ID configured
+func setupOAuthProviders(cfg Config) {
+	add := func(name string, client OAuthClientConfig, endpoint oauth2.Endpoint, scopes []string,
+		fetch func(context.Context, *http.Client) (oauthIdentity, error)) {
+		if client.ClientID == "" {
+			return
+		}
+		redirectURL := client.RedirectURL
+		if redirectURL == "" {
+			redirectURL = strings.TrimSuffix(cfg.PublicURL, "/") + "/auth/oauth/" + name + "/callback"
+		}
+		oauthProviders[name] = &oauthProvider{
+			config: &oauth2.Config{
+				ClientID:     client.ClientID,
+				ClientSecret: client.ClientSecret,
+				Endpoint:     endpoint,
+				RedirectURL:  redirectURL,
+				Scopes:       scopes,
+			},
+			fetchIdentity: fetch,
+		}
+		log.Printf("OAuth login enabled for %s", name)
+	}
+
+	add("google", cfg.GoogleOAuth, endpoints.Google, []string{"openid", "email", "profile"}, fetchGoogleIdentity)
+	add("github", cfg.GitHubOAuth, endpoints.GitHub, []string{"read:user", "user:email"}, fetchGitHubIdentity)
+}
+
+// setOAuthCookie stores a short-lived value for the callback request
+func setOAuthCookie(w http.ResponseWriter, name, value string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/auth/oauth",
+		MaxAge:   maxAge,
+		Secure:   secureCookies,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+////////////////////////
+// OAuth API Handlers //
+////////////////////////
+
+// List the enabled login providers (GET /auth/oauth)
+func listOAuthProviders(w http.ResponseWriter, r *http.Request) {
+	names := make([]string, 0, len(oauthProviders))
+	for name := range oauthProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	json.NewEncoder(w).Encode(names)
+}
+
+// Redirect to the provider's consent page (GET /auth/oauth/{provider})
+func startOAuthLogin(w http.ResponseWriter, r *http.Request) {
+	provider, ok := oauthProviders[mux.Vars(r)["provider"]]
+	if !ok {
+		http.Error(w, "Unknown login provider", http.StatusNotFound)
+		return
+	}
+
+	state, err := randomToken(24)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	setOAuthCookie(w, oauthStateCookie, state, oauthCookieMaxAge)
+	setOAuthCookie(w, oauthVerifierCookie, verifier, oauthCookieMaxAge)
+
+	authURL := provider.config.AuthCodeURL(state, oauth2.S256ChallengeOption(verifier))
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// Complete the login after the provider redirects back
+// (GET /auth/oauth/{provider}/callback)
+func finishOAuthLogin(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["provider"]
+	provider, ok := oauthProviders[name]
+	if !ok {
+		http.Error(w, "Unknown login provider", http.StatusNotFound)
+		return
+	}
+
+	// The state must match the cookie set when the flow started
+	stateCookie, err := r.Cookie(oauthStateCookie)
+	if err != nil || stateCookie.Value == "" || stateCookie.Value != r.URL.Query().Get("state") {
+		http.Error(w, "Invalid OAuth state", http.StatusBadRequest)
+		return
+	}
+	verifierCookie, err := r.Cookie(oauthVerifierCookie)
+	if err != nil {
+		http.Error(w, "Invalid OAuth state", http.StatusBadRequest)
+		return
+	}
+	setOAuthCookie(w, oauthStateCookie, "", -1)
+	setOAuthCookie(w, oauthVerifierCookie, "", -1)
+
+	if errMsg := r.URL.Query().Get("error"); errMsg != "" {
+		http.Error(w, "Login was not authorized: "+errMsg, http.StatusUnauthorized)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 15*time.Second)
+	defer cancel()
+
+	token, err := provider.config.Exchange(ctx, r.URL.Query().Get("code"), oauth2.VerifierOption(verifierCookie.Value))
+	if err != nil {
+		log.Printf("OAuth code exchange with %s failed: %v", name, err)
+		http.Error(w, "Login failed", http.StatusBadGateway)
+		return
+	}
+
+	identity, err := provider.fetchIdentity(ctx, provider.config.Client(ctx, token))
+	if err != nil {
+		log.Printf("OAuth identity lookup with %s failed: %v", name, err)
+		http.Error(w, "Login failed", http.StatusBadGateway)
+		return
+	}
+
+	// A logged-in user starting the flow links the identity to their account
+	current, loggedIn := currentUser(r)
+	user, err := linkOAuthIdentity(r.Context(), name, identity, current, loggedIn)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if user.Banned {
+		http.Error(w, "This account is banned", http.StatusForbidden)
+		return
+	}
+
+	ticket, err := beginLogin(w, user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if ticket != "" {
+		// The web UI picks up the ticket and asks for the second factor
+		http.Redirect(w, r, "/?twoFactorTicket="+url.QueryEscape(ticket), http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// linkOAuthIdentity returns the local user for a provider identity. Known
+// identities map to their linked user; otherwise the identity is linked to
+// the logged-in user, or a new user is created. Accounts are never linked
+// by matching email alone, as that would let a provider account take over
+// a local one.
+func linkOAuthIdentity(ctx context.Context, provider string, identity oauthIdentity, current User, loggedIn bool) (User, error) {
+	userID, err := store.FindIdentity(ctx, provider, identity.Subject)
+	if err != nil && !errors.Is(err, errNotFound) {
+		return User{}, err
+	}
+
+	if err == nil {
+		if loggedIn && current.ID != userID {
+			return User{}, errors.New("this " + provider + " account is linked to another user")
+		}
+		user, ok := findUserByID(ctx, userID)
+		if !ok {
+			return User{}, errors.New("linked user no longer exists")
+		}
+		return user, nil
+	}
+
+	user := current
+	if !loggedIn {
+		var err error
+		user, err = createExternalUser(ctx, identity)
+		if err != nil {
+			return User{}, err
+		}
+	}
+
+	if err := store.LinkIdentity(ctx, provider, identity.Subject, user.ID); err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+// createExternalUser creates a passwordless user for an external login,
+// adding a numeric suffix when the preferred username is taken
+func createExternalUser(ctx context.Context, identity oauthIdentity) (User, error) {
+	login := strings.TrimSpace(identity.Login)
+	if login == "" {
+		login = "user"
+	}
+
+	for i := 1; ; i++ {
+		name := login
+		if i > 1 {
+			name = login + strconv.Itoa(i)
+		}
+		user, err := addUser(ctx, User{Username: name, Email: identity.Email, EmailVerified: identity.Email != ""})
+		if !errors.Is(err, errUsernameTaken) {
+			return user, err
+		}
+	}
+}
+
+// getJSON fetches a URL with the authorized client and decodes the body
+func getJSON(ctx context.Context, client *http.Client, rawURL string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", rawURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", rawURL, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// fetchGoogleIdentity reads the OpenID Connect userinfo endpoint
+func fetchGoogleIdentity(ctx context.Context, client *http.Client) (oauthIdentity, error) {
+	var info struct {
+		Sub           string `json:"sub"`
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+	}
+	if err := getJSON(ctx, client, "https://openidconnect.googleapis.com/v1/userinfo", &info); err != nil {
+		return oauthIdentity{}, err
+	}
+	if info.Sub == "" {
+		return oauthIdentity{}, errors.New("userinfo response has no subject")
+	}
+
+	identity := oauthIdentity{Subject: info.Sub, Login: strings.Split(info.Email, "@")[0]}
+	if info.EmailVerified {
+		identity.Email = info.Email
+	}
+	return identity, nil
+}
+
+// fetchGitHubIdentity reads the GitHub user and their primary email
+func fetchGitHubIdentity(ctx context.Context, client *http.Client) (oauthIdentity, error) {
+	var info struct {
+		ID    int64  `json:"id"`
+		Login string `json:"login"`
+	}
+	if err := getJSON(ctx, client, "https://api.github.com/user", &info); err != nil {
+		return oauthIdentity{}, err
+	}
+	if info.ID == 0 {
+		return oauthIdentity{}, errors.New("user response has no ID")
+	}
+
+	identity := oauthIdentity{Subject: strconv.FormatInt(info.ID, 10), Login: info.Login}
+
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	if err := getJSON(ctx, client, "https://api.github.com/user/emails", &emails); err == nil {
+		for _, e := range emails {
+			if e.Primary && e.Verified {
+				identity.Email = e.Email
+			}
+		}
+	}
+	return identity, nil
+}
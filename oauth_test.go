@@ -0,0 +1,188 @@
+package chat
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/oauth2"
+)
+
+// fakeOAuthProvider stands in for a provider's token endpoint. It only
+// hands out a token for the code it issued, with the verifier matching
+// the challenge of the login that got it.
+func fakeOAuthProvider(t *testing.T) (*oauthProvider, *string) {
+	t.Helper()
+	var challenge string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if r.PostForm.Get("code") != "good-code" || base64.RawURLEncoding.EncodeToString(sum[:]) != challenge {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"token","token_type":"bearer"}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	return &oauthProvider{
+		config: &oauth2.Config{
+			ClientID:    "client",
+			Endpoint:    oauth2.Endpoint{AuthURL: srv.URL + "/auth", TokenURL: srv.URL + "/token"},
+			RedirectURL: "http://chat.example/auth/oauth/test/callback",
+		},
+		fetchIdentity: func(ctx context.Context, client *http.Client) (oauthIdentity, error) {
+			return oauthIdentity{Subject: "42", Login: "octocat"}, nil
+		},
+	}, &challenge
+}
+
+func TestOAuthLogin(t *testing.T) {
+	useMemoryStore(t)
+	prevSessions := sessions
+	sessions = newMemorySessionStore()
+	t.Cleanup(func() { sessions = prevSessions })
+	provider, challenge := fakeOAuthProvider(t)
+	oauthProviders["test"] = provider
+	t.Cleanup(func() { delete(oauthProviders, "test") })
+
+	// Start a login and keep what it hands the browser and the provider
+	start := func(t *testing.T) (state, verifier string) {
+		r := mux.SetURLVars(httptest.NewRequest("GET", "/auth/oauth/test", nil), map[string]string{"provider": "test"})
+		w := httptest.NewRecorder()
+		startOAuthLogin(w, r)
+		if w.Code != http.StatusFound {
+			t.Fatalf("start: status %d", w.Code)
+		}
+		loc, err := url.Parse(w.Header().Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		q := loc.Query()
+		if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+			t.Fatalf("no S256 challenge in %s", loc)
+		}
+		*challenge = q.Get("code_challenge")
+		for _, c := range w.Result().Cookies() {
+			switch c.Name {
+			case oauthStateCookie:
+				state = c.Value
+			case oauthVerifierCookie:
+				verifier = c.Value
+			}
+		}
+		if state == "" || state != q.Get("state") || verifier == "" {
+			t.Fatalf("state %q and verifier %q don't match %s", state, verifier, loc)
+		}
+		return state, verifier
+	}
+
+	tests := []struct {
+		name string
+		// What the callback gets, from what start handed out
+		query   func(state string) url.Values
+		cookies func(state, verifier string) []*http.Cookie
+		want    int
+	}{
+		{
+			"valid",
+			func(state string) url.Values { return url.Values{"state": {state}, "code": {"good-code"}} },
+			func(state, verifier string) []*http.Cookie {
+				return []*http.Cookie{{Name: oauthStateCookie, Value: state}, {Name: oauthVerifierCookie, Value: verifier}}
+			},
+			http.StatusFound,
+		},
+		{
+			"state mismatch",
+			func(state string) url.Values { return url.Values{"state": {state + "x"}, "code": {"good-code"}} },
+			func(state, verifier string) []*http.Cookie {
+				return []*http.Cookie{{Name: oauthStateCookie, Value: state}, {Name: oauthVerifierCookie, Value: verifier}}
+			},
+			http.StatusBadRequest,
+		},
+		{
+			"no state cookie",
+			func(state string) url.Values { return url.Values{"state": {state}, "code": {"good-code"}} },
+			func(state, verifier string) []*http.Cookie {
+				return []*http.Cookie{{Name: oauthVerifierCookie, Value: verifier}}
+			},
+			http.StatusBadRequest,
+		},
+		{
+			"empty state",
+			func(state string) url.Values { return url.Values{"state": {""}, "code": {"good-code"}} },
+			func(state, verifier string) []*http.Cookie {
+				return []*http.Cookie{{Name: oauthStateCookie, Value: ""}, {Name: oauthVerifierCookie, Value: verifier}}
+			},
+			http.StatusBadRequest,
+		},
+		{
+			"no verifier cookie",
+			func(state string) url.Values { return url.Values{"state": {state}, "code": {"good-code"}} },
+			func(state, verifier string) []*http.Cookie {
+				return []*http.Cookie{{Name: oauthStateCookie, Value: state}}
+			},
+			http.StatusBadRequest,
+		},
+		{
+			"wrong verifier",
+			func(state string) url.Values { return url.Values{"state": {state}, "code": {"good-code"}} },
+			func(state, verifier string) []*http.Cookie {
+				return []*http.Cookie{{Name: oauthStateCookie, Value: state}, {Name: oauthVerifierCookie, Value: oauth2.GenerateVerifier()}}
+			},
+			http.StatusBadGateway,
+		},
+		{
+			"denied by the user",
+			func(state string) url.Values { return url.Values{"state": {state}, "error": {"access_denied"}} },
+			func(state, verifier string) []*http.Cookie {
+				return []*http.Cookie{{Name: oauthStateCookie, Value: state}, {Name: oauthVerifierCookie, Value: verifier}}
+			},
+			http.StatusUnauthorized,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state, verifier := start(t)
+			r := httptest.NewRequest("GET", "/auth/oauth/test/callback?"+tt.query(state).Encode(), nil)
+			r = mux.SetURLVars(r, map[string]string{"provider": "test"})
+			for _, c := range tt.cookies(state, verifier) {
+				r.AddCookie(c)
+			}
+			w := httptest.NewRecorder()
+			finishOAuthLogin(w, r)
+			if w.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+
+			cleared, session := 0, false
+			for _, c := range w.Result().Cookies() {
+				if (c.Name == oauthStateCookie || c.Name == oauthVerifierCookie) && c.MaxAge < 0 {
+					cleared++
+				}
+				session = session || c.Name == sessionCookieName
+			}
+			if session != (tt.want == http.StatusFound) {
+				t.Errorf("session started: %v", session)
+			}
+			// Once the state checks out it can't be used again
+			if tt.want != http.StatusBadRequest && cleared != 2 {
+				t.Errorf("%d OAuth cookies cleared, want 2", cleared)
+			}
+		})
+	}
+
+	user, ok := findUserByUsername(context.Background(), "octocat")
+	if !ok {
+		t.Fatal("no user created for the identity")
+	}
+	if id, err := store.FindIdentity(context.Background(), "test", "42"); err != nil || id != user.ID {
+		t.Errorf("identity linked to %d (%v), want %d", id, err, user.ID)
+	}
+}
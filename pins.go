@@ -0,0 +1,119 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Pin is a message a manager pinned to the top of its room, such as an
+// announcement. It keeps a copy of the message, so it still shows once the
+// message is archived.
+type Pin struct {
+	Room     string    `json:"room"`
+	Message  Message   `json:"message"`
+	PinnedBy string    `json:"pinnedBy"`
+	PinnedAt time.Time `json:"pinnedAt"`
+
+	RoomID      int `json:"-"`
+	WorkspaceID int `json:"-"`
+}
+
+// findMessage returns a message of a room by ID
+func findMessage(r *http.Request, room Room, id int) (Message, error) {
+	// The message may still be queued for the store
+	messageQueue.Flush()
+	msgs, err := chatService.History(r.Context(), room, id+1, 1)
+	if err != nil {
+		return Message{}, err
+	}
+	if len(msgs) == 0 || msgs[0].ID != id {
+		return Message{}, errNotFound
+	}
+	return msgs[0], nil
+}
+
+//////////////////////
+// Pin API Handlers //
+//////////////////////
+
+// List the pinned messages of a room, newest pin first
+// (GET /rooms/{name}/pins)
+func getPins(w http.ResponseWriter, r *http.Request) {
+	room, ok := roomFromVars(w, r)
+	if !ok {
+		return
+	}
+	pins, err := store.ListPins(r.Context(), room.WorkspaceID, room.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(pins)
+}
+
+// Pin a message to its room (PUT /rooms/{name}/pins/{id}). Pinning it
+// again keeps the first pin.
+func pinMessage(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+		return
+	}
+	room, ok := roomFromVars(w, r)
+	if !ok {
+		return
+	}
+	msg, err := findMessage(r, room, id)
+	if errors.Is(err, errNotFound) {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	user, _ := currentUser(r)
+	msg.Room = room.Name
+	pin, err := store.PinMessage(r.Context(), Pin{
+		Room:        room.Name,
+		Message:     msg,
+		PinnedBy:    user.Username,
+		PinnedAt:    time.Now().UTC(),
+		RoomID:      room.ID,
+		WorkspaceID: room.WorkspaceID,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(pin)
+}
+
+// Unpin a message (DELETE /rooms/{name}/pins/{id})
+func unpinMessage(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+		return
+	}
+	room, ok := roomFromVars(w, r)
+	if !ok {
+		return
+	}
+	err = store.UnpinMessage(r.Context(), room.ID, id)
+	if errors.Is(err, errNotFound) {
+		http.Error(w, "Pin not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
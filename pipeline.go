@@ -0,0 +1,416 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// MessagePipelineConfig tunes the built-in steps of the message pipeline
+type MessagePipelineConfig struct {
+	MaxLength    int           // Longest message content in characters
+	RateInterval time.Duration // A connection earns one message per interval...
+	RateBurst    int           // ...and may save up this many
+	BlockedWords []string      // Messages containing any of these are rejected
+	// The first HoldNewPosters messages of accounts younger than
+	// NewAccountAge wait for a moderator's approval; 0 holds none
+	HoldNewPosters int
+	NewAccountAge  time.Duration
+}
+
+// MessageContext carries an inbound chat message through the pipeline
+// together with what is known about its sender
+type MessageContext struct {
+	Request  *http.Request
+	User     User
+	LoggedIn bool
+	Token    *APIToken // API token the connection authenticated with, if any
+	Room     Room
+	Message  Message
+}
+
+// bridgeRequest stands in for the HTTP request of messages that arrive
+// over a bridge such as MQTT or XMPP, scoped to ws. remote identifies the
+// sender where the pipeline would otherwise use the client's IP.
+func bridgeRequest(ws Workspace, remote string) *http.Request {
+	r, _ := http.NewRequest(http.MethodPost, "/", nil)
+	r.RemoteAddr = remote
+	return r.WithContext(context.WithValue(r.Context(), workspaceContextKey{}, ws))
+}
+
+// MessageHandler processes an inbound message. Returning an error stops
+// the message; a *MessageRejection error is reported back to the sender.
+type MessageHandler func(mc *MessageContext) error
+
+// MessageMiddleware wraps the rest of the pipeline. It is called once per
+// connection, so state kept in the closure (such as a rate limit) belongs
+// to that connection.
+type MessageMiddleware func(next MessageHandler) MessageHandler
+
+// MessageRejection is returned by a pipeline step that refuses a message
+type MessageRejection struct {
+	Code   string // One of the rejection codes below
+	Reason string
+	// Close ends the connection instead of only dropping the message
+	Close bool
+	// How long the sender should wait before trying again, if it's known
+	RetryAfter time.Duration
+
+	// Reason before formatting, to translate it for the sender
+	format string
+	args   []any
+}
+
+func (e *MessageRejection) Error() string {
+	return e.Reason
+}
+
+// localized returns the reason in a locale
+func (e *MessageRejection) localized(locale string) string {
+	if e.format == "" {
+		return translate(locale, e.Reason)
+	}
+	return translatef(locale, e.format, e.args...)
+}
+
+// MessageError is the error frame, telling a client why a frame of theirs
+// was dropped: a rate limit, a message that didn't validate, something
+// they may not do or a room that doesn't work out. Message is meant for
+// people; clients should branch on Code.
+type MessageError struct {
+	Type       string `json:"type"` // Always "error"
+	Code       string `json:"code,omitempty"`
+	Message    string `json:"message"`
+	RetryAfter int    `json:"retryAfter,omitempty"` // Seconds to wait before trying again
+
+	// The dropped message's clientMsgId, if it had one
+	ClientMsgID string `json:"clientMsgId,omitempty"`
+
+	// Error repeats Message for clients from before error frames had a type
+	Error string `json:"error"`
+}
+
+// errorFrame builds the error frame for a code and message
+func errorFrame(code, message string) MessageError {
+	return MessageError{Type: "error", Code: code, Message: message, Error: message}
+}
+
+// rejectionFrame builds the error frame telling a sender in a locale why
+// their message was dropped
+func rejectionFrame(rejection *MessageRejection, locale, clientMsgID string) MessageError {
+	frame := errorFrame(rejection.Code, rejection.localized(locale))
+	if rejection.RetryAfter > 0 {
+		frame.RetryAfter = max(1, int(math.Ceil(rejection.RetryAfter.Seconds())))
+	}
+	frame.ClientMsgID = clientMsgID
+	return frame
+}
+
+// Codes of rejected messages
+const (
+	rejectTokenScope       = "auth.scope"
+	rejectAccessToken      = "auth.token"
+	rejectNoUsername       = "message.username"
+	rejectReservedUsername = "message.username_reserved"
+	rejectEmpty            = "message.empty"
+	rejectClientMsgID      = "message.client_id"
+	rejectTooLong          = "message.length"
+	rejectBadAttachment    = "message.attachment"
+	rejectBlockedWord      = "message.blocked"
+	rejectConnectionRate   = "rate.connection"
+	rejectSenderRate       = "rate.sender"
+	rejectSlowMode         = "room.slow_mode"
+	rejectNoRoom           = "room.none"
+	rejectRoomNotFound     = "room.not_found"
+	rejectPolicyLength     = "policy.length"
+	rejectPolicyLinks      = "policy.links"
+	rejectPolicyAttachment = "policy.attachments"
+	rejectPolicyType       = "policy.content_type"
+)
+
+// Most attachments a message may carry
+const maxMessageAttachments = 10
+
+// Longest clientMsgId a message may carry
+const maxClientMsgIDLength = 64
+
+// rejectMessage returns a rejection that only drops the message
+func rejectMessage(code, format string, args ...any) error {
+	return &MessageRejection{Code: code, Reason: fmt.Sprintf(format, args...), format: format, args: args}
+}
+
+// rejectMessageFor rejects a message that the sender may try again after
+// the wait
+func rejectMessageFor(wait time.Duration, code, format string, args ...any) error {
+	return &MessageRejection{Code: code, Reason: fmt.Sprintf(format, args...), format: format, args: args, RetryAfter: wait}
+}
+
+// Names of the built-in pipeline steps, in order
+const (
+	stepValidate      = "validate"
+	stepSanitize      = "sanitize"
+	stepPolicy        = "room-policy"
+	stepRateLimit     = "rate-limit"
+	stepSenderRate    = "sender-rate-limit"
+	stepModerate      = "moderate"
+	stepSlowMode      = "slow-mode"
+	stepHold          = "hold"
+	stepPersist       = "persist"
+	stepBroadcast     = "broadcast"
+	stepImpersonation = "impersonation-audit"
+	stepActivity      = "activity"
+	stepUrgent        = "urgent-mentions"
+)
+
+type messageStep struct {
+	name       string
+	middleware MessageMiddleware
+}
+
+var (
+	messageSteps   []messageStep
+	messageStepsMu sync.Mutex
+
+	messagePipelineConfig   MessagePipelineConfig
+	messagePipelineConfigMu sync.Mutex
+)
+
+// currentPipelineConfig returns the message limits, which a config reload
+// may change
+func currentPipelineConfig() MessagePipelineConfig {
+	messagePipelineConfigMu.Lock()
+	defer messagePipelineConfigMu.Unlock()
+	return messagePipelineConfig
+}
+
+// setupMessagePipeline registers the built-in steps
+func setupMessagePipeline(cfg MessagePipelineConfig) {
+	messagePipelineConfigMu.Lock()
+	messagePipelineConfig = cfg
+	messagePipelineConfigMu.Unlock()
+
+	messageStepsMu.Lock()
+	messageSteps = nil
+	messageStepsMu.Unlock()
+
+	registerMessageMiddleware(stepMaintenance, "", rejectDuringMaintenance)
+	registerMessageMiddleware(stepValidate, "", validateMessage)
+	registerMessageMiddleware(stepSanitize, "", sanitizeMessage)
+	registerMessageMiddleware(stepPolicy, "", enforceRoomPolicy)
+	registerMessageMiddleware(stepRateLimit, "", rateLimitMessages)
+	registerMessageMiddleware(stepSenderRate, "", limitSenderRate)
+	registerMessageMiddleware(stepModerate, "", moderateMessage)
+	registerMessageMiddleware(stepSlowMode, "", slowDownMessages)
+	registerMessageMiddleware(stepHold, "", holdForReview)
+	registerMessageMiddleware(stepPersist, "", persistMessage)
+	registerMessageMiddleware(stepBroadcast, "", broadcastMessage)
+	registerMessageMiddleware(stepImpersonation, "", auditImpersonatedMessages)
+	registerMessageMiddleware(stepActivity, "", trackActivity)
+	registerMessageMiddleware(stepUrgent, "", textUrgentMentions)
+}
+
+// registerMessageMiddleware adds a named step to the pipeline, just before
+// the step called before, or at the end when before is empty. Steps at
+// the end run after the message has been broadcast. Connections opened
+// afterwards pick up the new step.
+func registerMessageMiddleware(name, before string, mw MessageMiddleware) error {
+	messageStepsMu.Lock()
+	defer messageStepsMu.Unlock()
+
+	for _, step := range messageSteps {
+		if step.name == name {
+			return fmt.Errorf("message middleware %q is already registered", name)
+		}
+	}
+
+	step := messageStep{name, mw}
+	if before == "" {
+		messageSteps = append(messageSteps, step)
+		return nil
+	}
+	for i := range messageSteps {
+		if messageSteps[i].name == before {
+			messageSteps = append(messageSteps[:i], append([]messageStep{step}, messageSteps[i:]...)...)
+			return nil
+		}
+	}
+	return fmt.Errorf("no message middleware %q to insert %q before", before, name)
+}
+
+// newMessagePipeline builds the pipeline for a new connection
+func newMessagePipeline() MessageHandler {
+	messageStepsMu.Lock()
+	defer messageStepsMu.Unlock()
+
+	handler := func(mc *MessageContext) error { return nil }
+	for i := len(messageSteps) - 1; i >= 0; i-- {
+		handler = messageSteps[i].middleware(handler)
+	}
+	return handler
+}
+
+/////////////////////////
+// Built-in Middleware //
+/////////////////////////
+
+// validateMessage checks that the sender may post and that the message
+// has a sender name, content of a sensible length, and well-formed
+// attachments
+func validateMessage(next MessageHandler) MessageHandler {
+	return func(mc *MessageContext) error {
+		if mc.Token != nil && !mc.Token.hasScope(scopeChatPost) {
+			return &MessageRejection{Code: rejectTokenScope, Reason: "API token can't post messages", Close: true}
+		}
+		if strings.TrimSpace(mc.Message.Username) == "" {
+			return rejectMessage(rejectNoUsername, "Username is required")
+		}
+		if !mc.LoggedIn {
+			// Guests pick their name, but not one that passes them off as
+			// the server or a registered user
+			name := strings.TrimSpace(mc.Message.Username)
+			if strings.EqualFold(name, systemUsername) {
+				return rejectMessage(rejectReservedUsername, "Username %q is reserved", systemUsername)
+			}
+			if _, taken := findUserByUsername(mc.Request.Context(), name); taken {
+				return rejectMessage(rejectReservedUsername, "Username %q belongs to a registered user; log in to use it", name)
+			}
+		}
+		if len(mc.Message.ClientMsgID) > maxClientMsgIDLength {
+			return rejectMessage(rejectClientMsgID, "Client message IDs can have at most %d characters", maxClientMsgIDLength)
+		}
+		if strings.TrimSpace(mc.Message.Content) == "" && len(mc.Message.Attachments) == 0 {
+			return rejectMessage(rejectEmpty, "Message is empty")
+		}
+		if max := currentPipelineConfig().MaxLength; max > 0 && len([]rune(mc.Message.Content)) > max {
+			return rejectMessage(rejectTooLong, "Message is longer than %d characters", max)
+		}
+		if len(mc.Message.Attachments) > maxMessageAttachments {
+			return rejectMessage(rejectBadAttachment, "Messages can have at most %d attachments", maxMessageAttachments)
+		}
+		for i, a := range mc.Message.Attachments {
+			if err := checkAttachment(&a); err != nil {
+				return rejectMessage(rejectBadAttachment, "Attachment %d: %v", i+1, err)
+			}
+			mc.Message.Attachments[i] = a
+		}
+		return next(mc)
+	}
+}
+
+// checkAttachment validates an attachment and normalizes its media type
+func checkAttachment(a *Attachment) error {
+	if strings.TrimSpace(a.Name) == "" {
+		return errors.New("name is required")
+	}
+	if a.URL != "" {
+		// Links to this server, like the email gateway's, may be relative
+		u, err := url.Parse(a.URL)
+		local := err == nil && u.Scheme == "" && u.Host == "" && strings.HasPrefix(u.Path, "/")
+		if !local && (err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "") {
+			return errors.New("URL must be an http or https link")
+		}
+	}
+	mediaType, _, err := mime.ParseMediaType(a.ContentType)
+	if err != nil || !strings.Contains(mediaType, "/") {
+		return errors.New("content type must be a media type such as image/png")
+	}
+	a.ContentType = mediaType
+	return nil
+}
+
+// sanitizeMessage trims the message and strips invalid UTF-8 and control
+// characters other than newlines and tabs
+func sanitizeMessage(next MessageHandler) MessageHandler {
+	clean := func(s string) string {
+		s = strings.ToValidUTF8(s, "")
+		s = strings.Map(func(r rune) rune {
+			if unicode.IsControl(r) && r != '\n' && r != '\t' {
+				return -1
+			}
+			return r
+		}, s)
+		return strings.TrimSpace(s)
+	}
+
+	return func(mc *MessageContext) error {
+		mc.Message.Username = clean(mc.Message.Username)
+		mc.Message.Content = clean(mc.Message.Content)
+		for i := range mc.Message.Attachments {
+			mc.Message.Attachments[i].Name = clean(mc.Message.Attachments[i].Name)
+		}
+		if mc.Message.Content == "" && len(mc.Message.Attachments) == 0 {
+			return rejectMessage(rejectEmpty, "Message is empty")
+		}
+		return next(mc)
+	}
+}
+
+// rateLimitMessages limits how fast a connection may post, as a token
+// bucket refilled once per RateInterval
+func rateLimitMessages(next MessageHandler) MessageHandler {
+	cfg := currentPipelineConfig()
+	if cfg.RateInterval <= 0 || cfg.RateBurst <= 0 {
+		return next
+	}
+
+	tokens := cfg.RateBurst
+	last := time.Now()
+	return func(mc *MessageContext) error {
+		now := time.Now()
+		earned := int(now.Sub(last) / cfg.RateInterval)
+		if earned > 0 {
+			tokens = min(cfg.RateBurst, tokens+earned)
+			last = last.Add(time.Duration(earned) * cfg.RateInterval)
+		}
+		if tokens == cfg.RateBurst {
+			// A full bucket doesn't keep earning
+			last = now
+		}
+		if tokens == 0 {
+			return rejectMessageFor(cfg.RateInterval-now.Sub(last), rejectConnectionRate, "You're sending messages too fast")
+		}
+		tokens--
+		return next(mc)
+	}
+}
+
+// moderateMessage rejects messages containing a blocked word
+func moderateMessage(next MessageHandler) MessageHandler {
+	return func(mc *MessageContext) error {
+		content := strings.ToLower(mc.Message.Content)
+		for _, word := range currentPipelineConfig().BlockedWords {
+			if strings.Contains(content, strings.ToLower(word)) {
+				return rejectMessage(rejectBlockedWord, "Message contains a blocked word")
+			}
+		}
+		return next(mc)
+	}
+}
+
+// persistMessage hands the message to the write-behind queue. Messages
+// are saved in the background, so they are broadcast before the store
+// assigns their ID.
+func persistMessage(next MessageHandler) MessageHandler {
+	return func(mc *MessageContext) error {
+		mc.Message.ID = 0
+		messageQueue.Enqueue(mc.Message)
+		return next(mc)
+	}
+}
+
+// broadcastMessage sends the message to everyone in the room
+func broadcastMessage(next MessageHandler) MessageHandler {
+	return func(mc *MessageContext) error {
+		mc.Message.WorkspaceID = mc.Room.WorkspaceID
+		queueBroadcast(mc.Message)
+		return next(mc)
+	}
+}
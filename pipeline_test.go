@@ -0,0 +1,85 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+)
+
+// capturePosts swaps the message pipeline for validation alone, and
+// returns a function listing the messages that got through it, which
+// are neither stored nor broadcast
+func capturePosts(t *testing.T) func() []Message {
+	t.Helper()
+	var mu sync.Mutex
+	var posted []Message
+	capture := func(next MessageHandler) MessageHandler {
+		return func(mc *MessageContext) error {
+			mu.Lock()
+			posted = append(posted, mc.Message)
+			mu.Unlock()
+			return next(mc)
+		}
+	}
+
+	messageStepsMu.Lock()
+	prev := messageSteps
+	messageSteps = []messageStep{{stepValidate, validateMessage}, {stepPersist, capture}}
+	messageStepsMu.Unlock()
+	t.Cleanup(func() {
+		messageStepsMu.Lock()
+		messageSteps = prev
+		messageStepsMu.Unlock()
+	})
+
+	return func() []Message {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(posted)
+	}
+}
+
+func TestValidateMessageUsername(t *testing.T) {
+	useMemoryStore(t)
+	alice, err := store.CreateUser(context.Background(), User{Username: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		username string
+		user     User
+		loggedIn bool
+		want     string // Rejection code, "" when it's posted
+	}{
+		{"guest", "visitor", User{}, false, ""},
+		{"guest as a registered user", "alice", User{}, false, rejectReservedUsername},
+		{"guest as a registered user in other case", " ALICE ", User{}, false, rejectReservedUsername},
+		{"guest as the server", "System", User{}, false, rejectReservedUsername},
+		{"guest without a name", "  ", User{}, false, rejectNoUsername},
+		{"the registered user", "alice", alice, true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mc := &MessageContext{
+				Request:  httptest.NewRequest("GET", "/ws", nil),
+				User:     tt.user,
+				LoggedIn: tt.loggedIn,
+				Message:  Message{Username: tt.username, Content: "hi"},
+			}
+			err := validateMessage(func(*MessageContext) error { return nil })(mc)
+			var rejection *MessageRejection
+			errors.As(err, &rejection)
+			switch {
+			case tt.want == "" && err != nil:
+				t.Errorf("rejected: %v", err)
+			case tt.want != "" && (rejection == nil || rejection.Code != tt.want):
+				t.Errorf("error %v, want a %s rejection", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package chat
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// UserPreferences are settings users change for themselves
+type UserPreferences struct {
+	// DoNotDisturb holds back notifications until it is turned off
+	DoNotDisturb bool `json:"doNotDisturb"`
+	// SnoozeUntil holds back notifications until the given time
+	SnoozeUntil *time.Time `json:"snoozeUntil,omitempty"`
+	// SMSNotifications texts urgent notifications to the user's phone
+	SMSNotifications bool `json:"smsNotifications"`
+	// Locale is the language of server messages, such as "de"; empty
+	// follows the browser's Accept-Language
+	Locale string `json:"locale,omitempty"`
+}
+
+// notificationsMuted reports whether notifications to the user are held
+// back at now, by do-not-disturb or a snooze that hasn't run out. Every
+// notification channel must check it before notifying a user. Account
+// emails, such as password resets, aren't notifications and always go out.
+func (p UserPreferences) notificationsMuted(now time.Time) bool {
+	return p.DoNotDisturb || p.SnoozeUntil != nil && now.Before(*p.SnoozeUntil)
+}
+
+// Get the logged-in user's preferences (GET /me/preferences)
+func getPreferences(w http.ResponseWriter, r *http.Request) {
+	user, _ := currentUser(r)
+
+	json.NewEncoder(w).Encode(user.Preferences)
+}
+
+// Replace the logged-in user's preferences (PUT /me/preferences)
+func updatePreferences(w http.ResponseWriter, r *http.Request) {
+	user, _ := currentUser(r)
+
+	var prefs UserPreferences
+	err := json.NewDecoder(r.Body).Decode(&prefs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if prefs.SMSNotifications && user.Phone == "" {
+		http.Error(w, "Add a phone number before turning on text notifications", http.StatusBadRequest)
+		return
+	}
+	locale, ok := validLocale(prefs.Locale)
+	if !ok {
+		http.Error(w, "Unsupported locale: "+prefs.Locale+" (expected one of "+strings.Join(supportedLocales(), ", ")+")",
+			http.StatusBadRequest)
+		return
+	}
+	prefs.Locale = locale
+	if prefs.SnoozeUntil != nil {
+		// A snooze that has already run out is no snooze
+		if !prefs.SnoozeUntil.After(time.Now()) {
+			prefs.SnoozeUntil = nil
+		} else {
+			t := prefs.SnoozeUntil.UTC()
+			prefs.SnoozeUntil = &t
+		}
+	}
+
+	user, ok = updateUser(r.Context(), user.ID, func(u *User) { u.Preferences = prefs })
+	if !ok {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(user.Preferences)
+}
@@ -0,0 +1,85 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// PresenceEntry is a logged-in user who is connected, and the rooms they
+// are in
+type PresenceEntry struct {
+	Username string   `json:"username"`
+	Rooms    []string `json:"rooms"`
+}
+
+// Get who is online in the workspace (GET /presence). ?room= narrows it
+// down to one room. In a cluster the roster covers every node.
+func getPresence(w http.ResponseWriter, r *http.Request) {
+	ws := requestWorkspace(r)
+	rooms, err := store.ListRooms(r.Context(), ws.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	roomNames := make(map[int]string)
+	for _, room := range rooms {
+		roomNames[room.ID] = room.Name
+	}
+	if name := r.URL.Query().Get("room"); name != "" {
+		room, err := store.FindRoom(r.Context(), ws.ID, name)
+		if errors.Is(err, errNotFound) {
+			http.Error(w, "Room not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		roomNames = map[int]string{room.ID: room.Name}
+	}
+	json.NewEncoder(w).Encode(roomPresenceEntries(r.Context(), roomNames))
+}
+
+// roomPresenceEntries lists the users connected to the given rooms, by
+// username
+func roomPresenceEntries(ctx context.Context, roomNames map[int]string) []PresenceEntry {
+	var present []roomPresence
+	hub.do(func() {
+		for _, c := range hub.clients {
+			if c.userID != 0 {
+				present = append(present, roomPresence{c.roomID, c.userID})
+			}
+		}
+	})
+	if cluster != nil {
+		remote, err := cluster.remotePresence(ctx)
+		if err != nil {
+			// The local roster is better than none
+			log.Printf("Cluster presence unavailable: %v", err)
+		}
+		present = append(present, remote...)
+	}
+
+	byUser := make(map[int][]string)
+	for _, p := range present {
+		if name, ok := roomNames[p.roomID]; ok && !slices.Contains(byUser[p.userID], name) {
+			byUser[p.userID] = append(byUser[p.userID], name)
+		}
+	}
+	entries := []PresenceEntry{}
+	for id, rooms := range byUser {
+		user, ok := findUserByID(ctx, id)
+		if !ok {
+			continue
+		}
+		slices.Sort(rooms)
+		entries = append(entries, PresenceEntry{Username: user.Username, Rooms: rooms})
+	}
+	slices.SortFunc(entries, func(a, b PresenceEntry) int { return strings.Compare(a.Username, b.Username) })
+	return entries
+}
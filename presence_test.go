@@ -0,0 +1,101 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestPresenceRoster(t *testing.T) {
+	ctx := context.Background()
+	useMemoryStore(t)
+	useHub(t)
+	mr := useRedis(t)
+
+	ws, err := store.CreateWorkspace(ctx, Workspace{Slug: "acme", Name: "Acme"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := store.CreateWorkspace(ctx, Workspace{Slug: "other", Name: "Other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rooms := make(map[string]Room)
+	for _, room := range []Room{{WorkspaceID: ws.ID, Name: "general"}, {WorkspaceID: ws.ID, Name: "ops"}, {WorkspaceID: other.ID, Name: "lobby"}} {
+		if rooms[room.Name], err = store.CreateRoom(ctx, room); err != nil {
+			t.Fatal(err)
+		}
+	}
+	users := make(map[string]User)
+	for _, name := range []string{"alice", "bob", "carol"} {
+		if users[name], err = store.CreateUser(ctx, User{Username: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Alice and a guest are connected here, the others to another node
+	hub.do(func() {
+		hub.clients[&websocket.Conn{}] = chatClient{roomID: rooms["general"].ID, userID: users["alice"].ID}
+		hub.clients[&websocket.Conn{}] = chatClient{roomID: rooms["general"].ID}
+	})
+	a := startClusterNode(t, mr, ClusterConfig{NodeID: "a", Nodes: []string{"a", "b"}})
+	b := startClusterNode(t, mr, ClusterConfig{NodeID: "b", Nodes: []string{"a", "b"}})
+	b.connectUser(users["alice"].ID, rooms["ops"].ID)
+	b.connectUser(users["bob"].ID, rooms["ops"].ID)
+	b.connectUser(users["bob"].ID, rooms["general"].ID)
+	b.connectUser(users["carol"].ID, rooms["lobby"].ID)
+	eventually(t, "both nodes to announce themselves", func() bool {
+		members, err := a.members()
+		return err == nil && len(members) == 2
+	})
+	prev := cluster
+	cluster = a
+	t.Cleanup(func() { cluster = prev })
+
+	roster := func(t *testing.T, query string) ([]PresenceEntry, int) {
+		t.Helper()
+		r := httptest.NewRequest("GET", "/presence"+query, nil)
+		r = r.WithContext(context.WithValue(r.Context(), workspaceContextKey{}, ws))
+		w := httptest.NewRecorder()
+		getPresence(w, r)
+		var entries []PresenceEntry
+		if w.Code == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(&entries); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return entries, w.Code
+	}
+
+	tests := []struct {
+		name  string
+		query string
+		want  []PresenceEntry
+		code  int
+	}{
+		{"workspace", "", []PresenceEntry{{"alice", []string{"general", "ops"}}, {"bob", []string{"general", "ops"}}}, http.StatusOK},
+		{"room", "?room=ops", []PresenceEntry{{"alice", []string{"ops"}}, {"bob", []string{"ops"}}}, http.StatusOK},
+		{"room of another workspace", "?room=lobby", nil, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, code := roster(t, tt.query)
+			if code != tt.code || !reflect.DeepEqual(entries, tt.want) {
+				t.Errorf("roster %d %+v, want %d %+v", code, entries, tt.code, tt.want)
+			}
+		})
+	}
+
+	// Without Redis the node still knows its own clients
+	mr.Close()
+	entries, _ := roster(t, "")
+	mr.Restart() // For the nodes to leave
+	if want := []PresenceEntry{{"alice", []string{"general"}}}; !reflect.DeepEqual(entries, want) {
+		t.Errorf("local roster %+v, want %+v", entries, want)
+	}
+}
@@ -0,0 +1,221 @@
+package chat
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-pdf/fpdf"
+)
+
+// How far back a project report's recent activity goes
+const reportActivityWindow = 7 * 24 * time.Hour
+
+// ProjectReport is the content of a project's status report
+type ProjectReport struct {
+	Project     Project
+	GeneratedAt time.Time
+	Statuses    []StatusTasks // Open statuses first, completed last
+	Overdue     []Task
+	Activity    []ReportActivity // Newest first
+}
+
+// StatusTasks are the tasks of a project with one status
+type StatusTasks struct {
+	Status string
+	Tasks  []Task
+}
+
+// ReportActivity is a task created or completed recently
+type ReportActivity struct {
+	Time time.Time
+	What string // "created" or "completed"
+	Task Task
+}
+
+var projectReportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"date": func(t time.Time) string { return t.Format("Jan 2, 2006") },
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Project.Name}} status report</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+h1 { margin-bottom: 0; }
+table { border-collapse: collapse; width: 100%; margin-bottom: 1.5em; }
+th, td { text-align: left; padding: 4px 8px; border-bottom: 1px solid #ddd; }
+.meta { color: #666; }
+.overdue { color: #b00; }
+@media print { body { margin: 0; } h2 { page-break-after: avoid; } }
+</style>
+</head>
+<body>
+<h1>{{.Project.Name}}</h1>
+<p class="meta">Status report, {{date .GeneratedAt}}</p>
+{{range .Statuses}}
+<h2>{{.Status}} ({{len .Tasks}})</h2>
+<table>
+<tr><th>#</th><th>Task</th><th>Assignee</th><th>Priority</th><th>Due</th></tr>
+{{range .Tasks}}<tr><td>{{.ID}}</td><td>{{.Title}}</td><td>{{.Assignee}}</td><td>{{.Priority}}</td><td>{{with .DueDate}}{{date .}}{{end}}</td></tr>
+{{end}}</table>
+{{else}}
+<p>The project has no tasks.</p>
+{{end}}
+{{with .Overdue}}
+<h2 class="overdue">Overdue ({{len .}})</h2>
+<table>
+<tr><th>#</th><th>Task</th><th>Assignee</th><th>Due</th></tr>
+{{range .}}<tr><td>{{.ID}}</td><td>{{.Title}}</td><td>{{.Assignee}}</td><td>{{date .DueDate}}</td></tr>
+{{end}}</table>
+{{end}}
+<h2>Recent activity</h2>
+{{with .Activity}}<table>
+{{range .}}<tr><td>{{date .Time}}</td><td>#{{.Task.ID}} {{.Task.Title}}</td><td>{{.What}}</td></tr>
+{{end}}</table>
+{{else}}<p>Nothing was created or completed in the last week.</p>
+{{end}}
+</body>
+</html>
+`))
+
+// newProjectReport gathers the report of a project's tasks at now
+func newProjectReport(project Project, tasks []Task, now time.Time) ProjectReport {
+	report := ProjectReport{Project: project, GeneratedAt: now}
+	byStatus := make(map[string][]Task)
+	since := now.Add(-reportActivityWindow)
+	for _, task := range tasks {
+		byStatus[task.Status] = append(byStatus[task.Status], task)
+		if task.Status != "completed" && task.DueDate != nil && task.DueDate.Before(now) {
+			report.Overdue = append(report.Overdue, task)
+		}
+		if task.CreatedAt.After(since) {
+			report.Activity = append(report.Activity, ReportActivity{Time: task.CreatedAt, What: "created", Task: task})
+		}
+		if task.CompletedAt != nil && task.CompletedAt.After(since) {
+			report.Activity = append(report.Activity, ReportActivity{Time: *task.CompletedAt, What: "completed", Task: task})
+		}
+	}
+
+	for status, tasks := range byStatus {
+		report.Statuses = append(report.Statuses, StatusTasks{Status: status, Tasks: tasks})
+	}
+	slices.SortFunc(report.Statuses, func(a, b StatusTasks) int {
+		if (a.Status == "completed") != (b.Status == "completed") {
+			if a.Status == "completed" {
+				return 1
+			}
+			return -1
+		}
+		return strings.Compare(a.Status, b.Status)
+	})
+	slices.SortFunc(report.Overdue, func(a, b Task) int { return a.DueDate.Compare(*b.DueDate) })
+	slices.SortFunc(report.Activity, func(a, b ReportActivity) int { return b.Time.Compare(a.Time) })
+	return report
+}
+
+// writePDF renders the report as an A4 PDF
+func (report ProjectReport) writePDF(w *bytes.Buffer) error {
+	pdf := fpdf.New("P", "mm", "A4", "")
+	// The core fonts only cover Windows-1252
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+	pdf.SetTitle(report.Project.Name+" status report", true)
+	pdf.AddPage()
+
+	pdf.SetFont("Helvetica", "B", 18)
+	pdf.CellFormat(0, 10, tr(report.Project.Name), "", 1, "", false, 0, "")
+	pdf.SetFont("Helvetica", "", 10)
+	pdf.SetTextColor(100, 100, 100)
+	pdf.CellFormat(0, 6, "Status report, "+report.GeneratedAt.Format("Jan 2, 2006"), "", 1, "", false, 0, "")
+	pdf.SetTextColor(0, 0, 0)
+
+	heading := func(text string) {
+		pdf.Ln(4)
+		pdf.SetFont("Helvetica", "B", 13)
+		pdf.CellFormat(0, 8, tr(text), "", 1, "", false, 0, "")
+		pdf.SetFont("Helvetica", "", 10)
+	}
+	row := func(cells ...string) {
+		widths := []float64{15, 95, 40, 40}
+		for i, cell := range cells {
+			pdf.CellFormat(widths[i], 6, tr(cell), "B", 0, "", false, 0, "")
+		}
+		pdf.Ln(-1)
+	}
+	dueDate := func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+		return t.Format("Jan 2, 2006")
+	}
+
+	if len(report.Statuses) == 0 {
+		pdf.Ln(4)
+		pdf.CellFormat(0, 6, "The project has no tasks.", "", 1, "", false, 0, "")
+	}
+	for _, st := range report.Statuses {
+		heading(fmt.Sprintf("%s (%d)", st.Status, len(st.Tasks)))
+		for _, task := range st.Tasks {
+			row(fmt.Sprint(task.ID), task.Title, task.Assignee, dueDate(task.DueDate))
+		}
+	}
+	if len(report.Overdue) > 0 {
+		heading(fmt.Sprintf("Overdue (%d)", len(report.Overdue)))
+		for _, task := range report.Overdue {
+			row(fmt.Sprint(task.ID), task.Title, task.Assignee, dueDate(task.DueDate))
+		}
+	}
+	heading("Recent activity")
+	if len(report.Activity) == 0 {
+		pdf.CellFormat(0, 6, "Nothing was created or completed in the last week.", "", 1, "", false, 0, "")
+	}
+	for _, a := range report.Activity {
+		row(fmt.Sprint(a.Task.ID), a.Task.Title, a.What, a.Time.Format("Jan 2, 2006"))
+	}
+
+	return pdf.Output(w)
+}
+
+// Get a printable status report of a project: its tasks by status,
+// overdue tasks and the last week's activity (GET /projects/{id}/report).
+// ?format=pdf returns a PDF instead of an HTML page.
+func getProjectReport(w http.ResponseWriter, r *http.Request) {
+	project, ok := projectFromVars(w, r)
+	if !ok {
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "html" && format != "pdf" {
+		http.Error(w, `format must be "html" or "pdf"`, http.StatusBadRequest)
+		return
+	}
+
+	tasks, err := projectTasks(r, project)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	report := newProjectReport(project, tasks, time.Now().UTC())
+
+	// Render in full first, so a failure still gets an error response
+	var buf bytes.Buffer
+	if format == "pdf" {
+		err = report.writePDF(&buf)
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="project-%d-report.pdf"`, project.ID))
+	} else {
+		err = projectReportTemplate.Execute(&buf, report)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	}
+	if err != nil {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Del("Content-Disposition")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	buf.WriteTo(w)
+}
@@ -0,0 +1,334 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	statsDefaultWeeks = 8
+	statsMaxWeeks     = 52
+)
+
+// Project groups related tasks of a workspace, e.g. a product launch
+type Project struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"createdAt"`
+	// WIPLimits caps how many of the project's tasks may have a status at
+	// once, e.g. {"in_progress": 3}. Statuses without a limit have none.
+	WIPLimits   map[string]int `json:"wipLimits,omitempty"`
+	WorkspaceID int            `json:"-"`
+}
+
+// ProjectStats summarizes the tasks of a project
+type ProjectStats struct {
+	ProjectID int            `json:"projectId"`
+	Total     int            `json:"total"`
+	ByStatus  map[string]int `json:"byStatus"`
+	Overdue   int            `json:"overdue"` // Open tasks past their due date
+	// Throughput counts the tasks completed in each of the last weeks,
+	// oldest first
+	Throughput []WeeklyThroughput `json:"throughput"`
+	// AverageCycleTimeHours is how long the tasks completed in those weeks
+	// took from creation to completion on average
+	AverageCycleTimeHours float64 `json:"averageCycleTimeHours"`
+	// WIPViolations lists the statuses holding more tasks than their WIP
+	// limit allows, after an override or a lowered limit
+	WIPViolations []WIPViolation `json:"wipViolations"`
+}
+
+// WIPViolation is a status of a project over its WIP limit
+type WIPViolation struct {
+	Status string `json:"status"`
+	Limit  int    `json:"limit"`
+	Count  int    `json:"count"`
+}
+
+// WIPLimitError is returned when a task can't enter a status because the
+// status is at its project's WIP limit
+type WIPLimitError struct {
+	Project string
+	Status  string
+	Limit   int
+}
+
+func (e *WIPLimitError) Error() string {
+	return fmt.Sprintf("Project %s already has %d %s tasks, its WIP limit", e.Project, e.Limit, e.Status)
+}
+
+// WeeklyThroughput is the number of tasks completed in a week
+type WeeklyThroughput struct {
+	Week      string `json:"week"` // Monday the week starts on, in UTC
+	Completed int    `json:"completed"`
+}
+
+// startOfWeek returns midnight UTC on the Monday of t's week
+func startOfWeek(t time.Time) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+}
+
+// projectFromVars looks up the project named by the {id} route variable in
+// the request's workspace, writing an error response if it can't
+func projectFromVars(w http.ResponseWriter, r *http.Request) (Project, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return Project{}, false
+	}
+	project, err := store.GetProject(r.Context(), requestWorkspace(r).ID, id)
+	if errors.Is(err, errNotFound) {
+		http.Error(w, "Project not found", http.StatusNotFound)
+		return Project{}, false
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return Project{}, false
+	}
+	return project, true
+}
+
+// checkWIPLimit reports a *WIPLimitError if moving task into its status
+// and project would take the status past the project's WIP limit. The
+// task itself doesn't count towards the limit.
+func checkWIPLimit(ctx context.Context, task Task) error {
+	if task.ProjectID == 0 {
+		return nil
+	}
+	project, err := store.GetProject(ctx, task.WorkspaceID, task.ProjectID)
+	if err != nil {
+		return err
+	}
+	limit, ok := project.WIPLimits[task.Status]
+	if !ok {
+		return nil
+	}
+	tasks, err := store.ListTasks(ctx, task.WorkspaceID)
+	if err != nil {
+		return err
+	}
+	count := 0
+	for _, t := range tasks {
+		if t.ProjectID == project.ID && t.Status == task.Status && t.ID != task.ID {
+			count++
+		}
+	}
+	if count >= limit {
+		return &WIPLimitError{Project: project.Name, Status: task.Status, Limit: limit}
+	}
+	return nil
+}
+
+var errWIPOverrideForbidden = errors.New("only moderators can override WIP limits")
+
+// overrideWIPLimit runs write, which changes a task through the task
+// service on behalf of the request. If a WIP limit holds it up, moderators
+// can go past the limit with ?override=true, which is audited.
+func overrideWIPLimit(r *http.Request, write func(opts TaskWriteOptions) (Task, error)) (Task, error) {
+	user, _ := currentUser(r)
+	opts := TaskWriteOptions{By: user.Username}
+	task, err := write(opts)
+	var limitErr *WIPLimitError
+	if !errors.As(err, &limitErr) || r.URL.Query().Get("override") != "true" {
+		return task, err
+	}
+	if !canManageWorkspace(r.Context(), requestWorkspace(r), user) {
+		return Task{}, errWIPOverrideForbidden
+	}
+	opts.OverrideWIPLimit = true
+	task, err = write(opts)
+	if err == nil {
+		recordAudit(r, "task.wip_override", fmt.Sprintf("task %d", task.ID), limitErr.Error())
+	}
+	return task, err
+}
+
+// checkWIPLimits validates the WIP limits of a project
+func checkWIPLimits(limits map[string]int) error {
+	for status, limit := range limits {
+		if strings.TrimSpace(status) == "" || limit < 1 {
+			return errors.New("WIP limits must be positive numbers of tasks for a status")
+		}
+	}
+	return nil
+}
+
+// projectTasks returns the tasks of a project
+func projectTasks(r *http.Request, project Project) ([]Task, error) {
+	tasks, err := store.ListTasks(r.Context(), project.WorkspaceID)
+	if err != nil {
+		return nil, err
+	}
+	list := []Task{}
+	for _, task := range tasks {
+		if task.ProjectID == project.ID {
+			list = append(list, task)
+		}
+	}
+	return list, nil
+}
+
+//////////////////////////
+// Project API Handlers //
+//////////////////////////
+
+// List the projects of the workspace (GET /projects)
+func getProjects(w http.ResponseWriter, r *http.Request) {
+	projects, err := store.ListProjects(r.Context(), requestWorkspace(r).ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(projects)
+}
+
+// Create a project in the workspace (POST /projects)
+func createProject(w http.ResponseWriter, r *http.Request) {
+	var project Project
+	err := json.NewDecoder(r.Body).Decode(&project)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	project.Name = strings.TrimSpace(project.Name)
+	if project.Name == "" {
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+	if err := checkWIPLimits(project.WIPLimits); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	project.WorkspaceID = requestWorkspace(r).ID
+	project.CreatedAt = time.Now().UTC()
+	project, err = store.CreateProject(r.Context(), project)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(project)
+}
+
+// Get a project by ID (GET /projects/{id})
+func getProject(w http.ResponseWriter, r *http.Request) {
+	project, ok := projectFromVars(w, r)
+	if !ok {
+		return
+	}
+	json.NewEncoder(w).Encode(project)
+}
+
+// Get task counts and throughput of a project (GET /projects/{id}/stats).
+// ?weeks= sets how many weeks of throughput to report (default 8, at most
+// 52).
+func getProjectStats(w http.ResponseWriter, r *http.Request) {
+	project, ok := projectFromVars(w, r)
+	if !ok {
+		return
+	}
+	weeks := statsDefaultWeeks
+	if s := r.URL.Query().Get("weeks"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			http.Error(w, "weeks must be a positive number", http.StatusBadRequest)
+			return
+		}
+		weeks = min(n, statsMaxWeeks)
+	}
+
+	tasks, err := projectTasks(r, project)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	first := startOfWeek(now).AddDate(0, 0, -7*(weeks-1))
+	stats := ProjectStats{
+		ProjectID:  project.ID,
+		Total:      len(tasks),
+		ByStatus:   make(map[string]int),
+		Throughput: make([]WeeklyThroughput, weeks),
+	}
+	for i := range stats.Throughput {
+		stats.Throughput[i].Week = first.AddDate(0, 0, 7*i).Format(time.DateOnly)
+	}
+
+	var cycleTime time.Duration
+	var cycles int
+	for _, task := range tasks {
+		stats.ByStatus[task.Status]++
+		if task.Status != "completed" && task.DueDate != nil && task.DueDate.Before(now) {
+			stats.Overdue++
+		}
+		if task.CompletedAt == nil || task.CompletedAt.Before(first) {
+			continue
+		}
+		week := int(startOfWeek(*task.CompletedAt).Sub(first).Hours()) / (7 * 24)
+		if week < weeks {
+			stats.Throughput[week].Completed++
+		}
+		// Tasks from before creation times were recorded have none
+		if !task.CreatedAt.IsZero() {
+			cycleTime += task.CompletedAt.Sub(task.CreatedAt)
+			cycles++
+		}
+	}
+	if cycles > 0 {
+		stats.AverageCycleTimeHours = cycleTime.Hours() / float64(cycles)
+	}
+	stats.WIPViolations = []WIPViolation{}
+	for status, limit := range project.WIPLimits {
+		if stats.ByStatus[status] > limit {
+			stats.WIPViolations = append(stats.WIPViolations, WIPViolation{Status: status, Limit: limit, Count: stats.ByStatus[status]})
+		}
+	}
+	slices.SortFunc(stats.WIPViolations, func(a, b WIPViolation) int { return strings.Compare(a.Status, b.Status) })
+
+	json.NewEncoder(w).Encode(stats)
+}
+
+// Set the WIP limits of a project; moderators only
+// (PUT /projects/{id}/wip-limits). The body maps statuses to the most
+// tasks that may have them, and replaces the current limits.
+func setProjectWIPLimits(w http.ResponseWriter, r *http.Request) {
+	ws := requestWorkspace(r)
+	project, ok := projectFromVars(w, r)
+	if !ok {
+		return
+	}
+
+	var limits map[string]int
+	err := json.NewDecoder(r.Body).Decode(&limits)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkWIPLimits(limits); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	project, err = store.SetProjectWIPLimits(r.Context(), ws.ID, project.ID, limits)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r, "project.wip_limits", project.Name, fmt.Sprint(limits))
+
+	json.NewEncoder(w).Encode(project)
+}
@@ -0,0 +1,95 @@
+package chat
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Reverse proxies whose forwarding headers are trusted
+var trustedProxies []netip.Prefix
+
+// setTrustedProxies parses the configured proxy IPs and CIDR ranges
+func setTrustedProxies(list []string) error {
+	prefixes := make([]netip.Prefix, 0, len(list))
+	for _, item := range list {
+		if strings.Contains(item, "/") {
+			p, err := netip.ParsePrefix(item)
+			if err != nil {
+				return fmt.Errorf("invalid trusted proxy %q: %w", item, err)
+			}
+			prefixes = append(prefixes, p.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(item)
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy %q: %w", item, err)
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+	}
+	trustedProxies = prefixes
+	return nil
+}
+
+// isTrustedProxy reports whether addr belongs to a configured proxy
+func isTrustedProxy(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range trustedProxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the IP address of the client that made the request.
+//
+// The X-Forwarded-For and X-Real-IP headers are only consulted when the
+// direct peer is a trusted proxy, so clients can't spoof their address.
+// X-Forwarded-For is walked from the right, skipping trusted hops, and the
+// first untrusted address is the client. Requests arriving over a Unix
+// socket always come from a local proxy and are treated as trusted.
+func clientIP(r *http.Request) string {
+	peer, ok := remoteAddr(r)
+	if ok && !isTrustedProxy(peer) {
+		return peer.String()
+	}
+
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+			if err != nil {
+				break
+			}
+			if i == 0 || !isTrustedProxy(addr) {
+				return addr.Unmap().String()
+			}
+		}
+	}
+
+	if realIP, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP"))); err == nil {
+		return realIP.Unmap().String()
+	}
+
+	if ok {
+		return peer.String()
+	}
+	return r.RemoteAddr
+}
+
+// remoteAddr parses the IP of the direct peer, returning false for
+// non-IP transports such as Unix sockets
+func remoteAddr(r *http.Request) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
@@ -0,0 +1,65 @@
+package chat
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	prev := trustedProxies
+	t.Cleanup(func() { trustedProxies = prev })
+	if err := setTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1", "::ffff:172.16.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string // X-Forwarded-For lines
+		realIP     string
+		want       string
+	}{
+		{"direct client", "203.0.113.5:4000", nil, "", "203.0.113.5"},
+		{"spoofed by a direct client", "203.0.113.5:4000", []string{"1.2.3.4"}, "1.2.3.4", "203.0.113.5"},
+		{"through a trusted proxy", "10.0.0.1:4000", []string{"203.0.113.5"}, "", "203.0.113.5"},
+		{"trusted single address", "192.168.1.1:4000", []string{"203.0.113.5"}, "", "203.0.113.5"},
+		{"through trusted hops", "10.0.0.1:4000", []string{"203.0.113.5, 10.0.0.2"}, "", "203.0.113.5"},
+		{"spoofed left of the client", "10.0.0.1:4000", []string{"1.2.3.4, 203.0.113.5, 10.0.0.2"}, "", "203.0.113.5"},
+		{"split over header lines", "10.0.0.1:4000", []string{"1.2.3.4", "203.0.113.5"}, "", "203.0.113.5"},
+		{"every hop trusted", "10.0.0.1:4000", []string{"10.0.0.3, 10.0.0.2"}, "", "10.0.0.3"},
+		{"malformed hop", "10.0.0.1:4000", []string{"203.0.113.5, junk"}, "", "10.0.0.1"},
+		{"real IP from a trusted proxy", "10.0.0.1:4000", nil, "203.0.113.5", "203.0.113.5"},
+		{"mapped trusted proxy", "[::ffff:10.0.0.1]:4000", []string{"203.0.113.5"}, "", "203.0.113.5"},
+		{"mapped proxy in the list", "172.16.0.1:4000", []string{"203.0.113.5"}, "", "203.0.113.5"},
+		{"mapped client", "10.0.0.1:4000", []string{"::ffff:203.0.113.5"}, "", "203.0.113.5"},
+		{"IPv6 client", "[2001:db8::1]:4000", []string{"203.0.113.5"}, "", "2001:db8::1"},
+		{"unix socket", "@", []string{"203.0.113.5"}, "", "203.0.113.5"},
+		{"unix socket without headers", "@", nil, "", "@"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, v := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if tt.realIP != "" {
+				r.Header.Set("X-Real-IP", tt.realIP)
+			}
+			if got := clientIP(r); got != tt.want {
+				t.Errorf("clientIP() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetTrustedProxies(t *testing.T) {
+	prev := trustedProxies
+	t.Cleanup(func() { trustedProxies = prev })
+
+	for _, item := range []string{"10.0.0.0/33", "not-an-ip", "10.0.0.1/", ""} {
+		if err := setTrustedProxies([]string{item}); err == nil {
+			t.Errorf("setTrustedProxies(%q) accepted it", item)
+		}
+	}
+}
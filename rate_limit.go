@@ -0,0 +1,264 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RateLimitConfig limits how fast each user, or each IP for guests, may
+// post chat messages and call the API, over a sliding window. Unlike the
+// message pipeline's per-connection limit, it holds across connections
+// and, with the Redis store, across every node.
+type RateLimitConfig struct {
+	Store    string        // "memory" or "redis"
+	Window   time.Duration // Length of the sliding window
+	Messages int           // Chat messages per window, 0 for no limit
+	Requests int           // API requests per window, 0 for no limit
+	Connects int           // WebSocket connects per window, 0 for no limit
+
+	// Users and IPs past the connect limit wait ConnectBackoff, doubled
+	// each time they hit it again, up to MaxConnectBackoff
+	ConnectBackoff    time.Duration
+	MaxConnectBackoff time.Duration
+}
+
+// Timeout of a Redis rate limit check, after which the request is let
+// through
+const redisRateLimitTimeout = 500 * time.Millisecond
+
+// RateLimiter counts events per key over a sliding window
+type RateLimiter interface {
+	// Allow records an event for key unless limit events already happened
+	// within the last window, in which case it returns how long until the
+	// next one is allowed
+	Allow(ctx context.Context, key string, limit int, window time.Duration) (bool, time.Duration, error)
+	// Count returns how many events for key happened within the last
+	// window, and how long until the oldest of them leaves it
+	Count(ctx context.Context, key string, window time.Duration) (int, time.Duration, error)
+}
+
+var (
+	rateLimiter       RateLimiter = newMemoryRateLimiter()
+	rateLimitConfig   RateLimitConfig
+	rateLimitConfigMu sync.Mutex
+)
+
+// currentRateLimits returns the limits, which a config reload may change
+func currentRateLimits() RateLimitConfig {
+	rateLimitConfigMu.Lock()
+	defer rateLimitConfigMu.Unlock()
+	return rateLimitConfig
+}
+
+func newRateLimiter(cfg Config) (RateLimiter, error) {
+	switch cfg.RateLimit.Store {
+	case "", "memory":
+		return newMemoryRateLimiter(), nil
+	case "redis":
+		return newRedisRateLimiter(cfg.RedisURL)
+	default:
+		return nil, errors.New("unknown rate limit store: " + cfg.RateLimit.Store)
+	}
+}
+
+// rateLimitKey identifies who a request or message counts against: the
+// logged-in user, or the client's IP for guests
+func rateLimitKey(r *http.Request, kind string) string {
+	if user, ok := currentUser(r); ok {
+		return kind + ":user:" + strconv.Itoa(user.ID)
+	}
+	return kind + ":ip:" + clientIP(r)
+}
+
+// allowRate checks a limit, letting the event through if the limiter
+// fails so an outage doesn't take the server down with it
+func allowRate(ctx context.Context, key string, limit int) (bool, time.Duration) {
+	if limit <= 0 {
+		return true, 0
+	}
+	ok, retry, err := rateLimiter.Allow(ctx, key, limit, currentRateLimits().Window)
+	if err != nil {
+		log.Printf("Rate limit check for %s failed: %v", key, err)
+		return true, 0
+	}
+	return ok, retry
+}
+
+// rateLimitMiddleware answers 429 Too Many Requests to users and IPs past
+// the API request limit. WebSocket messages count against the chat limit
+// instead.
+func rateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isChatPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := rateLimitKey(r, "api")
+		ok, retry := allowRate(r.Context(), key, currentRateLimits().Requests)
+		if !ok {
+			// Counted for /me/usage, never limited
+			allowRate(r.Context(), "throttled:"+key, math.MaxInt32)
+			w.Header().Set("Retry-After", strconv.Itoa(max(1, int(math.Ceil(retry.Seconds())))))
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitSenderRate rejects messages past the chat limit of their sender,
+// however many connections they post from
+func limitSenderRate(next MessageHandler) MessageHandler {
+	return func(mc *MessageContext) error {
+		if ok, retry := allowRate(mc.Request.Context(), rateLimitKey(mc.Request, "chat"), currentRateLimits().Messages); !ok {
+			return rejectMessageFor(retry, rejectSenderRate, "You're sending messages too fast")
+		}
+		return next(mc)
+	}
+}
+
+// memoryRateLimiter keeps the time of each event in the window per key,
+// for a single instance
+type memoryRateLimiter struct {
+	mu     sync.Mutex
+	events map[string][]time.Time
+	swept  time.Time
+}
+
+func newMemoryRateLimiter() *memoryRateLimiter {
+	return &memoryRateLimiter{events: make(map[string][]time.Time)}
+}
+
+func (l *memoryRateLimiter) Allow(ctx context.Context, key string, limit int, window time.Duration) (bool, time.Duration, error) {
+	now := time.Now()
+	since := now.Add(-window)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Forget idle keys now and then
+	if now.Sub(l.swept) > window {
+		for k, times := range l.events {
+			if len(times) == 0 || times[len(times)-1].Before(since) {
+				delete(l.events, k)
+			}
+		}
+		l.swept = now
+	}
+
+	times := l.events[key]
+	i := 0
+	for i < len(times) && !times[i].After(since) {
+		i++
+	}
+	times = times[i:]
+	if len(times) >= limit {
+		l.events[key] = times
+		return false, times[len(times)-limit].Sub(since), nil
+	}
+	l.events[key] = append(times, now)
+	return true, 0, nil
+}
+
+func (l *memoryRateLimiter) Count(ctx context.Context, key string, window time.Duration) (int, time.Duration, error) {
+	since := time.Now().Add(-window)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	times := l.events[key]
+	i := 0
+	for i < len(times) && !times[i].After(since) {
+		i++
+	}
+	if i == len(times) {
+		return 0, 0, nil
+	}
+	return len(times) - i, times[i].Sub(since), nil
+}
+
+// redisRateLimiter keeps each key's events in a Redis sorted set scored by
+// time, so every node counts against the same window
+type redisRateLimiter struct {
+	client *redis.Client
+}
+
+// Drops the events that left the window, then records the new one if
+// there is room. Returns 0 and the oldest event's time in milliseconds
+// when the limit is reached.
+var slidingWindowScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", now - window)
+if redis.call("ZCARD", KEYS[1]) >= limit then
+	local oldest = redis.call("ZRANGE", KEYS[1], 0, 0, "WITHSCORES")
+	return {0, tonumber(oldest[2])}
+end
+redis.call("ZADD", KEYS[1], now, ARGV[4])
+redis.call("PEXPIRE", KEYS[1], window)
+return {1, 0}
+`)
+
+func newRedisRateLimiter(url string) (*redisRateLimiter, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(opts)
+	ctx, cancel := context.WithTimeout(context.Background(), redisSessionTimeout)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &redisRateLimiter{client: client}, nil
+}
+
+func (l *redisRateLimiter) Allow(ctx context.Context, key string, limit int, window time.Duration) (bool, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, redisRateLimitTimeout)
+	defer cancel()
+	// Events in the same millisecond need their own members
+	id, err := randomToken(8)
+	if err != nil {
+		return false, 0, err
+	}
+	now := time.Now().UnixMilli()
+	res, err := slidingWindowScript.Run(ctx, l.client, []string{"chat:ratelimit:" + key},
+		now, window.Milliseconds(), limit, id).Int64Slice()
+	if err != nil {
+		return false, 0, err
+	}
+	if res[0] == 1 {
+		return true, 0, nil
+	}
+	retry := time.Duration(res[1]+window.Milliseconds()-now) * time.Millisecond
+	return false, max(retry, 0), nil
+}
+
+func (l *redisRateLimiter) Count(ctx context.Context, key string, window time.Duration) (int, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, redisRateLimitTimeout)
+	defer cancel()
+	now := time.Now().UnixMilli()
+	min := "(" + strconv.FormatInt(now-window.Milliseconds(), 10)
+	events, err := l.client.ZRangeByScoreWithScores(ctx, "chat:ratelimit:"+key, &redis.ZRangeBy{Min: min, Max: "+inf"}).Result()
+	if err != nil || len(events) == 0 {
+		return 0, 0, err
+	}
+	reset := time.Duration(int64(events[0].Score)+window.Milliseconds()-now) * time.Millisecond
+	return len(events), max(reset, 0), nil
+}
+
+func (l *redisRateLimiter) Ping(ctx context.Context) error {
+	return l.client.Ping(ctx).Err()
+}
+
+func (l *redisRateLimiter) Close() error {
+	return l.client.Close()
+}
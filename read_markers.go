@@ -0,0 +1,83 @@
+package chat
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// ReadMarker is how far a user has read in a room
+type ReadMarker struct {
+	Room      string    `json:"room"`
+	MessageID int       `json:"messageId"` // Last message read
+	UpdatedAt time.Time `json:"updatedAt"`
+
+	UserID      int `json:"-"`
+	RoomID      int `json:"-"`
+	WorkspaceID int `json:"-"`
+}
+
+// ReadMarkerUpdate is the request body for moving a read marker
+type ReadMarkerUpdate struct {
+	MessageID int `json:"messageId"`
+}
+
+// readMarkersByRoom indexes read markers by room ID
+func readMarkersByRoom(markers []ReadMarker) map[int]ReadMarker {
+	byRoom := make(map[int]ReadMarker, len(markers))
+	for _, m := range markers {
+		byRoom[m.RoomID] = m
+	}
+	return byRoom
+}
+
+//////////////////////////////
+// Read Marker API Handlers //
+//////////////////////////////
+
+// List where the user has read up to in each room of the workspace
+// (GET /me/read-markers)
+func getReadMarkers(w http.ResponseWriter, r *http.Request) {
+	user, _ := currentUser(r)
+	markers, err := store.ListReadMarkers(r.Context(), user.ID, requestWorkspace(r).ID, time.Time{})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(markers)
+}
+
+// Mark a room read up to a message (PUT /rooms/{name}/read). Markers only
+// move forward, so a client that is behind can't undo what another one
+// read; the response has the marker as it stands.
+func setReadMarker(w http.ResponseWriter, r *http.Request) {
+	user, _ := currentUser(r)
+
+	var req ReadMarkerUpdate
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.MessageID <= 0 {
+		http.Error(w, "messageId is required", http.StatusBadRequest)
+		return
+	}
+	room, ok := roomFromVars(w, r)
+	if !ok {
+		return
+	}
+
+	marker, err := store.SetReadMarker(r.Context(), ReadMarker{
+		Room:        room.Name,
+		MessageID:   req.MessageID,
+		UpdatedAt:   time.Now().UTC(),
+		UserID:      user.ID,
+		RoomID:      room.ID,
+		WorkspaceID: room.WorkspaceID,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(marker)
+}
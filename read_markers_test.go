@@ -0,0 +1,63 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestSetReadMarker(t *testing.T) {
+	ctx := context.Background()
+	useMemoryStore(t)
+	ws, err := store.CreateWorkspace(ctx, Workspace{Slug: "acme", Name: "Acme"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.CreateRoom(ctx, Room{WorkspaceID: ws.ID, Name: "general"}); err != nil {
+		t.Fatal(err)
+	}
+	alice := User{ID: 1, Username: "alice"}
+
+	tests := []struct {
+		name string
+		room string
+		body string
+		want int
+		read int // Where the marker stands after
+	}{
+		{"first marker", "general", `{"messageId":5}`, http.StatusOK, 5},
+		{"forward", "general", `{"messageId":9}`, http.StatusOK, 9},
+		{"backward", "general", `{"messageId":7}`, http.StatusOK, 9},
+		{"no message", "general", `{}`, http.StatusBadRequest, 9},
+		{"bad body", "general", `{`, http.StatusBadRequest, 9},
+		{"missing room", "random", `{"messageId":3}`, http.StatusNotFound, 9},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("PUT", "/rooms/"+tt.room+"/read", strings.NewReader(tt.body))
+			r = r.WithContext(context.WithValue(r.Context(), workspaceContextKey{}, ws))
+			r = r.WithContext(context.WithValue(r.Context(), userContextKey{}, alice))
+			r = mux.SetURLVars(r, map[string]string{"name": tt.room})
+			w := httptest.NewRecorder()
+			setReadMarker(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+
+			w = httptest.NewRecorder()
+			getReadMarkers(w, r)
+			var markers []ReadMarker
+			if err := json.NewDecoder(w.Body).Decode(&markers); err != nil {
+				t.Fatal(err)
+			}
+			if len(markers) != 1 || markers[0].Room != "general" || markers[0].MessageID != tt.read {
+				t.Errorf("markers %+v, want general read up to %d", markers, tt.read)
+			}
+		})
+	}
+}
@@ -0,0 +1,186 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Most messages replayed to a client that resumes with ?since=
+const maxResumeMessages = 200
+
+// ReconnectNotice is the frame a node sends its clients before it shuts
+// down. Clients should reconnect after RetryAfter seconds, passing the
+// createdAt of the last message they saw as ?since= so the messages
+// posted in between are replayed, and the id of the last stored message
+// they have as ?lastId= so the replay doesn't repeat it. The cursor is
+// checked against the shared store, so it works on whichever node the
+// client lands on.
+type ReconnectNotice struct {
+	Reconnect ReconnectHint `json:"reconnect"`
+}
+
+type ReconnectHint struct {
+	Node       string `json:"node,omitempty"` // Node that takes over the client's room, in a cluster
+	RetryAfter int    `json:"retryAfter"`     // Seconds to wait before reconnecting
+}
+
+var (
+	// Age at which connections are rotated, or 0 for never, and the most
+	// a connection's lifetime is shortened by at random
+	maxConnectionLifetime    time.Duration
+	connectionLifetimeJitter time.Duration
+)
+
+// resumeSince parses the ?since= cursor a client reconnects with
+func resumeSince(r *http.Request) (time.Time, bool, error) {
+	s := r.URL.Query().Get("since")
+	if s == "" {
+		return time.Time{}, false, nil
+	}
+	since, err := time.Parse(time.RFC3339Nano, s)
+	return since, err == nil, err
+}
+
+// resumeLastID parses the ?lastId= a client may reconnect with: the ID of
+// the last stored message it has, so the replay leaves out that one and
+// the ones before it
+func resumeLastID(r *http.Request) (int, error) {
+	s := r.URL.Query().Get("lastId")
+	if s == "" {
+		return 0, nil
+	}
+	id, err := strconv.Atoi(s)
+	if err == nil && id < 0 {
+		err = errors.New("lastId must not be negative")
+	}
+	return id, err
+}
+
+// missedMessages returns the messages of a room posted after since and
+// before until, if given, oldest first, up to maxResumeMessages of the
+// latest ones. Times are compared to the microsecond, which is all some
+// databases keep.
+func missedMessages(ctx context.Context, room Room, since, until time.Time) ([]Message, error) {
+	since, until = since.Round(time.Microsecond), until.Round(time.Microsecond)
+	var missed []Message
+	beforeID := 0
+	for len(missed) < maxResumeMessages {
+		page, err := chatService.History(ctx, room, beforeID, maxResumeMessages)
+		if err != nil {
+			return nil, err
+		}
+		done := len(page) < maxResumeMessages
+		for i := len(page) - 1; i >= 0 && len(missed) < maxResumeMessages; i-- {
+			at := page[i].CreatedAt.Round(time.Microsecond)
+			if !at.After(since) {
+				done = true
+				break
+			}
+			if until.IsZero() || at.Before(until) {
+				missed = append(missed, page[i])
+			}
+		}
+		if done || len(page) == 0 {
+			break
+		}
+		beforeID = page[0].ID
+	}
+	slices.Reverse(missed)
+	return missed, nil
+}
+
+// resumeClient sends a resuming client what it missed, then what was
+// held back for it since it connected. The write-behind queue is written
+// out first, so the messages posted just before it connected are in the
+// store.
+func resumeClient(ctx context.Context, ws *websocket.Conn, room Room, since time.Time, lastID int) error {
+	if messageQueue != nil {
+		messageQueue.Flush()
+	}
+	missed, err := missedMessages(ctx, room, since, time.Time{})
+	if err != nil {
+		releaseClient(ws, nil, false)
+		return err
+	}
+	// Leave out the messages the client already has
+	missed = slices.DeleteFunc(missed, func(m Message) bool { return m.ID <= lastID })
+	return releaseClient(ws, missed, false)
+}
+
+// shutdownRetryAfter is how long clients wait before reconnecting after a
+// shutdown, long enough for the write-behind queues to save the messages
+// they would otherwise miss
+func shutdownRetryAfter() int {
+	wait := time.Second
+	if messageQueue != nil {
+		wait = max(wait, 2*messageQueue.cfg.FlushInterval)
+	}
+	return int(math.Ceil(wait.Seconds()))
+}
+
+// migrateClients disconnects every client as the node shuts down, telling
+// each which node takes over its room and when to reconnect
+func migrateClients() {
+	var ring *hashRing
+	if cluster != nil {
+		cluster.mu.Lock()
+		ring = newHashRing(slices.DeleteFunc(slices.Clone(cluster.nodes), func(n string) bool { return n == cluster.id }))
+		cluster.mu.Unlock()
+	}
+	retryAfter := shutdownRetryAfter()
+
+	var pumps []<-chan struct{}
+	hub.do(func() {
+		for ws, c := range hub.clients {
+			hint := ReconnectHint{RetryAfter: retryAfter}
+			if ring != nil {
+				hint.Node = ring.owner(c.roomID)
+			}
+			hub.write(ws, ReconnectNotice{Reconnect: hint})
+			if done := hub.hangUp(ws, websocket.CloseServiceRestart, closeReasonShutdown); done != nil {
+				pumps = append(pumps, done)
+			}
+		}
+	})
+
+	// Give the pumps a second to get the notices out before the node stops
+	deadline := time.After(time.Second)
+	for _, done := range pumps {
+		select {
+		case <-done:
+		case <-deadline:
+			return
+		}
+	}
+}
+
+// connectionLifetime picks how long a new connection may stay open, or 0
+// for as long as the client likes
+func connectionLifetime() time.Duration {
+	jitter := min(connectionLifetimeJitter, maxConnectionLifetime)
+	if maxConnectionLifetime <= 0 || jitter <= 0 {
+		return maxConnectionLifetime
+	}
+	return maxConnectionLifetime - rand.N(jitter)
+}
+
+// rotateConnection asks a client whose connection reached its lifetime to
+// reconnect and resume, like on shutdown, and closes the connection
+func rotateConnection(ws *websocket.Conn, reason string) {
+	retryAfter := shutdownRetryAfter()
+	hub.do(func() {
+		if _, ok := hub.clients[ws]; !ok {
+			return
+		}
+		hub.write(ws, ReconnectNotice{Reconnect: ReconnectHint{RetryAfter: retryAfter}})
+		hub.hangUp(ws, websocket.CloseServiceRestart, reason)
+	})
+}
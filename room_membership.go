@@ -0,0 +1,145 @@
+package chat
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// RoomChangeFrame confirms a client's {"join": room} or {"leave": true}.
+// Messages of the new room are numbered from their own sequence, so
+// clients start counting over after joining.
+type RoomChangeFrame struct {
+	Joined string `json:"joined,omitempty"`
+	Left   string `json:"left,omitempty"`
+}
+
+// ActiveRoom is a room with clients connected to it
+type ActiveRoom struct {
+	Name string `json:"name"`
+	// Logged-in users connected to the room, across the cluster, and
+	// guests connected to it on this node
+	Members int `json:"members"`
+}
+
+// joinCluster subscribes the node to a room a client joined and records
+// the user's presence in it. Clients in no room have nothing to join.
+func joinCluster(room Room, user User, loggedIn bool) {
+	if cluster == nil || room.ID == 0 {
+		return
+	}
+	cluster.join(room.ID)
+	if loggedIn {
+		cluster.connectUser(user.ID, room.ID)
+	}
+}
+
+// leaveCluster undoes joinCluster
+func leaveCluster(room Room, user User, loggedIn bool) {
+	if cluster == nil || room.ID == 0 {
+		return
+	}
+	cluster.leave(room.ID)
+	if loggedIn {
+		cluster.disconnectUser(user.ID, room.ID)
+	}
+}
+
+// moveClient moves a connection from one room to another, or out of
+// every room when to is the zero Room, and tells the client it moved.
+// Broadcasts in the new room are held back for it from then on, until
+// sendHistory sends what came before them.
+func moveClient(ws *websocket.Conn, from, to Room, user User, loggedIn bool) {
+	// Subscribe to the new room before letting go of the old one
+	joinCluster(to, user, loggedIn)
+	hub.do(func() {
+		c, ok := hub.clients[ws]
+		if !ok {
+			return
+		}
+		// Messages of the old room go out before the client hears it moved
+		hub.flushBatch(ws, c, time.Now())
+		change := RoomChangeFrame{Joined: to.Name}
+		if to.ID == 0 {
+			change = RoomChangeFrame{Left: from.Name}
+		}
+		// The flush drops a client that fell behind
+		if hub.write(ws, change) != nil {
+			return
+		}
+		c.roomID = to.ID
+		c.info.Room = to.Name
+		if to.ID != 0 {
+			// Frames still held back from the old room never go out
+			if c.held != nil {
+				for _, v := range *c.held {
+					frameDone(v)
+				}
+			}
+			c.held = new([]any)
+		}
+		hub.clients[ws] = c
+	})
+	leaveCluster(from, user, loggedIn)
+}
+
+// List the rooms of the workspace that clients are connected to, busiest
+// first (GET /rooms/active)
+func getActiveRooms(w http.ResponseWriter, r *http.Request) {
+	rooms, err := store.ListRooms(r.Context(), requestWorkspace(r).ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	roomNames := make(map[int]string)
+	for _, room := range rooms {
+		roomNames[room.ID] = room.Name
+	}
+
+	guests := make(map[int]int)
+	var present []roomPresence
+	hub.do(func() {
+		for _, c := range hub.clients {
+			if c.userID == 0 {
+				guests[c.roomID]++
+			} else {
+				present = append(present, roomPresence{c.roomID, c.userID})
+			}
+		}
+	})
+	if cluster != nil {
+		remote, err := cluster.remotePresence(r.Context())
+		if err != nil {
+			// The local count is better than none
+			log.Printf("Cluster presence unavailable: %v", err)
+		}
+		present = append(present, remote...)
+	}
+
+	members := guests
+	seen := make(map[roomPresence]bool)
+	for _, p := range present {
+		if !seen[p] {
+			seen[p] = true
+			members[p.roomID]++
+		}
+	}
+	active := []ActiveRoom{}
+	for id, n := range members {
+		if name, ok := roomNames[id]; ok {
+			active = append(active, ActiveRoom{Name: name, Members: n})
+		}
+	}
+	slices.SortFunc(active, func(a, b ActiveRoom) int {
+		if a.Members != b.Members {
+			return b.Members - a.Members
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+	json.NewEncoder(w).Encode(active)
+}
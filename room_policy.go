@@ -0,0 +1,170 @@
+package chat
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// RoomPolicy restricts what may be posted in a room, on top of the
+// server-wide limits
+type RoomPolicy struct {
+	MaxLength     int  `json:"maxLength"`     // Longest message in characters, 0 for the server limit
+	NoLinks       bool `json:"noLinks"`       // Reject messages containing URLs
+	NoAttachments bool `json:"noAttachments"` // Reject messages with attachments
+	// Domains links may point to, subdomains included; empty allows any
+	LinkDomains []string `json:"linkDomains,omitempty"`
+	// Domains links may not point to, subdomains included
+	BlockedLinkDomains []string `json:"blockedLinkDomains,omitempty"`
+	// ReviewLinks holds messages with links until a moderator approves them
+	ReviewLinks bool `json:"reviewLinks"`
+	// Media types attachments may have, such as "image/png" or
+	// "image/*"; empty allows any
+	ContentTypes []string `json:"contentTypes,omitempty"`
+}
+
+// allowsContentType reports whether attachments of a media type may be
+// posted under the policy
+func (p RoomPolicy) allowsContentType(mediaType string) bool {
+	if len(p.ContentTypes) == 0 {
+		return true
+	}
+	mediaType = strings.ToLower(mediaType)
+	for _, allowed := range p.ContentTypes {
+		if prefix, ok := strings.CutSuffix(allowed, "/*"); ok {
+			if strings.HasPrefix(mediaType, prefix+"/") {
+				return true
+			}
+		} else if mediaType == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// linkDomainIn reports whether host is one of domains or a subdomain of one
+func linkDomainIn(host string, domains []string) bool {
+	for _, d := range domains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// messageLinkHosts returns the host names the links in a message point to
+func messageLinkHosts(content string) []string {
+	var hosts []string
+	for _, link := range linkPattern.FindAllString(content, -1) {
+		if strings.HasPrefix(strings.ToLower(link), "www.") {
+			link = "http://" + link
+		}
+		u, err := url.Parse(link)
+		if err != nil || u.Hostname() == "" {
+			// Still a link, just not one any domain allows
+			hosts = append(hosts, "")
+			continue
+		}
+		hosts = append(hosts, strings.TrimSuffix(strings.ToLower(u.Hostname()), "."))
+	}
+	return hosts
+}
+
+// Media types or type wildcards in a room policy
+var contentTypePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9!#$&^_.+-]*/(?:\*|[a-z0-9][a-z0-9!#$&^_.+-]*)$`)
+
+// URLs with a scheme or starting with www.
+var linkPattern = regexp.MustCompile(`(?i)\b(?:[a-z][a-z0-9+.-]*://|www\.)\S+`)
+
+// Domain names in a room's link lists
+var linkDomainPattern = regexp.MustCompile(`^(?:[a-z0-9](?:[a-z0-9-]*[a-z0-9])?\.)*[a-z0-9](?:[a-z0-9-]*[a-z0-9])?$`)
+
+// enforceRoomPolicy rejects messages the room's policy doesn't allow,
+// saying which rule they broke
+func enforceRoomPolicy(next MessageHandler) MessageHandler {
+	return func(mc *MessageContext) error {
+		room := latestRoom(mc.Room)
+		policy := room.Policy
+		if max := policy.MaxLength; max > 0 && len([]rune(mc.Message.Content)) > max {
+			return rejectMessage(rejectPolicyLength, "Messages in #%s are limited to %d characters", room.Name, max)
+		}
+		if policy.NoLinks && linkPattern.MatchString(mc.Message.Content) {
+			return rejectMessage(rejectPolicyLinks, "Links aren't allowed in #%s", room.Name)
+		}
+		for _, host := range messageLinkHosts(mc.Message.Content) {
+			if linkDomainIn(host, policy.BlockedLinkDomains) {
+				return rejectMessage(rejectPolicyLinks, "Links to %s aren't allowed in #%s", host, room.Name)
+			}
+			if len(policy.LinkDomains) > 0 && !linkDomainIn(host, policy.LinkDomains) {
+				return rejectMessage(rejectPolicyLinks, "Only links to %s are allowed in #%s",
+					strings.Join(policy.LinkDomains, ", "), room.Name)
+			}
+		}
+		if policy.NoAttachments && len(mc.Message.Attachments) > 0 {
+			return rejectMessage(rejectPolicyAttachment, "Attachments aren't allowed in #%s", room.Name)
+		}
+		for _, a := range mc.Message.Attachments {
+			if !policy.allowsContentType(a.ContentType) {
+				return rejectMessage(rejectPolicyType, "%s files aren't allowed in #%s", a.ContentType, room.Name)
+			}
+		}
+		return next(mc)
+	}
+}
+
+// Set what may be posted in a room; moderators only
+// (PUT /rooms/{name}/policy)
+func setRoomPolicy(w http.ResponseWriter, r *http.Request) {
+	ws := requestWorkspace(r)
+
+	var policy RoomPolicy
+	err := json.NewDecoder(r.Body).Decode(&policy)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if policy.MaxLength < 0 {
+		http.Error(w, "Maximum length can't be negative", http.StatusBadRequest)
+		return
+	}
+	if max := currentPipelineConfig().MaxLength; max > 0 && policy.MaxLength > max {
+		http.Error(w, "Maximum length can't exceed the server limit of "+strconv.Itoa(max)+" characters", http.StatusBadRequest)
+		return
+	}
+	for i, t := range policy.ContentTypes {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if !contentTypePattern.MatchString(t) {
+			http.Error(w, "Invalid content type "+strconv.Quote(policy.ContentTypes[i]), http.StatusBadRequest)
+			return
+		}
+		policy.ContentTypes[i] = t
+	}
+	for _, list := range []*[]string{&policy.LinkDomains, &policy.BlockedLinkDomains} {
+		for i, d := range *list {
+			d = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(d)), "*.")
+			if !linkDomainPattern.MatchString(d) {
+				http.Error(w, "Invalid domain "+strconv.Quote((*list)[i]), http.StatusBadRequest)
+				return
+			}
+			(*list)[i] = d
+		}
+	}
+
+	room, ok := roomFromVars(w, r)
+	if !ok {
+		return
+	}
+	room, err = store.SetRoomPolicy(r.Context(), room.ID, policy)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	noteRoomUpdate(room)
+
+	details, _ := json.Marshal(policy)
+	recordAudit(r, "room.policy", ws.Slug+"/"+room.Name, string(details))
+	json.NewEncoder(w).Encode(room)
+}
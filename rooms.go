@@ -0,0 +1,181 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Room every workspace has, and the one clients join unless they ask for
+// another
+const defaultRoomName = "general"
+
+// Room is a chat channel inside a workspace
+type Room struct {
+	ID          int        `json:"id"`
+	WorkspaceID int        `json:"-"`
+	Name        string     `json:"name"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	SlowMode    int        `json:"slowMode"` // Seconds each user waits between messages, 0 when off
+	Policy      RoomPolicy `json:"policy"`
+
+	// Branding overrides the workspace's in the room
+	Branding RoomBranding `json:"branding"`
+}
+
+var (
+	errRoomExists = errors.New("room already exists")
+
+	roomNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_-]{0,63}$`)
+
+	// Rooms changed since startup, by ID. Connections hold the room as it
+	// was when they opened, and look here for newer settings.
+	updatedRooms   = make(map[int]Room)
+	updatedRoomsMu sync.Mutex
+)
+
+// noteRoomUpdate makes changed room settings apply to open connections
+func noteRoomUpdate(room Room) {
+	updatedRoomsMu.Lock()
+	defer updatedRoomsMu.Unlock()
+
+	updatedRooms[room.ID] = room
+}
+
+// latestRoom returns the room with its current settings
+func latestRoom(room Room) Room {
+	updatedRoomsMu.Lock()
+	defer updatedRoomsMu.Unlock()
+
+	if updated, ok := updatedRooms[room.ID]; ok {
+		return updated
+	}
+	return room
+}
+
+// findOrCreateRoom returns the named room of the workspace. The default
+// room is created on first use; other rooms must be created explicitly.
+func findOrCreateRoom(r *http.Request, ws Workspace, name string) (Room, error) {
+	room, err := store.FindRoom(r.Context(), ws.ID, name)
+	if !errors.Is(err, errNotFound) || !strings.EqualFold(name, defaultRoomName) {
+		return room, err
+	}
+
+	room, err = store.CreateRoom(r.Context(), Room{WorkspaceID: ws.ID, Name: defaultRoomName, CreatedAt: time.Now().UTC()})
+	if errors.Is(err, errRoomExists) {
+		// Created concurrently by another connection
+		return store.FindRoom(r.Context(), ws.ID, name)
+	}
+	return room, err
+}
+
+// roomFromVars looks up the room of the request's workspace named in the
+// route, answering with 404 when it doesn't exist
+func roomFromVars(w http.ResponseWriter, r *http.Request) (Room, bool) {
+	room, err := store.FindRoom(r.Context(), requestWorkspace(r).ID, mux.Vars(r)["name"])
+	if errors.Is(err, errNotFound) {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return Room{}, false
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return Room{}, false
+	}
+	return room, true
+}
+
+///////////////////////
+// Room API Handlers //
+///////////////////////
+
+// List the rooms of the workspace (GET /rooms)
+func getRooms(w http.ResponseWriter, r *http.Request) {
+	rooms, err := store.ListRooms(r.Context(), requestWorkspace(r).ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(rooms)
+}
+
+// Create a room in the workspace (POST /rooms)
+func createRoom(w http.ResponseWriter, r *http.Request) {
+	var room Room
+	err := json.NewDecoder(r.Body).Decode(&room)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !roomNamePattern.MatchString(room.Name) {
+		http.Error(w, "Room names are 1-64 letters, digits, dashes or underscores", http.StatusBadRequest)
+		return
+	}
+
+	room.WorkspaceID = requestWorkspace(r).ID
+	room.CreatedAt = time.Now().UTC()
+	// Moderators restrict the room afterwards
+	room.SlowMode = 0
+	room.Policy = RoomPolicy{}
+	room, err = store.CreateRoom(r.Context(), room)
+	if errors.Is(err, errRoomExists) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	publishEvent(room.WorkspaceID, eventRoomCreated, room.Name, room)
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(room)
+}
+
+// SlowModeSettings is the request body for changing a room's slow mode
+type SlowModeSettings struct {
+	Seconds int `json:"seconds"` // 0 turns slow mode off
+}
+
+// Set how often each user may post in a room; moderators only
+// (PUT /rooms/{name}/slow-mode)
+func setRoomSlowMode(w http.ResponseWriter, r *http.Request) {
+	ws := requestWorkspace(r)
+
+	var settings SlowModeSettings
+	err := json.NewDecoder(r.Body).Decode(&settings)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if settings.Seconds < 0 || time.Duration(settings.Seconds)*time.Second > maxSlowMode {
+		http.Error(w, fmt.Sprintf("Slow mode must be between 0 and %d seconds", int(maxSlowMode.Seconds())), http.StatusBadRequest)
+		return
+	}
+
+	room, ok := roomFromVars(w, r)
+	if !ok {
+		return
+	}
+
+	room, err = store.SetRoomSlowMode(r.Context(), room.ID, settings.Seconds)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	noteRoomUpdate(room)
+
+	details := "off"
+	if room.SlowMode > 0 {
+		details = strconv.Itoa(room.SlowMode) + "s"
+	}
+	recordAudit(r, "room.slow_mode", ws.Slug+"/"+room.Name, details)
+	json.NewEncoder(w).Encode(room)
+}
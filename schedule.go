@@ -0,0 +1,266 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Name scheduled messages are posted under. Nobody else may use it.
+const systemUsername = "system"
+
+// ScheduledMessage is an announcement the server posts to a room on a
+// cron schedule, e.g. a standup reminder or a maintenance notice
+type ScheduledMessage struct {
+	ID        int       `json:"id"`
+	Room      string    `json:"room"`
+	Cron      string    `json:"cron"`
+	Timezone  string    `json:"timezone"`
+	Message   string    `json:"message"`
+	CreatedBy string    `json:"createdBy"`
+	NextRun   time.Time `json:"nextRun"`
+
+	WorkspaceID int           `json:"-"`
+	RoomID      int           `json:"-"`
+	schedule    *cronSchedule // Parsed Cron in Timezone
+}
+
+// NewScheduledMessage is the request body for scheduling a message
+type NewScheduledMessage struct {
+	Room     string `json:"room"`
+	Cron     string `json:"cron"`
+	Timezone string `json:"timezone"` // IANA name, defaults to UTC
+	Message  string `json:"message"`
+}
+
+var (
+	// Every workspace's scheduled messages, loaded from the store
+	scheduledMessages   []ScheduledMessage
+	scheduledMessagesMu sync.Mutex
+)
+
+// loadScheduledMessages (re)loads the scheduled messages from the store,
+// parsing their schedules
+func loadScheduledMessages(ctx context.Context) error {
+	list, err := store.ListScheduledMessages(ctx)
+	if err != nil {
+		return err
+	}
+	loaded := make([]ScheduledMessage, 0, len(list))
+	for _, sm := range list {
+		loc, err := time.LoadLocation(sm.Timezone)
+		if err != nil {
+			log.Printf("Scheduled message %d: %v", sm.ID, err)
+			continue
+		}
+		if sm.schedule, err = parseCron(sm.Cron, loc); err != nil {
+			log.Printf("Scheduled message %d: %v", sm.ID, err)
+			continue
+		}
+		loaded = append(loaded, sm)
+	}
+
+	scheduledMessagesMu.Lock()
+	defer scheduledMessagesMu.Unlock()
+	scheduledMessages = loaded
+	return nil
+}
+
+// runScheduledMessages posts due messages at the start of every minute
+func runScheduledMessages() {
+	for {
+		now := time.Now()
+		time.Sleep(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+		// Every node has the schedules, but only one may post them
+		if cluster != nil && !cluster.leader() {
+			continue
+		}
+		postDueMessages(time.Now())
+	}
+}
+
+// postDueMessages posts every scheduled message due at now and saves when
+// each runs next. The next run is saved before posting, so a node taking
+// over after a crash skips a message rather than posting it twice.
+func postDueMessages(now time.Time) {
+	var due []ScheduledMessage
+	scheduledMessagesMu.Lock()
+	for i := range scheduledMessages {
+		sm := &scheduledMessages[i]
+		if sm.NextRun.After(now) {
+			continue
+		}
+		sm.NextRun = sm.schedule.next(now)
+		due = append(due, *sm)
+	}
+	// Schedules that will never fire again are done
+	scheduledMessages = slices.DeleteFunc(scheduledMessages, func(sm ScheduledMessage) bool { return sm.NextRun.IsZero() })
+	scheduledMessagesMu.Unlock()
+	if len(due) == 0 {
+		return
+	}
+
+	ctx, cancel := storeContext()
+	for _, sm := range due {
+		var err error
+		if sm.NextRun.IsZero() {
+			err = store.DeleteScheduledMessage(ctx, sm.ID)
+		} else {
+			err = store.SetScheduledMessageRun(ctx, sm.ID, sm.NextRun)
+		}
+		if err != nil && !errors.Is(err, errNotFound) {
+			log.Printf("Saving the next run of scheduled message %d: %v", sm.ID, err)
+		}
+	}
+	cancel()
+	registryChanged(registryScheduledMessages)
+
+	for _, sm := range due {
+		room := Room{ID: sm.RoomID, WorkspaceID: sm.WorkspaceID, Name: sm.Room}
+		if err := chatService.Announce(context.Background(), room, sm.Message); err != nil {
+			log.Printf("Scheduled message %d: %v", sm.ID, err)
+		}
+	}
+}
+
+////////////////////////////////////
+// Scheduled Message API Handlers //
+////////////////////////////////////
+
+// List the scheduled messages of the workspace (GET /admin/scheduled-messages)
+func listScheduledMessages(w http.ResponseWriter, r *http.Request) {
+	ws := requestWorkspace(r)
+
+	scheduledMessagesMu.Lock()
+	defer scheduledMessagesMu.Unlock()
+
+	list := []ScheduledMessage{}
+	for _, sm := range scheduledMessages {
+		if sm.WorkspaceID == ws.ID {
+			list = append(list, sm)
+		}
+	}
+	json.NewEncoder(w).Encode(list)
+}
+
+// Schedule a message in a room of the workspace
+// (POST /admin/scheduled-messages)
+func createScheduledMessage(w http.ResponseWriter, r *http.Request) {
+	var req NewScheduledMessage
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	req.Message = strings.TrimSpace(req.Message)
+	if req.Message == "" {
+		http.Error(w, "Message is required", http.StatusBadRequest)
+		return
+	}
+	if max := currentPipelineConfig().MaxLength; max > 0 && len([]rune(req.Message)) > max {
+		http.Error(w, "Message is longer than "+strconv.Itoa(max)+" characters", http.StatusBadRequest)
+		return
+	}
+	if req.Timezone == "" {
+		req.Timezone = "UTC"
+	}
+	loc, err := time.LoadLocation(req.Timezone)
+	if err != nil {
+		http.Error(w, "Unknown timezone: "+req.Timezone, http.StatusBadRequest)
+		return
+	}
+	schedule, err := parseCron(req.Cron, loc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	next := schedule.next(time.Now())
+	if next.IsZero() {
+		http.Error(w, "Cron expression never matches", http.StatusBadRequest)
+		return
+	}
+
+	if req.Room == "" {
+		req.Room = defaultRoomName
+	}
+	ws := requestWorkspace(r)
+	room, err := findOrCreateRoom(r, ws, req.Room)
+	if errors.Is(err, errNotFound) {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	user, _ := currentUser(r)
+	sm := ScheduledMessage{
+		Room:        room.Name,
+		Cron:        strings.TrimSpace(req.Cron),
+		Timezone:    req.Timezone,
+		Message:     req.Message,
+		CreatedBy:   user.Username,
+		NextRun:     next,
+		WorkspaceID: ws.ID,
+		RoomID:      room.ID,
+	}
+	if sm, err = store.CreateScheduledMessage(r.Context(), sm); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	registryChanged(registryScheduledMessages)
+
+	recordAudit(r, "scheduled_message.create", ws.Slug+"/"+room.Name, sm.Cron+" "+sm.Timezone)
+	log.Printf("Scheduled message %d for #%s, next run %s", sm.ID, room.Name, next.Format(time.RFC3339))
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(sm)
+}
+
+// Delete a scheduled message (DELETE /admin/scheduled-messages/{id})
+func deleteScheduledMessage(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid scheduled message ID", http.StatusBadRequest)
+		return
+	}
+	ws := requestWorkspace(r)
+
+	scheduledMessagesMu.Lock()
+	i := slices.IndexFunc(scheduledMessages, func(sm ScheduledMessage) bool {
+		return sm.ID == id && sm.WorkspaceID == ws.ID
+	})
+	var sm ScheduledMessage
+	if i >= 0 {
+		sm = scheduledMessages[i]
+	}
+	scheduledMessagesMu.Unlock()
+
+	if i < 0 {
+		http.Error(w, "Scheduled message not found", http.StatusNotFound)
+		return
+	}
+	err = store.DeleteScheduledMessage(r.Context(), sm.ID)
+	if errors.Is(err, errNotFound) {
+		http.Error(w, "Scheduled message not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	registryChanged(registryScheduledMessages)
+	recordAudit(r, "scheduled_message.delete", ws.Slug+"/"+sm.Room, strconv.Itoa(sm.ID))
+	w.WriteHeader(http.StatusNoContent)
+}
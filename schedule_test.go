@@ -0,0 +1,84 @@
+package chat
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// announcements records what the server announces instead of posting it
+type announcements struct {
+	ChatService
+	posted []string
+}
+
+func (a *announcements) Announce(ctx context.Context, room Room, content string) error {
+	a.posted = append(a.posted, room.Name+": "+content)
+	return nil
+}
+
+func TestPostDueMessages(t *testing.T) {
+	ctx := context.Background()
+	useMemoryStore(t)
+	chat := &announcements{}
+	prevChat := chatService
+	chatService = chat
+	t.Cleanup(func() {
+		chatService = prevChat
+		scheduledMessagesMu.Lock()
+		scheduledMessages = nil
+		scheduledMessagesMu.Unlock()
+	})
+
+	ws, err := store.CreateWorkspace(ctx, Workspace{Slug: "acme", Name: "Acme"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	room, err := store.CreateRoom(ctx, Room{WorkspaceID: ws.ID, Name: "general"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nine := time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC)
+	sm, err := store.CreateScheduledMessage(ctx, ScheduledMessage{
+		Room: room.Name, Cron: "0 9 * * *", Timezone: "UTC", Message: "Standup", NextRun: nine,
+		WorkspaceID: ws.ID, RoomID: room.ID,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		restart bool // Load the schedules from the store again first
+		now     time.Time
+		posted  int
+		nextRun time.Time // Saved in the store afterwards
+	}{
+		{"not due yet", true, nine.Add(-time.Minute), 0, nine},
+		{"due", false, nine, 1, nine.AddDate(0, 0, 1)},
+		{"due again after a restart", true, nine, 0, nine.AddDate(0, 0, 1)},
+		{"next day", false, nine.AddDate(0, 0, 1), 1, nine.AddDate(0, 0, 2)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.restart {
+				resetState()
+				if err := loadRegistries(ctx); err != nil {
+					t.Fatal(err)
+				}
+			}
+			chat.posted = nil
+			postDueMessages(tt.now)
+			if len(chat.posted) != tt.posted {
+				t.Errorf("posted %q, want %d messages", chat.posted, tt.posted)
+			}
+			list, err := store.ListScheduledMessages(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(list) != 1 || list[0].ID != sm.ID || !list[0].NextRun.Equal(tt.nextRun) {
+				t.Errorf("stored %+v, want the next run at %v", list, tt.nextRun)
+			}
+		})
+	}
+}
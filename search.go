@@ -0,0 +1,146 @@
+package chat
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Kinds of results the search endpoint returns
+var searchTypes = []string{"tasks", "messages", "rooms", "users"}
+
+const (
+	searchDefaultLimit = 20
+	searchMaxLimit     = 100
+)
+
+// SearchResults holds what matched a search, by type. Types that weren't
+// searched or had no matches are left out.
+type SearchResults struct {
+	Tasks    []Task       `json:"tasks,omitempty"`
+	Messages []Message    `json:"messages,omitempty"` // Newest first
+	Rooms    []Room       `json:"rooms,omitempty"`
+	Users    []SearchUser `json:"users,omitempty"` // Only for logged-in users
+}
+
+// SearchUser is a member of the workspace found by a search
+type SearchUser struct {
+	ID       int    `json:"id"`
+	Username string `json:"username"`
+}
+
+// containsFold reports whether s contains the lowercase text, ignoring case
+func containsFold(s, text string) bool {
+	return strings.Contains(strings.ToLower(s), text)
+}
+
+// Search the workspace's tasks, messages, rooms and members at once
+// (GET /search?q=). ?types= limits the search to a comma-separated list of
+// "tasks", "messages", "rooms" and "users", and ?limit= caps the results
+// of each type (default 20, at most 100). Only members of the workspace,
+// or visitors where guests are allowed, can search it, and only logged-in
+// users find other users.
+func search(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	text := strings.ToLower(strings.TrimSpace(query.Get("q")))
+	if text == "" {
+		http.Error(w, "Missing search text (?q=)", http.StatusBadRequest)
+		return
+	}
+
+	types := searchTypes
+	if t := query.Get("types"); t != "" {
+		types = strings.Split(t, ",")
+		for _, typ := range types {
+			if !slices.Contains(searchTypes, typ) {
+				http.Error(w, fmt.Sprintf("Unknown type %q, expected %s", typ, strings.Join(searchTypes, ", ")), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	limit := searchDefaultLimit
+	if l := query.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 {
+			http.Error(w, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, searchMaxLimit)
+	}
+
+	ws := requestWorkspace(r)
+	_, loggedIn := currentUser(r)
+	var results SearchResults
+
+	if slices.Contains(types, "tasks") {
+		tasks, err := store.ListTasks(r.Context(), ws.ID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, task := range tasks {
+			if len(results.Tasks) < limit && (containsFold(task.Title, text) || containsFold(task.Description, text)) {
+				results.Tasks = append(results.Tasks, task)
+			}
+		}
+	}
+
+	if slices.Contains(types, "messages") {
+		msgs, err := store.SearchMessages(r.Context(), ws.ID, text, limit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		results.Messages = msgs
+	}
+
+	if slices.Contains(types, "rooms") {
+		rooms, err := store.ListRooms(r.Context(), ws.ID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, room := range rooms {
+			if len(results.Rooms) < limit && containsFold(room.Name, text) {
+				results.Rooms = append(results.Rooms, room)
+			}
+		}
+	}
+
+	if slices.Contains(types, "users") && loggedIn {
+		// Everyone belongs to the default workspace
+		var users []SearchUser
+		if ws.Slug == defaultWorkspaceSlug {
+			all, err := store.ListUsers(r.Context())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			for _, u := range all {
+				if !u.Banned {
+					users = append(users, SearchUser{ID: u.ID, Username: u.Username})
+				}
+			}
+		} else {
+			members, err := store.ListMembers(r.Context(), ws.ID)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			for _, m := range members {
+				users = append(users, SearchUser{ID: m.UserID, Username: m.Username})
+			}
+		}
+		for _, u := range users {
+			if len(results.Users) < limit && containsFold(u.Username, text) {
+				results.Users = append(results.Users, u)
+			}
+		}
+	}
+
+	json.NewEncoder(w).Encode(results)
+}
@@ -0,0 +1,152 @@
+package chat
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password of every demo user
+const seedPassword = "demo-password"
+
+// Demo users; the first one is an admin
+var seedUsers = []string{"alice", "bob", "carol", "dave"}
+
+// seedRoom is a room with a scripted conversation of author, content pairs
+type seedRoom struct {
+	workspace string
+	name      string
+	lines     [][2]string
+}
+
+var seedRooms = []seedRoom{
+	{defaultWorkspaceSlug, defaultRoomName, [][2]string{
+		{"alice", "Morning everyone! Coffee machine is fixed."},
+		{"bob", "Finally. I was about to start a petition."},
+		{"carol", "Did anyone look at the release notes draft?"},
+		{"alice", "Yes, left a few comments. Mostly wording."},
+		{"dave", "I'll be a bit late to standup, dentist."},
+		{"carol", "No worries, we'll keep your spot warm."},
+		{"bob", "Heads up: staging is down for maintenance until noon."},
+		{"alice", "Thanks for the warning. Deploys are on hold until then."},
+	}},
+	{defaultWorkspaceSlug, "random", [][2]string{
+		{"dave", "Anyone up for lunch at the new ramen place?"},
+		{"bob", "Always."},
+		{"carol", "Count me in, 12:30?"},
+		{"dave", "12:30 it is."},
+	}},
+	{"acme", defaultRoomName, [][2]string{
+		{"alice", "Welcome to the Acme workspace!"},
+		{"bob", "Kickoff deck is in the shared drive."},
+		{"alice", "Great, let's go through it on Thursday."},
+	}},
+	{"acme", "ops", [][2]string{
+		{"bob", "Disk usage on db-2 is at 81%."},
+		{"alice", "Let's add a task to rotate the old WAL files."},
+		{"bob", "On it."},
+	}},
+}
+
+var seedTasks = []struct {
+	workspace string
+	task      Task
+}{
+	{defaultWorkspaceSlug, Task{Title: "Write release notes", Description: "Cover the new rooms and workspaces", Status: "pending"}},
+	{defaultWorkspaceSlug, Task{Title: "Fix the coffee machine", Description: "It makes a grinding noise", Status: "completed"}},
+	{defaultWorkspaceSlug, Task{Title: "Plan team offsite", Description: "Shortlist three venues", Status: "pending"}},
+	{"acme", Task{Title: "Prepare kickoff deck", Description: "Goals, timeline and owners", Status: "completed"}},
+	{"acme", Task{Title: "Rotate WAL files on db-2", Description: "Disk usage is above 80%", Status: "pending"}},
+}
+
+// seedDemoData fills an empty store with demo users, workspaces, rooms,
+// message history and tasks. It does nothing when users already exist.
+func seedDemoData(ctx context.Context) error {
+	existing, err := store.ListUsers(ctx)
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		log.Println("Not seeding demo data: the store already has users")
+		return nil
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(seedPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	users := make(map[string]User)
+	for i, name := range seedUsers {
+		role := roleUser
+		if i == 0 {
+			role = roleAdmin
+		}
+		user, err := addUser(ctx, User{Username: name, Email: name + "@example.com", EmailVerified: true, Role: role, PasswordHash: hash})
+		if err != nil {
+			return err
+		}
+		users[name] = user
+	}
+
+	// Everyone is in the default workspace; acme belongs to alice and bob
+	workspaces := make(map[string]Workspace)
+	workspaces[defaultWorkspaceSlug], err = store.FindWorkspace(ctx, defaultWorkspaceSlug)
+	if err != nil {
+		return err
+	}
+	workspaces["acme"], err = store.CreateWorkspace(ctx, Workspace{Slug: "acme", Name: "Acme Corp", CreatedAt: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	for name, role := range map[string]string{"alice": workspaceRoleOwner, "bob": workspaceRoleMember} {
+		u := users[name]
+		_, err := store.AddMember(ctx, WorkspaceMember{WorkspaceID: workspaces["acme"].ID, UserID: u.ID, Username: u.Username, Role: role})
+		if err != nil {
+			return err
+		}
+	}
+
+	// Spread the history over the last few days, oldest room first
+	at := time.Now().UTC().Add(-72 * time.Hour)
+	messages := 0
+	for _, sr := range seedRooms {
+		room, err := store.CreateRoom(ctx, Room{WorkspaceID: workspaces[sr.workspace].ID, Name: sr.name, CreatedAt: at})
+		if err != nil {
+			return err
+		}
+
+		var msgs []Message
+		for _, line := range sr.lines {
+			at = at.Add(37 * time.Minute)
+			author := users[line[0]]
+			msgs = append(msgs, Message{
+				Username:  author.Username,
+				UserID:    author.ID,
+				Content:   line[1],
+				Room:      room.Name,
+				RoomID:    room.ID,
+				CreatedAt: at,
+			})
+		}
+		if err := store.SaveMessages(ctx, msgs); err != nil {
+			return err
+		}
+		messages += len(msgs)
+	}
+
+	for _, st := range seedTasks {
+		task := st.task
+		task.WorkspaceID = workspaces[st.workspace].ID
+		task.CreatedAt = time.Now().UTC()
+		stampCompletion(&task, task.CreatedAt)
+		if _, err := store.CreateTask(ctx, task, ""); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Seeded %d demo users (password %q), %d rooms, %d messages and %d tasks",
+		len(seedUsers), seedPassword, len(seedRooms), messages, len(seedTasks))
+	return nil
+}
@@ -0,0 +1,194 @@
+package chat
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CheckResult is the outcome of one self-check
+type CheckResult struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"` // What was checked, or why it failed
+}
+
+// SelfCheckReport is what the server found when it checked its
+// configuration and connections
+type SelfCheckReport struct {
+	Ready     bool          `json:"ready"`
+	CheckedAt time.Time     `json:"checkedAt"`
+	Checks    []CheckResult `json:"checks"`
+}
+
+// selfCheck is one thing the server needs to work
+type selfCheck struct {
+	name string
+	run  func(ctx context.Context) (detail string, err error)
+}
+
+// pinger is implemented by the stores and clients of outside services
+type pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// Longest each check may take
+const selfCheckTimeout = 5 * time.Second
+
+// TLS certificates expiring sooner than this are reported, though the
+// server still starts
+const certExpiryWarning = 14 * 24 * time.Hour
+
+var (
+	// Configuration checks run at startup, which /readyz reports along
+	// with its own connection checks
+	startupReport   SelfCheckReport
+	startupReportMu sync.Mutex
+
+	errSelfCheckFailed = errors.New("self-check failed")
+)
+
+// configChecks are the checks that can run before the server is set up:
+// the listeners, directories and TLS certificate
+func configChecks(cfg Config, listeners []net.Listener, listenErr error) []selfCheck {
+	checks := []selfCheck{{"listen", func(context.Context) (string, error) {
+		if listenErr != nil {
+			return "", listenErr
+		}
+		addrs := make([]string, len(listeners))
+		for i, l := range listeners {
+			addrs[i] = l.Addr().String()
+		}
+		return strings.Join(addrs, ", "), nil
+	}}}
+	dirs := []struct{ name, dir string }{
+		{"attachments dir", cfg.Attachments.Dir},
+		{"archive dir", cfg.Archive.Dir},
+	}
+	for _, d := range dirs {
+		if d.dir != "" {
+			checks = append(checks, selfCheck{d.name, func(context.Context) (string, error) { return d.dir, checkWritableDir(d.dir) }})
+		}
+	}
+	if cfg.TLSEnabled() {
+		checks = append(checks, selfCheck{"tls certificate", func(context.Context) (string, error) {
+			return checkCertificate(cfg.TLSCertFile, cfg.TLSKeyFile)
+		}})
+	}
+	return checks
+}
+
+// connectionChecks are the checks of the services the running server
+// talks to
+func connectionChecks() []selfCheck {
+	var checks []selfCheck
+	add := func(name string, v any) {
+		if p, ok := v.(pinger); ok {
+			checks = append(checks, selfCheck{name, func(ctx context.Context) (string, error) { return "", p.Ping(ctx) }})
+		}
+	}
+	add("store", store)
+	add("session store", sessions)
+	add("rate limit store", rateLimiter)
+	if cluster != nil {
+		add("cluster backplane", cluster)
+	}
+	return checks
+}
+
+// runChecks runs checks one after the other and reports on all of them
+func runChecks(checks []selfCheck) SelfCheckReport {
+	report := SelfCheckReport{Ready: true, CheckedAt: time.Now().UTC(), Checks: []CheckResult{}}
+	for _, c := range checks {
+		ctx, cancel := context.WithTimeout(context.Background(), selfCheckTimeout)
+		detail, err := c.run(ctx)
+		cancel()
+		result := CheckResult{Name: c.name, OK: err == nil, Detail: detail}
+		if err != nil {
+			result.Detail = err.Error()
+			report.Ready = false
+		}
+		report.Checks = append(report.Checks, result)
+	}
+	return report
+}
+
+// logSelfCheck writes a report to the log, as JSON when a check failed so
+// it can be read by machines too
+func logSelfCheck(report SelfCheckReport) {
+	if report.Ready {
+		names := make([]string, len(report.Checks))
+		for i, c := range report.Checks {
+			names[i] = c.Name
+		}
+		log.Printf("Self-check passed: %s", strings.Join(names, ", "))
+		return
+	}
+	b, _ := json.MarshalIndent(report, "", "  ")
+	log.Printf("Self-check failed:\n%s", b)
+}
+
+// checkWritableDir makes sure a directory exists and files can be created
+// in it
+func checkWritableDir(dir string) error {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".self-check-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// checkCertificate loads the TLS key pair and checks that the certificate
+// is valid now
+func checkCertificate(certFile, keyFile string) (string, error) {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return "", err
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	switch {
+	case now.Before(leaf.NotBefore):
+		return "", fmt.Errorf("%s is not valid until %s", certFile, leaf.NotBefore.Format(time.RFC3339))
+	case now.After(leaf.NotAfter):
+		return "", fmt.Errorf("%s expired on %s", certFile, leaf.NotAfter.Format(time.RFC3339))
+	case leaf.NotAfter.Sub(now) < certExpiryWarning:
+		return fmt.Sprintf("%s expires soon, on %s", leaf.Subject.CommonName, leaf.NotAfter.Format(time.RFC3339)), nil
+	}
+	return fmt.Sprintf("%s valid until %s", leaf.Subject.CommonName, leaf.NotAfter.Format(time.RFC3339)), nil
+}
+
+// Report whether the server can take traffic: the configuration checks
+// from startup and a fresh round of connection checks (GET /readyz)
+func getReadiness(w http.ResponseWriter, r *http.Request) {
+	startupReportMu.Lock()
+	startup := startupReport
+	startupReportMu.Unlock()
+
+	report := runChecks(connectionChecks())
+	for _, c := range startup.Checks {
+		report.Checks = append(report.Checks, c)
+		report.Ready = report.Ready && c.OK
+	}
+	if !report.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,158 @@
+package chat
+
+import (
+	"slices"
+	"sync"
+)
+
+// Recent messages kept per room for backfills
+const backfillBufferSize = 500
+
+// Messages in a room are numbered by the node that owns the room as it
+// broadcasts them, so clients can tell when they missed one. When the
+// room moves to another node, the new owner carries on from the last
+// number it saw. A number lower than the last one means the sequence
+// started over; clients should then resume with ?since= instead.
+
+// clientFrame is anything a client sends over the WebSocket: a message
+// to post, a request for messages it missed, or a room to switch to or
+// leave
+type clientFrame struct {
+	Message
+	Backfill *BackfillRequest `json:"backfill"`
+
+	Join  string `json:"join"`  // Room to move the connection to
+	Leave bool   `json:"leave"` // Leave the room without joining another
+
+	// Access token of a client that connected as a guest, in its first
+	// frame, for clients that can't put it in the URL
+	Auth string `json:"auth"`
+}
+
+// BackfillRequest asks for the messages of the client's room numbered
+// From to To, inclusive
+type BackfillRequest struct {
+	From int64 `json:"from"`
+	To   int64 `json:"to"`
+}
+
+// BackfillFrame answers a BackfillRequest. Complete is false when some
+// of the messages are no longer kept; the client should reload the room's
+// history then.
+type BackfillFrame struct {
+	Backfill BackfillResult `json:"backfill"`
+}
+
+type BackfillResult struct {
+	From     int64     `json:"from"`
+	To       int64     `json:"to"`
+	Messages []Message `json:"messages"`
+	Complete bool      `json:"complete"`
+}
+
+// roomFrames is what this node knows of a room's sequence
+type roomFrames struct {
+	seq    int64     // Last number assigned or seen
+	recent []Message // Latest messages delivered here, oldest first
+}
+
+var (
+	roomSequences   = make(map[int]*roomFrames)
+	roomSequencesMu sync.Mutex
+)
+
+func roomFramesLocked(roomID int) *roomFrames {
+	rf, ok := roomSequences[roomID]
+	if !ok {
+		rf = &roomFrames{}
+		roomSequences[roomID] = rf
+	}
+	return rf
+}
+
+// sequenceMessage numbers a message this node broadcasts as the owner of
+// its room
+func sequenceMessage(msg *Message) {
+	roomSequencesMu.Lock()
+	defer roomSequencesMu.Unlock()
+	rf := roomFramesLocked(msg.RoomID)
+	rf.seq++
+	msg.Seq = rf.seq
+}
+
+// recordFrame keeps a message delivered to this node's clients for
+// backfills
+func recordFrame(msg Message) {
+	if msg.Seq == 0 {
+		return
+	}
+	roomSequencesMu.Lock()
+	defer roomSequencesMu.Unlock()
+	rf := roomFramesLocked(msg.RoomID)
+	if n := len(rf.recent); n > 0 && msg.Seq <= rf.recent[n-1].Seq {
+		// The sequence started over on a new owner
+		rf.recent = nil
+	}
+	rf.seq = max(rf.seq, msg.Seq)
+	rf.recent = append(rf.recent, msg)
+	if len(rf.recent) > backfillBufferSize {
+		rf.recent = slices.Delete(rf.recent, 0, len(rf.recent)-backfillBufferSize)
+	}
+}
+
+// backfill returns the kept messages of a room numbered from to to
+func backfill(roomID int, req BackfillRequest) BackfillFrame {
+	res := BackfillResult{From: req.From, To: req.To, Messages: []Message{}}
+	if req.To-req.From >= backfillBufferSize {
+		res.From = req.To - backfillBufferSize + 1
+	}
+
+	roomSequencesMu.Lock()
+	defer roomSequencesMu.Unlock()
+	if rf, ok := roomSequences[roomID]; ok {
+		for _, msg := range rf.recent {
+			if msg.Seq >= res.From && msg.Seq <= res.To {
+				res.Messages = append(res.Messages, msg)
+			}
+		}
+	}
+	res.Complete = res.From == req.From && int64(len(res.Messages)) == res.To-res.From+1
+	return BackfillFrame{Backfill: res}
+}
+
+// renameRecentFrames sets the name shown on the kept messages a user
+// posted in the rooms, so backfills don't bring back the old one
+func renameRecentFrames(roomIDs []int, userID int, username string) {
+	roomSequencesMu.Lock()
+	defer roomSequencesMu.Unlock()
+	for _, id := range roomIDs {
+		rf, ok := roomSequences[id]
+		if !ok {
+			continue
+		}
+		for i, msg := range rf.recent {
+			if msg.UserID == userID {
+				rf.recent[i].Username = username
+			}
+		}
+	}
+}
+
+// deliveredCopy returns the kept copy of a message its sender already
+// posted with the same client message ID, for a client resending what it
+// queued while it was reconnecting
+func deliveredCopy(msg Message) (Message, bool) {
+	roomSequencesMu.Lock()
+	defer roomSequencesMu.Unlock()
+	rf, ok := roomSequences[msg.RoomID]
+	if !ok {
+		return Message{}, false
+	}
+	for i := len(rf.recent) - 1; i >= 0; i-- {
+		sent := rf.recent[i]
+		if sent.ClientMsgID == msg.ClientMsgID && sent.Username == msg.Username && sent.UserID == msg.UserID {
+			return sent, true
+		}
+	}
+	return Message{}, false
+}
@@ -0,0 +1,175 @@
+package chat
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// First file descriptor passed by systemd socket activation (SD_LISTEN_FDS_START)
+const systemdListenFDsStart = 3
+
+// newHTTPServer builds the http.Server for the given configuration.
+//
+// HTTP/2 is negotiated via ALPN whenever TLS is enabled. With H2C set the
+// server additionally accepts HTTP/2 with prior knowledge on plaintext
+// connections. Either way HTTP/1.1 stays enabled, because the WebSocket
+// handshake on /ws relies on the HTTP/1.1 Upgrade mechanism.
+func newHTTPServer(cfg Config, handler http.Handler) *http.Server {
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	if cfg.TLSEnabled() {
+		protocols.SetHTTP2(true)
+	}
+	if cfg.H2C {
+		protocols.SetUnencryptedHTTP2(true)
+	}
+
+	return &http.Server{
+		Addr:      cfg.Addr,
+		Handler:   handler,
+		Protocols: &protocols,
+	}
+}
+
+// How long a graceful shutdown waits for in-flight requests
+const shutdownTimeout = 10 * time.Second
+
+// runServer starts serving on the listeners and blocks until one of them
+// fails, or until SIGINT or SIGTERM shut the server down gracefully, in
+// which case it returns nil. SIGHUP reloads the config.
+func runServer(cfg Config, srv *http.Server, listeners []net.Listener) error {
+	mode := "plaintext"
+	if cfg.TLSEnabled() {
+		mode = "TLS, HTTP/2 enabled"
+	} else if cfg.H2C {
+		mode = "h2c enabled"
+	}
+
+	errc := make(chan error, len(listeners))
+	for _, l := range listeners {
+		log.Printf("Server started on %s (%s)", l.Addr(), mode)
+		go func(l net.Listener) {
+			if cfg.TLSEnabled() {
+				errc <- srv.ServeTLS(l, cfg.TLSCertFile, cfg.TLSKeyFile)
+			} else {
+				errc <- srv.Serve(l)
+			}
+		}(l)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case err := <-errc:
+			return err
+		case <-hup:
+			if _, err := reloadSettings(); err != nil {
+				log.Printf("Config reload failed, keeping the current settings: %v", err)
+			}
+		case <-ctx.Done():
+			log.Println("Shutting down")
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancel()
+			return srv.Shutdown(shutdownCtx)
+		}
+	}
+}
+
+// closeListeners closes listeners the server won't serve on after all
+func closeListeners(listeners []net.Listener) {
+	for _, l := range listeners {
+		l.Close()
+	}
+}
+
+// openListeners returns the listeners to serve on. Sockets inherited from
+// systemd take precedence, then the Unix socket path, then the TCP address.
+func openListeners(cfg Config) ([]net.Listener, error) {
+	listeners, err := systemdListeners()
+	if err != nil {
+		return nil, err
+	}
+	if len(listeners) > 0 {
+		return listeners, nil
+	}
+
+	if cfg.UnixSocket != "" {
+		l, err := listenUnix(cfg.UnixSocket, cfg.UnixSocketMode)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{l}, nil
+	}
+
+	l, err := net.Listen("tcp", cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	return []net.Listener{l}, nil
+}
+
+// listenUnix listens on a Unix socket path, replacing a stale socket file
+// left behind by a previous run, and applies the configured permissions
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := listenUnixSocket(path, mode)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// systemdListeners returns the listeners passed in by systemd socket
+// activation (LISTEN_PID/LISTEN_FDS), or nil when not socket activated
+func systemdListeners() ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+
+	// Don't pass the variables on to child processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := make([]net.Listener, 0, n)
+	for fd := systemdListenFDsStart; fd < systemdListenFDsStart+n; fd++ {
+		f := os.NewFile(uintptr(fd), "systemd-socket-"+strconv.Itoa(fd))
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("systemd socket fd %d: %w", fd, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
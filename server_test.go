@@ -0,0 +1,44 @@
+package chat
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenUnix(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name string
+		mode os.FileMode
+	}{
+		{"owner only", 0600},
+		{"group", 0660},
+		{"anyone", 0666},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, "chat.sock")
+			l, err := listenUnix(path, tt.mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			fi, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Mode().Perm() != tt.mode {
+				t.Errorf("mode %v, want %v", fi.Mode().Perm(), tt.mode)
+			}
+		})
+	}
+
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listenUnix(file, 0600); err == nil {
+		t.Error("replaced a file that isn't a socket")
+	}
+}
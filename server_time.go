@@ -0,0 +1,71 @@
+package chat
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ServerTime lets clients work out how far their clock is off. With the
+// client's send time t0 and receive time t3, the offset to add to the
+// client's clock is ((ReceivedAt - t0) + (Time - t3)) / 2.
+type ServerTime struct {
+	Time       time.Time  `json:"time"`                 // When the response was written
+	UnixMilli  int64      `json:"unixMilli"`            // Time in milliseconds since the Unix epoch
+	ReceivedAt time.Time  `json:"receivedAt"`           // When the request arrived
+	ClientTime *time.Time `json:"clientTime,omitempty"` // The ?t= the client sent, echoed back
+}
+
+// stampFrame encodes a WebSocket frame into buf with the server's time as
+// its serverTime field, so clients can keep their clocks in step and
+// render relative times consistently. The stamp is written first and the
+// frame's fields moved up behind it, so the frame is encoded only once.
+func stampFrame(buf *bytes.Buffer, v any, now time.Time) error {
+	buf.WriteString(`{"serverTime":"`)
+	buf.Write(now.UTC().AppendFormat(buf.AvailableBuffer(), time.RFC3339Nano))
+	buf.WriteString(`",`)
+	start := buf.Len()
+	if err := encodeJSON(buf, v); err != nil {
+		return err
+	}
+
+	b := buf.Bytes()
+	frame := b[start:]
+	switch {
+	case bytes.Equal(frame, []byte("{}")):
+		buf.Truncate(start - 1)
+		buf.WriteByte('}')
+	case len(frame) >= 2 && frame[0] == '{':
+		copy(frame, frame[1:])
+		buf.Truncate(buf.Len() - 1)
+	default:
+		// Only objects take a stamp
+		buf.Truncate(copy(b, frame))
+	}
+	return nil
+}
+
+// Get the server's time (GET /time). Clients may pass their own send time
+// as ?t= (RFC 3339 or Unix milliseconds) to have it echoed back.
+func getServerTime(w http.ResponseWriter, r *http.Request) {
+	received := time.Now().UTC()
+	resp := ServerTime{ReceivedAt: received}
+	if t := r.URL.Query().Get("t"); t != "" {
+		if ms, err := strconv.ParseInt(t, 10, 64); err == nil {
+			sent := time.UnixMilli(ms).UTC()
+			resp.ClientTime = &sent
+		} else if sent, err := time.Parse(time.RFC3339Nano, t); err == nil {
+			resp.ClientTime = &sent
+		} else {
+			http.Error(w, "t must be an RFC 3339 time or Unix milliseconds", http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	resp.Time = time.Now().UTC()
+	resp.UnixMilli = resp.Time.UnixMilli()
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,275 @@
+package chat
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Name of the cookie carrying the session ID
+const sessionCookieName = "chat_session"
+
+// Session is a logged-in browser session
+type Session struct {
+	ID        string    `json:"id"`
+	UserID    int       `json:"userId"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// SessionStore persists sessions. Implementations must be safe for
+// concurrent use.
+type SessionStore interface {
+	// Create starts a new session for the user that expires after ttl
+	Create(userID int, ttl time.Duration) (Session, error)
+	// Get returns an unexpired session or errSessionNotFound
+	Get(id string) (Session, error)
+	// Renew pushes the session's expiry out to ttl from now
+	Renew(id string, ttl time.Duration) (Session, error)
+	// Delete ends a single session
+	Delete(id string) error
+	// DeleteUser ends every session belonging to the user
+	DeleteUser(userID int) error
+}
+
+var (
+	sessions SessionStore
+
+	// Session cookie settings, taken from the config at startup
+	sessionTTL    time.Duration
+	secureCookies bool
+
+	errSessionNotFound = errors.New("session not found")
+)
+
+// Context key for the authenticated user
+type userContextKey struct{}
+
+// randomToken returns n random bytes encoded as URL-safe base64
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// newSessionID returns a random, URL-safe session identifier
+func newSessionID() (string, error) {
+	return randomToken(32)
+}
+
+// newSessionStore creates the session store selected in the config
+func newSessionStore(cfg Config) (SessionStore, error) {
+	switch cfg.SessionStore {
+	case "", "memory":
+		return newMemorySessionStore(), nil
+	case "redis":
+		return newRedisSessionStore(cfg.RedisURL)
+	default:
+		return nil, errors.New("unknown session store: " + cfg.SessionStore)
+	}
+}
+
+// startSession creates a session for the user and sets the session cookie
+func startSession(w http.ResponseWriter, user User) error {
+	sess, err := sessions.Create(user.ID, sessionTTL)
+	if err != nil {
+		return err
+	}
+	setSessionCookie(w, sess)
+	return nil
+}
+
+// setSessionCookie writes the session cookie to the response
+func setSessionCookie(w http.ResponseWriter, sess Session) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    sess.ID,
+		Path:     "/",
+		Expires:  sess.ExpiresAt,
+		Secure:   secureCookies,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// clearSessionCookie tells the browser to drop the session cookie
+func clearSessionCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		Secure:   secureCookies,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// Middleware that loads the user from the session cookie, if any, and
+// renews sessions that are past half of their lifetime
+func sessionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie(sessionCookieName)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		sess, err := sessions.Get(cookie.Value)
+		if err != nil {
+			if !errors.Is(err, errSessionNotFound) {
+				log.Printf("Session lookup error: %v", err)
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user, ok := findUserByID(r.Context(), sess.UserID)
+		if !ok || user.Banned {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Sliding expiration: renew once half of the TTL has elapsed
+		if time.Until(sess.ExpiresAt) < sessionTTL/2 {
+			renewed, err := sessions.Renew(sess.ID, sessionTTL)
+			if err != nil {
+				log.Printf("Session renew error: %v", err)
+			} else {
+				setSessionCookie(w, renewed)
+			}
+		}
+
+		ctx := context.WithValue(r.Context(), userContextKey{}, user)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// currentUser returns the user authenticated for this request
+func currentUser(r *http.Request) (User, bool) {
+	user, ok := r.Context().Value(userContextKey{}).(User)
+	return user, ok
+}
+
+// Log out of the current session (POST /auth/logout)
+func logout(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		if err := sessions.Delete(cookie.Value); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	clearSessionCookie(w)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Log out of every session of the current user (POST /auth/logout-all)
+func logoutEverywhere(w http.ResponseWriter, r *http.Request) {
+	user, _ := currentUser(r)
+
+	if err := sessions.DeleteUser(user.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Access tokens were handed out along with the sessions
+	if err := revokeAccessTokens(r.Context(), user.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	clearSessionCookie(w)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/////////////////////////////
+// In-memory Session Store //
+/////////////////////////////
+
+// memorySessionStore keeps sessions in process memory. Sessions are lost
+// on restart and aren't shared between instances.
+type memorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]Session
+}
+
+func newMemorySessionStore() *memorySessionStore {
+	return &memorySessionStore{sessions: make(map[string]Session)}
+}
+
+func (s *memorySessionStore) Create(userID int, ttl time.Duration) (Session, error) {
+	id, err := newSessionID()
+	if err != nil {
+		return Session{}, err
+	}
+
+	now := time.Now().UTC()
+	sess := Session{ID: id, UserID: userID, CreatedAt: now, ExpiresAt: now.Add(ttl)}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sweep(now)
+	s.sessions[id] = sess
+	return sess, nil
+}
+
+func (s *memorySessionStore) Get(id string) (Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess, ok := s.sessions[id]
+	if !ok || time.Now().After(sess.ExpiresAt) {
+		return Session{}, errSessionNotFound
+	}
+	return sess, nil
+}
+
+func (s *memorySessionStore) Renew(id string, ttl time.Duration) (Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess, ok := s.sessions[id]
+	if !ok || time.Now().After(sess.ExpiresAt) {
+		return Session{}, errSessionNotFound
+	}
+	sess.ExpiresAt = time.Now().UTC().Add(ttl)
+	s.sessions[id] = sess
+	return sess, nil
+}
+
+func (s *memorySessionStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.sessions, id)
+	return nil
+}
+
+func (s *memorySessionStore) DeleteUser(userID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, sess := range s.sessions {
+		if sess.UserID == userID {
+			delete(s.sessions, id)
+		}
+	}
+	return nil
+}
+
+// sweep drops expired sessions. The caller must hold s.mu.
+func (s *memorySessionStore) sweep(now time.Time) {
+	for id, sess := range s.sessions {
+		if now.After(sess.ExpiresAt) {
+			delete(s.sessions, id)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Timeout applied to every Redis round trip made by the session store
+const redisSessionTimeout = 2 * time.Second
+
+// redisSessionStore keeps sessions in Redis so they survive restarts and
+// are shared by every instance. Each session is stored under its own key
+// with a TTL, and a per-user set indexes the session IDs for logout
+// everywhere.
+type redisSessionStore struct {
+	client *redis.Client
+}
+
+func newRedisSessionStore(url string) (*redisSessionStore, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+
+	client := redis.NewClient(opts)
+	ctx, cancel := context.WithTimeout(context.Background(), redisSessionTimeout)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		return nil, err
+	}
+	return &redisSessionStore{client: client}, nil
+}
+
+func redisSessionKey(id string) string {
+	return "chat:session:" + id
+}
+
+func redisUserSessionsKey(userID int) string {
+	return "chat:user-sessions:" + strconv.Itoa(userID)
+}
+
+func (s *redisSessionStore) Create(userID int, ttl time.Duration) (Session, error) {
+	id, err := newSessionID()
+	if err != nil {
+		return Session{}, err
+	}
+
+	now := time.Now().UTC()
+	sess := Session{ID: id, UserID: userID, CreatedAt: now, ExpiresAt: now.Add(ttl)}
+	if err := s.save(sess); err != nil {
+		return Session{}, err
+	}
+	return sess, nil
+}
+
+func (s *redisSessionStore) Get(id string) (Session, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisSessionTimeout)
+	defer cancel()
+
+	data, err := s.client.Get(ctx, redisSessionKey(id)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return Session{}, errSessionNotFound
+	}
+	if err != nil {
+		return Session{}, err
+	}
+
+	var sess Session
+	if err := json.Unmarshal(data, &sess); err != nil {
+		return Session{}, err
+	}
+	return sess, nil
+}
+
+func (s *redisSessionStore) Renew(id string, ttl time.Duration) (Session, error) {
+	sess, err := s.Get(id)
+	if err != nil {
+		return Session{}, err
+	}
+
+	sess.ExpiresAt = time.Now().UTC().Add(ttl)
+	if err := s.save(sess); err != nil {
+		return Session{}, err
+	}
+	return sess, nil
+}
+
+func (s *redisSessionStore) Delete(id string) error {
+	sess, err := s.Get(id)
+	if errors.Is(err, errSessionNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisSessionTimeout)
+	defer cancel()
+
+	pipe := s.client.TxPipeline()
+	pipe.Del(ctx, redisSessionKey(id))
+	pipe.SRem(ctx, redisUserSessionsKey(sess.UserID), id)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+func (s *redisSessionStore) DeleteUser(userID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisSessionTimeout)
+	defer cancel()
+
+	ids, err := s.client.SMembers(ctx, redisUserSessionsKey(userID)).Result()
+	if err != nil {
+		return err
+	}
+
+	keys := []string{redisUserSessionsKey(userID)}
+	for _, id := range ids {
+		keys = append(keys, redisSessionKey(id))
+	}
+	return s.client.Del(ctx, keys...).Err()
+}
+
+// save writes the session with a TTL matching its expiry and records it in
+// the user's session index
+func (s *redisSessionStore) save(sess Session) error {
+	data, err := json.Marshal(sess)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisSessionTimeout)
+	defer cancel()
+
+	ttl := time.Until(sess.ExpiresAt)
+	pipe := s.client.TxPipeline()
+	pipe.Set(ctx, redisSessionKey(sess.ID), data, ttl)
+	pipe.SAdd(ctx, redisUserSessionsKey(sess.UserID), sess.ID)
+	// The index only needs to live as long as the newest session
+	pipe.Expire(ctx, redisUserSessionsKey(sess.UserID), ttl)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+func (s *redisSessionStore) Ping(ctx context.Context) error {
+	return s.client.Ping(ctx).Err()
+}
@@ -0,0 +1,66 @@
+package chat
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Longest slow mode interval a room can have
+const maxSlowMode = 6 * time.Hour
+
+// slowModePoster identifies who posted in a slow-mode room
+type slowModePoster struct {
+	roomID int
+	poster string // "user:<id>", or "ip:<addr>" for guests
+}
+
+var (
+	// When each poster last got a message through
+	lastPosts  = make(map[slowModePoster]time.Time)
+	slowModeMu sync.Mutex
+)
+
+// takeSlowModeTurn records a post and returns 0, or returns how long the
+// poster still has to wait
+func takeSlowModeTurn(key slowModePoster, interval time.Duration) time.Duration {
+	slowModeMu.Lock()
+	defer slowModeMu.Unlock()
+
+	now := time.Now()
+	if wait := lastPosts[key].Add(interval).Sub(now); wait > 0 {
+		return wait
+	}
+	lastPosts[key] = now
+
+	// Forget posters that no interval can hold back any more
+	if len(lastPosts) > 10000 {
+		for k, t := range lastPosts {
+			if now.Sub(t) > maxSlowMode {
+				delete(lastPosts, k)
+			}
+		}
+	}
+	return 0
+}
+
+// slowDownMessages enforces the room's slow mode: each user may post once
+// per interval, and offenders are told how long to wait. Moderators, the
+// workspace owners and admins, are exempt.
+func slowDownMessages(next MessageHandler) MessageHandler {
+	return func(mc *MessageContext) error {
+		interval := time.Duration(latestRoom(mc.Room).SlowMode) * time.Second
+		if interval <= 0 || mc.LoggedIn && canManageWorkspace(mc.Request.Context(), requestWorkspace(mc.Request), mc.User) {
+			return next(mc)
+		}
+
+		key := slowModePoster{roomID: mc.Room.ID, poster: "ip:" + clientIP(mc.Request)}
+		if mc.LoggedIn {
+			key.poster = "user:" + strconv.Itoa(mc.User.ID)
+		}
+		if wait := takeSlowModeTurn(key, interval); wait > 0 {
+			return rejectMessageFor(wait, rejectSlowMode, "Slow mode is on, wait %s before posting again", (wait + time.Second - 1).Truncate(time.Second))
+		}
+		return next(mc)
+	}
+}
@@ -0,0 +1,327 @@
+package chat
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SMSConfig holds the text message gateway settings. Without a provider,
+// text messages are only written to the log.
+type SMSConfig struct {
+	Provider   string // "twilio", or empty to only log
+	APIURL     string // Base URL of the Twilio-compatible API
+	AccountSID string
+	AuthToken  string
+	From       string // Sender number in E.164 format
+	// MaxPerHour caps the text messages sent to one user in an hour,
+	// codes included. 0 means no cap
+	MaxPerHour int
+}
+
+// SMSProvider sends text messages through one gateway
+type SMSProvider interface {
+	SendSMS(to, body string) error
+}
+
+const (
+	smsCodeTTL         = 10 * time.Minute
+	smsCodeMaxAttempts = 5
+	// Notifications are cut to fit in two text messages
+	smsMaxLength = 300
+)
+
+var (
+	// Active text message gateway, selected in the config at startup
+	smsProvider   SMSProvider = logSMSProvider{}
+	smsMaxPerHour int
+
+	// When text messages went out recently, by user ID, for the rate cap
+	smsSent   = make(map[int][]time.Time)
+	smsSentMu sync.Mutex
+
+	// Phone numbers waiting to be confirmed, by user ID
+	phoneVerifications   = make(map[int]smsCode)
+	phoneVerificationsMu sync.Mutex
+
+	// Phone numbers in E.164 format, e.g. +14155550100
+	phonePattern = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+
+	// An urgent mention, "@@username", also texts the user
+	urgentMentionPattern = regexp.MustCompile(`@@([^\s@,.:;!?]+)`)
+
+	errNoPhone          = errors.New("user has no phone number")
+	errSMSRateLimited   = errors.New("too many text messages, try again later")
+	errSMSNotRequested  = errors.New("no code has been sent")
+	errSMSCodeIncorrect = errors.New("invalid code")
+)
+
+// smsCode is a one-time code sent by text message
+type smsCode struct {
+	Phone     string // Number the code was sent to
+	Hash      string
+	ExpiresAt time.Time
+	Attempts  int
+}
+
+// newSMSProvider returns the gateway selected in the config
+func newSMSProvider(cfg SMSConfig) (SMSProvider, error) {
+	switch cfg.Provider {
+	case "":
+		return logSMSProvider{}, nil
+	case "twilio":
+		if cfg.AccountSID == "" || cfg.AuthToken == "" || cfg.From == "" {
+			return nil, errors.New("twilio needs an account SID, auth token and sender number")
+		}
+		return &twilioProvider{cfg: cfg, client: &http.Client{Timeout: 10 * time.Second}}, nil
+	default:
+		return nil, fmt.Errorf("unknown SMS provider %q", cfg.Provider)
+	}
+}
+
+// sendSMS texts a user at phone, unless the rate cap has been reached
+func sendSMS(user User, phone, body string) error {
+	now := time.Now()
+	smsSentMu.Lock()
+	recent := smsSent[user.ID][:0]
+	for _, t := range smsSent[user.ID] {
+		if now.Sub(t) < time.Hour {
+			recent = append(recent, t)
+		}
+	}
+	if smsMaxPerHour > 0 && len(recent) >= smsMaxPerHour {
+		smsSent[user.ID] = recent
+		smsSentMu.Unlock()
+		return errSMSRateLimited
+	}
+	smsSent[user.ID] = append(recent, now)
+	smsSentMu.Unlock()
+
+	return smsProvider.SendSMS(phone, body)
+}
+
+// newSMSCode generates a six-digit code
+func newSMSCode(phone string) (string, smsCode, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", smsCode{}, err
+	}
+	code := fmt.Sprintf("%06d", n.Int64())
+	return code, smsCode{Phone: phone, Hash: hashSMSCode(code), ExpiresAt: time.Now().Add(smsCodeTTL)}, nil
+}
+
+func hashSMSCode(code string) string {
+	sum := sha256.Sum256([]byte(strings.TrimSpace(code)))
+	return hex.EncodeToString(sum[:])
+}
+
+// check counts an attempt and reports whether code matches
+func (c *smsCode) check(code string) error {
+	if c.Hash == "" || time.Now().After(c.ExpiresAt) || c.Attempts >= smsCodeMaxAttempts {
+		return errSMSNotRequested
+	}
+	c.Attempts++
+	if subtle.ConstantTimeCompare([]byte(c.Hash), []byte(hashSMSCode(code))) != 1 {
+		return errSMSCodeIncorrect
+	}
+	return nil
+}
+
+// smsNotifier texts notifications to users who have confirmed a phone
+// number and turned on text notifications
+type smsNotifier struct{}
+
+func (smsNotifier) Notify(user User, n Notification) error {
+	if user.Phone == "" {
+		return errNoPhone
+	}
+	if !user.Preferences.SMSNotifications || user.Preferences.notificationsMuted(time.Now()) {
+		return nil
+	}
+
+	body := []rune(n.Subject + ": " + n.Body)
+	if len(body) > smsMaxLength {
+		body = append(body[:smsMaxLength-1], '…')
+	}
+	return sendSMS(user, user.Phone, string(body))
+}
+
+// textUrgentMentions texts the users a logged-in sender mentions with
+// "@@username" once the message has gone out
+func textUrgentMentions(next MessageHandler) MessageHandler {
+	return func(mc *MessageContext) error {
+		if !mc.LoggedIn {
+			return next(mc)
+		}
+
+		ws := requestWorkspace(mc.Request)
+		notified := make(map[int]bool)
+		for _, m := range urgentMentionPattern.FindAllStringSubmatch(mc.Message.Content, -1) {
+			user, ok := findUserByUsername(mc.Request.Context(), m[1])
+			if !ok || user.ID == mc.User.ID || user.Phone == "" || notified[user.ID] || !isWorkspaceMember(mc.Request.Context(), ws, user.ID) {
+				continue
+			}
+			notified[user.ID] = true
+			notifyAsync(smsNotifier{}, user, Notification{
+				Subject: fmt.Sprintf("%s in #%s", mc.User.Username, mc.Room.Name),
+				Body:    mc.Message.Content,
+			})
+		}
+		return next(mc)
+	}
+}
+
+// twilioProvider sends text messages through the Twilio Messages API, or
+// any service that implements it
+type twilioProvider struct {
+	cfg    SMSConfig
+	client *http.Client
+}
+
+func (p *twilioProvider) SendSMS(to, body string) error {
+	endpoint := strings.TrimSuffix(p.cfg.APIURL, "/") + "/2010-04-01/Accounts/" + url.PathEscape(p.cfg.AccountSID) + "/Messages.json"
+	form := url.Values{"To": {to}, "From": {p.cfg.From}, "Body": {body}}
+
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(p.cfg.AccountSID, p.cfg.AuthToken)
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		var apiErr struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(io.LimitReader(res.Body, 64<<10)).Decode(&apiErr)
+		return fmt.Errorf("twilio: %s: %s", res.Status, apiErr.Message)
+	}
+	return nil
+}
+
+// logSMSProvider writes text messages to the server log instead of
+// sending them
+type logSMSProvider struct{}
+
+func (logSMSProvider) SendSMS(to, body string) error {
+	log.Printf("Text message to %s: %s", to, body)
+	return nil
+}
+
+///////////////////////////////
+// Phone Number API Handlers //
+///////////////////////////////
+
+// PhoneNumber is the request body for setting a phone number
+type PhoneNumber struct {
+	Phone string `json:"phone"`
+}
+
+// Set the logged-in user's phone number and text them a code to confirm
+// it (PUT /me/phone)
+func setPhoneNumber(w http.ResponseWriter, r *http.Request) {
+	user, _ := currentUser(r)
+
+	var req PhoneNumber
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	phone := strings.NewReplacer(" ", "", "-", "", "(", "", ")", "").Replace(req.Phone)
+	if !phonePattern.MatchString(phone) {
+		http.Error(w, "Phone numbers must be in international format, e.g. +14155550100", http.StatusBadRequest)
+		return
+	}
+
+	code, pending, err := newSMSCode(phone)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = sendSMS(user, phone, fmt.Sprintf("Your %s verification code is %s", totpIssuer, code))
+	if errors.Is(err, errSMSRateLimited) {
+		http.Error(w, "Too many text messages, try again later", http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		log.Printf("Text message to user %d failed: %v", user.ID, err)
+		http.Error(w, "Couldn't send a text message to that number", http.StatusBadGateway)
+		return
+	}
+
+	phoneVerificationsMu.Lock()
+	phoneVerifications[user.ID] = pending
+	phoneVerificationsMu.Unlock()
+
+	// The number only replaces the current one once it's confirmed
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"status": "code sent"})
+}
+
+// Confirm the phone number with the texted code (POST /me/phone/verify)
+func verifyPhoneNumber(w http.ResponseWriter, r *http.Request) {
+	user, _ := currentUser(r)
+
+	var req TwoFactorCode
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	phoneVerificationsMu.Lock()
+	pending := phoneVerifications[user.ID]
+	err = pending.check(req.Code)
+	if err == nil {
+		delete(phoneVerifications, user.ID)
+	} else if pending.Hash != "" {
+		phoneVerifications[user.ID] = pending
+	}
+	phoneVerificationsMu.Unlock()
+
+	if errors.Is(err, errSMSNotRequested) {
+		http.Error(w, "No code has been sent, or it has expired", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Invalid code", http.StatusBadRequest)
+		return
+	}
+
+	user, _ = updateUser(r.Context(), user.ID, func(u *User) { u.Phone = pending.Phone })
+	json.NewEncoder(w).Encode(user)
+}
+
+// Remove the logged-in user's phone number (DELETE /me/phone)
+func removePhoneNumber(w http.ResponseWriter, r *http.Request) {
+	user, _ := currentUser(r)
+
+	user, _ = updateUser(r.Context(), user.ID, func(u *User) {
+		u.Phone = ""
+		u.Preferences.SMSNotifications = false
+	})
+	phoneVerificationsMu.Lock()
+	delete(phoneVerifications, user.ID)
+	phoneVerificationsMu.Unlock()
+
+	json.NewEncoder(w).Encode(user)
+}
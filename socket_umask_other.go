@@ -0,0 +1,14 @@
+//go:build !unix
+
+package chat
+
+import (
+	"net"
+	"os"
+)
+
+// listenUnixSocket listens on the socket; there's no umask to narrow
+// here, so only the chmod after it applies the mode
+func listenUnixSocket(path string, _ os.FileMode) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
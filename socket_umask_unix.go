@@ -0,0 +1,18 @@
+//go:build unix
+
+package chat
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+// listenUnixSocket creates the socket under a umask that leaves it no
+// more open than mode, so it's never reachable with the default umask's
+// permissions before the chmod
+func listenUnixSocket(path string, mode os.FileMode) (net.Listener, error) {
+	old := syscall.Umask(0o777 &^ int(mode.Perm()))
+	defer syscall.Umask(old)
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,133 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// StoredAttachment records an attachment kept on disk: its size and who
+// shared it where
+type StoredAttachment struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Size        int64     `json:"size"`
+	UserID      int       `json:"userId"`
+	WorkspaceID int       `json:"workspaceId"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// StorageUsage is how many bytes of attachments a user or workspace takes
+// up, out of its quota
+type StorageUsage struct {
+	Used  int64 `json:"used"`
+	Quota int64 `json:"quota,omitempty"` // 0 when unlimited
+}
+
+// StorageQuotaExceeded is returned for an upload that would take its
+// uploader or workspace over their storage quota
+type StorageQuotaExceeded struct {
+	Name  string
+	Owner string // "your" or "the workspace's"
+	StorageUsage
+}
+
+func (e *StorageQuotaExceeded) Error() string {
+	return fmt.Sprintf("%s would go over %s storage quota: %s of %s used",
+		e.Name, e.Owner, formatByteSize(e.Used), formatByteSize(e.Quota))
+}
+
+// checkStorageQuota returns *StorageQuotaExceeded when size more bytes
+// would take a user or workspace over their quota
+func checkStorageQuota(ctx context.Context, name string, size int64, userID, workspaceID int) error {
+	cfg := attachmentConfig
+	if cfg.UserQuota <= 0 && cfg.WorkspaceQuota <= 0 {
+		return nil
+	}
+	byUser, byWorkspace, err := store.StorageUsage(ctx)
+	if err != nil {
+		return err
+	}
+	if cfg.UserQuota > 0 && byUser[userID]+size > cfg.UserQuota {
+		return &StorageQuotaExceeded{Name: name, Owner: "your", StorageUsage: StorageUsage{byUser[userID], cfg.UserQuota}}
+	}
+	if cfg.WorkspaceQuota > 0 && byWorkspace[workspaceID]+size > cfg.WorkspaceQuota {
+		return &StorageQuotaExceeded{Name: name, Owner: "the workspace's",
+			StorageUsage: StorageUsage{byWorkspace[workspaceID], cfg.WorkspaceQuota}}
+	}
+	return nil
+}
+
+// userStorageUsage returns the storage a user takes up
+func userStorageUsage(ctx context.Context, userID int) (StorageUsage, error) {
+	byUser, _, err := store.StorageUsage(ctx)
+	return StorageUsage{Used: byUser[userID], Quota: attachmentConfig.UserQuota}, err
+}
+
+// formatByteSize writes a number of bytes for people, e.g. "1.5 MB"
+func formatByteSize(n int64) string {
+	const unit = 1000
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "kMGTPE"[exp])
+}
+
+///////////////////////////////
+// Storage Admin API Handler //
+///////////////////////////////
+
+// userStorage is a user's line in the storage report
+type userStorage struct {
+	UserID   int    `json:"userId"`
+	Username string `json:"username"`
+	StorageUsage
+}
+
+// workspaceStorage is a workspace's line in the storage report
+type workspaceStorage struct {
+	WorkspaceID int    `json:"workspaceId"`
+	Slug        string `json:"slug"`
+	StorageUsage
+}
+
+// Get the storage every user and workspace takes up (GET /admin/storage)
+func getStorageUsage(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	byUser, byWorkspace, err := store.StorageUsage(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	users, err := store.ListUsers(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	workspaces, err := store.ListWorkspaces(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	report := struct {
+		Users      []userStorage      `json:"users"`
+		Workspaces []workspaceStorage `json:"workspaces"`
+	}{Users: []userStorage{}, Workspaces: []workspaceStorage{}}
+	for _, u := range users {
+		report.Users = append(report.Users, userStorage{u.ID, u.Username,
+			StorageUsage{byUser[u.ID], attachmentConfig.UserQuota}})
+	}
+	for _, ws := range workspaces {
+		report.Workspaces = append(report.Workspaces, workspaceStorage{ws.ID, ws.Slug,
+			StorageUsage{byWorkspace[ws.ID], attachmentConfig.WorkspaceQuota}})
+	}
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,375 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Store is the persistence layer. Handlers only talk to these interfaces,
+// so the in-memory, SQLite and Postgres implementations are
+// interchangeable. Implementations must be safe for concurrent use.
+type Store interface {
+	UserRepository
+	TaskRepository
+	TaskHistoryRepository
+	ProjectRepository
+	MessageRepository
+	RoomRepository
+	WorkspaceRepository
+	APITokenRepository
+	RoomWebhookRepository
+	AutomationRepository
+	EventSubscriptionRepository
+	ScheduledMessageRepository
+	AttachmentRepository
+	HeldMessageRepository
+	EventLogRepository
+	ServerStateRepository
+	AuditRepository
+	ActivityRepository
+	ReadMarkerRepository
+	PinRepository
+	BackupRepository
+
+	Close() error
+}
+
+// UserRepository stores user accounts and the external identities linked
+// to them
+type UserRepository interface {
+	// CreateUser assigns an ID and stores the user. Usernames and email
+	// addresses are unique regardless of case (errUsernameTaken, errEmailTaken).
+	CreateUser(ctx context.Context, user User) (User, error)
+	GetUser(ctx context.Context, id int) (User, error)
+	FindUserByUsername(ctx context.Context, username string) (User, error)
+	FindUserByEmail(ctx context.Context, email string) (User, error)
+	// UpdateUser atomically applies fn to the stored user. Nothing is
+	// saved when fn returns an error.
+	UpdateUser(ctx context.Context, id int, fn func(u *User) error) (User, error)
+	ListUsers(ctx context.Context) ([]User, error)
+
+	// LinkIdentity links an external login (e.g. an OAuth subject) to a user
+	LinkIdentity(ctx context.Context, provider, subject string, userID int) error
+	// FindIdentity returns the ID of the user linked to an external login
+	FindIdentity(ctx context.Context, provider, subject string) (int, error)
+}
+
+// TaskRepository stores tasks. Every task belongs to one workspace and is
+// only found through it. Each write appends its event to the history of
+// the task in the same transaction, so neither is stored without the
+// other; by is who made the change, empty when not logged in.
+type TaskRepository interface {
+	CreateTask(ctx context.Context, task Task, by string) (Task, error)
+	ListTasks(ctx context.Context, workspaceID int) ([]Task, error)
+	GetTask(ctx context.Context, workspaceID, id int) (Task, error)
+	// UpdateTask replaces the stored task with the same ID and workspace
+	UpdateTask(ctx context.Context, task Task, by string) (Task, error)
+	DeleteTask(ctx context.Context, workspaceID, id int, by string) error
+	// MergeTasks replaces a task and the task of the same workspace merged
+	// into it at once. The task's history gains a merged event.
+	MergeTasks(ctx context.Context, task, other Task, by string) (Task, error)
+	// ClaimTask atomically assigns an open task to username until the
+	// claim expires. It fails with errTaskClaimed while someone else holds
+	// the task, unless their claim expired before now.
+	ClaimTask(ctx context.Context, workspaceID, id int, username string, expires, now time.Time) (Task, error)
+	// ReleaseExpiredClaims unassigns the tasks whose claim expired before
+	// now and returns them
+	ReleaseExpiredClaims(ctx context.Context, now time.Time) ([]Task, error)
+}
+
+// TaskHistoryRepository reads the history of tasks: their events, and
+// snapshots of their state, which the task writes add. History outlives
+// deleted tasks.
+type TaskHistoryRepository interface {
+	// ListTaskEvents returns the events of a task after a version, oldest
+	// first
+	ListTaskEvents(ctx context.Context, workspaceID, taskID, afterVersion int) ([]TaskEvent, error)
+	// ListWorkspaceTaskEvents returns up to limit events of the
+	// workspace's tasks with an ID above afterID, oldest first. A
+	// workspace's events are stored in the order of their IDs, so none
+	// turns up later below an ID already listed.
+	ListWorkspaceTaskEvents(ctx context.Context, workspaceID int, afterID int64, limit int) ([]TaskEvent, error)
+	// LastTaskEventID returns the ID of the workspace's latest task event,
+	// or 0 when there are none
+	LastTaskEventID(ctx context.Context, workspaceID int) (int64, error)
+	// GetTaskSnapshot returns the latest snapshot of a task at or before
+	// a version
+	GetTaskSnapshot(ctx context.Context, workspaceID, taskID, version int) (TaskSnapshot, error)
+	// RenameTaskUser replaces a username in the workspace's task
+	// assignees and task history, and returns how many tasks, events and
+	// snapshots changed
+	RenameTaskUser(ctx context.Context, workspaceID int, username, newName string) (int, error)
+}
+
+// ProjectRepository stores projects, which group the tasks of a workspace
+type ProjectRepository interface {
+	CreateProject(ctx context.Context, project Project) (Project, error)
+	ListProjects(ctx context.Context, workspaceID int) ([]Project, error)
+	GetProject(ctx context.Context, workspaceID, id int) (Project, error)
+	SetProjectWIPLimits(ctx context.Context, workspaceID, id int, limits map[string]int) (Project, error)
+}
+
+// MessageRepository stores chat messages
+type MessageRepository interface {
+	// SaveMessages stores a batch of messages, assigning their IDs in order
+	SaveMessages(ctx context.Context, msgs []Message) error
+	// ListMessages returns up to limit messages of a room with an ID below
+	// beforeID (or the latest ones when beforeID is 0), oldest first
+	ListMessages(ctx context.Context, roomID, beforeID, limit int) ([]Message, error)
+	// SearchMessages returns up to limit messages in the workspace's rooms
+	// that contain text, ignoring case, newest first
+	SearchMessages(ctx context.Context, workspaceID int, text string, limit int) ([]Message, error)
+	// DeleteMessages removes every message of a room, and its pins, and
+	// returns how many messages there were
+	DeleteMessages(ctx context.Context, roomID int) (int, error)
+	// ListMessagesBefore returns up to limit messages of any room posted
+	// before t, oldest first
+	ListMessagesBefore(ctx context.Context, t time.Time, limit int) ([]Message, error)
+	// DeleteMessageIDs removes the messages with the given IDs
+	DeleteMessageIDs(ctx context.Context, ids []int) error
+	// CountUserMessages returns how many stored messages a user posted
+	CountUserMessages(ctx context.Context, userID int) (int, error)
+	// ListUserMessages returns up to limit messages a user posted in the
+	// workspace's rooms from from until before until, with an ID above
+	// afterID, oldest first
+	ListUserMessages(ctx context.Context, workspaceID, userID int, from, until time.Time, afterID, limit int) ([]Message, error)
+	// RenameUserMessages sets the name shown on the messages a user posted
+	// in the workspace's rooms and returns how many there were
+	RenameUserMessages(ctx context.Context, workspaceID, userID int, username string) (int, error)
+}
+
+// RoomRepository stores chat rooms. Room names are unique per workspace.
+type RoomRepository interface {
+	CreateRoom(ctx context.Context, room Room) (Room, error)
+	ListRooms(ctx context.Context, workspaceID int) ([]Room, error)
+	FindRoom(ctx context.Context, workspaceID int, name string) (Room, error)
+	SetRoomSlowMode(ctx context.Context, id, seconds int) (Room, error)
+	SetRoomPolicy(ctx context.Context, id int, policy RoomPolicy) (Room, error)
+	SetRoomBranding(ctx context.Context, id int, branding RoomBranding) (Room, error)
+}
+
+// WorkspaceRepository stores workspaces and their members
+type WorkspaceRepository interface {
+	// CreateWorkspace stores a workspace, failing with errSlugTaken when the
+	// slug is in use
+	CreateWorkspace(ctx context.Context, ws Workspace) (Workspace, error)
+	ListWorkspaces(ctx context.Context) ([]Workspace, error)
+	FindWorkspace(ctx context.Context, slug string) (Workspace, error)
+	UpdateWorkspaceSettings(ctx context.Context, id int, settings WorkspaceSettings) (Workspace, error)
+
+	// AddMember adds a member, or changes the role of an existing one
+	AddMember(ctx context.Context, m WorkspaceMember) (WorkspaceMember, error)
+	GetMember(ctx context.Context, workspaceID, userID int) (WorkspaceMember, error)
+	ListMembers(ctx context.Context, workspaceID int) ([]WorkspaceMember, error)
+	RemoveMember(ctx context.Context, workspaceID, userID int) error
+}
+
+// APITokenRepository stores API tokens. Tokens are looked up by the hash
+// of their secret, which is all that is kept of it.
+type APITokenRepository interface {
+	CreateAPIToken(ctx context.Context, token APIToken) (APIToken, error)
+	GetAPIToken(ctx context.Context, id int) (APIToken, error)
+	FindAPIToken(ctx context.Context, hash string) (APIToken, error)
+	ListAPITokens(ctx context.Context, userID int) ([]APIToken, error)
+	// UpdateAPIToken atomically applies fn to the stored token. Nothing is
+	// saved when fn returns an error.
+	UpdateAPIToken(ctx context.Context, id int, fn func(t *APIToken) error) (APIToken, error)
+	DeleteAPIToken(ctx context.Context, id int) error
+}
+
+// RoomWebhookRepository stores the webhooks of rooms. Every node keeps
+// them all in memory, so they are listed all at once.
+type RoomWebhookRepository interface {
+	CreateRoomWebhook(ctx context.Context, hook RoomWebhook) (RoomWebhook, error)
+	ListRoomWebhooks(ctx context.Context) ([]RoomWebhook, error)
+	DeleteRoomWebhook(ctx context.Context, id int) error
+}
+
+// AutomationRepository stores the automations of every workspace, which
+// every node keeps in memory
+type AutomationRepository interface {
+	CreateAutomation(ctx context.Context, a Automation) (Automation, error)
+	ListAutomations(ctx context.Context) ([]Automation, error)
+	// UpdateAutomation replaces the name, enabled flag, trigger and actions
+	UpdateAutomation(ctx context.Context, a Automation) (Automation, error)
+	DeleteAutomation(ctx context.Context, id int) error
+}
+
+// EventSubscriptionRepository stores the event subscriptions of every
+// workspace, which every node keeps in memory
+type EventSubscriptionRepository interface {
+	CreateEventSubscription(ctx context.Context, sub EventSubscription) (EventSubscription, error)
+	ListEventSubscriptions(ctx context.Context) ([]EventSubscription, error)
+	DeleteEventSubscription(ctx context.Context, id int) error
+}
+
+// ScheduledMessageRepository stores the scheduled messages of every
+// workspace, which every node keeps in memory
+type ScheduledMessageRepository interface {
+	CreateScheduledMessage(ctx context.Context, sm ScheduledMessage) (ScheduledMessage, error)
+	ListScheduledMessages(ctx context.Context) ([]ScheduledMessage, error)
+	// SetScheduledMessageRun saves when a scheduled message runs next
+	SetScheduledMessageRun(ctx context.Context, id int, next time.Time) error
+	DeleteScheduledMessage(ctx context.Context, id int) error
+}
+
+// AttachmentRepository records the attachments kept on disk, so storage
+// quotas know how much each user and workspace takes up
+type AttachmentRepository interface {
+	CreateStoredAttachment(ctx context.Context, a StoredAttachment) error
+	// StorageUsage returns the bytes of attachments each user shared and
+	// each workspace holds; those without any are left out
+	StorageUsage(ctx context.Context) (byUser, byWorkspace map[int]int64, err error)
+}
+
+// HeldMessageRepository stores chat messages waiting for a moderator
+type HeldMessageRepository interface {
+	CreateHeldMessage(ctx context.Context, m HeldMessage) (HeldMessage, error)
+	// ListHeldMessages returns the held messages of a workspace, oldest
+	// first
+	ListHeldMessages(ctx context.Context, workspaceID int) ([]HeldMessage, error)
+	// TakeHeldMessage removes a held message and returns it, so only one
+	// moderator gets to decide on it
+	TakeHeldMessage(ctx context.Context, workspaceID, id int) (HeldMessage, error)
+}
+
+// EventLogRepository keeps the domain events of every workspace for
+// integrations to replay
+type EventLogRepository interface {
+	// AppendEvents stores a batch of events, assigning their IDs in order
+	AppendEvents(ctx context.Context, events []LoggedEvent) error
+	// ListEvents returns up to limit events of a workspace with an ID above
+	// afterID, oldest first, only of the given types unless types is empty
+	ListEvents(ctx context.Context, workspaceID int, afterID int64, types []string, limit int) ([]LoggedEvent, error)
+	// OldestEventID returns the ID of the oldest event kept in any
+	// workspace, or 0 when there are none
+	OldestEventID(ctx context.Context) (int64, error)
+	// DeleteEventsBefore removes the events that happened before t and
+	// returns how many there were
+	DeleteEventsBefore(ctx context.Context, t time.Time) (int, error)
+	// UpdateEventData replaces the data of a stored event
+	UpdateEventData(ctx context.Context, id int64, data json.RawMessage) error
+}
+
+// ServerStateRepository keeps server-wide state that admins change at
+// runtime, so it outlives restarts and reaches every node
+type ServerStateRepository interface {
+	// GetServerState returns the value saved under key, or errNotFound
+	GetServerState(ctx context.Context, key string) (string, error)
+	SetServerState(ctx context.Context, key, value string) error
+}
+
+// AuditRepository keeps the audit log
+type AuditRepository interface {
+	// AppendAuditEvent assigns the next ID and stores the event
+	AppendAuditEvent(ctx context.Context, e AuditEvent) (AuditEvent, error)
+	// ListAuditEvents returns the events the filter selects, oldest first
+	ListAuditEvents(ctx context.Context, f AuditFilter) ([]AuditEvent, error)
+	// DeleteAuditEventsBefore removes the events recorded before t and
+	// returns how many there were
+	DeleteAuditEventsBefore(ctx context.Context, t time.Time) (int, error)
+}
+
+// ActivityRepository keeps the gamification stats of users
+type ActivityRepository interface {
+	// UpdateActivity atomically applies fn to a user's stats, which start
+	// out empty, and saves them
+	UpdateActivity(ctx context.Context, userID int, fn func(a *UserActivity)) (UserActivity, error)
+	// ListRoomActivity returns the stats of the users who posted in a
+	// room, with RoomMessages holding only that room
+	ListRoomActivity(ctx context.Context, roomID int) ([]UserActivity, error)
+}
+
+// ReadMarkerRepository keeps how far each user has read in each room
+type ReadMarkerRepository interface {
+	// SetReadMarker saves a marker unless the stored one is further
+	// along, and returns the stored one
+	SetReadMarker(ctx context.Context, m ReadMarker) (ReadMarker, error)
+	// ListReadMarkers returns a user's markers in a workspace updated
+	// after since
+	ListReadMarkers(ctx context.Context, userID, workspaceID int, since time.Time) ([]ReadMarker, error)
+}
+
+// PinRepository keeps the messages pinned in rooms
+type PinRepository interface {
+	// PinMessage pins a message to its room, or returns the pin it
+	// already has
+	PinMessage(ctx context.Context, pin Pin) (Pin, error)
+	// UnpinMessage removes a pin, or returns errNotFound
+	UnpinMessage(ctx context.Context, roomID, messageID int) error
+	// ListPins returns the pins of a room, or of every room of the
+	// workspace when roomID is 0, newest first
+	ListPins(ctx context.Context, workspaceID, roomID int) ([]Pin, error)
+}
+
+// BackupRepository exports and imports everything in the store
+type BackupRepository interface {
+	// Snapshot returns a consistent copy of all data
+	Snapshot(ctx context.Context) (*Snapshot, error)
+	// Restore loads a snapshot, keeping its IDs. It fails with
+	// errStoreNotEmpty unless the store holds nothing but the default
+	// workspace, which is replaced by the one in the snapshot.
+	Restore(ctx context.Context, snap *Snapshot) error
+}
+
+// Migrator is implemented by stores with a database schema
+type Migrator interface {
+	// MigrationStatus returns the schema version of the database and the
+	// latest one this build knows
+	MigrationStatus(ctx context.Context) (current, latest int, err error)
+	// Migrate applies the migrations the database hasn't seen yet
+	Migrate(ctx context.Context) error
+}
+
+// Snapshot is the full content of a store
+type Snapshot struct {
+	Users      []User
+	Identities []Identity
+	Workspaces []Workspace
+	Members    []WorkspaceMember
+	Rooms      []Room
+	Projects   []Project
+	Tasks      []Task
+	Messages   []Message
+	APITokens  []APIToken
+
+	RoomWebhooks       []RoomWebhook
+	Automations        []Automation
+	EventSubscriptions []EventSubscription
+	ScheduledMessages  []ScheduledMessage
+	StoredAttachments  []StoredAttachment
+	HeldMessages       []HeldMessage
+	Pins               []Pin
+	ReadMarkers        []ReadMarker
+	TaskEvents         []TaskEvent
+	TaskSnapshots      []TaskSnapshot
+}
+
+// Identity is an external login linked to a user
+type Identity struct {
+	Provider string
+	Subject  string
+	UserID   int
+}
+
+var (
+	// Active store, selected in the config at startup
+	store Store
+
+	errNotFound      = errors.New("not found")
+	errStoreNotEmpty = errors.New("store is not empty")
+)
+
+// newStore opens the store selected in the config
+func newStore(cfg Config) (Store, error) {
+	switch cfg.Store {
+	case "", "memory":
+		return newMemoryStore(), nil
+	case "sqlite", "postgres":
+		return openSQLStore(cfg.Store, cfg.DatabaseURL)
+	default:
+		return nil, errors.New("unknown store: " + cfg.Store)
+	}
+}
@@ -0,0 +1,1593 @@
+package chat
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Tasks are split by workspace into this many shards, each with its own
+// lock, so that busy workspaces don't hold up each other's tasks
+const taskShardCount = 16
+
+// taskShard holds the tasks of some workspaces
+type taskShard struct {
+	mu    sync.RWMutex
+	tasks map[int]Task
+	ids   []int // Sorted, which is also the order tasks were created in
+
+	// History of the shard's tasks, also of deleted ones, written with
+	// the tasks under the same lock
+	events    []TaskEvent
+	snapshots []TaskSnapshot
+}
+
+// memoryStore keeps everything in process memory. Data is lost on restart,
+// which makes it a good fit for development and tests.
+type memoryStore struct {
+	// Tasks have their own locks; taskShard picks the one for a workspace
+	taskShards      [taskShardCount]taskShard
+	nextTaskID      atomic.Int64
+	nextTaskEventID atomic.Int64
+
+	// Guards everything below. Reads only take the read lock, so they run
+	// in parallel and only wait for writes.
+	mu sync.RWMutex
+
+	users      []User
+	identities map[string]int // "provider:subject" -> user ID
+	projects   []Project
+	messages   []Message
+	rooms      []Room
+	workspaces []Workspace
+	members    []WorkspaceMember
+	apiTokens  []APIToken
+
+	roomWebhooks       []RoomWebhook
+	automations        []Automation
+	eventSubscriptions []EventSubscription
+	scheduledMessages  []ScheduledMessage
+	storedAttachments  []StoredAttachment
+	heldMessages       []HeldMessage
+	events             []LoggedEvent // Oldest first
+	serverState        map[string]string
+	auditEvents        []AuditEvent // Oldest first
+	activity           map[int]UserActivity
+	readMarkers        []ReadMarker
+	pins               []Pin // Oldest first
+
+	nextUserID              int
+	nextProjectID           int
+	nextMessageID           int
+	nextRoomID              int
+	nextWorkspaceID         int
+	nextAPITokenID          int
+	nextRoomWebhookID       int
+	nextAutomationID        int
+	nextEventSubscriptionID int
+	nextScheduledMessageID  int
+	nextHeldMessageID       int
+	nextEventID             int64
+	nextAuditEventID        int
+}
+
+func newMemoryStore() *memoryStore {
+	s := &memoryStore{
+		identities:              make(map[string]int),
+		serverState:             make(map[string]string),
+		activity:                make(map[int]UserActivity),
+		nextUserID:              1,
+		nextProjectID:           1,
+		nextMessageID:           1,
+		nextRoomID:              1,
+		nextWorkspaceID:         1,
+		nextAPITokenID:          1,
+		nextRoomWebhookID:       1,
+		nextAutomationID:        1,
+		nextEventSubscriptionID: 1,
+		nextScheduledMessageID:  1,
+		nextHeldMessageID:       1,
+		nextEventID:             1,
+		nextAuditEventID:        1,
+	}
+	for i := range s.taskShards {
+		s.taskShards[i].tasks = make(map[int]Task)
+	}
+	return s
+}
+
+// taskShard returns the shard holding a workspace's tasks
+func (s *memoryStore) taskShard(workspaceID int) *taskShard {
+	return &s.taskShards[uint(workspaceID)%taskShardCount]
+}
+
+// lockTasks takes the locks of every task shard, for the rare operations
+// that span workspaces
+func (s *memoryStore) lockTasks() {
+	for i := range s.taskShards {
+		s.taskShards[i].mu.Lock()
+	}
+}
+
+func (s *memoryStore) unlockTasks() {
+	for i := range s.taskShards {
+		s.taskShards[i].mu.Unlock()
+	}
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+///////////
+// Users //
+///////////
+
+func (s *memoryStore) CreateUser(ctx context.Context, user User) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, u := range s.users {
+		if strings.EqualFold(u.Username, user.Username) {
+			return User{}, errUsernameTaken
+		}
+		if user.Email != "" && strings.EqualFold(u.Email, user.Email) {
+			return User{}, errEmailTaken
+		}
+	}
+
+	user.ID = s.nextUserID
+	s.nextUserID++
+	s.users = append(s.users, user)
+	return user, nil
+}
+
+func (s *memoryStore) GetUser(ctx context.Context, id int) (User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, u := range s.users {
+		if u.ID == id {
+			return u, nil
+		}
+	}
+	return User{}, errNotFound
+}
+
+func (s *memoryStore) FindUserByUsername(ctx context.Context, username string) (User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, u := range s.users {
+		if strings.EqualFold(u.Username, username) {
+			return u, nil
+		}
+	}
+	return User{}, errNotFound
+}
+
+func (s *memoryStore) FindUserByEmail(ctx context.Context, email string) (User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, u := range s.users {
+		if u.Email != "" && strings.EqualFold(u.Email, email) {
+			return u, nil
+		}
+	}
+	return User{}, errNotFound
+}
+
+func (s *memoryStore) UpdateUser(ctx context.Context, id int, fn func(u *User) error) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.users {
+		if s.users[i].ID == id {
+			// Work on a copy so a failing fn leaves the user untouched
+			u := s.users[i]
+			u.RecoveryCodes = slices.Clone(u.RecoveryCodes)
+			if err := fn(&u); err != nil {
+				return User{}, err
+			}
+			s.users[i] = u
+			return u, nil
+		}
+	}
+	return User{}, errNotFound
+}
+
+func (s *memoryStore) ListUsers(ctx context.Context) ([]User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return slices.Clone(s.users), nil
+}
+
+func (s *memoryStore) LinkIdentity(ctx context.Context, provider, subject string, userID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.identities[provider+":"+subject] = userID
+	return nil
+}
+
+func (s *memoryStore) FindIdentity(ctx context.Context, provider, subject string) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	userID, ok := s.identities[provider+":"+subject]
+	if !ok {
+		return 0, errNotFound
+	}
+	return userID, nil
+}
+
+///////////
+// Tasks //
+///////////
+
+func (s *memoryStore) CreateTask(ctx context.Context, task Task, by string) (Task, error) {
+	shard := s.taskShard(task.WorkspaceID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	// Taken under the shard lock, so the shard's IDs stay sorted
+	task.ID = int(s.nextTaskID.Add(1))
+	shard.tasks[task.ID] = task
+	shard.ids = append(shard.ids, task.ID)
+	s.recordTaskWrite(shard, Task{}, task, 0, by)
+	return task, nil
+}
+
+func (s *memoryStore) ListTasks(ctx context.Context, workspaceID int) ([]Task, error) {
+	shard := s.taskShard(workspaceID)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	list := []Task{}
+	for _, id := range shard.ids {
+		if task := shard.tasks[id]; task.WorkspaceID == workspaceID && task.MergedInto == 0 {
+			list = append(list, task)
+		}
+	}
+	return list, nil
+}
+
+func (s *memoryStore) GetTask(ctx context.Context, workspaceID, id int) (Task, error) {
+	shard := s.taskShard(workspaceID)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	task, ok := shard.tasks[id]
+	if !ok || task.WorkspaceID != workspaceID {
+		return Task{}, errNotFound
+	}
+	return task, nil
+}
+
+func (s *memoryStore) UpdateTask(ctx context.Context, task Task, by string) (Task, error) {
+	shard := s.taskShard(task.WorkspaceID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	previous, ok := shard.tasks[task.ID]
+	if !ok || previous.WorkspaceID != task.WorkspaceID {
+		return Task{}, errNotFound
+	}
+	shard.tasks[task.ID] = task
+	s.recordTaskWrite(shard, previous, task, 0, by)
+	return task, nil
+}
+
+func (s *memoryStore) DeleteTask(ctx context.Context, workspaceID, id int, by string) error {
+	shard := s.taskShard(workspaceID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	previous, ok := shard.tasks[id]
+	if !ok || previous.WorkspaceID != workspaceID {
+		return errNotFound
+	}
+	delete(shard.tasks, id)
+	if i, ok := slices.BinarySearch(shard.ids, id); ok {
+		shard.ids = slices.Delete(shard.ids, i, i+1)
+	}
+	s.appendTaskEvent(shard, taskDeletedEvent(workspaceID, id, by), previous, Task{})
+	return nil
+}
+
+func (s *memoryStore) MergeTasks(ctx context.Context, task, other Task, by string) (Task, error) {
+	shard := s.taskShard(task.WorkspaceID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	var previous [2]Task
+	for i, t := range []Task{task, other} {
+		stored, ok := shard.tasks[t.ID]
+		if !ok || stored.WorkspaceID != task.WorkspaceID || t.WorkspaceID != task.WorkspaceID {
+			return Task{}, errNotFound
+		}
+		previous[i] = stored
+	}
+	shard.tasks[task.ID] = task
+	shard.tasks[other.ID] = other
+	s.recordTaskWrite(shard, previous[0], task, other.ID, by)
+	s.recordTaskWrite(shard, previous[1], other, 0, by)
+	return task, nil
+}
+
+func (s *memoryStore) ClaimTask(ctx context.Context, workspaceID, id int, username string, expires, now time.Time) (Task, error) {
+	shard := s.taskShard(workspaceID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	t, ok := shard.tasks[id]
+	if !ok || t.WorkspaceID != workspaceID || t.MergedInto != 0 {
+		return Task{}, errNotFound
+	}
+	if !claimable(t, username, now) {
+		return Task{}, errTaskClaimed
+	}
+	previous := t
+	t.Assignee = username
+	t.ClaimExpiresAt = &expires
+	shard.tasks[id] = t
+	s.recordTaskWrite(shard, previous, t, 0, username)
+	return t, nil
+}
+
+func (s *memoryStore) ReleaseExpiredClaims(ctx context.Context, now time.Time) ([]Task, error) {
+	var released []Task
+	for i := range s.taskShards {
+		shard := &s.taskShards[i]
+		shard.mu.Lock()
+		for _, id := range shard.ids {
+			t := shard.tasks[id]
+			if t.ClaimExpiresAt != nil && t.ClaimExpiresAt.Before(now) {
+				previous := t
+				t.Assignee = ""
+				t.ClaimExpiresAt = nil
+				shard.tasks[id] = t
+				s.recordTaskWrite(shard, previous, t, 0, systemUsername)
+				released = append(released, t)
+			}
+		}
+		shard.mu.Unlock()
+	}
+	slices.SortFunc(released, func(a, b Task) int { return a.ID - b.ID })
+	return released, nil
+}
+
+//////////////////
+// Task History //
+//////////////////
+
+// recordTaskWrite adds the event of a write to a task of the shard to its
+// history, if the write changed anything. The caller holds the shard's
+// lock.
+func (s *memoryStore) recordTaskWrite(shard *taskShard, previous, task Task, mergedFrom int, by string) {
+	if e, ok := taskChangeEvent(previous, task, mergedFrom, by); ok {
+		s.appendTaskEvent(shard, e, previous, task)
+	}
+}
+
+// appendTaskEvent stores an event as the next version of its task, with
+// the snapshots due. The caller holds the shard's lock.
+func (s *memoryStore) appendTaskEvent(shard *taskShard, e TaskEvent, previous, task Task) {
+	e.Version = 1
+	for _, other := range slices.Backward(shard.events) {
+		if other.TaskID == e.TaskID && other.WorkspaceID == e.WorkspaceID {
+			e.Version = other.Version + 1
+			break
+		}
+	}
+	e.ID = s.nextTaskEventID.Add(1)
+	shard.events = append(shard.events, e)
+	for _, snap := range taskEventSnapshots(e, previous, task) {
+		snap.Task.Tags = slices.Clone(snap.Task.Tags)
+		shard.snapshots = append(shard.snapshots, snap)
+	}
+}
+
+func (s *memoryStore) ListWorkspaceTaskEvents(ctx context.Context, workspaceID int, afterID int64, limit int) ([]TaskEvent, error) {
+	shard := s.taskShard(workspaceID)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	// The shard's events are in the order of their IDs, which are handed
+	// out under its lock
+	list := []TaskEvent{}
+	for _, e := range shard.events {
+		if len(list) == limit {
+			break
+		}
+		if e.WorkspaceID == workspaceID && e.ID > afterID {
+			list = append(list, e)
+		}
+	}
+	return list, nil
+}
+
+func (s *memoryStore) LastTaskEventID(ctx context.Context, workspaceID int) (int64, error) {
+	shard := s.taskShard(workspaceID)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	for _, e := range slices.Backward(shard.events) {
+		if e.WorkspaceID == workspaceID {
+			return e.ID, nil
+		}
+	}
+	return 0, nil
+}
+
+func (s *memoryStore) ListTaskEvents(ctx context.Context, workspaceID, taskID, afterVersion int) ([]TaskEvent, error) {
+	shard := s.taskShard(workspaceID)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	list := []TaskEvent{}
+	for _, e := range shard.events {
+		if e.TaskID == taskID && e.WorkspaceID == workspaceID && e.Version > afterVersion {
+			list = append(list, e)
+		}
+	}
+	return list, nil
+}
+
+func (s *memoryStore) GetTaskSnapshot(ctx context.Context, workspaceID, taskID, version int) (TaskSnapshot, error) {
+	shard := s.taskShard(workspaceID)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	found := false
+	var latest TaskSnapshot
+	for _, snap := range shard.snapshots {
+		if snap.TaskID == taskID && snap.WorkspaceID == workspaceID && snap.Version <= version && (!found || snap.Version > latest.Version) {
+			latest, found = snap, true
+		}
+	}
+	if !found {
+		return TaskSnapshot{}, errNotFound
+	}
+	latest.Task.Tags = slices.Clone(latest.Task.Tags)
+	return latest, nil
+}
+
+func (s *memoryStore) RenameTaskUser(ctx context.Context, workspaceID int, username, newName string) (int, error) {
+	n := 0
+	shard := s.taskShard(workspaceID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	for id, t := range shard.tasks {
+		if t.WorkspaceID == workspaceID && t.Assignee == username {
+			t.Assignee = newName
+			shard.tasks[id] = t
+			n++
+		}
+	}
+	for i, e := range shard.events {
+		if e.WorkspaceID != workspaceID {
+			continue
+		}
+		if e, ok := renameInTaskEvent(e, username, newName); ok {
+			shard.events[i] = e
+			n++
+		}
+	}
+	for i, snap := range shard.snapshots {
+		if snap.WorkspaceID == workspaceID && snap.Task.Assignee == username {
+			shard.snapshots[i].Task.Assignee = newName
+			n++
+		}
+	}
+	return n, nil
+}
+
+//////////////
+// Projects //
+//////////////
+
+func (s *memoryStore) CreateProject(ctx context.Context, project Project) (Project, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	project.ID = s.nextProjectID
+	s.nextProjectID++
+	s.projects = append(s.projects, project)
+	return project, nil
+}
+
+func (s *memoryStore) ListProjects(ctx context.Context, workspaceID int) ([]Project, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := []Project{}
+	for _, p := range s.projects {
+		if p.WorkspaceID == workspaceID {
+			list = append(list, p)
+		}
+	}
+	return list, nil
+}
+
+func (s *memoryStore) GetProject(ctx context.Context, workspaceID, id int) (Project, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, p := range s.projects {
+		if p.ID == id && p.WorkspaceID == workspaceID {
+			return p, nil
+		}
+	}
+	return Project{}, errNotFound
+}
+
+func (s *memoryStore) SetProjectWIPLimits(ctx context.Context, workspaceID, id int, limits map[string]int) (Project, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.projects {
+		if p := &s.projects[i]; p.ID == id && p.WorkspaceID == workspaceID {
+			p.WIPLimits = limits
+			return *p, nil
+		}
+	}
+	return Project{}, errNotFound
+}
+
+//////////////
+// Messages //
+//////////////
+
+func (s *memoryStore) SaveMessages(ctx context.Context, msgs []Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, msg := range msgs {
+		msg.ID = s.nextMessageID
+		s.nextMessageID++
+		s.messages = append(s.messages, msg)
+	}
+	return nil
+}
+
+func (s *memoryStore) ListMessages(ctx context.Context, roomID, beforeID, limit int) ([]Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// Walk backwards from the newest message, then restore the order
+	list := []Message{}
+	for i := len(s.messages) - 1; i >= 0 && len(list) < limit; i-- {
+		m := s.messages[i]
+		if m.RoomID == roomID && (beforeID == 0 || m.ID < beforeID) {
+			list = append(list, m)
+		}
+	}
+	slices.Reverse(list)
+	return list, nil
+}
+
+func (s *memoryStore) SearchMessages(ctx context.Context, workspaceID int, text string, limit int) ([]Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rooms := make(map[int]string)
+	for _, r := range s.rooms {
+		if r.WorkspaceID == workspaceID {
+			rooms[r.ID] = r.Name
+		}
+	}
+	text = strings.ToLower(text)
+	list := []Message{}
+	for i := len(s.messages) - 1; i >= 0 && len(list) < limit; i-- {
+		m := s.messages[i]
+		name, ok := rooms[m.RoomID]
+		if ok && strings.Contains(strings.ToLower(m.Content), text) {
+			m.Room = name
+			list = append(list, m)
+		}
+	}
+	return list, nil
+}
+
+func (s *memoryStore) RenameUserMessages(ctx context.Context, workspaceID, userID int, username string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rooms := make(map[int]bool)
+	for _, r := range s.rooms {
+		if r.WorkspaceID == workspaceID {
+			rooms[r.ID] = true
+		}
+	}
+	n := 0
+	for i, m := range s.messages {
+		if m.UserID == userID && rooms[m.RoomID] {
+			s.messages[i].Username = username
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *memoryStore) DeleteMessages(ctx context.Context, roomID int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	before := len(s.messages)
+	s.messages = slices.DeleteFunc(s.messages, func(m Message) bool { return m.RoomID == roomID })
+	s.pins = slices.DeleteFunc(s.pins, func(p Pin) bool { return p.RoomID == roomID })
+	return before - len(s.messages), nil
+}
+
+func (s *memoryStore) ListMessagesBefore(ctx context.Context, t time.Time, limit int) ([]Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := []Message{}
+	for _, m := range s.messages {
+		if len(list) == limit {
+			break
+		}
+		if m.CreatedAt.Before(t) {
+			list = append(list, m)
+		}
+	}
+	return list, nil
+}
+
+func (s *memoryStore) DeleteMessageIDs(ctx context.Context, ids []int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.messages = slices.DeleteFunc(s.messages, func(m Message) bool { return slices.Contains(ids, m.ID) })
+	return nil
+}
+
+func (s *memoryStore) CountUserMessages(ctx context.Context, userID int) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	n := 0
+	for _, m := range s.messages {
+		if m.UserID == userID {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *memoryStore) ListUserMessages(ctx context.Context, workspaceID, userID int, from, until time.Time, afterID, limit int) ([]Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rooms := make(map[int]string)
+	for _, r := range s.rooms {
+		if r.WorkspaceID == workspaceID {
+			rooms[r.ID] = r.Name
+		}
+	}
+	list := []Message{}
+	for _, m := range s.messages {
+		if len(list) == limit {
+			break
+		}
+		name, ok := rooms[m.RoomID]
+		if ok && m.UserID == userID && m.ID > afterID && !m.CreatedAt.Before(from) && m.CreatedAt.Before(until) {
+			m.Room = name
+			list = append(list, m)
+		}
+	}
+	return list, nil
+}
+
+///////////
+// Rooms //
+///////////
+
+func (s *memoryStore) CreateRoom(ctx context.Context, room Room) (Room, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, r := range s.rooms {
+		if r.WorkspaceID == room.WorkspaceID && strings.EqualFold(r.Name, room.Name) {
+			return Room{}, errRoomExists
+		}
+	}
+
+	room.ID = s.nextRoomID
+	s.nextRoomID++
+	s.rooms = append(s.rooms, room)
+	return room, nil
+}
+
+func (s *memoryStore) ListRooms(ctx context.Context, workspaceID int) ([]Room, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := []Room{}
+	for _, r := range s.rooms {
+		if r.WorkspaceID == workspaceID {
+			list = append(list, r)
+		}
+	}
+	return list, nil
+}
+
+func (s *memoryStore) FindRoom(ctx context.Context, workspaceID int, name string) (Room, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, r := range s.rooms {
+		if r.WorkspaceID == workspaceID && strings.EqualFold(r.Name, name) {
+			return r, nil
+		}
+	}
+	return Room{}, errNotFound
+}
+
+func (s *memoryStore) SetRoomSlowMode(ctx context.Context, id, seconds int) (Room, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.rooms {
+		if s.rooms[i].ID == id {
+			s.rooms[i].SlowMode = seconds
+			return s.rooms[i], nil
+		}
+	}
+	return Room{}, errNotFound
+}
+
+func (s *memoryStore) SetRoomPolicy(ctx context.Context, id int, policy RoomPolicy) (Room, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.rooms {
+		if s.rooms[i].ID == id {
+			s.rooms[i].Policy = policy
+			return s.rooms[i], nil
+		}
+	}
+	return Room{}, errNotFound
+}
+
+func (s *memoryStore) SetRoomBranding(ctx context.Context, id int, branding RoomBranding) (Room, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.rooms {
+		if s.rooms[i].ID == id {
+			s.rooms[i].Branding = branding
+			return s.rooms[i], nil
+		}
+	}
+	return Room{}, errNotFound
+}
+
+////////////////
+// Workspaces //
+////////////////
+
+func (s *memoryStore) CreateWorkspace(ctx context.Context, ws Workspace) (Workspace, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, existing := range s.workspaces {
+		if existing.Slug == ws.Slug {
+			return Workspace{}, errSlugTaken
+		}
+	}
+
+	ws.ID = s.nextWorkspaceID
+	s.nextWorkspaceID++
+	s.workspaces = append(s.workspaces, ws)
+	return ws, nil
+}
+
+func (s *memoryStore) ListWorkspaces(ctx context.Context) ([]Workspace, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return slices.Clone(s.workspaces), nil
+}
+
+func (s *memoryStore) FindWorkspace(ctx context.Context, slug string) (Workspace, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, ws := range s.workspaces {
+		if ws.Slug == slug {
+			return ws, nil
+		}
+	}
+	return Workspace{}, errNotFound
+}
+
+func (s *memoryStore) UpdateWorkspaceSettings(ctx context.Context, id int, settings WorkspaceSettings) (Workspace, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.workspaces {
+		if s.workspaces[i].ID == id {
+			s.workspaces[i].Settings = settings
+			return s.workspaces[i], nil
+		}
+	}
+	return Workspace{}, errNotFound
+}
+
+func (s *memoryStore) AddMember(ctx context.Context, m WorkspaceMember) (WorkspaceMember, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, existing := range s.members {
+		if existing.WorkspaceID == m.WorkspaceID && existing.UserID == m.UserID {
+			s.members[i].Role = m.Role
+			return s.members[i], nil
+		}
+	}
+
+	if m.JoinedAt.IsZero() {
+		m.JoinedAt = time.Now().UTC()
+	}
+	s.members = append(s.members, m)
+	return m, nil
+}
+
+func (s *memoryStore) GetMember(ctx context.Context, workspaceID, userID int) (WorkspaceMember, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, m := range s.members {
+		if m.WorkspaceID == workspaceID && m.UserID == userID {
+			return m, nil
+		}
+	}
+	return WorkspaceMember{}, errNotFound
+}
+
+func (s *memoryStore) ListMembers(ctx context.Context, workspaceID int) ([]WorkspaceMember, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := []WorkspaceMember{}
+	for _, m := range s.members {
+		if m.WorkspaceID == workspaceID {
+			list = append(list, m)
+		}
+	}
+	return list, nil
+}
+
+func (s *memoryStore) RemoveMember(ctx context.Context, workspaceID, userID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, m := range s.members {
+		if m.WorkspaceID == workspaceID && m.UserID == userID {
+			s.members = append(s.members[:i], s.members[i+1:]...)
+			return nil
+		}
+	}
+	return errNotFound
+}
+
+////////////////
+// API Tokens //
+////////////////
+
+func (s *memoryStore) CreateAPIToken(ctx context.Context, token APIToken) (APIToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token.ID = s.nextAPITokenID
+	s.nextAPITokenID++
+	s.apiTokens = append(s.apiTokens, token)
+	return token, nil
+}
+
+func (s *memoryStore) GetAPIToken(ctx context.Context, id int) (APIToken, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, t := range s.apiTokens {
+		if t.ID == id {
+			return t, nil
+		}
+	}
+	return APIToken{}, errNotFound
+}
+
+func (s *memoryStore) FindAPIToken(ctx context.Context, hash string) (APIToken, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, t := range s.apiTokens {
+		if t.Hash == hash {
+			return t, nil
+		}
+	}
+	return APIToken{}, errNotFound
+}
+
+func (s *memoryStore) ListAPITokens(ctx context.Context, userID int) ([]APIToken, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := []APIToken{}
+	for _, t := range s.apiTokens {
+		if t.UserID == userID {
+			list = append(list, t)
+		}
+	}
+	return list, nil
+}
+
+func (s *memoryStore) UpdateAPIToken(ctx context.Context, id int, fn func(t *APIToken) error) (APIToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.apiTokens {
+		if s.apiTokens[i].ID == id {
+			t := s.apiTokens[i]
+			t.Scopes = slices.Clone(t.Scopes)
+			if err := fn(&t); err != nil {
+				return APIToken{}, err
+			}
+			s.apiTokens[i] = t
+			return t, nil
+		}
+	}
+	return APIToken{}, errNotFound
+}
+
+func (s *memoryStore) DeleteAPIToken(ctx context.Context, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, t := range s.apiTokens {
+		if t.ID == id {
+			s.apiTokens = slices.Delete(s.apiTokens, i, i+1)
+			return nil
+		}
+	}
+	return errNotFound
+}
+
+///////////////////
+// Room Webhooks //
+///////////////////
+
+func (s *memoryStore) CreateRoomWebhook(ctx context.Context, hook RoomWebhook) (RoomWebhook, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hook.ID = s.nextRoomWebhookID
+	s.nextRoomWebhookID++
+	s.roomWebhooks = append(s.roomWebhooks, hook)
+	return hook, nil
+}
+
+func (s *memoryStore) ListRoomWebhooks(ctx context.Context) ([]RoomWebhook, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return slices.Clone(s.roomWebhooks), nil
+}
+
+func (s *memoryStore) DeleteRoomWebhook(ctx context.Context, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, hook := range s.roomWebhooks {
+		if hook.ID == id {
+			s.roomWebhooks = slices.Delete(s.roomWebhooks, i, i+1)
+			return nil
+		}
+	}
+	return errNotFound
+}
+
+/////////////////
+// Automations //
+/////////////////
+
+func (s *memoryStore) CreateAutomation(ctx context.Context, a Automation) (Automation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a.ID = s.nextAutomationID
+	s.nextAutomationID++
+	a.Actions = slices.Clone(a.Actions)
+	s.automations = append(s.automations, a)
+	return a, nil
+}
+
+func (s *memoryStore) ListAutomations(ctx context.Context) ([]Automation, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := slices.Clone(s.automations)
+	for i := range list {
+		list[i].Actions = slices.Clone(list[i].Actions)
+	}
+	return list, nil
+}
+
+func (s *memoryStore) UpdateAutomation(ctx context.Context, a Automation) (Automation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.automations {
+		if s.automations[i].ID == a.ID {
+			stored := &s.automations[i]
+			stored.Name, stored.Enabled, stored.Trigger = a.Name, a.Enabled, a.Trigger
+			stored.Actions = slices.Clone(a.Actions)
+			return *stored, nil
+		}
+	}
+	return Automation{}, errNotFound
+}
+
+func (s *memoryStore) DeleteAutomation(ctx context.Context, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, a := range s.automations {
+		if a.ID == id {
+			s.automations = slices.Delete(s.automations, i, i+1)
+			return nil
+		}
+	}
+	return errNotFound
+}
+
+////////////////////////
+// Scheduled Messages //
+////////////////////////
+
+func (s *memoryStore) CreateScheduledMessage(ctx context.Context, sm ScheduledMessage) (ScheduledMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sm.ID = s.nextScheduledMessageID
+	s.nextScheduledMessageID++
+	sm.schedule = nil
+	s.scheduledMessages = append(s.scheduledMessages, sm)
+	return sm, nil
+}
+
+func (s *memoryStore) ListScheduledMessages(ctx context.Context) ([]ScheduledMessage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return slices.Clone(s.scheduledMessages), nil
+}
+
+func (s *memoryStore) SetScheduledMessageRun(ctx context.Context, id int, next time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.scheduledMessages {
+		if s.scheduledMessages[i].ID == id {
+			s.scheduledMessages[i].NextRun = next
+			return nil
+		}
+	}
+	return errNotFound
+}
+
+func (s *memoryStore) DeleteScheduledMessage(ctx context.Context, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, sm := range s.scheduledMessages {
+		if sm.ID == id {
+			s.scheduledMessages = slices.Delete(s.scheduledMessages, i, i+1)
+			return nil
+		}
+	}
+	return errNotFound
+}
+
+/////////////////////////
+// Event Subscriptions //
+/////////////////////////
+
+func (s *memoryStore) CreateEventSubscription(ctx context.Context, sub EventSubscription) (EventSubscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sub.ID = s.nextEventSubscriptionID
+	s.nextEventSubscriptionID++
+	s.eventSubscriptions = append(s.eventSubscriptions, sub)
+	return sub, nil
+}
+
+func (s *memoryStore) ListEventSubscriptions(ctx context.Context) ([]EventSubscription, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return slices.Clone(s.eventSubscriptions), nil
+}
+
+func (s *memoryStore) DeleteEventSubscription(ctx context.Context, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, sub := range s.eventSubscriptions {
+		if sub.ID == id {
+			s.eventSubscriptions = slices.Delete(s.eventSubscriptions, i, i+1)
+			return nil
+		}
+	}
+	return errNotFound
+}
+
+/////////////////
+// Attachments //
+/////////////////
+
+func (s *memoryStore) CreateStoredAttachment(ctx context.Context, a StoredAttachment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.storedAttachments = append(s.storedAttachments, a)
+	return nil
+}
+
+func (s *memoryStore) StorageUsage(ctx context.Context) (map[int]int64, map[int]int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	byUser, byWorkspace := make(map[int]int64), make(map[int]int64)
+	for _, a := range s.storedAttachments {
+		byUser[a.UserID] += a.Size
+		byWorkspace[a.WorkspaceID] += a.Size
+	}
+	return byUser, byWorkspace, nil
+}
+
+///////////////////
+// Held Messages //
+///////////////////
+
+func (s *memoryStore) CreateHeldMessage(ctx context.Context, m HeldMessage) (HeldMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m.ID = s.nextHeldMessageID
+	s.nextHeldMessageID++
+	m.Message.Attachments = slices.Clone(m.Message.Attachments)
+	s.heldMessages = append(s.heldMessages, m)
+	return m, nil
+}
+
+func (s *memoryStore) ListHeldMessages(ctx context.Context, workspaceID int) ([]HeldMessage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := []HeldMessage{}
+	for _, m := range s.heldMessages {
+		if m.WorkspaceID == workspaceID {
+			list = append(list, m)
+		}
+	}
+	return list, nil
+}
+
+func (s *memoryStore) TakeHeldMessage(ctx context.Context, workspaceID, id int) (HeldMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, m := range s.heldMessages {
+		if m.ID == id && m.WorkspaceID == workspaceID {
+			s.heldMessages = slices.Delete(s.heldMessages, i, i+1)
+			return m, nil
+		}
+	}
+	return HeldMessage{}, errNotFound
+}
+
+///////////////
+// Event Log //
+///////////////
+
+func (s *memoryStore) AppendEvents(ctx context.Context, events []LoggedEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, e := range events {
+		e.ID = s.nextEventID
+		s.nextEventID++
+		s.events = append(s.events, e)
+	}
+	return nil
+}
+
+func (s *memoryStore) ListEvents(ctx context.Context, workspaceID int, afterID int64, types []string, limit int) ([]LoggedEvent, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := []LoggedEvent{}
+	i, _ := slices.BinarySearchFunc(s.events, afterID+1, func(e LoggedEvent, id int64) int { return cmp.Compare(e.ID, id) })
+	for _, e := range s.events[i:] {
+		if len(list) == limit {
+			break
+		}
+		if e.WorkspaceID == workspaceID && (len(types) == 0 || slices.Contains(types, e.Type)) {
+			list = append(list, e)
+		}
+	}
+	return list, nil
+}
+
+func (s *memoryStore) OldestEventID(ctx context.Context) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(s.events) == 0 {
+		return 0, nil
+	}
+	return s.events[0].ID, nil
+}
+
+func (s *memoryStore) DeleteEventsBefore(ctx context.Context, t time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := len(s.events)
+	s.events = slices.DeleteFunc(s.events, func(e LoggedEvent) bool { return e.Time.Before(t) })
+	return n - len(s.events), nil
+}
+
+func (s *memoryStore) UpdateEventData(ctx context.Context, id int64, data json.RawMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i, ok := slices.BinarySearchFunc(s.events, id, func(e LoggedEvent, id int64) int { return cmp.Compare(e.ID, id) })
+	if !ok {
+		return errNotFound
+	}
+	s.events[i].Data = data
+	return nil
+}
+
+//////////////////
+// Server state //
+//////////////////
+
+func (s *memoryStore) GetServerState(ctx context.Context, key string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	value, ok := s.serverState[key]
+	if !ok {
+		return "", errNotFound
+	}
+	return value, nil
+}
+
+func (s *memoryStore) SetServerState(ctx context.Context, key, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.serverState[key] = value
+	return nil
+}
+
+///////////////
+// Audit Log //
+///////////////
+
+func (s *memoryStore) AppendAuditEvent(ctx context.Context, e AuditEvent) (AuditEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e.ID = s.nextAuditEventID
+	s.nextAuditEventID++
+	s.auditEvents = append(s.auditEvents, e)
+	return e, nil
+}
+
+func (s *memoryStore) ListAuditEvents(ctx context.Context, f AuditFilter) ([]AuditEvent, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := []AuditEvent{}
+	for _, e := range s.auditEvents {
+		if e.ID <= f.AfterID {
+			continue
+		}
+		if f.Impersonated != "" && e.OnBehalfOf != f.Impersonated &&
+			(e.Action != "impersonation.start" || e.Target != f.Impersonated) {
+			continue
+		}
+		list = append(list, e)
+	}
+	if f.Limit > 0 && len(list) > f.Limit {
+		if f.Latest {
+			list = list[len(list)-f.Limit:]
+		} else {
+			list = list[:f.Limit]
+		}
+	}
+	return slices.Clone(list), nil
+}
+
+func (s *memoryStore) DeleteAuditEventsBefore(ctx context.Context, t time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := len(s.auditEvents)
+	s.auditEvents = slices.DeleteFunc(s.auditEvents, func(e AuditEvent) bool { return e.Time.Before(t) })
+	return n - len(s.auditEvents), nil
+}
+
+//////////////
+// Activity //
+//////////////
+
+func (s *memoryStore) UpdateActivity(ctx context.Context, userID int, fn func(a *UserActivity)) (UserActivity, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a, ok := s.activity[userID]
+	if !ok {
+		a = UserActivity{UserID: userID}
+	}
+	a.RoomMessages = maps.Clone(a.RoomMessages)
+	if a.RoomMessages == nil {
+		a.RoomMessages = make(map[int]int)
+	}
+	a.Achievements = slices.Clone(a.Achievements)
+	fn(&a)
+	s.activity[userID] = a
+	return a, nil
+}
+
+func (s *memoryStore) ListRoomActivity(ctx context.Context, roomID int) ([]UserActivity, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := []UserActivity{}
+	for _, a := range s.activity {
+		if a.RoomMessages[roomID] == 0 {
+			continue
+		}
+		a.RoomMessages = map[int]int{roomID: a.RoomMessages[roomID]}
+		a.Achievements = slices.Clone(a.Achievements)
+		list = append(list, a)
+	}
+	return list, nil
+}
+
+//////////////////
+// Read Markers //
+//////////////////
+
+func (s *memoryStore) SetReadMarker(ctx context.Context, m ReadMarker) (ReadMarker, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, stored := range s.readMarkers {
+		if stored.UserID == m.UserID && stored.RoomID == m.RoomID {
+			if stored.MessageID >= m.MessageID {
+				return stored, nil
+			}
+			s.readMarkers[i] = m
+			return m, nil
+		}
+	}
+	s.readMarkers = append(s.readMarkers, m)
+	return m, nil
+}
+
+func (s *memoryStore) ListReadMarkers(ctx context.Context, userID, workspaceID int, since time.Time) ([]ReadMarker, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := []ReadMarker{}
+	for _, m := range s.readMarkers {
+		if m.UserID == userID && m.WorkspaceID == workspaceID && m.UpdatedAt.After(since) {
+			list = append(list, m)
+		}
+	}
+	return list, nil
+}
+
+//////////
+// Pins //
+//////////
+
+func (s *memoryStore) PinMessage(ctx context.Context, pin Pin) (Pin, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, p := range s.pins {
+		if p.RoomID == pin.RoomID && p.Message.ID == pin.Message.ID {
+			return p, nil
+		}
+	}
+	s.pins = append(s.pins, pin)
+	return pin, nil
+}
+
+func (s *memoryStore) UnpinMessage(ctx context.Context, roomID, messageID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := slices.IndexFunc(s.pins, func(p Pin) bool { return p.RoomID == roomID && p.Message.ID == messageID })
+	if i < 0 {
+		return errNotFound
+	}
+	s.pins = slices.Delete(s.pins, i, i+1)
+	return nil
+}
+
+func (s *memoryStore) ListPins(ctx context.Context, workspaceID, roomID int) ([]Pin, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := []Pin{}
+	for i := len(s.pins) - 1; i >= 0; i-- {
+		p := s.pins[i]
+		if p.WorkspaceID == workspaceID && (roomID == 0 || p.RoomID == roomID) {
+			list = append(list, p)
+		}
+	}
+	return list, nil
+}
+
+////////////
+// Backup //
+////////////
+
+func (s *memoryStore) Snapshot(ctx context.Context) (*Snapshot, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	s.lockTasks()
+	defer s.unlockTasks()
+
+	snap := &Snapshot{
+		Users:      slices.Clone(s.users),
+		Workspaces: slices.Clone(s.workspaces),
+		Members:    slices.Clone(s.members),
+		Rooms:      slices.Clone(s.rooms),
+		Projects:   slices.Clone(s.projects),
+		Messages:   slices.Clone(s.messages),
+		APITokens:  slices.Clone(s.apiTokens),
+
+		RoomWebhooks:       slices.Clone(s.roomWebhooks),
+		Automations:        slices.Clone(s.automations),
+		EventSubscriptions: slices.Clone(s.eventSubscriptions),
+		ScheduledMessages:  slices.Clone(s.scheduledMessages),
+		StoredAttachments:  slices.Clone(s.storedAttachments),
+		HeldMessages:       slices.Clone(s.heldMessages),
+		Pins:               slices.Clone(s.pins),
+		ReadMarkers:        slices.Clone(s.readMarkers),
+	}
+	for i := range s.taskShards {
+		shard := &s.taskShards[i]
+		for _, id := range shard.ids {
+			snap.Tasks = append(snap.Tasks, shard.tasks[id])
+		}
+		snap.TaskEvents = append(snap.TaskEvents, shard.events...)
+		snap.TaskSnapshots = append(snap.TaskSnapshots, shard.snapshots...)
+	}
+	slices.SortFunc(snap.Tasks, func(a, b Task) int { return a.ID - b.ID })
+	slices.SortFunc(snap.TaskEvents, func(a, b TaskEvent) int { return cmp.Compare(a.ID, b.ID) })
+	for key, userID := range s.identities {
+		provider, subject, _ := strings.Cut(key, ":")
+		snap.Identities = append(snap.Identities, Identity{Provider: provider, Subject: subject, UserID: userID})
+	}
+	return snap, nil
+}
+
+func (s *memoryStore) Restore(ctx context.Context, snap *Snapshot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lockTasks()
+	defer s.unlockTasks()
+
+	empty := len(s.users) == 0 && len(s.projects) == 0 && len(s.messages) == 0 &&
+		len(s.rooms) == 0 && len(s.members) == 0 && len(s.identities) == 0
+	for i := range s.taskShards {
+		empty = empty && len(s.taskShards[i].tasks) == 0 && len(s.taskShards[i].events) == 0
+	}
+	for _, ws := range s.workspaces {
+		empty = empty && ws.Slug == defaultWorkspaceSlug
+	}
+	if !empty {
+		return errStoreNotEmpty
+	}
+
+	s.users = slices.Clone(snap.Users)
+	s.workspaces = slices.Clone(snap.Workspaces)
+	s.members = slices.Clone(snap.Members)
+	s.rooms = slices.Clone(snap.Rooms)
+	s.projects = slices.Clone(snap.Projects)
+	for _, t := range snap.Tasks {
+		shard := s.taskShard(t.WorkspaceID)
+		shard.tasks[t.ID] = t
+		shard.ids = append(shard.ids, t.ID)
+	}
+	for i := range s.taskShards {
+		slices.Sort(s.taskShards[i].ids)
+	}
+	for _, e := range snap.TaskEvents {
+		shard := s.taskShard(e.WorkspaceID)
+		shard.events = append(shard.events, e)
+	}
+	for _, ts := range snap.TaskSnapshots {
+		shard := s.taskShard(ts.WorkspaceID)
+		shard.snapshots = append(shard.snapshots, ts)
+	}
+	s.messages = slices.Clone(snap.Messages)
+	s.apiTokens = slices.Clone(snap.APITokens)
+	s.roomWebhooks = slices.Clone(snap.RoomWebhooks)
+	s.automations = slices.Clone(snap.Automations)
+	s.eventSubscriptions = slices.Clone(snap.EventSubscriptions)
+	s.scheduledMessages = slices.Clone(snap.ScheduledMessages)
+	s.storedAttachments = slices.Clone(snap.StoredAttachments)
+	s.heldMessages = slices.Clone(snap.HeldMessages)
+	s.pins = slices.Clone(snap.Pins)
+	s.readMarkers = slices.Clone(snap.ReadMarkers)
+	for _, id := range snap.Identities {
+		s.identities[id.Provider+":"+id.Subject] = id.UserID
+	}
+
+	// Continue numbering after the highest restored IDs
+	s.nextUserID, s.nextWorkspaceID, s.nextRoomID, s.nextProjectID, s.nextMessageID = 1, 1, 1, 1, 1
+	s.nextAPITokenID, s.nextRoomWebhookID, s.nextAutomationID, s.nextEventSubscriptionID = 1, 1, 1, 1
+	s.nextScheduledMessageID, s.nextHeldMessageID = 1, 1
+	for _, u := range s.users {
+		s.nextUserID = max(s.nextUserID, u.ID+1)
+	}
+	for _, ws := range s.workspaces {
+		s.nextWorkspaceID = max(s.nextWorkspaceID, ws.ID+1)
+	}
+	for _, r := range s.rooms {
+		s.nextRoomID = max(s.nextRoomID, r.ID+1)
+	}
+	// nextTaskID holds the last ID handed out
+	for _, t := range snap.Tasks {
+		s.nextTaskID.Store(max(s.nextTaskID.Load(), int64(t.ID)))
+	}
+	for _, e := range snap.TaskEvents {
+		s.nextTaskEventID.Store(max(s.nextTaskEventID.Load(), e.ID))
+	}
+	for _, p := range s.projects {
+		s.nextProjectID = max(s.nextProjectID, p.ID+1)
+	}
+	for _, m := range s.messages {
+		s.nextMessageID = max(s.nextMessageID, m.ID+1)
+	}
+	for _, t := range s.apiTokens {
+		s.nextAPITokenID = max(s.nextAPITokenID, t.ID+1)
+	}
+	for _, hook := range s.roomWebhooks {
+		s.nextRoomWebhookID = max(s.nextRoomWebhookID, hook.ID+1)
+	}
+	for _, a := range s.automations {
+		s.nextAutomationID = max(s.nextAutomationID, a.ID+1)
+	}
+	for _, sub := range s.eventSubscriptions {
+		s.nextEventSubscriptionID = max(s.nextEventSubscriptionID, sub.ID+1)
+	}
+	for _, sm := range s.scheduledMessages {
+		s.nextScheduledMessageID = max(s.nextScheduledMessageID, sm.ID+1)
+	}
+	for _, m := range s.heldMessages {
+		s.nextHeldMessageID = max(s.nextHeldMessageID, m.ID+1)
+	}
+	return nil
+}
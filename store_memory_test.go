@@ -0,0 +1,137 @@
+package chat
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// taskReader is the part of the store the benchmarks exercise
+type taskReader interface {
+	GetTask(ctx context.Context, workspaceID, id int) (Task, error)
+	ListTasks(ctx context.Context, workspaceID int) ([]Task, error)
+	UpdateTask(ctx context.Context, task Task, by string) (Task, error)
+}
+
+// mutexStore serializes every call with one sync.Mutex, the way the
+// memory store used to
+type mutexStore struct {
+	mu sync.Mutex
+	s  *memoryStore
+}
+
+func (m *mutexStore) GetTask(ctx context.Context, workspaceID, id int) (Task, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.s.GetTask(ctx, workspaceID, id)
+}
+
+func (m *mutexStore) ListTasks(ctx context.Context, workspaceID int) ([]Task, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.s.ListTasks(ctx, workspaceID)
+}
+
+func (m *mutexStore) UpdateTask(ctx context.Context, task Task, by string) (Task, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.s.UpdateTask(ctx, task, by)
+}
+
+// rwMutexStore puts every task behind one sync.RWMutex, as before tasks
+// were sharded
+type rwMutexStore struct {
+	mu sync.RWMutex
+	s  *memoryStore
+}
+
+func (m *rwMutexStore) GetTask(ctx context.Context, workspaceID, id int) (Task, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.s.GetTask(ctx, workspaceID, id)
+}
+
+func (m *rwMutexStore) ListTasks(ctx context.Context, workspaceID int) ([]Task, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.s.ListTasks(ctx, workspaceID)
+}
+
+func (m *rwMutexStore) UpdateTask(ctx context.Context, task Task, by string) (Task, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.s.UpdateTask(ctx, task, by)
+}
+
+// Tasks created for the benchmarks
+const (
+	benchWorkspaces = 8
+	benchTasks      = 100 // Per workspace
+)
+
+// benchmarkTaskStores runs read against the old single mutex, a single
+// RWMutex and the sharded store, with one write in every ten operations.
+// Each parallel goroutine works in its own workspace.
+func benchmarkTaskStores(b *testing.B, read func(s taskReader, workspaceID, id int) error) {
+	stores := []struct {
+		name string
+		wrap func(*memoryStore) taskReader
+	}{
+		{"Mutex", func(s *memoryStore) taskReader { return &mutexStore{s: s} }},
+		{"RWMutex", func(s *memoryStore) taskReader { return &rwMutexStore{s: s} }},
+		{"Sharded", func(s *memoryStore) taskReader { return s }},
+	}
+	for _, st := range stores {
+		b.Run(st.name, func(b *testing.B) {
+			ctx := context.Background()
+			mem := newMemoryStore()
+			var tasks [benchWorkspaces + 1][]Task
+			for ws := 1; ws <= benchWorkspaces; ws++ {
+				for i := range benchTasks {
+					task, err := mem.CreateTask(ctx, Task{WorkspaceID: ws, Title: fmt.Sprint("Task ", i), Status: "pending"}, "")
+					if err != nil {
+						b.Fatal(err)
+					}
+					tasks[ws] = append(tasks[ws], task)
+				}
+			}
+			s := st.wrap(mem)
+
+			var goroutines atomic.Int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				ws := int(goroutines.Add(1)%benchWorkspaces) + 1
+				for i := 0; pb.Next(); i++ {
+					task := tasks[ws][i%benchTasks]
+					if i%10 == 0 {
+						if _, err := s.UpdateTask(ctx, task, ""); err != nil {
+							b.Error(err)
+							return
+						}
+						continue
+					}
+					if err := read(s, ws, task.ID); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkMemoryStoreGetParallel(b *testing.B) {
+	benchmarkTaskStores(b, func(s taskReader, workspaceID, id int) error {
+		_, err := s.GetTask(context.Background(), workspaceID, id)
+		return err
+	})
+}
+
+func BenchmarkMemoryStoreListParallel(b *testing.B) {
+	benchmarkTaskStores(b, func(s taskReader, workspaceID, id int) error {
+		_, err := s.ListTasks(context.Background(), workspaceID)
+		return err
+	})
+}
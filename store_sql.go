@@ -0,0 +1,2593 @@
+package chat
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqlStore implements Store on database/sql. SQLite and Postgres share the
+// queries, which stick to the common subset of both and use $N
+// placeholders; only the DDL differs between the dialects.
+type sqlStore struct {
+	db      *sql.DB
+	dialect string // "sqlite" or "postgres"
+}
+
+// Column types that differ between the dialects, substituted into the
+// migrations below
+var sqlTypes = map[string]*strings.Replacer{
+	"sqlite": strings.NewReplacer(
+		"{{id}}", "INTEGER PRIMARY KEY AUTOINCREMENT",
+		"{{time}}", "TIMESTAMP",
+		"{{bytes}}", "BLOB",
+	),
+	"postgres": strings.NewReplacer(
+		"{{id}}", "BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY",
+		"{{time}}", "TIMESTAMPTZ",
+		"{{bytes}}", "BYTEA",
+	),
+}
+
+// Escapes the wildcards of LIKE patterns, with \ as the escape character
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// Schema migrations, applied in order. Never edit a migration once it has
+// shipped; add a new one instead.
+var sqlMigrations = [][]string{
+	// 1: initial schema
+	{
+		`CREATE TABLE users (
+			id {{id}},
+			username TEXT NOT NULL,
+			email TEXT NOT NULL DEFAULT '',
+			email_verified BOOLEAN NOT NULL DEFAULT FALSE,
+			role TEXT NOT NULL,
+			password_hash {{bytes}},
+			created_at {{time}} NOT NULL,
+			totp_enabled BOOLEAN NOT NULL DEFAULT FALSE,
+			totp_secret TEXT NOT NULL DEFAULT '',
+			totp_last_counter BIGINT NOT NULL DEFAULT 0,
+			recovery_codes TEXT NOT NULL DEFAULT ''
+		)`,
+		`CREATE UNIQUE INDEX users_username ON users (lower(username))`,
+		`CREATE UNIQUE INDEX users_email ON users (lower(email)) WHERE email <> ''`,
+		`CREATE TABLE identities (
+			provider TEXT NOT NULL,
+			subject TEXT NOT NULL,
+			user_id BIGINT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			PRIMARY KEY (provider, subject)
+		)`,
+		`CREATE TABLE workspaces (
+			id {{id}},
+			slug TEXT NOT NULL UNIQUE,
+			name TEXT NOT NULL,
+			created_at {{time}} NOT NULL,
+			open_membership BOOLEAN NOT NULL DEFAULT FALSE,
+			anonymous_chat BOOLEAN NOT NULL DEFAULT FALSE
+		)`,
+		`CREATE TABLE workspace_members (
+			workspace_id BIGINT NOT NULL REFERENCES workspaces (id) ON DELETE CASCADE,
+			user_id BIGINT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			role TEXT NOT NULL,
+			joined_at {{time}} NOT NULL,
+			PRIMARY KEY (workspace_id, user_id)
+		)`,
+		`CREATE TABLE tasks (
+			id {{id}},
+			workspace_id BIGINT NOT NULL REFERENCES workspaces (id) ON DELETE CASCADE,
+			title TEXT NOT NULL,
+			description TEXT NOT NULL,
+			status TEXT NOT NULL
+		)`,
+		`CREATE INDEX tasks_workspace ON tasks (workspace_id, id)`,
+		`CREATE TABLE rooms (
+			id {{id}},
+			workspace_id BIGINT NOT NULL REFERENCES workspaces (id) ON DELETE CASCADE,
+			name TEXT NOT NULL,
+			created_at {{time}} NOT NULL
+		)`,
+		`CREATE UNIQUE INDEX rooms_name ON rooms (workspace_id, lower(name))`,
+		`CREATE TABLE messages (
+			id {{id}},
+			room_id BIGINT NOT NULL REFERENCES rooms (id) ON DELETE CASCADE,
+			user_id BIGINT,
+			username TEXT NOT NULL,
+			content TEXT NOT NULL,
+			created_at {{time}} NOT NULL
+		)`,
+		`CREATE INDEX messages_room ON messages (room_id, id)`,
+	},
+	// 2: banned users
+	{
+		`ALTER TABLE users ADD COLUMN banned BOOLEAN NOT NULL DEFAULT FALSE`,
+	},
+	// 3: room slow mode
+	{
+		`ALTER TABLE rooms ADD COLUMN slow_mode INTEGER NOT NULL DEFAULT 0`,
+	},
+	// 4: notification preferences
+	{
+		`ALTER TABLE users ADD COLUMN do_not_disturb BOOLEAN NOT NULL DEFAULT FALSE`,
+		`ALTER TABLE users ADD COLUMN snooze_until {{time}}`,
+	},
+	// 5: room content policy
+	{
+		`ALTER TABLE rooms ADD COLUMN policy_max_length INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE rooms ADD COLUMN policy_no_links BOOLEAN NOT NULL DEFAULT FALSE`,
+	},
+	// 6: phone numbers for text messages
+	{
+		`ALTER TABLE users ADD COLUMN phone TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE users ADD COLUMN sms_notifications BOOLEAN NOT NULL DEFAULT FALSE`,
+	},
+	// 7: task assignees, priorities, tags and due dates
+	{
+		`ALTER TABLE tasks ADD COLUMN assignee TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE tasks ADD COLUMN priority TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE tasks ADD COLUMN tags TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE tasks ADD COLUMN due_date {{time}}`,
+	},
+	// 8: tombstones of merged tasks
+	{
+		`ALTER TABLE tasks ADD COLUMN merged_into INTEGER NOT NULL DEFAULT 0`,
+	},
+	// 9: projects, and when tasks were created and completed
+	{
+		`CREATE TABLE projects (
+			id {{id}},
+			workspace_id BIGINT NOT NULL REFERENCES workspaces (id) ON DELETE CASCADE,
+			name TEXT NOT NULL,
+			created_at {{time}} NOT NULL
+		)`,
+		`ALTER TABLE tasks ADD COLUMN project_id BIGINT NOT NULL DEFAULT 0`,
+		`ALTER TABLE tasks ADD COLUMN created_at {{time}}`,
+		`ALTER TABLE tasks ADD COLUMN completed_at {{time}}`,
+	},
+	// 10: work-in-progress limits of projects, as a JSON object
+	{
+		`ALTER TABLE projects ADD COLUMN wip_limits TEXT NOT NULL DEFAULT ''`,
+	},
+	// 11: task claims
+	{
+		`ALTER TABLE tasks ADD COLUMN claim_expires_at {{time}}`,
+	},
+	// 12: API tokens, which only keep a hash of their secret
+	{
+		`CREATE TABLE api_tokens (
+			id {{id}},
+			user_id BIGINT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			name TEXT NOT NULL,
+			scopes TEXT NOT NULL,
+			hint TEXT NOT NULL,
+			hash TEXT NOT NULL,
+			created_at {{time}} NOT NULL,
+			expires_at {{time}},
+			last_used_at {{time}}
+		)`,
+		`CREATE UNIQUE INDEX api_tokens_hash ON api_tokens (hash)`,
+		`CREATE INDEX api_tokens_user ON api_tokens (user_id, id)`,
+	},
+	// 13: message attachments and the room policies restricting them
+	{
+		`ALTER TABLE messages ADD COLUMN attachments TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE rooms ADD COLUMN policy_no_attachments BOOLEAN NOT NULL DEFAULT FALSE`,
+		`ALTER TABLE rooms ADD COLUMN policy_content_types TEXT NOT NULL DEFAULT ''`,
+	},
+	// 14: room webhooks, automations and event subscriptions, which were
+	// only kept in memory
+	{
+		`CREATE TABLE room_webhooks (
+			id {{id}},
+			room_id BIGINT NOT NULL REFERENCES rooms (id) ON DELETE CASCADE,
+			url TEXT NOT NULL,
+			batch BOOLEAN NOT NULL,
+			secret TEXT NOT NULL,
+			created_by TEXT NOT NULL,
+			created_at {{time}} NOT NULL
+		)`,
+		`CREATE TABLE automations (
+			id {{id}},
+			workspace_id BIGINT NOT NULL REFERENCES workspaces (id) ON DELETE CASCADE,
+			name TEXT NOT NULL,
+			enabled BOOLEAN NOT NULL,
+			trigger_spec TEXT NOT NULL,
+			actions TEXT NOT NULL,
+			secret TEXT NOT NULL,
+			created_by TEXT NOT NULL,
+			created_at {{time}} NOT NULL
+		)`,
+		`CREATE TABLE event_subscriptions (
+			id {{id}},
+			workspace_id BIGINT NOT NULL REFERENCES workspaces (id) ON DELETE CASCADE,
+			user_id BIGINT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			room_id BIGINT NOT NULL DEFAULT 0,
+			event_types TEXT NOT NULL,
+			filters TEXT NOT NULL,
+			action TEXT NOT NULL,
+			secret TEXT NOT NULL,
+			created_by TEXT NOT NULL,
+			created_at {{time}} NOT NULL
+		)`,
+	},
+	// 15: finding the messages old enough to archive
+	{
+		`CREATE INDEX messages_created_at ON messages (created_at)`,
+	},
+	// 16: attachments kept on disk, for storage quotas
+	{
+		`CREATE TABLE stored_attachments (
+			id TEXT PRIMARY KEY,
+			name TEXT NOT NULL,
+			size BIGINT NOT NULL,
+			user_id BIGINT NOT NULL,
+			workspace_id BIGINT NOT NULL,
+			created_at {{time}} NOT NULL
+		)`,
+		`CREATE INDEX stored_attachments_user_id ON stored_attachments (user_id)`,
+		`CREATE INDEX stored_attachments_workspace_id ON stored_attachments (workspace_id)`,
+	},
+	// 17: room link lists and messages held for review
+	{
+		`ALTER TABLE rooms ADD COLUMN policy_link_domains TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE rooms ADD COLUMN policy_blocked_link_domains TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE rooms ADD COLUMN policy_review_links BOOLEAN NOT NULL DEFAULT FALSE`,
+		`CREATE TABLE held_messages (
+			id {{id}},
+			workspace_id BIGINT NOT NULL REFERENCES workspaces (id) ON DELETE CASCADE,
+			room_id BIGINT NOT NULL REFERENCES rooms (id) ON DELETE CASCADE,
+			user_id BIGINT NOT NULL DEFAULT 0,
+			origin TEXT NOT NULL DEFAULT '',
+			message TEXT NOT NULL,
+			reason TEXT NOT NULL,
+			held_at {{time}} NOT NULL
+		)`,
+	},
+	// 18: counting the messages of new accounts
+	{
+		`CREATE INDEX messages_user_id ON messages (user_id)`,
+	},
+	// 19: impersonation tokens
+	{
+		`ALTER TABLE api_tokens ADD COLUMN impersonated_by TEXT NOT NULL DEFAULT ''`,
+	},
+	// 20: user locale
+	{
+		`ALTER TABLE users ADD COLUMN locale TEXT NOT NULL DEFAULT ''`,
+	},
+	// 21: workspace branding
+	{
+		`ALTER TABLE workspaces ADD COLUMN brand_name TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE workspaces ADD COLUMN brand_logo_url TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE workspaces ADD COLUMN brand_color TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE workspaces ADD COLUMN brand_support_email TEXT NOT NULL DEFAULT ''`,
+	},
+	// 22: room branding and welcome banners
+	{
+		`ALTER TABLE workspaces ADD COLUMN welcome_banner TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE rooms ADD COLUMN brand_logo_url TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE rooms ADD COLUMN brand_color TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE rooms ADD COLUMN welcome_banner TEXT NOT NULL DEFAULT ''`,
+	},
+	// 23: the event log
+	{
+		`CREATE TABLE events (
+			id {{id}},
+			event_id TEXT NOT NULL,
+			workspace_id BIGINT NOT NULL,
+			type TEXT NOT NULL,
+			time {{time}} NOT NULL,
+			data TEXT NOT NULL
+		)`,
+		`CREATE INDEX events_workspace_id ON events (workspace_id, id)`,
+		`CREATE INDEX events_time ON events (time)`,
+	},
+	// 24: task history
+	{
+		`CREATE TABLE task_events (
+			id {{id}},
+			workspace_id BIGINT NOT NULL,
+			task_id BIGINT NOT NULL,
+			version INTEGER NOT NULL,
+			type TEXT NOT NULL,
+			fields TEXT NOT NULL,
+			previous TEXT NOT NULL,
+			by_user TEXT NOT NULL,
+			created_at {{time}} NOT NULL,
+			UNIQUE (workspace_id, task_id, version)
+		)`,
+		`CREATE TABLE task_snapshots (
+			workspace_id BIGINT NOT NULL,
+			task_id BIGINT NOT NULL,
+			version INTEGER NOT NULL,
+			task TEXT NOT NULL,
+			deleted BOOLEAN NOT NULL,
+			created_at {{time}} NOT NULL,
+			PRIMARY KEY (workspace_id, task_id, version)
+		)`,
+	},
+	// 25: client message IDs, for replays after a reconnect
+	{
+		`ALTER TABLE messages ADD COLUMN client_msg_id TEXT NOT NULL DEFAULT ''`,
+	},
+	// 26: anonymizing departed users
+	{
+		`ALTER TABLE workspaces ADD COLUMN anonymize_departed BOOLEAN NOT NULL DEFAULT FALSE`,
+	},
+	// 27: server state, such as maintenance mode
+	{
+		`CREATE TABLE server_state (
+			key TEXT PRIMARY KEY,
+			value TEXT NOT NULL
+		)`,
+	},
+	// 28: access token revocation
+	{
+		`ALTER TABLE users ADD COLUMN token_generation INTEGER NOT NULL DEFAULT 0`,
+	},
+	// 29: scheduled messages, which were only kept in memory
+	{
+		`CREATE TABLE scheduled_messages (
+			id {{id}},
+			room_id BIGINT NOT NULL REFERENCES rooms (id) ON DELETE CASCADE,
+			cron TEXT NOT NULL,
+			timezone TEXT NOT NULL,
+			message TEXT NOT NULL,
+			created_by TEXT NOT NULL,
+			next_run {{time}} NOT NULL
+		)`,
+	},
+	// 30: the audit log, which was only kept in memory
+	{
+		`CREATE TABLE audit_events (
+			id {{id}},
+			time {{time}} NOT NULL,
+			action TEXT NOT NULL,
+			actor TEXT NOT NULL,
+			ip TEXT NOT NULL,
+			target TEXT NOT NULL,
+			details TEXT NOT NULL,
+			on_behalf_of TEXT NOT NULL
+		)`,
+		`CREATE INDEX audit_events_time ON audit_events (time)`,
+	},
+	// 31: finding what admins did while impersonating a user
+	{
+		`CREATE INDEX audit_events_on_behalf_of ON audit_events (on_behalf_of)`,
+		`CREATE INDEX audit_events_target ON audit_events (action, target)`,
+	},
+	// 32: gamification stats, which were only kept in memory
+	{
+		`CREATE TABLE user_activity (
+			user_id BIGINT PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+			username TEXT NOT NULL,
+			messages INTEGER NOT NULL,
+			tasks_completed INTEGER NOT NULL,
+			streak INTEGER NOT NULL,
+			best_streak INTEGER NOT NULL,
+			last_day TEXT NOT NULL,
+			achievements TEXT NOT NULL
+		)`,
+		`CREATE TABLE room_activity (
+			user_id BIGINT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			room_id BIGINT NOT NULL REFERENCES rooms (id) ON DELETE CASCADE,
+			messages INTEGER NOT NULL,
+			PRIMARY KEY (user_id, room_id)
+		)`,
+		`CREATE INDEX room_activity_room_id ON room_activity (room_id)`,
+	},
+	// 33: read markers
+	{
+		`CREATE TABLE read_markers (
+			user_id BIGINT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			room_id BIGINT NOT NULL REFERENCES rooms (id) ON DELETE CASCADE,
+			message_id BIGINT NOT NULL,
+			updated_at {{time}} NOT NULL,
+			PRIMARY KEY (user_id, room_id)
+		)`,
+	},
+	// 34: pinned messages
+	{
+		`CREATE TABLE pins (
+			room_id BIGINT NOT NULL REFERENCES rooms (id) ON DELETE CASCADE,
+			message_id BIGINT NOT NULL,
+			message TEXT NOT NULL,
+			pinned_by TEXT NOT NULL,
+			pinned_at {{time}} NOT NULL,
+			PRIMARY KEY (room_id, message_id)
+		)`,
+	},
+	// 35: task merges in history
+	{
+		`ALTER TABLE task_events ADD COLUMN merged_from BIGINT NOT NULL DEFAULT 0`,
+	},
+	// 36: the task changes feed, which reads a workspace's task events by ID
+	{
+		`CREATE INDEX task_events_workspace_id ON task_events (workspace_id, id)`,
+	},
+}
+
+// openSQLStore connects to the database and brings its schema up to date.
+// For SQLite the URL is a file path, for Postgres a connection string.
+func openSQLStore(dialect, url string) (*sqlStore, error) {
+	driver := "pgx"
+	if dialect == "sqlite" {
+		driver = "sqlite3"
+		if url == "" {
+			url = "chat.db"
+		}
+		if !strings.Contains(url, "?") {
+			url += "?_foreign_keys=on&_busy_timeout=5000&_journal_mode=WAL"
+		}
+	}
+
+	db, err := sql.Open(driver, url)
+	if err != nil {
+		return nil, err
+	}
+	if dialect == "sqlite" {
+		// SQLite allows a single writer; serialising access avoids
+		// "database is locked" errors under load
+		db.SetMaxOpenConns(1)
+	}
+
+	s := &sqlStore{db: db, dialect: dialect}
+	if err := s.Migrate(context.Background()); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// MigrationStatus returns the schema version of the database and the
+// latest one this build knows
+func (s *sqlStore) MigrationStatus(ctx context.Context) (int, int, error) {
+	_, err := s.db.ExecContext(ctx, sqlTypes[s.dialect].Replace(
+		`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY, applied_at {{time}} NOT NULL)`))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var current int
+	err = s.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current)
+	return current, len(sqlMigrations), err
+}
+
+// Migrate applies every migration the database hasn't seen yet
+func (s *sqlStore) Migrate(ctx context.Context) error {
+	current, _, err := s.MigrationStatus(ctx)
+	if err != nil {
+		return err
+	}
+
+	for version := current + 1; version <= len(sqlMigrations); version++ {
+		err := s.inTx(ctx, func(tx *sql.Tx) error {
+			for _, stmt := range sqlMigrations[version-1] {
+				if _, err := tx.ExecContext(ctx, sqlTypes[s.dialect].Replace(stmt)); err != nil {
+					return fmt.Errorf("migration %d: %w", version, err)
+				}
+			}
+			_, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, applied_at) VALUES ($1, $2)`, version, time.Now().UTC())
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		log.Printf("Applied database migration %d", version)
+	}
+	return nil
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *sqlStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+// inTx runs fn in a transaction, committing when it returns nil
+func (s *sqlStore) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// forUpdate locks the selected rows on Postgres. SQLite locks the whole
+// database for writes and has no row locks.
+func (s *sqlStore) forUpdate() string {
+	if s.dialect == "postgres" {
+		return " FOR UPDATE"
+	}
+	return ""
+}
+
+// notFound maps sql.ErrNoRows to errNotFound
+func notFound(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return errNotFound
+	}
+	return err
+}
+
+// queryer is implemented by *sql.DB and *sql.Tx
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// rowScanner is implemented by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+///////////
+// Users //
+///////////
+
+const userColumns = `id, username, email, email_verified, role, password_hash, created_at,
+	totp_enabled, totp_secret, totp_last_counter, recovery_codes, banned, do_not_disturb, snooze_until,
+	phone, sms_notifications, locale, token_generation`
+
+func scanUser(row rowScanner) (User, error) {
+	var u User
+	var recoveryCodes string
+	var snoozeUntil sql.NullTime
+	err := row.Scan(&u.ID, &u.Username, &u.Email, &u.EmailVerified, &u.Role, &u.PasswordHash, &u.CreatedAt,
+		&u.TOTPEnabled, &u.TOTPSecret, &u.TOTPLastCounter, &recoveryCodes, &u.Banned,
+		&u.Preferences.DoNotDisturb, &snoozeUntil, &u.Phone, &u.Preferences.SMSNotifications, &u.Preferences.Locale,
+		&u.TokenGeneration)
+	if err != nil {
+		return User{}, notFound(err)
+	}
+	if recoveryCodes != "" {
+		u.RecoveryCodes = strings.Split(recoveryCodes, ",")
+	}
+	if snoozeUntil.Valid {
+		u.Preferences.SnoozeUntil = &snoozeUntil.Time
+	}
+	return u, nil
+}
+
+func (s *sqlStore) CreateUser(ctx context.Context, user User) (User, error) {
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		var exists bool
+		err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM users WHERE lower(username) = lower($1))`, user.Username).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return errUsernameTaken
+		}
+		if user.Email != "" {
+			err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM users WHERE lower(email) = lower($1))`, user.Email).Scan(&exists)
+			if err != nil {
+				return err
+			}
+			if exists {
+				return errEmailTaken
+			}
+		}
+
+		return tx.QueryRowContext(ctx, `INSERT INTO users (username, email, email_verified, role, password_hash, created_at,
+				totp_enabled, totp_secret, totp_last_counter, recovery_codes, banned, do_not_disturb, snooze_until,
+				phone, sms_notifications, locale, token_generation)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17) RETURNING id`,
+			user.Username, user.Email, user.EmailVerified, user.Role, user.PasswordHash, user.CreatedAt,
+			user.TOTPEnabled, user.TOTPSecret, user.TOTPLastCounter, strings.Join(user.RecoveryCodes, ","), user.Banned,
+			user.Preferences.DoNotDisturb, user.Preferences.SnoozeUntil, user.Phone, user.Preferences.SMSNotifications,
+			user.Preferences.Locale, user.TokenGeneration,
+		).Scan(&user.ID)
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+func (s *sqlStore) GetUser(ctx context.Context, id int) (User, error) {
+	return scanUser(s.db.QueryRowContext(ctx, `SELECT `+userColumns+` FROM users WHERE id = $1`, id))
+}
+
+func (s *sqlStore) FindUserByUsername(ctx context.Context, username string) (User, error) {
+	return scanUser(s.db.QueryRowContext(ctx, `SELECT `+userColumns+` FROM users WHERE lower(username) = lower($1)`, username))
+}
+
+func (s *sqlStore) FindUserByEmail(ctx context.Context, email string) (User, error) {
+	if email == "" {
+		return User{}, errNotFound
+	}
+	return scanUser(s.db.QueryRowContext(ctx, `SELECT `+userColumns+` FROM users WHERE lower(email) = lower($1)`, email))
+}
+
+func (s *sqlStore) UpdateUser(ctx context.Context, id int, fn func(u *User) error) (User, error) {
+	var user User
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		user, err = scanUser(tx.QueryRowContext(ctx, `SELECT `+userColumns+` FROM users WHERE id = $1`+s.forUpdate(), id))
+		if err != nil {
+			return err
+		}
+		if err := fn(&user); err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, `UPDATE users SET username = $1, email = $2, email_verified = $3, role = $4,
+				password_hash = $5, totp_enabled = $6, totp_secret = $7, totp_last_counter = $8, recovery_codes = $9,
+				banned = $10, do_not_disturb = $11, snooze_until = $12, phone = $13, sms_notifications = $14,
+				locale = $15, token_generation = $16
+			WHERE id = $17`,
+			user.Username, user.Email, user.EmailVerified, user.Role,
+			user.PasswordHash, user.TOTPEnabled, user.TOTPSecret, user.TOTPLastCounter, strings.Join(user.RecoveryCodes, ","),
+			user.Banned, user.Preferences.DoNotDisturb, user.Preferences.SnoozeUntil, user.Phone, user.Preferences.SMSNotifications,
+			user.Preferences.Locale, user.TokenGeneration, id)
+		return err
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+func (s *sqlStore) ListUsers(ctx context.Context) ([]User, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+userColumns+` FROM users ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []User{}
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, u)
+	}
+	return list, rows.Err()
+}
+
+func (s *sqlStore) LinkIdentity(ctx context.Context, provider, subject string, userID int) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO identities (provider, subject, user_id) VALUES ($1, $2, $3)
+		ON CONFLICT (provider, subject) DO UPDATE SET user_id = excluded.user_id`, provider, subject, userID)
+	return err
+}
+
+func (s *sqlStore) FindIdentity(ctx context.Context, provider, subject string) (int, error) {
+	var userID int
+	err := s.db.QueryRowContext(ctx, `SELECT user_id FROM identities WHERE provider = $1 AND subject = $2`, provider, subject).Scan(&userID)
+	return userID, notFound(err)
+}
+
+///////////
+// Tasks //
+///////////
+
+const taskColumns = `id, workspace_id, title, description, status, assignee, priority, tags, due_date, merged_into,
+	project_id, created_at, completed_at, claim_expires_at`
+
+func scanTask(row rowScanner) (Task, error) {
+	var t Task
+	var tags string
+	var dueDate, createdAt, completedAt, claimExpiresAt sql.NullTime
+	err := row.Scan(&t.ID, &t.WorkspaceID, &t.Title, &t.Description, &t.Status, &t.Assignee, &t.Priority, &tags, &dueDate, &t.MergedInto,
+		&t.ProjectID, &createdAt, &completedAt, &claimExpiresAt)
+	if err != nil {
+		return Task{}, notFound(err)
+	}
+	// Tasks created before migration 9 have no creation time
+	t.CreatedAt = createdAt.Time
+	if completedAt.Valid {
+		t.CompletedAt = &completedAt.Time
+	}
+	if claimExpiresAt.Valid {
+		t.ClaimExpiresAt = &claimExpiresAt.Time
+	}
+	if tags != "" {
+		t.Tags = strings.Split(tags, ",")
+	}
+	if dueDate.Valid {
+		t.DueDate = &dueDate.Time
+	}
+	return t, nil
+}
+
+func (s *sqlStore) CreateTask(ctx context.Context, task Task, by string) (Task, error) {
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, `INSERT INTO tasks (workspace_id, title, description, status,
+				assignee, priority, tags, due_date, merged_into, project_id, created_at, completed_at, claim_expires_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13) RETURNING id`,
+			task.WorkspaceID, task.Title, task.Description, task.Status,
+			task.Assignee, task.Priority, strings.Join(task.Tags, ","), task.DueDate, task.MergedInto,
+			task.ProjectID, task.CreatedAt, task.CompletedAt, task.ClaimExpiresAt).Scan(&task.ID)
+		if err != nil {
+			return err
+		}
+		return s.recordTaskWrite(ctx, tx, Task{}, task, 0, by)
+	})
+	if err != nil {
+		return Task{}, err
+	}
+	return task, nil
+}
+
+func (s *sqlStore) ListTasks(ctx context.Context, workspaceID int) ([]Task, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+taskColumns+` FROM tasks
+		WHERE workspace_id = $1 AND merged_into = 0 ORDER BY id`, workspaceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []Task{}
+	for rows.Next() {
+		t, err := scanTask(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, t)
+	}
+	return list, rows.Err()
+}
+
+func (s *sqlStore) GetTask(ctx context.Context, workspaceID, id int) (Task, error) {
+	return scanTask(s.db.QueryRowContext(ctx, `SELECT `+taskColumns+` FROM tasks
+		WHERE id = $1 AND workspace_id = $2`, id, workspaceID))
+}
+
+func (s *sqlStore) UpdateTask(ctx context.Context, task Task, by string) (Task, error) {
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		return s.updateTask(ctx, tx, task, 0, by)
+	})
+	if err != nil {
+		return Task{}, err
+	}
+	return task, nil
+}
+
+// updateTask replaces a stored task in a transaction and adds the change
+// to its history
+func (s *sqlStore) updateTask(ctx context.Context, tx *sql.Tx, task Task, mergedFrom int, by string) error {
+	previous, err := s.lockTask(ctx, tx, task.WorkspaceID, task.ID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE tasks SET title = $1, description = $2, status = $3,
+			assignee = $4, priority = $5, tags = $6, due_date = $7, merged_into = $8,
+			project_id = $9, completed_at = $10, claim_expires_at = $11
+		WHERE id = $12 AND workspace_id = $13`,
+		task.Title, task.Description, task.Status,
+		task.Assignee, task.Priority, strings.Join(task.Tags, ","), task.DueDate, task.MergedInto,
+		task.ProjectID, task.CompletedAt, task.ClaimExpiresAt, task.ID, task.WorkspaceID)
+	if err != nil {
+		return err
+	}
+	return s.recordTaskWrite(ctx, tx, previous, task, mergedFrom, by)
+}
+
+// lockTask reads a stored task in a transaction that writes it
+func (s *sqlStore) lockTask(ctx context.Context, tx *sql.Tx, workspaceID, id int) (Task, error) {
+	return scanTask(tx.QueryRowContext(ctx, `SELECT `+taskColumns+` FROM tasks
+		WHERE id = $1 AND workspace_id = $2`+s.forUpdate(), id, workspaceID))
+}
+
+func (s *sqlStore) DeleteTask(ctx context.Context, workspaceID, id int, by string) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		previous, err := s.lockTask(ctx, tx, workspaceID, id)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM tasks WHERE id = $1 AND workspace_id = $2`, id, workspaceID); err != nil {
+			return err
+		}
+		return s.appendTaskEvent(ctx, tx, taskDeletedEvent(workspaceID, id, by), previous, Task{})
+	})
+}
+
+func (s *sqlStore) MergeTasks(ctx context.Context, task, other Task, by string) (Task, error) {
+	if other.WorkspaceID != task.WorkspaceID {
+		return Task{}, errNotFound
+	}
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		if err := s.updateTask(ctx, tx, task, other.ID, by); err != nil {
+			return err
+		}
+		return s.updateTask(ctx, tx, other, 0, by)
+	})
+	if err != nil {
+		return Task{}, err
+	}
+	return task, nil
+}
+
+func (s *sqlStore) ClaimTask(ctx context.Context, workspaceID, id int, username string, expires, now time.Time) (Task, error) {
+	var task Task
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		previous, err := s.lockTask(ctx, tx, workspaceID, id)
+		if err != nil {
+			return err
+		}
+		if previous.MergedInto != 0 {
+			return errNotFound
+		}
+		// The conditions match claimable; checking them in the UPDATE makes
+		// the claim atomic on SQLite, which has no row locks
+		task, err = scanTask(tx.QueryRowContext(ctx, `UPDATE tasks SET assignee = $1, claim_expires_at = $2
+			WHERE id = $3 AND workspace_id = $4 AND status <> 'completed'
+				AND (assignee = '' OR lower(assignee) = lower($1) OR claim_expires_at < $5)
+			RETURNING `+taskColumns, username, expires, id, workspaceID, now))
+		if errors.Is(err, errNotFound) {
+			return errTaskClaimed
+		}
+		if err != nil {
+			return err
+		}
+		return s.recordTaskWrite(ctx, tx, previous, task, 0, username)
+	})
+	if err != nil {
+		return Task{}, err
+	}
+	return task, nil
+}
+
+func (s *sqlStore) ReleaseExpiredClaims(ctx context.Context, now time.Time) ([]Task, error) {
+	var released []Task
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		expired, err := queryAll(ctx, tx, scanTask, `SELECT `+taskColumns+` FROM tasks
+			WHERE claim_expires_at < $1 ORDER BY id`+s.forUpdate(), now)
+		if err != nil {
+			return err
+		}
+		for _, previous := range expired {
+			t := previous
+			t.Assignee, t.ClaimExpiresAt = "", nil
+			_, err := tx.ExecContext(ctx, `UPDATE tasks SET assignee = '', claim_expires_at = NULL WHERE id = $1`, t.ID)
+			if err != nil {
+				return err
+			}
+			if err := s.recordTaskWrite(ctx, tx, previous, t, 0, systemUsername); err != nil {
+				return err
+			}
+			released = append(released, t)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return released, nil
+}
+
+//////////////////
+// Task History //
+//////////////////
+
+// First key of the advisory locks that order the task events of each
+// workspace on Postgres; the second is the workspace ID
+const taskEventsLockKey = 24
+
+const taskEventColumns = `id, workspace_id, task_id, version, type, fields, previous, by_user, created_at, merged_from`
+
+func scanTaskEvent(row rowScanner) (TaskEvent, error) {
+	var e TaskEvent
+	var fields, previous string
+	err := row.Scan(&e.ID, &e.WorkspaceID, &e.TaskID, &e.Version, &e.Type, &fields, &previous, &e.By, &e.At, &e.MergedFrom)
+	if err != nil {
+		return TaskEvent{}, err
+	}
+	json.Unmarshal([]byte(fields), &e.Fields)
+	json.Unmarshal([]byte(previous), &e.Previous)
+	return e, nil
+}
+
+// recordTaskWrite adds the event of a write to a task to its history in
+// the write's transaction, if the write changed anything
+func (s *sqlStore) recordTaskWrite(ctx context.Context, tx *sql.Tx, previous, task Task, mergedFrom int, by string) error {
+	e, ok := taskChangeEvent(previous, task, mergedFrom, by)
+	if !ok {
+		return nil
+	}
+	return s.appendTaskEvent(ctx, tx, e, previous, task)
+}
+
+// appendTaskEvent stores an event as the next version of its task, with
+// the snapshots due
+func (s *sqlStore) appendTaskEvent(ctx context.Context, tx *sql.Tx, e TaskEvent, previous, task Task) error {
+	// The changes feed reads a workspace's events by ID, so they have to
+	// commit in the order of their IDs. Postgres hands out IDs to parallel
+	// transactions, which are held up here until the one before commits;
+	// SQLite only ever runs one write.
+	if s.dialect == "postgres" {
+		if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1, $2)`, taskEventsLockKey, e.WorkspaceID); err != nil {
+			return err
+		}
+	}
+	// Appends to the same task on other nodes fail the unique version, and
+	// with it the write, rather than fork the history
+	err := tx.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) + 1 FROM task_events
+		WHERE workspace_id = $1 AND task_id = $2`, e.WorkspaceID, e.TaskID).Scan(&e.Version)
+	if err != nil {
+		return err
+	}
+	fields, _ := json.Marshal(e.Fields)
+	previousFields, _ := json.Marshal(e.Previous)
+	_, err = tx.ExecContext(ctx, `INSERT INTO task_events (workspace_id, task_id, version, type, fields, previous, by_user, created_at, merged_from)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		e.WorkspaceID, e.TaskID, e.Version, e.Type, string(fields), string(previousFields), e.By, e.At, e.MergedFrom)
+	if err != nil {
+		return err
+	}
+	for _, snap := range taskEventSnapshots(e, previous, task) {
+		if err := insertTaskSnapshot(ctx, tx, snap); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqlStore) ListWorkspaceTaskEvents(ctx context.Context, workspaceID int, afterID int64, limit int) ([]TaskEvent, error) {
+	list, err := queryAll(ctx, s.db, scanTaskEvent, `SELECT `+taskEventColumns+` FROM task_events
+		WHERE workspace_id = $1 AND id > $2 ORDER BY id LIMIT $3`, workspaceID, afterID, limit)
+	if list == nil {
+		list = []TaskEvent{}
+	}
+	return list, err
+}
+
+func (s *sqlStore) LastTaskEventID(ctx context.Context, workspaceID int) (int64, error) {
+	var id int64
+	err := s.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(id), 0) FROM task_events WHERE workspace_id = $1`, workspaceID).Scan(&id)
+	return id, err
+}
+
+func (s *sqlStore) ListTaskEvents(ctx context.Context, workspaceID, taskID, afterVersion int) ([]TaskEvent, error) {
+	list, err := queryAll(ctx, s.db, scanTaskEvent, `SELECT `+taskEventColumns+` FROM task_events
+		WHERE workspace_id = $1 AND task_id = $2 AND version > $3 ORDER BY version`, workspaceID, taskID, afterVersion)
+	if list == nil {
+		list = []TaskEvent{}
+	}
+	return list, err
+}
+
+func insertTaskSnapshot(ctx context.Context, tx *sql.Tx, snap TaskSnapshot) error {
+	task, _ := json.Marshal(snap.Task)
+	_, err := tx.ExecContext(ctx, `INSERT INTO task_snapshots (workspace_id, task_id, version, task, deleted, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6)`, snap.WorkspaceID, snap.TaskID, snap.Version, string(task), snap.Deleted, snap.At)
+	return err
+}
+
+const taskSnapshotColumns = `workspace_id, task_id, version, task, deleted, created_at`
+
+func scanTaskSnapshot(row rowScanner) (TaskSnapshot, error) {
+	var snap TaskSnapshot
+	var task string
+	err := row.Scan(&snap.WorkspaceID, &snap.TaskID, &snap.Version, &task, &snap.Deleted, &snap.At)
+	if err != nil {
+		return TaskSnapshot{}, notFound(err)
+	}
+	json.Unmarshal([]byte(task), &snap.Task)
+	snap.Task.WorkspaceID = snap.WorkspaceID
+	return snap, nil
+}
+
+func (s *sqlStore) GetTaskSnapshot(ctx context.Context, workspaceID, taskID, version int) (TaskSnapshot, error) {
+	return scanTaskSnapshot(s.db.QueryRowContext(ctx, `SELECT `+taskSnapshotColumns+` FROM task_snapshots
+		WHERE workspace_id = $1 AND task_id = $2 AND version <= $3 ORDER BY version DESC LIMIT 1`, workspaceID, taskID, version))
+}
+
+func (s *sqlStore) RenameTaskUser(ctx context.Context, workspaceID int, username, newName string) (int, error) {
+	n := 0
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, `UPDATE tasks SET assignee = $1 WHERE workspace_id = $2 AND assignee = $3`,
+			newName, workspaceID, username)
+		if err != nil {
+			return err
+		}
+		tasks, _ := res.RowsAffected()
+		n = int(tasks)
+
+		// History keeps the name inside JSON, so whatever may hold it is
+		// checked here
+		pattern := "%" + username + "%"
+		events, err := queryAll(ctx, tx, scanTaskEvent, `SELECT `+taskEventColumns+` FROM task_events
+			WHERE workspace_id = $1 AND (by_user = $2 OR fields LIKE $3 OR previous LIKE $3)`, workspaceID, username, pattern)
+		if err != nil {
+			return err
+		}
+		for _, e := range events {
+			e, ok := renameInTaskEvent(e, username, newName)
+			if !ok {
+				continue
+			}
+			fields, _ := json.Marshal(e.Fields)
+			previous, _ := json.Marshal(e.Previous)
+			_, err := tx.ExecContext(ctx, `UPDATE task_events SET fields = $1, previous = $2, by_user = $3 WHERE id = $4`,
+				string(fields), string(previous), e.By, e.ID)
+			if err != nil {
+				return err
+			}
+			n++
+		}
+
+		snaps, err := queryAll(ctx, tx, func(row rowScanner) (TaskSnapshot, error) {
+			var snap TaskSnapshot
+			var task string
+			err := row.Scan(&snap.TaskID, &snap.Version, &task)
+			if err == nil {
+				err = json.Unmarshal([]byte(task), &snap.Task)
+			}
+			return snap, err
+		}, `SELECT task_id, version, task FROM task_snapshots WHERE workspace_id = $1 AND task LIKE $2`, workspaceID, pattern)
+		if err != nil {
+			return err
+		}
+		for _, snap := range snaps {
+			if snap.Task.Assignee != username {
+				continue
+			}
+			snap.Task.Assignee = newName
+			task, _ := json.Marshal(snap.Task)
+			_, err := tx.ExecContext(ctx, `UPDATE task_snapshots SET task = $1
+				WHERE workspace_id = $2 AND task_id = $3 AND version = $4`, string(task), workspaceID, snap.TaskID, snap.Version)
+			if err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+//////////////
+// Projects //
+//////////////
+
+const projectColumns = `id, workspace_id, name, created_at, wip_limits`
+
+func scanProject(row rowScanner) (Project, error) {
+	var p Project
+	var limits string
+	err := row.Scan(&p.ID, &p.WorkspaceID, &p.Name, &p.CreatedAt, &limits)
+	if err != nil {
+		return Project{}, notFound(err)
+	}
+	if limits != "" {
+		if err := json.Unmarshal([]byte(limits), &p.WIPLimits); err != nil {
+			return Project{}, fmt.Errorf("project %d WIP limits: %w", p.ID, err)
+		}
+	}
+	return p, nil
+}
+
+// encodeWIPLimits returns the text stored for a project's WIP limits
+func encodeWIPLimits(limits map[string]int) string {
+	if len(limits) == 0 {
+		return ""
+	}
+	b, _ := json.Marshal(limits)
+	return string(b)
+}
+
+func (s *sqlStore) CreateProject(ctx context.Context, project Project) (Project, error) {
+	err := s.db.QueryRowContext(ctx, `INSERT INTO projects (workspace_id, name, created_at, wip_limits)
+		VALUES ($1, $2, $3, $4) RETURNING id`,
+		project.WorkspaceID, project.Name, project.CreatedAt, encodeWIPLimits(project.WIPLimits)).Scan(&project.ID)
+	if err != nil {
+		return Project{}, err
+	}
+	return project, nil
+}
+
+func (s *sqlStore) ListProjects(ctx context.Context, workspaceID int) ([]Project, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+projectColumns+` FROM projects
+		WHERE workspace_id = $1 ORDER BY id`, workspaceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []Project{}
+	for rows.Next() {
+		p, err := scanProject(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, p)
+	}
+	return list, rows.Err()
+}
+
+func (s *sqlStore) GetProject(ctx context.Context, workspaceID, id int) (Project, error) {
+	return scanProject(s.db.QueryRowContext(ctx, `SELECT `+projectColumns+` FROM projects
+		WHERE id = $1 AND workspace_id = $2`, id, workspaceID))
+}
+
+func (s *sqlStore) SetProjectWIPLimits(ctx context.Context, workspaceID, id int, limits map[string]int) (Project, error) {
+	return scanProject(s.db.QueryRowContext(ctx, `UPDATE projects SET wip_limits = $1
+		WHERE id = $2 AND workspace_id = $3 RETURNING `+projectColumns, encodeWIPLimits(limits), id, workspaceID))
+}
+
+//////////////
+// Messages //
+//////////////
+
+const messageColumns = `m.id, m.room_id, COALESCE(m.user_id, 0), m.username, m.content, m.created_at, m.attachments, m.client_msg_id, r.name`
+
+func scanMessage(row rowScanner) (Message, error) {
+	var m Message
+	var attachments string
+	err := row.Scan(&m.ID, &m.RoomID, &m.UserID, &m.Username, &m.Content, &m.CreatedAt, &attachments, &m.ClientMsgID, &m.Room)
+	if err == nil && attachments != "" {
+		err = json.Unmarshal([]byte(attachments), &m.Attachments)
+	}
+	return m, err
+}
+
+// encodeAttachments returns the text stored for a message's attachments
+func encodeAttachments(attachments []Attachment) string {
+	if len(attachments) == 0 {
+		return ""
+	}
+	b, _ := json.Marshal(attachments)
+	return string(b)
+}
+
+func (s *sqlStore) SaveMessages(ctx context.Context, msgs []Message) error {
+	// One transaction per batch keeps the number of commits (and fsyncs)
+	// down, which is where most of the cost of an insert goes
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		stmt, err := tx.PrepareContext(ctx, `INSERT INTO messages (room_id, user_id, username, content, created_at, attachments, client_msg_id)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)`)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+
+		for _, msg := range msgs {
+			// Anonymous messages have no user
+			var userID sql.NullInt64
+			if msg.UserID != 0 {
+				userID = sql.NullInt64{Int64: int64(msg.UserID), Valid: true}
+			}
+			_, err := stmt.ExecContext(ctx, msg.RoomID, userID, msg.Username, msg.Content, msg.CreatedAt, encodeAttachments(msg.Attachments), msg.ClientMsgID)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *sqlStore) ListMessages(ctx context.Context, roomID, beforeID, limit int) ([]Message, error) {
+	query := `SELECT ` + messageColumns + `
+		FROM messages m JOIN rooms r ON r.id = m.room_id
+		WHERE m.room_id = $1 AND ($2 = 0 OR m.id < $2)
+		ORDER BY m.id DESC LIMIT $3`
+	rows, err := s.db.QueryContext(ctx, query, roomID, beforeID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []Message{}
+	for rows.Next() {
+		m, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, m)
+	}
+
+	// Fetched newest first; return them oldest first
+	for i, j := 0, len(list)-1; i < j; i, j = i+1, j-1 {
+		list[i], list[j] = list[j], list[i]
+	}
+	return list, rows.Err()
+}
+
+func (s *sqlStore) SearchMessages(ctx context.Context, workspaceID int, text string, limit int) ([]Message, error) {
+	pattern := "%" + likeEscaper.Replace(strings.ToLower(text)) + "%"
+	rows, err := s.db.QueryContext(ctx, `SELECT `+messageColumns+`
+		FROM messages m JOIN rooms r ON r.id = m.room_id
+		WHERE r.workspace_id = $1 AND LOWER(m.content) LIKE $2 ESCAPE '\'
+		ORDER BY m.id DESC LIMIT $3`, workspaceID, pattern, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []Message{}
+	for rows.Next() {
+		m, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, m)
+	}
+	return list, rows.Err()
+}
+
+func (s *sqlStore) DeleteMessages(ctx context.Context, roomID int) (int, error) {
+	var n int64
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM pins WHERE room_id = $1`, roomID); err != nil {
+			return err
+		}
+		res, err := tx.ExecContext(ctx, `DELETE FROM messages WHERE room_id = $1`, roomID)
+		if err != nil {
+			return err
+		}
+		n, err = res.RowsAffected()
+		return err
+	})
+	return int(n), err
+}
+
+func (s *sqlStore) ListMessagesBefore(ctx context.Context, t time.Time, limit int) ([]Message, error) {
+	return queryAll(ctx, s.db, scanMessage, `SELECT `+messageColumns+`
+		FROM messages m JOIN rooms r ON r.id = m.room_id
+		WHERE m.created_at < $1
+		ORDER BY m.id LIMIT $2`, t, limit)
+}
+
+func (s *sqlStore) DeleteMessageIDs(ctx context.Context, ids []int) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		stmt, err := tx.PrepareContext(ctx, `DELETE FROM messages WHERE id = $1`)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+
+		for _, id := range ids {
+			if _, err := stmt.ExecContext(ctx, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *sqlStore) CountUserMessages(ctx context.Context, userID int) (int, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM messages WHERE user_id = $1`, userID).Scan(&n)
+	return n, err
+}
+
+func (s *sqlStore) ListUserMessages(ctx context.Context, workspaceID, userID int, from, until time.Time, afterID, limit int) ([]Message, error) {
+	return queryAll(ctx, s.db, scanMessage, `SELECT `+messageColumns+`
+		FROM messages m JOIN rooms r ON r.id = m.room_id
+		WHERE r.workspace_id = $1 AND m.user_id = $2 AND m.created_at >= $3 AND m.created_at < $4 AND m.id > $5
+		ORDER BY m.id LIMIT $6`, workspaceID, userID, from, until, afterID, limit)
+}
+
+func (s *sqlStore) RenameUserMessages(ctx context.Context, workspaceID, userID int, username string) (int, error) {
+	res, err := s.db.ExecContext(ctx, `UPDATE messages SET username = $1
+		WHERE user_id = $2 AND room_id IN (SELECT id FROM rooms WHERE workspace_id = $3)`, username, userID, workspaceID)
+	if err != nil {
+		return 0, err
+	}
+	n, _ := res.RowsAffected()
+	return int(n), nil
+}
+
+///////////
+// Rooms //
+///////////
+
+const roomColumns = `id, workspace_id, name, created_at, slow_mode, policy_max_length, policy_no_links,
+	policy_no_attachments, policy_content_types, policy_link_domains, policy_blocked_link_domains, policy_review_links,
+	brand_logo_url, brand_color, welcome_banner`
+
+func scanRoom(row rowScanner) (Room, error) {
+	var r Room
+	var contentTypes, linkDomains, blockedLinkDomains string
+	err := row.Scan(&r.ID, &r.WorkspaceID, &r.Name, &r.CreatedAt, &r.SlowMode, &r.Policy.MaxLength, &r.Policy.NoLinks,
+		&r.Policy.NoAttachments, &contentTypes, &linkDomains, &blockedLinkDomains, &r.Policy.ReviewLinks,
+		&r.Branding.LogoURL, &r.Branding.Color, &r.Branding.WelcomeBanner)
+	if contentTypes != "" {
+		r.Policy.ContentTypes = strings.Split(contentTypes, ",")
+	}
+	if linkDomains != "" {
+		r.Policy.LinkDomains = strings.Split(linkDomains, ",")
+	}
+	if blockedLinkDomains != "" {
+		r.Policy.BlockedLinkDomains = strings.Split(blockedLinkDomains, ",")
+	}
+	return r, notFound(err)
+}
+
+func (s *sqlStore) CreateRoom(ctx context.Context, room Room) (Room, error) {
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		var exists bool
+		err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM rooms WHERE workspace_id = $1 AND lower(name) = lower($2))`,
+			room.WorkspaceID, room.Name).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return errRoomExists
+		}
+
+		return tx.QueryRowContext(ctx, `INSERT INTO rooms (workspace_id, name, created_at, slow_mode, policy_max_length, policy_no_links,
+			policy_no_attachments, policy_content_types, policy_link_domains, policy_blocked_link_domains, policy_review_links,
+			brand_logo_url, brand_color, welcome_banner)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14) RETURNING id`,
+			room.WorkspaceID, room.Name, room.CreatedAt, room.SlowMode, room.Policy.MaxLength, room.Policy.NoLinks,
+			room.Policy.NoAttachments, strings.Join(room.Policy.ContentTypes, ","), strings.Join(room.Policy.LinkDomains, ","),
+			strings.Join(room.Policy.BlockedLinkDomains, ","), room.Policy.ReviewLinks,
+			room.Branding.LogoURL, room.Branding.Color, room.Branding.WelcomeBanner).Scan(&room.ID)
+	})
+	if err != nil {
+		return Room{}, err
+	}
+	return room, nil
+}
+
+func (s *sqlStore) ListRooms(ctx context.Context, workspaceID int) ([]Room, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+roomColumns+` FROM rooms
+		WHERE workspace_id = $1 ORDER BY id`, workspaceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []Room{}
+	for rows.Next() {
+		r, err := scanRoom(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, r)
+	}
+	return list, rows.Err()
+}
+
+func (s *sqlStore) FindRoom(ctx context.Context, workspaceID int, name string) (Room, error) {
+	return scanRoom(s.db.QueryRowContext(ctx, `SELECT `+roomColumns+` FROM rooms
+		WHERE workspace_id = $1 AND lower(name) = lower($2)`, workspaceID, name))
+}
+
+func (s *sqlStore) SetRoomSlowMode(ctx context.Context, id, seconds int) (Room, error) {
+	return scanRoom(s.db.QueryRowContext(ctx, `UPDATE rooms SET slow_mode = $1
+		WHERE id = $2 RETURNING `+roomColumns, seconds, id))
+}
+
+func (s *sqlStore) SetRoomPolicy(ctx context.Context, id int, policy RoomPolicy) (Room, error) {
+	return scanRoom(s.db.QueryRowContext(ctx, `UPDATE rooms SET policy_max_length = $1, policy_no_links = $2,
+		policy_no_attachments = $3, policy_content_types = $4, policy_link_domains = $5, policy_blocked_link_domains = $6,
+		policy_review_links = $7
+		WHERE id = $8 RETURNING `+roomColumns, policy.MaxLength, policy.NoLinks,
+		policy.NoAttachments, strings.Join(policy.ContentTypes, ","), strings.Join(policy.LinkDomains, ","),
+		strings.Join(policy.BlockedLinkDomains, ","), policy.ReviewLinks, id))
+}
+
+func (s *sqlStore) SetRoomBranding(ctx context.Context, id int, branding RoomBranding) (Room, error) {
+	return scanRoom(s.db.QueryRowContext(ctx, `UPDATE rooms SET brand_logo_url = $1, brand_color = $2, welcome_banner = $3
+		WHERE id = $4 RETURNING `+roomColumns, branding.LogoURL, branding.Color, branding.WelcomeBanner, id))
+}
+
+////////////////
+// Workspaces //
+////////////////
+
+const workspaceColumns = `id, slug, name, created_at, open_membership, anonymous_chat,
+	brand_name, brand_logo_url, brand_color, brand_support_email, welcome_banner, anonymize_departed`
+
+func scanWorkspace(row rowScanner) (Workspace, error) {
+	var ws Workspace
+	b := &ws.Settings.Branding
+	err := row.Scan(&ws.ID, &ws.Slug, &ws.Name, &ws.CreatedAt, &ws.Settings.OpenMembership, &ws.Settings.AnonymousChat,
+		&b.Name, &b.LogoURL, &b.Color, &b.SupportEmail, &b.WelcomeBanner, &ws.Settings.AnonymizeDeparted)
+	return ws, notFound(err)
+}
+
+func (s *sqlStore) CreateWorkspace(ctx context.Context, ws Workspace) (Workspace, error) {
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		var exists bool
+		err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM workspaces WHERE slug = $1)`, ws.Slug).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return errSlugTaken
+		}
+
+		b := ws.Settings.Branding
+		return tx.QueryRowContext(ctx, `INSERT INTO workspaces (slug, name, created_at, open_membership, anonymous_chat,
+				brand_name, brand_logo_url, brand_color, brand_support_email, welcome_banner, anonymize_departed)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) RETURNING id`,
+			ws.Slug, ws.Name, ws.CreatedAt, ws.Settings.OpenMembership, ws.Settings.AnonymousChat,
+			b.Name, b.LogoURL, b.Color, b.SupportEmail, b.WelcomeBanner, ws.Settings.AnonymizeDeparted).Scan(&ws.ID)
+	})
+	if err != nil {
+		return Workspace{}, err
+	}
+	return ws, nil
+}
+
+func (s *sqlStore) ListWorkspaces(ctx context.Context) ([]Workspace, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+workspaceColumns+` FROM workspaces ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []Workspace{}
+	for rows.Next() {
+		ws, err := scanWorkspace(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, ws)
+	}
+	return list, rows.Err()
+}
+
+func (s *sqlStore) FindWorkspace(ctx context.Context, slug string) (Workspace, error) {
+	return scanWorkspace(s.db.QueryRowContext(ctx, `SELECT `+workspaceColumns+` FROM workspaces WHERE slug = $1`, slug))
+}
+
+func (s *sqlStore) UpdateWorkspaceSettings(ctx context.Context, id int, settings WorkspaceSettings) (Workspace, error) {
+	b := settings.Branding
+	return scanWorkspace(s.db.QueryRowContext(ctx, `UPDATE workspaces SET open_membership = $1, anonymous_chat = $2,
+			brand_name = $3, brand_logo_url = $4, brand_color = $5, brand_support_email = $6, welcome_banner = $7,
+			anonymize_departed = $8
+		WHERE id = $9 RETURNING `+workspaceColumns,
+		settings.OpenMembership, settings.AnonymousChat, b.Name, b.LogoURL, b.Color, b.SupportEmail, b.WelcomeBanner,
+		settings.AnonymizeDeparted, id))
+}
+
+const memberColumns = `m.workspace_id, m.user_id, u.username, m.role, m.joined_at`
+
+func scanMember(row rowScanner) (WorkspaceMember, error) {
+	var m WorkspaceMember
+	err := row.Scan(&m.WorkspaceID, &m.UserID, &m.Username, &m.Role, &m.JoinedAt)
+	return m, notFound(err)
+}
+
+func (s *sqlStore) AddMember(ctx context.Context, m WorkspaceMember) (WorkspaceMember, error) {
+	if m.JoinedAt.IsZero() {
+		m.JoinedAt = time.Now().UTC()
+	}
+	_, err := s.db.ExecContext(ctx, `INSERT INTO workspace_members (workspace_id, user_id, role, joined_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (workspace_id, user_id) DO UPDATE SET role = excluded.role`,
+		m.WorkspaceID, m.UserID, m.Role, m.JoinedAt)
+	if err != nil {
+		return WorkspaceMember{}, err
+	}
+	return s.GetMember(ctx, m.WorkspaceID, m.UserID)
+}
+
+func (s *sqlStore) GetMember(ctx context.Context, workspaceID, userID int) (WorkspaceMember, error) {
+	return scanMember(s.db.QueryRowContext(ctx, `SELECT `+memberColumns+`
+		FROM workspace_members m JOIN users u ON u.id = m.user_id
+		WHERE m.workspace_id = $1 AND m.user_id = $2`, workspaceID, userID))
+}
+
+func (s *sqlStore) ListMembers(ctx context.Context, workspaceID int) ([]WorkspaceMember, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+memberColumns+`
+		FROM workspace_members m JOIN users u ON u.id = m.user_id
+		WHERE m.workspace_id = $1 ORDER BY m.joined_at`, workspaceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []WorkspaceMember{}
+	for rows.Next() {
+		m, err := scanMember(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, m)
+	}
+	return list, rows.Err()
+}
+
+func (s *sqlStore) RemoveMember(ctx context.Context, workspaceID, userID int) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM workspace_members WHERE workspace_id = $1 AND user_id = $2`, workspaceID, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+////////////////
+// API Tokens //
+////////////////
+
+const apiTokenColumns = `id, user_id, name, scopes, hint, hash, created_at, expires_at, last_used_at, impersonated_by`
+
+func scanAPIToken(row rowScanner) (APIToken, error) {
+	var t APIToken
+	var scopes string
+	var expiresAt, lastUsedAt sql.NullTime
+	err := row.Scan(&t.ID, &t.UserID, &t.Name, &scopes, &t.Hint, &t.Hash, &t.CreatedAt, &expiresAt, &lastUsedAt, &t.ImpersonatedBy)
+	if err != nil {
+		return APIToken{}, notFound(err)
+	}
+	if scopes != "" {
+		t.Scopes = strings.Split(scopes, ",")
+	}
+	if expiresAt.Valid {
+		t.ExpiresAt = &expiresAt.Time
+	}
+	if lastUsedAt.Valid {
+		t.LastUsedAt = &lastUsedAt.Time
+	}
+	return t, nil
+}
+
+func (s *sqlStore) CreateAPIToken(ctx context.Context, token APIToken) (APIToken, error) {
+	err := s.db.QueryRowContext(ctx, `INSERT INTO api_tokens (user_id, name, scopes, hint, hash, created_at, expires_at, last_used_at,
+			impersonated_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id`,
+		token.UserID, token.Name, strings.Join(token.Scopes, ","), token.Hint, token.Hash,
+		token.CreatedAt, token.ExpiresAt, token.LastUsedAt, token.ImpersonatedBy).Scan(&token.ID)
+	if err != nil {
+		return APIToken{}, err
+	}
+	return token, nil
+}
+
+func (s *sqlStore) GetAPIToken(ctx context.Context, id int) (APIToken, error) {
+	return scanAPIToken(s.db.QueryRowContext(ctx, `SELECT `+apiTokenColumns+` FROM api_tokens WHERE id = $1`, id))
+}
+
+func (s *sqlStore) FindAPIToken(ctx context.Context, hash string) (APIToken, error) {
+	return scanAPIToken(s.db.QueryRowContext(ctx, `SELECT `+apiTokenColumns+` FROM api_tokens WHERE hash = $1`, hash))
+}
+
+func (s *sqlStore) ListAPITokens(ctx context.Context, userID int) ([]APIToken, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+apiTokenColumns+` FROM api_tokens WHERE user_id = $1 ORDER BY id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []APIToken{}
+	for rows.Next() {
+		t, err := scanAPIToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, t)
+	}
+	return list, rows.Err()
+}
+
+func (s *sqlStore) UpdateAPIToken(ctx context.Context, id int, fn func(t *APIToken) error) (APIToken, error) {
+	var token APIToken
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		token, err = scanAPIToken(tx.QueryRowContext(ctx, `SELECT `+apiTokenColumns+` FROM api_tokens WHERE id = $1`+s.forUpdate(), id))
+		if err != nil {
+			return err
+		}
+		if err := fn(&token); err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, `UPDATE api_tokens SET name = $1, scopes = $2, hint = $3, hash = $4,
+				expires_at = $5, last_used_at = $6
+			WHERE id = $7`,
+			token.Name, strings.Join(token.Scopes, ","), token.Hint, token.Hash, token.ExpiresAt, token.LastUsedAt, id)
+		return err
+	})
+	if err != nil {
+		return APIToken{}, err
+	}
+	return token, nil
+}
+
+func (s *sqlStore) DeleteAPIToken(ctx context.Context, id int) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM api_tokens WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+///////////////////
+// Room Webhooks //
+///////////////////
+
+const roomWebhookColumns = `h.id, r.workspace_id, h.room_id, r.name, h.url, h.batch, h.secret, h.created_by, h.created_at`
+
+func scanRoomWebhook(row rowScanner) (RoomWebhook, error) {
+	var h RoomWebhook
+	err := row.Scan(&h.ID, &h.WorkspaceID, &h.RoomID, &h.Room, &h.URL, &h.Batch, &h.Secret, &h.CreatedBy, &h.CreatedAt)
+	return h, notFound(err)
+}
+
+func (s *sqlStore) CreateRoomWebhook(ctx context.Context, hook RoomWebhook) (RoomWebhook, error) {
+	err := s.db.QueryRowContext(ctx, `INSERT INTO room_webhooks (room_id, url, batch, secret, created_by, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`,
+		hook.RoomID, hook.URL, hook.Batch, hook.Secret, hook.CreatedBy, hook.CreatedAt).Scan(&hook.ID)
+	if err != nil {
+		return RoomWebhook{}, err
+	}
+	return hook, nil
+}
+
+func (s *sqlStore) ListRoomWebhooks(ctx context.Context) ([]RoomWebhook, error) {
+	return queryAll(ctx, s.db, scanRoomWebhook, `SELECT `+roomWebhookColumns+`
+		FROM room_webhooks h JOIN rooms r ON r.id = h.room_id ORDER BY h.id`)
+}
+
+func (s *sqlStore) DeleteRoomWebhook(ctx context.Context, id int) error {
+	return s.deleteByID(ctx, "room_webhooks", id)
+}
+
+/////////////////
+// Automations //
+/////////////////
+
+const automationColumns = `id, workspace_id, name, enabled, trigger_spec, actions, secret, created_by, created_at`
+
+// storedAutomationAction is how an action is kept in the actions column,
+// with the room ID its JSON leaves out
+type storedAutomationAction struct {
+	AutomationAction
+	RoomID int `json:"roomId,omitempty"`
+}
+
+// encodeAutomation returns the text stored for an automation's trigger and
+// actions
+func encodeAutomation(a Automation) (trigger, actions string) {
+	stored := make([]storedAutomationAction, len(a.Actions))
+	for i, action := range a.Actions {
+		stored[i] = storedAutomationAction{AutomationAction: action, RoomID: action.RoomID}
+	}
+	t, _ := json.Marshal(a.Trigger)
+	b, _ := json.Marshal(stored)
+	return string(t), string(b)
+}
+
+func scanAutomation(row rowScanner) (Automation, error) {
+	var a Automation
+	var trigger, actions string
+	err := row.Scan(&a.ID, &a.WorkspaceID, &a.Name, &a.Enabled, &trigger, &actions, &a.Secret, &a.CreatedBy, &a.CreatedAt)
+	if err != nil {
+		return Automation{}, notFound(err)
+	}
+	var stored []storedAutomationAction
+	if err := json.Unmarshal([]byte(trigger), &a.Trigger); err != nil {
+		return Automation{}, fmt.Errorf("automation %d trigger: %w", a.ID, err)
+	}
+	if err := json.Unmarshal([]byte(actions), &stored); err != nil {
+		return Automation{}, fmt.Errorf("automation %d actions: %w", a.ID, err)
+	}
+	for _, action := range stored {
+		action.AutomationAction.RoomID = action.RoomID
+		a.Actions = append(a.Actions, action.AutomationAction)
+	}
+	return a, nil
+}
+
+func (s *sqlStore) CreateAutomation(ctx context.Context, a Automation) (Automation, error) {
+	trigger, actions := encodeAutomation(a)
+	err := s.db.QueryRowContext(ctx, `INSERT INTO automations (workspace_id, name, enabled, trigger_spec, actions, secret, created_by, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id`,
+		a.WorkspaceID, a.Name, a.Enabled, trigger, actions, a.Secret, a.CreatedBy, a.CreatedAt).Scan(&a.ID)
+	if err != nil {
+		return Automation{}, err
+	}
+	return a, nil
+}
+
+func (s *sqlStore) ListAutomations(ctx context.Context) ([]Automation, error) {
+	return queryAll(ctx, s.db, scanAutomation, `SELECT `+automationColumns+` FROM automations ORDER BY id`)
+}
+
+func (s *sqlStore) UpdateAutomation(ctx context.Context, a Automation) (Automation, error) {
+	trigger, actions := encodeAutomation(a)
+	return scanAutomation(s.db.QueryRowContext(ctx, `UPDATE automations SET name = $1, enabled = $2, trigger_spec = $3, actions = $4
+		WHERE id = $5 RETURNING `+automationColumns, a.Name, a.Enabled, trigger, actions, a.ID))
+}
+
+func (s *sqlStore) DeleteAutomation(ctx context.Context, id int) error {
+	return s.deleteByID(ctx, "automations", id)
+}
+
+////////////////////////
+// Scheduled Messages //
+////////////////////////
+
+const scheduledMessageColumns = `m.id, r.workspace_id, m.room_id, r.name, m.cron, m.timezone, m.message, m.created_by, m.next_run`
+
+func scanScheduledMessage(row rowScanner) (ScheduledMessage, error) {
+	var sm ScheduledMessage
+	err := row.Scan(&sm.ID, &sm.WorkspaceID, &sm.RoomID, &sm.Room, &sm.Cron, &sm.Timezone, &sm.Message, &sm.CreatedBy, &sm.NextRun)
+	return sm, notFound(err)
+}
+
+func (s *sqlStore) CreateScheduledMessage(ctx context.Context, sm ScheduledMessage) (ScheduledMessage, error) {
+	err := s.db.QueryRowContext(ctx, `INSERT INTO scheduled_messages (room_id, cron, timezone, message, created_by, next_run)
+		VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`,
+		sm.RoomID, sm.Cron, sm.Timezone, sm.Message, sm.CreatedBy, sm.NextRun).Scan(&sm.ID)
+	if err != nil {
+		return ScheduledMessage{}, err
+	}
+	return sm, nil
+}
+
+func (s *sqlStore) ListScheduledMessages(ctx context.Context) ([]ScheduledMessage, error) {
+	return queryAll(ctx, s.db, scanScheduledMessage, `SELECT `+scheduledMessageColumns+`
+		FROM scheduled_messages m JOIN rooms r ON r.id = m.room_id ORDER BY m.id`)
+}
+
+func (s *sqlStore) SetScheduledMessageRun(ctx context.Context, id int, next time.Time) error {
+	res, err := s.db.ExecContext(ctx, `UPDATE scheduled_messages SET next_run = $1 WHERE id = $2`, next, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (s *sqlStore) DeleteScheduledMessage(ctx context.Context, id int) error {
+	return s.deleteByID(ctx, "scheduled_messages", id)
+}
+
+/////////////////////////
+// Event Subscriptions //
+/////////////////////////
+
+const eventSubscriptionColumns = `id, workspace_id, user_id, room_id, event_types, filters, action, secret, created_by, created_at`
+
+func scanEventSubscription(row rowScanner) (EventSubscription, error) {
+	var sub EventSubscription
+	var eventTypes, filters, action string
+	err := row.Scan(&sub.ID, &sub.WorkspaceID, &sub.UserID, &sub.RoomID, &eventTypes, &filters, &action,
+		&sub.Secret, &sub.CreatedBy, &sub.CreatedAt)
+	if err != nil {
+		return EventSubscription{}, notFound(err)
+	}
+	sub.EventTypes = []string{}
+	if eventTypes != "" {
+		sub.EventTypes = strings.Split(eventTypes, ",")
+	}
+	if filters != "" {
+		if err := json.Unmarshal([]byte(filters), &sub.Filters); err != nil {
+			return EventSubscription{}, fmt.Errorf("subscription %d filters: %w", sub.ID, err)
+		}
+	}
+	if err := json.Unmarshal([]byte(action), &sub.Action); err != nil {
+		return EventSubscription{}, fmt.Errorf("subscription %d action: %w", sub.ID, err)
+	}
+	return sub, nil
+}
+
+// encodeEventSubscription returns the text stored for a subscription's
+// filters and action
+func encodeEventSubscription(sub EventSubscription) (filters, action string) {
+	if len(sub.Filters) > 0 {
+		b, _ := json.Marshal(sub.Filters)
+		filters = string(b)
+	}
+	b, _ := json.Marshal(sub.Action)
+	return filters, string(b)
+}
+
+func (s *sqlStore) CreateEventSubscription(ctx context.Context, sub EventSubscription) (EventSubscription, error) {
+	filters, action := encodeEventSubscription(sub)
+	err := s.db.QueryRowContext(ctx, `INSERT INTO event_subscriptions (workspace_id, user_id, room_id, event_types, filters, action,
+			secret, created_by, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id`,
+		sub.WorkspaceID, sub.UserID, sub.RoomID, strings.Join(sub.EventTypes, ","), filters, action,
+		sub.Secret, sub.CreatedBy, sub.CreatedAt).Scan(&sub.ID)
+	if err != nil {
+		return EventSubscription{}, err
+	}
+	return sub, nil
+}
+
+func (s *sqlStore) ListEventSubscriptions(ctx context.Context) ([]EventSubscription, error) {
+	return queryAll(ctx, s.db, scanEventSubscription, `SELECT `+eventSubscriptionColumns+` FROM event_subscriptions ORDER BY id`)
+}
+
+func (s *sqlStore) DeleteEventSubscription(ctx context.Context, id int) error {
+	return s.deleteByID(ctx, "event_subscriptions", id)
+}
+
+/////////////////
+// Attachments //
+/////////////////
+
+const storedAttachmentColumns = `id, name, size, user_id, workspace_id, created_at`
+
+func scanStoredAttachment(row rowScanner) (StoredAttachment, error) {
+	var a StoredAttachment
+	err := row.Scan(&a.ID, &a.Name, &a.Size, &a.UserID, &a.WorkspaceID, &a.CreatedAt)
+	return a, notFound(err)
+}
+
+func (s *sqlStore) CreateStoredAttachment(ctx context.Context, a StoredAttachment) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO stored_attachments (`+storedAttachmentColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6)`, a.ID, a.Name, a.Size, a.UserID, a.WorkspaceID, a.CreatedAt)
+	return err
+}
+
+func (s *sqlStore) StorageUsage(ctx context.Context) (map[int]int64, map[int]int64, error) {
+	byUser, err := s.sumBy(ctx, "user_id")
+	if err != nil {
+		return nil, nil, err
+	}
+	byWorkspace, err := s.sumBy(ctx, "workspace_id")
+	if err != nil {
+		return nil, nil, err
+	}
+	return byUser, byWorkspace, nil
+}
+
+// sumBy adds up the size of stored attachments grouped by a column
+func (s *sqlStore) sumBy(ctx context.Context, column string) (map[int]int64, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+column+`, SUM(size) FROM stored_attachments GROUP BY `+column)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sums := make(map[int]int64)
+	for rows.Next() {
+		var id int
+		var size int64
+		if err := rows.Scan(&id, &size); err != nil {
+			return nil, err
+		}
+		sums[id] = size
+	}
+	return sums, rows.Err()
+}
+
+///////////////////
+// Held Messages //
+///////////////////
+
+const heldMessageColumns = `id, workspace_id, room_id, user_id, origin, message, reason, held_at`
+
+func scanHeldMessage(row rowScanner) (HeldMessage, error) {
+	var m HeldMessage
+	var msg string
+	err := row.Scan(&m.ID, &m.WorkspaceID, &m.Message.RoomID, &m.Message.UserID, &m.Message.Origin, &msg, &m.Reason, &m.HeldAt)
+	if err != nil {
+		return HeldMessage{}, notFound(err)
+	}
+	// Message leaves its IDs out of the JSON, so they come from the columns
+	ids := m.Message
+	if err := json.Unmarshal([]byte(msg), &m.Message); err != nil {
+		return HeldMessage{}, fmt.Errorf("held message %d: %w", m.ID, err)
+	}
+	m.Message.RoomID, m.Message.UserID, m.Message.Origin = ids.RoomID, ids.UserID, ids.Origin
+	m.Message.WorkspaceID = m.WorkspaceID
+	return m, nil
+}
+
+func (s *sqlStore) CreateHeldMessage(ctx context.Context, m HeldMessage) (HeldMessage, error) {
+	msg, _ := json.Marshal(m.Message)
+	err := s.db.QueryRowContext(ctx, `INSERT INTO held_messages (workspace_id, room_id, user_id, origin, message, reason, held_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id`,
+		m.WorkspaceID, m.Message.RoomID, m.Message.UserID, m.Message.Origin, string(msg), m.Reason, m.HeldAt).Scan(&m.ID)
+	if err != nil {
+		return HeldMessage{}, err
+	}
+	return m, nil
+}
+
+func (s *sqlStore) ListHeldMessages(ctx context.Context, workspaceID int) ([]HeldMessage, error) {
+	return queryAll(ctx, s.db, scanHeldMessage, `SELECT `+heldMessageColumns+` FROM held_messages
+		WHERE workspace_id = $1 ORDER BY id`, workspaceID)
+}
+
+func (s *sqlStore) TakeHeldMessage(ctx context.Context, workspaceID, id int) (HeldMessage, error) {
+	return scanHeldMessage(s.db.QueryRowContext(ctx, `DELETE FROM held_messages WHERE id = $1 AND workspace_id = $2
+		RETURNING `+heldMessageColumns, id, workspaceID))
+}
+
+///////////////
+// Event Log //
+///////////////
+
+const eventColumns = `id, event_id, workspace_id, type, time, data`
+
+func scanEvent(row rowScanner) (LoggedEvent, error) {
+	var e LoggedEvent
+	var data string
+	err := row.Scan(&e.ID, &e.EventID, &e.WorkspaceID, &e.Type, &e.Time, &data)
+	e.Data = json.RawMessage(data)
+	return e, err
+}
+
+func (s *sqlStore) AppendEvents(ctx context.Context, events []LoggedEvent) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		stmt, err := tx.PrepareContext(ctx, `INSERT INTO events (event_id, workspace_id, type, time, data)
+			VALUES ($1, $2, $3, $4, $5)`)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+
+		for _, e := range events {
+			if _, err := stmt.ExecContext(ctx, e.EventID, e.WorkspaceID, e.Type, e.Time, string(e.Data)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *sqlStore) ListEvents(ctx context.Context, workspaceID int, afterID int64, types []string, limit int) ([]LoggedEvent, error) {
+	query := `SELECT ` + eventColumns + ` FROM events WHERE workspace_id = $1 AND id > $2`
+	args := []any{workspaceID, afterID}
+	if len(types) > 0 {
+		placeholders := make([]string, len(types))
+		for i, typ := range types {
+			args = append(args, typ)
+			placeholders[i] = fmt.Sprintf("$%d", len(args))
+		}
+		query += ` AND type IN (` + strings.Join(placeholders, ", ") + `)`
+	}
+	args = append(args, limit)
+	query += fmt.Sprintf(` ORDER BY id LIMIT $%d`, len(args))
+
+	list, err := queryAll(ctx, s.db, scanEvent, query, args...)
+	if list == nil {
+		list = []LoggedEvent{}
+	}
+	return list, err
+}
+
+func (s *sqlStore) OldestEventID(ctx context.Context) (int64, error) {
+	var id int64
+	err := s.db.QueryRowContext(ctx, `SELECT COALESCE(MIN(id), 0) FROM events`).Scan(&id)
+	return id, err
+}
+
+func (s *sqlStore) DeleteEventsBefore(ctx context.Context, t time.Time) (int, error) {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM events WHERE time < $1`, t)
+	if err != nil {
+		return 0, err
+	}
+	n, _ := res.RowsAffected()
+	return int(n), nil
+}
+
+func (s *sqlStore) UpdateEventData(ctx context.Context, id int64, data json.RawMessage) error {
+	res, err := s.db.ExecContext(ctx, `UPDATE events SET data = $1 WHERE id = $2`, string(data), id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+// deleteByID deletes a row of a table with an id column, or returns
+// errNotFound
+func (s *sqlStore) deleteByID(ctx context.Context, table string, id int) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM `+table+` WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+///////////////
+// Audit Log //
+///////////////
+
+const auditEventColumns = `id, time, action, actor, ip, target, details, on_behalf_of`
+
+func scanAuditEvent(row rowScanner) (AuditEvent, error) {
+	var e AuditEvent
+	err := row.Scan(&e.ID, &e.Time, &e.Action, &e.Actor, &e.IP, &e.Target, &e.Details, &e.OnBehalfOf)
+	return e, notFound(err)
+}
+
+func (s *sqlStore) AppendAuditEvent(ctx context.Context, e AuditEvent) (AuditEvent, error) {
+	err := s.db.QueryRowContext(ctx, `INSERT INTO audit_events (time, action, actor, ip, target, details, on_behalf_of)
+		VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id`,
+		e.Time, e.Action, e.Actor, e.IP, e.Target, e.Details, e.OnBehalfOf).Scan(&e.ID)
+	if err != nil {
+		return AuditEvent{}, err
+	}
+	return e, nil
+}
+
+func (s *sqlStore) ListAuditEvents(ctx context.Context, f AuditFilter) ([]AuditEvent, error) {
+	query := `SELECT ` + auditEventColumns + ` FROM audit_events WHERE id > $1`
+	args := []any{f.AfterID}
+	if f.Impersonated != "" {
+		args = append(args, f.Impersonated)
+		query += fmt.Sprintf(` AND (on_behalf_of = $%d OR (action = 'impersonation.start' AND target = $%d))`, len(args), len(args))
+	}
+	order := `id`
+	if f.Latest {
+		order = `id DESC`
+	}
+	query += ` ORDER BY ` + order
+	if f.Limit > 0 {
+		args = append(args, f.Limit)
+		query += fmt.Sprintf(` LIMIT $%d`, len(args))
+	}
+
+	list, err := queryAll(ctx, s.db, scanAuditEvent, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	if f.Latest {
+		slices.Reverse(list)
+	}
+	if list == nil {
+		list = []AuditEvent{}
+	}
+	return list, nil
+}
+
+func (s *sqlStore) DeleteAuditEventsBefore(ctx context.Context, t time.Time) (int, error) {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM audit_events WHERE time < $1`, t)
+	if err != nil {
+		return 0, err
+	}
+	n, _ := res.RowsAffected()
+	return int(n), nil
+}
+
+//////////////
+// Activity //
+//////////////
+
+const userActivityColumns = `a.user_id, a.username, a.messages, a.tasks_completed, a.streak, a.best_streak, a.last_day, a.achievements`
+
+func scanUserActivity(row rowScanner) (UserActivity, error) {
+	var a UserActivity
+	var achievements string
+	err := row.Scan(&a.UserID, &a.Username, &a.Messages, &a.TasksCompleted, &a.Streak, &a.BestStreak, &a.LastDay, &achievements)
+	if err != nil {
+		return UserActivity{}, notFound(err)
+	}
+	if achievements != "" {
+		a.Achievements = strings.Split(achievements, ",")
+	}
+	return a, nil
+}
+
+func (s *sqlStore) UpdateActivity(ctx context.Context, userID int, fn func(a *UserActivity)) (UserActivity, error) {
+	var a UserActivity
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		a, err = scanUserActivity(tx.QueryRowContext(ctx, `SELECT `+userActivityColumns+` FROM user_activity a WHERE a.user_id = $1`, userID))
+		if errors.Is(err, errNotFound) {
+			a, err = UserActivity{UserID: userID}, nil
+		}
+		if err != nil {
+			return err
+		}
+		rows, err := tx.QueryContext(ctx, `SELECT room_id, messages FROM room_activity WHERE user_id = $1`, userID)
+		if err != nil {
+			return err
+		}
+		before := make(map[int]int)
+		for rows.Next() {
+			var roomID, n int
+			if err := rows.Scan(&roomID, &n); err != nil {
+				rows.Close()
+				return err
+			}
+			before[roomID] = n
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		a.RoomMessages = maps.Clone(before)
+		fn(&a)
+
+		_, err = tx.ExecContext(ctx, `INSERT INTO user_activity (user_id, username, messages, tasks_completed, streak, best_streak, last_day, achievements)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+			ON CONFLICT (user_id) DO UPDATE SET username = excluded.username, messages = excluded.messages,
+				tasks_completed = excluded.tasks_completed, streak = excluded.streak, best_streak = excluded.best_streak,
+				last_day = excluded.last_day, achievements = excluded.achievements`,
+			a.UserID, a.Username, a.Messages, a.TasksCompleted, a.Streak, a.BestStreak, a.LastDay, strings.Join(a.Achievements, ","))
+		if err != nil {
+			return err
+		}
+		// Only the rooms whose count changed are written
+		for roomID, n := range a.RoomMessages {
+			if before[roomID] == n {
+				continue
+			}
+			_, err := tx.ExecContext(ctx, `INSERT INTO room_activity (user_id, room_id, messages) VALUES ($1, $2, $3)
+				ON CONFLICT (user_id, room_id) DO UPDATE SET messages = excluded.messages`, a.UserID, roomID, n)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return UserActivity{}, err
+	}
+	return a, nil
+}
+
+func (s *sqlStore) ListRoomActivity(ctx context.Context, roomID int) ([]UserActivity, error) {
+	list, err := queryAll(ctx, s.db, func(row rowScanner) (UserActivity, error) {
+		var a UserActivity
+		var achievements string
+		var n int
+		err := row.Scan(&a.UserID, &a.Username, &a.Messages, &a.TasksCompleted, &a.Streak, &a.BestStreak, &a.LastDay, &achievements, &n)
+		if achievements != "" {
+			a.Achievements = strings.Split(achievements, ",")
+		}
+		a.RoomMessages = map[int]int{roomID: n}
+		return a, err
+	}, `SELECT `+userActivityColumns+`, r.messages FROM user_activity a
+		JOIN room_activity r ON r.user_id = a.user_id WHERE r.room_id = $1 AND r.messages > 0`, roomID)
+	if list == nil {
+		list = []UserActivity{}
+	}
+	return list, err
+}
+
+//////////////////
+// Read Markers //
+//////////////////
+
+const readMarkerColumns = `r.name, m.message_id, m.updated_at, m.user_id, m.room_id, r.workspace_id`
+
+func scanReadMarker(row rowScanner) (ReadMarker, error) {
+	var m ReadMarker
+	err := row.Scan(&m.Room, &m.MessageID, &m.UpdatedAt, &m.UserID, &m.RoomID, &m.WorkspaceID)
+	return m, notFound(err)
+}
+
+func (s *sqlStore) SetReadMarker(ctx context.Context, m ReadMarker) (ReadMarker, error) {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO read_markers (user_id, room_id, message_id, updated_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, room_id) DO UPDATE SET message_id = excluded.message_id, updated_at = excluded.updated_at
+		WHERE read_markers.message_id < excluded.message_id`, m.UserID, m.RoomID, m.MessageID, m.UpdatedAt)
+	if err != nil {
+		return ReadMarker{}, err
+	}
+	return scanReadMarker(s.db.QueryRowContext(ctx, `SELECT `+readMarkerColumns+`
+		FROM read_markers m JOIN rooms r ON r.id = m.room_id WHERE m.user_id = $1 AND m.room_id = $2`, m.UserID, m.RoomID))
+}
+
+func (s *sqlStore) ListReadMarkers(ctx context.Context, userID, workspaceID int, since time.Time) ([]ReadMarker, error) {
+	list, err := queryAll(ctx, s.db, scanReadMarker, `SELECT `+readMarkerColumns+`
+		FROM read_markers m JOIN rooms r ON r.id = m.room_id
+		WHERE m.user_id = $1 AND r.workspace_id = $2 AND m.updated_at > $3 ORDER BY r.name`, userID, workspaceID, since)
+	if list == nil {
+		list = []ReadMarker{}
+	}
+	return list, err
+}
+
+//////////
+// Pins //
+//////////
+
+const pinColumns = `r.name, p.message, p.pinned_by, p.pinned_at, p.room_id, r.workspace_id`
+
+func scanPin(row rowScanner) (Pin, error) {
+	var p Pin
+	var msg string
+	err := row.Scan(&p.Room, &msg, &p.PinnedBy, &p.PinnedAt, &p.RoomID, &p.WorkspaceID)
+	if err != nil {
+		return Pin{}, notFound(err)
+	}
+	if err := json.Unmarshal([]byte(msg), &p.Message); err != nil {
+		return Pin{}, fmt.Errorf("pin in room %d: %w", p.RoomID, err)
+	}
+	// Message leaves its IDs out of the JSON
+	p.Message.RoomID, p.Message.WorkspaceID = p.RoomID, p.WorkspaceID
+	return p, nil
+}
+
+func (s *sqlStore) PinMessage(ctx context.Context, pin Pin) (Pin, error) {
+	msg, err := json.Marshal(pin.Message)
+	if err != nil {
+		return Pin{}, err
+	}
+	_, err = s.db.ExecContext(ctx, `INSERT INTO pins (room_id, message_id, message, pinned_by, pinned_at)
+		VALUES ($1, $2, $3, $4, $5) ON CONFLICT (room_id, message_id) DO NOTHING`,
+		pin.RoomID, pin.Message.ID, string(msg), pin.PinnedBy, pin.PinnedAt)
+	if err != nil {
+		return Pin{}, err
+	}
+	return scanPin(s.db.QueryRowContext(ctx, `SELECT `+pinColumns+` FROM pins p JOIN rooms r ON r.id = p.room_id
+		WHERE p.room_id = $1 AND p.message_id = $2`, pin.RoomID, pin.Message.ID))
+}
+
+func (s *sqlStore) UnpinMessage(ctx context.Context, roomID, messageID int) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM pins WHERE room_id = $1 AND message_id = $2`, roomID, messageID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (s *sqlStore) ListPins(ctx context.Context, workspaceID, roomID int) ([]Pin, error) {
+	list, err := queryAll(ctx, s.db, scanPin, `SELECT `+pinColumns+` FROM pins p JOIN rooms r ON r.id = p.room_id
+		WHERE r.workspace_id = $1 AND ($2 = 0 OR p.room_id = $2) ORDER BY p.pinned_at DESC, p.message_id DESC`,
+		workspaceID, roomID)
+	if list == nil {
+		list = []Pin{}
+	}
+	return list, err
+}
+
+//////////////////
+// Server state //
+//////////////////
+
+func (s *sqlStore) GetServerState(ctx context.Context, key string) (string, error) {
+	var value string
+	err := s.db.QueryRowContext(ctx, `SELECT value FROM server_state WHERE key = $1`, key).Scan(&value)
+	return value, notFound(err)
+}
+
+func (s *sqlStore) SetServerState(ctx context.Context, key, value string) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO server_state (key, value) VALUES ($1, $2)
+		ON CONFLICT (key) DO UPDATE SET value = excluded.value`, key, value)
+	return err
+}
+
+////////////
+// Backup //
+////////////
+
+// queryAll runs a query and scans every row
+func queryAll[T any](ctx context.Context, db queryer, scan func(rowScanner) (T, error), query string, args ...any) ([]T, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []T
+	for rows.Next() {
+		v, err := scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+	}
+	return list, rows.Err()
+}
+
+func (s *sqlStore) Snapshot(ctx context.Context) (*Snapshot, error) {
+	// A single transaction sees one consistent state of the database.
+	// Postgres needs repeatable read for that; SQLite always provides it.
+	var opts *sql.TxOptions
+	if s.dialect == "postgres" {
+		opts = &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true}
+	}
+	tx, err := s.db.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	snap := &Snapshot{}
+	snap.Users, err = queryAll(ctx, tx, scanUser, `SELECT `+userColumns+` FROM users ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	snap.Identities, err = queryAll(ctx, tx, func(row rowScanner) (Identity, error) {
+		var id Identity
+		return id, row.Scan(&id.Provider, &id.Subject, &id.UserID)
+	}, `SELECT provider, subject, user_id FROM identities`)
+	if err != nil {
+		return nil, err
+	}
+	snap.Workspaces, err = queryAll(ctx, tx, scanWorkspace, `SELECT `+workspaceColumns+` FROM workspaces ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	snap.Members, err = queryAll(ctx, tx, scanMember, `SELECT `+memberColumns+`
+		FROM workspace_members m JOIN users u ON u.id = m.user_id`)
+	if err != nil {
+		return nil, err
+	}
+	snap.Rooms, err = queryAll(ctx, tx, scanRoom, `SELECT `+roomColumns+` FROM rooms ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	snap.Projects, err = queryAll(ctx, tx, scanProject, `SELECT `+projectColumns+` FROM projects ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	snap.Tasks, err = queryAll(ctx, tx, scanTask, `SELECT `+taskColumns+` FROM tasks ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	snap.Messages, err = queryAll(ctx, tx, scanMessage, `SELECT `+messageColumns+`
+		FROM messages m JOIN rooms r ON r.id = m.room_id ORDER BY m.id`)
+	if err != nil {
+		return nil, err
+	}
+	snap.APITokens, err = queryAll(ctx, tx, scanAPIToken, `SELECT `+apiTokenColumns+` FROM api_tokens ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	snap.RoomWebhooks, err = queryAll(ctx, tx, scanRoomWebhook, `SELECT `+roomWebhookColumns+`
+		FROM room_webhooks h JOIN rooms r ON r.id = h.room_id ORDER BY h.id`)
+	if err != nil {
+		return nil, err
+	}
+	snap.Automations, err = queryAll(ctx, tx, scanAutomation, `SELECT `+automationColumns+` FROM automations ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	snap.EventSubscriptions, err = queryAll(ctx, tx, scanEventSubscription, `SELECT `+eventSubscriptionColumns+` FROM event_subscriptions ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	snap.ScheduledMessages, err = queryAll(ctx, tx, scanScheduledMessage, `SELECT `+scheduledMessageColumns+`
+		FROM scheduled_messages m JOIN rooms r ON r.id = m.room_id ORDER BY m.id`)
+	if err != nil {
+		return nil, err
+	}
+	snap.HeldMessages, err = queryAll(ctx, tx, scanHeldMessage, `SELECT `+heldMessageColumns+` FROM held_messages ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	snap.StoredAttachments, err = queryAll(ctx, tx, scanStoredAttachment, `SELECT `+storedAttachmentColumns+`
+		FROM stored_attachments ORDER BY created_at, id`)
+	if err != nil {
+		return nil, err
+	}
+	snap.Pins, err = queryAll(ctx, tx, scanPin, `SELECT `+pinColumns+` FROM pins p JOIN rooms r ON r.id = p.room_id
+		ORDER BY p.pinned_at, p.message_id`)
+	if err != nil {
+		return nil, err
+	}
+	snap.ReadMarkers, err = queryAll(ctx, tx, scanReadMarker, `SELECT `+readMarkerColumns+`
+		FROM read_markers m JOIN rooms r ON r.id = m.room_id ORDER BY m.user_id, m.room_id`)
+	if err != nil {
+		return nil, err
+	}
+	snap.TaskEvents, err = queryAll(ctx, tx, scanTaskEvent, `SELECT `+taskEventColumns+` FROM task_events ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	snap.TaskSnapshots, err = queryAll(ctx, tx, scanTaskSnapshot, `SELECT `+taskSnapshotColumns+` FROM task_snapshots
+		ORDER BY workspace_id, task_id, version`)
+	if err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+func (s *sqlStore) Restore(ctx context.Context, snap *Snapshot) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		var rows int
+		err := tx.QueryRowContext(ctx, `SELECT
+			(SELECT COUNT(*) FROM users) + (SELECT COUNT(*) FROM tasks) + (SELECT COUNT(*) FROM messages) +
+			(SELECT COUNT(*) FROM projects) + (SELECT COUNT(*) FROM task_events) +
+			(SELECT COUNT(*) FROM rooms) + (SELECT COUNT(*) FROM workspace_members) +
+			(SELECT COUNT(*) FROM workspaces WHERE slug <> $1)`, defaultWorkspaceSlug).Scan(&rows)
+		if err != nil {
+			return err
+		}
+		if rows > 0 {
+			return errStoreNotEmpty
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM workspaces`); err != nil {
+			return err
+		}
+
+		// Parents before children, so foreign keys are satisfied
+		for _, u := range snap.Users {
+			_, err := tx.ExecContext(ctx, `INSERT INTO users (id, username, email, email_verified, role, password_hash, created_at,
+					totp_enabled, totp_secret, totp_last_counter, recovery_codes, banned, do_not_disturb, snooze_until,
+					phone, sms_notifications, locale, token_generation)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18)`,
+				u.ID, u.Username, u.Email, u.EmailVerified, u.Role, u.PasswordHash, u.CreatedAt,
+				u.TOTPEnabled, u.TOTPSecret, u.TOTPLastCounter, strings.Join(u.RecoveryCodes, ","), u.Banned,
+				u.Preferences.DoNotDisturb, u.Preferences.SnoozeUntil, u.Phone, u.Preferences.SMSNotifications,
+				u.Preferences.Locale, u.TokenGeneration)
+			if err != nil {
+				return fmt.Errorf("user %d: %w", u.ID, err)
+			}
+		}
+		for _, t := range snap.APITokens {
+			_, err := tx.ExecContext(ctx, `INSERT INTO api_tokens (`+apiTokenColumns+`)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`, t.ID, t.UserID, t.Name, strings.Join(t.Scopes, ","),
+				t.Hint, t.Hash, t.CreatedAt, t.ExpiresAt, t.LastUsedAt, t.ImpersonatedBy)
+			if err != nil {
+				return fmt.Errorf("API token %d: %w", t.ID, err)
+			}
+		}
+		for _, id := range snap.Identities {
+			_, err := tx.ExecContext(ctx, `INSERT INTO identities (provider, subject, user_id) VALUES ($1, $2, $3)`,
+				id.Provider, id.Subject, id.UserID)
+			if err != nil {
+				return fmt.Errorf("identity %s:%s: %w", id.Provider, id.Subject, err)
+			}
+		}
+		for _, ws := range snap.Workspaces {
+			b := ws.Settings.Branding
+			_, err := tx.ExecContext(ctx, `INSERT INTO workspaces (id, slug, name, created_at, open_membership, anonymous_chat,
+					brand_name, brand_logo_url, brand_color, brand_support_email, welcome_banner, anonymize_departed)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`,
+				ws.ID, ws.Slug, ws.Name, ws.CreatedAt, ws.Settings.OpenMembership, ws.Settings.AnonymousChat,
+				b.Name, b.LogoURL, b.Color, b.SupportEmail, b.WelcomeBanner, ws.Settings.AnonymizeDeparted)
+			if err != nil {
+				return fmt.Errorf("workspace %s: %w", ws.Slug, err)
+			}
+		}
+		for _, m := range snap.Members {
+			_, err := tx.ExecContext(ctx, `INSERT INTO workspace_members (workspace_id, user_id, role, joined_at)
+				VALUES ($1, $2, $3, $4)`, m.WorkspaceID, m.UserID, m.Role, m.JoinedAt)
+			if err != nil {
+				return fmt.Errorf("member %d of workspace %d: %w", m.UserID, m.WorkspaceID, err)
+			}
+		}
+		for _, r := range snap.Rooms {
+			_, err := tx.ExecContext(ctx, `INSERT INTO rooms (`+roomColumns+`)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)`,
+				r.ID, r.WorkspaceID, r.Name, r.CreatedAt, r.SlowMode, r.Policy.MaxLength, r.Policy.NoLinks,
+				r.Policy.NoAttachments, strings.Join(r.Policy.ContentTypes, ","), strings.Join(r.Policy.LinkDomains, ","),
+				strings.Join(r.Policy.BlockedLinkDomains, ","), r.Policy.ReviewLinks,
+				r.Branding.LogoURL, r.Branding.Color, r.Branding.WelcomeBanner)
+			if err != nil {
+				return fmt.Errorf("room %d: %w", r.ID, err)
+			}
+		}
+		for _, p := range snap.Projects {
+			_, err := tx.ExecContext(ctx, `INSERT INTO projects (`+projectColumns+`)
+				VALUES ($1, $2, $3, $4, $5)`, p.ID, p.WorkspaceID, p.Name, p.CreatedAt, encodeWIPLimits(p.WIPLimits))
+			if err != nil {
+				return fmt.Errorf("project %d: %w", p.ID, err)
+			}
+		}
+		for _, t := range snap.Tasks {
+			_, err := tx.ExecContext(ctx, `INSERT INTO tasks (`+taskColumns+`)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)`, t.ID, t.WorkspaceID, t.Title, t.Description, t.Status,
+				t.Assignee, t.Priority, strings.Join(t.Tags, ","), t.DueDate, t.MergedInto,
+				t.ProjectID, t.CreatedAt, t.CompletedAt, t.ClaimExpiresAt)
+			if err != nil {
+				return fmt.Errorf("task %d: %w", t.ID, err)
+			}
+		}
+		for _, m := range snap.Messages {
+			var userID sql.NullInt64
+			if m.UserID != 0 {
+				userID = sql.NullInt64{Int64: int64(m.UserID), Valid: true}
+			}
+			_, err := tx.ExecContext(ctx, `INSERT INTO messages (id, room_id, user_id, username, content, created_at, attachments, client_msg_id)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`, m.ID, m.RoomID, userID, m.Username, m.Content, m.CreatedAt, encodeAttachments(m.Attachments), m.ClientMsgID)
+			if err != nil {
+				return fmt.Errorf("message %d: %w", m.ID, err)
+			}
+		}
+		for _, h := range snap.RoomWebhooks {
+			_, err := tx.ExecContext(ctx, `INSERT INTO room_webhooks (id, room_id, url, batch, secret, created_by, created_at)
+				VALUES ($1, $2, $3, $4, $5, $6, $7)`, h.ID, h.RoomID, h.URL, h.Batch, h.Secret, h.CreatedBy, h.CreatedAt)
+			if err != nil {
+				return fmt.Errorf("room webhook %d: %w", h.ID, err)
+			}
+		}
+		for _, a := range snap.Automations {
+			trigger, actions := encodeAutomation(a)
+			_, err := tx.ExecContext(ctx, `INSERT INTO automations (`+automationColumns+`)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+				a.ID, a.WorkspaceID, a.Name, a.Enabled, trigger, actions, a.Secret, a.CreatedBy, a.CreatedAt)
+			if err != nil {
+				return fmt.Errorf("automation %d: %w", a.ID, err)
+			}
+		}
+		for _, sub := range snap.EventSubscriptions {
+			filters, action := encodeEventSubscription(sub)
+			_, err := tx.ExecContext(ctx, `INSERT INTO event_subscriptions (`+eventSubscriptionColumns+`)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+				sub.ID, sub.WorkspaceID, sub.UserID, sub.RoomID, strings.Join(sub.EventTypes, ","), filters, action,
+				sub.Secret, sub.CreatedBy, sub.CreatedAt)
+			if err != nil {
+				return fmt.Errorf("event subscription %d: %w", sub.ID, err)
+			}
+		}
+		for _, sm := range snap.ScheduledMessages {
+			_, err := tx.ExecContext(ctx, `INSERT INTO scheduled_messages (id, room_id, cron, timezone, message, created_by, next_run)
+				VALUES ($1, $2, $3, $4, $5, $6, $7)`, sm.ID, sm.RoomID, sm.Cron, sm.Timezone, sm.Message, sm.CreatedBy, sm.NextRun)
+			if err != nil {
+				return fmt.Errorf("scheduled message %d: %w", sm.ID, err)
+			}
+		}
+		for _, m := range snap.HeldMessages {
+			msg, _ := json.Marshal(m.Message)
+			_, err := tx.ExecContext(ctx, `INSERT INTO held_messages (`+heldMessageColumns+`)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`, m.ID, m.WorkspaceID, m.Message.RoomID, m.Message.UserID,
+				m.Message.Origin, string(msg), m.Reason, m.HeldAt)
+			if err != nil {
+				return fmt.Errorf("held message %d: %w", m.ID, err)
+			}
+		}
+		for _, a := range snap.StoredAttachments {
+			_, err := tx.ExecContext(ctx, `INSERT INTO stored_attachments (`+storedAttachmentColumns+`)
+				VALUES ($1, $2, $3, $4, $5, $6)`, a.ID, a.Name, a.Size, a.UserID, a.WorkspaceID, a.CreatedAt)
+			if err != nil {
+				return fmt.Errorf("stored attachment %s: %w", a.ID, err)
+			}
+		}
+		for _, p := range snap.Pins {
+			msg, _ := json.Marshal(p.Message)
+			_, err := tx.ExecContext(ctx, `INSERT INTO pins (room_id, message_id, message, pinned_by, pinned_at)
+				VALUES ($1, $2, $3, $4, $5)`, p.RoomID, p.Message.ID, string(msg), p.PinnedBy, p.PinnedAt)
+			if err != nil {
+				return fmt.Errorf("pin of message %d: %w", p.Message.ID, err)
+			}
+		}
+		for _, m := range snap.ReadMarkers {
+			_, err := tx.ExecContext(ctx, `INSERT INTO read_markers (user_id, room_id, message_id, updated_at)
+				VALUES ($1, $2, $3, $4)`, m.UserID, m.RoomID, m.MessageID, m.UpdatedAt)
+			if err != nil {
+				return fmt.Errorf("read marker of user %d in room %d: %w", m.UserID, m.RoomID, err)
+			}
+		}
+		for _, e := range snap.TaskEvents {
+			fields, _ := json.Marshal(e.Fields)
+			previous, _ := json.Marshal(e.Previous)
+			_, err := tx.ExecContext(ctx, `INSERT INTO task_events (`+taskEventColumns+`)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+				e.ID, e.WorkspaceID, e.TaskID, e.Version, e.Type, string(fields), string(previous), e.By, e.At, e.MergedFrom)
+			if err != nil {
+				return fmt.Errorf("task event %d: %w", e.ID, err)
+			}
+		}
+		for _, ts := range snap.TaskSnapshots {
+			if err := insertTaskSnapshot(ctx, tx, ts); err != nil {
+				return fmt.Errorf("snapshot of task %d: %w", ts.TaskID, err)
+			}
+		}
+
+		// SQLite moves AUTOINCREMENT past explicit IDs by itself; Postgres
+		// identity sequences have to be moved by hand
+		if s.dialect == "postgres" {
+			for _, table := range []string{"users", "workspaces", "rooms", "projects", "tasks", "messages", "api_tokens",
+				"room_webhooks", "automations", "event_subscriptions", "scheduled_messages", "held_messages", "task_events"} {
+				_, err := tx.ExecContext(ctx, `SELECT setval(pg_get_serial_sequence('`+table+`', 'id'),
+					COALESCE((SELECT MAX(id) FROM `+table+`), 0) + 1, false)`)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
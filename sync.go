@@ -0,0 +1,184 @@
+package chat
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Task changes the delta sync journal keeps. Clients whose cursor is older
+// than the oldest of them get every task again.
+const syncJournalSize = 10000
+
+// SyncResponse is everything that changed in a workspace since a cursor,
+// for clients catching up after being offline
+type SyncResponse struct {
+	// Cursor to pass as ?since= next time
+	Cursor string `json:"cursor"`
+	// Messages posted since the cursor, oldest first, up to
+	// maxResumeMessages per room. The same message may come up in two
+	// syncs in a row, so clients should keep messages by ID.
+	Messages []Message `json:"messages"`
+	// Rooms that had more messages than were sent; the older ones are
+	// in the room's history
+	TruncatedRooms []string `json:"truncatedRooms,omitempty"`
+	// Tasks created or changed since the cursor, and the IDs of tasks
+	// deleted or merged away. With FullTasks, Tasks is every task in the
+	// workspace and replaces the client's list.
+	Tasks        []Task `json:"tasks"`
+	DeletedTasks []int  `json:"deletedTasks"`
+	FullTasks    bool   `json:"fullTasks"`
+	// Who is online now
+	Presence []PresenceEntry `json:"presence"`
+	// The user's read markers that moved since the cursor, so their
+	// other devices mark the same messages read
+	ReadMarkers []ReadMarker `json:"readMarkers"`
+}
+
+// syncChange is a task that changed, as recorded in the journal
+type syncChange struct {
+	at          time.Time
+	workspaceID int
+	taskID      int
+}
+
+var (
+	// Recent task changes, oldest first. The journal covers every change
+	// from syncJournalStart on.
+	syncJournal      []syncChange
+	syncJournalStart = time.Now().UTC()
+	syncJournalMu    sync.Mutex
+)
+
+// recordSyncChange adds the tasks an event changed to the journal
+func recordSyncChange(e Event) {
+	var ids []int
+	switch data := e.Data.(type) {
+	case Task:
+		if e.Type == eventTaskCreated {
+			ids = []int{data.ID}
+		}
+	case TaskUpdatedEvent:
+		ids = []int{data.ID}
+	case TaskCompletedEvent:
+		ids = []int{data.ID}
+	case TaskDeletedEvent:
+		ids = []int{data.ID}
+	case TaskMergedEvent:
+		ids = []int{data.ID, data.MergedID}
+	}
+	if len(ids) == 0 {
+		return
+	}
+
+	syncJournalMu.Lock()
+	defer syncJournalMu.Unlock()
+	for _, id := range ids {
+		syncJournal = append(syncJournal, syncChange{e.Time, e.WorkspaceID, id})
+	}
+	if len(syncJournal) > syncJournalSize {
+		// Drop the oldest quarter at once rather than one by one
+		drop := len(syncJournal) - syncJournalSize*3/4
+		syncJournalStart = syncJournal[drop-1].at
+		syncJournal = slices.Delete(syncJournal, 0, drop)
+	}
+}
+
+// changedTasks returns the IDs of the workspace's tasks changed after
+// since, or false when the journal doesn't reach back that far
+func changedTasks(workspaceID int, since time.Time) ([]int, bool) {
+	syncJournalMu.Lock()
+	defer syncJournalMu.Unlock()
+	if since.Before(syncJournalStart) {
+		return nil, false
+	}
+	var ids []int
+	for _, c := range syncJournal {
+		if c.workspaceID == workspaceID && c.at.After(since) && !slices.Contains(ids, c.taskID) {
+			ids = append(ids, c.taskID)
+		}
+	}
+	return ids, true
+}
+
+// Get what changed in the workspace since a cursor: messages, tasks and
+// presence, in one response (GET /sync?since=). Without a cursor it
+// returns the latest messages of each room and every task.
+func getSync(w http.ResponseWriter, r *http.Request) {
+	since, _, err := resumeSince(r)
+	if err != nil {
+		http.Error(w, "Invalid since", http.StatusBadRequest)
+		return
+	}
+	ws := requestWorkspace(r)
+	ctx := r.Context()
+
+	// Write out this node's queued messages so they are in the store.
+	// Other nodes may still have some queued, so in a cluster the cursor
+	// stays back by their flush interval.
+	messageQueue.Flush()
+	now := time.Now().UTC()
+	cursor := now
+	if cluster != nil {
+		cursor = now.Add(-messageQueue.cfg.FlushInterval)
+	}
+
+	rooms, err := store.ListRooms(ctx, ws.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp := SyncResponse{
+		Cursor:       cursor.Format(time.RFC3339Nano),
+		Messages:     []Message{},
+		Tasks:        []Task{},
+		DeletedTasks: []int{},
+	}
+	roomNames := make(map[int]string)
+	for _, room := range rooms {
+		roomNames[room.ID] = room.Name
+		msgs, err := missedMessages(ctx, room, since, now.Add(time.Microsecond))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(msgs) == maxResumeMessages {
+			resp.TruncatedRooms = append(resp.TruncatedRooms, room.Name)
+		}
+		resp.Messages = append(resp.Messages, msgs...)
+	}
+
+	tasks, err := taskService.List(ctx, ws)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// The journal only sees this node's changes, so in a cluster every
+	// task is sent
+	changed, ok := changedTasks(ws.ID, since)
+	if !ok || cluster != nil {
+		resp.Tasks, resp.FullTasks = tasks, true
+	} else {
+		for _, id := range changed {
+			i := slices.IndexFunc(tasks, func(t Task) bool { return t.ID == id })
+			if i < 0 {
+				resp.DeletedTasks = append(resp.DeletedTasks, id)
+			} else {
+				resp.Tasks = append(resp.Tasks, tasks[i])
+			}
+		}
+	}
+
+	resp.Presence = roomPresenceEntries(ctx, roomNames)
+	resp.ReadMarkers = []ReadMarker{}
+	if user, ok := currentUser(r); ok {
+		resp.ReadMarkers, err = store.ListReadMarkers(ctx, user.ID, ws.ID, since)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,190 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Tasks listed per page of the changes feed, by default and at most
+const (
+	taskChangesDefaultLimit = 100
+	taskChangesMaxLimit     = 1000
+)
+
+// TaskChangesResponse is a page of the tasks changed since a cursor
+type TaskChangesResponse struct {
+	// Cursor to pass as ?since= next time
+	Cursor string `json:"cursor"`
+	// Tasks created, changed, deleted or merged away since the cursor,
+	// in the order they first changed. A task that changed more than once
+	// is listed once, as it is now, and may come up again on the next
+	// page.
+	Changes []TaskChange `json:"changes"`
+	// More changes are waiting; ask again right away with the cursor
+	HasMore bool `json:"hasMore"`
+	// The cursor was missing or not one of this server's, so Changes is
+	// a page of every task in the workspace. Once the last page is in,
+	// the pages replace the integration's copy; tasks that change while
+	// they are listed come up again after them.
+	Full bool `json:"full"`
+}
+
+// TaskChange is a task as it is now, or a tombstone for one that's gone
+type TaskChange struct {
+	ID         int   `json:"id"`
+	Deleted    bool  `json:"deleted,omitempty"`
+	MergedInto int   `json:"mergedInto,omitempty"` // For tasks deleted by merging them into another
+	Task       *Task `json:"task,omitempty"`       // Unset for deleted tasks
+}
+
+// taskChangesCursor is a position in the changes feed: the ID of the last
+// task event a client has seen, and during a full listing the ID of the
+// last task it was sent
+type taskChangesCursor struct {
+	eventID int64
+	listing bool
+	taskID  int
+}
+
+// String formats a cursor as the event ID, followed by the task ID during
+// a listing
+func (c taskChangesCursor) String() string {
+	if c.listing {
+		return fmt.Sprintf("%d.%d", c.eventID, c.taskID)
+	}
+	return strconv.FormatInt(c.eventID, 10)
+}
+
+// parseTaskChangesCursor reads a cursor formatted by String
+func parseTaskChangesCursor(s string) (taskChangesCursor, bool) {
+	event, task, listing := strings.Cut(s, ".")
+	c := taskChangesCursor{listing: listing}
+	var err error
+	if c.eventID, err = strconv.ParseInt(event, 10, 64); err != nil || c.eventID < 0 {
+		return taskChangesCursor{}, false
+	}
+	if listing {
+		if c.taskID, err = strconv.Atoi(task); err != nil || c.taskID < 0 {
+			return taskChangesCursor{}, false
+		}
+	}
+	return c, true
+}
+
+// changedTaskIDs returns up to limit IDs of the workspace's tasks changed
+// after a task event, in the order they first changed, the ID of the last
+// event they cover and whether there are more
+func changedTaskIDs(ctx context.Context, workspaceID int, after int64, limit int) (ids []int, last int64, more bool, err error) {
+	last = after
+	seen := make(map[int]bool)
+pages:
+	for {
+		events, err := store.ListWorkspaceTaskEvents(ctx, workspaceID, after, limit)
+		if err != nil {
+			return nil, 0, false, err
+		}
+		for _, e := range events {
+			if !seen[e.TaskID] {
+				if len(ids) == limit {
+					more = true
+					break pages
+				}
+				seen[e.TaskID] = true
+				ids = append(ids, e.TaskID)
+			}
+			last = e.ID
+		}
+		if len(events) < limit {
+			break
+		}
+		after = events[len(events)-1].ID
+	}
+	return ids, last, more, nil
+}
+
+// Get the tasks changed since a cursor, with tombstones for deleted tasks,
+// for integrations keeping a copy of the workspace's tasks
+// (GET /tasks/changes?since=). The feed follows the stored task history,
+// so cursors outlive restarts and work on every node. Without a cursor
+// every task is listed. ?limit= caps the changes per page (default 100,
+// at most 1000), also while listing every task.
+func getTaskChanges(w http.ResponseWriter, r *http.Request) {
+	limit := taskChangesDefaultLimit
+	if l := r.URL.Query().Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 {
+			http.Error(w, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, taskChangesMaxLimit)
+	}
+	ws := requestWorkspace(r)
+	ctx := r.Context()
+	resp := TaskChangesResponse{Changes: []TaskChange{}}
+
+	cursor, ok := parseTaskChangesCursor(r.URL.Query().Get("since"))
+	if !ok || !cursor.listing {
+		latest, err := store.LastTaskEventID(ctx, ws.ID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// A cursor past the latest event is from another server, or from
+		// before a restore. Listing starts at the latest event, so changes
+		// made while listing come up again after it.
+		if !ok || cursor.eventID > latest {
+			cursor = taskChangesCursor{eventID: latest, listing: true}
+		}
+	}
+
+	if cursor.listing {
+		tasks, err := taskService.List(ctx, ws)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// Tasks are listed by ID
+		for _, task := range tasks {
+			if task.ID <= cursor.taskID {
+				continue
+			}
+			if len(resp.Changes) == limit {
+				resp.HasMore = true
+				break
+			}
+			resp.Changes = append(resp.Changes, TaskChange{ID: task.ID, Task: &task})
+			cursor.taskID = task.ID
+		}
+		cursor.listing = resp.HasMore
+		resp.Cursor, resp.Full = cursor.String(), true
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	ids, last, more, err := changedTaskIDs(ctx, ws.ID, cursor.eventID, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, id := range ids {
+		task, err := taskService.Get(ctx, ws, id)
+		switch {
+		case errors.Is(err, errNotFound):
+			resp.Changes = append(resp.Changes, TaskChange{ID: id, Deleted: true})
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		case task.MergedInto != 0:
+			resp.Changes = append(resp.Changes, TaskChange{ID: id, Deleted: true, MergedInto: task.MergedInto})
+		default:
+			resp.Changes = append(resp.Changes, TaskChange{ID: id, Task: &task})
+		}
+	}
+	resp.Cursor, resp.HasMore = taskChangesCursor{eventID: last}.String(), more
+	json.NewEncoder(w).Encode(resp)
+}
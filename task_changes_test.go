@@ -0,0 +1,107 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestTaskChanges(t *testing.T) {
+	ctx := context.Background()
+	mem := useMemoryStore(t)
+	ws := Workspace{ID: 1, Slug: "acme"}
+
+	fetch := func(t *testing.T, since string, limit int) TaskChangesResponse {
+		t.Helper()
+		query := url.Values{"since": {since}, "limit": {fmt.Sprint(limit)}}
+		r := httptest.NewRequest("GET", "/tasks/changes?"+query.Encode(), nil)
+		r = r.WithContext(context.WithValue(r.Context(), workspaceContextKey{}, ws))
+		w := httptest.NewRecorder()
+		getTaskChanges(w, r)
+		var resp TaskChangesResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("%v: %s", err, w.Body)
+		}
+		return resp
+	}
+	// changes lists the task ID of each change, marking tombstones
+	changes := func(resp TaskChangesResponse) string {
+		var list []string
+		for _, c := range resp.Changes {
+			if c.Deleted {
+				list = append(list, fmt.Sprint("-", c.ID))
+			} else {
+				list = append(list, fmt.Sprint(c.ID))
+			}
+		}
+		return fmt.Sprint(list)
+	}
+
+	var tasks []Task
+	for _, title := range []string{"a", "b", "c"} {
+		task, err := store.CreateTask(ctx, Task{WorkspaceID: ws.ID, Title: title, Status: "pending"}, "alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tasks = append(tasks, task)
+	}
+
+	// Every task, a page at a time
+	first := fetch(t, "", 2)
+	second := fetch(t, first.Cursor, 2)
+	if !first.Full || !first.HasMore || !second.Full || second.HasMore ||
+		changes(first) != fmt.Sprintf("[%d %d]", tasks[0].ID, tasks[1].ID) || changes(second) != fmt.Sprintf("[%d]", tasks[2].ID) {
+		t.Fatalf("listing %+v then %+v", first, second)
+	}
+	cursor := second.Cursor
+
+	b := tasks[1]
+	b.Title = "b2"
+	if _, err := store.UpdateTask(ctx, b, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeleteTask(ctx, ws.ID, tasks[0].ID, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	b.Title = "b3"
+	if _, err := store.UpdateTask(ctx, b, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	d, err := store.CreateTask(ctx, Task{WorkspaceID: ws.ID, Title: "d", Status: "pending"}, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each changed task once, as it is now
+	page := fetch(t, cursor, 2)
+	if page.Full || !page.HasMore || changes(page) != fmt.Sprintf("[%d -%d]", b.ID, tasks[0].ID) || page.Changes[0].Task.Title != "b3" {
+		t.Fatalf("first changes %+v", page)
+	}
+	page = fetch(t, page.Cursor, 2)
+	if page.Full || page.HasMore || changes(page) != fmt.Sprintf("[%d]", d.ID) {
+		t.Fatalf("second changes %+v", page)
+	}
+	cursor = page.Cursor
+
+	// The cursor outlives the server, as the history is stored
+	snap, err := mem.Snapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store = newMemoryStore()
+	if err := store.Restore(ctx, snap); err != nil {
+		t.Fatal(err)
+	}
+	if page := fetch(t, cursor, 2); page.Full || page.HasMore || len(page.Changes) != 0 || page.Cursor != cursor {
+		t.Errorf("after a restart %+v", page)
+	}
+
+	for _, since := range []string{"m2f1x3.12", "999", "-1", "1.x"} {
+		if page := fetch(t, since, 10); !page.Full || len(page.Changes) != 3 {
+			t.Errorf("cursor %s: %+v", since, page)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package chat
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Media types clients can ask for in the Accept header to get task
+// resources with links to related resources, for hypermedia tooling.
+// Anything else gets plain JSON.
+const (
+	mediaJSONAPI = "application/vnd.api+json"
+	mediaHAL     = "application/hal+json"
+)
+
+// taskFormat returns the hypermedia format the request accepts, if any,
+// going by the order of the Accept header. JSON:API doesn't allow media
+// type parameters.
+func taskFormat(r *http.Request) string {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case mediaJSONAPI:
+			if len(params) == 0 {
+				return mediaJSONAPI
+			}
+		case mediaHAL:
+			return mediaHAL
+		case "application/json", "application/*", "*/*":
+			return ""
+		}
+	}
+	return ""
+}
+
+// workspacePath is the path of a resource in the request's workspace
+func workspacePath(r *http.Request, path string) string {
+	if ws := requestWorkspace(r); ws.Slug != defaultWorkspaceSlug {
+		return "/w/" + ws.Slug + path
+	}
+	return path
+}
+
+// JSON:API documents (https://jsonapi.org/format/)
+
+type jsonAPIDocument struct {
+	Data  any               `json:"data"`
+	Links map[string]string `json:"links"`
+	Meta  map[string]any    `json:"meta,omitempty"`
+}
+
+type jsonAPIResource struct {
+	Type          string                         `json:"type"`
+	ID            string                         `json:"id"`
+	Attributes    any                            `json:"attributes"`
+	Relationships map[string]jsonAPIRelationship `json:"relationships,omitempty"`
+	Links         map[string]string              `json:"links"`
+}
+
+type jsonAPIRelationship struct {
+	Links map[string]string  `json:"links,omitempty"`
+	Data  *jsonAPIIdentifier `json:"data"` // Null when there is none
+}
+
+type jsonAPIIdentifier struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+// taskAttributes are the fields of a task that aren't its ID or
+// relationships
+type taskAttributes struct {
+	Title          string     `json:"title"`
+	Description    string     `json:"description"`
+	Status         string     `json:"status"`
+	Priority       string     `json:"priority,omitempty"`
+	Tags           []string   `json:"tags,omitempty"`
+	DueDate        *time.Time `json:"dueDate,omitempty"`
+	CreatedAt      time.Time  `json:"createdAt"`
+	CompletedAt    *time.Time `json:"completedAt,omitempty"`
+	ClaimExpiresAt *time.Time `json:"claimExpiresAt,omitempty"`
+}
+
+func jsonAPITask(r *http.Request, task Task) jsonAPIResource {
+	self := workspacePath(r, fmt.Sprintf("/tasks/%d", task.ID))
+	res := jsonAPIResource{
+		Type: "tasks",
+		ID:   strconv.Itoa(task.ID),
+		Attributes: taskAttributes{
+			Title:          task.Title,
+			Description:    task.Description,
+			Status:         task.Status,
+			Priority:       task.Priority,
+			Tags:           task.Tags,
+			DueDate:        task.DueDate,
+			CreatedAt:      task.CreatedAt,
+			CompletedAt:    task.CompletedAt,
+			ClaimExpiresAt: task.ClaimExpiresAt,
+		},
+		// Unset relationships are there with null data
+		Relationships: map[string]jsonAPIRelationship{"project": {}, "assignee": {}},
+		Links:         map[string]string{"self": self},
+	}
+	if task.ProjectID != 0 {
+		id := strconv.Itoa(task.ProjectID)
+		res.Relationships["project"] = jsonAPIRelationship{
+			Links: map[string]string{"related": workspacePath(r, "/projects/"+id)},
+			Data:  &jsonAPIIdentifier{Type: "projects", ID: id},
+		}
+	}
+	// Users have no resource of their own; they are known by username
+	if task.Assignee != "" {
+		res.Relationships["assignee"] = jsonAPIRelationship{Data: &jsonAPIIdentifier{Type: "users", ID: task.Assignee}}
+	}
+	if task.MergedInto != 0 {
+		id := strconv.Itoa(task.MergedInto)
+		res.Relationships["mergedInto"] = jsonAPIRelationship{
+			Links: map[string]string{"related": workspacePath(r, "/tasks/"+id)},
+			Data:  &jsonAPIIdentifier{Type: "tasks", ID: id},
+		}
+	}
+	return res
+}
+
+// HAL documents (https://datatracker.ietf.org/doc/html/draft-kelly-json-hal)
+
+type halLink struct {
+	Href string `json:"href"`
+}
+
+type halTask struct {
+	Task
+	Links map[string]halLink `json:"_links"`
+}
+
+type halTaskList struct {
+	Links    map[string]halLink   `json:"_links"`
+	Embedded map[string][]halTask `json:"_embedded"`
+	Count    int                  `json:"count"`
+}
+
+func halTaskResource(r *http.Request, task Task) halTask {
+	self := workspacePath(r, fmt.Sprintf("/tasks/%d", task.ID))
+	links := map[string]halLink{
+		"self":  {self},
+		"clone": {self + "/clone"},
+		"claim": {self + "/claim"},
+	}
+	if task.ProjectID != 0 {
+		links["project"] = halLink{workspacePath(r, fmt.Sprintf("/projects/%d", task.ProjectID))}
+	}
+	if task.MergedInto != 0 {
+		links["mergedInto"] = halLink{workspacePath(r, fmt.Sprintf("/tasks/%d", task.MergedInto))}
+	}
+	return halTask{Task: task, Links: links}
+}
+
+// writeTask writes a task in the format the request accepts
+func writeTask(w http.ResponseWriter, r *http.Request, status int, task Task) {
+	var v any = task
+	switch format := taskFormat(r); format {
+	case mediaJSONAPI:
+		res := jsonAPITask(r, task)
+		v = jsonAPIDocument{Data: res, Links: res.Links}
+		w.Header().Set("Content-Type", format)
+	case mediaHAL:
+		v = halTaskResource(r, task)
+		w.Header().Set("Content-Type", format)
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeTasks writes a list of tasks in the format the request accepts
+func writeTasks(w http.ResponseWriter, r *http.Request, tasks []Task) {
+	self := workspacePath(r, r.URL.RequestURI())
+	switch format := taskFormat(r); format {
+	case mediaJSONAPI:
+		data := make([]jsonAPIResource, len(tasks))
+		for i, task := range tasks {
+			data[i] = jsonAPITask(r, task)
+		}
+		w.Header().Set("Content-Type", format)
+		json.NewEncoder(w).Encode(jsonAPIDocument{
+			Data:  data,
+			Links: map[string]string{"self": self},
+			Meta:  map[string]any{"count": len(tasks)},
+		})
+	case mediaHAL:
+		embedded := make([]halTask, len(tasks))
+		for i, task := range tasks {
+			embedded[i] = halTaskResource(r, task)
+		}
+		w.Header().Set("Content-Type", format)
+		json.NewEncoder(w).Encode(halTaskList{
+			Links:    map[string]halLink{"self": {self}},
+			Embedded: map[string][]halTask{"tasks": embedded},
+			Count:    len(tasks),
+		})
+	default:
+		json.NewEncoder(w).Encode(tasks)
+	}
+}
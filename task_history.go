@@ -0,0 +1,313 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Task history is kept as a log of events per task, numbered by version
+// from 1. A task's state at any version is the latest snapshot at or
+// before it with the events after the snapshot applied. The tasks table
+// holds the current state of each task for listing and search. The store
+// writes a task and the event that leads to it in one transaction, so a
+// change that can't be added to the history fails.
+
+// Types of task history events
+const (
+	taskEventCreated      = "created"
+	taskEventFieldChanged = "field_changed"
+	taskEventCompleted    = "completed"
+	taskEventDeleted      = "deleted"
+	taskEventMerged       = "merged" // Another task was merged into this one
+)
+
+// A snapshot is taken every this many versions of a task, so rebuilding
+// a version never applies more events than that
+const taskSnapshotInterval = 20
+
+// TaskEvent is a change to a task. Fields holds the new values of the
+// fields that changed, by their JSON name, and Previous their old ones; a
+// null value means the field was unset.
+type TaskEvent struct {
+	ID          int64                      `json:"-"`
+	WorkspaceID int                        `json:"-"`
+	TaskID      int                        `json:"taskId"`
+	Version     int                        `json:"version"`
+	Type        string                     `json:"type"`
+	Fields      map[string]json.RawMessage `json:"fields,omitempty"`
+	Previous    map[string]json.RawMessage `json:"previous,omitempty"`
+	By          string                     `json:"by,omitempty"` // Empty when not logged in
+	At          time.Time                  `json:"at"`
+	// ID of the task merged in, for merged events
+	MergedFrom int `json:"mergedFrom,omitempty"`
+}
+
+// TaskSnapshot is the state of a task at a version. Version 0 is the
+// state of a task from before history was kept, when it first changed.
+type TaskSnapshot struct {
+	WorkspaceID int
+	TaskID      int
+	Version     int
+	Task        Task
+	Deleted     bool
+	At          time.Time
+}
+
+// TaskHistory is the response of GET /tasks/{id}/history. Events include
+// those of the tasks merged into the task, which carry their own taskId
+// and versions.
+type TaskHistory struct {
+	TaskID  int         `json:"taskId"`
+	Version int         `json:"version"` // Latest version
+	Events  []TaskEvent `json:"events"`
+}
+
+// TaskVersion is a task as it was at a version
+type TaskVersion struct {
+	Version int       `json:"version"`
+	At      time.Time `json:"at"`
+	Deleted bool      `json:"deleted"`
+	Task    *Task     `json:"task,omitempty"` // Unset for deleted tasks
+}
+
+// taskFields returns a task's fields by their JSON name. Unset fields
+// are left out.
+func taskFields(task Task) map[string]json.RawMessage {
+	b, _ := json.Marshal(task)
+	var fields map[string]json.RawMessage
+	json.Unmarshal(b, &fields)
+	return fields
+}
+
+// diffTasks returns the new and old values of the fields that differ
+func diffTasks(previous, task Task) (fields, old map[string]json.RawMessage) {
+	a, b := taskFields(previous), taskFields(task)
+	fields, old = make(map[string]json.RawMessage), make(map[string]json.RawMessage)
+	for name, value := range b {
+		if !bytes.Equal(a[name], value) {
+			fields[name], old[name] = value, orNull(a[name])
+		}
+	}
+	for name, value := range a {
+		if _, ok := b[name]; !ok {
+			fields[name], old[name] = json.RawMessage("null"), value
+		}
+	}
+	return fields, old
+}
+
+func orNull(v json.RawMessage) json.RawMessage {
+	if v == nil {
+		return json.RawMessage("null")
+	}
+	return v
+}
+
+// applyTaskFields sets fields of a task to the values of an event
+func applyTaskFields(task Task, fields map[string]json.RawMessage) Task {
+	current := taskFields(task)
+	for name, value := range fields {
+		if bytes.Equal(value, []byte("null")) {
+			delete(current, name)
+		} else {
+			current[name] = value
+		}
+	}
+	b, _ := json.Marshal(current)
+	var applied Task
+	json.Unmarshal(b, &applied)
+	applied.WorkspaceID = task.WorkspaceID
+	return applied
+}
+
+// taskAtVersion rebuilds a task as it was at a version, or at its latest
+// version when version is 0. It returns errNotFound when the task has no
+// history that far.
+func taskAtVersion(ctx context.Context, workspaceID, taskID, version int) (TaskSnapshot, error) {
+	upTo := version
+	if upTo == 0 {
+		upTo = math.MaxInt32
+	}
+	snap, err := store.GetTaskSnapshot(ctx, workspaceID, taskID, upTo)
+	fromCreation := errors.Is(err, errNotFound)
+	if fromCreation {
+		snap = TaskSnapshot{WorkspaceID: workspaceID, TaskID: taskID, Task: Task{WorkspaceID: workspaceID}}
+	} else if err != nil {
+		return TaskSnapshot{}, err
+	}
+	events, err := store.ListTaskEvents(ctx, workspaceID, taskID, snap.Version)
+	if err != nil {
+		return TaskSnapshot{}, err
+	}
+	if fromCreation && (len(events) == 0 || events[0].Type != taskEventCreated) {
+		return TaskSnapshot{}, errNotFound
+	}
+
+	for _, e := range events {
+		if e.Version > upTo {
+			break
+		}
+		snap.Version, snap.At = e.Version, e.At
+		if e.Type == taskEventDeleted {
+			snap.Deleted = true
+			continue
+		}
+		snap.Task = applyTaskFields(snap.Task, e.Fields)
+	}
+	if version != 0 && snap.Version != version {
+		return TaskSnapshot{}, errNotFound
+	}
+	return snap, nil
+}
+
+// taskChangeEvent returns the event of a write that took a task from
+// previous to task, or false when the write changed nothing. A previous
+// task without an ID makes it the task's created event, and mergedFrom
+// makes it a merged event. The store numbers it.
+func taskChangeEvent(previous, task Task, mergedFrom int, by string) (TaskEvent, bool) {
+	fields, old := diffTasks(previous, task)
+	if len(fields) == 0 && mergedFrom == 0 {
+		return TaskEvent{}, false
+	}
+	typ := taskEventFieldChanged
+	switch {
+	case previous.ID == 0:
+		typ, old = taskEventCreated, nil
+	case mergedFrom != 0:
+		typ = taskEventMerged
+	case task.Status == "completed" && previous.Status != "completed":
+		typ = taskEventCompleted
+	}
+	return TaskEvent{
+		WorkspaceID: task.WorkspaceID,
+		TaskID:      task.ID,
+		Type:        typ,
+		Fields:      fields,
+		Previous:    old,
+		By:          by,
+		At:          time.Now().UTC(),
+		MergedFrom:  mergedFrom,
+	}, true
+}
+
+// taskDeletedEvent returns the event that ends the history of a task
+func taskDeletedEvent(workspaceID, taskID int, by string) TaskEvent {
+	return TaskEvent{WorkspaceID: workspaceID, TaskID: taskID, Type: taskEventDeleted, By: by, At: time.Now().UTC()}
+}
+
+// taskEventSnapshots returns the snapshots to store with a numbered event
+// that took a task from previous to task. A task from before history was
+// kept starts its history with a snapshot of its state before the event,
+// and every taskSnapshotInterval versions the state after it is kept.
+func taskEventSnapshots(e TaskEvent, previous, task Task) []TaskSnapshot {
+	var snaps []TaskSnapshot
+	if e.Version == 1 && e.Type != taskEventCreated {
+		snaps = append(snaps, TaskSnapshot{WorkspaceID: e.WorkspaceID, TaskID: e.TaskID, Task: previous, At: e.At})
+	}
+	if e.Version%taskSnapshotInterval == 0 {
+		snaps = append(snaps, TaskSnapshot{
+			WorkspaceID: e.WorkspaceID,
+			TaskID:      e.TaskID,
+			Version:     e.Version,
+			Task:        task,
+			Deleted:     e.Type == taskEventDeleted,
+			At:          e.At,
+		})
+	}
+	return snaps
+}
+
+// withMergedHistory adds the history of the tasks merged into a task, and
+// of those merged into them, to the task's events, oldest first
+func withMergedHistory(ctx context.Context, workspaceID int, events []TaskEvent) ([]TaskEvent, error) {
+	all := events
+	for _, e := range events {
+		if e.Type != taskEventMerged {
+			continue
+		}
+		merged, err := store.ListTaskEvents(ctx, workspaceID, e.MergedFrom, 0)
+		if err != nil {
+			return nil, err
+		}
+		if merged, err = withMergedHistory(ctx, workspaceID, merged); err != nil {
+			return nil, err
+		}
+		all = append(all, merged...)
+	}
+	if len(all) > len(events) {
+		slices.SortStableFunc(all, func(a, b TaskEvent) int { return a.At.Compare(b.At) })
+	}
+	return all, nil
+}
+
+// Get the history of a task, oldest change first, also after it was
+// deleted (GET /tasks/{id}/history). It includes the history of the tasks
+// merged into it.
+func getTaskHistory(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid task ID", http.StatusBadRequest)
+		return
+	}
+	events, err := store.ListTaskEvents(r.Context(), requestWorkspace(r).ID, id, 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(events) == 0 {
+		if _, err := taskService.Get(r.Context(), requestWorkspace(r), id); err != nil {
+			writeTaskError(w, err)
+			return
+		}
+	}
+
+	history := TaskHistory{TaskID: id}
+	if n := len(events); n > 0 {
+		history.Version = events[n-1].Version
+	}
+	if history.Events, err = withMergedHistory(r.Context(), requestWorkspace(r).ID, events); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(history)
+}
+
+// Get a task as it was at a version of its history
+// (GET /tasks/{id}/history/{version})
+func getTaskVersion(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid task ID", http.StatusBadRequest)
+		return
+	}
+	version, err := strconv.Atoi(vars["version"])
+	if err != nil || version < 1 {
+		http.Error(w, "Invalid version", http.StatusBadRequest)
+		return
+	}
+
+	snap, err := taskAtVersion(r.Context(), requestWorkspace(r).ID, id, version)
+	if errors.Is(err, errNotFound) {
+		http.Error(w, "Version not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	v := TaskVersion{Version: snap.Version, At: snap.At, Deleted: snap.Deleted}
+	if !snap.Deleted {
+		v.Task = &snap.Task
+	}
+	json.NewEncoder(w).Encode(v)
+}
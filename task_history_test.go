@@ -0,0 +1,116 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestMergedHistory(t *testing.T) {
+	ctx := context.Background()
+	useMemoryStore(t)
+	ws := Workspace{ID: 1, Slug: "acme"}
+
+	var tasks [3]Task
+	for i := range tasks {
+		task, err := store.CreateTask(ctx, Task{WorkspaceID: ws.ID, Title: fmt.Sprint("task ", i), Status: "pending"}, "alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tasks[i] = task
+	}
+	// Task 2 goes into task 1, then task 1 into task 0
+	for _, merge := range [][2]int{{1, 2}, {0, 1}} {
+		task, other := tasks[merge[0]], tasks[merge[1]]
+		task.Tags = append(task.Tags, fmt.Sprint("from-", other.ID))
+		other.MergedInto = task.ID
+		if _, err := store.MergeTasks(ctx, task, other, "bob"); err != nil {
+			t.Fatal(err)
+		}
+		tasks[merge[0]], tasks[merge[1]] = task, other
+	}
+
+	tests := []struct {
+		task    int
+		version int
+		events  string // Task ID and type of each event
+	}{
+		{tasks[0].ID, 2, fmt.Sprintf("[%[1]d created %[2]d created %[3]d created %[2]d merged %[3]d field_changed %[1]d merged %[2]d field_changed]",
+			tasks[0].ID, tasks[1].ID, tasks[2].ID)},
+		{tasks[2].ID, 2, fmt.Sprintf("[%[1]d created %[1]d field_changed]", tasks[2].ID)},
+	}
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.task), func(t *testing.T) {
+			r := httptest.NewRequest("GET", fmt.Sprintf("/tasks/%d/history", tt.task), nil)
+			r = r.WithContext(context.WithValue(r.Context(), workspaceContextKey{}, ws))
+			r = mux.SetURLVars(r, map[string]string{"id": strconv.Itoa(tt.task)})
+			w := httptest.NewRecorder()
+			getTaskHistory(w, r)
+			var history TaskHistory
+			if err := json.NewDecoder(w.Body).Decode(&history); err != nil {
+				t.Fatal(err)
+			}
+			var events []string
+			for _, e := range history.Events {
+				events = append(events, fmt.Sprint(e.TaskID, " ", e.Type))
+			}
+			if fmt.Sprint(events) != tt.events || history.Version != tt.version {
+				t.Errorf("version %d, events %v, want version %d, events %s", history.Version, events, tt.version, tt.events)
+			}
+		})
+	}
+
+	_, _, err := taskService.Undo(ctx, ws, tasks[0].ID, time.Hour, TaskWriteOptions{By: "bob"})
+	if !errors.Is(err, errMergeUndo) {
+		t.Errorf("undoing the merge: %v", err)
+	}
+}
+
+// History goes into backups along with the tasks, deleted ones included
+func TestTaskHistoryBackup(t *testing.T) {
+	ctx := context.Background()
+	mem := newMemoryStore()
+	task, err := mem.CreateTask(ctx, Task{WorkspaceID: 1, Title: "Ship it", Status: "pending"}, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < taskSnapshotInterval; i++ {
+		task.Description = fmt.Sprint("Take ", i)
+		if task, err = mem.UpdateTask(ctx, task, "bob"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mem.DeleteTask(ctx, 1, task.ID, "bob"); err != nil {
+		t.Fatal(err)
+	}
+
+	snap, err := mem.Snapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := newMemoryStore()
+	if err := restored.Restore(ctx, snap); err != nil {
+		t.Fatal(err)
+	}
+	events, err := restored.ListTaskEvents(ctx, 1, task.ID, 0)
+	if err != nil || len(events) != taskSnapshotInterval+1 || events[len(events)-1].Type != taskEventDeleted {
+		t.Fatalf("restored %d events (%v)", len(events), err)
+	}
+	if s, err := restored.GetTaskSnapshot(ctx, 1, task.ID, taskSnapshotInterval); err != nil || s.Task.Description != task.Description {
+		t.Errorf("restored snapshot %+v (%v)", s, err)
+	}
+	// New events are numbered after the restored ones
+	if _, err := restored.CreateTask(ctx, Task{WorkspaceID: 1, Title: "Next", Status: "pending"}, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if s, _ := restored.Snapshot(ctx); s.TaskEvents[len(s.TaskEvents)-1].ID <= events[len(events)-1].ID {
+		t.Errorf("event IDs start over: %+v", s.TaskEvents)
+	}
+}
@@ -0,0 +1,202 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/analysis/analyzer/keyword"
+	"github.com/blevesearch/bleve/v2/analysis/analyzer/standard"
+	"github.com/blevesearch/bleve/v2/search/highlight/highlighter/html"
+	"github.com/blevesearch/bleve/v2/search/query"
+)
+
+const (
+	taskSearchDefaultLimit = 20
+	taskSearchMaxLimit     = 100
+)
+
+// Full-text index of the tasks of every workspace. It lives in memory, is
+// built from the store at startup and is updated on every task write.
+var taskIndex bleve.Index
+
+// TaskSearchHit is a task matching a search, with the matching parts of
+// its title and description marked up with <mark> tags
+type TaskSearchHit struct {
+	Task       Task                `json:"task"`
+	Score      float64             `json:"score"`
+	Highlights map[string][]string `json:"highlights,omitempty"`
+}
+
+// newTaskIndex creates the task index and fills it with the stored tasks
+func newTaskIndex(ctx context.Context) (bleve.Index, error) {
+	text := bleve.NewTextFieldMapping()
+	text.Analyzer = standard.Name
+	exact := bleve.NewTextFieldMapping()
+	exact.Analyzer = keyword.Name
+	exact.Store = false
+
+	doc := bleve.NewDocumentMapping()
+	doc.AddFieldMappingsAt("workspace", exact)
+	doc.AddFieldMappingsAt("title", text)
+	doc.AddFieldMappingsAt("description", text)
+	doc.AddFieldMappingsAt("tags", text)
+	mapping := bleve.NewIndexMapping()
+	mapping.DefaultMapping = doc
+
+	index, err := bleve.NewMemOnly(mapping)
+	if err != nil {
+		return nil, err
+	}
+	workspaces, err := store.ListWorkspaces(ctx)
+	if err != nil {
+		index.Close()
+		return nil, err
+	}
+	batch := index.NewBatch()
+	for _, ws := range workspaces {
+		tasks, err := store.ListTasks(ctx, ws.ID)
+		if err != nil {
+			index.Close()
+			return nil, err
+		}
+		for _, task := range tasks {
+			if err := batch.Index(taskDocumentID(task.WorkspaceID, task.ID), taskDocument(task)); err != nil {
+				index.Close()
+				return nil, err
+			}
+		}
+	}
+	if err := index.Batch(batch); err != nil {
+		index.Close()
+		return nil, err
+	}
+	return index, nil
+}
+
+// taskDocumentID is the ID of a task in the index, which holds every
+// workspace's tasks
+func taskDocumentID(workspaceID, id int) string {
+	return fmt.Sprintf("%d:%d", workspaceID, id)
+}
+
+// taskDocument is what the index stores of a task
+func taskDocument(task Task) map[string]any {
+	return map[string]any{
+		"workspace":   strconv.Itoa(task.WorkspaceID),
+		"title":       task.Title,
+		"description": task.Description,
+		"tags":        task.Tags,
+	}
+}
+
+// indexTask adds a new or changed task to the index. Merged tasks are
+// taken out of it.
+func indexTask(task Task) {
+	if task.MergedInto != 0 {
+		unindexTask(task.WorkspaceID, task.ID)
+		return
+	}
+	if err := taskIndex.Index(taskDocumentID(task.WorkspaceID, task.ID), taskDocument(task)); err != nil {
+		log.Printf("Task index error: %v", err)
+	}
+}
+
+// unindexTask takes a deleted task out of the index
+func unindexTask(workspaceID, id int) {
+	if err := taskIndex.Delete(taskDocumentID(workspaceID, id)); err != nil {
+		log.Printf("Task index error: %v", err)
+	}
+}
+
+// taskSearchQuery matches the tasks of a workspace that contain every word
+// of text, the last one also as the start of a word so results show up
+// while the user is still typing. Title matches rank highest.
+func taskSearchQuery(workspaceID int, text string) query.Query {
+	workspace := bleve.NewTermQuery(strconv.Itoa(workspaceID))
+	workspace.SetField("workspace")
+	conj := bleve.NewConjunctionQuery(workspace)
+
+	words := strings.Fields(text)
+	for i, word := range words {
+		title := bleve.NewMatchQuery(word)
+		title.SetField("title")
+		title.SetBoost(2)
+		description := bleve.NewMatchQuery(word)
+		description.SetField("description")
+		tags := bleve.NewMatchQuery(word)
+		tags.SetField("tags")
+		disj := bleve.NewDisjunctionQuery(title, description, tags)
+		if i == len(words)-1 {
+			for _, field := range []string{"title", "description"} {
+				prefix := bleve.NewPrefixQuery(strings.ToLower(word))
+				prefix.SetField(field)
+				disj.AddQuery(prefix)
+			}
+		}
+		conj.AddQuery(disj)
+	}
+	return conj
+}
+
+// Search the workspace's tasks by title, description and tags, best
+// matches first (GET /tasks/search?q=). ?limit= caps the results (default
+// 20, at most 100).
+func searchTasks(w http.ResponseWriter, r *http.Request) {
+	text := strings.TrimSpace(r.URL.Query().Get("q"))
+	if text == "" {
+		http.Error(w, "Missing search text (?q=)", http.StatusBadRequest)
+		return
+	}
+	limit := taskSearchDefaultLimit
+	if l := r.URL.Query().Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 {
+			http.Error(w, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, taskSearchMaxLimit)
+	}
+
+	ws := requestWorkspace(r)
+	req := bleve.NewSearchRequestOptions(taskSearchQuery(ws.ID, text), limit, 0, false)
+	req.Highlight = bleve.NewHighlightWithStyle(html.Name)
+	req.Highlight.AddField("title")
+	req.Highlight.AddField("description")
+	res, err := taskIndex.SearchInContext(r.Context(), req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	hits := []TaskSearchHit{}
+	for _, hit := range res.Hits {
+		_, idStr, _ := strings.Cut(hit.ID, ":")
+		id, _ := strconv.Atoi(idStr)
+		task, err := store.GetTask(r.Context(), ws.ID, id)
+		if errors.Is(err, errNotFound) {
+			continue
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// Fields are highlighted whether they matched or not
+		highlights := make(map[string][]string)
+		for field, fragments := range hit.Fragments {
+			for _, f := range fragments {
+				if strings.Contains(f, "<mark>") {
+					highlights[field] = append(highlights[field], f)
+				}
+			}
+		}
+		hits = append(hits, TaskSearchHit{Task: task, Score: hit.Score, Highlights: highlights})
+	}
+	json.NewEncoder(w).Encode(hits)
+}
@@ -0,0 +1,395 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// TaskService holds the task rules shared by every frontend: the REST API,
+// bridges such as MQTT, and importers. Its methods return errNotFound,
+// *ValidationError, *WIPLimitError, *MergedTaskError, errTaskClaimed,
+// errNothingToUndo or errUndoExpired for requests that can't be carried
+// out.
+type TaskService interface {
+	List(ctx context.Context, ws Workspace) ([]Task, error)
+	Get(ctx context.Context, ws Workspace, id int) (Task, error)
+	// Create stores a new task, which starts out pending unless it says
+	// otherwise. A zero CreatedAt is set to the current time.
+	Create(ctx context.Context, ws Workspace, task Task, opts TaskWriteOptions) (Task, error)
+	// Update overwrites the fields of a task that are set in changes, and
+	// returns the task before and after
+	Update(ctx context.Context, ws Workspace, id int, changes Task, opts TaskWriteOptions) (previous, task Task, err error)
+	Delete(ctx context.Context, ws Workspace, id int) error
+	Clone(ctx context.Context, ws Workspace, id int, clone CloneOptions, opts TaskWriteOptions) (Task, error)
+	// Merge merges the task otherID, and its history, into the task id,
+	// leaving otherID as a tombstone redirecting to it
+	Merge(ctx context.Context, ws Workspace, id, otherID int, opts TaskWriteOptions) (Task, error)
+	// Claim assigns an open task to username until ttl has passed
+	Claim(ctx context.Context, ws Workspace, id int, username string, ttl time.Duration) (Task, error)
+	// Undo reverts the latest change to a task if it was made within
+	// window, and returns the task and the change it reverted
+	Undo(ctx context.Context, ws Workspace, id int, window time.Duration, opts TaskWriteOptions) (Task, TaskEvent, error)
+}
+
+// TaskWriteOptions describe who is changing tasks and how
+type TaskWriteOptions struct {
+	By               string // Username recorded in events, empty when not logged in
+	OverrideWIPLimit bool   // Let tasks past their project's WIP limits
+}
+
+// ValidationError reports a request a service rejected because of its
+// input. The message is meant for the user.
+type ValidationError struct {
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Message
+}
+
+// MergedTaskError is returned when a task that was merged into another is
+// changed
+type MergedTaskError struct {
+	ID         int
+	MergedInto int
+}
+
+func (e *MergedTaskError) Error() string {
+	return fmt.Sprintf("Task %d was merged into task %d", e.ID, e.MergedInto)
+}
+
+var taskService TaskService = storeTaskService{}
+
+// storeTaskService is the TaskService backed by the configured store
+type storeTaskService struct{}
+
+func (storeTaskService) List(ctx context.Context, ws Workspace) ([]Task, error) {
+	return store.ListTasks(ctx, ws.ID)
+}
+
+func (storeTaskService) Get(ctx context.Context, ws Workspace, id int) (Task, error) {
+	return store.GetTask(ctx, ws.ID, id)
+}
+
+// open returns a task that hasn't been merged into another
+func (s storeTaskService) open(ctx context.Context, ws Workspace, id int) (Task, error) {
+	task, err := s.Get(ctx, ws, id)
+	if err != nil {
+		return Task{}, err
+	}
+	if task.MergedInto != 0 {
+		return Task{}, &MergedTaskError{ID: task.ID, MergedInto: task.MergedInto}
+	}
+	return task, nil
+}
+
+// checkWIPLimit checks the WIP limit of the status task moves into unless
+// the options override it
+func (opts TaskWriteOptions) checkWIPLimit(ctx context.Context, task Task) error {
+	if opts.OverrideWIPLimit {
+		return nil
+	}
+	return checkWIPLimit(ctx, task)
+}
+
+func (s storeTaskService) Create(ctx context.Context, ws Workspace, task Task, opts TaskWriteOptions) (Task, error) {
+	if task.Status == "" {
+		task.Status = "pending"
+	}
+	if err := checkTaskFields(ctx, ws, &task); err != nil {
+		return Task{}, &ValidationError{Message: err.Error()}
+	}
+
+	// Store the task in the workspace, which assigns its ID
+	task.WorkspaceID = ws.ID
+	if err := opts.checkWIPLimit(ctx, task); err != nil {
+		return Task{}, err
+	}
+	now := time.Now().UTC()
+	if task.CreatedAt.IsZero() {
+		task.CreatedAt = now
+	}
+	task.MergedInto = 0
+	task.ClaimExpiresAt = nil
+	stampCompletion(&task, now)
+	task, err := store.CreateTask(ctx, task, opts.By)
+	if err != nil {
+		return Task{}, err
+	}
+
+	indexTask(task)
+	publishEvent(task.WorkspaceID, eventTaskCreated, strconv.Itoa(task.ID), task)
+	return task, nil
+}
+
+func (s storeTaskService) Update(ctx context.Context, ws Workspace, id int, changes Task, opts TaskWriteOptions) (Task, Task, error) {
+	previous, err := s.open(ctx, ws, id)
+	if err != nil {
+		return Task{}, Task{}, err
+	}
+
+	// Only overwrite the fields that were sent
+	task := previous
+	if changes.Title != "" {
+		task.Title = changes.Title
+	}
+	if changes.Description != "" {
+		task.Description = changes.Description
+	}
+	if changes.Status != "" {
+		task.Status = changes.Status
+	}
+	if changes.Assignee != "" {
+		// Assigning a task outright ends any claim on it
+		task.Assignee = changes.Assignee
+		task.ClaimExpiresAt = nil
+	}
+	if changes.Priority != "" {
+		task.Priority = changes.Priority
+	}
+	if changes.Tags != nil {
+		task.Tags = changes.Tags
+	}
+	if changes.DueDate != nil {
+		task.DueDate = changes.DueDate
+	}
+	if changes.ProjectID != 0 {
+		task.ProjectID = changes.ProjectID
+	}
+	stampCompletion(&task, time.Now().UTC())
+	if task.Status == "completed" {
+		task.ClaimExpiresAt = nil
+	}
+	if err := checkTaskFields(ctx, ws, &task); err != nil {
+		return Task{}, Task{}, &ValidationError{Message: err.Error()}
+	}
+	if task.Status != previous.Status || task.ProjectID != previous.ProjectID {
+		if err := opts.checkWIPLimit(ctx, task); err != nil {
+			return Task{}, Task{}, err
+		}
+	}
+
+	task, err = store.UpdateTask(ctx, task, opts.By)
+	if err != nil {
+		return Task{}, Task{}, err
+	}
+
+	indexTask(task)
+	publishEvent(task.WorkspaceID, eventTaskUpdated, strconv.Itoa(task.ID), TaskUpdatedEvent{
+		Task:           task,
+		PreviousStatus: previous.Status,
+		PreviousTags:   previous.Tags,
+		UpdatedBy:      opts.By,
+	})
+	if previous.Status != "completed" && task.Status == "completed" {
+		publishEvent(task.WorkspaceID, eventTaskCompleted, strconv.Itoa(task.ID), TaskCompletedEvent{Task: task, CompletedBy: opts.By})
+	}
+	return previous, task, nil
+}
+
+func (storeTaskService) Delete(ctx context.Context, ws Workspace, id int) error {
+	if err := store.DeleteTask(ctx, ws.ID, id, ""); err != nil {
+		return err
+	}
+	unindexTask(ws.ID, id)
+	publishEvent(ws.ID, eventTaskDeleted, strconv.Itoa(id), TaskDeletedEvent{ID: id})
+	return nil
+}
+
+// Clone creates a copy of a task. The copy keeps the description,
+// priority, due date and project, and optionally the tags, but starts out
+// pending and unassigned.
+func (s storeTaskService) Clone(ctx context.Context, ws Workspace, id int, clone CloneOptions, opts TaskWriteOptions) (Task, error) {
+	task, err := s.open(ctx, ws, id)
+	if err != nil {
+		return Task{}, err
+	}
+
+	copied := Task{
+		Title:       task.Title,
+		Description: task.Description,
+		Status:      "pending",
+		Priority:    task.Priority,
+		DueDate:     task.DueDate,
+		ProjectID:   task.ProjectID,
+		CreatedAt:   time.Now().UTC(),
+		WorkspaceID: task.WorkspaceID,
+	}
+	if clone.Title != "" {
+		copied.Title = clone.Title
+	}
+	if clone.Tags {
+		copied.Tags = task.Tags
+	}
+	if err := opts.checkWIPLimit(ctx, copied); err != nil {
+		return Task{}, err
+	}
+
+	copied, err = store.CreateTask(ctx, copied, opts.By)
+	if err != nil {
+		return Task{}, err
+	}
+
+	indexTask(copied)
+	publishEvent(copied.WorkspaceID, eventTaskCreated, strconv.Itoa(copied.ID), copied)
+	return copied, nil
+}
+
+// Merge keeps the task's title and status, adds the other's description
+// and tags, and takes the higher priority and earlier due date. The task's
+// history gains a merged event, through which it shows the other's
+// history. Tasks have no comments, attachments or watchers to move.
+func (s storeTaskService) Merge(ctx context.Context, ws Workspace, id, otherID int, opts TaskWriteOptions) (Task, error) {
+	if id == otherID {
+		return Task{}, &ValidationError{Message: "Can't merge a task into itself"}
+	}
+	var tasks [2]Task
+	for i, id := range []int{id, otherID} {
+		var err error
+		tasks[i], err = s.open(ctx, ws, id)
+		if err != nil {
+			return Task{}, err
+		}
+	}
+	task, other := tasks[0], tasks[1]
+
+	if other.Description != "" {
+		if task.Description != "" {
+			task.Description += "\n\n"
+		}
+		task.Description += fmt.Sprintf("Merged from #%d %s:\n%s", other.ID, other.Title, other.Description)
+	}
+	task.Tags = append(slices.Clone(task.Tags), other.Tags...)
+	if task.Assignee == "" {
+		task.Assignee = other.Assignee
+	}
+	if slices.Index(taskPriorities, other.Priority) > slices.Index(taskPriorities, task.Priority) {
+		task.Priority = other.Priority
+	}
+	if other.DueDate != nil && (task.DueDate == nil || other.DueDate.Before(*task.DueDate)) {
+		task.DueDate = other.DueDate
+	}
+	// The other task's assignee may have left the workspace since
+	if err := checkTaskFields(ctx, ws, &task); err != nil {
+		task.Assignee = tasks[0].Assignee
+		if err := checkTaskFields(ctx, ws, &task); err != nil {
+			return Task{}, &ValidationError{Message: err.Error()}
+		}
+	}
+
+	other.MergedInto = task.ID
+	task, err := store.MergeTasks(ctx, task, other, opts.By)
+	if err != nil {
+		return Task{}, err
+	}
+	indexTask(task)
+	indexTask(other)
+
+	publishEvent(task.WorkspaceID, eventTaskMerged, strconv.Itoa(task.ID), TaskMergedEvent{
+		Task:     task,
+		MergedID: other.ID,
+		MergedBy: opts.By,
+	})
+	return task, nil
+}
+
+func (storeTaskService) Claim(ctx context.Context, ws Workspace, id int, username string, ttl time.Duration) (Task, error) {
+	if ttl <= 0 || ttl > maxClaimTTL {
+		return Task{}, &ValidationError{Message: fmt.Sprintf("ttl must be between 1 and %d seconds", int(maxClaimTTL.Seconds()))}
+	}
+	now := time.Now().UTC()
+	task, err := store.ClaimTask(ctx, ws.ID, id, username, now.Add(ttl), now)
+	if err != nil {
+		return Task{}, err
+	}
+
+	publishEvent(task.WorkspaceID, eventTaskUpdated, strconv.Itoa(task.ID), TaskUpdatedEvent{
+		Task:           task,
+		PreviousStatus: task.Status,
+		PreviousTags:   task.Tags,
+		UpdatedBy:      username,
+	})
+	return task, nil
+}
+
+func (s storeTaskService) Undo(ctx context.Context, ws Workspace, id int, window time.Duration, opts TaskWriteOptions) (Task, TaskEvent, error) {
+	previous, err := s.open(ctx, ws, id)
+	if err != nil {
+		return Task{}, TaskEvent{}, err
+	}
+	events, err := store.ListTaskEvents(ctx, ws.ID, id, 0)
+	if err != nil {
+		return Task{}, TaskEvent{}, err
+	}
+	// Creating a task isn't a change to it; delete the task instead
+	if len(events) == 0 || events[len(events)-1].Type == taskEventCreated {
+		return Task{}, TaskEvent{}, errNothingToUndo
+	}
+	undone := events[len(events)-1]
+	// Reverting the fields would leave the other task a tombstone
+	if undone.Type == taskEventMerged {
+		return Task{}, TaskEvent{}, errMergeUndo
+	}
+	if time.Since(undone.At) > window {
+		return Task{}, TaskEvent{}, errUndoExpired
+	}
+
+	task := applyTaskFields(previous, undone.Previous)
+	if err := checkTaskFields(ctx, ws, &task); err != nil {
+		return Task{}, TaskEvent{}, &ValidationError{Message: err.Error()}
+	}
+	if task.Status != previous.Status || task.ProjectID != previous.ProjectID {
+		if err := opts.checkWIPLimit(ctx, task); err != nil {
+			return Task{}, TaskEvent{}, err
+		}
+	}
+
+	// Undoing is a change of its own, so undoing again redoes the change
+	task, err = store.UpdateTask(ctx, task, opts.By)
+	if err != nil {
+		return Task{}, TaskEvent{}, err
+	}
+
+	indexTask(task)
+	publishEvent(task.WorkspaceID, eventTaskUpdated, strconv.Itoa(task.ID), TaskUpdatedEvent{
+		Task:           task,
+		PreviousStatus: previous.Status,
+		PreviousTags:   previous.Tags,
+		UpdatedBy:      opts.By,
+	})
+	if previous.Status != "completed" && task.Status == "completed" {
+		publishEvent(task.WorkspaceID, eventTaskCompleted, strconv.Itoa(task.ID), TaskCompletedEvent{Task: task, CompletedBy: opts.By})
+	}
+	return task, undone, nil
+}
+
+// writeTaskError writes the error response for an error from the task
+// service
+func writeTaskError(w http.ResponseWriter, err error) {
+	var (
+		invalid  *ValidationError
+		limitErr *WIPLimitError
+		merged   *MergedTaskError
+	)
+	switch {
+	case errors.Is(err, errNotFound):
+		http.Error(w, "Task not found", http.StatusNotFound)
+	case errors.Is(err, errTaskClaimed):
+		http.Error(w, "Task is completed or assigned to someone else", http.StatusConflict)
+	case errors.Is(err, errNothingToUndo), errors.Is(err, errUndoExpired), errors.Is(err, errMergeUndo):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, errWIPOverrideForbidden):
+		http.Error(w, "Only moderators can override WIP limits", http.StatusForbidden)
+	case errors.As(err, &invalid):
+		http.Error(w, invalid.Message, http.StatusBadRequest)
+	case errors.As(err, &limitErr), errors.As(err, &merged):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,80 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var (
+	errNothingToUndo = errors.New("Task has no change to undo")
+	errUndoExpired   = errors.New("The latest change to the task is too old to undo")
+	errMergeUndo     = errors.New("The latest change to the task is a merge, which can't be undone")
+)
+
+// How long after a change to a task it can be undone
+var taskUndoWindow = 5 * time.Minute
+
+// UndoRequest is the optional request body for undoing a change to a task.
+// Clients sending it for a slash command set Room to have a confirmation
+// posted there.
+type UndoRequest struct {
+	Room string `json:"room"`
+}
+
+// Undo the latest change to a task, if it was made within the undo window
+// (POST /tasks/{id}/undo)
+func undoTask(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid task ID", http.StatusBadRequest)
+		return
+	}
+
+	var req UndoRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	ws := requestWorkspace(r)
+	ctx := r.Context()
+	var room Room
+	if req.Room != "" {
+		if room, err = store.FindRoom(ctx, ws.ID, req.Room); err != nil {
+			http.Error(w, "No room called "+req.Room, http.StatusBadRequest)
+			return
+		}
+	}
+
+	var undone TaskEvent
+	task, err := overrideWIPLimit(r, func(opts TaskWriteOptions) (task Task, err error) {
+		task, undone, err = taskService.Undo(ctx, ws, id, taskUndoWindow, opts)
+		return task, err
+	})
+	if err != nil {
+		writeTaskError(w, err)
+		return
+	}
+
+	if req.Room != "" {
+		user, _ := currentUser(r)
+		fields := slices.Sorted(maps.Keys(undone.Fields))
+		text := fmt.Sprintf("%s undid the last change to task %d %q (%s)", user.Username, task.ID, task.Title, strings.Join(fields, ", "))
+		// The change is undone either way
+		if err := chatService.Announce(ctx, room, text); err != nil {
+			log.Printf("Confirming the undo of task %d: %v", task.ID, err)
+		}
+	}
+	writeTask(w, r, http.StatusOK, task)
+}
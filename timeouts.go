@@ -0,0 +1,48 @@
+package chat
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// TimeoutConfig bounds how long operations may run before they are
+// cancelled. Zero means no limit.
+type TimeoutConfig struct {
+	Request   time.Duration // An API request, including its store calls
+	Store     time.Duration // A store call made outside of a request, e.g. by a bridge
+	Webhook   time.Duration // Delivering a webhook, automation or event subscription
+	Broadcast time.Duration // Writing a chat message to one WebSocket client
+}
+
+var timeouts TimeoutConfig
+
+// requestTimeoutMiddleware cancels the request's context once it has run
+// for the request timeout, so store calls and outgoing requests made on
+// its behalf stop. WebSocket connections are long-lived and exempt.
+func requestTimeoutMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isChatPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx, cancel := withTimeout(r.Context(), timeouts.Request)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// withTimeout returns a context that is cancelled after timeout, unless
+// the timeout is zero
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// storeContext returns a context for store calls made outside of a
+// request, which gives up after the store timeout
+func storeContext() (context.Context, context.CancelFunc) {
+	return withTimeout(context.Background(), timeouts.Store)
+}
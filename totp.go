@@ -0,0 +1,458 @@
+package chat
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TOTP parameters (RFC 6238 defaults understood by all authenticator apps)
+const (
+	totpPeriod        = 30 * time.Second
+	totpDigits        = 6
+	totpSkew          = 1 // Accept codes one period before or after now
+	recoveryCodeCount = 10
+
+	// How long a password-verified login waits for its second factor
+	loginChallengeTTL         = 5 * time.Minute
+	loginChallengeMaxAttempts = 5
+)
+
+var (
+	// Issuer shown in authenticator apps, taken from the config at startup
+	totpIssuer = "Go Chat"
+
+	// Logins waiting for a second factor, keyed by ticket
+	loginChallenges   = make(map[string]loginChallenge)
+	loginChallengesMu sync.Mutex
+
+	totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+// loginChallenge is a login that passed the first factor
+type loginChallenge struct {
+	UserID    int
+	ExpiresAt time.Time
+	Attempts  int
+	SMSCode   smsCode // Set once a code has been texted as a fallback
+}
+
+// TwoFactorCode is the request body carrying a TOTP or recovery code
+type TwoFactorCode struct {
+	Ticket string `json:"ticket,omitempty"`
+	Code   string `json:"code"`
+}
+
+// generateTOTPSecret returns a random 160-bit secret in base32
+func generateTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// totpCode computes the code for a secret at the given time step
+func totpCode(secret []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation (RFC 4226 section 5.3)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// checkTOTP validates a code against the secret and returns the matched
+// time step. Steps at or before lastCounter are rejected so a code can't
+// be replayed.
+func checkTOTP(secret, code string, lastCounter uint64, now time.Time) (uint64, bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return 0, false
+	}
+	code = strings.ReplaceAll(code, " ", "")
+
+	current := uint64(now.Unix()) / uint64(totpPeriod/time.Second)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastCounter {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpProvisioningURI builds the otpauth:// URI that authenticator apps
+// import, usually rendered as a QR code by the client
+func totpProvisioningURI(username, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", totpIssuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(int(totpPeriod/time.Second)))
+
+	label := url.PathEscape(totpIssuer + ":" + username)
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+// generateRecoveryCodes returns fresh one-time codes and their hashes
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		raw := strings.ToLower(totpEncoding.EncodeToString(b))
+		codes[i] = raw[:4] + "-" + raw[4:]
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode normalizes and hashes a recovery code for storage
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// verifySecondFactor checks a TOTP or recovery code for the user and
+// records its use. Recovery codes are consumed.
+func verifySecondFactor(ctx context.Context, userID int, code string) bool {
+	_, err := store.UpdateUser(ctx, userID, func(u *User) error {
+		if !u.TOTPEnabled {
+			return errInvalidCredentials
+		}
+		if step, ok := checkTOTP(u.TOTPSecret, code, u.TOTPLastCounter, time.Now()); ok {
+			u.TOTPLastCounter = step
+			return nil
+		}
+		hash := hashRecoveryCode(code)
+		for j, h := range u.RecoveryCodes {
+			if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+				u.RecoveryCodes = append(u.RecoveryCodes[:j:j], u.RecoveryCodes[j+1:]...)
+				return nil
+			}
+		}
+		return errInvalidCredentials
+	})
+	return err == nil
+}
+
+// beginLogin starts a session for a user who passed the first factor. When
+// the user has 2FA enabled no session is created; instead a ticket is
+// returned that must be redeemed with a code at /auth/2fa.
+func beginLogin(w http.ResponseWriter, user User) (string, error) {
+	if !user.TOTPEnabled {
+		return "", startSession(w, user)
+	}
+
+	ticket, err := randomToken(24)
+	if err != nil {
+		return "", err
+	}
+
+	loginChallengesMu.Lock()
+	defer loginChallengesMu.Unlock()
+
+	now := time.Now()
+	for t, c := range loginChallenges {
+		if now.After(c.ExpiresAt) {
+			delete(loginChallenges, t)
+		}
+	}
+	loginChallenges[ticket] = loginChallenge{UserID: user.ID, ExpiresAt: now.Add(loginChallengeTTL)}
+	return ticket, nil
+}
+
+// writeTwoFactorChallenge tells the client that a second factor is needed
+func writeTwoFactorChallenge(w http.ResponseWriter, ticket string) {
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"twoFactorRequired": true,
+		"ticket":            ticket,
+	})
+}
+
+////////////////////////////////////////
+// Two-Factor Authentication Handlers //
+////////////////////////////////////////
+
+// Complete a login with a TOTP, recovery or texted code (POST /auth/2fa)
+func completeTwoFactorLogin(w http.ResponseWriter, r *http.Request) {
+	var req TwoFactorCode
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	loginChallengesMu.Lock()
+	challenge, ok := loginChallenges[req.Ticket]
+	if ok && time.Now().After(challenge.ExpiresAt) {
+		delete(loginChallenges, req.Ticket)
+		ok = false
+	}
+	if ok {
+		challenge.Attempts++
+		if challenge.Attempts >= loginChallengeMaxAttempts {
+			delete(loginChallenges, req.Ticket)
+		} else {
+			loginChallenges[req.Ticket] = challenge
+		}
+	}
+	loginChallengesMu.Unlock()
+
+	if !ok {
+		http.Error(w, "Login expired, please log in again", http.StatusUnauthorized)
+		return
+	}
+
+	// The user is loaded again, as they may have been banned since they
+	// gave their password
+	user, ok := findUserByID(r.Context(), challenge.UserID)
+	if !ok {
+		http.Error(w, "User not found", http.StatusUnauthorized)
+		return
+	}
+	if user.Banned {
+		loginChallengesMu.Lock()
+		delete(loginChallenges, req.Ticket)
+		loginChallengesMu.Unlock()
+		http.Error(w, "This account is banned", http.StatusForbidden)
+		return
+	}
+
+	// Guessing codes counts towards the same lockout as guessing passwords
+	if wait := checkLoginAllowed(r, user.Username); wait > 0 {
+		writeLockedOut(w, wait)
+		return
+	}
+	if challenge.SMSCode.check(req.Code) != nil && !verifySecondFactor(r.Context(), user.ID, req.Code) {
+		recordLoginFailure(r, user.Username)
+		http.Error(w, "Invalid two-factor code", http.StatusUnauthorized)
+		return
+	}
+
+	loginChallengesMu.Lock()
+	delete(loginChallenges, req.Ticket)
+	loginChallengesMu.Unlock()
+
+	recordLoginSuccess(user.Username)
+	if err := startSession(w, user); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeLoggedIn(w, http.StatusOK, user)
+}
+
+// Text a login code to the user's phone, for when their authenticator
+// isn't at hand (POST /auth/2fa/sms)
+func sendLoginCode(w http.ResponseWriter, r *http.Request) {
+	var req TwoFactorCode
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	loginChallengesMu.Lock()
+	challenge, ok := loginChallenges[req.Ticket]
+	loginChallengesMu.Unlock()
+	if !ok || time.Now().After(challenge.ExpiresAt) {
+		http.Error(w, "Login expired, please log in again", http.StatusUnauthorized)
+		return
+	}
+
+	user, ok := findUserByID(r.Context(), challenge.UserID)
+	if !ok {
+		http.Error(w, "User not found", http.StatusUnauthorized)
+		return
+	}
+	if user.Banned {
+		http.Error(w, "This account is banned", http.StatusForbidden)
+		return
+	}
+	if user.Phone == "" {
+		http.Error(w, "No phone number has been confirmed for this account", http.StatusBadRequest)
+		return
+	}
+
+	code, sent, err := newSMSCode(user.Phone)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = sendSMS(user, user.Phone, fmt.Sprintf("Your %s login code is %s", totpIssuer, code))
+	if errors.Is(err, errSMSRateLimited) {
+		http.Error(w, "Too many text messages, try again later", http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		log.Printf("Text message to user %d failed: %v", user.ID, err)
+		http.Error(w, "Couldn't send a text message", http.StatusBadGateway)
+		return
+	}
+
+	loginChallengesMu.Lock()
+	if challenge, ok := loginChallenges[req.Ticket]; ok {
+		challenge.SMSCode = sent
+		loginChallenges[req.Ticket] = challenge
+	}
+	loginChallengesMu.Unlock()
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"status": "code sent"})
+}
+
+// Start 2FA enrollment with a new secret (POST /me/2fa/enroll)
+func enrollTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, _ := currentUser(r)
+	if user.TOTPEnabled {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The secret only becomes active once a code from it is confirmed
+	if _, ok := updateUser(r.Context(), user.ID, func(u *User) { u.TOTPSecret = secret }); !ok {
+		http.Error(w, "Could not save the two-factor secret", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"secret":          secret,
+		"provisioningUri": totpProvisioningURI(user.Username, secret),
+	})
+}
+
+// Confirm enrollment with a code and enable 2FA (POST /me/2fa/confirm)
+func confirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, _ := currentUser(r)
+
+	var req TwoFactorCode
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if user.TOTPEnabled {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+	if user.TOTPSecret == "" {
+		http.Error(w, "Start enrollment first", http.StatusBadRequest)
+		return
+	}
+	step, valid := checkTOTP(user.TOTPSecret, req.Code, 0, time.Now())
+	if !valid {
+		http.Error(w, "Invalid two-factor code", http.StatusBadRequest)
+		return
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, ok := updateUser(r.Context(), user.ID, func(u *User) {
+		u.TOTPEnabled = true
+		u.TOTPLastCounter = step
+		u.RecoveryCodes = hashes
+	}); !ok {
+		http.Error(w, "Could not enable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	// Recovery codes are only ever shown here
+	json.NewEncoder(w).Encode(map[string][]string{"recoveryCodes": codes})
+}
+
+// Replace the recovery codes (POST /me/2fa/recovery-codes)
+func regenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	user, _ := currentUser(r)
+
+	var req TwoFactorCode
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !verifySecondFactor(r.Context(), user.ID, req.Code) {
+		http.Error(w, "Invalid two-factor code", http.StatusUnauthorized)
+		return
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, ok := updateUser(r.Context(), user.ID, func(u *User) { u.RecoveryCodes = hashes }); !ok {
+		http.Error(w, "Could not save the recovery codes", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string][]string{"recoveryCodes": codes})
+}
+
+// Turn off 2FA after checking a current code (POST /me/2fa/disable)
+func disableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, _ := currentUser(r)
+
+	var req TwoFactorCode
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !verifySecondFactor(r.Context(), user.ID, req.Code) {
+		http.Error(w, "Invalid two-factor code", http.StatusUnauthorized)
+		return
+	}
+
+	updated, ok := updateUser(r.Context(), user.ID, func(u *User) {
+		u.TOTPEnabled = false
+		u.TOTPSecret = ""
+		u.TOTPLastCounter = 0
+		u.RecoveryCodes = nil
+	})
+	if !ok {
+		http.Error(w, "Could not disable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(updated)
+}
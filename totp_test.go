@@ -0,0 +1,64 @@
+package chat
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCompleteTwoFactorLogin(t *testing.T) {
+	ctx := context.Background()
+	useMemoryStore(t)
+	prevSessions := sessions
+	sessions = newMemorySessionStore()
+	t.Cleanup(func() { sessions = prevSessions })
+
+	tests := []struct {
+		name    string
+		banned  bool // Banned between the password and the code
+		code    string
+		want    int
+		session bool
+	}{
+		{"valid code", false, "recovery-1", http.StatusOK, true},
+		{"wrong code", false, "recovery-9", http.StatusUnauthorized, false},
+		{"banned since the password", true, "recovery-1", http.StatusForbidden, false},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, err := store.CreateUser(ctx, User{
+				Username:      fmt.Sprintf("user%d", i),
+				TOTPEnabled:   true,
+				TOTPSecret:    "JBSWY3DPEHPK3PXP",
+				RecoveryCodes: []string{hashRecoveryCode("recovery-1")},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ticket, err := beginLogin(httptest.NewRecorder(), user)
+			if err != nil || ticket == "" {
+				t.Fatalf("no ticket: %v", err)
+			}
+			if tt.banned {
+				updateUser(ctx, user.ID, func(u *User) { u.Banned = true })
+			}
+
+			body := `{"ticket":"` + ticket + `","code":"` + tt.code + `"}`
+			w := httptest.NewRecorder()
+			completeTwoFactorLogin(w, httptest.NewRequest("POST", "/auth/2fa", strings.NewReader(body)))
+			if w.Code != tt.want {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			session := false
+			for _, c := range w.Result().Cookies() {
+				session = session || c.Name == sessionCookieName
+			}
+			if session != tt.session {
+				t.Errorf("session started: %v", session)
+			}
+		})
+	}
+}
@@ -0,0 +1,519 @@
+package chat
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// UploadConfig limits resumable uploads
+type UploadConfig struct {
+	MaxSize int64 // Largest file
+	// MaxPending is how many bytes of unfinished uploads each user may
+	// have open at once
+	MaxPending int64
+	Expiry     time.Duration // Unfinished uploads are deleted after this
+}
+
+// Version of the tus protocol (https://tus.io/protocols/resumable-upload)
+// the upload API speaks, and the extensions it supports
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,expiration,termination"
+)
+
+// How often expired uploads are deleted
+const uploadExpiryInterval = time.Hour
+
+// Directory under AttachmentConfig.Dir keeping unfinished uploads
+const uploadsDir = ".uploads"
+
+var (
+	uploadConfig UploadConfig
+
+	// Uploads a PATCH request is writing to, which other requests leave
+	// alone until it's done
+	busyUploads   = make(map[string]bool)
+	busyUploadsMu sync.Mutex
+)
+
+// Upload is a file sent in chunks over the tus protocol. Once every byte
+// arrived it's scanned and kept like any attachment, and Attachment can
+// be shared in a chat message.
+type Upload struct {
+	ID          string      `json:"id"`
+	Name        string      `json:"name"`
+	ContentType string      `json:"contentType"`
+	Length      int64       `json:"length"`
+	Offset      int64       `json:"offset"` // Bytes received so far
+	CreatedAt   time.Time   `json:"createdAt"`
+	ExpiresAt   time.Time   `json:"expiresAt"`
+	Attachment  *Attachment `json:"attachment,omitempty"` // Once complete
+}
+
+// storedUpload is how an upload is kept next to its data, with the owner
+// Upload leaves out of its JSON
+type storedUpload struct {
+	Upload
+	UserID      int `json:"userId"`
+	WorkspaceID int `json:"workspaceId"`
+}
+
+func (u Upload) complete() bool {
+	return u.Offset == u.Length
+}
+
+func uploadInfoPath(id string) string {
+	return filepath.Join(attachmentConfig.Dir, uploadsDir, id+".json")
+}
+
+func uploadDataPath(id string) string {
+	return filepath.Join(attachmentConfig.Dir, uploadsDir, id+".part")
+}
+
+// loadUpload reads an upload's state, or returns errNotFound
+func loadUpload(id string) (storedUpload, error) {
+	var up storedUpload
+	if strings.ContainsAny(id, `./\`) {
+		return up, errNotFound
+	}
+	data, err := os.ReadFile(uploadInfoPath(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return up, errNotFound
+	}
+	if err != nil {
+		return up, err
+	}
+	err = json.Unmarshal(data, &up)
+	return up, err
+}
+
+// saveUpload writes an upload's state, replacing the old one at once
+func saveUpload(up storedUpload) error {
+	data, err := json.Marshal(up)
+	if err != nil {
+		return err
+	}
+	tmp := uploadInfoPath(up.ID) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, uploadInfoPath(up.ID))
+}
+
+// removeUpload deletes an upload's state and data
+func removeUpload(id string) {
+	os.Remove(uploadDataPath(id))
+	os.Remove(uploadInfoPath(id))
+}
+
+// listUploads returns every upload's state
+func listUploads() ([]storedUpload, error) {
+	entries, err := os.ReadDir(filepath.Join(attachmentConfig.Dir, uploadsDir))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []storedUpload
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok {
+			continue
+		}
+		if up, err := loadUpload(id); err == nil {
+			list = append(list, up)
+		}
+	}
+	return list, nil
+}
+
+// pendingUploadBytes is the length of a user's unfinished uploads
+func pendingUploadBytes(userID int) (int64, error) {
+	list, err := listUploads()
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, up := range list {
+		if up.UserID == userID && !up.complete() {
+			total += up.Length
+		}
+	}
+	return total, nil
+}
+
+// runUploadExpiry deletes expired uploads every uploadExpiryInterval
+func runUploadExpiry() {
+	for now := range time.Tick(uploadExpiryInterval) {
+		if attachmentConfig.Dir == "" {
+			continue
+		}
+		if err := expireUploads(now); err != nil {
+			log.Printf("Listing uploads failed: %v", err)
+		}
+	}
+}
+
+// expireUploads deletes the uploads that expired by now, leaving those a
+// request is writing to for the next round
+func expireUploads(now time.Time) error {
+	list, err := listUploads()
+	if err != nil {
+		return err
+	}
+	for _, up := range list {
+		if now.After(up.ExpiresAt) && lockUpload(up.ID) {
+			removeUpload(up.ID)
+			unlockUpload(up.ID)
+		}
+	}
+	return nil
+}
+
+// lockUpload marks an upload busy, or reports that it already is
+func lockUpload(id string) bool {
+	busyUploadsMu.Lock()
+	defer busyUploadsMu.Unlock()
+	if busyUploads[id] {
+		return false
+	}
+	busyUploads[id] = true
+	return true
+}
+
+func unlockUpload(id string) {
+	busyUploadsMu.Lock()
+	defer busyUploadsMu.Unlock()
+	delete(busyUploads, id)
+}
+
+// parseUploadMetadata decodes an Upload-Metadata header, a comma-separated
+// list of keys each followed by its base64 value
+func parseUploadMetadata(header string) (map[string]string, error) {
+	meta := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, encoded, _ := strings.Cut(pair, " ")
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("metadata %q isn't base64", key)
+		}
+		meta[key] = string(value)
+	}
+	return meta, nil
+}
+
+// tusHeaders sets the headers every tus response carries
+func tusHeaders(w http.ResponseWriter) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+// uploadFromVars answers for requests that can't touch the upload named
+// in the route: without uploads enabled, a login and the upload belonging
+// to the user
+func uploadFromVars(w http.ResponseWriter, r *http.Request) (storedUpload, bool) {
+	tusHeaders(w)
+	if attachmentConfig.Dir == "" {
+		http.Error(w, "Uploads are not enabled", http.StatusNotFound)
+		return storedUpload{}, false
+	}
+	user, ok := currentUser(r)
+	if !ok {
+		http.Error(w, "Not logged in", http.StatusUnauthorized)
+		return storedUpload{}, false
+	}
+	up, err := loadUpload(mux.Vars(r)["id"])
+	if errors.Is(err, errNotFound) || (err == nil && (up.UserID != user.ID || up.WorkspaceID != requestWorkspace(r).ID)) {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return storedUpload{}, false
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return storedUpload{}, false
+	}
+	return up, true
+}
+
+/////////////////////////
+// Upload API Handlers //
+/////////////////////////
+
+// Describe the upload API to tus clients (OPTIONS /uploads)
+func describeUploads(w http.ResponseWriter, r *http.Request) {
+	tusHeaders(w)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	if uploadConfig.MaxSize > 0 {
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(uploadConfig.MaxSize, 10))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Start an upload; the filename and filetype go in Upload-Metadata
+// (POST /uploads)
+func createUpload(w http.ResponseWriter, r *http.Request) {
+	tusHeaders(w)
+	if attachmentConfig.Dir == "" {
+		http.Error(w, "Uploads are not enabled", http.StatusNotFound)
+		return
+	}
+	user, _ := currentUser(r)
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "Unsupported tus version", http.StatusPreconditionFailed)
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "Upload-Length must be the size of the file", http.StatusBadRequest)
+		return
+	}
+	if uploadConfig.MaxSize > 0 && length > uploadConfig.MaxSize {
+		http.Error(w, fmt.Sprintf("Files can be at most %d bytes", uploadConfig.MaxSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+	meta, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(meta["filename"]) == "" {
+		http.Error(w, "Upload-Metadata must include the filename", http.StatusBadRequest)
+		return
+	}
+	contentType := meta["filetype"]
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	pending, err := pendingUploadBytes(user.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if uploadConfig.MaxPending > 0 && pending+length > uploadConfig.MaxPending {
+		http.Error(w, fmt.Sprintf("Your unfinished uploads can add up to at most %d bytes; finish or delete some first",
+			uploadConfig.MaxPending), http.StatusRequestEntityTooLarge)
+		return
+	}
+	// Refused up front rather than once every byte arrived, counting the
+	// unfinished uploads too
+	err = checkStorageQuota(r.Context(), attachmentName(meta["filename"]), pending+length, user.ID, requestWorkspace(r).ID)
+	var overQuota *StorageQuotaExceeded
+	if errors.As(err, &overQuota) {
+		http.Error(w, overQuota.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	id, err := randomToken(16)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	now := time.Now().UTC()
+	up := storedUpload{
+		Upload: Upload{
+			ID:          id,
+			Name:        attachmentName(meta["filename"]),
+			ContentType: contentType,
+			Length:      length,
+			CreatedAt:   now,
+			ExpiresAt:   now.Add(uploadConfig.Expiry),
+		},
+		UserID:      user.ID,
+		WorkspaceID: requestWorkspace(r).ID,
+	}
+	err = os.MkdirAll(filepath.Join(attachmentConfig.Dir, uploadsDir), 0750)
+	if err == nil {
+		err = os.WriteFile(uploadDataPath(id), nil, 0640)
+	}
+	if err == nil {
+		err = saveUpload(up)
+	}
+	if err != nil {
+		removeUpload(id)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Relative to the request, which may be under a workspace prefix
+	w.Header().Set("Location", "uploads/"+id)
+	w.Header().Set("Upload-Expires", up.ExpiresAt.Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(up.Upload)
+}
+
+// Get how much of an upload arrived (HEAD /uploads/{id})
+func headUpload(w http.ResponseWriter, r *http.Request) {
+	up, ok := uploadFromVars(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(up.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(up.Length, 10))
+	w.Header().Set("Upload-Expires", up.ExpiresAt.Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+}
+
+// Get an upload, with its attachment once it's complete (GET /uploads/{id})
+func getUpload(w http.ResponseWriter, r *http.Request) {
+	up, ok := uploadFromVars(w, r)
+	if !ok {
+		return
+	}
+	json.NewEncoder(w).Encode(up.Upload)
+}
+
+// Send the next chunk of an upload, starting at Upload-Offset
+// (PATCH /uploads/{id})
+func patchUpload(w http.ResponseWriter, r *http.Request) {
+	up, ok := uploadFromVars(w, r)
+	if !ok {
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		http.Error(w, "Upload-Offset is required", http.StatusBadRequest)
+		return
+	}
+	if !lockUpload(up.ID) {
+		http.Error(w, "Another request is writing to this upload", http.StatusConflict)
+		return
+	}
+	defer unlockUpload(up.ID)
+
+	// Read again now that nothing else writes to it
+	if up, err = loadUpload(up.ID); err != nil {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	if up.Attachment != nil {
+		http.Error(w, "Upload is already complete", http.StatusConflict)
+		return
+	}
+	if offset != up.Offset {
+		http.Error(w, fmt.Sprintf("Upload-Offset must be %d", up.Offset), http.StatusConflict)
+		return
+	}
+
+	// A complete upload whose file couldn't be kept is finished again by
+	// a PATCH at its length, with no body
+	if !up.complete() {
+		f, err := os.OpenFile(uploadDataPath(up.ID), os.O_WRONLY|os.O_APPEND, 0640)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// Whatever arrived before the connection dropped counts, so the
+		// client resumes from there
+		n, copyErr := io.Copy(f, io.LimitReader(r.Body, up.Length-up.Offset))
+		if err := f.Close(); err != nil && copyErr == nil {
+			copyErr = err
+		}
+		up.Offset += n
+		if err := saveUpload(up); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if copyErr != nil {
+			http.Error(w, copyErr.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if up.complete() {
+		if !finishUpload(w, r, &up) {
+			return
+		}
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(up.Offset, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finishUpload keeps a complete upload as an attachment, answering for
+// files that are rejected or can't be kept. When keeping it fails for
+// another reason, the data stays so the client can finish it again.
+func finishUpload(w http.ResponseWriter, r *http.Request, up *storedUpload) bool {
+	data, err := os.Open(uploadDataPath(up.ID))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	user, _ := currentUser(r)
+	link, err := saveAttachment(r.Context(), attachmentUpload{
+		Name:        up.Name,
+		ContentType: up.ContentType,
+		Data:        data,
+		Uploader:    user,
+		Workspace:   requestWorkspace(r),
+	})
+	data.Close()
+	var rejected *AttachmentRejected
+	if errors.As(err, &rejected) {
+		removeUpload(up.ID)
+		http.Error(w, rejected.Error(), http.StatusUnprocessableEntity)
+		return false
+	}
+	var overQuota *StorageQuotaExceeded
+	if errors.As(err, &overQuota) {
+		removeUpload(up.ID)
+		http.Error(w, overQuota.Error(), http.StatusRequestEntityTooLarge)
+		return false
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+
+	// The state stays until it expires, so the client can look up the link
+	up.Attachment = &Attachment{Name: up.Name, URL: link, ContentType: up.ContentType}
+	if err := saveUpload(*up); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	os.Remove(uploadDataPath(up.ID))
+	return true
+}
+
+// Abandon an upload (DELETE /uploads/{id})
+func deleteUpload(w http.ResponseWriter, r *http.Request) {
+	up, ok := uploadFromVars(w, r)
+	if !ok {
+		return
+	}
+	if !lockUpload(up.ID) {
+		http.Error(w, "Another request is writing to this upload", http.StatusConflict)
+		return
+	}
+	defer unlockUpload(up.ID)
+	removeUpload(up.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,215 @@
+package chat
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// scannerFunc is an AttachmentScanner that runs a function
+type scannerFunc func(r io.Reader) (string, error)
+
+func (f scannerFunc) Scan(ctx context.Context, r io.Reader) (string, error) {
+	return f(r)
+}
+
+func TestUploads(t *testing.T) {
+	ctx := context.Background()
+	useMemoryStore(t)
+	prevAttachments, prevUploads, prevScanner := attachmentConfig, uploadConfig, attachmentScanner
+	attachmentConfig = AttachmentConfig{Dir: t.TempDir()}
+	uploadConfig = UploadConfig{MaxSize: 100, MaxPending: 150, Expiry: time.Hour}
+	t.Cleanup(func() { attachmentConfig, uploadConfig, attachmentScanner = prevAttachments, prevUploads, prevScanner })
+
+	ws, err := store.CreateWorkspace(ctx, Workspace{Slug: "acme", Name: "Acme"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, bob := User{ID: 1, Username: "alice"}, User{ID: 2, Username: "bob"}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/uploads", describeUploads).Methods("OPTIONS")
+	router.HandleFunc("/uploads", createUpload).Methods("POST")
+	router.HandleFunc("/uploads/{id}", headUpload).Methods("HEAD")
+	router.HandleFunc("/uploads/{id}", getUpload).Methods("GET")
+	router.HandleFunc("/uploads/{id}", patchUpload).Methods("PATCH")
+	router.HandleFunc("/uploads/{id}", deleteUpload).Methods("DELETE")
+	call := func(user User, method, target string, header map[string]string, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+		r = r.WithContext(context.WithValue(r.Context(), workspaceContextKey{}, ws))
+		r = r.WithContext(context.WithValue(r.Context(), userContextKey{}, user))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+	meta := func(name string) string {
+		return "filename " + base64.StdEncoding.EncodeToString([]byte(name)) + ",filetype " + base64.StdEncoding.EncodeToString([]byte("text/plain"))
+	}
+	create := func(t *testing.T, length string) string {
+		t.Helper()
+		w := call(alice, "POST", "/uploads", map[string]string{"Tus-Resumable": tusVersion, "Upload-Length": length, "Upload-Metadata": meta("notes.txt")}, "")
+		if w.Code != http.StatusCreated {
+			t.Fatalf("creating: %d %s", w.Code, w.Body)
+		}
+		var up Upload
+		if err := json.NewDecoder(w.Body).Decode(&up); err != nil {
+			t.Fatal(err)
+		}
+		if w.Header().Get("Location") != "uploads/"+up.ID || w.Header().Get("Upload-Expires") == "" {
+			t.Errorf("headers %v", w.Header())
+		}
+		return up.ID
+	}
+	patch := func(user User, id, offset, body string) *httptest.ResponseRecorder {
+		return call(user, "PATCH", "/uploads/"+id, map[string]string{"Content-Type": "application/offset+octet-stream", "Upload-Offset": offset}, body)
+	}
+
+	w := call(alice, "OPTIONS", "/uploads", nil, "")
+	if w.Code != http.StatusNoContent || w.Header().Get("Tus-Version") != tusVersion || w.Header().Get("Tus-Max-Size") != "100" ||
+		w.Header().Get("Tus-Extension") != tusExtensions {
+		t.Errorf("options %d %v", w.Code, w.Header())
+	}
+
+	refused := []struct {
+		name   string
+		header map[string]string
+		code   int
+	}{
+		{"old protocol", map[string]string{"Tus-Resumable": "0.2.2", "Upload-Length": "10", "Upload-Metadata": meta("a.txt")}, http.StatusPreconditionFailed},
+		{"no length", map[string]string{"Tus-Resumable": tusVersion, "Upload-Metadata": meta("a.txt")}, http.StatusBadRequest},
+		{"too big", map[string]string{"Tus-Resumable": tusVersion, "Upload-Length": "101", "Upload-Metadata": meta("a.txt")}, http.StatusRequestEntityTooLarge},
+		{"no filename", map[string]string{"Tus-Resumable": tusVersion, "Upload-Length": "10", "Upload-Metadata": meta(" ")}, http.StatusBadRequest},
+		{"bad metadata", map[string]string{"Tus-Resumable": tusVersion, "Upload-Length": "10", "Upload-Metadata": "filename a.txt"}, http.StatusBadRequest},
+	}
+	for _, tt := range refused {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := call(alice, "POST", "/uploads", tt.header, ""); w.Code != tt.code {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.code, w.Body)
+			}
+		})
+	}
+
+	// Unfinished uploads count against the user's allowance until they
+	// finish or are deleted
+	id := create(t, "10")
+	big := create(t, "100")
+	if w := call(alice, "POST", "/uploads", map[string]string{"Tus-Resumable": tusVersion, "Upload-Length": "50", "Upload-Metadata": meta("more.txt")}, ""); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("over the allowance: %d %s", w.Code, w.Body)
+	}
+	if w := call(alice, "DELETE", "/uploads/"+big, nil, ""); w.Code != http.StatusNoContent {
+		t.Errorf("deleting: %d %s", w.Code, w.Body)
+	}
+	if w := call(alice, "HEAD", "/uploads/"+big, nil, ""); w.Code != http.StatusNotFound {
+		t.Errorf("deleted upload: %d", w.Code)
+	}
+
+	// Chunks have to continue where the upload stands
+	if w := call(bob, "HEAD", "/uploads/"+id, nil, ""); w.Code != http.StatusNotFound {
+		t.Errorf("someone else's upload: %d", w.Code)
+	}
+	chunks := []struct {
+		name   string
+		user   User
+		ctype  string
+		offset string
+		body   string
+		code   int
+		after  string // Upload-Offset after the request
+	}{
+		{"someone else's", bob, "application/offset+octet-stream", "0", "01234", http.StatusNotFound, "0"},
+		{"not a chunk", alice, "text/plain", "0", "01234", http.StatusUnsupportedMediaType, "0"},
+		{"no offset", alice, "application/offset+octet-stream", "", "01234", http.StatusBadRequest, "0"},
+		{"wrong offset", alice, "application/offset+octet-stream", "3", "01234", http.StatusConflict, "0"},
+		{"first", alice, "application/offset+octet-stream", "0", "01234", http.StatusNoContent, "5"},
+		{"again", alice, "application/offset+octet-stream", "0", "01234", http.StatusConflict, "5"},
+	}
+	for _, tt := range chunks {
+		t.Run(tt.name, func(t *testing.T) {
+			w := call(tt.user, "PATCH", "/uploads/"+id, map[string]string{"Content-Type": tt.ctype, "Upload-Offset": tt.offset}, tt.body)
+			if w.Code != tt.code {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.code, w.Body)
+			}
+			w = call(alice, "HEAD", "/uploads/"+id, nil, "")
+			if w.Header().Get("Upload-Offset") != tt.after || w.Header().Get("Upload-Length") != "10" {
+				t.Errorf("offset %s of %s, want %s", w.Header().Get("Upload-Offset"), w.Header().Get("Upload-Length"), tt.after)
+			}
+		})
+	}
+
+	// Requests wait their turn
+	lockUpload(id)
+	if w := patch(alice, id, "5", "56789"); w.Code != http.StatusConflict {
+		t.Errorf("writing to a busy upload: %d", w.Code)
+	}
+	unlockUpload(id)
+
+	// A finish that fails keeps the data, for the client to finish again
+	attachmentScanner = scannerFunc(func(io.Reader) (string, error) { return "", errors.New("clamd is down") })
+	if w := patch(alice, id, "5", "56789 and more"); w.Code != http.StatusInternalServerError {
+		t.Errorf("finishing without a scanner: %d %s", w.Code, w.Body)
+	}
+	attachmentScanner = nil
+	w = patch(alice, id, "10", "")
+	if w.Code != http.StatusNoContent || w.Header().Get("Upload-Offset") != "10" {
+		t.Errorf("finishing again: %d %s", w.Code, w.Body)
+	}
+	var up Upload
+	if err := json.NewDecoder(call(alice, "GET", "/uploads/"+id, nil, "").Body).Decode(&up); err != nil {
+		t.Fatal(err)
+	}
+	if up.Attachment == nil || !strings.HasSuffix(up.Attachment.URL, "/notes.txt") || up.Attachment.ContentType != "text/plain" {
+		t.Fatalf("upload %+v", up)
+	}
+	attachmentID := path.Base(path.Dir(up.Attachment.URL))
+	if data, err := os.ReadFile(filepath.Join(attachmentConfig.Dir, attachmentID, "notes.txt")); err != nil || string(data) != "0123456789" {
+		t.Errorf("attachment %q, %v", data, err)
+	}
+	if byUser, _, err := store.StorageUsage(ctx); err != nil || byUser[alice.ID] != 10 {
+		t.Errorf("storage %v, %v", byUser, err)
+	}
+	if _, err := os.Stat(uploadDataPath(id)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("upload data kept: %v", err)
+	}
+	if w := patch(alice, id, "10", ""); w.Code != http.StatusConflict {
+		t.Errorf("finishing twice: %d", w.Code)
+	}
+
+	// Files the scanner flags are dropped
+	infected := create(t, "4")
+	attachmentScanner = scannerFunc(func(io.Reader) (string, error) { return "Eicar-Test-Signature", nil })
+	if w := patch(alice, infected, "0", "X5O!"); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("infected upload: %d %s", w.Code, w.Body)
+	}
+	attachmentScanner = nil
+	if w := call(alice, "HEAD", "/uploads/"+infected, nil, ""); w.Code != http.StatusNotFound {
+		t.Errorf("infected upload kept: %d", w.Code)
+	}
+
+	// Expired uploads are deleted, unless a request is writing to them
+	busy, idle := create(t, "10"), create(t, "10")
+	lockUpload(busy)
+	if err := expireUploads(time.Now().Add(uploadConfig.Expiry + time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	unlockUpload(busy)
+	for upload, code := range map[string]int{id: http.StatusNotFound, idle: http.StatusNotFound, busy: http.StatusOK} {
+		if w := call(alice, "HEAD", "/uploads/"+upload, nil, ""); w.Code != code {
+			t.Errorf("upload %s after expiry: %d, want %d", upload, w.Code, code)
+		}
+	}
+}
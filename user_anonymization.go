@@ -0,0 +1,431 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Workspaces that allow it in their settings can have the name of users
+// who left replaced with formerMemberName in their history: their stored
+// and archived messages, the messages kept for backfills, the tasks
+// assigned to them, task history and the event log. Messages keep their
+// content; only who posted them is hidden. Every step can run again
+// without harm, so a job cut short by a restart starts over.
+
+// Name shown instead of an anonymized user's
+const formerMemberName = "Former member"
+
+// Fields of event data that hold a username
+var eventUsernameFields = map[string]bool{
+	"username":    true,
+	"assignee":    true,
+	"updatedBy":   true,
+	"completedBy": true,
+	"mergedBy":    true,
+}
+
+// Statuses of an anonymization
+const (
+	anonymizationRunning = "running"
+	anonymizationDone    = "done"
+	anonymizationFailed  = "failed"
+)
+
+// Anonymization is a background job replacing a departed user's name in
+// a workspace's messages and event log
+type Anonymization struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"userId"`
+	Status     string     `json:"status"`
+	Messages   int        `json:"messages"` // Messages renamed so far
+	Archived   int        `json:"archived"` // Archived messages renamed so far
+	Tasks      int        `json:"tasks"`    // Tasks, task events and snapshots renamed so far
+	Events     int        `json:"events"`   // Logged events rewritten so far
+	Error      string     `json:"error,omitempty"`
+	StartedBy  string     `json:"startedBy"`
+	StartedAt  time.Time  `json:"startedAt"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+
+	WorkspaceID int    `json:"-"`
+	username    string // Name being replaced
+}
+
+// Key of the anonymizations in the server state
+const anonymizationsStateKey = "anonymizations"
+
+// storedAnonymization is how an anonymization is kept in the server state
+type storedAnonymization struct {
+	Anonymization
+	WorkspaceID int    `json:"workspaceId"`
+	Username    string `json:"username"`
+}
+
+var (
+	// Anonymizations are saved in the server state as they progress, and
+	// the ones cut short by a restart run again when the server starts
+	anonymizations      []Anonymization
+	nextAnonymizationID int = 1
+	anonymizationsMu    sync.Mutex
+)
+
+// hasDeparted tells whether a user has left the workspace: they were a
+// member and have been removed. Everyone belongs to the default
+// workspace, so nobody leaves it; being banned isn't leaving.
+func hasDeparted(ctx context.Context, ws Workspace, user User) bool {
+	if ws.Slug == defaultWorkspaceSlug {
+		return false
+	}
+	return !isWorkspaceMember(ctx, ws, user.ID)
+}
+
+// loadAnonymizations restores the anonymizations saved in the store. It
+// runs at startup; resumeAnonymizations then runs the unfinished ones.
+func loadAnonymizations(ctx context.Context) error {
+	saved, err := store.GetServerState(ctx, anonymizationsStateKey)
+	if errors.Is(err, errNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var stored []storedAnonymization
+	if err := json.Unmarshal([]byte(saved), &stored); err != nil {
+		return fmt.Errorf("saved anonymizations: %w", err)
+	}
+
+	anonymizationsMu.Lock()
+	defer anonymizationsMu.Unlock()
+	anonymizations = anonymizations[:0]
+	for _, s := range stored {
+		a := s.Anonymization
+		a.WorkspaceID, a.username = s.WorkspaceID, s.Username
+		anonymizations = append(anonymizations, a)
+		nextAnonymizationID = max(nextAnonymizationID, a.ID+1)
+	}
+	return nil
+}
+
+// resumeAnonymizations runs again the anonymizations a restart cut short
+func resumeAnonymizations() {
+	anonymizationsMu.Lock()
+	defer anonymizationsMu.Unlock()
+	for _, a := range anonymizations {
+		if a.Status == anonymizationRunning {
+			go runAnonymization(a)
+		}
+	}
+}
+
+// saveAnonymizationsLocked saves the anonymizations in the store. The
+// caller holds anonymizationsMu.
+func saveAnonymizationsLocked() {
+	stored := make([]storedAnonymization, len(anonymizations))
+	for i, a := range anonymizations {
+		stored[i] = storedAnonymization{Anonymization: a, WorkspaceID: a.WorkspaceID, Username: a.username}
+	}
+	b, err := json.Marshal(stored)
+	if err == nil {
+		ctx, cancel := storeContext()
+		err = store.SetServerState(ctx, anonymizationsStateKey, string(b))
+		cancel()
+	}
+	if err != nil {
+		log.Printf("Saving anonymizations failed: %v", err)
+	}
+}
+
+// Start anonymizing a user who left the workspace (POST
+// /admin/users/{id}/anonymize). The job runs in the background; follow
+// it with GET /admin/anonymizations/{id}.
+func anonymizeUser(w http.ResponseWriter, r *http.Request) {
+	ws := requestWorkspace(r)
+	if !ws.Settings.AnonymizeDeparted {
+		http.Error(w, "This workspace doesn't anonymize departed users", http.StatusForbidden)
+		return
+	}
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	user, ok := findUserByID(r.Context(), id)
+	if !ok {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if !hasDeparted(r.Context(), ws, user) {
+		http.Error(w, "The user hasn't left the workspace", http.StatusConflict)
+		return
+	}
+	admin, _ := currentUser(r)
+
+	anonymizationsMu.Lock()
+	for _, a := range anonymizations {
+		if a.WorkspaceID == ws.ID && a.UserID == user.ID && a.Status == anonymizationRunning {
+			anonymizationsMu.Unlock()
+			http.Error(w, "The user is already being anonymized", http.StatusConflict)
+			return
+		}
+	}
+	job := Anonymization{
+		ID:          nextAnonymizationID,
+		UserID:      user.ID,
+		Status:      anonymizationRunning,
+		StartedBy:   admin.Username,
+		StartedAt:   time.Now().UTC(),
+		WorkspaceID: ws.ID,
+		username:    user.Username,
+	}
+	nextAnonymizationID++
+	anonymizations = append(anonymizations, job)
+	saveAnonymizationsLocked()
+	anonymizationsMu.Unlock()
+
+	recordAudit(r, "user.anonymize", user.Username, ws.Slug)
+	go runAnonymization(job)
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+// Get the progress of an anonymization (GET /admin/anonymizations/{id})
+func getAnonymization(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid anonymization ID", http.StatusBadRequest)
+		return
+	}
+	ws := requestWorkspace(r)
+
+	anonymizationsMu.Lock()
+	defer anonymizationsMu.Unlock()
+	for _, a := range anonymizations {
+		if a.ID == id && a.WorkspaceID == ws.ID {
+			json.NewEncoder(w).Encode(a)
+			return
+		}
+	}
+	http.Error(w, "Anonymization not found", http.StatusNotFound)
+}
+
+// updateAnonymization applies fn to the job with the given ID and saves
+// the jobs
+func updateAnonymization(id int, fn func(a *Anonymization)) {
+	anonymizationsMu.Lock()
+	defer anonymizationsMu.Unlock()
+	for i := range anonymizations {
+		if anonymizations[i].ID == id {
+			fn(&anonymizations[i])
+			saveAnonymizationsLocked()
+			return
+		}
+	}
+}
+
+// runAnonymization renames the user's messages, stored and archived,
+// their tasks and the events logged about them, and records how it went
+func runAnonymization(job Anonymization) {
+	ctx := context.Background()
+	err := anonymizeMessages(ctx, job)
+	if err == nil {
+		err = anonymizeArchive(ctx, job)
+	}
+	if err == nil {
+		err = anonymizeTasks(ctx, job)
+	}
+	if err == nil {
+		err = anonymizeEvents(ctx, job)
+	}
+
+	now := time.Now().UTC()
+	updateAnonymization(job.ID, func(a *Anonymization) {
+		a.Status, a.FinishedAt = anonymizationDone, &now
+		if err != nil {
+			a.Status, a.Error = anonymizationFailed, err.Error()
+		}
+	})
+	if err != nil {
+		log.Printf("Anonymizing %s failed: %v", job.username, err)
+	}
+}
+
+// anonymizeMessages renames the messages the user posted in the
+// workspace, in the store and in the rooms' backfill buffers
+func anonymizeMessages(ctx context.Context, job Anonymization) error {
+	// Messages still in the write-behind queue would keep the name
+	messageQueue.Flush()
+
+	n, err := store.RenameUserMessages(ctx, job.WorkspaceID, job.UserID, formerMemberName)
+	if err != nil {
+		return fmt.Errorf("renaming messages: %w", err)
+	}
+	rooms, err := store.ListRooms(ctx, job.WorkspaceID)
+	if err != nil {
+		return fmt.Errorf("listing rooms: %w", err)
+	}
+	ids := make([]int, len(rooms))
+	for i, room := range rooms {
+		ids[i] = room.ID
+	}
+	renameRecentFrames(ids, job.UserID, formerMemberName)
+	updateAnonymization(job.ID, func(a *Anonymization) { a.Messages = n })
+	return nil
+}
+
+// anonymizeArchive rewrites the archive files of the workspace's rooms
+// that hold messages the user posted
+func anonymizeArchive(ctx context.Context, job Anonymization) error {
+	if archiveConfig.Dir == "" {
+		return nil
+	}
+	rooms, err := store.ListRooms(ctx, job.WorkspaceID)
+	if err != nil {
+		return fmt.Errorf("listing rooms: %w", err)
+	}
+	for _, room := range rooms {
+		files, err := archiveFiles(archiveConfig.Dir, room.ID)
+		if err != nil {
+			return fmt.Errorf("listing the archive of room %d: %w", room.ID, err)
+		}
+		for _, f := range files {
+			msgs, err := readArchiveFile(f.path)
+			if err != nil {
+				return fmt.Errorf("reading the archive: %w", err)
+			}
+			n := 0
+			for i, m := range msgs {
+				if m.UserID == job.UserID && m.Username != formerMemberName {
+					msgs[i].Username = formerMemberName
+					n++
+				}
+			}
+			if n == 0 {
+				continue
+			}
+			if err := replaceArchiveFile(f.path, msgs); err != nil {
+				return fmt.Errorf("rewriting the archive: %w", err)
+			}
+			updateAnonymization(job.ID, func(a *Anonymization) { a.Archived += n })
+		}
+	}
+	return nil
+}
+
+// anonymizeTasks renames the user in the workspace's task assignees and
+// task history
+func anonymizeTasks(ctx context.Context, job Anonymization) error {
+	n, err := store.RenameTaskUser(ctx, job.WorkspaceID, job.username, formerMemberName)
+	if err != nil {
+		return fmt.Errorf("renaming tasks: %w", err)
+	}
+	updateAnonymization(job.ID, func(a *Anonymization) { a.Tasks = n })
+	return nil
+}
+
+// anonymizeEvents rewrites the workspace's logged events that name the
+// user, a page at a time
+func anonymizeEvents(ctx context.Context, job Anonymization) error {
+	if eventLog != nil {
+		eventLog.Flush()
+	}
+
+	var after int64
+	for {
+		page, err := store.ListEvents(ctx, job.WorkspaceID, after, nil, eventLogMaxLimit)
+		if err != nil {
+			return fmt.Errorf("listing events: %w", err)
+		}
+		n := 0
+		for _, e := range page {
+			data, changed, err := renameInEventData(e.Data, job.username)
+			if err != nil {
+				log.Printf("Event %d not anonymized: %v", e.ID, err)
+				continue
+			}
+			if !changed {
+				continue
+			}
+			// Events removed past the retention meanwhile are gone anyway
+			err = store.UpdateEventData(ctx, e.ID, data)
+			if err != nil && !errors.Is(err, errNotFound) {
+				return fmt.Errorf("rewriting event %d: %w", e.ID, err)
+			}
+			n++
+		}
+		if n > 0 {
+			updateAnonymization(job.ID, func(a *Anonymization) { a.Events += n })
+		}
+		if len(page) < eventLogMaxLimit {
+			return nil
+		}
+		after = page[len(page)-1].ID
+	}
+}
+
+// renameInEventData replaces the username with formerMemberName in the
+// fields of event data that hold one, wherever they are nested
+func renameInEventData(data json.RawMessage, username string) (json.RawMessage, bool, error) {
+	var v any
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, false, err
+	}
+	if !renameInValue(v, username) {
+		return data, false, nil
+	}
+	out, err := json.Marshal(v)
+	return out, err == nil, err
+}
+
+// renameInTaskEvent replaces the username in who made a task change and in
+// the assignees it set or unset. The event's fields are copied before
+// they change.
+func renameInTaskEvent(e TaskEvent, username, newName string) (TaskEvent, bool) {
+	changed := false
+	if e.By == username {
+		e.By, changed = newName, true
+	}
+	rename := func(fields map[string]json.RawMessage) map[string]json.RawMessage {
+		var assignee string
+		if json.Unmarshal(fields["assignee"], &assignee) != nil || assignee != username {
+			return fields
+		}
+		fields = maps.Clone(fields)
+		fields["assignee"], _ = json.Marshal(newName)
+		changed = true
+		return fields
+	}
+	e.Fields, e.Previous = rename(e.Fields), rename(e.Previous)
+	return e, changed
+}
+
+func renameInValue(v any, username string) bool {
+	changed := false
+	switch v := v.(type) {
+	case map[string]any:
+		for k, field := range v {
+			if s, ok := field.(string); ok && eventUsernameFields[k] && s == username {
+				v[k] = formerMemberName
+				changed = true
+			} else if renameInValue(field, username) {
+				changed = true
+			}
+		}
+	case []any:
+		for _, item := range v {
+			if renameInValue(item, username) {
+				changed = true
+			}
+		}
+	}
+	return changed
+}
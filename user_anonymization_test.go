@@ -0,0 +1,198 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestHasDeparted(t *testing.T) {
+	ctx := context.Background()
+	useMemoryStore(t)
+	ws, err := store.CreateWorkspace(ctx, Workspace{Slug: "acme", Name: "Acme"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	member := User{ID: 1, Username: "alice"}
+	if _, err := store.AddMember(ctx, WorkspaceMember{WorkspaceID: ws.ID, UserID: member.ID, Role: "member"}); err != nil {
+		t.Fatal(err)
+	}
+	defaultWS := Workspace{ID: 99, Slug: defaultWorkspaceSlug}
+
+	tests := []struct {
+		name string
+		ws   Workspace
+		user User
+		want bool
+	}{
+		{"member", ws, member, false},
+		{"removed member", ws, User{ID: 2, Username: "bob"}, true},
+		{"banned member", ws, User{ID: 1, Username: "alice", Banned: true}, false},
+		{"default workspace", defaultWS, User{ID: 3, Username: "carol"}, false},
+		{"banned in the default workspace", defaultWS, User{ID: 3, Username: "carol", Banned: true}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hasDeparted(ctx, tt.ws, tt.user); got != tt.want {
+				t.Errorf("hasDeparted() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenameInTaskEvent(t *testing.T) {
+	raw := func(s string) json.RawMessage { b, _ := json.Marshal(s); return b }
+	tests := []struct {
+		name         string
+		event        TaskEvent
+		changed      bool
+		by, assignee string
+		previous     string
+	}{
+		{"made by", TaskEvent{By: "alice"}, true, formerMemberName, "", ""},
+		{"assigned to", TaskEvent{By: "bob", Fields: map[string]json.RawMessage{"assignee": raw("alice")}}, true, "bob", formerMemberName, ""},
+		{"unassigned from", TaskEvent{By: "bob", Previous: map[string]json.RawMessage{"assignee": raw("alice")}}, true, "bob", "", formerMemberName},
+		{"someone else", TaskEvent{By: "bob", Fields: map[string]json.RawMessage{"assignee": raw("carol")}}, false, "bob", "carol", ""},
+		{"other fields", TaskEvent{By: "bob", Fields: map[string]json.RawMessage{"title": raw("alice")}}, false, "bob", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before, _ := json.Marshal(tt.event)
+			got, changed := renameInTaskEvent(tt.event, "alice", formerMemberName)
+			if changed != tt.changed {
+				t.Errorf("changed = %v, want %v", changed, tt.changed)
+			}
+			var assignee, previous string
+			json.Unmarshal(got.Fields["assignee"], &assignee)
+			json.Unmarshal(got.Previous["assignee"], &previous)
+			if got.By != tt.by || assignee != tt.assignee || previous != tt.previous {
+				t.Errorf("got by %q, assignee %q, previous %q; want %q, %q, %q", got.By, assignee, previous, tt.by, tt.assignee, tt.previous)
+			}
+			// The stored event's fields are left alone
+			if after, _ := json.Marshal(tt.event); string(after) != string(before) {
+				t.Errorf("event changed in place: %s, was %s", after, before)
+			}
+		})
+	}
+}
+
+func TestRunAnonymization(t *testing.T) {
+	ctx := context.Background()
+	useMemoryStore(t)
+	prevArchive, prevQueue := archiveConfig, messageQueue
+	archiveConfig = ArchiveConfig{Dir: t.TempDir()}
+	messageQueue = newMessageWriter(store, MessageWriterConfig{})
+	t.Cleanup(func() {
+		messageQueue.Close()
+		archiveConfig, messageQueue = prevArchive, prevQueue
+	})
+
+	ws, err := store.CreateWorkspace(ctx, Workspace{Slug: "acme", Name: "Acme"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	room, err := store.CreateRoom(ctx, Room{WorkspaceID: ws.ID, Name: "general"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	post := func(id int, username string, userID int) Message {
+		return Message{ID: id, Username: username, UserID: userID, Content: "hi", Room: room.Name, RoomID: room.ID, WorkspaceID: ws.ID, CreatedAt: at}
+	}
+	if err := writeArchiveFile(archiveConfig.Dir, room.ID, []Message{post(1, "alice", 7), post(2, "bob", 8)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveMessages(ctx, []Message{post(0, "alice", 7), post(0, "bob", 8)}); err != nil {
+		t.Fatal(err)
+	}
+	recorded := post(0, "alice", 7)
+	recorded.Seq = 1
+	recordFrame(recorded)
+	t.Cleanup(func() {
+		roomSequencesMu.Lock()
+		delete(roomSequences, room.ID)
+		roomSequencesMu.Unlock()
+	})
+	task, err := store.CreateTask(ctx, Task{Title: "Ship it", Assignee: "alice", WorkspaceID: ws.ID}, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Enough changes for a snapshot
+	for i := 1; i < taskSnapshotInterval; i++ {
+		task.Description = fmt.Sprint("Take ", i)
+		if task, err = store.UpdateTask(ctx, task, "bob"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	job := Anonymization{ID: 1, UserID: 7, Status: anonymizationRunning, WorkspaceID: ws.ID, username: "alice"}
+	anonymizationsMu.Lock()
+	prevJobs := anonymizations
+	anonymizations = []Anonymization{job}
+	anonymizationsMu.Unlock()
+	t.Cleanup(func() {
+		anonymizationsMu.Lock()
+		anonymizations = prevJobs
+		anonymizationsMu.Unlock()
+	})
+
+	// Running a job again, as after a restart, changes nothing more
+	for range 2 {
+		runAnonymization(job)
+	}
+
+	anonymizationsMu.Lock()
+	got := anonymizations[0]
+	anonymizationsMu.Unlock()
+	if got.Status != anonymizationDone {
+		t.Fatalf("status = %s (%s), want %s", got.Status, got.Error, anonymizationDone)
+	}
+	names := func(msgs []Message) []string {
+		var list []string
+		for _, m := range msgs {
+			list = append(list, m.Username)
+		}
+		return list
+	}
+	want := []string{formerMemberName, "bob"}
+	stored, err := store.ListMessages(ctx, room.ID, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archived, err := archivedHistory(room.ID, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for what, msgs := range map[string][]Message{"stored": stored, "archived": archived} {
+		if got := names(msgs); len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+			t.Errorf("%s messages by %v, want %v", what, got, want)
+		}
+	}
+	if frame := backfill(room.ID, BackfillRequest{From: 1, To: 1}); frame.Backfill.Messages[0].Username != formerMemberName {
+		t.Errorf("backfill has %s", frame.Backfill.Messages[0].Username)
+	}
+	if task, _ := store.GetTask(ctx, ws.ID, task.ID); task.Assignee != formerMemberName {
+		t.Errorf("task assigned to %s", task.Assignee)
+	}
+	if events, _ := store.ListTaskEvents(ctx, ws.ID, task.ID, 0); events[0].By != formerMemberName {
+		t.Errorf("task event by %s", events[0].By)
+	}
+	if snap, _ := store.GetTaskSnapshot(ctx, ws.ID, task.ID, taskSnapshotInterval); snap.Task.Assignee != formerMemberName {
+		t.Errorf("task snapshot assigned to %s", snap.Task.Assignee)
+	}
+
+	// The job is saved, so a restart finds it
+	anonymizationsMu.Lock()
+	anonymizations = nil
+	anonymizationsMu.Unlock()
+	if err := loadAnonymizations(ctx); err != nil {
+		t.Fatal(err)
+	}
+	anonymizationsMu.Lock()
+	defer anonymizationsMu.Unlock()
+	if len(anonymizations) != 1 || anonymizations[0].username != "alice" || anonymizations[0].Status != anonymizationDone {
+		t.Errorf("loaded %+v", anonymizations)
+	}
+}
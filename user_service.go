@@ -0,0 +1,53 @@
+package chat
+
+import (
+	"context"
+	"net/mail"
+	"strings"
+)
+
+// UserService holds the account rules shared by every frontend
+type UserService interface {
+	// Register creates an account with the username and password of creds
+	// and an optional email address. It returns a *ValidationError for
+	// unusable credentials, and errUsernameTaken or errEmailTaken.
+	Register(ctx context.Context, creds Credentials) (User, error)
+	// Authenticate checks a username and password with the configured
+	// auth provider, returning errInvalidCredentials if they are wrong
+	Authenticate(ctx context.Context, username, password string) (User, error)
+}
+
+var userService UserService = providerUserService{}
+
+// providerUserService is the UserService backed by the configured auth
+// provider and store
+type providerUserService struct{}
+
+func (providerUserService) Register(ctx context.Context, creds Credentials) (User, error) {
+	creds.Username = strings.TrimSpace(creds.Username)
+	if creds.Username == "" {
+		return User{}, &ValidationError{Message: "Username is required"}
+	}
+	if strings.EqualFold(creds.Username, systemUsername) {
+		return User{}, &ValidationError{Message: "Username is reserved"}
+	}
+	if len(creds.Password) < minPasswordLength {
+		return User{}, &ValidationError{Message: "Password must be at least 8 characters"}
+	}
+
+	creds.Email = strings.TrimSpace(creds.Email)
+	if creds.Email != "" {
+		addr, err := mail.ParseAddress(creds.Email)
+		if err != nil || addr.Address != creds.Email {
+			return User{}, &ValidationError{Message: "Invalid email address"}
+		}
+	} else if requireEmailVerification {
+		return User{}, &ValidationError{Message: "Email address is required"}
+	}
+
+	return createUser(ctx, creds.Username, creds.Email, creds.Password)
+}
+
+func (providerUserService) Authenticate(ctx context.Context, username, password string) (User, error) {
+	return authProvider.Authenticate(ctx, strings.TrimSpace(username), password)
+}
@@ -0,0 +1,260 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// User represents a registered chat user
+type User struct {
+	ID            int       `json:"id"`
+	Username      string    `json:"username"`
+	Email         string    `json:"email,omitempty"`
+	EmailVerified bool      `json:"emailVerified"`
+	Role          string    `json:"role"`
+	PasswordHash  []byte    `json:"-"`
+	CreatedAt     time.Time `json:"createdAt"`
+
+	// Two-factor authentication. The secret is set during enrollment but
+	// only enforced once TOTPEnabled is true. Recovery codes are stored
+	// as SHA-256 hashes.
+	TOTPEnabled     bool     `json:"totpEnabled"`
+	TOTPSecret      string   `json:"-"`
+	TOTPLastCounter uint64   `json:"-"`
+	RecoveryCodes   []string `json:"-"`
+
+	// Banned users can't log in, and their sessions and API tokens stop
+	// working
+	Banned bool `json:"banned"`
+
+	// Bumped to revoke every access token issued to the user so far
+	TokenGeneration int `json:"-"`
+
+	// Phone is a confirmed number in E.164 format for text messages
+	Phone string `json:"phone,omitempty"`
+
+	Preferences UserPreferences `json:"preferences"`
+}
+
+// Credentials is the request body for registration and login
+type Credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Email    string `json:"email,omitempty"` // Registration only
+}
+
+var (
+	errUsernameTaken      = errors.New("username already taken")
+	errEmailTaken         = errors.New("email address already in use")
+	errInvalidCredentials = errors.New("invalid username or password")
+)
+
+// Minimum password length accepted at registration
+const minPasswordLength = 8
+
+// createUser registers a new user with a bcrypt-hashed password
+func createUser(ctx context.Context, username, email, password string) (User, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return User{}, err
+	}
+
+	return addUser(ctx, User{Username: username, Email: email, PasswordHash: hash})
+}
+
+// addUser fills in the defaults for a new user and stores it. The store
+// rejects usernames and email addresses that are already taken.
+func addUser(ctx context.Context, user User) (User, error) {
+	if user.Role == "" {
+		user.Role = roleUser
+		if isBootstrapAdmin(user.Username) {
+			user.Role = roleAdmin
+		}
+	}
+	user.CreatedAt = time.Now().UTC()
+	return store.CreateUser(ctx, user)
+}
+
+// upsertExternalUser finds the user by username, creating it if needed,
+// and updates the email and role from an external directory
+func upsertExternalUser(ctx context.Context, username, email, role string) (User, error) {
+	existing, ok := findUserByUsername(ctx, username)
+	if !ok {
+		return addUser(ctx, User{Username: username, Email: email, EmailVerified: email != "", Role: role})
+	}
+
+	return store.UpdateUser(ctx, existing.ID, func(u *User) error {
+		u.Email = email
+		u.EmailVerified = email != ""
+		u.Role = role
+		return nil
+	})
+}
+
+// lookupUser turns a store lookup into the found/not found form the
+// handlers use, logging unexpected errors
+func lookupUser(user User, err error) (User, bool) {
+	if err != nil {
+		if !errors.Is(err, errNotFound) {
+			log.Printf("User lookup error: %v", err)
+		}
+		return User{}, false
+	}
+	return user, true
+}
+
+// findUserByUsername looks up a user by username, case-insensitively
+func findUserByUsername(ctx context.Context, username string) (User, bool) {
+	return lookupUser(store.FindUserByUsername(ctx, username))
+}
+
+// findUserByEmail returns the user with the given email address
+func findUserByEmail(ctx context.Context, email string) (User, bool) {
+	email = strings.TrimSpace(email)
+	if email == "" {
+		return User{}, false
+	}
+	return lookupUser(store.FindUserByEmail(ctx, email))
+}
+
+// findUserByID returns the user with the given ID
+func findUserByID(ctx context.Context, id int) (User, bool) {
+	return lookupUser(store.GetUser(ctx, id))
+}
+
+// updateUser applies fn to the stored user
+func updateUser(ctx context.Context, id int, fn func(u *User)) (User, bool) {
+	return lookupUser(store.UpdateUser(ctx, id, func(u *User) error {
+		fn(u)
+		return nil
+	}))
+}
+
+///////////////////////
+// Auth API Handlers //
+///////////////////////
+
+// Register a new account and start a session (POST /auth/register)
+func register(w http.ResponseWriter, r *http.Request) {
+	var creds Credentials
+	err := json.NewDecoder(r.Body).Decode(&creds)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !authProvider.AllowsRegistration() || !featureEnabled(r, featureRegistration) {
+		writeFeatureDisabled(w, "Registration")
+		return
+	}
+
+	user, err := userService.Register(r.Context(), creds)
+	var invalid *ValidationError
+	if errors.As(err, &invalid) {
+		http.Error(w, invalid.Message, http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, errUsernameTaken) {
+		http.Error(w, "Username already taken", http.StatusConflict)
+		return
+	}
+	if errors.Is(err, errEmailTaken) {
+		http.Error(w, "Email address already in use", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// With verification on, the account stays locked until the link in
+	// the email is opened
+	if requireEmailVerification {
+		sendVerificationEmail(user)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(user)
+		return
+	}
+
+	if user.Email != "" {
+		sendVerificationEmail(user)
+	}
+	if err := startSession(w, user); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeLoggedIn(w, http.StatusCreated, user)
+}
+
+// Log in with a username and password (POST /auth/login)
+func login(w http.ResponseWriter, r *http.Request) {
+	var creds Credentials
+	err := json.NewDecoder(r.Body).Decode(&creds)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	username := strings.TrimSpace(creds.Username)
+	if wait := checkLoginAllowed(r, username); wait > 0 {
+		writeLockedOut(w, wait)
+		return
+	}
+
+	user, err := userService.Authenticate(r.Context(), username, creds.Password)
+	if errors.Is(err, errInvalidCredentials) {
+		recordLoginFailure(r, username)
+		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Printf("Login error for %s: %v", username, err)
+		http.Error(w, "Login is temporarily unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	if user.Banned {
+		http.Error(w, "This account is banned", http.StatusForbidden)
+		return
+	}
+	if requireEmailVerification && user.Email != "" && !user.EmailVerified {
+		http.Error(w, "Verify your email address before logging in", http.StatusForbidden)
+		return
+	}
+
+	ticket, err := beginLogin(w, user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if ticket != "" {
+		writeTwoFactorChallenge(w, ticket)
+		return
+	}
+
+	recordLoginSuccess(username)
+	writeLoggedIn(w, http.StatusOK, user)
+}
+
+// Get the logged-in user and the storage their attachments take up (GET /me)
+func getMe(w http.ResponseWriter, r *http.Request) {
+	user, _ := currentUser(r)
+	storage, err := userStorageUsage(r.Context(), user.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(struct {
+		User
+		Storage StorageUsage `json:"storage"`
+	}{user, storage})
+}
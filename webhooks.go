@@ -0,0 +1,426 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Batched webhooks are sent whatever has piled up this often, or as soon
+// as a batch is full
+const (
+	webhookBatchInterval = 10 * time.Second
+	webhookBatchSize     = 100
+)
+
+// Deliveries waiting for each webhook. A webhook that falls further
+// behind loses the new ones rather than holding up the chat.
+const webhookQueueSize = 100
+
+// RoomWebhook is a URL that receives every message posted in a room.
+//
+// Each delivery is a POST of a WebhookPayload. The body is signed with the
+// webhook's secret: X-Chat-Signature is "sha256=" followed by the hex
+// HMAC-SHA256 of the X-Chat-Timestamp value, a dot, and the body.
+type RoomWebhook struct {
+	ID        int       `json:"id"`
+	Room      string    `json:"room"`
+	URL       string    `json:"url"`
+	Batch     bool      `json:"batch"` // Collect messages and send them together
+	CreatedBy string    `json:"createdBy"`
+	CreatedAt time.Time `json:"createdAt"`
+
+	WorkspaceID int    `json:"-"`
+	RoomID      int    `json:"-"`
+	Secret      string `json:"-"`
+}
+
+// NewRoomWebhook is the request body for adding a webhook
+type NewRoomWebhook struct {
+	URL   string `json:"url"`
+	Batch bool   `json:"batch"`
+}
+
+// CreatedRoomWebhook is returned once, when a webhook is added
+type CreatedRoomWebhook struct {
+	RoomWebhook
+	Secret string `json:"secret"`
+}
+
+// WebhookPayload is the body of a webhook delivery. Unbatched webhooks get
+// one message per delivery.
+type WebhookPayload struct {
+	Room     string    `json:"room"`
+	Messages []Message `json:"messages"`
+}
+
+var (
+	// Every room's webhooks, loaded from the store
+	roomWebhooks []RoomWebhook
+	// Messages waiting for the next batch, by webhook ID
+	webhookBatches = make(map[int][]Message)
+	// Deliveries waiting to be sent, by webhook ID. Each webhook has one
+	// goroutine sending them in order.
+	webhookQueues  = make(map[int]chan []Message)
+	roomWebhooksMu sync.Mutex
+
+	// Deliveries are bounded by the webhook timeout instead. Webhooks are
+	// dialed directly rather than through a proxy, so that checkWebhookDial
+	// sees the address they really go to.
+	webhookClient = &http.Client{Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+			Control:   checkWebhookDial,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}}
+
+	// Lets webhooks, automations and event subscriptions call servers on
+	// the private network (CHAT_WEBHOOK_ALLOW_PRIVATE)
+	allowPrivateWebhooks bool
+)
+
+// queueWebhookDeliveries hands a broadcast message to the room's webhooks
+func queueWebhookDeliveries(msg Message) {
+	roomWebhooksMu.Lock()
+	defer roomWebhooksMu.Unlock()
+
+	for _, hook := range roomWebhooks {
+		if hook.RoomID != msg.RoomID {
+			continue
+		}
+		if !hook.Batch {
+			queueWebhookDelivery(hook, []Message{msg})
+			continue
+		}
+		webhookBatches[hook.ID] = append(webhookBatches[hook.ID], msg)
+		if len(webhookBatches[hook.ID]) >= webhookBatchSize {
+			queueWebhookDelivery(hook, webhookBatches[hook.ID])
+			delete(webhookBatches, hook.ID)
+		}
+	}
+}
+
+// queueWebhookDelivery queues messages for a webhook, starting its sender
+// if needed, or drops them when the queue is full. The caller holds
+// roomWebhooksMu.
+func queueWebhookDelivery(hook RoomWebhook, messages []Message) {
+	queue, ok := webhookQueues[hook.ID]
+	if !ok {
+		queue = make(chan []Message, webhookQueueSize)
+		webhookQueues[hook.ID] = queue
+		go func() {
+			for messages := range queue {
+				deliverWebhook(hook, messages)
+			}
+		}()
+	}
+	select {
+	case queue <- messages:
+	default:
+		log.Printf("Webhook %d is falling behind, dropped %d messages", hook.ID, len(messages))
+	}
+}
+
+// stopWebhookDeliveries ends the sender of a removed webhook once it has
+// sent what is queued. The caller holds roomWebhooksMu.
+func stopWebhookDeliveries(id int) {
+	if queue, ok := webhookQueues[id]; ok {
+		close(queue)
+		delete(webhookQueues, id)
+	}
+	delete(webhookBatches, id)
+}
+
+// loadRoomWebhooks replaces the webhooks in memory with the stored ones,
+// stopping the senders of those that were removed
+func loadRoomWebhooks(ctx context.Context) error {
+	list, err := store.ListRoomWebhooks(ctx)
+	if err != nil {
+		return err
+	}
+
+	roomWebhooksMu.Lock()
+	defer roomWebhooksMu.Unlock()
+	for _, hook := range roomWebhooks {
+		if !slices.ContainsFunc(list, func(h RoomWebhook) bool { return h.ID == hook.ID }) {
+			stopWebhookDeliveries(hook.ID)
+		}
+	}
+	roomWebhooks = list
+	return nil
+}
+
+// runWebhookBatches sends the pending batches every webhookBatchInterval
+func runWebhookBatches() {
+	for range time.Tick(webhookBatchInterval) {
+		flushWebhookBatches()
+	}
+}
+
+func flushWebhookBatches() {
+	roomWebhooksMu.Lock()
+	defer roomWebhooksMu.Unlock()
+
+	for _, hook := range roomWebhooks {
+		if batch := webhookBatches[hook.ID]; len(batch) > 0 {
+			queueWebhookDelivery(hook, batch)
+		}
+	}
+	webhookBatches = make(map[int][]Message)
+}
+
+// deliverWebhook posts messages to a webhook. Failed deliveries are logged
+// and dropped.
+func deliverWebhook(hook RoomWebhook, messages []Message) {
+	ctx, cancel := withTimeout(context.Background(), timeouts.Webhook)
+	defer cancel()
+	header := http.Header{"X-Chat-Webhook-ID": {strconv.Itoa(hook.ID)}}
+	err := postSignedJSON(ctx, hook.URL, hook.Secret, header, WebhookPayload{Room: hook.Room, Messages: messages})
+	if err != nil {
+		log.Printf("Webhook %d delivery failed: %v", hook.ID, err)
+	}
+}
+
+// postSignedJSON posts v as JSON to url with the extra header fields,
+// signed with secret as described on RoomWebhook
+func postSignedJSON(ctx context.Context, url, secret string, header http.Header, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, values := range header {
+		for _, v := range values {
+			req.Header.Add(k, v)
+		}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Chat-Timestamp", timestamp)
+	req.Header.Set("X-Chat-Signature", "sha256="+signWebhook(secret, timestamp, body))
+
+	res, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("%s returned %s", url, res.Status)
+	}
+	return nil
+}
+
+// Addresses that aren't routed on the internet, besides the loopback,
+// link-local and private ones netip reports
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"), // Carrier-grade NAT, also used for cloud metadata
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("fec0::/10"),
+}
+
+// publicAddress reports whether an IP address is on the internet, rather
+// than the server itself or a private network like the cloud metadata
+// service at 169.254.169.254
+func publicAddress(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return false
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkWebhookURL parses a URL that webhooks, automations or event
+// subscriptions will post to. Unless private webhooks are allowed, its
+// host must only resolve to public addresses. Deliveries check again when
+// they connect, since DNS can change in between.
+func checkWebhookURL(ctx context.Context, raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.New("Webhook URL must be an absolute http or https URL")
+	}
+	if allowPrivateWebhooks {
+		return u, nil
+	}
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", u.Hostname())
+	if err != nil {
+		return nil, fmt.Errorf("Webhook host %s can't be resolved", u.Hostname())
+	}
+	for _, ip := range ips {
+		if !publicAddress(ip) {
+			return nil, errors.New("Webhook URL must not point to a loopback, link-local or private address")
+		}
+	}
+	return u, nil
+}
+
+// checkWebhookDial refuses connections to non-public addresses, wherever
+// DNS or redirects sent the delivery
+func checkWebhookDial(network, address string, _ syscall.RawConn) error {
+	if allowPrivateWebhooks {
+		return nil
+	}
+	addr, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if !publicAddress(addr.Addr()) {
+		return fmt.Errorf("webhook address %s is not public", addr.Addr())
+	}
+	return nil
+}
+
+// signWebhook returns the hex HMAC-SHA256 of a delivery
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s.", timestamp)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//////////////////////////
+// Webhook API Handlers //
+//////////////////////////
+
+// List the webhooks of a room; moderators only (GET /rooms/{name}/webhooks)
+func listRoomWebhooks(w http.ResponseWriter, r *http.Request) {
+	room, ok := roomFromVars(w, r)
+	if !ok {
+		return
+	}
+
+	roomWebhooksMu.Lock()
+	defer roomWebhooksMu.Unlock()
+
+	list := []RoomWebhook{}
+	for _, hook := range roomWebhooks {
+		if hook.RoomID == room.ID {
+			list = append(list, hook)
+		}
+	}
+	json.NewEncoder(w).Encode(list)
+}
+
+// Add a webhook receiving the messages of a room; moderators only
+// (POST /rooms/{name}/webhooks)
+func createRoomWebhook(w http.ResponseWriter, r *http.Request) {
+	user, _ := currentUser(r)
+	ws := requestWorkspace(r)
+
+	var req NewRoomWebhook
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	u, err := checkWebhookURL(r.Context(), req.URL)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	room, ok := roomFromVars(w, r)
+	if !ok {
+		return
+	}
+	secret, err := randomToken(32)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	hook := RoomWebhook{
+		Room:        room.Name,
+		URL:         u.String(),
+		Batch:       req.Batch,
+		CreatedBy:   user.Username,
+		CreatedAt:   time.Now().UTC(),
+		WorkspaceID: room.WorkspaceID,
+		RoomID:      room.ID,
+		Secret:      secret,
+	}
+	if hook, err = store.CreateRoomWebhook(r.Context(), hook); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	registryChanged(registryRoomWebhooks)
+
+	recordAudit(r, "room.webhook.create", ws.Slug+"/"+room.Name, hook.URL)
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(CreatedRoomWebhook{RoomWebhook: hook, Secret: secret})
+}
+
+// Remove a webhook from a room; moderators only
+// (DELETE /rooms/{name}/webhooks/{id})
+func deleteRoomWebhook(w http.ResponseWriter, r *http.Request) {
+	ws := requestWorkspace(r)
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid webhook ID", http.StatusBadRequest)
+		return
+	}
+	room, ok := roomFromVars(w, r)
+	if !ok {
+		return
+	}
+
+	roomWebhooksMu.Lock()
+	i := slices.IndexFunc(roomWebhooks, func(hook RoomWebhook) bool {
+		return hook.ID == id && hook.RoomID == room.ID
+	})
+	var hook RoomWebhook
+	if i >= 0 {
+		hook = roomWebhooks[i]
+	}
+	roomWebhooksMu.Unlock()
+
+	if i < 0 {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+	if err := store.DeleteRoomWebhook(r.Context(), id); errors.Is(err, errNotFound) {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	registryChanged(registryRoomWebhooks)
+	recordAudit(r, "room.webhook.delete", ws.Slug+"/"+room.Name, hook.URL)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,129 @@
+package chat
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestPublicAddress(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"203.0.113.5", true},
+		{"8.8.8.8", true},
+		{"2606:4700::1111", true},
+		{"::ffff:8.8.8.8", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.100.100.200", false},
+		{"0.0.0.0", false},
+		{"0.1.2.3", false},
+		{"192.0.0.170", false},
+		{"198.18.0.1", false},
+		{"240.0.0.1", false},
+		{"255.255.255.255", false},
+		{"224.0.0.1", false},
+		{"fc00::1", false},
+		{"fe80::1", false},
+		{"fec0::1", false},
+		{"ff02::1", false},
+		{"::", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			if got := publicAddress(netip.MustParseAddr(tt.addr)); got != tt.want {
+				t.Errorf("publicAddress(%s) = %v, want %v", tt.addr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckWebhookURL(t *testing.T) {
+	prev := allowPrivateWebhooks
+	t.Cleanup(func() { allowPrivateWebhooks = prev })
+
+	tests := []struct {
+		name         string
+		url          string
+		allowPrivate bool
+		ok           bool
+	}{
+		{"public", "https://203.0.113.5/hook", false, true},
+		{"public with port", "http://203.0.113.5:8080/hook", false, true},
+		{"loopback", "http://127.0.0.1/hook", false, false},
+		{"localhost", "http://localhost/hook", false, false},
+		{"IPv6 loopback", "http://[::1]/hook", false, false},
+		{"metadata service", "http://169.254.169.254/latest/meta-data", false, false},
+		{"private", "https://10.0.0.1/hook", false, false},
+		{"mapped private", "https://[::ffff:10.0.0.1]/hook", false, false},
+		{"private allowed", "http://127.0.0.1/hook", true, true},
+		{"other scheme", "ftp://203.0.113.5/hook", false, false},
+		{"other scheme with private allowed", "file:///etc/passwd", true, false},
+		{"relative", "/hook", false, false},
+		{"no host", "https:///hook", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allowPrivateWebhooks = tt.allowPrivate
+			_, err := checkWebhookURL(context.Background(), tt.url)
+			if tt.ok && err != nil {
+				t.Errorf("checkWebhookURL(%s) = %v", tt.url, err)
+			}
+			if !tt.ok && err == nil {
+				t.Errorf("checkWebhookURL(%s) accepted it", tt.url)
+			}
+		})
+	}
+}
+
+// Deliveries check the address they connect to, not just the URL, as DNS
+// or a redirect can send them somewhere the URL check never saw
+func TestWebhookDial(t *testing.T) {
+	prev := allowPrivateWebhooks
+	t.Cleanup(func() { allowPrivateWebhooks = prev })
+
+	var delivered []byte
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		delivered, _ = io.ReadAll(r.Body)
+		if r.Header.Get("X-Chat-Signature") != "sha256="+signWebhook("secret", r.Header.Get("X-Chat-Timestamp"), delivered) {
+			http.Error(w, "bad signature", http.StatusUnauthorized)
+		}
+	}))
+	t.Cleanup(target.Close)
+	redirect := httptest.NewServer(http.RedirectHandler(target.URL, http.StatusTemporaryRedirect))
+	t.Cleanup(redirect.Close)
+
+	tests := []struct {
+		name         string
+		url          string
+		allowPrivate bool
+		ok           bool
+	}{
+		{"private", target.URL, false, false},
+		{"private allowed", target.URL, true, true},
+		{"redirected with private allowed", redirect.URL, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allowPrivateWebhooks = tt.allowPrivate
+			delivered = nil
+			err := postSignedJSON(context.Background(), tt.url, "secret", nil, WebhookPayload{Room: "general"})
+			if tt.ok && (err != nil || delivered == nil) {
+				t.Errorf("delivery failed: %v", err)
+			}
+			if !tt.ok && (err == nil || delivered != nil) {
+				t.Errorf("delivered %s", delivered)
+			}
+		})
+	}
+}
@@ -0,0 +1,510 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Slug of the workspace that requests without a workspace prefix or
+// subdomain belong to. It is open to everyone, like the app was before
+// workspaces existed.
+const defaultWorkspaceSlug = "default"
+
+// Roles of workspace members
+const (
+	workspaceRoleOwner  = "owner"
+	workspaceRoleMember = "member"
+)
+
+// Workspace is an isolated team space. Tasks and chat belong to exactly one
+// workspace, and only its members can see them.
+type Workspace struct {
+	ID        int               `json:"id"`
+	Slug      string            `json:"slug"`
+	Name      string            `json:"name"`
+	CreatedAt time.Time         `json:"createdAt"`
+	Settings  WorkspaceSettings `json:"settings"`
+}
+
+// WorkspaceSettings are the per-workspace options owners can change
+type WorkspaceSettings struct {
+	// OpenMembership lets any logged-in user join without an invitation
+	OpenMembership bool `json:"openMembership"`
+	// AnonymousChat lets visitors who aren't members read and post in the
+	// workspace chat
+	AnonymousChat bool `json:"anonymousChat"`
+	// AnonymizeDeparted lets admins have the name of users who left the
+	// workspace replaced with "Former member" in its history
+	AnonymizeDeparted bool `json:"anonymizeDeparted"`
+	// Branding dresses up the emails sent about the workspace
+	Branding WorkspaceBranding `json:"branding"`
+}
+
+// WorkspaceBranding overrides the server's branding in emails and the web
+// app; empty fields keep the server's
+type WorkspaceBranding struct {
+	Name         string `json:"name,omitempty"`         // Product name shown instead of the server's
+	LogoURL      string `json:"logoUrl,omitempty"`      // https:// URL of the logo in HTML emails
+	Color        string `json:"color,omitempty"`        // Accent color as #rrggbb
+	SupportEmail string `json:"supportEmail,omitempty"` // Where replies to emails should go
+
+	// Shown to users when they open the web app
+	WelcomeBanner string `json:"welcomeBanner,omitempty"`
+}
+
+// WorkspaceMember links a user to a workspace
+type WorkspaceMember struct {
+	WorkspaceID int       `json:"-"`
+	UserID      int       `json:"userId"`
+	Username    string    `json:"username"`
+	Role        string    `json:"role"`
+	JoinedAt    time.Time `json:"joinedAt"`
+}
+
+var (
+	// Base domain for workspace subdomains, e.g. "chat.example.com" makes
+	// acme.chat.example.com the "acme" workspace. Empty disables subdomains.
+	workspaceDomain string
+
+	errSlugTaken = errors.New("workspace slug already taken")
+
+	workspaceSlugPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{1,30}[a-z0-9]$`)
+)
+
+// Context key for the workspace a request is scoped to
+type workspaceContextKey struct{}
+
+// ensureDefaultWorkspace creates the default workspace on first start
+func ensureDefaultWorkspace(ctx context.Context) error {
+	_, err := store.FindWorkspace(ctx, defaultWorkspaceSlug)
+	if !errors.Is(err, errNotFound) {
+		return err
+	}
+
+	_, err = store.CreateWorkspace(ctx, Workspace{
+		Slug:      defaultWorkspaceSlug,
+		Name:      "Default",
+		CreatedAt: time.Now().UTC(),
+		Settings:  WorkspaceSettings{OpenMembership: true, AnonymousChat: true},
+	})
+	if errors.Is(err, errSlugTaken) {
+		return nil
+	}
+	return err
+}
+
+func findWorkspaceBySlug(ctx context.Context, slug string) (Workspace, bool) {
+	ws, err := store.FindWorkspace(ctx, strings.ToLower(slug))
+	if err != nil {
+		if !errors.Is(err, errNotFound) {
+			log.Printf("Workspace lookup error: %v", err)
+		}
+		return Workspace{}, false
+	}
+	return ws, true
+}
+
+// workspaceMember returns the user's membership, if any
+func workspaceMember(ctx context.Context, ws Workspace, userID int) (WorkspaceMember, bool) {
+	m, err := store.GetMember(ctx, ws.ID, userID)
+	if err != nil {
+		if !errors.Is(err, errNotFound) {
+			log.Printf("Workspace member lookup error: %v", err)
+		}
+		return WorkspaceMember{}, false
+	}
+	return m, true
+}
+
+// isWorkspaceMember reports whether the user belongs to the workspace.
+// Everyone belongs to the default workspace.
+func isWorkspaceMember(ctx context.Context, ws Workspace, userID int) bool {
+	if ws.Slug == defaultWorkspaceSlug {
+		return true
+	}
+	_, ok := workspaceMember(ctx, ws, userID)
+	return ok
+}
+
+// canManageWorkspace reports whether the user may change the workspace's
+// settings and members: its owners and deployment admins
+func canManageWorkspace(ctx context.Context, ws Workspace, user User) bool {
+	if user.Role == roleAdmin {
+		return true
+	}
+	m, ok := workspaceMember(ctx, ws, user.ID)
+	return ok && m.Role == workspaceRoleOwner
+}
+
+// requestWorkspace returns the workspace the request is scoped to
+func requestWorkspace(r *http.Request) Workspace {
+	if ws, ok := r.Context().Value(workspaceContextKey{}).(Workspace); ok {
+		return ws
+	}
+	ws, _ := findWorkspaceBySlug(r.Context(), defaultWorkspaceSlug)
+	return ws
+}
+
+// resolveWorkspace finds the workspace a request addresses, either through
+// a subdomain of workspaceDomain or a /w/{slug} path prefix, and returns
+// the path with the prefix removed
+func resolveWorkspace(r *http.Request) (slug, path string) {
+	path = r.URL.Path
+	if rest, ok := strings.CutPrefix(path, "/w/"); ok {
+		slug, path, _ = strings.Cut(rest, "/")
+		return slug, "/" + path
+	}
+
+	if workspaceDomain != "" {
+		host := r.Host
+		if h, _, ok := strings.Cut(host, ":"); ok {
+			host = h
+		}
+		if sub, ok := strings.CutSuffix(strings.ToLower(host), "."+workspaceDomain); ok && !strings.Contains(sub, ".") {
+			return sub, path
+		}
+	}
+	return defaultWorkspaceSlug, path
+}
+
+// workspaceHandler scopes every request to a workspace before routing it.
+// The /w/{slug} prefix is stripped, so the same routes serve every
+// workspace.
+func workspaceHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		slug, path := resolveWorkspace(r)
+		ws, ok := findWorkspaceBySlug(r.Context(), slug)
+		if !ok {
+			http.Error(w, "Workspace not found", http.StatusNotFound)
+			return
+		}
+
+		r = r.WithContext(context.WithValue(r.Context(), workspaceContextKey{}, ws))
+		if path != r.URL.Path {
+			r.URL.Path = path
+			r.URL.RawPath = ""
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Middleware that keeps non-members out of a workspace's tasks, projects,
+// rooms, chat and search, and visitors out of them everywhere when guest
+// access is off
+func workspaceAccessMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Path
+		scoped := isChatPath(path) || path == "/rooms" || strings.HasPrefix(path, "/rooms/") ||
+			path == "/tasks" || strings.HasPrefix(path, "/tasks/") || path == "/search" || path == "/messages" ||
+			path == "/projects" || strings.HasPrefix(path, "/projects/") || strings.HasPrefix(path, "/import/") ||
+			path == "/presence" || path == "/uploads" || strings.HasPrefix(path, "/uploads/") ||
+			strings.HasPrefix(path, "/moderation/")
+		if !scoped {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user, ok := currentUser(r)
+		if !ok && !featureEnabled(r, featureGuestAccess) {
+			http.Error(w, "Not logged in", http.StatusUnauthorized)
+			return
+		}
+
+		ws := requestWorkspace(r)
+		if ws.Slug == defaultWorkspaceSlug {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if isChatPath(path) && ws.Settings.AnonymousChat {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !ok {
+			http.Error(w, "Not logged in", http.StatusUnauthorized)
+			return
+		}
+		if !isWorkspaceMember(r.Context(), ws, user.ID) {
+			http.Error(w, "Not a member of this workspace", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// NewWorkspace is the request body for creating a workspace
+type NewWorkspace struct {
+	Slug     string            `json:"slug"`
+	Name     string            `json:"name"`
+	Settings WorkspaceSettings `json:"settings"`
+}
+
+// MemberRequest is the request body for adding a workspace member
+type MemberRequest struct {
+	Username string `json:"username"`
+	Role     string `json:"role,omitempty"` // "member" (default) or "owner"
+}
+
+// workspaceFromVars looks up the workspace named in the route, answering
+// with 404 when it doesn't exist
+func workspaceFromVars(w http.ResponseWriter, r *http.Request) (Workspace, bool) {
+	ws, ok := findWorkspaceBySlug(r.Context(), mux.Vars(r)["slug"])
+	if !ok {
+		http.Error(w, "Workspace not found", http.StatusNotFound)
+	}
+	return ws, ok
+}
+
+////////////////////////////
+// Workspace API Handlers //
+////////////////////////////
+
+// Create a workspace owned by the current user (POST /workspaces)
+func createWorkspace(w http.ResponseWriter, r *http.Request) {
+	user, _ := currentUser(r)
+	if !featureEnabled(r, featureWorkspaceCreation) && user.Role != roleAdmin {
+		writeFeatureDisabled(w, "Workspace creation")
+		return
+	}
+
+	var req NewWorkspace
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	req.Slug = strings.ToLower(strings.TrimSpace(req.Slug))
+	if !workspaceSlugPattern.MatchString(req.Slug) {
+		http.Error(w, "Slug must be 3-32 lowercase letters, digits or dashes", http.StatusBadRequest)
+		return
+	}
+	if req.Name = strings.TrimSpace(req.Name); req.Name == "" {
+		req.Name = req.Slug
+	}
+
+	ws, err := store.CreateWorkspace(r.Context(), Workspace{
+		Slug:      req.Slug,
+		Name:      req.Name,
+		CreatedAt: time.Now().UTC(),
+		Settings:  req.Settings,
+	})
+	if errors.Is(err, errSlugTaken) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	_, err = store.AddMember(r.Context(), WorkspaceMember{WorkspaceID: ws.ID, UserID: user.ID, Username: user.Username, Role: workspaceRoleOwner})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r, "workspace.create", ws.Slug, "")
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(ws)
+}
+
+// List the workspaces the current user belongs to (GET /workspaces)
+func listWorkspaces(w http.ResponseWriter, r *http.Request) {
+	user, _ := currentUser(r)
+
+	all, err := store.ListWorkspaces(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	list := []Workspace{}
+	for _, ws := range all {
+		if isWorkspaceMember(r.Context(), ws, user.ID) {
+			list = append(list, ws)
+		}
+	}
+	json.NewEncoder(w).Encode(list)
+}
+
+// Get a workspace (GET /workspaces/{slug})
+func getWorkspace(w http.ResponseWriter, r *http.Request) {
+	ws, ok := workspaceFromVars(w, r)
+	if !ok {
+		return
+	}
+
+	// Open workspaces are discoverable so users can join them
+	user, _ := currentUser(r)
+	if !ws.Settings.OpenMembership && !isWorkspaceMember(r.Context(), ws, user.ID) && user.Role != roleAdmin {
+		http.Error(w, "Workspace not found", http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(ws)
+}
+
+// Change a workspace's settings (PUT /workspaces/{slug}/settings)
+func updateWorkspaceSettings(w http.ResponseWriter, r *http.Request) {
+	ws, ok := workspaceFromVars(w, r)
+	if !ok {
+		return
+	}
+
+	var settings WorkspaceSettings
+	err := json.NewDecoder(r.Body).Decode(&settings)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validBranding(settings.Branding); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ws, err = store.UpdateWorkspaceSettings(r.Context(), ws.ID, settings)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(r, "workspace.settings", ws.Slug, "")
+	json.NewEncoder(w).Encode(ws)
+}
+
+// List a workspace's members (GET /workspaces/{slug}/members)
+func listWorkspaceMembers(w http.ResponseWriter, r *http.Request) {
+	user, _ := currentUser(r)
+	ws, ok := workspaceFromVars(w, r)
+	if !ok {
+		return
+	}
+	if !isWorkspaceMember(r.Context(), ws, user.ID) && user.Role != roleAdmin {
+		http.Error(w, "Not a member of this workspace", http.StatusForbidden)
+		return
+	}
+
+	members, err := store.ListMembers(r.Context(), ws.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(members)
+}
+
+// Add a user to a workspace (POST /workspaces/{slug}/members)
+func addWorkspaceMemberHandler(w http.ResponseWriter, r *http.Request) {
+	user, _ := currentUser(r)
+	ws, ok := workspaceFromVars(w, r)
+	if !ok {
+		return
+	}
+	if ws.Slug == defaultWorkspaceSlug {
+		http.Error(w, "Everyone is a member of the default workspace", http.StatusBadRequest)
+		return
+	}
+
+	var req MemberRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Role == "" {
+		req.Role = workspaceRoleMember
+	}
+	if req.Role != workspaceRoleMember && req.Role != workspaceRoleOwner {
+		http.Error(w, "Role must be member or owner", http.StatusBadRequest)
+		return
+	}
+
+	target, ok := findUserByUsername(r.Context(), req.Username)
+	if !ok {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	m, err := store.AddMember(r.Context(), WorkspaceMember{WorkspaceID: ws.ID, UserID: target.ID, Username: target.Username, Role: req.Role})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r, "workspace.member_add", ws.Slug, target.Username+" as "+req.Role)
+	if target.Email != "" {
+		sendEmail(emailWorkspaceInvitation, EmailData{
+			User:      target,
+			Workspace: ws,
+			Link:      publicURL + "/w/" + ws.Slug + "/",
+			Inviter:   user.Username,
+		})
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(m)
+}
+
+// Remove a user from a workspace (DELETE /workspaces/{slug}/members/{userID}).
+// Members may always remove themselves.
+func removeWorkspaceMember(w http.ResponseWriter, r *http.Request) {
+	user, _ := currentUser(r)
+	ws, ok := workspaceFromVars(w, r)
+	if !ok {
+		return
+	}
+	userID, err := strconv.Atoi(mux.Vars(r)["userID"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	if userID != user.ID && !canManageWorkspace(r.Context(), ws, user) {
+		http.Error(w, "Only workspace owners can remove members", http.StatusForbidden)
+		return
+	}
+
+	err = store.RemoveMember(r.Context(), ws.ID, userID)
+	if errors.Is(err, errNotFound) {
+		http.Error(w, "Member not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(r, "workspace.member_remove", ws.Slug, "user "+strconv.Itoa(userID))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Join a workspace with open membership (POST /workspaces/{slug}/join)
+func joinWorkspace(w http.ResponseWriter, r *http.Request) {
+	user, _ := currentUser(r)
+	ws, ok := workspaceFromVars(w, r)
+	if !ok {
+		return
+	}
+	if !ws.Settings.OpenMembership {
+		http.Error(w, "This workspace is invitation only", http.StatusForbidden)
+		return
+	}
+	if isWorkspaceMember(r.Context(), ws, user.ID) {
+		http.Error(w, "Already a member", http.StatusConflict)
+		return
+	}
+
+	m, err := store.AddMember(r.Context(), WorkspaceMember{WorkspaceID: ws.ID, UserID: user.ID, Username: user.Username, Role: workspaceRoleMember})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(m)
+}
@@ -0,0 +1,519 @@
+package chat
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// XMPPConfig holds the settings of the XMPP gateway. It connects to an
+// XMPP server as an external component (XEP-0114) serving Domain, where
+// each room is a multi-user chat (XEP-0045): #general of the default
+// workspace is general@Domain, and #ops of the acme workspace is
+// acme.ops@Domain.
+type XMPPConfig struct {
+	ComponentAddr string // host:port of the server's component port; empty disables the gateway
+	Domain        string // Component domain, e.g. chat.example.com
+	Secret        string // Shared secret configured for the component on the server
+}
+
+// Namespaces of the XMPP protocols the gateway speaks
+const (
+	nsXMPPStreams   = "http://etherx.jabber.org/streams"
+	nsXMPPComponent = "jabber:component:accept"
+	nsXMPPStanzas   = "urn:ietf:params:xml:ns:xmpp-stanzas"
+	nsDiscoInfo     = "http://jabber.org/protocol/disco#info"
+	nsDiscoItems    = "http://jabber.org/protocol/disco#items"
+	nsMUC           = "http://jabber.org/protocol/muc"
+	nsMUCUser       = "http://jabber.org/protocol/muc#user"
+	nsPing          = "urn:xmpp:ping"
+)
+
+// Stanzas waiting to be written to the server. When it can't keep up,
+// further stanzas are dropped.
+const xmppQueueSize = 1024
+
+// XMPP gateway connected at startup, or nil when it is disabled
+var xmppGateway *xmppComponent
+
+// xmppStanza is an incoming message, presence or iq stanza
+type xmppStanza struct {
+	XMLName xml.Name
+	From    string        `xml:"from,attr"`
+	To      string        `xml:"to,attr"`
+	ID      string        `xml:"id,attr"`
+	Type    string        `xml:"type,attr"`
+	Body    string        `xml:"body"`
+	Payload []xmppElement `xml:",any"`
+}
+
+// xmppElement is a child element, of which only the name matters
+type xmppElement struct {
+	XMLName xml.Name
+}
+
+// xmppOccupant is an XMPP user who has joined a room
+type xmppOccupant struct {
+	jid      string // Full JID, where the room's stanzas are sent
+	nick     string
+	room     Room
+	roomJID  string // Bare JID of the room
+	pipeline MessageHandler
+}
+
+// xmppOccupantKey identifies an occupant: one JID can be in many rooms
+type xmppOccupantKey struct {
+	jid    string
+	roomID int
+}
+
+// xmppComponent bridges chat rooms to XMPP multi-user chats. XMPP users
+// take part like guests, under the nickname they join with, so the
+// workspace has to allow anonymous chat.
+type xmppComponent struct {
+	cfg XMPPConfig
+	out chan []byte
+
+	mu        sync.Mutex
+	conn      net.Conn
+	closed    bool
+	occupants map[xmppOccupantKey]*xmppOccupant
+}
+
+// newXMPPGateway connects to the XMPP server and keeps reconnecting in the
+// background whenever the connection drops
+func newXMPPGateway(cfg XMPPConfig) (*xmppComponent, error) {
+	if cfg.ComponentAddr == "" {
+		return nil, nil
+	}
+	if cfg.Domain == "" {
+		return nil, errors.New("the component domain is required")
+	}
+	c := &xmppComponent{
+		cfg:       cfg,
+		out:       make(chan []byte, xmppQueueSize),
+		occupants: make(map[xmppOccupantKey]*xmppOccupant),
+	}
+	conn, dec, err := c.connect()
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("XMPP gateway serving %s through %s", cfg.Domain, cfg.ComponentAddr)
+	go c.write()
+	go c.run(conn, dec)
+	return c, nil
+}
+
+// connect opens a stream to the server and authenticates the component
+func (c *xmppComponent) connect() (net.Conn, *xml.Decoder, error) {
+	conn, err := net.DialTimeout("tcp", c.cfg.ComponentAddr, 10*time.Second)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	fail := func(err error) (net.Conn, *xml.Decoder, error) {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	_, err = fmt.Fprintf(conn, "<stream:stream xmlns='%s' xmlns:stream='%s' to='%s'>",
+		nsXMPPComponent, nsXMPPStreams, xmlEscape(c.cfg.Domain))
+	if err != nil {
+		return fail(err)
+	}
+	dec := xml.NewDecoder(bufio.NewReader(conn))
+	start, err := nextElement(dec)
+	if err != nil {
+		return fail(err)
+	}
+	if start.Name.Local != "stream" {
+		return fail(fmt.Errorf("unexpected <%s> instead of a stream", start.Name.Local))
+	}
+	var streamID string
+	for _, attr := range start.Attr {
+		if attr.Name.Local == "id" {
+			streamID = attr.Value
+		}
+	}
+
+	sum := sha1.Sum([]byte(streamID + c.cfg.Secret))
+	if _, err := fmt.Fprintf(conn, "<handshake>%s</handshake>", hex.EncodeToString(sum[:])); err != nil {
+		return fail(err)
+	}
+	start, err = nextElement(dec)
+	if err != nil {
+		return fail(err)
+	}
+	if start.Name.Local != "handshake" {
+		return fail(errors.New("the server refused the handshake; check the domain and secret"))
+	}
+	dec.Skip()
+
+	conn.SetDeadline(time.Time{})
+	c.mu.Lock()
+	c.conn = conn
+	c.mu.Unlock()
+	return conn, dec, nil
+}
+
+// nextElement returns the next start element of the stream
+func nextElement(dec *xml.Decoder) (xml.StartElement, error) {
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return xml.StartElement{}, err
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			return tok, nil
+		case xml.EndElement:
+			// </stream:stream>
+			return xml.StartElement{}, io.EOF
+		}
+	}
+}
+
+// run handles incoming stanzas, reconnecting when the stream ends
+func (c *xmppComponent) run(conn net.Conn, dec *xml.Decoder) {
+	backoff := time.Second
+	for {
+		err := c.read(dec)
+		conn.Close()
+
+		c.mu.Lock()
+		closed := c.closed
+		// Occupants have to join again on the new stream
+		c.occupants = make(map[xmppOccupantKey]*xmppOccupant)
+		c.mu.Unlock()
+		if closed {
+			return
+		}
+		log.Printf("XMPP stream ended: %v", err)
+
+		for {
+			time.Sleep(backoff)
+			conn, dec, err = c.connect()
+			if err == nil {
+				backoff = time.Second
+				break
+			}
+			backoff = min(2*backoff, time.Minute)
+			log.Printf("XMPP reconnect failed: %v", err)
+		}
+		log.Printf("XMPP gateway reconnected to %s", c.cfg.ComponentAddr)
+	}
+}
+
+// read decodes and handles stanzas until the stream fails
+func (c *xmppComponent) read(dec *xml.Decoder) error {
+	for {
+		start, err := nextElement(dec)
+		if err != nil {
+			return err
+		}
+		var s xmppStanza
+		if err := dec.DecodeElement(&s, &start); err != nil {
+			return err
+		}
+		switch s.XMLName.Local {
+		case "presence":
+			c.handlePresence(s)
+		case "message":
+			c.handleMessage(s)
+		case "iq":
+			c.handleIQ(s)
+		case "error":
+			return errors.New("stream error from the server")
+		}
+	}
+}
+
+// write sends queued stanzas to the current connection
+func (c *xmppComponent) write() {
+	for stanza := range c.out {
+		c.mu.Lock()
+		conn := c.conn
+		c.mu.Unlock()
+
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if _, err := conn.Write(stanza); err != nil {
+			// The reader notices too, and reconnects
+			log.Printf("XMPP write error: %v", err)
+			conn.Close()
+		}
+	}
+}
+
+// send queues a stanza
+func (c *xmppComponent) send(format string, args ...any) {
+	select {
+	case c.out <- fmt.Appendf(nil, format, args...):
+	default:
+		log.Println("XMPP: send queue is full, dropping a stanza")
+	}
+}
+
+// roomFromJID finds the room a JID addresses
+func (c *xmppComponent) roomFromJID(jid string) (Workspace, Room, error) {
+	bare, _, _ := strings.Cut(jid, "/")
+	local, domain, ok := strings.Cut(bare, "@")
+	if !ok || !strings.EqualFold(domain, c.cfg.Domain) {
+		return Workspace{}, Room{}, errNotFound
+	}
+
+	slug, name, ok := strings.Cut(local, ".")
+	if !ok {
+		slug, name = defaultWorkspaceSlug, local
+	}
+	ctx, cancel := storeContext()
+	defer cancel()
+	ws, ok := findWorkspaceBySlug(ctx, slug)
+	if !ok {
+		return Workspace{}, Room{}, errNotFound
+	}
+	room, err := findOrCreateRoom(bridgeRequest(ws, "xmpp"), ws, name)
+	return ws, room, err
+}
+
+// roomJID returns the bare JID of a room
+func (c *xmppComponent) roomJID(ws Workspace, room Room) string {
+	if ws.Slug == defaultWorkspaceSlug {
+		return room.Name + "@" + c.cfg.Domain
+	}
+	return ws.Slug + "." + room.Name + "@" + c.cfg.Domain
+}
+
+// handlePresence joins and leaves rooms
+func (c *xmppComponent) handlePresence(s xmppStanza) {
+	_, nick, _ := strings.Cut(s.To, "/")
+	ws, room, err := c.roomFromJID(s.To)
+	if err != nil {
+		c.sendError("presence", s, "item-not-found", "Room not found")
+		return
+	}
+	roomJID := c.roomJID(ws, room)
+	key := xmppOccupantKey{jid: s.From, roomID: room.ID}
+
+	if s.Type == "unavailable" {
+		c.mu.Lock()
+		occupant, ok := c.occupants[key]
+		delete(c.occupants, key)
+		c.mu.Unlock()
+		if ok {
+			c.sendPresence(occupant, occupant.jid, true, true)
+			c.broadcastPresence(occupant, true)
+		}
+		return
+	}
+	if s.Type != "" {
+		return
+	}
+
+	r := bridgeRequest(ws, "xmpp:"+strings.SplitN(s.From, "/", 2)[0])
+	switch {
+	case ws.Slug != defaultWorkspaceSlug && !ws.Settings.AnonymousChat, !featureEnabled(r, featureGuestAccess):
+		c.sendError("presence", s, "registration-required", "This room doesn't allow guests")
+		return
+	case strings.TrimSpace(nick) == "":
+		c.sendError("presence", s, "jid-malformed", "A nickname is required")
+		return
+	case strings.EqualFold(nick, systemUsername):
+		c.sendError("presence", s, "conflict", "That nickname is reserved")
+		return
+	}
+
+	c.mu.Lock()
+	for k, o := range c.occupants {
+		if k.roomID == room.ID && k.jid != s.From && strings.EqualFold(o.nick, nick) {
+			c.mu.Unlock()
+			c.sendError("presence", s, "conflict", "That nickname is in use")
+			return
+		}
+	}
+	_, rejoined := c.occupants[key]
+	occupant := &xmppOccupant{jid: s.From, nick: nick, room: room, roomJID: roomJID, pipeline: newMessagePipeline()}
+	c.occupants[key] = occupant
+	var others []*xmppOccupant
+	for k, o := range c.occupants {
+		if k.roomID == room.ID && k.jid != s.From {
+			others = append(others, o)
+		}
+	}
+	c.mu.Unlock()
+	if rejoined {
+		c.sendPresence(occupant, occupant.jid, false, true)
+		return
+	}
+
+	// Everyone already there, then the joiner's own presence, then the
+	// subject, which tells the client the join is complete
+	for _, o := range others {
+		c.sendPresence(o, occupant.jid, false, false)
+	}
+	c.sendPresence(occupant, occupant.jid, false, true)
+	c.send("<message type='groupchat' from='%s' to='%s'><subject/></message>", xmlEscape(roomJID), xmlEscape(occupant.jid))
+	c.broadcastPresence(occupant, false)
+}
+
+// sendPresence tells to about an occupant, marking it as their own
+// presence when self is set
+func (c *xmppComponent) sendPresence(o *xmppOccupant, to string, unavailable, self bool) {
+	typ, role, status := "", "participant", ""
+	if unavailable {
+		typ, role = " type='unavailable'", "none"
+	}
+	if self {
+		status = "<status code='110'/>"
+	}
+	c.send("<presence from='%s/%s' to='%s'%s><x xmlns='%s'><item affiliation='none' role='%s'/>%s</x></presence>",
+		xmlEscape(o.roomJID), xmlEscape(o.nick), xmlEscape(to), typ, nsMUCUser, role, status)
+}
+
+// broadcastPresence tells the other occupants of a room about o
+func (c *xmppComponent) broadcastPresence(o *xmppOccupant, unavailable bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, other := range c.occupants {
+		if k.roomID == o.room.ID && k.jid != o.jid {
+			c.sendPresence(o, other.jid, unavailable, false)
+		}
+	}
+}
+
+// handleMessage posts groupchat messages through the message pipeline
+func (c *xmppComponent) handleMessage(s xmppStanza) {
+	if s.Type != "groupchat" || s.Body == "" {
+		return
+	}
+	ws, room, err := c.roomFromJID(s.To)
+	if err != nil {
+		c.sendError("message", s, "item-not-found", "Room not found")
+		return
+	}
+	c.mu.Lock()
+	occupant, ok := c.occupants[xmppOccupantKey{jid: s.From, roomID: room.ID}]
+	c.mu.Unlock()
+	if !ok {
+		c.sendError("message", s, "not-acceptable", "Join the room before posting")
+		return
+	}
+
+	err = occupant.pipeline(&MessageContext{
+		Request: bridgeRequest(ws, "xmpp:"+strings.SplitN(s.From, "/", 2)[0]),
+		Room:    room,
+		Message: Message{
+			Username:  occupant.nick,
+			Content:   s.Body,
+			Room:      room.Name,
+			RoomID:    room.ID,
+			CreatedAt: time.Now().UTC(),
+		},
+	})
+	var rejection *MessageRejection
+	if errors.As(err, &rejection) {
+		c.sendError("message", s, "not-acceptable", rejection.Reason)
+	} else if err != nil {
+		log.Printf("Message pipeline error from XMPP %s: %v", s.From, err)
+	}
+}
+
+// handleIQ answers service discovery and pings
+func (c *xmppComponent) handleIQ(s xmppStanza) {
+	if s.Type != "get" && s.Type != "set" {
+		return
+	}
+	var query xml.Name
+	if len(s.Payload) > 0 {
+		query = s.Payload[0].XMLName
+	}
+	result := func(payload string) {
+		c.send("<iq type='result' id='%s' from='%s' to='%s'>%s</iq>", xmlEscape(s.ID), xmlEscape(s.To), xmlEscape(s.From), payload)
+	}
+
+	isDomain := strings.EqualFold(s.To, c.cfg.Domain)
+	switch {
+	case s.Type == "get" && query.Space == nsPing:
+		result("")
+	case s.Type == "get" && query.Space == nsDiscoInfo && isDomain:
+		result(fmt.Sprintf("<query xmlns='%s'><identity category='conference' type='text' name='Chat'/><feature var='%s'/><feature var='%s'/><feature var='%s'/></query>",
+			nsDiscoInfo, nsMUC, nsDiscoInfo, nsDiscoItems))
+	case s.Type == "get" && query.Space == nsDiscoInfo:
+		_, room, err := c.roomFromJID(s.To)
+		if err != nil {
+			c.sendError("iq", s, "item-not-found", "Room not found")
+			return
+		}
+		result(fmt.Sprintf("<query xmlns='%s'><identity category='conference' type='text' name='#%s'/><feature var='%s'/><feature var='muc_public'/><feature var='muc_open'/><feature var='muc_semianonymous'/></query>",
+			nsDiscoInfo, xmlEscape(room.Name), nsMUC))
+	case s.Type == "get" && query.Space == nsDiscoItems && isDomain:
+		ctx, cancel := storeContext()
+		defer cancel()
+		ws, _ := findWorkspaceBySlug(ctx, defaultWorkspaceSlug)
+		rooms, err := store.ListRooms(ctx, ws.ID)
+		if err != nil {
+			c.sendError("iq", s, "internal-server-error", err.Error())
+			return
+		}
+		var items strings.Builder
+		for _, room := range rooms {
+			fmt.Fprintf(&items, "<item jid='%s' name='#%s'/>", xmlEscape(c.roomJID(ws, room)), xmlEscape(room.Name))
+		}
+		result(fmt.Sprintf("<query xmlns='%s'>%s</query>", nsDiscoItems, items.String()))
+	default:
+		c.sendError("iq", s, "service-unavailable", "")
+	}
+}
+
+// sendError answers a stanza with an error of the given condition
+func (c *xmppComponent) sendError(kind string, s xmppStanza, condition, text string) {
+	errType := "cancel"
+	if condition == "not-acceptable" || condition == "registration-required" {
+		errType = "auth"
+	}
+	var textElem string
+	if text != "" {
+		textElem = fmt.Sprintf("<text xmlns='%s'>%s</text>", nsXMPPStanzas, xmlEscape(text))
+	}
+	c.send("<%s type='error' id='%s' from='%s' to='%s'><error type='%s'><%s xmlns='%s'/>%s</error></%s>",
+		kind, xmlEscape(s.ID), xmlEscape(s.To), xmlEscape(s.From), errType, condition, nsXMPPStanzas, textElem, kind)
+}
+
+// deliver sends a broadcast chat message to the room's XMPP occupants
+func (c *xmppComponent) deliver(msg Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, o := range c.occupants {
+		if k.roomID != msg.RoomID {
+			continue
+		}
+		c.send("<message type='groupchat' from='%s/%s' to='%s'><body>%s</body></message>",
+			xmlEscape(o.roomJID), xmlEscape(msg.Username), xmlEscape(o.jid), xmlEscape(msg.Content))
+	}
+}
+
+// Close ends the stream
+func (c *xmppComponent) Close() {
+	c.mu.Lock()
+	c.closed = true
+	conn := c.conn
+	c.mu.Unlock()
+	conn.Write([]byte("</stream:stream>"))
+	conn.Close()
+}
+
+// xmlEscape escapes s for use in XML text and attributes
+func xmlEscape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
@@ -0,0 +1,207 @@
+package chat
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// xmppTestStanza is a stanza the gateway sent, as the server sees it
+type xmppTestStanza struct {
+	XMLName xml.Name
+	From    string `xml:"from,attr"`
+	To      string `xml:"to,attr"`
+	Type    string `xml:"type,attr"`
+	Inner   string `xml:",innerxml"`
+}
+
+func (s xmppTestStanza) String() string {
+	return fmt.Sprintf("<%s type=%q from=%q to=%q>%s", s.XMLName.Local, s.Type, s.From, s.To, s.Inner)
+}
+
+// xmppTestServer is the server end of a component stream
+type xmppTestServer struct {
+	t    *testing.T
+	conn net.Conn
+	dec  *xml.Decoder
+}
+
+// startXMPPServer accepts one component connection, checking its
+// handshake against secret
+func startXMPPServer(t *testing.T, secret string) (string, <-chan *xmppTestServer) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	accepted := make(chan *xmppTestServer, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		t.Cleanup(func() { conn.Close() })
+		s := &xmppTestServer{t: t, conn: conn, dec: xml.NewDecoder(conn)}
+		if _, err := nextElement(s.dec); err != nil {
+			t.Errorf("stream header: %v", err)
+			return
+		}
+		fmt.Fprintf(conn, "<stream:stream xmlns='%s' xmlns:stream='%s' id='s1'>", nsXMPPComponent, nsXMPPStreams)
+		var handshake struct {
+			Digest string `xml:",chardata"`
+		}
+		if err := s.dec.Decode(&handshake); err != nil {
+			t.Errorf("handshake: %v", err)
+			return
+		}
+		sum := sha1.Sum([]byte("s1" + secret))
+		if handshake.Digest != hex.EncodeToString(sum[:]) {
+			fmt.Fprint(conn, "<stream:error><not-authorized xmlns='urn:ietf:params:xml:ns:xmpp-streams'/></stream:error>")
+			conn.Close()
+			return
+		}
+		fmt.Fprint(conn, "<handshake/>")
+		accepted <- s
+	}()
+	return ln.Addr().String(), accepted
+}
+
+// send writes a stanza to the gateway
+func (s *xmppTestServer) send(format string, args ...any) {
+	s.t.Helper()
+	if _, err := fmt.Fprintf(s.conn, format, args...); err != nil {
+		s.t.Fatal(err)
+	}
+}
+
+// receive reads the next n stanzas the gateway sends, sorted by
+// recipient as those sent to several occupants come in any order
+func (s *xmppTestServer) receive(n int) []xmppTestStanza {
+	s.t.Helper()
+	s.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var stanzas []xmppTestStanza
+	for range n {
+		var stanza xmppTestStanza
+		if err := s.dec.Decode(&stanza); err != nil {
+			s.t.Fatalf("after %v: %v", stanzas, err)
+		}
+		stanzas = append(stanzas, stanza)
+	}
+	slices.SortStableFunc(stanzas, func(a, b xmppTestStanza) int { return strings.Compare(a.To, b.To) })
+	return stanzas
+}
+
+// expect reads stanzas and checks each against a description: its name,
+// recipient and a part of its content
+func (s *xmppTestServer) expect(want ...[3]string) {
+	s.t.Helper()
+	got := s.receive(len(want))
+	for i, w := range want {
+		if got[i].XMLName.Local != w[0] || got[i].To != w[1] || !strings.Contains(got[i].Inner, w[2]) {
+			s.t.Errorf("stanza %d is %v, want <%s> to %s with %s", i, got[i], w[0], w[1], w[2])
+		}
+	}
+}
+
+func TestXMPPGateway(t *testing.T) {
+	ctx := context.Background()
+	useMemoryStore(t)
+	t.Cleanup(resetState)
+	setFeatureDefaults(map[string]bool{featureGuestAccess: true})
+	posted := capturePosts(t)
+
+	if err := ensureDefaultWorkspace(ctx); err != nil {
+		t.Fatal(err)
+	}
+	acme, err := store.CreateWorkspace(ctx, Workspace{Slug: "acme", Name: "Acme"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.CreateRoom(ctx, Room{WorkspaceID: acme.ID, Name: "ops"}); err != nil {
+		t.Fatal(err)
+	}
+
+	addr, _ := startXMPPServer(t, "s3cret")
+	if _, err := newXMPPGateway(XMPPConfig{ComponentAddr: addr, Domain: "chat.example.com", Secret: "wrong"}); err == nil {
+		t.Fatal("connected with the wrong secret")
+	}
+	addr, accepted := startXMPPServer(t, "s3cret")
+	c, err := newXMPPGateway(XMPPConfig{ComponentAddr: addr, Domain: "chat.example.com", Secret: "s3cret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	s := <-accepted
+
+	const (
+		alice = "alice@example.org/phone"
+		bob   = "bob@example.org/laptop"
+		room  = "general@chat.example.com"
+	)
+
+	// Joining gets the occupant's own presence, then the subject
+	s.send("<presence from='%s' to='%s/alice'><x xmlns='%s'/></presence>", alice, room, nsMUC)
+	s.expect(
+		[3]string{"presence", alice, "code='110'"},
+		[3]string{"message", alice, "<subject/>"},
+	)
+	// Others see the joiner, who first hears about them
+	s.send("<presence from='%s' to='%s/bob'/>", bob, room)
+	got := s.receive(4)
+	if got[0].To != alice || got[0].From != room+"/bob" || got[1].From != room+"/alice" || got[2].From != room+"/bob" || got[3].XMLName.Local != "message" {
+		t.Errorf("joins %v", got)
+	}
+	// Nicknames are unique in a room, and some are reserved
+	s.send("<presence from='carol@example.org/x' to='%s/ALICE'/>", room)
+	s.expect([3]string{"presence", "carol@example.org/x", "<conflict"})
+	s.send("<presence from='carol@example.org/x' to='%s/System'/>", room)
+	s.expect([3]string{"presence", "carol@example.org/x", "<conflict"})
+	// Rooms of workspaces without anonymous chat turn guests away
+	s.send("<presence from='carol@example.org/x' to='acme.ops@chat.example.com/carol'/>")
+	s.expect([3]string{"presence", "carol@example.org/x", "<registration-required"})
+
+	// Occupants post through the pipeline; others can't post at all
+	s.send("<message type='groupchat' from='%s' to='%s'><body>hello &amp; welcome</body></message>", alice, room)
+	s.send("<message type='groupchat' from='carol@example.org/x' to='%s'><body>hi</body></message>", room)
+	s.expect([3]string{"message", "carol@example.org/x", "Join the room before posting"})
+	if msgs := posted(); len(msgs) != 1 || msgs[0].Username != "alice" || msgs[0].Content != "hello & welcome" || msgs[0].Room != "general" {
+		t.Errorf("posted %+v", msgs)
+	}
+
+	// Chat messages reach every occupant of the room
+	general, err := store.FindRoom(ctx, 1, "general")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.deliver(Message{Username: "dave", Content: "<b>hi</b>", RoomID: general.ID})
+	s.expect(
+		[3]string{"message", alice, "<body>&lt;b&gt;hi&lt;/b&gt;</body>"},
+		[3]string{"message", bob, "<body>&lt;b&gt;hi&lt;/b&gt;</body>"},
+	)
+
+	// Discovery and pings
+	s.send("<iq type='get' id='1' from='%s' to='chat.example.com'><query xmlns='%s'/></iq>", alice, nsDiscoItems)
+	s.expect([3]string{"iq", alice, "jid='general@chat.example.com'"})
+	s.send("<iq type='get' id='2' from='%s' to='chat.example.com'><ping xmlns='%s'/></iq>", alice, nsPing)
+	s.expect([3]string{"iq", alice, ""})
+	s.send("<iq type='get' id='3' from='%s' to='chat.example.com'><vCard xmlns='vcard-temp'/></iq>", alice)
+	s.expect([3]string{"iq", alice, "<service-unavailable"})
+
+	// Leaving tells the occupant and the others
+	s.send("<presence type='unavailable' from='%s' to='%s/bob'/>", bob, room)
+	s.expect(
+		[3]string{"presence", alice, "role='none'"},
+		[3]string{"presence", bob, "code='110'"},
+	)
+	c.deliver(Message{Username: "dave", Content: "bye", RoomID: general.ID})
+	s.expect([3]string{"message", alice, "<body>bye</body>"})
+}